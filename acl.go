@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+)
+
+// Site roles, strongest first
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var roleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3}
+
+// siteRole returns userID's role on siteID, or "" when they are not a member
+func siteRole(userID, siteID string) string {
+	if userID == "" || siteID == "" {
+		return ""
+	}
+	var role string
+	err := db.QueryRow(`SELECT role FROM site_members WHERE site_id = ? AND user_id = ?`, siteID, userID).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("role on site %s: %v", siteID, err)
+	}
+	return role
+}
+
+// siteHasACL reports whether any members are set on siteID. Sites without
+// members fall back to per-node ownership.
+func siteHasACL(siteID string) bool {
+	if siteID == "" {
+		return false
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM site_members WHERE site_id = ?`, siteID).Scan(&n); err != nil {
+		log.Printf("members of site %s: %v", siteID, err)
+		return true // fail closed: check roles, which the lookup will deny
+	}
+	return n > 0
+}
+
+// hasSiteRole reports whether the request's user holds at least role on siteID
+func hasSiteRole(r *http.Request, siteID, role string) bool {
+	return roleRank[siteRole(currentUserID(r), siteID)] >= roleRank[role]
+}
+
+// nodeAccess loads what the access checks need to know about a node
+func nodeAccess(nodeID string) (siteID, ownerID, visibility string) {
+	var site, owner, vis sql.NullString
+	err := db.QueryRow(`SELECT n.site_id, n.owner_id, v.visibility FROM nodes n
+		LEFT JOIN node_visibility v ON v.node_id = n.id WHERE n.id = ?`, nodeID).Scan(&site, &owner, &vis)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("access to node %s: %v", nodeID, err)
+	}
+	return site.String, owner.String, vis.String
+}
+
+// canModifyNode reports whether the request may change nodeID. On sites with
+// members editors and owners may edit; elsewhere only the node's owner may, and
+// nodes without an owner (created before accounts existed) are open to any
+// signed-in user.
+func canModifyNode(r *http.Request, nodeID string) bool {
+	if !authEnabled() {
+		return true
+	}
+	u := currentUser(r)
+	if u == nil {
+		return false
+	}
+	siteID, owner, _ := nodeAccess(nodeID)
+	if siteHasACL(siteID) {
+		return roleRank[siteRole(u.ID, siteID)] >= roleRank[RoleEditor]
+	}
+	return owner == "" || owner == u.ID
+}
+
+// nodeReadFilter returns a predicate telling whether the request may read a
+// node. Members of a site read all of its nodes; others only its public ones.
+// Site membership is loaded once so listings stay cheap; call it before
+// opening the listing's rows.
+func nodeReadFilter(r *http.Request) func(siteID, visibility string) bool {
+	if !authEnabled() {
+		return func(string, string) bool { return true }
+	}
+	acl, err := siteIDs(`SELECT DISTINCT site_id FROM site_members`)
+	if err != nil {
+		log.Printf("site members: %v", err)
+		return func(_, visibility string) bool { return visibility == "public" }
+	}
+	member := map[string]bool{}
+	if uid := currentUserID(r); uid != "" {
+		if member, err = siteIDs(`SELECT site_id FROM site_members WHERE user_id = ?`, uid); err != nil {
+			log.Printf("site members: %v", err)
+			member = map[string]bool{}
+		}
+	}
+	return func(siteID, visibility string) bool {
+		return !acl[siteID] || member[siteID] || visibility == "public"
+	}
+}
+
+// siteIDs collects the site ids a query returns
+func siteIDs(query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	set := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		set[id] = true
+	}
+	return set, rows.Err()
+}
+
+// nodeReadSQL is nodeReadFilter as a condition on nodes n joined with their
+// node_visibility v, for listings that filter and page in SQL
+func nodeReadSQL(r *http.Request) (string, []interface{}) {
+	if !authEnabled() {
+		return "1 = 1", nil
+	}
+	return `(n.site_id IS NULL OR n.site_id NOT IN (SELECT site_id FROM site_members)
+		OR n.site_id IN (SELECT site_id FROM site_members WHERE user_id = ?) OR v.visibility = 'public')`, []interface{}{currentUserID(r)}
+}
+
+// canReadNode reports whether the request may read nodeID
+func canReadNode(r *http.Request, nodeID string) bool {
+	siteID, _, vis := nodeAccess(nodeID)
+	return nodeReadFilter(r)(siteID, vis)
+}
+
+// canManageSite reports whether the request may change a site's settings or
+// members: owners on sites with members, any signed-in user otherwise
+func canManageSite(r *http.Request, siteID string) bool {
+	if !authEnabled() {
+		return true
+	}
+	if siteHasACL(siteID) {
+		return hasSiteRole(r, siteID, RoleOwner)
+	}
+	return currentUser(r) != nil
+}
+
+// canCreateInSite reports whether the request may add nodes to siteID
+func canCreateInSite(r *http.Request, siteID string) bool {
+	if !authEnabled() || !siteHasACL(siteID) {
+		return true
+	}
+	return hasSiteRole(r, siteID, RoleEditor)
+}
+
+func addSiteMember(siteID, userID, role string) error {
+	_, err := db.Exec(`INSERT INTO site_members (id, site_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(site_id, user_id) DO UPDATE SET role = excluded.role`,
+		ids.New("member"), siteID, userID, role, time.Now().Unix())
+	return err
+}
+
+// siteOwnerCount counts siteID's owners other than exceptUserID
+func siteOwnerCount(siteID, exceptUserID string) int {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM site_members WHERE site_id = ? AND role = ? AND user_id != ?`, siteID, RoleOwner, exceptUserID).Scan(&n); err != nil {
+		log.Printf("owners of site %s: %v", siteID, err)
+	}
+	return n
+}
+
+// handleSiteMembers serves /api/sites/{id}/members:
+// GET lists members, POST {user_id|username, role} adds or changes one,
+// DELETE ?user_id= removes one. The first member added to a site without
+// members makes the requester its owner.
+func handleSiteMembers(w http.ResponseWriter, r *http.Request, siteID string) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		if authEnabled() && siteHasACL(siteID) && !hasSiteRole(r, siteID, RoleViewer) {
+			apierror.Write(w, http.StatusForbidden, "only site members can list members")
+			return
+		}
+		rows, err := db.Query(`SELECT m.user_id, u.username, m.role, m.created_at FROM site_members m
+			JOIN users u ON u.id = m.user_id WHERE m.site_id = ? ORDER BY u.username`, siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		defer rows.Close()
+		members := []map[string]interface{}{}
+		for rows.Next() {
+			var userID, username, role string
+			var created int64
+			if err := rows.Scan(&userID, &username, &role, &created); err != nil {
+				apierror.WriteError(w, r, err)
+				return
+			}
+			members = append(members, map[string]interface{}{"user_id": userID, "username": username, "role": role, "created_at": created})
+		}
+		if err := rows.Err(); err != nil {
+			apierror.WriteError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(members)
+	case "POST":
+		if !canManageSite(r, siteID) {
+			apierror.Write(w, http.StatusForbidden, "only site owners can manage members")
+			return
+		}
+		var req struct {
+			UserID   string `json:"user_id"`
+			Username string `json:"username"`
+			Role     string `json:"role"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if _, ok := roleRank[req.Role]; !ok {
+			apierror.Write(w, http.StatusBadRequest, "role must be owner, editor or viewer")
+			return
+		}
+		if req.UserID == "" {
+			err := db.QueryRow(`SELECT id FROM users WHERE username = ?`, req.Username).Scan(&req.UserID)
+			if err != nil && err != sql.ErrNoRows {
+				apierror.Internal(w, r, err)
+				return
+			}
+		}
+		var exists int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, req.UserID).Scan(&exists); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if exists == 0 {
+			apierror.Write(w, http.StatusNotFound, "user not found")
+			return
+		}
+		if req.Role != RoleOwner && siteRole(req.UserID, siteID) == RoleOwner && siteOwnerCount(siteID, req.UserID) == 0 {
+			apierror.Write(w, http.StatusConflict, "a site must keep at least one owner")
+			return
+		}
+		if uid := currentUserID(r); uid != "" && !siteHasACL(siteID) && uid != req.UserID {
+			addSiteMember(siteID, uid, RoleOwner)
+		}
+		if err := addSiteMember(siteID, req.UserID, req.Role); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"site_id": siteID, "user_id": req.UserID, "role": req.Role})
+	case "DELETE":
+		if !canManageSite(r, siteID) {
+			apierror.Write(w, http.StatusForbidden, "only site owners can manage members")
+			return
+		}
+		userID := r.URL.Query().Get("user_id")
+		if siteRole(userID, siteID) == RoleOwner && siteOwnerCount(siteID, userID) == 0 {
+			apierror.Write(w, http.StatusConflict, "a site must keep at least one owner")
+			return
+		}
+		db.Exec(`DELETE FROM site_members WHERE site_id = ? AND user_id = ?`, siteID, userID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// splitSitePath splits "/api/sites/{id}/{rest}" into id and rest
+func splitSitePath(path string) (string, string) {
+	p := strings.TrimPrefix(path, "/api/sites/")
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
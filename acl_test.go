@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSiteRolesEnforced(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tmp, err := ioutil.TempDir("", "acl-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(user string) string {
+		rr := do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"})
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out.Token
+	}
+	listed := func(token, nodeID string) bool {
+		var nodes []Node
+		json.NewDecoder(do("GET", "/api/nodes", token, nil).Body).Decode(&nodes)
+		for _, n := range nodes {
+			if n.ID == nodeID {
+				return true
+			}
+		}
+		return false
+	}
+
+	do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"})
+	ada := login("ada")
+	do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"})
+	bob := login("bob")
+
+	var site Site
+	json.NewDecoder(do("POST", "/api/sites", ada, map[string]string{"name": "Team"}).Body).Decode(&site)
+	var node Node
+	rr := do("POST", "/api/node-create", ada, map[string]string{"type": "note", "path": "n.md", "title": "N", "site_id": site.ID})
+	json.NewDecoder(rr.Body).Decode(&node)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("owner create: %d", rr.Code)
+	}
+
+	update := map[string]string{"id": node.ID, "type": "note", "path": "n.md", "title": "N2"}
+	if rr := do("POST", "/api/node-create", bob, map[string]string{"type": "note", "path": "x.md", "site_id": site.ID}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected non-member create to be refused, got %d", rr.Code)
+	}
+	if listed(bob, node.ID) {
+		t.Fatalf("private node listed for non-member")
+	}
+	if rr := do("GET", "/api/node/"+node.ID, bob, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for non-member read, got %d", rr.Code)
+	}
+
+	if rr := do("POST", "/api/sites/"+site.ID+"/members", bob, map[string]string{"username": "bob", "role": "owner"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected non-owner to be refused membership changes, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/sites/"+site.ID+"/members", ada, map[string]string{"username": "bob", "role": "viewer"}); rr.Code != http.StatusCreated {
+		t.Fatalf("add viewer: %d %s", rr.Code, rr.Body.String())
+	}
+	if !listed(bob, node.ID) {
+		t.Fatalf("viewer should see site nodes")
+	}
+	if rr := do("PUT", "/api/node-update", bob, update); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewer update to be refused, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/publish?node_id="+node.ID, bob, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewer publish to be refused, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/publish-job", bob, map[string]string{"node_id": node.ID, "channel_id": "ch1"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewer publish job to be refused, got %d", rr.Code)
+	}
+	db.Exec(`INSERT INTO publish_jobs (id, node_id, channel_id, status, created_at) VALUES ('job_failed', ?, 'ch1', 'failed', 1)`, node.ID)
+	if rr := do("POST", "/api/publish-job/job_failed/retry", bob, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected viewer retry to be refused, got %d", rr.Code)
+	}
+
+	do("POST", "/api/sites/"+site.ID+"/members", ada, map[string]string{"username": "bob", "role": "editor"})
+	if rr := do("PUT", "/api/node-update", bob, update); rr.Code != http.StatusOK {
+		t.Fatalf("expected editor update, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/api/publish?node_id="+node.ID, bob, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected editor publish, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/publish-job/job_failed/retry", bob, nil); rr.Code != http.StatusCreated {
+		t.Fatalf("expected editor retry, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("DELETE", "/api/sites/"+site.ID, bob, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected editor site delete to be refused, got %d", rr.Code)
+	}
+
+	var members []map[string]interface{}
+	json.NewDecoder(do("GET", "/api/sites/"+site.ID+"/members", bob, nil).Body).Decode(&members)
+	if len(members) != 2 {
+		t.Fatalf("expected 2 members, got %v", members)
+	}
+	adaID := ""
+	for _, m := range members {
+		if m["username"] == "ada" {
+			adaID = m["user_id"].(string)
+		}
+	}
+	if rr := do("DELETE", "/api/sites/"+site.ID+"/members?user_id="+adaID, ada, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("expected last owner removal to be refused, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	plugins "veil/pkg/plugins"
+	"veil/pkg/validate"
+)
+
+// === Alerts ===
+// Alerts tell whoever runs the vault that it needs attention: a publishing
+// channel keeps failing, a backup failed, the disk or the vault quota is
+// nearly full, a plugin was quarantined or panicked. Unlike notifications
+// they are about the system rather than content, and they leave the app
+// through alert_transports: email, a webhook, or a plugin such as a chat bot.
+// An alert stays open under its kind and key until its condition clears.
+// Repeats meanwhile only count; they are sent again after alertConfig.Repeat
+// or when the alert turns critical, so one broken channel can't flood anyone.
+
+// Alert kinds
+const (
+	AlertPublishFailed   = "publish_failed"
+	AlertBackupFailed    = "backup_failed"
+	AlertDiskFull        = "disk_full"
+	AlertPluginUnhealthy = "plugin_unhealthy"
+)
+
+// Alert severities; a transport gets the alerts at or above its min_severity
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var severityRank = map[string]int{SeverityWarning: 1, SeverityCritical: 2}
+
+// AlertConfig holds the alert thresholds
+type AlertConfig struct {
+	// PublishFailures publish jobs failing in a row on a channel raise an
+	// alert, critical at twice as many
+	PublishFailures int
+	// DiskFreePercent of the vault's disk left free raises an alert,
+	// critical at half of it
+	DiskFreePercent float64
+	// VaultPercent of --max-vault-mb in use raises an alert, critical once
+	// the quota is reached
+	VaultPercent float64
+	// Repeat is how long an open alert stays quiet before it is sent again
+	Repeat time.Duration
+}
+
+// alertConfig is configured by the serve flags (--alert-publish-failures,
+// --alert-disk-free-percent, --alert-vault-percent, --alert-repeat-minutes)
+var alertConfig = AlertConfig{PublishFailures: 3, DiskFreePercent: 10, VaultPercent: 90, Repeat: 6 * time.Hour}
+
+// alertCheckInterval is how often the disk and the plugins are checked
+const alertCheckInterval = 5 * time.Minute
+
+// diskSpace measures the disk; tests replace it
+var diskSpace = statDisk
+
+// alertMu keeps the open-or-count decision for a kind and key atomic
+var alertMu sync.Mutex
+
+// Alert is one raised condition
+type Alert struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Key        string `json:"key"`
+	Severity   string `json:"severity"`
+	Title      string `json:"title"`
+	Body       string `json:"body,omitempty"`
+	Count      int    `json:"count"`
+	FirstAt    int64  `json:"first_at"`
+	LastAt     int64  `json:"last_at"`
+	SentAt     int64  `json:"sent_at,omitempty"`
+	ResolvedAt int64  `json:"resolved_at,omitempty"`
+}
+
+// AlertTransport is somewhere alerts are sent. Config is {host, port, from,
+// to, username} for email, {url} for a webhook and {plugin, action, ...} for
+// a plugin; the SMTP password and webhook signing secret are the credentials
+// alert/{id}/password and alert/{id}/secret.
+type AlertTransport struct {
+	ID          string                 `json:"id"`
+	Name        string                 `json:"name" validate:"required,max=200"`
+	Type        string                 `json:"type" validate:"required,oneof=email|webhook|plugin"`
+	Config      map[string]interface{} `json:"config"`
+	Kinds       []string               `json:"kinds,omitempty"`
+	MinSeverity string                 `json:"min_severity" validate:"oneof=warning|critical"`
+	Active      bool                   `json:"active"`
+	LastStatus  string                 `json:"last_status,omitempty"`
+	LastError   string                 `json:"last_error,omitempty"`
+	LastSentAt  int64                  `json:"last_sent_at,omitempty"`
+	CreatedAt   int64                  `json:"created_at"`
+}
+
+// raiseAlert opens the alert for kind and key, or counts a repeat of the
+// open one, and sends it unless it was sent within alertConfig.Repeat and
+// hasn't turned critical since
+func raiseAlert(kind, key, severity, title, body string) {
+	alertMu.Lock()
+	now := time.Now().Unix()
+	a := Alert{Kind: kind, Key: key, Severity: severity, Title: title, Body: body, Count: 1, FirstAt: now, LastAt: now}
+	var previous string
+	err := db.QueryRow(`SELECT id, severity, count, first_at, COALESCE(sent_at, 0) FROM alerts WHERE kind = ? AND key = ? AND resolved_at IS NULL`, kind, key).
+		Scan(&a.ID, &previous, &a.Count, &a.FirstAt, &a.SentAt)
+	switch {
+	case err == sql.ErrNoRows:
+		a.ID = ids.New("alert")
+		_, err = db.Exec(`INSERT INTO alerts (id, kind, key, severity, title, body, count, first_at, last_at) VALUES (?, ?, ?, ?, ?, ?, 1, ?, ?)`,
+			a.ID, kind, key, severity, title, body, now, now)
+	case err == nil:
+		a.Count++
+		_, err = db.Exec(`UPDATE alerts SET severity = ?, title = ?, body = ?, count = ?, last_at = ? WHERE id = ?`, severity, title, body, a.Count, now, a.ID)
+	}
+	if err != nil {
+		alertMu.Unlock()
+		log.Printf("alert %s %s: %v", kind, key, err)
+		return
+	}
+	escalated := severityRank[severity] > severityRank[previous] && previous != ""
+	if a.SentAt != 0 && !escalated && now-a.SentAt < int64(alertConfig.Repeat/time.Second) {
+		alertMu.Unlock()
+		return
+	}
+	a.SentAt = now
+	db.Exec(`UPDATE alerts SET sent_at = ? WHERE id = ?`, now, a.ID)
+	alertMu.Unlock()
+
+	events.Publish(events.AlertRaised, a)
+	sendAlert(a, false)
+}
+
+// resolveAlert closes the open alert for kind and key, if any, and tells the
+// transports it was sent to that it cleared
+func resolveAlert(kind, key string) {
+	alertMu.Lock()
+	a, err := scanAlert(db.QueryRow(`SELECT `+alertColumns+` FROM alerts WHERE kind = ? AND key = ? AND resolved_at IS NULL`, kind, key).Scan)
+	if err != nil {
+		alertMu.Unlock()
+		return
+	}
+	a.ResolvedAt = time.Now().Unix()
+	db.Exec(`UPDATE alerts SET resolved_at = ? WHERE id = ?`, a.ResolvedAt, a.ID)
+	alertMu.Unlock()
+
+	events.Publish(events.AlertResolved, a)
+	if a.SentAt != 0 {
+		sendAlert(a, true)
+	}
+}
+
+const alertColumns = `id, kind, key, severity, title, COALESCE(body, ''), count, first_at, last_at, COALESCE(sent_at, 0), COALESCE(resolved_at, 0)`
+
+func scanAlert(scan func(dest ...interface{}) error) (Alert, error) {
+	var a Alert
+	err := scan(&a.ID, &a.Kind, &a.Key, &a.Severity, &a.Title, &a.Body, &a.Count, &a.FirstAt, &a.LastAt, &a.SentAt, &a.ResolvedAt)
+	return a, err
+}
+
+// sendAlert delivers a to every active transport that takes its kind and
+// severity, recording how each delivery went
+func sendAlert(a Alert, resolved bool) {
+	transports, err := alertTransports(true)
+	if err != nil {
+		log.Printf("alert %s: %v", a.ID, err)
+		return
+	}
+	for _, t := range transports {
+		if len(t.Kinds) > 0 && !slices.Contains(t.Kinds, a.Kind) || severityRank[a.Severity] < severityRank[t.MinSeverity] {
+			continue
+		}
+		deliverAlert(t, a, resolved)
+	}
+}
+
+// deliverAlert sends a through one transport and records the outcome on it
+func deliverAlert(t AlertTransport, a Alert, resolved bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	status, err := "sent", error(nil)
+	switch t.Type {
+	case "email":
+		err = sendAlertEmail(t, a, resolved)
+	case "webhook":
+		status, err = sendAlertWebhook(ctx, t, a, resolved)
+	case "plugin":
+		err = sendAlertPlugin(ctx, t, a, resolved)
+	default:
+		err = fmt.Errorf("unknown alert transport type %q", t.Type)
+	}
+	errMsg := ""
+	if err != nil {
+		status, errMsg = "error", err.Error()
+		log.Printf("alert transport %s: %v", t.ID, err)
+	}
+	db.Exec(`UPDATE alert_transports SET last_status = ?, last_error = ?, last_sent_at = ? WHERE id = ?`, status, errMsg, time.Now().Unix(), t.ID)
+	return err
+}
+
+// alertText is the subject and plain-text message for a
+func alertText(a Alert, resolved bool) (subject, text string) {
+	if resolved {
+		subject = "[veil] Resolved: " + a.Title
+	} else {
+		subject = "[veil] " + strings.ToUpper(a.Severity) + ": " + a.Title
+	}
+	var b strings.Builder
+	b.WriteString(a.Title + "\n")
+	if a.Body != "" {
+		b.WriteString("\n" + a.Body + "\n")
+	}
+	fmt.Fprintf(&b, "\nSeen %d time(s) since %s.", a.Count, time.Unix(a.FirstAt, 0).UTC().Format(time.RFC1123))
+	if resolved {
+		fmt.Fprintf(&b, " Cleared %s.", time.Unix(a.ResolvedAt, 0).UTC().Format(time.RFC1123))
+	}
+	return subject, b.String() + "\n"
+}
+
+// configString is a transport setting as a string
+func configString(config map[string]interface{}, key string) string {
+	switch v := config[key].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// configList is a transport setting given as a list or a comma separated string
+func configList(config map[string]interface{}, key string) []string {
+	var out []string
+	switch v := config[key].(type) {
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok && s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// sendAlertEmail mails a over SMTP, authenticating when a username is set
+func sendAlertEmail(t AlertTransport, a Alert, resolved bool) error {
+	host, port := configString(t.Config, "host"), configString(t.Config, "port")
+	if port == "" {
+		port = "587"
+	}
+	from, to := configString(t.Config, "from"), configList(t.Config, "to")
+	var auth smtp.Auth
+	if user := configString(t.Config, "username"); user != "" {
+		password, err := plugins.GetCredentialManager().GetCredential("alert/" + t.ID + "/password")
+		if err != nil {
+			return fmt.Errorf("no SMTP password: store one as alert/%s/password", t.ID)
+		}
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	subject, text := alertText(a, resolved)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(to, ", "), subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(host+":"+port, auth, from, to, msg.Bytes())
+}
+
+// sendAlertWebhook posts a as JSON, signed like publish hooks when the
+// transport has a secret
+func sendAlertWebhook(ctx context.Context, t AlertTransport, a Alert, resolved bool) (string, error) {
+	event := events.AlertRaised
+	if resolved {
+		event = events.AlertResolved
+	}
+	subject, text := alertText(a, resolved)
+	body, _ := json.Marshal(map[string]interface{}{"event": event, "alert": a, "subject": subject, "text": text})
+	req, err := http.NewRequestWithContext(ctx, "POST", configString(t.Config, "url"), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Veil-Event", event)
+	if secret, err := plugins.GetCredentialManager().GetCredential("alert/" + t.ID + "/secret"); err == nil {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Veil-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.Status, fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return resp.Status, nil
+}
+
+// sendAlertPlugin hands a to a plugin action ("notify" unless the transport
+// says otherwise) with the message and the rest of the transport's config,
+// such as the chat a bot posts to
+func sendAlertPlugin(ctx context.Context, t AlertTransport, a Alert, resolved bool) error {
+	subject, text := alertText(a, resolved)
+	payload := map[string]interface{}{"subject": subject, "text": text, "alert": a, "resolved": resolved}
+	for k, v := range t.Config {
+		if k != "plugin" && k != "action" {
+			payload[k] = v
+		}
+	}
+	action := configString(t.Config, "action")
+	if action == "" {
+		action = "notify"
+	}
+	_, err := plugins.GetRegistry().Execute(ctx, configString(t.Config, "plugin"), action, payload)
+	return err
+}
+
+// alertTransports lists the transports, only the active ones if asked
+func alertTransports(activeOnly bool) ([]AlertTransport, error) {
+	query := `SELECT id, name, type, config, kinds, min_severity, COALESCE(active, 0), COALESCE(last_status, ''), COALESCE(last_error, ''),
+		COALESCE(last_sent_at, 0), created_at FROM alert_transports`
+	if activeOnly {
+		query += ` WHERE active = 1`
+	}
+	rows, err := db.Query(query + ` ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []AlertTransport{}
+	for rows.Next() {
+		var t AlertTransport
+		var config, kinds string
+		if err := rows.Scan(&t.ID, &t.Name, &t.Type, &config, &kinds, &t.MinSeverity, &t.Active, &t.LastStatus, &t.LastError, &t.LastSentAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(config), &t.Config)
+		if kinds != "" {
+			t.Kinds = strings.Split(kinds, ",")
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// checkPublishChannel raises or clears a channel's publish alert from its
+// latest publish jobs
+func checkPublishChannel(channelID string) {
+	rows, err := db.Query(`SELECT status, COALESCE(error, '') FROM publish_jobs WHERE kind = ? AND channel_id = ? AND status IN ('success', 'failed')
+		ORDER BY COALESCE(completed_at, created_at) DESC, created_at DESC LIMIT ?`, plugins.JobKindPublish, channelID, 2*alertConfig.PublishFailures)
+	if err != nil {
+		return
+	}
+	failures, lastError := 0, ""
+	for rows.Next() {
+		var status, errMsg string
+		if err := rows.Scan(&status, &errMsg); err != nil {
+			rows.Close()
+			log.Printf("alert check, publish jobs of %s: %v", channelID, err)
+			return
+		}
+		if status != "failed" {
+			break
+		}
+		if failures == 0 {
+			lastError = errMsg
+		}
+		failures++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("alert check, publish jobs of %s: %v", channelID, err)
+		return
+	}
+	if alertConfig.PublishFailures <= 0 || failures < alertConfig.PublishFailures {
+		if failures == 0 {
+			resolveAlert(AlertPublishFailed, channelID)
+		}
+		return
+	}
+	var name string
+	if err := db.QueryRow(`SELECT name FROM publishing_channels WHERE id = ?`, channelID).Scan(&name); err != nil && err != sql.ErrNoRows {
+		log.Printf("alert check, channel %s: %v", channelID, err)
+	}
+	if name == "" {
+		name = channelID
+	}
+	severity := SeverityWarning
+	if failures >= 2*alertConfig.PublishFailures {
+		severity = SeverityCritical
+	}
+	raiseAlert(AlertPublishFailed, channelID, severity, "Publishing to "+name+" is failing",
+		fmt.Sprintf("The last %d publish jobs failed. Latest error: %s", failures, lastError))
+}
+
+// reportBackup raises a backup alert for target when err is set and clears
+// it once a backup to target succeeds again
+func reportBackup(target string, err error) {
+	if err == nil {
+		resolveAlert(AlertBackupFailed, target)
+		return
+	}
+	raiseAlert(AlertBackupFailed, target, SeverityCritical, "Backup to "+target+" failed", err.Error())
+}
+
+// checkDisk raises or clears the alerts for the vault's disk and quota
+func checkDisk() {
+	dir := "."
+	if dbPath != "" {
+		dir = filepath.Dir(dbPath)
+	}
+	if free, total, ok := diskSpace(dir); ok && total > 0 && alertConfig.DiskFreePercent > 0 {
+		percent := float64(free) * 100 / float64(total)
+		if percent < alertConfig.DiskFreePercent {
+			severity := SeverityWarning
+			if percent < alertConfig.DiskFreePercent/2 {
+				severity = SeverityCritical
+			}
+			raiseAlert(AlertDiskFull, "disk", severity, "The vault's disk is nearly full",
+				fmt.Sprintf("%.1f%% free (%d MB of %d MB) on the disk holding %s.", percent, free>>20, total>>20, dir))
+		} else {
+			resolveAlert(AlertDiskFull, "disk")
+		}
+	}
+	if limits.MaxVaultBytes > 0 && alertConfig.VaultPercent > 0 {
+		used := vaultUsage()
+		percent := float64(used) * 100 / float64(limits.MaxVaultBytes)
+		if percent >= alertConfig.VaultPercent {
+			severity := SeverityWarning
+			if used >= limits.MaxVaultBytes {
+				severity = SeverityCritical
+			}
+			raiseAlert(AlertDiskFull, "vault", severity, "The vault is nearly at its size limit",
+				fmt.Sprintf("%d MB of the %d MB allowed by --max-vault-mb are in use (%.0f%%).", used>>20, limits.MaxVaultBytes>>20, percent))
+		} else {
+			resolveAlert(AlertDiskFull, "vault")
+		}
+	}
+}
+
+// checkPlugins raises an alert for each quarantined plugin, clearing it once
+// the plugin is out of quarantine, and one for each plugin that panicked
+// since the last check. Panics stay open until resolved by hand.
+func checkPlugins(seenPanics map[string]int) {
+	quarantined := map[string]bool{}
+	for _, q := range plugins.ListQuarantined() {
+		quarantined["quarantine:"+q.Slug] = true
+		raiseAlert(AlertPluginUnhealthy, "quarantine:"+q.Slug, SeverityWarning, "Plugin "+q.Name+" is quarantined", q.Error)
+	}
+	rows, err := db.Query(`SELECT key FROM alerts WHERE kind = ? AND key LIKE 'quarantine:%' AND resolved_at IS NULL`, AlertPluginUnhealthy)
+	if err == nil {
+		var cleared []string
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				log.Printf("alert check, quarantined plugins: %v", err)
+				continue
+			}
+			if !quarantined[key] {
+				cleared = append(cleared, key)
+			}
+		}
+		rows.Close()
+		for _, key := range cleared {
+			resolveAlert(AlertPluginUnhealthy, key)
+		}
+	}
+	for name, n := range plugins.GetRegistry().Panics() {
+		if n > seenPanics[name] {
+			raiseAlert(AlertPluginUnhealthy, "panic:"+name, SeverityWarning, "Plugin "+name+" panicked",
+				fmt.Sprintf("%d panics since the server started.", n))
+		}
+		seenPanics[name] = n
+	}
+}
+
+// watchAlerts raises alerts from publish jobs as they finish and checks the
+// disk and the plugins every interval, until the returned stop is called
+func watchAlerts(interval time.Duration) (stop func()) {
+	sub := events.Subscribe(notificationBuffer, events.JobProgress)
+	done := make(chan struct{})
+	go func() {
+		for ev := range sub.C {
+			data, _ := ev.Data.(map[string]interface{})
+			kind, _ := data["kind"].(string)
+			status, _ := data["status"].(string)
+			channelID, _ := data["channel_id"].(string)
+			if kind == plugins.JobKindPublish && channelID != "" && (status == "failed" || status == "success") {
+				checkPublishChannel(channelID)
+			}
+		}
+	}()
+	go func() {
+		seenPanics := map[string]int{}
+		check := func() {
+			checkDisk()
+			checkPlugins(seenPanics)
+		}
+		check()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				check()
+			}
+		}
+	}()
+	return func() {
+		sub.Close()
+		close(done)
+	}
+}
+
+// GET /api/alerts[?state=open|resolved|all][&limit=N]
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can see alerts")
+		return
+	}
+	where := `resolved_at IS NULL`
+	switch r.URL.Query().Get("state") {
+	case "", "open":
+	case "resolved":
+		where = `resolved_at IS NOT NULL`
+	case "all":
+		where = `1 = 1`
+	default:
+		apierror.Write(w, http.StatusBadRequest, "state must be open, resolved or all")
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	rows, err := db.Query(`SELECT `+alertColumns+` FROM alerts WHERE `+where+` ORDER BY last_at DESC, id DESC LIMIT ?`, limit)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+	list := []Alert{}
+	for rows.Next() {
+		if a, err := scanAlert(rows.Scan); err == nil {
+			list = append(list, a)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// POST /api/alerts/resolve?id= closes an alert by hand, such as a plugin
+// panic that won't clear itself
+func handleAlertResolve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can resolve alerts")
+		return
+	}
+	var kind, key string
+	if err := db.QueryRow(`SELECT kind, key FROM alerts WHERE id = ? AND resolved_at IS NULL`, r.URL.Query().Get("id")).Scan(&kind, &key); err != nil {
+		apierror.Write(w, http.StatusNotFound, "no open alert with that id")
+		return
+	}
+	resolveAlert(kind, key)
+	a, _ := scanAlert(db.QueryRow(`SELECT `+alertColumns+` FROM alerts WHERE id = ?`, r.URL.Query().Get("id")).Scan)
+	json.NewEncoder(w).Encode(a)
+}
+
+// /api/alert-transports: GET lists them, POST adds one, DELETE ?id= removes
+// one. Admins only.
+func handleAlertTransports(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can manage alert transports")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		list, err := alertTransports(false)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		t := AlertTransport{Active: true, MinSeverity: SeverityWarning}
+		if err := validate.DecodeJSON(r.Body, &t); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		var problems validate.Errors
+		switch t.Type {
+		case "email":
+			if configString(t.Config, "host") == "" {
+				problems.Add("config.host", "is required")
+			}
+			if !strings.Contains(configString(t.Config, "from"), "@") {
+				problems.Add("config.from", "must be an email address")
+			}
+			if len(configList(t.Config, "to")) == 0 {
+				problems.Add("config.to", "is required")
+			}
+		case "webhook":
+			if !isHTTPURL(configString(t.Config, "url")) {
+				problems.Add("config.url", "must be an http(s) URL")
+			}
+		case "plugin":
+			if configString(t.Config, "plugin") == "" {
+				problems.Add("config.plugin", "is required")
+			}
+		}
+		for _, k := range t.Kinds {
+			if k != AlertPublishFailed && k != AlertBackupFailed && k != AlertDiskFull && k != AlertPluginUnhealthy {
+				problems.Add("kinds", "unknown alert kind "+k)
+			}
+		}
+		if err := problems.Err(); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if t.Config == nil {
+			t.Config = map[string]interface{}{}
+		}
+		config, _ := json.Marshal(t.Config)
+		t.ID, t.CreatedAt = ids.New("atr"), time.Now().Unix()
+		if _, err := db.Exec(`INSERT INTO alert_transports (id, name, type, config, kinds, min_severity, active, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			t.ID, t.Name, t.Type, string(config), strings.Join(t.Kinds, ","), t.MinSeverity, t.Active, t.CreatedAt); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case "DELETE":
+		res, err := db.Exec(`DELETE FROM alert_transports WHERE id = ?`, r.URL.Query().Get("id"))
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, http.StatusNotFound, "alert transport not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /api/alert-transports/test?id= sends a test alert through one
+// transport, whatever its kinds and severity, and reports how it went
+func handleAlertTransportTest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can manage alert transports")
+		return
+	}
+	list, _ := alertTransports(false)
+	i := slices.IndexFunc(list, func(t AlertTransport) bool { return t.ID == r.URL.Query().Get("id") })
+	if i < 0 {
+		apierror.Write(w, http.StatusNotFound, "alert transport not found")
+		return
+	}
+	now := time.Now().Unix()
+	test := Alert{ID: "test", Kind: "test", Key: "test", Severity: SeverityWarning, Title: "Test alert from veil",
+		Body: "If you can read this, alerts sent through " + list[i].Name + " arrive.", Count: 1, FirstAt: now, LastAt: now, SentAt: now}
+	if err := deliverAlert(list[i], test, false); err != nil {
+		apierror.Write(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	plugins "veil/pkg/plugins"
+)
+
+// chatTestPlugin records what it is asked to post
+type chatTestPlugin struct {
+	mu   *sync.Mutex
+	sent *[]map[string]interface{}
+}
+
+func (chatTestPlugin) Name() string                                   { return "chat-test" }
+func (chatTestPlugin) Version() string                                { return "1.0.0" }
+func (chatTestPlugin) Initialize(config map[string]interface{}) error { return nil }
+func (chatTestPlugin) Validate() error                                { return nil }
+func (chatTestPlugin) Shutdown() error                                { return nil }
+func (p chatTestPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	if action != "post" {
+		return nil, errors.New("unknown action " + action)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	*p.sent = append(*p.sent, payload.(map[string]interface{}))
+	return nil, nil
+}
+
+// fakeSMTP accepts mail on a local port and hands each message to got
+func fakeSMTP(t *testing.T, got chan<- string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, "220 fake ESMTP\r\n")
+				var data strings.Builder
+				for inData := false; ; {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch {
+					case inData && line == ".\r\n":
+						inData = false
+						got <- data.String()
+						io.WriteString(conn, "250 queued\r\n")
+					case inData:
+						data.WriteString(line)
+					case strings.HasPrefix(line, "DATA"):
+						inData = true
+						io.WriteString(conn, "354 go ahead\r\n")
+					case strings.HasPrefix(line, "QUIT"):
+						io.WriteString(conn, "221 bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestAlerts(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	defer func(c AlertConfig) { alertConfig = c }(alertConfig)
+	defer func() { diskSpace = statDisk }()
+	alertConfig = AlertConfig{PublishFailures: 2, DiskFreePercent: 10, Repeat: time.Hour}
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	addTransport := func(body map[string]interface{}) AlertTransport {
+		rr := do("POST", "/api/alert-transports", body)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("adding %v: %d %s", body, rr.Code, rr.Body.String())
+		}
+		var tr AlertTransport
+		json.NewDecoder(rr.Body).Decode(&tr)
+		return tr
+	}
+	openAlerts := func() []Alert {
+		var out []Alert
+		json.NewDecoder(do("GET", "/api/alerts", nil).Body).Decode(&out)
+		return out
+	}
+
+	var mu sync.Mutex
+	var hooks []map[string]interface{}
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		hooks = append(hooks, body)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	var chats []map[string]interface{}
+	plugins.GetRegistry().Register(chatTestPlugin{mu: &mu, sent: &chats})
+	defer plugins.GetRegistry().Unregister("chat-test")
+	mail := make(chan string, 4)
+	smtpHost, smtpPort, _ := net.SplitHostPort(fakeSMTP(t, mail))
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(hooks), len(chats)
+	}
+
+	if rr := do("POST", "/api/alert-transports", map[string]interface{}{"name": "x", "type": "webhook", "config": map[string]string{"url": "ftp://x"}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a webhook needs an http URL: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/alert-transports", map[string]interface{}{"name": "x", "type": "pager"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown transport types should be refused: %d", rr.Code)
+	}
+	webhook := addTransport(map[string]interface{}{"name": "ops hook", "type": "webhook", "config": map[string]string{"url": hook.URL}})
+	addTransport(map[string]interface{}{"name": "ops chat", "type": "plugin", "min_severity": "critical", "kinds": []string{AlertDiskFull},
+		"config": map[string]string{"plugin": "chat-test", "action": "post", "room": "#ops"}})
+	addTransport(map[string]interface{}{"name": "ops mail", "type": "email", "kinds": []string{AlertBackupFailed},
+		"config": map[string]interface{}{"host": smtpHost, "port": smtpPort, "from": "veil@example.com", "to": "ops@example.com, oncall@example.com"}})
+
+	// a channel failing repeatedly is one alert, sent once until it turns critical
+	testDB.Exec(`INSERT INTO publishing_channels (id, name, type, config, active, created_at) VALUES ('ch1', 'Netlify', 'static', '{}', 1, 1)`)
+	publish := func(id, status string, at int) {
+		testDB.Exec(`INSERT INTO publish_jobs (id, kind, node_id, channel_id, status, error, created_at, completed_at) VALUES (?, ?, 'n1', 'ch1', ?, 'deploy refused', ?, ?)`,
+			id, plugins.JobKindPublish, status, at, at)
+		checkPublishChannel("ch1")
+	}
+	publish("j1", "failed", 1)
+	if len(openAlerts()) != 0 {
+		t.Fatal("one failure is below the threshold")
+	}
+	publish("j2", "failed", 2)
+	publish("j3", "failed", 3)
+	got := openAlerts()
+	if len(got) != 1 || got[0].Kind != AlertPublishFailed || got[0].Count != 2 || got[0].Severity != SeverityWarning || !strings.Contains(got[0].Body, "deploy refused") {
+		t.Fatalf("expected one warning for the channel: %+v", got)
+	}
+	if h, c := counts(); h != 1 || c != 0 {
+		t.Fatalf("the repeat should not be sent again, and chat only takes critical disk alerts: %d hooks, %d chats", h, c)
+	}
+	publish("j4", "failed", 4)
+	if h, _ := counts(); h != 2 || openAlerts()[0].Severity != SeverityCritical {
+		t.Fatalf("turning critical should send again: %d hooks", h)
+	}
+	publish("j5", "success", 5)
+	if len(openAlerts()) != 0 {
+		t.Fatal("a successful publish should clear the alert")
+	}
+	mu.Lock()
+	last := hooks[len(hooks)-1]
+	mu.Unlock()
+	if last["event"] != "alert.resolved" || !strings.Contains(last["subject"].(string), "Resolved: Publishing to Netlify is failing") {
+		t.Fatalf("unexpected resolution: %v", last)
+	}
+
+	// disk space: warnings go to the hook, critical ones to the chat as well
+	diskSpace = func(string) (uint64, uint64, bool) { return 8 << 30, 100 << 30, true }
+	checkDisk()
+	if h, c := counts(); h != 4 || c != 0 {
+		t.Fatalf("a disk warning should reach the hook only: %d hooks, %d chats", h, c)
+	}
+	diskSpace = func(string) (uint64, uint64, bool) { return 3 << 30, 100 << 30, true }
+	checkDisk()
+	mu.Lock()
+	if len(chats) != 1 || chats[0]["room"] != "#ops" || !strings.Contains(chats[0]["text"].(string), "3.0% free") {
+		t.Fatalf("a critical disk alert should be posted to the chat: %v", chats)
+	}
+	mu.Unlock()
+	diskSpace = func(string) (uint64, uint64, bool) { return 50 << 30, 100 << 30, true }
+	checkDisk()
+	if len(openAlerts()) != 0 {
+		t.Fatal("freed space should clear the alert")
+	}
+
+	// backups alert by mail
+	reportBackup("s3://backups", errors.New("access denied"))
+	select {
+	case msg := <-mail:
+		if !strings.Contains(msg, "Subject: [veil] CRITICAL: Backup to s3://backups failed") || !strings.Contains(msg, "access denied") || !strings.Contains(msg, "To: ops@example.com, oncall@example.com") {
+			t.Fatalf("unexpected mail:\n%s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the backup alert should be mailed")
+	}
+
+	// panicking plugins stay open until resolved by hand
+	testDB.Exec(`INSERT INTO alerts (id, kind, key, severity, title, count, first_at, last_at) VALUES ('a1', ?, 'panic:x', 'warning', 'Plugin x panicked', 1, 1, 1)`, AlertPluginUnhealthy)
+	if rr := do("POST", "/api/alerts/resolve?id=a1", nil); rr.Code != http.StatusOK {
+		t.Fatalf("resolve: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/alerts/resolve?id=a1", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("a resolved alert can't be resolved again: %d", rr.Code)
+	}
+	var resolved []Alert
+	json.NewDecoder(do("GET", "/api/alerts?state=resolved", nil).Body).Decode(&resolved)
+	if len(resolved) != 3 {
+		t.Fatalf("expected the publish, disk and panic alerts resolved: %+v", resolved)
+	}
+
+	if rr := do("POST", "/api/alert-transports/test?id="+webhook.ID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("test alert: %d %s", rr.Code, rr.Body.String())
+	}
+	hook.Close()
+	if rr := do("POST", "/api/alert-transports/test?id="+webhook.ID, nil); rr.Code != http.StatusBadGateway {
+		t.Fatalf("a failed test should say so: %d", rr.Code)
+	}
+	var list []AlertTransport
+	json.NewDecoder(do("GET", "/api/alert-transports", nil).Body).Decode(&list)
+	if len(list) != 3 || list[0].LastStatus != "error" || list[0].LastError == "" {
+		t.Fatalf("transports should record their last delivery: %+v", list)
+	}
+	if rr := do("DELETE", "/api/alert-transports?id="+webhook.ID, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rr.Code)
+	}
+}
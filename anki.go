@@ -0,0 +1,487 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Anki Export ===
+// Nodes tagged "flashcard" (or "flashcards", or of type flashcard) become
+// Anki notes. A node holds either several cards, one per line as
+// "front :: back" or as "Q: ..." / "A: ..." pairs, or a single card whose
+// front is the title and back the content. Fields are markdown rendered to
+// HTML and the node's tags carry over. Images under /media/ are bundled into
+// .apkg decks. Re-importing a deck updates the same notes, since each note's
+// guid comes from its node and position.
+
+// Flashcard is one Anki note
+type Flashcard struct {
+	NodeID string   `json:"node_id"`
+	Front  string   `json:"front"`
+	Back   string   `json:"back"`
+	Tags   []string `json:"tags"`
+	// GUID identifies the note across exports
+	GUID string `json:"guid"`
+}
+
+// AnkiExport selects the cards for a deck
+type AnkiExport struct {
+	SiteID string
+	Tag    string // defaults to flashcard
+	Deck   string
+}
+
+var (
+	ankiPairLine = regexp.MustCompile(`^\s*(.+?)\s+::\s+(.+?)\s*$`)
+	ankiQuestion = regexp.MustCompile(`(?i)^\s*Q:\s*(.*)$`)
+	ankiAnswer   = regexp.MustCompile(`(?i)^\s*A:\s*(.*)$`)
+	ankiImage    = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)\)`)
+	ankiMediaRef = regexp.MustCompile(`(src|href)="/media/([^"?#]+)"`)
+	ankiTagStrip = regexp.MustCompile(`<[^>]*>`)
+)
+
+// ankiModelID is fixed so every export shares one note type in Anki
+const ankiModelID = 1718200000000
+
+// parseFlashcards splits a node into cards
+func parseFlashcards(node Node) []Flashcard {
+	var cards []Flashcard
+	add := func(front, back string) {
+		front, back = strings.TrimSpace(front), strings.TrimSpace(back)
+		if front == "" || back == "" {
+			return
+		}
+		cards = append(cards, Flashcard{NodeID: node.ID, Front: front, Back: back})
+	}
+
+	var q, a []string
+	inAnswer := false
+	flush := func() {
+		if len(q) > 0 {
+			add(strings.Join(q, "\n"), strings.Join(a, "\n"))
+		}
+		q, a, inAnswer = nil, nil, false
+	}
+	for _, line := range strings.Split(node.Content, "\n") {
+		if m := ankiQuestion.FindStringSubmatch(line); m != nil {
+			flush()
+			q = []string{m[1]}
+			continue
+		}
+		if m := ankiAnswer.FindStringSubmatch(line); m != nil && len(q) > 0 {
+			inAnswer = true
+			a = append(a, m[1])
+			continue
+		}
+		if len(q) > 0 {
+			if inAnswer {
+				a = append(a, line)
+			} else {
+				q = append(q, line)
+			}
+			continue
+		}
+		if m := ankiPairLine.FindStringSubmatch(line); m != nil {
+			add(m[1], m[2])
+		}
+	}
+	flush()
+
+	if len(cards) == 0 {
+		add(node.Title, node.Content)
+	}
+	for i := range cards {
+		sum := sha1.Sum([]byte(fmt.Sprintf("veil:%s:%d", node.ID, i)))
+		cards[i].GUID = base64.RawStdEncoding.EncodeToString(sum[:])[:10]
+	}
+	return cards
+}
+
+// collectFlashcards loads the cards for opts from the nodes canRead allows
+func collectFlashcards(opts AnkiExport, canRead func(siteID, visibility string) bool) ([]Flashcard, error) {
+	tag := opts.Tag
+	if tag == "" {
+		tag = "flashcard"
+	}
+	query := `SELECT n.id, n.title, COALESCE(n.content, ''), COALESCE(n.site_id, ''), COALESCE(v.visibility, '')
+		FROM nodes n LEFT JOIN node_visibility v ON v.node_id = n.id
+		WHERE n.deleted_at IS NULL AND (n.type = 'flashcard' OR n.id IN (
+			SELECT nt.node_id FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE t.name = ? OR t.name = ?))`
+	args := []interface{}{tag, tag + "s"}
+	if opts.SiteID != "" {
+		query += ` AND n.site_id = ?`
+		args = append(args, opts.SiteID)
+	}
+	rows, err := db.Query(query+` ORDER BY n.created_at, n.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for rows.Next() {
+		var n Node
+		var vis string
+		if err := rows.Scan(&n.ID, &n.Title, &n.Content, &n.SiteID, &vis); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if canRead(n.SiteID, vis) {
+			nodes = append(nodes, n)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var cards []Flashcard
+	for _, n := range nodes {
+		var tags []string
+		trows, err := db.Query(`SELECT t.name FROM tags t JOIN node_tags nt ON nt.tag_id = t.id WHERE nt.node_id = ? ORDER BY t.name`, n.ID)
+		if err != nil {
+			return nil, err
+		}
+		for trows.Next() {
+			var name string
+			if err := trows.Scan(&name); err != nil {
+				trows.Close()
+				return nil, err
+			}
+			// Anki tags are space separated
+			tags = append(tags, strings.ReplaceAll(name, " ", "_"))
+		}
+		trows.Close()
+		if err := trows.Err(); err != nil {
+			return nil, err
+		}
+		for _, c := range parseFlashcards(n) {
+			c.Tags = tags
+			c.Front = ankiField(c.Front)
+			c.Back = ankiField(c.Back)
+			cards = append(cards, c)
+		}
+	}
+	return cards, nil
+}
+
+// ankiField renders a card side to HTML. Images are set aside first so the
+// markdown emphasis rules leave underscores in their file names alone.
+func ankiField(md string) string {
+	var images []string
+	md = ankiImage.ReplaceAllStringFunc(md, func(m string) string {
+		sub := ankiImage.FindStringSubmatch(m)
+		images = append(images, fmt.Sprintf(`<img src="%s" alt="%s">`, html.EscapeString(sub[2]), html.EscapeString(sub[1])))
+		return fmt.Sprintf("\x00%d\x00", len(images)-1)
+	})
+	out := strings.TrimSpace(markdownToHTML(md))
+	for i, img := range images {
+		out = strings.Replace(out, fmt.Sprintf("\x00%d\x00", i), img, 1)
+	}
+	return out
+}
+
+// ankiMedia rewrites /media/ links in a field to bare file names, as Anki
+// expects, and records the files used
+func ankiMedia(field string, files map[string]string) string {
+	return ankiMediaRef.ReplaceAllStringFunc(field, func(m string) string {
+		sub := ankiMediaRef.FindStringSubmatch(m)
+		name := path.Base(sub[2])
+		if _, err := os.Stat(filepath.Join("media", name)); err != nil {
+			return m
+		}
+		files[name] = filepath.Join("media", name)
+		return sub[1] + `="` + name + `"`
+	})
+}
+
+// WriteAnkiCSV writes cards as an Anki text import: front, back and tags
+// separated by tabs, with HTML fields
+func WriteAnkiCSV(w io.Writer, deck string, cards []Flashcard) error {
+	fmt.Fprintf(w, "#separator:tab\n#html:true\n#guid column:1\n#tags column:4\n")
+	if deck != "" {
+		fmt.Fprintf(w, "#deck:%s\n", deck)
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t'
+	for _, c := range cards {
+		if err := cw.Write([]string{c.GUID, c.Front, c.Back, strings.Join(c.Tags, " ")}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteAnkiPackage writes cards as an .apkg: a zip holding an Anki
+// collection database, a media index and the media files
+func WriteAnkiPackage(w io.Writer, deck string, cards []Flashcard) error {
+	if deck == "" {
+		deck = "Veil"
+	}
+	files := map[string]string{}
+	for i := range cards {
+		cards[i].Front = ankiMedia(cards[i].Front, files)
+		cards[i].Back = ankiMedia(cards[i].Back, files)
+	}
+
+	tmp, err := os.CreateTemp("", "veil-anki-*.anki2")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := buildAnkiCollection(tmp.Name(), deck, cards); err != nil {
+		return err
+	}
+	collection, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	f, _ := zw.Create("collection.anki2")
+	f.Write(collection)
+	index := map[string]string{}
+	n := 0
+	for name, src := range files {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			continue
+		}
+		key := strconv.Itoa(n)
+		n++
+		index[key] = name
+		f, _ := zw.Create(key)
+		f.Write(data)
+	}
+	f, _ = zw.Create("media")
+	json.NewEncoder(f).Encode(index)
+	return zw.Close()
+}
+
+// ankiSchema is the Anki 2.1 legacy (schema 11) collection layout, which
+// every Anki version imports
+const ankiSchema = `
+CREATE TABLE col (id integer primary key, crt integer not null, mod integer not null, scm integer not null,
+	ver integer not null, dty integer not null, usn integer not null, ls integer not null, conf text not null,
+	models text not null, decks text not null, dconf text not null, tags text not null);
+CREATE TABLE notes (id integer primary key, guid text not null, mid integer not null, mod integer not null,
+	usn integer not null, tags text not null, flds text not null, sfld integer not null, csum integer not null,
+	flags integer not null, data text not null);
+CREATE TABLE cards (id integer primary key, nid integer not null, did integer not null, ord integer not null,
+	mod integer not null, usn integer not null, type integer not null, queue integer not null, due integer not null,
+	ivl integer not null, factor integer not null, reps integer not null, lapses integer not null, left integer not null,
+	odue integer not null, odid integer not null, flags integer not null, data text not null);
+CREATE TABLE revlog (id integer primary key, cid integer not null, usn integer not null, ease integer not null,
+	ivl integer not null, lastIvl integer not null, factor integer not null, time integer not null, type integer not null);
+CREATE TABLE graves (usn integer not null, oid integer not null, type integer not null);
+CREATE INDEX ix_notes_usn on notes (usn);
+CREATE INDEX ix_cards_usn on cards (usn);
+CREATE INDEX ix_revlog_usn on revlog (usn);
+CREATE INDEX ix_cards_nid on cards (nid);
+CREATE INDEX ix_cards_sched on cards (did, queue, due);
+CREATE INDEX ix_revlog_cid on revlog (cid);
+CREATE INDEX ix_notes_csum on notes (csum);`
+
+func buildAnkiCollection(file, deck string, cards []Flashcard) error {
+	adb, err := sql.Open("sqlite", file)
+	if err != nil {
+		return err
+	}
+	defer adb.Close()
+	for _, stmt := range strings.Split(ankiSchema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := adb.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	h := fnv.New32a()
+	h.Write([]byte(deck))
+	deckID := int64(1<<30) + int64(h.Sum32()>>2)
+	decks := map[string]interface{}{
+		"1":                           ankiDeck(1, "Default", now),
+		strconv.FormatInt(deckID, 10): ankiDeck(deckID, deck, now),
+	}
+	models := map[string]interface{}{strconv.FormatInt(ankiModelID, 10): map[string]interface{}{
+		"id": ankiModelID, "name": "Veil Basic", "type": 0, "mod": now.Unix(), "usn": -1, "sortf": 0, "did": deckID,
+		"tmpls": []map[string]interface{}{{
+			"name": "Card 1", "ord": 0, "qfmt": "{{Front}}", "afmt": "{{FrontSide}}<hr id=answer>{{Back}}",
+			"did": nil, "bqfmt": "", "bafmt": "",
+		}},
+		"flds": []map[string]interface{}{
+			{"name": "Front", "ord": 0, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{}},
+			{"name": "Back", "ord": 1, "sticky": false, "rtl": false, "font": "Arial", "size": 20, "media": []string{}},
+		},
+		"css":       ".card { font-family: arial; font-size: 20px; text-align: left; color: black; background-color: white; }",
+		"latexPre":  "\\documentclass[12pt]{article}\n\\special{papersize=3in,5in}\n\\usepackage{amssymb,amsmath}\n\\pagestyle{empty}\n\\begin{document}\n",
+		"latexPost": "\\end{document}", "req": []interface{}{[]interface{}{0, "any", []int{0}}}, "tags": []string{}, "vers": []int{},
+	}}
+	dconf := map[string]interface{}{"1": map[string]interface{}{
+		"id": 1, "name": "Default", "replayq": true, "maxTaken": 60, "timer": 0, "autoplay": true, "mod": 0, "usn": 0, "dyn": false,
+		"new":   map[string]interface{}{"delays": []int{1, 10}, "ints": []int{1, 4, 7}, "initialFactor": 2500, "separate": true, "order": 1, "perDay": 20, "bury": false},
+		"rev":   map[string]interface{}{"perDay": 200, "ease4": 1.3, "fuzz": 0.05, "minSpace": 1, "ivlFct": 1, "maxIvl": 36500, "bury": false},
+		"lapse": map[string]interface{}{"delays": []int{10}, "mult": 0, "minInt": 1, "leechFails": 8, "leechAction": 0},
+	}}
+	conf := map[string]interface{}{
+		"activeDecks": []int64{deckID}, "curDeck": deckID, "newSpread": 0, "collapseTime": 1200, "timeLim": 0,
+		"estTimes": true, "dueCounts": true, "curModel": strconv.FormatInt(ankiModelID, 10), "nextPos": len(cards) + 1,
+		"sortType": "noteFld", "sortBackwards": false, "addToCur": true,
+	}
+	js := func(v interface{}) string { b, _ := json.Marshal(v); return string(b) }
+	if _, err := adb.Exec(`INSERT INTO col VALUES (1, ?, ?, ?, 11, 0, 0, 0, ?, ?, ?, ?, '{}')`,
+		now.Unix(), now.UnixMilli(), now.UnixMilli(), js(conf), js(models), js(decks), js(dconf)); err != nil {
+		return err
+	}
+
+	base := now.UnixMilli()
+	for i, c := range cards {
+		id := base + int64(i)
+		tags := ""
+		if len(c.Tags) > 0 {
+			tags = " " + strings.Join(c.Tags, " ") + " "
+		}
+		sort := ankiPlain(c.Front)
+		sum := sha1.Sum([]byte(sort))
+		if _, err := adb.Exec(`INSERT INTO notes VALUES (?, ?, ?, ?, -1, ?, ?, ?, ?, 0, '')`,
+			id, c.GUID, ankiModelID, now.Unix(), tags, c.Front+"\x1f"+c.Back, sort, int64(binary.BigEndian.Uint32(sum[:4]))); err != nil {
+			return err
+		}
+		if _, err := adb.Exec(`INSERT INTO cards VALUES (?, ?, ?, 0, ?, -1, 0, 0, ?, 0, 0, 0, 0, 0, 0, 0, 0, '')`,
+			id, id, deckID, now.Unix(), i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ankiDeck(id int64, name string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id": id, "name": name, "desc": "", "mod": now.Unix(), "usn": -1, "collapsed": false, "browserCollapsed": false,
+		"newToday": []int{0, 0}, "revToday": []int{0, 0}, "lrnToday": []int{0, 0}, "timeToday": []int{0, 0},
+		"dyn": 0, "extendNew": 10, "extendRev": 50, "conf": 1,
+	}
+}
+
+// ankiPlain is a field's text without markup, for sorting and checksums
+func ankiPlain(field string) string {
+	return strings.TrimSpace(ankiTagStrip.ReplaceAllString(field, ""))
+}
+
+// GET /api/export/anki?site_id=&tag=flashcard&deck=&format=apkg|csv
+func handleAnkiExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := AnkiExport{SiteID: q.Get("site_id"), Tag: q.Get("tag"), Deck: q.Get("deck")}
+	cards, err := collectFlashcards(opts, nodeReadFilter(r))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		apierror.Internal(w, r, err)
+		return
+	}
+	if opts.Deck == "" {
+		opts.Deck = "Veil"
+	}
+	name := slugify(opts.Deck)
+	if name == "" {
+		name = "veil"
+	}
+
+	switch q.Get("format") {
+	case "", "apkg":
+		var buf bytes.Buffer
+		if err := WriteAnkiPackage(&buf, opts.Deck, cards); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.apkg", name))
+		w.Write(buf.Bytes())
+	case "csv":
+		w.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.txt", name))
+		WriteAnkiCSV(w, opts.Deck, cards)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		apierror.Write(w, http.StatusBadRequest, "format must be apkg or csv")
+	}
+}
+
+// exportAnki is `veil export anki [--site <id>] [--tag <tag>] [--deck <name>]
+// [--format apkg|csv] [--out <file>]`, run in the vault directory
+func exportAnki(args []string) {
+	opts := AnkiExport{}
+	format, outPath := "apkg", ""
+	for i := 0; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "--site":
+			opts.SiteID = args[i+1]
+		case "--tag":
+			opts.Tag = args[i+1]
+		case "--deck":
+			opts.Deck = args[i+1]
+		case "--format":
+			format = args[i+1]
+		case "--out":
+			outPath = args[i+1]
+		}
+	}
+	if format != "apkg" && format != "csv" {
+		fmt.Fprintf(os.Stderr, "unsupported export format: %s\n", format)
+		return
+	}
+	if outPath == "" {
+		outPath = "veil." + format
+		if format == "csv" {
+			outPath = "veil.txt"
+		}
+	}
+	if err := openVault("."); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open vault: %v\n", err)
+		return
+	}
+	defer db.Close()
+	cards, err := collectFlashcards(opts, func(string, string) bool { return true })
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+		return
+	}
+	f, err := os.Create(outPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create output file: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if format == "csv" {
+		err = WriteAnkiCSV(f, opts.Deck, cards)
+	} else {
+		err = WriteAnkiPackage(f, opts.Deck, cards)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d cards -> %s\n", len(cards), outPath)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFlashcards(t *testing.T) {
+	pairs := parseFlashcards(Node{ID: "n1", Title: "Capitals", Content: "France :: Paris\nJapan :: Tokyo\nnot a card"})
+	if len(pairs) != 2 || pairs[1].Front != "Japan" || pairs[1].Back != "Tokyo" {
+		t.Fatalf("unexpected pair cards: %+v", pairs)
+	}
+	qa := parseFlashcards(Node{ID: "n2", Content: "Q: What is 2+2?\nA: 4\n\nQ: Largest planet?\nA: Jupiter\nby mass"})
+	if len(qa) != 2 || qa[0].Back != "4" || qa[1].Back != "Jupiter\nby mass" {
+		t.Fatalf("unexpected Q/A cards: %+v", qa)
+	}
+	whole := parseFlashcards(Node{ID: "n3", Title: "Mitosis", Content: "Cell division."})
+	if len(whole) != 1 || whole[0].Front != "Mitosis" || whole[0].Back != "Cell division." {
+		t.Fatalf("unexpected whole-node card: %+v", whole)
+	}
+	if again := parseFlashcards(Node{ID: "n1", Content: "France :: Paris"}); again[0].GUID != pairs[0].GUID {
+		t.Fatalf("guid should be stable for the same node and position")
+	}
+}
+
+func TestAnkiExport(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "anki-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	os.MkdirAll("media", 0755)
+	ioutil.WriteFile(filepath.Join("media", "media_1_cell.png"), []byte("PNG"), 0644)
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, mime_type, created_at, modified_at) VALUES
+		('node_cards', 'note', 'bio.md', 'Biology', 'Q: Organelle?\nA: ![cell](/media/media_1_cell.png) **Mitochondria**', 'text/markdown', 1, 1),
+		('node_plain', 'note', 'plain.md', 'Plain', 'France :: Paris', 'text/markdown', 2, 2)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('tag_fc', 'flashcard'), ('tag_bio', 'cell biology')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'node_cards', 'tag_fc'), ('nt2', 'node_cards', 'tag_bio')`)
+
+	mux := setupRoutes()
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/export/anki?deck=Biology", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("apkg export: %d %s", rr.Code, rr.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("apkg is not a zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	var media map[string]string
+	json.Unmarshal(files["media"], &media)
+	if media["0"] != "media_1_cell.png" || string(files["0"]) != "PNG" {
+		t.Fatalf("media not bundled: %v", media)
+	}
+
+	collection := filepath.Join(tmp, "collection.anki2")
+	ioutil.WriteFile(collection, files["collection.anki2"], 0644)
+	adb, err := sql.Open("sqlite", collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adb.Close()
+	var flds, tags string
+	if err := adb.QueryRow(`SELECT flds, tags FROM notes`).Scan(&flds, &tags); err != nil {
+		t.Fatalf("reading note: %v", err)
+	}
+	parts := strings.Split(flds, "\x1f")
+	if len(parts) != 2 || !strings.Contains(parts[1], `<img src="media_1_cell.png"`) || !strings.Contains(parts[1], "<strong>Mitochondria</strong>") {
+		t.Fatalf("unexpected fields: %q", flds)
+	}
+	if tags != " cell_biology flashcard " {
+		t.Fatalf("unexpected tags %q", tags)
+	}
+	var cards int
+	adb.QueryRow(`SELECT COUNT(*) FROM cards`).Scan(&cards)
+	var decks string
+	adb.QueryRow(`SELECT decks FROM col`).Scan(&decks)
+	if cards != 1 || !strings.Contains(decks, `"name":"Biology"`) {
+		t.Fatalf("expected one card in the Biology deck, got %d cards, decks %s", cards, decks)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/export/anki?format=csv", nil))
+	if body := rr.Body.String(); !strings.HasPrefix(body, "#separator:tab") || !strings.Contains(body, "Organelle") || strings.Contains(body, "Paris") {
+		t.Fatalf("unexpected csv export: %s", body)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/validate"
+)
+
+// === Archival ===
+// Archiving hides a node from default lists, search and site exports without
+// deleting it: it still opens by id, resolves as a link or URI and keeps its
+// history. Lists take ?archived=include for everything or ?archived=only for
+// the archive alone, and site exports take archived nodes on request.
+
+// archivedClause is the condition a node list adds for the request's
+// ?archived=, on the nodes table as alias ("" or "n.")
+func archivedClause(r *http.Request, alias string) string {
+	switch r.URL.Query().Get("archived") {
+	case "include":
+		return ""
+	case "only":
+		return " AND " + alias + "archived_at IS NOT NULL"
+	}
+	return " AND " + alias + "archived_at IS NULL"
+}
+
+// setNodeArchived archives or restores a live node. changed is false when it
+// already was in that state.
+func setNodeArchived(nodeID string, archived bool) (changed bool, err error) {
+	var res sql.Result
+	if archived {
+		res, err = db.Exec(`UPDATE nodes SET archived_at = ? WHERE id = ? AND deleted_at IS NULL AND archived_at IS NULL`,
+			time.Now().Unix(), nodeID)
+	} else {
+		res, err = db.Exec(`UPDATE nodes SET archived_at = NULL WHERE id = ? AND deleted_at IS NULL AND archived_at IS NOT NULL`, nodeID)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// announceArchival publishes the change and, for published nodes, queues
+// the site rebuilds that add or drop their pages
+func announceArchival(nodeIDs []string, archived bool) {
+	typ := events.NodeUnarchived
+	if archived {
+		typ = events.NodeArchived
+	}
+	rebuilt := map[string]bool{}
+	for _, id := range nodeIDs {
+		var n Node
+		var status string
+		db.QueryRow(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, ''), COALESCE(status, '') FROM nodes WHERE id = ?`, id).
+			Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.SiteID, &status)
+		publishNodeEvent(typ, n)
+		if n.SiteID != "" && (status == "published" || status == "public") && !rebuilt[n.SiteID] {
+			rebuilt[n.SiteID] = true
+			queueStaticRebuilds(n.SiteID, n.ID)
+		}
+	}
+}
+
+// handleNodeArchive serves POST /api/node/{id}/archive and
+// /api/node/{id}/unarchive
+func handleNodeArchive(w http.ResponseWriter, r *http.Request, nodeID string, archive bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var exists int
+	if db.QueryRow(`SELECT 1 FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).Scan(&exists) != nil || !canReadNode(r, nodeID) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's owner can archive it")
+		return
+	}
+	changed, err := setNodeArchived(nodeID, archive)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	if changed {
+		announceArchival([]string{nodeID}, archive)
+	}
+	var archivedAt sql.NullInt64
+	db.QueryRow(`SELECT archived_at FROM nodes WHERE id = ?`, nodeID).Scan(&archivedAt)
+	resp := map[string]interface{}{"id": nodeID, "archived": archivedAt.Valid, "changed": changed}
+	if archivedAt.Valid {
+		resp["archived_at"] = archivedAt.Int64
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ArchiveByAge selects live nodes not modified since Before for bulk archival
+type ArchiveByAge struct {
+	OlderThanDays int    `json:"older_than_days" validate:"required,min=1"`
+	SiteID        string `json:"site_id" validate:"max=128"`
+	Type          string `json:"type" validate:"max=64"`
+	DryRun        bool   `json:"dry_run"`
+}
+
+// archiveByAge archives the nodes req selects that allow accepts, or only
+// lists them on a dry run, oldest first
+func archiveByAge(req ArchiveByAge, allow func(nodeID string) bool) ([]string, error) {
+	cutoff := time.Now().AddDate(0, 0, -req.OlderThanDays).Unix()
+	query := `SELECT id FROM nodes WHERE deleted_at IS NULL AND archived_at IS NULL AND modified_at < ?`
+	args := []interface{}{cutoff}
+	if req.SiteID != "" {
+		query += ` AND site_id = ?`
+		args = append(args, req.SiteID)
+	}
+	if req.Type != "" {
+		query += ` AND type = ?`
+		args = append(args, req.Type)
+	}
+	rows, err := db.Query(query+` ORDER BY modified_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, id)
+	}
+	rows.Close()
+
+	ids := []string{}
+	for _, id := range candidates {
+		if allow != nil && !allow(id) {
+			continue
+		}
+		if req.DryRun {
+			ids = append(ids, id)
+			continue
+		}
+		changed, err := setNodeArchived(id, true)
+		if err != nil {
+			return ids, err
+		}
+		if changed {
+			ids = append(ids, id)
+		}
+	}
+	if !req.DryRun {
+		announceArchival(ids, true)
+	}
+	return ids, nil
+}
+
+// handleArchive serves POST /api/archive {older_than_days, site_id?, type?,
+// dry_run?}, archiving the matching nodes the caller may modify
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req ArchiveByAge
+	if err := validate.DecodeJSON(r.Body, &req); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	ids, err := archiveByAge(req, func(id string) bool { return canModifyNode(r, id) })
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"archived": ids, "count": len(ids), "dry_run": req.DryRun})
+}
+
+// archiveCommand is `veil archive --older-than 365d [--site ID] [--type T]
+// [--dry-run] [--vault NAME|PATH]`
+func archiveCommand() {
+	usage := "Usage: veil archive --older-than DAYS[d] [--site ID] [--type TYPE] [--dry-run] [--vault NAME|PATH]"
+	vault := "."
+	var req ArchiveByAge
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--dry-run" {
+			req.DryRun = true
+			continue
+		}
+		if i+1 >= len(args) {
+			break
+		}
+		switch args[i] {
+		case "--older-than":
+			days, err := strconv.Atoi(strings.TrimSuffix(args[i+1], "d"))
+			if err != nil || days < 1 {
+				fmt.Println(usage)
+				return
+			}
+			req.OlderThanDays = days
+		case "--site":
+			req.SiteID = args[i+1]
+		case "--type":
+			req.Type = args[i+1]
+		case "--vault":
+			vault = args[i+1]
+			if v, ok := lookupVault(vault); ok {
+				vault = v.Path
+			}
+		}
+		i++
+	}
+	if req.OlderThanDays == 0 {
+		fmt.Println(usage)
+		return
+	}
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+
+	ids, err := archiveByAge(req, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	verb := "Archived"
+	if req.DryRun {
+		verb = "Would archive"
+	}
+	for _, id := range ids {
+		var path, title string
+		db.QueryRow(`SELECT path, COALESCE(title, '') FROM nodes WHERE id = ?`, id).Scan(&path, &title)
+		fmt.Printf("  %s - %s (%s)\n", path, title, id)
+	}
+	fmt.Printf("%s %d node(s) not modified in %d days\n", verb, len(ids), req.OlderThanDays)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeArchival(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	old := time.Now().AddDate(0, 0, -400).Unix()
+	now := time.Now().Unix()
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Blog', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('stale', 'post', 's1', 'stale.md', 'Stale', 'findme old', 'stale', 'text/markdown', 'published', 1, ?),
+		('fresh', 'post', 's1', 'fresh.md', 'Fresh', 'findme new', 'fresh', 'text/markdown', 'published', 2, ?),
+		('memo', 'note', NULL, 'memo.md', 'Memo', 'findme memo', 'memo', 'text/markdown', '', 3, ?)`, old, now, old)
+	mux := setupRoutes()
+	ids := func(url string) string {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		var nodes []Node
+		json.Unmarshal(rr.Body.Bytes(), &nodes)
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/node/stale/archive", nil))
+	var resp struct {
+		Archived bool `json:"archived"`
+		Changed  bool `json:"changed"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != 200 || !resp.Archived || !resp.Changed {
+		t.Fatalf("archive: %d %s", rr.Code, rr.Body.String())
+	}
+	if got := ids("/api/nodes"); got != "fresh,memo" {
+		t.Fatalf("archived nodes should drop out of the list, got %s", got)
+	}
+	if got := ids("/api/nodes?archived=only"); got != "stale" {
+		t.Fatalf("expected only the archive, got %s", got)
+	}
+	if got := ids("/api/nodes?archived=include"); got != "fresh,memo,stale" {
+		t.Fatalf("expected everything, got %s", got)
+	}
+	if got := ids("/api/search?q=findme"); got != "fresh,memo" {
+		t.Fatalf("search should skip archived nodes, got %s", got)
+	}
+
+	// still reachable by id and as a link
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/node/stale", nil))
+	var node Node
+	json.Unmarshal(rr.Body.Bytes(), &node)
+	if rr.Code != 200 || node.ArchivedAt == nil {
+		t.Fatalf("an archived node should still open: %d %s", rr.Code, rr.Body.String())
+	}
+	if id := resolveLink("s1", nodeLink{Type: "wiki", Target: "Stale"}); id != "stale" {
+		t.Fatalf("an archived node should still resolve, got %q", id)
+	}
+
+	paths := func(opts ExportOptions) string {
+		files, err := planSite(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, f := range files {
+			out = append(out, f.Path)
+		}
+		return strings.Join(out, " ")
+	}
+	if got := paths(ExportOptions{SiteID: "s1"}); strings.Contains(got, "stale") {
+		t.Fatalf("exports should leave archived nodes out: %s", got)
+	}
+	if got := paths(ExportOptions{SiteID: "s1", IncludeArchived: true}); !strings.Contains(got, "stale") {
+		t.Fatalf("exports should take archived nodes on request: %s", got)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/node/stale/unarchive", nil))
+	if json.Unmarshal(rr.Body.Bytes(), &resp); resp.Archived || !resp.Changed {
+		t.Fatalf("unarchive: %s", rr.Body.String())
+	}
+
+	// bulk archival by age, dry run first
+	bulk := func(body string) (result struct {
+		Archived []string `json:"archived"`
+		Count    int      `json:"count"`
+	}) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/archive", bytes.NewBufferString(body)))
+		if rr.Code != 200 {
+			t.Fatalf("bulk archive: %d %s", rr.Code, rr.Body.String())
+		}
+		json.Unmarshal(rr.Body.Bytes(), &result)
+		return result
+	}
+	if res := bulk(`{"older_than_days": 365, "dry_run": true}`); strings.Join(res.Archived, ",") != "memo,stale" {
+		t.Fatalf("dry run should list the old nodes: %+v", res)
+	}
+	if got := ids("/api/nodes"); got != "fresh,memo,stale" {
+		t.Fatalf("a dry run should change nothing, got %s", got)
+	}
+	if res := bulk(`{"older_than_days": 365, "site_id": "s1"}`); res.Count != 1 || res.Archived[0] != "stale" {
+		t.Fatalf("expected only the site's old node: %+v", res)
+	}
+	if got := ids("/api/nodes"); got != "fresh,memo" {
+		t.Fatalf("got %s", got)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/archive", bytes.NewBufferString(`{}`)))
+	if rr.Code != 400 {
+		t.Fatalf("older_than_days should be required, got %d", rr.Code)
+	}
+}
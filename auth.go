@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+)
+
+const (
+	sessionCookie    = "veil_session"
+	sessionTTL       = 30 * 24 * time.Hour
+	passwordIter     = 210000
+	minPasswordLen   = 8
+	passwordHashAlgo = "pbkdf2-sha256"
+)
+
+// openRegistration lets anyone register once accounts exist (serve --open-registration).
+// Otherwise only the first account can be created anonymously.
+var openRegistration bool
+
+// hashPassword returns "pbkdf2-sha256$<iter>$<salt>$<key>" with hex salt and key
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIter, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%x$%x", passwordHashAlgo, passwordIter, salt, key), nil
+}
+
+func verifyPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != passwordHashAlgo {
+		return false
+	}
+	var iter int
+	if _, err := fmt.Sscanf(parts[1], "%d", &iter); err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authEnabled reports whether any account exists. Until the first user
+// registers the vault stays in single-user mode and nothing is gated.
+func authEnabled() bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM users WHERE password_hash IS NOT NULL`).Scan(&n)
+	return n > 0
+}
+
+// createSession stores a new session for userID and returns its bearer token
+func createSession(userID string) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now()
+	expires := now.Add(sessionTTL)
+	_, err := db.Exec(`INSERT INTO sessions (id, user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		ids.New("sess"), userID, hashToken(token), now.Unix(), expires.Unix())
+	return token, expires, err
+}
+
+// sessionToken reads the token from "Authorization: Bearer" or the session cookie
+func sessionToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// currentUser returns the user owning the request's session, or nil
+func currentUser(r *http.Request) *User {
+	token := sessionToken(r)
+	if token == "" {
+		return nil
+	}
+	var u User
+	var email sql.NullString
+	var created int64
+	err := db.QueryRow(`SELECT u.id, u.username, u.email, COALESCE(u.is_admin, 0), u.created_at FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, hashToken(token), time.Now().Unix()).
+		Scan(&u.ID, &u.Username, &email, &u.IsAdmin, &created)
+	if err != nil {
+		return nil
+	}
+	u.Email = email.String
+	u.CreatedAt = time.Unix(created, 0)
+	return &u
+}
+
+// currentUserID is currentUser's id, or "" for anonymous requests
+func currentUserID(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.ID
+	}
+	return ""
+}
+
+// commitAuthor names the signed-in user as the author of codex commits
+func commitAuthor(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Username
+	}
+	return "Veil System"
+}
+
+// isMutating reports whether a request changes state
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// requireAuth rejects mutating API requests without a valid session once
+// accounts exist. Registration and login stay reachable.
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		public := r.URL.Path == "/api/auth/login" || r.URL.Path == "/api/auth/register"
+		// codex sync checks its own bearer token
+		public = public || strings.HasPrefix(r.URL.Path, "/api/codex/sync/")
+		// and build hooks their own token
+		public = public || strings.HasPrefix(r.URL.Path, "/api/sites/") && strings.HasSuffix(r.URL.Path, "/build-hook")
+		// verifying a bundle changes nothing, and is for anyone handed one
+		public = public || r.URL.Path == "/api/verify"
+		// node deletion is a GET endpoint, so gate it explicitly
+		mutating := isMutating(r) || r.URL.Path == "/api/node-delete"
+		if mutating && !public && strings.HasPrefix(r.URL.Path, "/api/") && authEnabled() && currentUser(r) == nil {
+			w.Header().Set("Content-Type", "application/json")
+			apierror.Write(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// === API Handlers - Auth ===
+func handleAuthRegister(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" || len(req.Password) < minPasswordLen {
+		apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("username and a password of at least %d characters are required", minPasswordLen))
+		return
+	}
+	if authEnabled() && !openRegistration && currentUser(r) == nil {
+		apierror.Write(w, http.StatusForbidden, "registration is closed; sign in to add accounts")
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	now := time.Now()
+	// the first account administers the vault
+	user := User{ID: ids.New("user"), Username: req.Username, Email: req.Email,
+		IsAdmin: !authEnabled(), CreatedAt: time.Unix(now.Unix(), 0)}
+	var email interface{}
+	if req.Email != "" {
+		email = req.Email
+	}
+	if _, err := db.Exec(`INSERT INTO users (id, username, email, password_hash, is_admin, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Username, email, hash, boolToInt(user.IsAdmin), now.Unix()); err != nil {
+		apierror.Write(w, http.StatusConflict, "username or email already registered")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func handleAuthLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+
+	var user User
+	var email, hash sql.NullString
+	var created int64
+	err := db.QueryRow(`SELECT id, username, email, password_hash, created_at FROM users WHERE username = ?`, req.Username).
+		Scan(&user.ID, &user.Username, &email, &hash, &created)
+	if err != nil || !hash.Valid || !verifyPassword(req.Password, hash.String) {
+		apierror.Write(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+	user.Email = email.String
+	user.CreatedAt = time.Unix(created, 0)
+
+	token, expires, err := createSession(user.ID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	setSessionCookie(w, r, token, expires)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expires.Unix(),
+		"user":       user,
+	})
+}
+
+func handleAuthLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if token := sessionToken(r); token != "" {
+		db.Exec(`DELETE FROM sessions WHERE token_hash = ?`, hashToken(token))
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAuthMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := currentUser(r)
+	if u == nil {
+		apierror.WriteWith(w, &apierror.Error{Status: http.StatusUnauthorized, Message: "not signed in"},
+			map[string]interface{}{"auth_enabled": authEnabled()})
+		return
+	}
+	json.NewEncoder(w).Encode(u)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAuthRegisterLoginAndOwnership(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tmp, err := ioutil.TempDir("", "auth-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(user string) string {
+		rr := do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("login %s: %d %s", user, rr.Code, rr.Body.String())
+		}
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out.Token
+	}
+
+	// single-user mode until an account exists
+	if rr := do("POST", "/api/node-create", "", map[string]string{"type": "note", "path": "a.md", "title": "A"}); rr.Code != http.StatusCreated {
+		t.Fatalf("expected anonymous create before accounts exist, got %d", rr.Code)
+	}
+
+	if rr := do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "short"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for short password, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"}); rr.Code != http.StatusCreated {
+		t.Fatalf("register: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/api/auth/register", "", map[string]string{"username": "eve", "password": "correct horse"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected closed registration, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/login", "", map[string]string{"username": "ada", "password": "wrong password"}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for bad password, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/node-create", "", map[string]string{"type": "note", "path": "b.md"}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for anonymous create, got %d", rr.Code)
+	}
+
+	ada := login("ada")
+	rr := do("POST", "/api/node-create", ada, map[string]string{"type": "note", "path": "b.md", "title": "B"})
+	var node Node
+	json.NewDecoder(rr.Body).Decode(&node)
+	if rr.Code != http.StatusCreated || node.OwnerID == "" {
+		t.Fatalf("expected owned node, got %d %+v", rr.Code, node)
+	}
+
+	if rr := do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"}); rr.Code != http.StatusCreated {
+		t.Fatalf("expected signed-in user to register another, got %d", rr.Code)
+	}
+	bob := login("bob")
+	update := map[string]string{"id": node.ID, "type": "note", "path": "b.md", "title": "B2"}
+	if rr := do("PUT", "/api/node-update", bob, update); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-owner update, got %d", rr.Code)
+	}
+	if rr := do("PUT", "/api/node-update", ada, update); rr.Code != http.StatusOK {
+		t.Fatalf("expected owner update, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := do("GET", "/api/auth/me", bob, nil); rr.Code != http.StatusOK {
+		t.Fatalf("me: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/auth/logout", bob, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("logout: %d", rr.Code)
+	}
+	if rr := do("GET", "/api/auth/me", bob, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected session to end on logout, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Backlink Index ===
+// node_backlinks holds one row per (target, source) pair of node_references,
+// and nodes.backlink_count how many live nodes link to a node. Both are
+// updated when a node's references are rewritten or the node is deleted, so
+// backlink lookups and list views need no join over node_references.
+
+// maxBacklinkBatch caps the ids of one /api/backlinks?ids= request
+const maxBacklinkBatch = 200
+
+// indexBacklinks brings sourceID's index rows in step with its references
+// and recounts every node it started or stopped linking to
+func indexBacklinks(d *sql.DB, sourceID string) error {
+	targets, err := backlinkTargets(d, sourceID)
+	if err != nil {
+		return err
+	}
+	if _, err := d.Exec(`DELETE FROM node_backlinks WHERE source_node_id = ?`, sourceID); err != nil {
+		return err
+	}
+	if _, err := d.Exec(`INSERT INTO node_backlinks (target_node_id, source_node_id, link_count, updated_at)
+		SELECT target_node_id, source_node_id, COUNT(*), ? FROM node_references WHERE source_node_id = ?
+		GROUP BY target_node_id, source_node_id`, time.Now().Unix(), sourceID); err != nil {
+		return err
+	}
+	now, err := backlinkTargets(d, sourceID)
+	if err != nil {
+		return err
+	}
+	return recountBacklinks(d, append(targets, now...))
+}
+
+// backlinkTargets lists the nodes sourceID links to, per the index
+func backlinkTargets(d *sql.DB, sourceID string) ([]string, error) {
+	rows, err := d.Query(`SELECT target_node_id FROM node_backlinks WHERE source_node_id = ?`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// recountBacklinks refreshes the cached backlink_count of ids
+func recountBacklinks(d *sql.DB, ids []string) error {
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := d.Exec(`UPDATE nodes SET backlink_count = (
+			SELECT COUNT(*) FROM node_backlinks b JOIN nodes s ON s.id = b.source_node_id
+			WHERE b.target_node_id = nodes.id AND s.deleted_at IS NULL) WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backlinkSource is a node linking to another, as backlink endpoints list it
+type backlinkSource struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+}
+
+// readableBacklinks maps each of targets to the live nodes linking to it that
+// r may read, in one query
+func readableBacklinks(r *http.Request, targets []string) (map[string][]backlinkSource, error) {
+	found := map[string][]backlinkSource{}
+	if len(targets) == 0 {
+		return found, nil
+	}
+	args := make([]interface{}, len(targets))
+	for i, id := range targets {
+		args[i] = id
+	}
+	rows, err := db.Query(`SELECT b.target_node_id, n.id, COALESCE(n.title, ''), n.type, n.path,
+		COALESCE(n.site_id, ''), COALESCE(v.visibility, '')
+		FROM node_backlinks b JOIN nodes n ON n.id = b.source_node_id
+		LEFT JOIN node_visibility v ON v.node_id = n.id
+		WHERE b.target_node_id IN (?`+strings.Repeat(", ?", len(targets)-1)+`) AND n.deleted_at IS NULL
+		ORDER BY b.target_node_id, n.path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	canRead := nodeReadFilter(r)
+	for rows.Next() {
+		var target, siteID, vis string
+		var s backlinkSource
+		if err := rows.Scan(&target, &s.ID, &s.Title, &s.Type, &s.Path, &siteID, &vis); err != nil {
+			return nil, err
+		}
+		if canRead(siteID, vis) {
+			found[target] = append(found[target], s)
+		}
+	}
+	return found, rows.Err()
+}
+
+// handleBacklinksBatch serves GET /api/backlinks?ids=a,b,c for list views:
+// for each readable id, the nodes linking to it and how many there are.
+// Unknown or unreadable ids are left out.
+func handleBacklinksBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		apierror.Write(w, http.StatusBadRequest, "ids is required")
+		return
+	}
+	if len(ids) > maxBacklinkBatch {
+		apierror.Write(w, http.StatusBadRequest, "at most 200 ids per request")
+		return
+	}
+
+	var readable []string
+	for _, id := range ids {
+		var exists int
+		if db.QueryRow(`SELECT 1 FROM nodes WHERE id = ? AND deleted_at IS NULL`, id).Scan(&exists) == nil && canReadNode(r, id) {
+			readable = append(readable, id)
+		}
+	}
+	backlinks, err := readableBacklinks(r, readable)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	type entry struct {
+		Count     int              `json:"count"`
+		Backlinks []backlinkSource `json:"backlinks"`
+	}
+	result := map[string]entry{}
+	for _, id := range readable {
+		sources := backlinks[id]
+		if sources == nil {
+			sources = []backlinkSource{}
+		}
+		result[id] = entry{Count: len(sources), Backlinks: sources}
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,717 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+	s3storage "veil/pkg/codex/storage/s3"
+	plugins "veil/pkg/plugins"
+	"veil/pkg/store"
+)
+
+// === Backups ===
+// veil serve backs the vault up on a cron schedule (--backup-schedule).
+// veil.db, media/ and the codex objects go into a veil-backup-<time>.zip,
+// the archive veil migrate --backup writes and veil restore reads, in the
+// vault's backups/ directory, and a copy goes to an S3 bucket and an SFTP
+// directory when they are configured. After every backup each target is
+// rotated: the newest archive of each of the last --backup-keep-daily days
+// and --backup-keep-weekly weeks is kept and the rest deleted. A target
+// that fails raises a backup alert until a backup to it succeeds.
+// /api/backups lists the archives and makes one now;
+// /api/backups/{name}/restore checks one and restores it into a new vault.
+
+// BackupConfig is configured by the --backup-* flags
+type BackupConfig struct {
+	// Schedule is a cron expression (minute hour day month weekday, or
+	// @hourly, @daily, @weekly, @monthly) in local time; "" takes no backups
+	Schedule string
+	// Dir holds the archives, relative to the vault
+	Dir string
+	// KeepDaily and KeepWeekly are how many days and weeks keep their
+	// newest archive; with both 0 nothing is deleted
+	KeepDaily  int
+	KeepWeekly int
+	// S3 and SFTP ("user@host:dir") get a copy of every archive when set
+	S3           *s3storage.Config
+	SFTP         string
+	SFTPPort     string
+	SFTPIdentity string
+}
+
+var backupConfig = BackupConfig{Dir: "backups", KeepDaily: 7, KeepWeekly: 4}
+
+// backupMu keeps scheduled and requested backups from overlapping
+var backupMu sync.Mutex
+
+const (
+	backupPrefix     = "veil-backup-"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// Backup is an archive and the targets holding a copy of it
+type Backup struct {
+	Name      string   `json:"name"`
+	CreatedAt int64    `json:"created_at"`
+	Size      int64    `json:"size,omitempty"` // of the local copy
+	Targets   []string `json:"targets"`
+}
+
+// backupTime is when the archive called name was made, if name is one
+func backupTime(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, backupPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	if ts, ok = strings.CutSuffix(ts, ".zip"); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupTimeFormat, ts)
+	return t, err == nil
+}
+
+// createBackupZip writes an archive of the vault at base into base
+func createBackupZip(base string) (string, error) {
+	return writeBackupZip(base, filepath.Join(base, vaultDBName), base)
+}
+
+// writeBackupZip writes an archive of dbFile as veil.db and base's media/
+// and codex objects into dir. The archive only appears once complete.
+func writeBackupZip(base, dbFile, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	out := filepath.Join(dir, backupPrefix+time.Now().UTC().Format(backupTimeFormat)+".zip")
+	f, err := os.CreateTemp(dir, ".veil-backup-")
+	if err != nil {
+		return "", err
+	}
+	zw := zip.NewWriter(f)
+	err = addBackupFiles(zw, base, dbFile)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), out)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return out, nil
+}
+
+func addBackupFiles(zw *zip.Writer, base, dbFile string) error {
+	// include veil.db if exists
+	if fi, err := os.Stat(dbFile); err == nil && !fi.IsDir() {
+		if err := addFileToZip(zw, dbFile, vaultDBName); err != nil {
+			return err
+		}
+	}
+
+	// include .codex objects, loose and packed
+	for _, dir := range []string{"objects", "objects/pack"} {
+		files, err := os.ReadDir(filepath.Join(base, ".codex", filepath.FromSlash(dir)))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			p := filepath.Join(base, ".codex", filepath.FromSlash(dir), f.Name())
+			if err := addFileToZip(zw, p, path.Join(".codex", dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	// include media/ with its variants
+	media := filepath.Join(base, "media")
+	if _, err := os.Stat(media); err != nil {
+		return nil
+	}
+	return filepath.WalkDir(media, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		return addFileToZip(zw, p, filepath.ToSlash(rel))
+	})
+}
+
+func addFileToZip(zw *zip.Writer, path, rel string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := zw.Create(rel)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// backupTarget is somewhere archives are kept
+type backupTarget interface {
+	name() string
+	upload(archive string) error
+	list() ([]string, error)
+	fetch(name, dest string) error
+	remove(name string) error
+}
+
+// backupTargets are the local directory and the configured remote targets
+func backupTargets() []backupTarget {
+	targets := []backupTarget{localBackups(backupConfig.Dir)}
+	if backupConfig.S3 != nil {
+		if s, err := s3storage.New(*backupConfig.S3); err != nil {
+			reportBackup("s3", err)
+		} else {
+			targets = append(targets, s3Backups{s})
+		}
+	}
+	if backupConfig.SFTP != "" {
+		host, dir, _ := strings.Cut(backupConfig.SFTP, ":")
+		targets = append(targets, sftpBackups{host: host, dir: strings.TrimSuffix(dir, "/"), port: backupConfig.SFTPPort, identity: backupConfig.SFTPIdentity})
+	}
+	return targets
+}
+
+// localBackups is a directory of archives
+type localBackups string
+
+func (d localBackups) name() string { return "local" }
+
+// upload does nothing: archives are written here first
+func (d localBackups) upload(archive string) error { return nil }
+
+func (d localBackups) list() ([]string, error) {
+	entries, err := os.ReadDir(string(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, err
+}
+
+func (d localBackups) fetch(name, dest string) error {
+	f, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileFrom(dest, f)
+}
+
+func (d localBackups) remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+// s3Backups keeps archives under the bucket's prefix
+type s3Backups struct{ store *s3storage.S3Storage }
+
+func (s s3Backups) name() string { return "s3" }
+
+func (s s3Backups) upload(archive string) error {
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		return err
+	}
+	return s.store.PutFile(filepath.Base(archive), data, "application/zip")
+}
+
+func (s s3Backups) list() ([]string, error) { return s.store.ListFiles(backupPrefix) }
+
+func (s s3Backups) fetch(name, dest string) error {
+	rc, err := s.store.GetFile(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return writeFileFrom(dest, rc)
+}
+
+func (s s3Backups) remove(name string) error { return s.store.DeleteFile(name) }
+
+// writeFileFrom writes what r holds to a new file dest
+func writeFileFrom(dest string, r io.Reader) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// sftpBackups keeps archives in a remote directory, with the sftp command
+// the sftp publishing channel uses
+type sftpBackups struct{ host, dir, port, identity string }
+
+func (s sftpBackups) name() string { return "sftp" }
+
+// run runs the sftp batch script built from lines, quoting each path
+func (s sftpBackups) run(lines ...[]string) (string, error) {
+	var batch strings.Builder
+	for _, l := range lines {
+		batch.WriteString(l[0])
+		for _, p := range l[1:] {
+			q, err := plugins.SFTPQuote(p)
+			if err != nil {
+				return "", err
+			}
+			batch.WriteString(" " + q)
+		}
+		batch.WriteString("\n")
+	}
+	args := []string{"-b", "-"}
+	if s.port != "" {
+		args = append(args, "-P", s.port)
+	}
+	if s.identity != "" {
+		args = append(args, "-i", s.identity)
+	}
+	cmd := exec.Command("sftp", append(args, "--", s.host)...)
+	cmd.Stdin = strings.NewReader(batch.String())
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sftp failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+func (s sftpBackups) upload(archive string) error {
+	_, err := s.run([]string{"-mkdir", s.dir}, []string{"put", archive, s.dir + "/" + filepath.Base(archive)})
+	return err
+}
+
+func (s sftpBackups) list() ([]string, error) {
+	out, err := s.run([]string{"ls -1", s.dir})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range strings.Fields(out) {
+		if name := path.Base(f); strings.HasPrefix(name, backupPrefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s sftpBackups) fetch(name, dest string) error {
+	_, err := s.run([]string{"get", s.dir + "/" + name, dest})
+	return err
+}
+
+func (s sftpBackups) remove(name string) error {
+	_, err := s.run([]string{"rm", s.dir + "/" + name})
+	return err
+}
+
+// runBackup archives the vault into the backup directory, copies the
+// archive to the remote targets and rotates every target
+func runBackup() (*Backup, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	archive, err := snapshotVault()
+	reportBackup("local", err)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{Name: filepath.Base(archive), CreatedAt: time.Now().Unix()}
+	if fi, err := os.Stat(archive); err == nil {
+		b.Size = fi.Size()
+	}
+	for _, t := range backupTargets() {
+		err := t.upload(archive)
+		if err == nil {
+			err = rotateTarget(t)
+		}
+		reportBackup(t.name(), err)
+		if err != nil {
+			log.Printf("backup: %s: %v", t.name(), err)
+			continue
+		}
+		b.Targets = append(b.Targets, t.name())
+	}
+	return b, nil
+}
+
+// snapshotVault writes an archive of the open vault into the backup
+// directory. VACUUM INTO copies the database consistently while the server
+// keeps writing to it.
+func snapshotVault() (string, error) {
+	if store.IsPostgres(db) {
+		return "", fmt.Errorf("the database is in PostgreSQL; back it up with pg_dump")
+	}
+	tmp, err := os.MkdirTemp("", "veil-backup-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	dbFile := filepath.Join(tmp, vaultDBName)
+	if _, err := db.Exec(`VACUUM INTO ?`, dbFile); err != nil {
+		return "", err
+	}
+	return writeBackupZip(".", dbFile, backupConfig.Dir)
+}
+
+// rotateTarget deletes the archives in t the keep policy lets go
+func rotateTarget(t backupTarget) error {
+	names, err := t.list()
+	if err != nil {
+		return err
+	}
+	for _, name := range rotateBackups(names, backupConfig.KeepDaily, backupConfig.KeepWeekly) {
+		if err := t.remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateBackups returns the archives among names to delete: the newest
+// archive of each of the newest daily days and weekly weeks that have one
+// is kept. Names that aren't archives are left alone.
+func rotateBackups(names []string, daily, weekly int) []string {
+	if daily <= 0 && weekly <= 0 {
+		return nil
+	}
+	type archive struct {
+		name string
+		at   time.Time
+	}
+	var archives []archive
+	for _, name := range names {
+		if at, ok := backupTime(name); ok {
+			archives = append(archives, archive{name, at})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].at.After(archives[j].at) })
+	days, weeks := map[string]bool{}, map[string]bool{}
+	var remove []string
+	for _, a := range archives {
+		keep := false
+		if day := a.at.Format("2006-01-02"); !days[day] && len(days) < daily {
+			days[day], keep = true, true
+		}
+		year, w := a.at.ISOWeek()
+		if week := fmt.Sprintf("%d-%02d", year, w); !weeks[week] && len(weeks) < weekly {
+			weeks[week], keep = true, true
+		}
+		if !keep {
+			remove = append(remove, a.name)
+		}
+	}
+	return remove
+}
+
+// listBackups lists the archives in every target, newest first. A remote
+// target that can't be listed is left out.
+func listBackups() ([]*Backup, error) {
+	byName := map[string]*Backup{}
+	for _, t := range backupTargets() {
+		names, err := t.list()
+		if err != nil {
+			if t.name() == "local" {
+				return nil, err
+			}
+			log.Printf("backup: listing %s: %v", t.name(), err)
+			continue
+		}
+		for _, name := range names {
+			at, ok := backupTime(name)
+			if !ok {
+				continue
+			}
+			b := byName[name]
+			if b == nil {
+				b = &Backup{Name: name, CreatedAt: at.Unix(), Targets: []string{}}
+				byName[name] = b
+			}
+			b.Targets = append(b.Targets, t.name())
+			if t.name() == "local" {
+				if fi, err := os.Stat(filepath.Join(backupConfig.Dir, name)); err == nil {
+					b.Size = fi.Size()
+				}
+			}
+		}
+	}
+	list := make([]*Backup, 0, len(byName))
+	for _, b := range byName {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	return list, nil
+}
+
+// fetchBackup copies the archive called name from the first target holding
+// it into a scratch directory, removed by cleanup
+func fetchBackup(name string) (archive string, cleanup func(), err error) {
+	tmp, err := os.MkdirTemp("", "veil-backup-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(tmp) }
+	archive = filepath.Join(tmp, name)
+	for _, t := range backupTargets() {
+		if err = t.fetch(name, archive); err == nil {
+			return archive, cleanup, nil
+		}
+	}
+	cleanup()
+	return "", nil, err
+}
+
+// watchBackups takes a backup whenever schedule falls due, until stopped
+func watchBackups(schedule *cronSchedule) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			next := schedule.next(time.Now())
+			if next.IsZero() {
+				return
+			}
+			t := time.NewTimer(time.Until(next))
+			select {
+			case <-done:
+				t.Stop()
+				return
+			case <-t.C:
+				if b, err := runBackup(); err != nil {
+					log.Printf("backup: %v", err)
+				} else {
+					log.Printf("backup: wrote %s to %s", b.Name, strings.Join(b.Targets, ", "))
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// handleBackups lists the archives (GET) or takes a backup now (POST)
+func handleBackups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can manage backups")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		list, err := listBackups()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		resp := struct {
+			Schedule string    `json:"schedule"`
+			NextRun  int64     `json:"next_run,omitempty"`
+			Backups  []*Backup `json:"backups"`
+		}{Schedule: backupConfig.Schedule, Backups: list}
+		if s, err := parseCron(backupConfig.Schedule); err == nil {
+			resp.NextRun = s.next(time.Now()).Unix()
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "POST":
+		b, err := runBackup()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(b)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleBackupRestore is POST /api/backups/{name}/restore with an optional
+// {"to": dir}: it checks the archive and, given a new directory, restores it
+// there as a vault, as veil restore does
+func handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/backups/"), "/")
+	if _, ok := backupTime(name); !ok || action != "restore" {
+		apierror.Write(w, http.StatusNotFound, "backup not found")
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can manage backups")
+		return
+	}
+	var req struct {
+		To string `json:"to"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid restore request")
+			return
+		}
+	}
+	archive, cleanup, err := fetchBackup(name)
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, "backup not found")
+		return
+	}
+	defer cleanup()
+	report, err := restoreBackup(archive, req.To)
+	if err != nil {
+		apierror.Write(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	report.Archive = name
+	if report.To != "" {
+		if _, err := registerVault(report.To, "", false); err != nil {
+			log.Printf("backup: failed to update vault registry: %v", err)
+		}
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// cronSchedule is a parsed cron expression: the minutes, hours, days of the
+// month, months and weekdays it allows, as bit sets
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// with both day fields restricted a day matching either one matches,
+	// as in cron
+	domAny, dowAny bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a five-field cron expression or one of its @ aliases
+func parseCron(expr string) (*cronSchedule, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("a cron expression has 5 fields: minute hour day month weekday")
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron field %q: %v", f, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1 // 7 is Sunday too
+	}
+	return &cronSchedule{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*"}, nil
+}
+
+// parseCronField parses a comma-separated list of *, n or n-m, each with an
+// optional /step
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		span, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step")
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("not a number")
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("not a number")
+				}
+			} else if stepped {
+				hi = max
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("must be within %d-%d", min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// next is the first minute after t the schedule allows, or the zero time
+// if none does within five years
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	// 2026-03-04 is a Wednesday
+	for _, c := range []struct{ expr, from, want string }{
+		{"0 3 * * *", "2026-03-04 02:59", "2026-03-04 03:00"},
+		{"0 3 * * *", "2026-03-04 03:00", "2026-03-05 03:00"},
+		{"*/15 * * * *", "2026-03-04 10:07", "2026-03-04 10:15"},
+		{"30 2 * * 0", "2026-03-04 10:00", "2026-03-08 02:30"},
+		{"30 2 * * 7", "2026-03-04 10:00", "2026-03-08 02:30"},
+		{"0 0 1,15 * *", "2026-03-02 00:00", "2026-03-15 00:00"},
+		{"0 0 13 * 5", "2026-03-04 00:00", "2026-03-06 00:00"}, // day 13 or a Friday
+		{"0 9-17/4 * * 1-5", "2026-03-06 18:00", "2026-03-09 09:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"@weekly", "2026-03-04 00:00", "2026-03-08 00:00"},
+		{"@daily", "2026-12-31 23:30", "2027-01-01 00:00"},
+	} {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", c.expr, err)
+		}
+		if got := s.next(at(c.from)); !got.Equal(at(c.want)) {
+			t.Fatalf("%s after %s: got %s, want %s", c.expr, c.from, got, c.want)
+		}
+	}
+	if s, _ := parseCron("0 0 31 2 *"); !s.next(time.Now()).IsZero() {
+		t.Fatal("a schedule that never falls due has no next run")
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "0 0 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@yearly"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Fatalf("%q should be refused", expr)
+		}
+	}
+}
+
+func TestRotateBackups(t *testing.T) {
+	names := []string{
+		"veil-backup-20260304T030000Z.zip", // Wednesday
+		"veil-backup-20260304T120000Z.zip",
+		"veil-backup-20260303T030000Z.zip",
+		"veil-backup-20260302T030000Z.zip", // Monday
+		"veil-backup-20260301T030000Z.zip", // Sunday, the week before
+		"veil-backup-20260222T030000Z.zip",
+		"veil-backup-20260215T030000Z.zip",
+		"notes.txt",
+	}
+	remove := rotateBackups(names, 2, 2)
+	sort.Strings(remove)
+	want := []string{
+		"veil-backup-20260215T030000Z.zip",
+		"veil-backup-20260222T030000Z.zip",
+		"veil-backup-20260302T030000Z.zip",
+		"veil-backup-20260304T030000Z.zip",
+	}
+	if !reflect.DeepEqual(remove, want) {
+		t.Fatalf("got %v, want %v", remove, want)
+	}
+	if remove := rotateBackups(names, 0, 0); remove != nil {
+		t.Fatalf("keeping 0 days and weeks should keep everything: %v", remove)
+	}
+}
+
+// fakeBackupTarget holds archives in memory
+type fakeBackupTarget struct{ files map[string]bool }
+
+func (f *fakeBackupTarget) name() string { return "fake" }
+func (f *fakeBackupTarget) upload(archive string) error {
+	f.files[filepath.Base(archive)] = true
+	return nil
+}
+func (f *fakeBackupTarget) list() ([]string, error) {
+	var names []string
+	for n := range f.files {
+		names = append(names, n)
+	}
+	return names, nil
+}
+func (f *fakeBackupTarget) fetch(name, dest string) error { return os.ErrNotExist }
+func (f *fakeBackupTarget) remove(name string) error {
+	delete(f.files, name)
+	return nil
+}
+
+func TestBackupsAPI(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp := t.TempDir()
+	t.Setenv("VEIL_VAULTS_FILE", filepath.Join(tmp, "vaults.json"))
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	saved := backupConfig
+	defer func() { backupConfig = saved }()
+	backupConfig = BackupConfig{Dir: "backups", KeepDaily: 1, Schedule: "0 3 * * *"}
+
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, mime_type, status, created_at, modified_at) VALUES ('n1', 'note', 'a.md', 'A', 'kept', 'text/markdown', 'draft', 1, 1)`)
+	os.MkdirAll(filepath.Join("media", "variants"), 0755)
+	os.WriteFile(filepath.Join("media", "variants", "a-320.jpg"), []byte("pixels"), 0644)
+	// an archive from an earlier day, rotated away by the next backup
+	os.MkdirAll("backups", 0755)
+	os.WriteFile(filepath.Join("backups", "veil-backup-20200101T030000Z.zip"), []byte("old"), 0644)
+
+	h := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+
+	rr := do("POST", "/api/backups", nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("backup: %d %s", rr.Code, rr.Body)
+	}
+	var b Backup
+	json.NewDecoder(rr.Body).Decode(&b)
+	if _, ok := backupTime(b.Name); !ok || b.Size == 0 || !reflect.DeepEqual(b.Targets, []string{"local"}) {
+		t.Fatalf("unexpected backup: %+v", b)
+	}
+	if _, err := os.Stat(filepath.Join("backups", "veil-backup-20200101T030000Z.zip")); !os.IsNotExist(err) {
+		t.Fatal("the old archive should have been rotated away")
+	}
+
+	rr = do("GET", "/api/backups", nil)
+	var list struct {
+		Schedule string    `json:"schedule"`
+		NextRun  int64     `json:"next_run"`
+		Backups  []*Backup `json:"backups"`
+	}
+	json.NewDecoder(rr.Body).Decode(&list)
+	if list.Schedule != "0 3 * * *" || list.NextRun <= time.Now().Unix() || len(list.Backups) != 1 || list.Backups[0].Name != b.Name {
+		t.Fatalf("unexpected list: %d %+v", rr.Code, list)
+	}
+
+	dest := filepath.Join(tmp, "restored")
+	rr = do("POST", "/api/backups/"+b.Name+"/restore", map[string]string{"to": dest})
+	var report RestoreReport
+	json.NewDecoder(rr.Body).Decode(&report)
+	if rr.Code != http.StatusOK || report.To != dest || report.Nodes != 1 || report.MediaFiles != 1 {
+		t.Fatalf("restore: %d %+v", rr.Code, report)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "media", "variants", "a-320.jpg")); string(data) != "pixels" {
+		t.Fatalf("restored media %q", data)
+	}
+	if _, ok := lookupVault(dest); !ok {
+		t.Fatal("the restored vault should be registered")
+	}
+	if rr := do("POST", "/api/backups/"+b.Name+"/restore", map[string]string{"to": dest}); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("restoring over a vault should be refused: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/backups/veil-backup-20200101T030000Z.zip/restore", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("a missing archive: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/backups/veil.db/restore", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("only archive names can be restored: %d", rr.Code)
+	}
+
+	fake := &fakeBackupTarget{files: map[string]bool{"veil-backup-20200101T030000Z.zip": true, b.Name: true, "other.zip": true}}
+	if err := rotateTarget(fake); err != nil || len(fake.files) != 2 || !fake.files[b.Name] || !fake.files["other.zip"] {
+		t.Fatalf("rotating a remote target: %v %v", err, fake.files)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/bench"
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+	s3storage "veil/pkg/codex/storage/s3"
+)
+
+// === Benchmarks ===
+//
+// `veil bench` fills a server with a synthetic vault and times it (see
+// pkg/bench). Without --url it starts its own server on a throwaway vault,
+// so runs on the same machine compare; with --url it measures a running
+// server, seeding a new site there. Codex operations are timed against the
+// local filesystem, the cached filesystem and, when configured, S3.
+
+// runBench seeds the server at base, times its API, then times codex on
+// each backend
+func runBench(base, token string, cfg bench.Config, backends map[string]codexpkg.Storage) (*bench.Report, error) {
+	cfg = cfg.WithDefaults()
+	report := &bench.Report{Target: base, StartedAt: time.Now().UTC(), Config: cfg}
+	c := bench.NewClient(base, token)
+	vault, results, err := bench.Seed(c, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("seeding the vault: %w", err)
+	}
+	report.Results = append(results, bench.Run(c, vault, cfg)...)
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Results = append(report.Results, bench.Codex(name, backends[name], cfg)...)
+	}
+	return report, nil
+}
+
+func benchCommand() {
+	// Usage: veil bench [--nodes N] [--links N] [--media N] [--media-kb N] [--requests N]
+	//   [--exports N] [--concurrency N] [--seed N] [--url URL] [--token T]
+	//   [--codex-s3-endpoint URL --codex-s3-bucket B ...] [--out FILE]
+	//   [--baseline FILE] [--tolerance PCT] [--json]
+	usage := "Usage: veil bench [--nodes N] [--links N] [--media N] [--media-kb N] [--requests N] [--exports N] [--concurrency N] [--seed N] [--url URL] [--token T] [--codex-s3-* ...] [--out FILE] [--baseline FILE] [--tolerance PCT] [--json]"
+	var cfg bench.Config
+	var s3cfg *s3storage.Config
+	target, token := "", os.Getenv("VEIL_SESSION_TOKEN")
+	out, baseline := "", ""
+	tolerance := 20.0
+	asJSON := false
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--json" {
+			asJSON = true
+			continue
+		}
+		if i+1 >= len(args) {
+			fmt.Println(usage)
+			return
+		}
+		i++
+		val := args[i]
+		if strings.HasPrefix(arg, "--codex-s3-") {
+			s3Flag(&s3cfg, strings.TrimPrefix(arg, "--codex-s3-"), val)
+			continue
+		}
+		switch arg {
+		case "--nodes", "--links", "--media", "--media-kb", "--requests", "--exports", "--concurrency", "--seed":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				log.Fatalf("%s needs a number: %q", arg, val)
+			}
+			switch arg {
+			case "--nodes":
+				cfg.Nodes = n
+			case "--links":
+				cfg.Links = n
+			case "--media":
+				// --media 0 means none rather than the default
+				cfg.Media = n
+				if n == 0 {
+					cfg.Media = -1
+				}
+			case "--media-kb":
+				cfg.MediaBytes = n << 10
+			case "--requests":
+				cfg.Requests = n
+			case "--exports":
+				cfg.Exports = n
+			case "--concurrency":
+				cfg.Concurrency = n
+			case "--seed":
+				cfg.Seed = int64(n)
+			}
+		case "--url":
+			target = val
+		case "--token":
+			token = val
+		case "--out":
+			out = val
+		case "--baseline":
+			baseline = val
+		case "--tolerance":
+			t, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+			if err != nil || t < 0 {
+				log.Fatalf("--tolerance needs a percentage: %q", val)
+			}
+			tolerance = t
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+	// paths are read and written from where the command was run, not from
+	// the throwaway vault it changes into
+	if out != "" {
+		out, _ = filepath.Abs(out)
+	}
+	var base *bench.Report
+	if baseline != "" {
+		data, err := os.ReadFile(baseline)
+		if err != nil {
+			log.Fatal("Failed to read baseline:", err)
+		}
+		base = &bench.Report{}
+		if err := json.Unmarshal(data, base); err != nil {
+			log.Fatal("Failed to read baseline:", err)
+		}
+	}
+
+	scratch, err := os.MkdirTemp("", "veil-bench-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(scratch)
+	backends := map[string]codexpkg.Storage{}
+	backends["fs"] = fsstorage.New(filepath.Join(scratch, "codex"))
+	backends["fs_cached"] = codexpkg.NewCachedStorage(fsstorage.New(filepath.Join(scratch, "codex-cached")), codexCacheBytes)
+	if s3cfg != nil {
+		s3, err := s3storage.New(*s3cfg)
+		if err != nil {
+			log.Fatal("S3 storage unavailable:", err)
+		}
+		backends["s3"] = s3
+	}
+
+	if target == "" {
+		if err := openVault(filepath.Join(scratch, "vault")); err != nil {
+			log.Fatal("Failed to open vault:", err)
+		}
+		defer db.Close()
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		go http.Serve(ln, securityHeaders(requireAuth(setupRoutes())))
+		target = "http://" + ln.Addr().String()
+	}
+	if !asJSON {
+		fmt.Printf("Benchmarking %s...\n", target)
+	}
+	report, err := runBench(target, token, cfg, backends)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if out != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(out, data, 0644); err != nil {
+			log.Fatal("Failed to write report:", err)
+		}
+	}
+	var regressions []bench.Regression
+	if base != nil {
+		regressions = bench.Compare(base, report, tolerance/100)
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(struct {
+			*bench.Report
+			Regressions []bench.Regression `json:"regressions,omitempty"`
+		}{report, regressions}, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		fmt.Print(bench.Table(report.Results))
+		if base != nil {
+			for _, r := range regressions {
+				fmt.Printf("  slower: %-28s %s %.2f -> %.2f (+%.0f%%)\n", r.Name, r.Metric, r.Baseline, r.Current, r.Change*100)
+			}
+			if len(regressions) == 0 {
+				fmt.Printf("No regressions beyond %.0f%% of the baseline\n", tolerance)
+			}
+		}
+	}
+	if len(regressions) > 0 {
+		os.RemoveAll(scratch)
+		os.Exit(1)
+	}
+}
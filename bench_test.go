@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"veil/pkg/bench"
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+)
+
+func TestRunBench(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	srv := httptest.NewServer(securityHeaders(requireAuth(setupRoutes())))
+	defer srv.Close()
+	backends := map[string]codexpkg.Storage{"fs": fsstorage.New(t.TempDir())}
+	report, err := runBench(srv.URL, "", bench.Config{Nodes: 12, Media: 2, MediaBytes: 2048, Requests: 10, Exports: 1, Concurrency: 2}, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bench.Result{}
+	for _, r := range report.Results {
+		got[r.Name] = r
+	}
+	for _, name := range []string{"api.node_create", "api.node_update", "api.media_upload", "api.node_get", "api.nodes_list",
+		"api.tree", "api.backlinks", "search", "query", "media_get", "export.zip", "codex.fs.put_json", "codex.fs.commit"} {
+		r, ok := got[name]
+		if !ok {
+			t.Fatalf("missing %s in %+v", name, report.Results)
+		}
+		if r.Errors > 0 || r.Ops == 0 {
+			t.Fatalf("%s: %d ops, %d errors: %s", name, r.Ops, r.Errors, r.FirstError)
+		}
+	}
+	if report.Config.Links != 36 || report.Target != srv.URL {
+		t.Fatalf("the report should record the run: %+v", report.Config)
+	}
+	// a run compared with itself has nothing slower
+	if regs := bench.Compare(report, report, 0.2); len(regs) != 0 {
+		t.Fatalf("unexpected regressions: %+v", regs)
+	}
+}
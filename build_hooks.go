@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	plugins "veil/pkg/plugins"
+	"veil/pkg/validate"
+)
+
+// === Build Hooks ===
+// Build hooks connect a site to CI in both directions. A build hook is a
+// token an outside system (a CI job, a headless CMS, cron) sends to
+// POST /api/sites/{id}/build-hook to rebuild and deploy the site. It queues
+// a publish job on every active channel that builds or deploys the site, as
+// publishing one of its nodes does. Publish hooks go the other way: once a
+// publish job for the site succeeds they tell a pipeline, with a GitHub
+// Actions repository_dispatch event or a JSON POST signed with a shared
+// secret. Notifications go through the job queue, so a CI outage is retried
+// like a failed deploy. Secrets come from the credential manager:
+// hook/<hook_id>/token for GitHub and hook/<hook_id>/secret for webhooks.
+
+// jobKindPublishHook is the job queue kind of publish hook notifications
+const jobKindPublishHook = "publish_hook"
+
+// githubRepo is an "owner/repo" publish hook target
+var githubRepo = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+// hookClient sends publish hook notifications
+var hookClient = &http.Client{Timeout: 30 * time.Second}
+
+func init() {
+	plugins.AfterPublish = queuePublishHooks
+	plugins.RegisterJobKind(jobKindPublishHook, runPublishHook)
+}
+
+// BuildHook is an incoming hook; Token is only set in the response creating it
+type BuildHook struct {
+	ID              string `json:"id"`
+	SiteID          string `json:"site_id"`
+	Name            string `json:"name" validate:"required,max=100"`
+	Token           string `json:"token,omitempty"`
+	URL             string `json:"url,omitempty"`
+	LastTriggeredAt int64  `json:"last_triggered_at,omitempty"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
+// PublishHook notifies a CI pipeline after the site publishes
+type PublishHook struct {
+	ID         string `json:"id"`
+	SiteID     string `json:"site_id"`
+	Type       string `json:"type" validate:"required,oneof=github|webhook"`
+	Target     string `json:"target" validate:"required,max=500"` // owner/repo or URL
+	EventType  string `json:"event_type,omitempty" validate:"max=100"`
+	APIURL     string `json:"api_url,omitempty" validate:"max=500"` // GitHub Enterprise
+	Active     bool   `json:"active"`
+	LastStatus string `json:"last_status,omitempty"`
+	LastError  string `json:"last_error,omitempty"`
+	LastSentAt int64  `json:"last_sent_at,omitempty"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// publishHookEvent is what a publish hook sends: the client_payload of a
+// repository_dispatch, or the body of a webhook
+type publishHookEvent struct {
+	Event     string `json:"event"`
+	HookID    string `json:"hook_id"`
+	SiteID    string `json:"site_id"`
+	NodeID    string `json:"node_id,omitempty"`
+	ChannelID string `json:"channel_id"`
+	JobID     string `json:"job_id"`
+	At        int64  `json:"published_at"`
+}
+
+// GET/POST/DELETE ?id= /api/sites/{id}/build-hooks
+func handleBuildHooks(w http.ResponseWriter, r *http.Request, siteID string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !canManageSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "only site owners can manage build hooks")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		rows, err := db.Query(`SELECT id, name, COALESCE(last_triggered_at, 0), created_at FROM build_hooks WHERE site_id = ? ORDER BY created_at`, siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		defer rows.Close()
+		hooks := []BuildHook{}
+		for rows.Next() {
+			h := BuildHook{SiteID: siteID}
+			if err := rows.Scan(&h.ID, &h.Name, &h.LastTriggeredAt, &h.CreatedAt); err != nil {
+				apierror.Internal(w, r, err)
+				return
+			}
+			hooks = append(hooks, h)
+		}
+		if err := rows.Err(); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(hooks)
+	case "POST":
+		var h BuildHook
+		if err := validate.DecodeJSON(r.Body, &h); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		var exists int
+		db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, siteID).Scan(&exists)
+		if exists == 0 {
+			apierror.Write(w, http.StatusNotFound, "site not found")
+			return
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		h.ID, h.SiteID, h.Token, h.CreatedAt = ids.New("bhook"), siteID, hex.EncodeToString(b), time.Now().Unix()
+		h.URL = requestBaseURL(r) + "/api/sites/" + url.PathEscape(siteID) + "/build-hook"
+		if _, err := db.Exec(`INSERT INTO build_hooks (id, site_id, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+			h.ID, siteID, h.Name, hashToken(h.Token), h.CreatedAt); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(h)
+	case "DELETE":
+		res, err := db.Exec(`DELETE FROM build_hooks WHERE id = ? AND site_id = ?`, r.URL.Query().Get("id"), siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, http.StatusNotFound, "build hook not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /api/sites/{id}/build-hook with the hook's token as a bearer token
+// or ?token=. Session auth doesn't apply; the token is the credential.
+func handleBuildHookTrigger(w http.ResponseWriter, r *http.Request, siteID string) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	var hookID string
+	if token == "" || db.QueryRow(`SELECT id FROM build_hooks WHERE site_id = ? AND token_hash = ?`, siteID, hashToken(token)).Scan(&hookID) != nil {
+		apierror.Write(w, http.StatusUnauthorized, "invalid build hook token")
+		return
+	}
+	db.Exec(`UPDATE build_hooks SET last_triggered_at = ? WHERE id = ?`, time.Now().Unix(), hookID)
+
+	jobs := queueStaticRebuilds(siteID, "")
+	if len(jobs) == 0 {
+		apierror.Write(w, http.StatusConflict, "the site has no active channel that builds or deploys it")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"hook_id": hookID, "site_id": siteID, "jobs": jobs})
+}
+
+// GET/POST/DELETE ?id= /api/sites/{id}/publish-hooks
+func handlePublishHooks(w http.ResponseWriter, r *http.Request, siteID string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !canManageSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "only site owners can manage publish hooks")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		hooks, err := publishHooks(siteID, false)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(hooks)
+	case "POST":
+		h := PublishHook{Active: true}
+		if err := validate.DecodeJSON(r.Body, &h); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		var problems validate.Errors
+		switch {
+		case h.Type == "github" && !githubRepo.MatchString(h.Target):
+			problems.Add("target", "must be owner/repo")
+		case h.Type == "webhook" && !isHTTPURL(h.Target):
+			problems.Add("target", "must be an http(s) URL")
+		}
+		if h.APIURL != "" && !isHTTPURL(h.APIURL) {
+			problems.Add("api_url", "must be an http(s) URL")
+		}
+		if err := problems.Err(); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		var exists int
+		db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, siteID).Scan(&exists)
+		if exists == 0 {
+			apierror.Write(w, http.StatusNotFound, "site not found")
+			return
+		}
+		h.ID, h.SiteID, h.CreatedAt = ids.New("phook"), siteID, time.Now().Unix()
+		if _, err := db.Exec(`INSERT INTO publish_hooks (id, site_id, type, target, event_type, api_url, active, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			h.ID, siteID, h.Type, h.Target, h.EventType, h.APIURL, h.Active, h.CreatedAt); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(h)
+	case "DELETE":
+		res, err := db.Exec(`DELETE FROM publish_hooks WHERE id = ? AND site_id = ?`, r.URL.Query().Get("id"), siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, http.StatusNotFound, "publish hook not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// publishHooks lists a site's publish hooks, only the active ones if asked
+func publishHooks(siteID string, activeOnly bool) ([]PublishHook, error) {
+	query := `SELECT id, type, target, COALESCE(event_type, ''), COALESCE(api_url, ''), COALESCE(active, 0),
+		COALESCE(last_status, ''), COALESCE(last_error, ''), COALESCE(last_sent_at, 0), created_at FROM publish_hooks WHERE site_id = ?`
+	if activeOnly {
+		query += ` AND active = 1`
+	}
+	rows, err := db.Query(query+` ORDER BY created_at`, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []PublishHook{}
+	for rows.Next() {
+		h := PublishHook{SiteID: siteID}
+		if err := rows.Scan(&h.ID, &h.Type, &h.Target, &h.EventType, &h.APIURL, &h.Active,
+			&h.LastStatus, &h.LastError, &h.LastSentAt, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// queuePublishHooks queues a notification on each active publish hook of the
+// site a successful publish job built: the channel's site_id, else the
+// node's site
+func queuePublishHooks(job plugins.PublishJob, channel plugins.PublishingChannel) {
+	siteID, _ := channel.Config["site_id"].(string)
+	if siteID == "" && job.NodeID != "" {
+		siteID, _, _ = nodeAccess(job.NodeID)
+	}
+	if siteID == "" {
+		return
+	}
+	hooks, err := publishHooks(siteID, true)
+	if err != nil {
+		return
+	}
+	for _, h := range hooks {
+		ev := publishHookEvent{Event: "publish", HookID: h.ID, SiteID: siteID, NodeID: job.NodeID,
+			ChannelID: channel.ID, JobID: job.ID, At: time.Now().Unix()}
+		if _, err := plugins.EnqueueJob(jobKindPublishHook, ev); err != nil {
+			log.Printf("publish hook %s: %v", h.ID, err)
+		}
+	}
+}
+
+// runPublishHook sends one notification. Rejections other than rate limits
+// fail at once; network errors and server errors are retried.
+func runPublishHook(ctx context.Context, job *plugins.Job) (interface{}, error) {
+	var ev publishHookEvent
+	if err := json.Unmarshal(job.Payload, &ev); err != nil {
+		return nil, plugins.Permanent(err)
+	}
+	var h PublishHook
+	err := db.QueryRow(`SELECT type, target, COALESCE(event_type, ''), COALESCE(api_url, '') FROM publish_hooks WHERE id = ? AND active = 1`, ev.HookID).
+		Scan(&h.Type, &h.Target, &h.EventType, &h.APIURL)
+	if err != nil {
+		return nil, plugins.Permanent(fmt.Errorf("publish hook %s is gone or inactive", ev.HookID))
+	}
+
+	req, err := publishHookRequest(ctx, ev.HookID, h, ev)
+	if err != nil {
+		return nil, plugins.Permanent(err)
+	}
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		recordPublishHook(ev.HookID, "error", err.Error())
+		return nil, err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+		recordPublishHook(ev.HookID, resp.Status, err.Error())
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, plugins.Permanent(err)
+		}
+		return nil, err
+	}
+	recordPublishHook(ev.HookID, resp.Status, "")
+	return map[string]interface{}{"hook_id": ev.HookID, "status": resp.StatusCode}, nil
+}
+
+// publishHookRequest builds the request a hook sends for ev
+func publishHookRequest(ctx context.Context, hookID string, h PublishHook, ev publishHookEvent) (*http.Request, error) {
+	creds := plugins.GetCredentialManager()
+	switch h.Type {
+	case "github":
+		token, err := creds.GetCredential("hook/" + hookID + "/token")
+		if err != nil {
+			return nil, fmt.Errorf("no GitHub token: store one as hook/%s/token", hookID)
+		}
+		eventType := h.EventType
+		if eventType == "" {
+			eventType = "veil-publish"
+		}
+		api := strings.TrimSuffix(h.APIURL, "/")
+		if api == "" {
+			api = "https://api.github.com"
+		}
+		body, _ := json.Marshal(map[string]interface{}{"event_type": eventType, "client_payload": ev})
+		req, err := http.NewRequestWithContext(ctx, "POST", api+"/repos/"+h.Target+"/dispatches", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	case "webhook":
+		body, _ := json.Marshal(ev)
+		req, err := http.NewRequestWithContext(ctx, "POST", h.Target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Veil-Event", ev.Event)
+		if secret, err := creds.GetCredential("hook/" + hookID + "/secret"); err == nil {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			req.Header.Set("X-Veil-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		return req, nil
+	}
+	return nil, fmt.Errorf("unknown publish hook type %q", h.Type)
+}
+
+func recordPublishHook(id, status, errMsg string) {
+	db.Exec(`UPDATE publish_hooks SET last_status = ?, last_error = ?, last_sent_at = ? WHERE id = ?`, status, errMsg, time.Now().Unix(), id)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	plugins "veil/pkg/plugins"
+)
+
+func TestBuildAndPublishHooks(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	// jobs run in the background; keep them on the one in-memory connection
+	testDB.SetMaxOpenConns(1)
+	plugins.SetDB(testDB)
+	tmp, err := ioutil.TempDir("", "build-hooks-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1), ('s2', 'Bare', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'hello', 'a', 'text/markdown', 'published', 1, 1)`)
+	testDB.Exec(`INSERT INTO publishing_channels (id, name, type, config, active, created_at) VALUES
+		('ch1', 'Site', 'static', '{"output_dir": "public", "site_id": "s1"}', 1, 1)`)
+
+	dispatches := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		dispatches <- r
+		bodies <- b
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer github.Close()
+
+	mux := setupRoutes()
+	call := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := call("POST", "/api/sites/s1/build-hooks", `{"name": "CI"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create build hook: %d %s", rr.Code, rr.Body.String())
+	}
+	var hook BuildHook
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	if len(hook.Token) != 64 || !strings.HasSuffix(hook.URL, "/api/sites/s1/build-hook") {
+		t.Fatalf("a new build hook should come with its token and URL: %+v", hook)
+	}
+	if rr := call("GET", "/api/sites/s1/build-hooks", ""); strings.Contains(rr.Body.String(), hook.Token) {
+		t.Fatal("listing build hooks should not reveal tokens")
+	}
+
+	if rr := call("POST", "/api/sites/s1/publish-hooks", `{"type": "github", "target": "not a repo"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a bad repository should be rejected: %d", rr.Code)
+	}
+	rr = call("POST", "/api/sites/s1/publish-hooks", `{"type": "github", "target": "acme/site", "api_url": "`+github.URL+`"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create publish hook: %d %s", rr.Code, rr.Body.String())
+	}
+	var publishHook PublishHook
+	json.Unmarshal(rr.Body.Bytes(), &publishHook)
+	plugins.GetCredentialManager().StoreCredential("hook/"+publishHook.ID+"/token", "ghp_test")
+	defer plugins.GetCredentialManager().DeleteCredential("hook/" + publishHook.ID + "/token")
+
+	if rr := call("POST", "/api/sites/s1/build-hook", "", "Authorization", "Bearer wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("a wrong token should be refused: %d", rr.Code)
+	}
+	if rr := call("POST", "/api/sites/s2/build-hook?token="+hook.Token, ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("a token should only trigger its own site: %d", rr.Code)
+	}
+
+	queue := plugins.StartJobQueue(plugins.JobQueueConfig{Workers: 1, PollInterval: 5 * time.Millisecond, BaseBackoff: time.Millisecond})
+	defer queue.Stop()
+	rr = call("POST", "/api/sites/s1/build-hook", "", "Authorization", "Bearer "+hook.Token)
+	if rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), `"channel_id":"ch1"`) {
+		t.Fatalf("trigger: %d %s", rr.Code, rr.Body.String())
+	}
+
+	select {
+	case req := <-dispatches:
+		body := <-bodies
+		if req.URL.Path != "/repos/acme/site/dispatches" || req.Header.Get("Authorization") != "Bearer ghp_test" {
+			t.Fatalf("unexpected dispatch: %s %v", req.URL.Path, req.Header)
+		}
+		var dispatch struct {
+			EventType     string           `json:"event_type"`
+			ClientPayload publishHookEvent `json:"client_payload"`
+		}
+		json.Unmarshal(body, &dispatch)
+		if dispatch.EventType != "veil-publish" || dispatch.ClientPayload.SiteID != "s1" || dispatch.ClientPayload.ChannelID != "ch1" {
+			t.Fatalf("unexpected dispatch body: %s", body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("a successful publish should dispatch to GitHub")
+	}
+	if _, err := os.Stat(filepath.Join("public", "a.html")); err != nil {
+		t.Fatalf("the build hook should build the site: %v", err)
+	}
+
+	rr = call("POST", "/api/sites/s2/build-hooks", `{"name": "CI"}`)
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	if rr := call("POST", "/api/sites/s2/build-hook?token="+hook.Token, ""); rr.Code != http.StatusConflict {
+		t.Fatalf("a site without channels has nothing to build: %d", rr.Code)
+	}
+	if rr := call("DELETE", "/api/sites/s1/publish-hooks?id="+publishHook.ID, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete publish hook: %d", rr.Code)
+	}
+}
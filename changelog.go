@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	codexpkg "veil/pkg/codex"
+	"veil/pkg/ids"
+)
+
+// === Release Changelogs ===
+// A changelog lists the pages added, changed and removed between two codex
+// revisions (commit hashes, tags or branches). It can be read as JSON or
+// markdown, or saved as a "changelog" node so it shows up in the site feed.
+
+// buildChangelog compares two revisions and links every entry that is still
+// a node to its preview page. With siteID set, only that site's nodes are kept.
+func buildChangelog(from, to, siteID, baseURL string) (*codexpkg.Changelog, error) {
+	cl, err := codexRepo().Changelog(from, to)
+	if err != nil {
+		return nil, err
+	}
+	annotate := func(entries []codexpkg.ChangelogEntry) []codexpkg.ChangelogEntry {
+		out := []codexpkg.ChangelogEntry{}
+		for _, e := range entries {
+			nodeID := strings.TrimPrefix(e.URN, nodeURN(""))
+			var nodeSite, title string
+			var deleted *int64
+			found := nodeID != e.URN && db.QueryRow(`SELECT COALESCE(site_id, ''), COALESCE(title, ''), deleted_at FROM nodes WHERE id = ?`, nodeID).
+				Scan(&nodeSite, &title, &deleted) == nil
+			if siteID != "" && (!found || nodeSite != siteID) {
+				continue
+			}
+			if found {
+				if title != "" {
+					e.Title = title
+				}
+				if deleted == nil && nodeSite != "" {
+					e.Link = fmt.Sprintf("%s/preview/%s/%s", baseURL, nodeSite, nodeID)
+				}
+			}
+			out = append(out, e)
+		}
+		return out
+	}
+	cl.Added = annotate(cl.Added)
+	cl.Changed = annotate(cl.Changed)
+	cl.Removed = annotate(cl.Removed)
+	// removed pages have nowhere to link to
+	for i := range cl.Removed {
+		cl.Removed[i].Link = ""
+	}
+	return cl, nil
+}
+
+// GET /api/changelog?from=&to=&site_id=&format=json|markdown returns the
+// changelog between two revisions.
+// POST /api/changelog {from, to, site_id, title?, publish?} saves it as a
+// changelog node in the site; published changelogs appear in its RSS feed.
+func handleChangelog(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		From    string `json:"from"`
+		To      string `json:"to"`
+		SiteID  string `json:"site_id"`
+		Title   string `json:"title"`
+		Publish bool   `json:"publish"`
+	}
+	switch r.Method {
+	case "GET":
+		q := r.URL.Query()
+		req.From, req.To, req.SiteID = q.Get("from"), q.Get("to"), q.Get("site_id")
+	case "POST":
+		json.NewDecoder(r.Body).Decode(&req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if req.From == "" || req.To == "" {
+		apierror.Write(w, http.StatusBadRequest, "from and to required")
+		return
+	}
+
+	cl, err := buildChangelog(req.From, req.To, req.SiteID, requestBaseURL(r))
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if req.Title == "" {
+		req.Title = fmt.Sprintf("Changes from %s to %s", req.From, req.To)
+	}
+
+	if r.Method == "GET" {
+		if r.URL.Query().Get("format") == "markdown" {
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			w.Write([]byte(cl.Markdown(req.Title)))
+			return
+		}
+		json.NewEncoder(w).Encode(cl)
+		return
+	}
+
+	if req.SiteID == "" {
+		apierror.Write(w, http.StatusBadRequest, "site_id required to save a changelog")
+		return
+	}
+	var exists int
+	db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, req.SiteID).Scan(&exists)
+	if exists == 0 {
+		apierror.Write(w, http.StatusNotFound, "site not found")
+		return
+	}
+	if !canCreateInSite(r, req.SiteID) {
+		apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+		return
+	}
+
+	now := time.Now().Unix()
+	id := ids.New("node")
+	slug := slugify(req.Title)
+	content := cl.Markdown(req.Title)
+	status := "draft"
+	var publishedAt interface{}
+	if req.Publish {
+		status, publishedAt = "published", now
+	}
+	var owner interface{}
+	if uid := currentUserID(r); uid != "" {
+		owner = uid
+	}
+	meta, _ := json.Marshal(map[string]string{"from": cl.From, "to": cl.To})
+	if _, err := db.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, status, metadata, created_at, modified_at, owner_id)
+		VALUES (?, 'changelog', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, req.SiteID, "changelog/"+slug+".md", req.Title, content, slug, status, string(meta), now, now, owner); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current)
+		VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, 1)`,
+		ids.New("v"), id, content, req.Title, status, publishedAt, now, now)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":   id,
+		"status":    status,
+		"changelog": cl,
+	})
+}
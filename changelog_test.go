@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codexpkg "veil/pkg/codex"
+)
+
+func TestChangelogBetweenReleases(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "changelog-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	db.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Blog', 'blog', 1, 1), ('s2', 'Other', 'blog', 1, 1)`)
+	db.Exec(`INSERT INTO nodes (id, type, site_id, path, title, created_at, modified_at) VALUES
+		('n1', 'page', 's1', 'about.md', 'About us', 1, 1),
+		('n2', 'post', 's1', 'hello.md', 'Hello', 1, 1),
+		('n3', 'page', 's2', 'elsewhere.md', 'Elsewhere', 1, 1)`)
+
+	repo := codexRepo()
+	put := func(v map[string]interface{}) string {
+		b, _ := json.Marshal(v)
+		h, err := repo.PutObjectStream(bytes.NewReader(b), "application/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	about1 := put(map[string]interface{}{"urn": nodeURN("n1"), "type": "page", "title": "About", "content": "v1"})
+	about2 := put(map[string]interface{}{"urn": nodeURN("n1"), "type": "page", "title": "About", "content": "v2"})
+	hello := put(map[string]interface{}{"urn": nodeURN("n2"), "type": "post", "title": "Hello"})
+	other := put(map[string]interface{}{"urn": nodeURN("n3"), "type": "page", "title": "Elsewhere"})
+	c1 := &codexpkg.Commit{Timestamp: time.Now().Add(-time.Hour), Message: "v1", Objects: []string{about1}}
+	repo.PutCommit(c1)
+	c2 := &codexpkg.Commit{Parents: []string{c1.Hash}, Timestamp: time.Now(), Message: "v2", Objects: []string{about2, hello, other}}
+	repo.PutCommit(c2)
+	repo.SetRef("refs/tags/v1", c1.Hash)
+	repo.SetRef("refs/tags/v2", c2.Hash)
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+
+	if rr := do("GET", "/api/changelog?from=v0&to=v2", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown revision to 404, got %d", rr.Code)
+	}
+	var cl codexpkg.Changelog
+	json.NewDecoder(do("GET", "/api/changelog?from=v1&to=v2&site_id=s1", nil).Body).Decode(&cl)
+	if len(cl.Added) != 1 || cl.Added[0].Title != "Hello" || !strings.HasSuffix(cl.Added[0].Link, "/preview/s1/n2") ||
+		len(cl.Changed) != 1 || cl.Changed[0].Title != "About us" {
+		t.Fatalf("unexpected changelog: %+v", cl)
+	}
+	json.NewDecoder(do("GET", "/api/changelog?from=v1&to=v2", nil).Body).Decode(&cl)
+	if len(cl.Added) != 2 {
+		t.Fatalf("expected pages from every site without site_id: %+v", cl.Added)
+	}
+	md := do("GET", "/api/changelog?from=v1&to=v2&site_id=s1&format=markdown", nil).Body.String()
+	if !strings.Contains(md, "## Added") || !strings.Contains(md, "[Hello](") || strings.Contains(md, "Elsewhere") {
+		t.Fatalf("unexpected markdown:\n%s", md)
+	}
+
+	rr := do("POST", "/api/changelog", map[string]interface{}{"from": "v1", "to": "v2", "site_id": "s1", "title": "Release 2", "publish": true})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("save changelog: %d %s", rr.Code, rr.Body.String())
+	}
+	items, err := loadFeedItems("s1", "http://localhost", 10)
+	if err != nil || len(items) != 1 || items[0].Title != "Release 2" {
+		t.Fatalf("expected published changelog in the feed, got %+v %v", items, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Change Feed ===
+// /api/feed/changes.json lets mirrors and search indexes follow a vault's
+// published content without an account. It is a paged feed in the manner
+// of RFC 5005 archived feeds, built from the content_changes log (see
+// migrations/023_content_changes.sql). Without ?page the current document
+// lists the newest changes. It links to the newest archive page with
+// "prev-archive". Archive pages hold fixed ranges of the log, so once full
+// they never change and are served as immutable. A consumer reads the
+// current document and follows prev-archive links back to the last change
+// it has seen, then polls the current document with If-None-Match.
+
+// changesPageSize is the number of log entries per archive page. Pages are
+// ranges of seq, so changing it renumbers every page.
+const changesPageSize = 100
+
+// ContentChange is one entry of the change feed
+type ContentChange struct {
+	Seq       int64  `json:"seq"`
+	Action    string `json:"action"` // add, update or delete
+	NodeID    string `json:"node_id"`
+	SiteID    string `json:"site_id"`
+	Title     string `json:"title"`
+	URI       string `json:"uri"`
+	URL       string `json:"url,omitempty"` // the node's page; not set for deletes
+	ChangedAt string `json:"changed_at"`
+}
+
+// ChangeFeed is one document of the change feed. Links uses the RFC 5005 and
+// RFC 4287 relation names.
+type ChangeFeed struct {
+	Title   string            `json:"title"`
+	Archive bool              `json:"archive"` // an immutable archive page
+	Links   map[string]string `json:"links"`
+	Updated string            `json:"updated,omitempty"`
+	Items   []ContentChange   `json:"items"`
+}
+
+// GET /api/feed/changes.json[?page=N][&site_id=]
+func handleChangesFeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	siteID := q.Get("site_id")
+
+	var last int64
+	db.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM content_changes`).Scan(&last)
+	full := last / changesPageSize // archive pages that are complete
+
+	page := full + 1 // the current document
+	archive := false
+	if p := q.Get("page"); p != "" {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || n < 1 || n > full {
+			apierror.Write(w, http.StatusNotFound, "no such archive page")
+			return
+		}
+		page, archive = n, true
+	}
+
+	base := requestBaseURL(r)
+	link := func(page int64) string {
+		v := url.Values{}
+		if page > 0 {
+			v.Set("page", strconv.FormatInt(page, 10))
+		}
+		if siteID != "" {
+			v.Set("site_id", siteID)
+		}
+		if len(v) == 0 {
+			return base + "/api/feed/changes.json"
+		}
+		return base + "/api/feed/changes.json?" + v.Encode()
+	}
+	feed := ChangeFeed{Title: "Content changes", Archive: archive, Items: []ContentChange{},
+		Links: map[string]string{"self": link(page), "current": link(0)}}
+	if !archive {
+		feed.Links["self"] = link(0)
+	}
+	if page > 1 {
+		feed.Links["prev-archive"] = link(page - 1)
+	}
+	if archive && page < full {
+		feed.Links["next-archive"] = link(page + 1)
+	}
+	if siteID != "" {
+		feed.Title = "Content changes of " + siteID
+	}
+
+	items, err := loadContentChanges(base, siteID, (page-1)*changesPageSize, page*changesPageSize)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	feed.Items = items
+	if len(items) > 0 {
+		feed.Updated = items[0].ChangedAt
+	}
+
+	body, _ := json.MarshalIndent(feed, "", "  ")
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if archive {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// loadContentChanges returns the log entries with after < seq <= upTo,
+// newest first, of one site or of all of them
+func loadContentChanges(base, siteID string, after, upTo int64) ([]ContentChange, error) {
+	rows, err := db.Query(`SELECT seq, action, node_id, site_id, COALESCE(title, ''), uri, changed_at FROM content_changes
+		WHERE seq > ? AND seq <= ? AND (? = '' OR site_id = ?) ORDER BY seq DESC`, after, upTo, siteID, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []ContentChange{}
+	for rows.Next() {
+		var c ContentChange
+		var at int64
+		if err := rows.Scan(&c.Seq, &c.Action, &c.NodeID, &c.SiteID, &c.Title, &c.URI, &at); err != nil {
+			return nil, err
+		}
+		c.ChangedAt = time.Unix(at, 0).UTC().Format(time.RFC3339)
+		if c.Action != "delete" {
+			c.URL = fmt.Sprintf("%s/preview/%s/%s", base, c.SiteID, c.NodeID)
+		}
+		items = append(items, c)
+	}
+	return items, rows.Err()
+}
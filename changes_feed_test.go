@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChangesFeed(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	get := func(path string) (*httptest.ResponseRecorder, ChangeFeed) {
+		rr := httptest.NewRecorder()
+		setupRoutes().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var feed ChangeFeed
+		json.Unmarshal(rr.Body.Bytes(), &feed)
+		return rr, feed
+	}
+	exec := func(q string, args ...interface{}) {
+		if _, err := testDB.Exec(q, args...); err != nil {
+			t.Fatalf("%v: %s", err, q)
+		}
+	}
+
+	exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'one', 'a', 'published', 1, 1),
+		('draft', 'post', 's1', 'd.md', 'Draft', '', 'd', 'draft', 1, 1)`)
+	exec(`UPDATE nodes SET content = 'two' WHERE id = 'a'`)
+	exec(`UPDATE nodes SET backlink_count = 3 WHERE id = 'a'`)
+	exec(`UPDATE nodes SET content = 'still a draft' WHERE id = 'draft'`)
+	exec(`UPDATE nodes SET status = 'published' WHERE id = 'draft'`)
+	exec(`UPDATE nodes SET deleted_at = 5 WHERE id = 'a'`)
+
+	rr, feed := get("/api/feed/changes.json")
+	if rr.Code != 200 || feed.Archive {
+		t.Fatalf("current document: %d %s", rr.Code, rr.Body.String())
+	}
+	var got []string
+	for _, c := range feed.Items {
+		got = append(got, c.Action+" "+c.NodeID)
+	}
+	if fmt.Sprint(got) != "[delete a add draft update a add a]" {
+		t.Fatalf("unexpected changes, newest first: %v", got)
+	}
+	if del := feed.Items[0]; del.URI != "veil://s1/post/a" || del.Title != "A" || del.URL != "" {
+		t.Fatalf("a delete should keep what went: %+v", del)
+	}
+	if _, ok := feed.Links["prev-archive"]; ok {
+		t.Fatal("a short log has no archive pages")
+	}
+
+	// fill two archive pages
+	for i := 0; i < 2*changesPageSize; i++ {
+		exec(`UPDATE nodes SET content = ? WHERE id = 'draft'`, fmt.Sprint(i))
+	}
+	_, feed = get("/api/feed/changes.json")
+	if len(feed.Items) != 4 || feed.Links["prev-archive"] == "" {
+		t.Fatalf("the current document should hold what's past the full pages: %d items, %v", len(feed.Items), feed.Links)
+	}
+	rr, page := get("/api/feed/changes.json?page=1")
+	if !page.Archive || len(page.Items) != changesPageSize || page.Items[len(page.Items)-1].Seq != 1 ||
+		page.Links["next-archive"] == "" || page.Links["prev-archive"] != "" {
+		t.Fatalf("unexpected first archive page: %d items, %v", len(page.Items), page.Links)
+	}
+	if rr.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("archive pages should be cacheable forever: %q", rr.Header().Get("Cache-Control"))
+	}
+	req := httptest.NewRequest("GET", "/api/feed/changes.json?page=1", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	setupRoutes().ServeHTTP(rr, req)
+	if rr.Code != 304 {
+		t.Fatalf("a matching ETag should give 304, got %d", rr.Code)
+	}
+	if rr, _ := get("/api/feed/changes.json?page=3"); rr.Code != 404 {
+		t.Fatalf("the current page is not an archive page: %d", rr.Code)
+	}
+	if _, feed := get("/api/feed/changes.json?site_id=other"); len(feed.Items) != 0 {
+		t.Fatalf("site_id should filter: %+v", feed.Items)
+	}
+}
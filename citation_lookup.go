@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/validate"
+)
+
+// === Citation lookup ===
+//
+// /api/citations/lookup turns a DOI, ISBN or arXiv ID into a citation of a
+// node. DOIs are read from Crossref as CSL-JSON, ISBNs from Open Library and
+// arXiv IDs from the arXiv API. Looking up an identifier the node already
+// cites refreshes that entry instead of adding a second one.
+
+// Where a looked up citation came from, kept in its citation_format
+const (
+	CitationFormatCrossref    = "crossref"
+	CitationFormatOpenLibrary = "openlibrary"
+	CitationFormatArXiv       = "arxiv"
+)
+
+// Metadata services, variables so tests can point them elsewhere
+var (
+	crossrefAPI    = "https://api.crossref.org"
+	openLibraryAPI = "https://openlibrary.org"
+	arxivAPI       = "https://export.arxiv.org/api"
+)
+
+// lookupClient fetches citation metadata
+var lookupClient = &http.Client{Timeout: 20 * time.Second}
+
+// lookupMaxResponse caps what a metadata service may answer
+const lookupMaxResponse = 4 << 20
+
+// errLookupNotFound is a service answering that it has no such work
+var errLookupNotFound = errors.New("no record of this identifier")
+
+var (
+	doiPattern      = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+	arxivNewPattern = regexp.MustCompile(`^\d{4}\.\d{4,5}(v\d+)?$`)
+	arxivOldPattern = regexp.MustCompile(`^[a-z-]+(\.[A-Z]{2})?/\d{7}(v\d+)?$`)
+)
+
+// parseCitationIdentifier works out what kind of identifier s is, returning
+// its kind (doi, isbn or arxiv) and normalized form
+func parseCitationIdentifier(s string) (kind, id string, ok bool) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	for _, prefix := range []string{"https://arxiv.org/abs/", "http://arxiv.org/abs/", "arxiv:"} {
+		if strings.HasPrefix(lower, prefix) {
+			s = s[len(prefix):]
+			if arxivNewPattern.MatchString(s) || arxivOldPattern.MatchString(s) {
+				return "arxiv", s, true
+			}
+			return "", "", false
+		}
+	}
+	if arxivNewPattern.MatchString(s) || arxivOldPattern.MatchString(s) {
+		return "arxiv", s, true
+	}
+	if strings.HasPrefix(lower, "isbn") {
+		s = strings.TrimLeft(s[4:], ": ")
+	}
+	if isbn := strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(s)); validISBN(isbn) {
+		return "isbn", isbn, true
+	}
+	c := Citation{DOI: s}
+	normalizeCitation(&c)
+	if doiPattern.MatchString(c.DOI) {
+		return "doi", c.DOI, true
+	}
+	return "", "", false
+}
+
+// validISBN checks the length and check digit of an ISBN-10 or ISBN-13
+func validISBN(s string) bool {
+	switch len(s) {
+	case 10:
+		sum := 0
+		for i, r := range s {
+			d := int(r - '0')
+			if r == 'X' && i == 9 {
+				d = 10
+			} else if r < '0' || r > '9' {
+				return false
+			}
+			sum += (10 - i) * d
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, r := range s {
+			if r < '0' || r > '9' {
+				return false
+			}
+			if i%2 == 1 {
+				sum += 3 * int(r-'0')
+			} else {
+				sum += int(r - '0')
+			}
+		}
+		return sum%10 == 0
+	}
+	return false
+}
+
+// CitationLookupRequest is what /api/citations/lookup takes. Identifier is
+// a DOI, ISBN or arXiv ID, in any of their usual spellings.
+type CitationLookupRequest struct {
+	NodeID      string `json:"node_id" validate:"required"`
+	Identifier  string `json:"identifier" validate:"required,max=500"`
+	CitationKey string `json:"citation_key" validate:"max=255"`
+}
+
+// POST /api/citations/lookup {node_id, identifier, citation_key?} fetches an
+// identifier's metadata and stores it as a citation of the node. Needs edit
+// rights on the node.
+func handleCitationLookup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req CitationLookupRequest
+	if err := validate.DecodeJSON(r.Body, &req); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	kind, id, ok := parseCitationIdentifier(req.Identifier)
+	if !ok {
+		validate.WriteError(w, validate.Errors{{Field: "identifier", Message: "must be a DOI, ISBN or arXiv ID"}})
+		return
+	}
+	if !checkCitationNode(w, r, req.NodeID) {
+		return
+	}
+
+	c, err := lookupCitation(r.Context(), kind, id)
+	if err != nil {
+		status := http.StatusBadGateway
+		if err == errLookupNotFound {
+			status = http.StatusNotFound
+		}
+		apierror.Write(w, status, fmt.Sprintf("%s %s: %v", kind, id, err))
+		return
+	}
+	c.NodeID = req.NodeID
+	normalizeCitation(&c)
+	if err := validate.Struct(&c).Err(); err != nil {
+		apierror.Write(w, http.StatusBadGateway, fmt.Sprintf("%s %s: unusable metadata: %v", kind, id, err))
+		return
+	}
+
+	// an identifier the node already cites refreshes that entry
+	var existing string
+	if c.DOI != "" {
+		db.QueryRow(`SELECT citation_key FROM citations WHERE node_id = ? AND LOWER(doi) = LOWER(?)`, c.NodeID, c.DOI).Scan(&existing)
+	}
+	if existing == "" && c.URL != "" {
+		db.QueryRow(`SELECT citation_key FROM citations WHERE node_id = ? AND url = ?`, c.NodeID, c.URL).Scan(&existing)
+	}
+	switch {
+	case req.CitationKey != "":
+		if uniqueCitationKey(c.NodeID, req.CitationKey, "", nil) != req.CitationKey && req.CitationKey != existing {
+			apierror.Write(w, http.StatusConflict, "the node already has a citation with this key")
+			return
+		}
+		c.CitationKey = req.CitationKey
+	case existing != "":
+		c.CitationKey = existing
+	default:
+		c.CitationKey = uniqueCitationKey(c.NodeID, defaultCitationKey(c), "", nil)
+	}
+	if existing != "" && existing != c.CitationKey {
+		db.Exec(`DELETE FROM citations WHERE node_id = ? AND citation_key = ?`, c.NodeID, existing)
+	}
+	if err := upsertCitation(&c); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	if existing != "" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(c)
+}
+
+// lookupCitation fetches the metadata of an identifier parseCitationIdentifier
+// recognised
+func lookupCitation(ctx context.Context, kind, id string) (Citation, error) {
+	switch kind {
+	case "doi":
+		return lookupDOI(ctx, id)
+	case "isbn":
+		return lookupISBN(ctx, id)
+	case "arxiv":
+		return lookupArXiv(ctx, id)
+	}
+	return Citation{}, fmt.Errorf("unknown identifier kind %q", kind)
+}
+
+// lookupGet fetches a metadata service URL
+func lookupGet(ctx context.Context, u, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "Veil/1.0 (citation lookup)")
+	resp, err := lookupClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errLookupNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, lookupMaxResponse))
+}
+
+// lookupDOI reads a DOI's record from Crossref in CSL-JSON
+func lookupDOI(ctx context.Context, doi string) (Citation, error) {
+	data, err := lookupGet(ctx, crossrefAPI+"/works/"+strings.ReplaceAll(url.PathEscape(doi), "%2F", "/")+"/transform/application/vnd.citationstyles.csl+json", "application/vnd.citationstyles.csl+json")
+	if err != nil {
+		return Citation{}, err
+	}
+	entries, err := parseCSLJSON(data)
+	if err != nil {
+		return Citation{}, fmt.Errorf("reading Crossref record: %v", err)
+	}
+	if len(entries) == 0 {
+		return Citation{}, errLookupNotFound
+	}
+	c := entries[0]
+	// Crossref ids are DOIs, which make poor keys
+	c.CitationKey = ""
+	if c.DOI == "" {
+		c.DOI = doi
+	}
+	c.CitationFormat = CitationFormatCrossref
+	return c, nil
+}
+
+// openLibraryBook is the part of an Open Library books API record citations
+// use
+type openLibraryBook struct {
+	Title    string `json:"title"`
+	Subtitle string `json:"subtitle"`
+	URL      string `json:"url"`
+	Authors  []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Publishers []struct {
+		Name string `json:"name"`
+	} `json:"publishers"`
+	PublishDate string `json:"publish_date"`
+}
+
+// lookupISBN reads an ISBN's record from Open Library
+func lookupISBN(ctx context.Context, isbn string) (Citation, error) {
+	q := url.Values{"bibkeys": {"ISBN:" + isbn}, "format": {"json"}, "jscmd": {"data"}}
+	data, err := lookupGet(ctx, openLibraryAPI+"/api/books?"+q.Encode(), "application/json")
+	if err != nil {
+		return Citation{}, err
+	}
+	var books map[string]openLibraryBook
+	if err := json.Unmarshal(data, &books); err != nil {
+		return Citation{}, fmt.Errorf("reading Open Library record: %v", err)
+	}
+	book, ok := books["ISBN:"+isbn]
+	if !ok {
+		return Citation{}, errLookupNotFound
+	}
+	c := Citation{EntryType: "book", Title: book.Title, Year: firstYear(book.PublishDate), URL: book.URL, CitationFormat: CitationFormatOpenLibrary}
+	if book.Subtitle != "" {
+		c.Title += ": " + book.Subtitle
+	}
+	var authors []string
+	for _, a := range book.Authors {
+		if a.Name != "" {
+			authors = append(authors, a.Name)
+		}
+	}
+	c.Authors = strings.Join(authors, " and ")
+	if len(book.Publishers) > 0 {
+		c.Publisher = book.Publishers[0].Name
+	}
+	return c, nil
+}
+
+// arxivFeed is the part of an arXiv API Atom feed citations use
+type arxivFeed struct {
+	Entries []struct {
+		ID         string `xml:"id"`
+		Title      string `xml:"title"`
+		Published  string `xml:"published"`
+		DOI        string `xml:"http://arxiv.org/schemas/atom doi"`
+		JournalRef string `xml:"http://arxiv.org/schemas/atom journal_ref"`
+		Authors    []struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+	} `xml:"entry"`
+}
+
+// lookupArXiv reads a preprint's record from the arXiv API
+func lookupArXiv(ctx context.Context, id string) (Citation, error) {
+	data, err := lookupGet(ctx, arxivAPI+"/query?"+url.Values{"id_list": {id}}.Encode(), "application/atom+xml")
+	if err != nil {
+		return Citation{}, err
+	}
+	var feed arxivFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		return Citation{}, fmt.Errorf("reading arXiv record: %v", err)
+	}
+	// an unknown id gives an entry without a title, or no entry at all
+	if len(feed.Entries) == 0 || strings.TrimSpace(feed.Entries[0].Title) == "" {
+		return Citation{}, errLookupNotFound
+	}
+	e := feed.Entries[0]
+	c := Citation{EntryType: "misc", Title: strings.Join(strings.Fields(e.Title), " "), Year: firstYear(e.Published),
+		Publication: "arXiv:" + id, Publisher: "arXiv", URL: "https://arxiv.org/abs/" + id, DOI: e.DOI, CitationFormat: CitationFormatArXiv}
+	if e.JournalRef != "" {
+		c.EntryType, c.Publication = "article", strings.Join(strings.Fields(e.JournalRef), " ")
+	}
+	var authors []string
+	for _, a := range e.Authors {
+		if name := strings.Join(strings.Fields(a.Name), " "); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	c.Authors = strings.Join(authors, " and ")
+	return c, nil
+}
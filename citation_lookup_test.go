@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseCitationIdentifier(t *testing.T) {
+	cases := []struct{ in, kind, id string }{
+		{"10.1145/359576.359579", "doi", "10.1145/359576.359579"},
+		{"https://doi.org/10.1145/359576.359579", "doi", "10.1145/359576.359579"},
+		{"doi:10.1038/nature14539", "doi", "10.1038/nature14539"},
+		{"978-0-262-03384-8", "isbn", "9780262033848"},
+		{"ISBN: 0-262-03384-4", "isbn", "0262033844"},
+		{"080442957X", "isbn", "080442957X"},
+		{"arXiv:1706.03762v5", "arxiv", "1706.03762v5"},
+		{"https://arxiv.org/abs/hep-th/9711200", "arxiv", "hep-th/9711200"},
+		{"2101.00001", "arxiv", "2101.00001"},
+	}
+	for _, c := range cases {
+		kind, id, ok := parseCitationIdentifier(c.in)
+		if !ok || kind != c.kind || id != c.id {
+			t.Errorf("%q: got %s %s %v, want %s %s", c.in, kind, id, ok, c.kind, c.id)
+		}
+	}
+	for _, bad := range []string{"978-0-262-03384-9", "hello", "11.1234/x", "arxiv:nope"} {
+		if kind, _, ok := parseCitationIdentifier(bad); ok {
+			t.Errorf("%q: expected no match, got %s", bad, kind)
+		}
+	}
+}
+
+func TestCitationLookup(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "citation-lookup-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	services := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/works/10.1145/359576.359579/transform/application/vnd.citationstyles.csl+json":
+			w.Write([]byte(`{"type": "article-journal", "id": "https://doi.org/10.1145/359576.359579", "title": "Time, clocks, and the ordering of events in a distributed system",
+				"author": [{"given": "Leslie", "family": "Lamport"}], "container-title": "Communications of the ACM", "publisher": "ACM",
+				"volume": "21", "issue": "7", "page": "558-565", "DOI": "10.1145/359576.359579", "issued": {"date-parts": [[1978, 7]]}}`))
+		case r.URL.Path == "/api/books" && r.URL.Query().Get("bibkeys") == "ISBN:9780262033848":
+			w.Write([]byte(`{"ISBN:9780262033848": {"title": "Introduction to Algorithms", "authors": [{"name": "Thomas H. Cormen"}, {"name": "Charles E. Leiserson"}],
+				"publishers": [{"name": "MIT Press"}], "publish_date": "2009", "url": "https://openlibrary.org/books/OL1M"}}`))
+		case r.URL.Path == "/api/books":
+			w.Write([]byte(`{}`))
+		case r.URL.Path == "/query" && r.URL.Query().Get("id_list") == "1706.03762":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom" xmlns:arxiv="http://arxiv.org/schemas/atom">
+  <entry>
+    <id>http://arxiv.org/abs/1706.03762v7</id>
+    <published>2017-06-12T17:57:34Z</published>
+    <title>Attention Is All
+      You Need</title>
+    <author><name>Ashish Vaswani</name></author>
+    <author><name>Noam Shazeer</name></author>
+  </entry>
+</feed>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer services.Close()
+	defer func(c, o, a string) { crossrefAPI, openLibraryAPI, arxivAPI = c, o, a }(crossrefAPI, openLibraryAPI, arxivAPI)
+	crossrefAPI, openLibraryAPI, arxivAPI = services.URL, services.URL, services.URL
+
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('site_a', 'Site A', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, created_at, modified_at) VALUES
+		('node_paper', 'note', 'site_a', 'paper.md', 'Paper', 'Body', 'text/markdown', 1, 1)`)
+
+	mux := setupRoutes()
+	lookup := func(identifier string) (*httptest.ResponseRecorder, Citation) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/citations/lookup", strings.NewReader(`{"node_id":"node_paper","identifier":"`+identifier+`"}`)))
+		var c Citation
+		json.Unmarshal(rr.Body.Bytes(), &c)
+		return rr, c
+	}
+
+	rr, c := lookup("https://doi.org/10.1145/359576.359579")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("DOI lookup: %d %s", rr.Code, rr.Body.String())
+	}
+	if c.CitationKey != "lamport1978" || c.EntryType != "article" || c.Publication != "Communications of the ACM" || c.Pages != "558–565" || c.CitationFormat != CitationFormatCrossref {
+		t.Fatalf("unexpected DOI citation: %+v", c)
+	}
+	// looking the same DOI up again refreshes the entry
+	if rr, again := lookup("10.1145/359576.359579"); rr.Code != http.StatusOK || again.ID != c.ID {
+		t.Fatalf("expected the second lookup to update %s, got %d %s", c.ID, rr.Code, rr.Body.String())
+	}
+
+	rr, c = lookup("978-0-262-03384-8")
+	if rr.Code != http.StatusCreated || c.EntryType != "book" || c.Publisher != "MIT Press" || c.Year != 2009 ||
+		c.Authors != "Thomas H. Cormen and Charles E. Leiserson" || c.CitationKey != "cormen2009" {
+		t.Fatalf("unexpected ISBN citation: %d %+v", rr.Code, c)
+	}
+
+	rr, c = lookup("arXiv:1706.03762")
+	if rr.Code != http.StatusCreated || c.Title != "Attention Is All You Need" || c.Year != 2017 || c.URL != "https://arxiv.org/abs/1706.03762" {
+		t.Fatalf("unexpected arXiv citation: %d %+v", rr.Code, c)
+	}
+
+	if rr, _ := lookup("9780306406157"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown ISBN to answer 404, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr, _ := lookup("not an identifier"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+
+	var count int
+	testDB.QueryRow(`SELECT COUNT(*) FROM citations WHERE node_id = 'node_paper'`).Scan(&count)
+	if count != 3 {
+		t.Fatalf("expected 3 citations, got %d", count)
+	}
+}
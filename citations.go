@@ -0,0 +1,1293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Citations ===
+//
+// A node's citations are its bibliography. /api/citations edits them one at a
+// time as JSON, imports whole BibTeX and CSL-JSON files (an entry whose key
+// the node already has is updated, so importing a file again refreshes it) and
+// exports them in either format. Entries are kept as fields rather than as
+// the file they came from: imported LaTeX is decoded to plain text, and
+// exports are written from the fields. Citations are formatted in APA, MLA or
+// Chicago (notes and bibliography) style, by /api/citations/render and below
+// the body of preview and exported pages. A node picks its style with
+// citation_style in its front matter, APA by default.
+
+// Citation styles
+const (
+	CitationStyleAPA     = "apa"
+	CitationStyleMLA     = "mla"
+	CitationStyleChicago = "chicago"
+)
+
+// Where a citation came from, kept in its citation_format
+const (
+	CitationFormatBibTeX  = "bibtex"
+	CitationFormatCSLJSON = "csl-json"
+	CitationFormatManual  = "manual"
+)
+
+// citationMaxImport caps the size of an imported bibliography
+const citationMaxImport = 8 << 20
+
+const citationColumns = `id, node_id, COALESCE(citation_key, ''), COALESCE(entry_type, ''), COALESCE(authors, ''), COALESCE(title, ''),
+	COALESCE(year, 0), COALESCE(publication, ''), COALESCE(publisher, ''), COALESCE(volume, ''), COALESCE(issue, ''), COALESCE(pages, ''),
+	COALESCE(url, ''), COALESCE(doi, ''), COALESCE(format, ''), COALESCE(raw_bibtex, '')`
+
+func scanCitation(row interface{ Scan(...interface{}) error }) (Citation, error) {
+	var c Citation
+	err := row.Scan(&c.ID, &c.NodeID, &c.CitationKey, &c.EntryType, &c.Authors, &c.Title, &c.Year, &c.Publication, &c.Publisher,
+		&c.Volume, &c.Issue, &c.Pages, &c.URL, &c.DOI, &c.CitationFormat, &c.RawBibtex)
+	return c, err
+}
+
+// nodeCitations returns a node's citations in bibliography order
+func nodeCitations(nodeID string) []Citation {
+	rows, err := db.Query(`SELECT `+citationColumns+` FROM citations WHERE node_id = ?`, nodeID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var out []Citation
+	for rows.Next() {
+		if c, err := scanCitation(rows); err == nil {
+			out = append(out, c)
+		}
+	}
+	sortCitations(out)
+	return out
+}
+
+// sortCitations orders entries by first author (or title when there is
+// none), then year, then title
+func sortCitations(cs []Citation) {
+	sortKey := func(c Citation) string {
+		if names := citationNames(c.Authors); len(names) > 0 {
+			return strings.ToLower(names[0].Family + " " + names[0].Given)
+		}
+		return strings.ToLower(c.Title)
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := sortKey(cs[i]), sortKey(cs[j])
+		if a != b {
+			return a < b
+		}
+		if cs[i].Year != cs[j].Year {
+			return cs[i].Year < cs[j].Year
+		}
+		return strings.ToLower(cs[i].Title) < strings.ToLower(cs[j].Title)
+	})
+}
+
+// pageRange is a range of pages written with hyphens, as in 12--19
+var pageRange = regexp.MustCompile(`(\w)\s*-+\s*(\w)`)
+
+// normalizeCitation tidies fields from any source
+func normalizeCitation(c *Citation) {
+	c.EntryType = strings.ToLower(strings.TrimSpace(c.EntryType))
+	if c.EntryType == "" {
+		c.EntryType = "misc"
+	}
+	c.DOI = strings.TrimSpace(c.DOI)
+	for _, prefix := range []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/", "doi:"} {
+		if len(c.DOI) >= len(prefix) && strings.EqualFold(c.DOI[:len(prefix)], prefix) {
+			c.DOI = c.DOI[len(prefix):]
+		}
+	}
+	c.Pages = pageRange.ReplaceAllString(strings.TrimSpace(c.Pages), "$1–$2")
+	c.Authors = strings.Join(strings.Fields(c.Authors), " ")
+}
+
+// uniqueCitationKey returns base, or base with a letter after it, that no
+// other citation of the node has. taken holds keys already used by the
+// entries being saved alongside.
+func uniqueCitationKey(nodeID, base, exceptID string, taken map[string]bool) string {
+	key := base
+	for n := 0; ; n++ {
+		if n > 0 {
+			key = base + string(rune('a'+(n-1)%26))
+			if n > 26 {
+				key += strconv.Itoa((n - 1) / 26)
+			}
+		}
+		var id string
+		err := db.QueryRow(`SELECT id FROM citations WHERE node_id = ? AND citation_key = ?`, nodeID, key).Scan(&id)
+		if !taken[key] && (err != nil || id == exceptID) {
+			return key
+		}
+	}
+}
+
+// defaultCitationKey is the author-year key BibTeX tools generate, like
+// smith2020
+func defaultCitationKey(c Citation) string {
+	base := "ref"
+	if names := citationNames(c.Authors); len(names) > 0 {
+		var b strings.Builder
+		for _, r := range strings.ToLower(names[0].Family) {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				b.WriteRune(r)
+			}
+		}
+		if b.Len() > 0 {
+			base = b.String()
+		}
+	}
+	if c.Year > 0 {
+		base += strconv.Itoa(c.Year)
+	}
+	return base
+}
+
+// upsertCitation stores an imported citation, updating the node's entry with
+// the same key if there is one
+func upsertCitation(c *Citation) error {
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO citations (id, node_id, citation_key, entry_type, authors, title, year, publication, publisher, volume, issue, pages, url, doi, format, raw_bibtex, created_at, modified_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(node_id, citation_key) DO UPDATE SET entry_type = excluded.entry_type, authors = excluded.authors, title = excluded.title,
+			year = excluded.year, publication = excluded.publication, publisher = excluded.publisher, volume = excluded.volume, issue = excluded.issue,
+			pages = excluded.pages, url = excluded.url, doi = excluded.doi, format = excluded.format, raw_bibtex = excluded.raw_bibtex, modified_at = excluded.modified_at`,
+		ids.New("cite"), c.NodeID, c.CitationKey, c.EntryType, c.Authors, c.Title, c.Year, c.Publication, c.Publisher, c.Volume, c.Issue, c.Pages,
+		c.URL, c.DOI, c.CitationFormat, nullIfEmpty(c.RawBibtex), now, now)
+	if err != nil {
+		return err
+	}
+	return db.QueryRow(`SELECT id FROM citations WHERE node_id = ? AND citation_key = ?`, c.NodeID, c.CitationKey).Scan(&c.ID)
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// GET    /api/citations?node_id=...[&format=bibtex|csl-json]  A node's citations, or a file of them
+// POST   /api/citations                     {node_id, title, authors, ...} adds one
+// POST   /api/citations?node_id=...&format=bibtex|csl-json    Imports a file sent as the body
+// PUT    /api/citations                     {id, ...} replaces one
+// DELETE /api/citations?id=...
+//
+// Imports may also be recognised by their Content-Type, application/x-bibtex
+// or application/vnd.citationstyles.csl+json. Changes need edit rights on the
+// node.
+func handleCitations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		switch strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]) {
+		case "application/x-bibtex", "text/x-bibtex":
+			format = CitationFormatBibTeX
+		case "application/vnd.citationstyles.csl+json":
+			format = CitationFormatCSLJSON
+		}
+	}
+	if format != "" && format != CitationFormatBibTeX && format != CitationFormatCSLJSON {
+		validate.WriteError(w, validate.Errors{{Field: "format", Message: "must be bibtex or csl-json"}})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		nodeID := r.URL.Query().Get("node_id")
+		if !citationNodeExists(nodeID) || !canReadNode(r, nodeID) {
+			apierror.Write(w, http.StatusNotFound, "node not found")
+			return
+		}
+		citations := nodeCitations(nodeID)
+		switch format {
+		case CitationFormatBibTeX:
+			w.Header().Set("Content-Type", "application/x-bibtex; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.bib"`, nodeID))
+			io.WriteString(w, formatBibTeX(citations))
+		case CitationFormatCSLJSON:
+			w.Header().Set("Content-Type", "application/vnd.citationstyles.csl+json")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, nodeID))
+			json.NewEncoder(w).Encode(formatCSLJSON(citations))
+		default:
+			if citations == nil {
+				citations = []Citation{}
+			}
+			json.NewEncoder(w).Encode(citations)
+		}
+	case "POST":
+		if format != "" {
+			importCitations(w, r, format)
+			return
+		}
+		var c Citation
+		verrs, _ := validate.DecodeJSON(r.Body, &c).(validate.Errors)
+		if c.NodeID == "" {
+			verrs.Add("node_id", "is required")
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		if !checkCitationNode(w, r, c.NodeID) {
+			return
+		}
+		normalizeCitation(&c)
+		if c.CitationKey == "" {
+			c.CitationKey = uniqueCitationKey(c.NodeID, defaultCitationKey(c), "", nil)
+		} else if uniqueCitationKey(c.NodeID, c.CitationKey, "", nil) != c.CitationKey {
+			apierror.Write(w, http.StatusConflict, "the node already has a citation with this key")
+			return
+		}
+		c.ID = ids.New("cite")
+		c.CitationFormat = CitationFormatManual
+		c.RawBibtex = ""
+		now := time.Now().Unix()
+		if _, err := db.Exec(`INSERT INTO citations (id, node_id, citation_key, entry_type, authors, title, year, publication, publisher, volume, issue, pages, url, doi, format, created_at, modified_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			c.ID, c.NodeID, c.CitationKey, c.EntryType, c.Authors, c.Title, c.Year, c.Publication, c.Publisher, c.Volume, c.Issue, c.Pages,
+			c.URL, c.DOI, c.CitationFormat, now, now); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	case "PUT":
+		var c Citation
+		verrs, _ := validate.DecodeJSON(r.Body, &c).(validate.Errors)
+		if c.ID == "" {
+			verrs.Add("id", "is required")
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		current, err := scanCitation(db.QueryRow(`SELECT `+citationColumns+` FROM citations WHERE id = ?`, c.ID))
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, "citation not found")
+			return
+		}
+		if !checkCitationNode(w, r, current.NodeID) {
+			return
+		}
+		// a citation stays with its node, and once edited no longer matches
+		// the entry it was imported from
+		c.NodeID, c.CitationFormat, c.RawBibtex = current.NodeID, current.CitationFormat, ""
+		normalizeCitation(&c)
+		if c.CitationKey == "" {
+			c.CitationKey = current.CitationKey
+		}
+		if uniqueCitationKey(c.NodeID, c.CitationKey, c.ID, nil) != c.CitationKey {
+			apierror.Write(w, http.StatusConflict, "the node already has a citation with this key")
+			return
+		}
+		db.Exec(`UPDATE citations SET citation_key = ?, entry_type = ?, authors = ?, title = ?, year = ?, publication = ?, publisher = ?,
+			volume = ?, issue = ?, pages = ?, url = ?, doi = ?, raw_bibtex = NULL, modified_at = ? WHERE id = ?`,
+			c.CitationKey, c.EntryType, c.Authors, c.Title, c.Year, c.Publication, c.Publisher, c.Volume, c.Issue, c.Pages, c.URL, c.DOI,
+			time.Now().Unix(), c.ID)
+		json.NewEncoder(w).Encode(c)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		var nodeID string
+		if db.QueryRow(`SELECT node_id FROM citations WHERE id = ?`, id).Scan(&nodeID) != nil {
+			apierror.Write(w, http.StatusNotFound, "citation not found")
+			return
+		}
+		if !checkCitationNode(w, r, nodeID) {
+			return
+		}
+		db.Exec(`DELETE FROM citations WHERE id = ?`, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func citationNodeExists(nodeID string) bool {
+	var one int
+	return nodeID != "" && db.QueryRow(`SELECT 1 FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).Scan(&one) == nil
+}
+
+// checkCitationNode answers 404 or 403 unless the request may change the
+// node's citations
+func checkCitationNode(w http.ResponseWriter, r *http.Request, nodeID string) bool {
+	if !citationNodeExists(nodeID) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return false
+	}
+	if !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's editors can change its citations")
+		return false
+	}
+	return true
+}
+
+// CitationImportSkip is an entry an import left out
+type CitationImportSkip struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// importCitations stores the entries of a BibTeX or CSL-JSON body
+func importCitations(w http.ResponseWriter, r *http.Request, format string) {
+	nodeID := r.URL.Query().Get("node_id")
+	if nodeID == "" {
+		validate.WriteError(w, validate.Errors{{Field: "node_id", Message: "is required"}})
+		return
+	}
+	if !checkCitationNode(w, r, nodeID) {
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, citationMaxImport+1))
+	if err != nil || len(data) > citationMaxImport {
+		apierror.Write(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("bibliographies are limited to %d bytes", citationMaxImport))
+		return
+	}
+	var entries []Citation
+	if format == CitationFormatBibTeX {
+		entries, err = parseBibTeX(string(data))
+	} else {
+		entries, err = parseCSLJSON(data)
+	}
+	if err != nil {
+		validate.WriteError(w, validate.Errors{{Message: "invalid " + format + ": " + err.Error()}})
+		return
+	}
+
+	imported := []Citation{}
+	skipped := []CitationImportSkip{}
+	taken := map[string]bool{}
+	for _, c := range entries {
+		c.NodeID, c.CitationFormat = nodeID, format
+		normalizeCitation(&c)
+		if err := validate.Struct(&c).Err(); err != nil {
+			skipped = append(skipped, CitationImportSkip{Key: c.CitationKey, Error: err.Error()})
+			continue
+		}
+		if c.CitationKey == "" {
+			c.CitationKey = uniqueCitationKey(nodeID, defaultCitationKey(c), "", taken)
+		} else if taken[c.CitationKey] {
+			skipped = append(skipped, CitationImportSkip{Key: c.CitationKey, Error: "key appears more than once in the file"})
+			continue
+		}
+		taken[c.CitationKey] = true
+		if err := upsertCitation(&c); err != nil {
+			skipped = append(skipped, CitationImportSkip{Key: c.CitationKey, Error: err.Error()})
+			continue
+		}
+		imported = append(imported, c)
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"imported": len(imported), "citations": imported, "skipped": skipped})
+}
+
+// CitationRender is a node's formatted bibliography
+type CitationRender struct {
+	NodeID string `json:"node_id"`
+	Style  string `json:"style"`
+	// HTML is the bibliography block pages show
+	HTML string `json:"html"`
+	// Entries are the formatted entries as plain text, in order
+	Entries []string `json:"entries"`
+}
+
+// GET /api/citations/render?node_id=...[&style=apa|mla|chicago] formats a
+// node's citations. The style defaults to the node's citation_style.
+func handleCitationsRender(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	nodeID := r.URL.Query().Get("node_id")
+	var metadata string
+	if db.QueryRow(`SELECT COALESCE(metadata, '') FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).Scan(&metadata) != nil || !canReadNode(r, nodeID) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+	style := r.URL.Query().Get("style")
+	if style == "" {
+		style = nodeCitationStyle(metadata)
+	}
+	if !validCitationStyle(style) {
+		validate.WriteError(w, validate.Errors{{Field: "style", Message: "must be apa, mla or chicago"}})
+		return
+	}
+	citations := nodeCitations(nodeID)
+	out := CitationRender{NodeID: nodeID, Style: style, HTML: bibliographyHTML(citations, style), Entries: []string{}}
+	for _, c := range citations {
+		out.Entries = append(out.Entries, html.UnescapeString(htmlTag.ReplaceAllString(formatCitation(c, style), "")))
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+func validCitationStyle(style string) bool {
+	return style == CitationStyleAPA || style == CitationStyleMLA || style == CitationStyleChicago
+}
+
+// nodeCitationStyle is the style a node's front matter asks for
+func nodeCitationStyle(metadata string) string {
+	var meta map[string]interface{}
+	json.Unmarshal([]byte(metadata), &meta)
+	if s, ok := meta["citation_style"].(string); ok && validCitationStyle(strings.ToLower(s)) {
+		return strings.ToLower(s)
+	}
+	return CitationStyleAPA
+}
+
+// nodeBibliography is the bibliography block rendered pages end with, empty
+// for nodes without citations
+func nodeBibliography(node Node) string {
+	if node.ID == "" {
+		return ""
+	}
+	citations := nodeCitations(node.ID)
+	if len(citations) == 0 {
+		return ""
+	}
+	return "\n" + bibliographyHTML(citations, nodeCitationStyle(node.Metadata))
+}
+
+// bibliographyHTML formats citations as a block in the markup citeproc
+// uses, so stylesheets written for it apply
+func bibliographyHTML(citations []Citation, style string) string {
+	if len(citations) == 0 {
+		return ""
+	}
+	heading := map[string]string{CitationStyleAPA: "References", CitationStyleMLA: "Works Cited", CitationStyleChicago: "Bibliography"}[style]
+	var b strings.Builder
+	fmt.Fprintf(&b, "<section class=\"bibliography bibliography-%s\">\n<h2>%s</h2>\n<div class=\"csl-bib-body\">\n", style, heading)
+	for _, c := range citations {
+		fmt.Fprintf(&b, "<div class=\"csl-entry\" id=\"ref-%s\">%s</div>\n", html.EscapeString(c.CitationKey), formatCitation(c, style))
+	}
+	b.WriteString("</div>\n</section>\n")
+	return b.String()
+}
+
+// citationName is one author. Literal names (organisations, written in
+// braces in BibTeX) are kept whole in Family.
+type citationName struct {
+	Family, Given string
+	Literal       bool
+}
+
+var citationAnd = regexp.MustCompile(`\s+and\s+`)
+
+// citationNames splits a BibTeX author list, "Family, Given and Given
+// Family and {Organisation}"
+func citationNames(authors string) []citationName {
+	var out []citationName
+	for _, part := range splitTopLevel(strings.TrimSpace(authors), citationAnd) {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+			continue
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			out = append(out, citationName{Family: part[1 : len(part)-1], Literal: true})
+		case strings.Contains(part, ","):
+			family, given, _ := strings.Cut(part, ",")
+			// "von Last, Jr, First" keeps the suffix with the family name
+			if suffix, first, ok := strings.Cut(given, ","); ok {
+				family, given = family+", "+strings.TrimSpace(suffix), first
+			}
+			out = append(out, citationName{Family: strings.TrimSpace(family), Given: strings.TrimSpace(given)})
+		default:
+			words := strings.Fields(part)
+			out = append(out, citationName{Family: words[len(words)-1], Given: strings.Join(words[:len(words)-1], " ")})
+		}
+	}
+	return out
+}
+
+// splitTopLevel splits s at matches of sep outside braces
+func splitTopLevel(s string, sep *regexp.Regexp) []string {
+	var parts []string
+	start, depth := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		default:
+			if depth == 0 {
+				if loc := sep.FindStringIndex(s[i:]); loc != nil && loc[0] == 0 && loc[1] > 0 {
+					parts = append(parts, s[start:i])
+					i += loc[1] - 1
+					start = i + 1
+				}
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// initials turns "John Ronald" into "J. R." and "Jean-Paul" into "J.-P."
+func initials(given string) string {
+	var words []string
+	for _, w := range strings.Fields(given) {
+		var parts []string
+		for _, p := range strings.Split(w, "-") {
+			if r := []rune(p); len(r) > 0 {
+				parts = append(parts, string(r[0])+".")
+			}
+		}
+		words = append(words, strings.Join(parts, "-"))
+	}
+	return strings.Join(words, " ")
+}
+
+func (n citationName) familyFirst(initialsOnly bool) string {
+	if n.Literal || n.Given == "" {
+		return n.Family
+	}
+	if initialsOnly {
+		return n.Family + ", " + initials(n.Given)
+	}
+	return n.Family + ", " + n.Given
+}
+
+func (n citationName) givenFirst() string {
+	if n.Literal || n.Given == "" {
+		return n.Family
+	}
+	return n.Given + " " + n.Family
+}
+
+// citationAuthors formats the author list the way style wants it
+func citationAuthors(names []citationName, style string) string {
+	var out []string
+	switch style {
+	case CitationStyleAPA:
+		// APA lists up to 20 authors, and the last after an ellipsis past that
+		for i, n := range names {
+			if len(names) > 20 && i == 19 {
+				return strings.Join(out, ", ") + ", . . . " + names[len(names)-1].familyFirst(true)
+			}
+			out = append(out, n.familyFirst(true))
+		}
+		switch len(out) {
+		case 1:
+			return out[0]
+		case 2:
+			return out[0] + ", & " + out[1]
+		}
+		return strings.Join(out[:len(out)-1], ", ") + ", & " + out[len(out)-1]
+	case CitationStyleMLA:
+		switch len(names) {
+		case 1:
+			return names[0].familyFirst(false)
+		case 2:
+			return names[0].familyFirst(false) + ", and " + names[1].givenFirst()
+		}
+		return names[0].familyFirst(false) + ", et al."
+	}
+	// Chicago lists up to ten, then the first seven and et al.
+	if len(names) > 10 {
+		names = names[:7]
+		out = append(out, names[0].familyFirst(false))
+		for _, n := range names[1:] {
+			out = append(out, n.givenFirst())
+		}
+		return strings.Join(out, ", ") + ", et al."
+	}
+	out = append(out, names[0].familyFirst(false))
+	for _, n := range names[1:] {
+		out = append(out, n.givenFirst())
+	}
+	if len(out) == 1 {
+		return out[0]
+	}
+	return strings.Join(out[:len(out)-1], ", ") + ", and " + out[len(out)-1]
+}
+
+// withPeriod ends s with a period unless it already ends a sentence
+func withPeriod(s string) string {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.HasSuffix(s, ".") || strings.HasSuffix(s, "?") || strings.HasSuffix(s, "!") {
+		return s
+	}
+	return s + "."
+}
+
+// italicTitle is <em>Title</em>. with the period after the italics
+func italicTitle(title string) string {
+	title = strings.TrimSpace(title)
+	if withPeriod(title) == title {
+		return "<em>" + html.EscapeString(title) + "</em>"
+	}
+	return "<em>" + html.EscapeString(title) + "</em>."
+}
+
+// quotedTitle is "Title." with the period inside the quotes
+func quotedTitle(title string) string {
+	return "&ldquo;" + html.EscapeString(withPeriod(title)) + "&rdquo;"
+}
+
+// citationKind groups BibTeX entry types by how styles lay them out
+func citationKind(entryType string) string {
+	switch entryType {
+	case "article":
+		return "article"
+	case "book", "booklet", "manual", "proceedings", "phdthesis", "mastersthesis", "techreport":
+		return "book"
+	case "inproceedings", "incollection", "inbook", "conference":
+		return "chapter"
+	}
+	return "other"
+}
+
+// formatCitation formats one entry as HTML in style
+func formatCitation(c Citation, style string) string {
+	esc := html.EscapeString
+	names := citationNames(c.Authors)
+	kind := citationKind(c.EntryType)
+	year := ""
+	if c.Year > 0 {
+		year = strconv.Itoa(c.Year)
+	}
+	link := ""
+	if c.DOI != "" {
+		link = "https://doi.org/" + c.DOI
+	} else if c.URL != "" {
+		link = c.URL
+	}
+	var parts []string
+	add := func(s string) {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	italic := func(s string) string { return "<em>" + esc(s) + "</em>" }
+
+	switch style {
+	case CitationStyleAPA:
+		when := "(n.d.)."
+		if year != "" {
+			when = "(" + year + ")."
+		}
+		title := esc(withPeriod(c.Title))
+		if kind == "book" || kind == "other" {
+			title = italicTitle(c.Title)
+		}
+		if len(names) > 0 {
+			add(esc(withPeriod(citationAuthors(names, style))) + " " + when)
+			add(title)
+		} else {
+			add(title + " " + when)
+		}
+		switch kind {
+		case "article":
+			source := italic(c.Publication)
+			if c.Volume != "" {
+				source += ", " + italic(c.Volume)
+				if c.Issue != "" {
+					source += "(" + esc(c.Issue) + ")"
+				}
+			}
+			if c.Pages != "" {
+				source += ", " + esc(c.Pages)
+			}
+			if c.Publication != "" {
+				add(source + ".")
+			}
+		case "chapter":
+			if c.Publication != "" {
+				in := "In " + italic(c.Publication)
+				if c.Pages != "" {
+					in += " (pp. " + esc(c.Pages) + ")"
+				}
+				add(in + ".")
+			}
+			if c.Publisher != "" {
+				add(esc(withPeriod(c.Publisher)))
+			}
+		default:
+			if c.Publication != "" {
+				add(esc(withPeriod(c.Publication)))
+			}
+			if c.Publisher != "" {
+				add(esc(withPeriod(c.Publisher)))
+			}
+		}
+		add(esc(link))
+	case CitationStyleMLA:
+		if len(names) > 0 {
+			add(esc(withPeriod(citationAuthors(names, style))))
+		}
+		var container []string
+		if kind == "book" || kind == "other" {
+			add(italicTitle(c.Title))
+			if c.Publication != "" {
+				container = append(container, italic(c.Publication))
+			}
+		} else {
+			add(quotedTitle(c.Title))
+			if c.Publication != "" {
+				container = append(container, italic(c.Publication))
+			}
+			if c.Volume != "" {
+				container = append(container, "vol. "+esc(c.Volume))
+			}
+			if c.Issue != "" {
+				container = append(container, "no. "+esc(c.Issue))
+			}
+		}
+		if c.Publisher != "" && kind != "article" {
+			container = append(container, esc(c.Publisher))
+		}
+		if year != "" {
+			container = append(container, year)
+		}
+		if c.Pages != "" {
+			prefix := "p. "
+			if strings.Contains(c.Pages, "–") {
+				prefix = "pp. "
+			}
+			container = append(container, prefix+esc(c.Pages))
+		}
+		if link != "" {
+			container = append(container, esc(strings.TrimPrefix(strings.TrimPrefix(link, "https://"), "http://")))
+		}
+		if len(container) > 0 {
+			add(strings.Join(container, ", ") + ".")
+		}
+	default:
+		if len(names) > 0 {
+			add(esc(withPeriod(citationAuthors(names, style))))
+		}
+		switch kind {
+		case "article":
+			add(quotedTitle(c.Title))
+			source := italic(c.Publication)
+			if c.Volume != "" {
+				source += " " + esc(c.Volume)
+			}
+			if c.Issue != "" {
+				source += ", no. " + esc(c.Issue)
+			}
+			if year != "" {
+				source += " (" + year + ")"
+			}
+			if c.Pages != "" {
+				source += ": " + esc(c.Pages)
+			}
+			add(source + ".")
+		case "chapter":
+			add(quotedTitle(c.Title))
+			if c.Publication != "" {
+				in := "In " + italic(c.Publication)
+				if c.Pages != "" {
+					in += ", " + esc(c.Pages)
+				}
+				add(in + ".")
+			}
+			add(esc(publisherYear(c.Publisher, year)))
+		default:
+			add(italicTitle(c.Title))
+			if c.Publication != "" {
+				add(esc(withPeriod(c.Publication)))
+			}
+			add(esc(publisherYear(c.Publisher, year)))
+		}
+		if link != "" {
+			add(esc(link) + ".")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// publisherYear is Chicago's "Publisher, Year."
+func publisherYear(publisher, year string) string {
+	switch {
+	case publisher != "" && year != "":
+		return publisher + ", " + year + "."
+	case publisher != "":
+		return withPeriod(publisher)
+	case year != "":
+		return year + "."
+	}
+	return ""
+}
+
+// --- BibTeX ---
+
+// bibFields maps BibTeX fields onto citation fields. The first field an
+// entry has of each group wins.
+var bibFields = []struct {
+	names []string
+	set   func(c *Citation, v string)
+}{
+	{[]string{"title"}, func(c *Citation, v string) { c.Title = v }},
+	{[]string{"journal", "journaltitle", "booktitle", "series"}, func(c *Citation, v string) { c.Publication = v }},
+	{[]string{"publisher", "institution", "school", "organization"}, func(c *Citation, v string) { c.Publisher = v }},
+	{[]string{"volume"}, func(c *Citation, v string) { c.Volume = v }},
+	{[]string{"number", "issue"}, func(c *Citation, v string) { c.Issue = v }},
+	{[]string{"pages"}, func(c *Citation, v string) { c.Pages = v }},
+	{[]string{"url"}, func(c *Citation, v string) { c.URL = v }},
+	{[]string{"doi"}, func(c *Citation, v string) { c.DOI = v }},
+	{[]string{"year", "date"}, func(c *Citation, v string) { c.Year = firstYear(v) }},
+}
+
+var yearPattern = regexp.MustCompile(`\d{4}`)
+
+func firstYear(s string) int {
+	y, _ := strconv.Atoi(yearPattern.FindString(s))
+	return y
+}
+
+// bibMonths are the month macros BibTeX predefines
+var bibMonths = map[string]string{"jan": "January", "feb": "February", "mar": "March", "apr": "April", "may": "May", "jun": "June",
+	"jul": "July", "aug": "August", "sep": "September", "oct": "October", "nov": "November", "dec": "December"}
+
+// bibParser reads a BibTeX file
+type bibParser struct {
+	src    string
+	pos    int
+	macros map[string]string
+}
+
+func (p *bibParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.src[:min(p.pos, len(p.src))], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *bibParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// ident reads a name: an entry type, key part, field or macro name
+func (p *bibParser) ident() string {
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\r\n{}(),=#\"", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// braced reads a {...} group, returning what is inside
+func (p *bibParser) braced() (string, error) {
+	start, depth := p.pos, 0
+	for ; p.pos < len(p.src); p.pos++ {
+		switch p.src[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return p.src[start+1 : p.pos-1], nil
+			}
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unbalanced braces")
+}
+
+// value reads a field value: braced or quoted strings, numbers and macros,
+// joined with #
+func (p *bibParser) value() (string, error) {
+	var out strings.Builder
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return "", p.errorf("unexpected end of file")
+		}
+		switch c := p.src[p.pos]; {
+		case c == '{':
+			s, err := p.braced()
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(s)
+		case c == '"':
+			start, depth := p.pos, 0
+			for p.pos++; p.pos < len(p.src) && (p.src[p.pos] != '"' || depth > 0); p.pos++ {
+				if p.src[p.pos] == '{' {
+					depth++
+				} else if p.src[p.pos] == '}' {
+					depth--
+				}
+			}
+			if p.pos >= len(p.src) {
+				p.pos = start
+				return "", p.errorf("unterminated string")
+			}
+			out.WriteString(p.src[start+1 : p.pos])
+			p.pos++
+		default:
+			name := p.ident()
+			if name == "" {
+				return "", p.errorf("expected a value")
+			}
+			if m, ok := p.macros[strings.ToLower(name)]; ok {
+				out.WriteString(m)
+			} else if m, ok := bibMonths[strings.ToLower(name)]; ok {
+				out.WriteString(m)
+			} else {
+				out.WriteString(name)
+			}
+		}
+		p.skipSpace()
+		if p.pos < len(p.src) && p.src[p.pos] == '#' {
+			p.pos++
+			continue
+		}
+		return out.String(), nil
+	}
+}
+
+// parseBibTeX reads the entries of a BibTeX file. @string macros are
+// expanded, @comment and @preamble skipped, and text outside entries ignored
+// as BibTeX does.
+func parseBibTeX(src string) ([]Citation, error) {
+	p := &bibParser{src: src, macros: map[string]string{}}
+	var out []Citation
+	for {
+		at := strings.IndexByte(p.src[p.pos:], '@')
+		if at < 0 {
+			return out, nil
+		}
+		start := p.pos + at
+		p.pos = start + 1
+		p.skipSpace()
+		kind := strings.ToLower(p.ident())
+		p.skipSpace()
+		if p.pos >= len(p.src) || (p.src[p.pos] != '{' && p.src[p.pos] != '(') {
+			if kind == "comment" {
+				continue
+			}
+			return nil, p.errorf("expected { after @%s", kind)
+		}
+		closer := byte('}')
+		if p.src[p.pos] == '(' {
+			closer = ')'
+		}
+		switch kind {
+		case "comment", "preamble":
+			if closer == '}' {
+				if _, err := p.braced(); err != nil {
+					return nil, err
+				}
+			} else if end := strings.IndexByte(p.src[p.pos:], ')'); end >= 0 {
+				p.pos += end + 1
+			}
+			continue
+		}
+		p.pos++
+		var c Citation
+		fields := map[string]string{}
+		if kind != "string" {
+			p.skipSpace()
+			keyStart := p.pos
+			for p.pos < len(p.src) && p.src[p.pos] != ',' && p.src[p.pos] != closer {
+				p.pos++
+			}
+			c = Citation{EntryType: kind, CitationKey: strings.TrimSpace(p.src[keyStart:p.pos])}
+			if p.pos < len(p.src) && p.src[p.pos] == ',' {
+				p.pos++
+			}
+		}
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.src) {
+				p.pos = start
+				return nil, p.errorf("unterminated @%s entry", kind)
+			}
+			if p.src[p.pos] == closer {
+				p.pos++
+				break
+			}
+			name := strings.ToLower(p.ident())
+			p.skipSpace()
+			if name == "" || p.pos >= len(p.src) || p.src[p.pos] != '=' {
+				return nil, p.errorf("expected field = value in @%s{%s", kind, c.CitationKey)
+			}
+			p.pos++
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = v
+			p.skipSpace()
+			if p.pos < len(p.src) && p.src[p.pos] == ',' {
+				p.pos++
+			}
+		}
+		if kind == "string" {
+			for name, v := range fields {
+				p.macros[name] = v
+			}
+			continue
+		}
+		for _, f := range bibFields {
+			for _, name := range f.names {
+				if v, ok := fields[name]; ok {
+					f.set(&c, strings.TrimSpace(decodeLaTeX(v)))
+					break
+				}
+			}
+		}
+		// edited books are cited by their editors
+		authors, ok := fields["author"]
+		if !ok {
+			authors = fields["editor"]
+		}
+		// braces around a whole name mark an organisation, so they stay
+		var names []string
+		for _, name := range splitTopLevel(authors, citationAnd) {
+			if name = strings.TrimSpace(strings.Join(strings.Fields(name), " ")); name == "" {
+				continue
+			}
+			if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") && !strings.HasPrefix(name, "{\\") {
+				names = append(names, "{"+decodeLaTeX(name[1:len(name)-1])+"}")
+			} else {
+				names = append(names, decodeLaTeX(name))
+			}
+		}
+		c.Authors = strings.Join(names, " and ")
+		c.RawBibtex = strings.TrimSpace(p.src[start:p.pos])
+		out = append(out, c)
+	}
+}
+
+var (
+	// symbol accents may be followed directly by their letter, as in \"o,
+	// letter accents need braces or a space, as in \c{c}
+	latexAccent  = regexp.MustCompile(`\\(?:([` + "`" + `'"^~=.])\s*(?:\{\\?([A-Za-z])\}|\\?([A-Za-z]))|([uvHcr])(?:\s*\{\\?([A-Za-z])\}|\s+\\?([A-Za-z])))`)
+	latexCommand = regexp.MustCompile(`\\(?:emph|textit|textbf|textsc|texttt|textrm|textsf|mbox|url|href\{[^{}]*\})\s*\{([^{}]*)\}`)
+	latexSymbol  = strings.NewReplacer(`\&`, "&", `\%`, "%", `\$`, "$", `\#`, "#", `\_`, "_", `\{`, "{", `\}`, "}",
+		`\ss`, "ß", `\o`, "ø", `\O`, "Ø", `\aa`, "å", `\AA`, "Å", `\ae`, "æ", `\AE`, "Æ", `\oe`, "œ", `\OE`, "Œ", `\l`, "ł", `\L`, "Ł",
+		`\i`, "ı", "---", "—", "--", "–", "``", "“", "''", "”", `\textendash`, "–", `\textemdash`, "—", "~", " ", `\ `, " ")
+	// latexAccents maps an accent command and letter to the accented letter
+	latexAccents = map[string]string{}
+)
+
+func init() {
+	for accent, pairs := range map[string]string{
+		`"`: "aäeëiïoöuüyÿAÄEËIÏOÖUÜYŸ", `'`: "aáeéiíoóuúyýcćnńsśzźAÁEÉIÍOÓUÚYÝCĆNŃSŚZŹ", "`": "aàeèiìoòuùAÀEÈIÌOÒUÙ",
+		"^": "aâeêiîoôuûAÂEÊIÎOÔUÛ", "~": "aãnñoõAÃNÑOÕ", "c": "cçsşCÇSŞ", "v": "cčsšzžrřeěnňCČSŠZŽRŘEĚNŇ",
+		"=": "aāeēiīoōuūAĀEĒIĪOŌUŪ", ".": "zżeėZŻ", "u": "aăgğAĂGĞ", "H": "oőuűOŐUŰ", "r": "aåuůAÅUŮ",
+	} {
+		runes := []rune(pairs)
+		for i := 0; i+1 < len(runes); i += 2 {
+			latexAccents[accent+string(runes[i])] = string(runes[i+1])
+		}
+	}
+}
+
+// decodeLaTeX turns the LaTeX in a BibTeX value into plain text: accents,
+// escaped symbols, dashes and formatting commands. Braces that only protect
+// capitalisation are dropped.
+func decodeLaTeX(s string) string {
+	s = latexAccent.ReplaceAllStringFunc(s, func(m string) string {
+		sub := latexAccent.FindStringSubmatch(m)
+		letter := sub[2] + sub[3] + sub[5] + sub[6]
+		if out, ok := latexAccents[sub[1]+sub[4]+letter]; ok {
+			return out
+		}
+		return letter
+	})
+	for prev := ""; prev != s; {
+		prev, s = s, latexCommand.ReplaceAllString(s, "$1")
+	}
+	s = latexSymbol.Replace(s)
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '{' || s[i] == '}' {
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+var bibEscape = strings.NewReplacer(`&`, `\&`, `%`, `\%`, `$`, `\$`, `#`, `\#`, `_`, `\_`, "–", "--", "—", "---")
+
+// formatBibTeX writes citations as a BibTeX file
+func formatBibTeX(citations []Citation) string {
+	var b strings.Builder
+	for i, c := range citations {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "@%s{%s", c.EntryType, c.CitationKey)
+		field := func(name, v string) {
+			if v != "" {
+				fmt.Fprintf(&b, ",\n  %s = {%s}", name, v)
+			}
+		}
+		field("author", bibEscape.Replace(c.Authors))
+		// double braces keep the title's capitalisation as written
+		if c.Title != "" {
+			field("title", "{"+bibEscape.Replace(c.Title)+"}")
+		}
+		container := "journal"
+		if citationKind(c.EntryType) != "article" {
+			container = "booktitle"
+		}
+		field(container, bibEscape.Replace(c.Publication))
+		field("publisher", bibEscape.Replace(c.Publisher))
+		if c.Year > 0 {
+			field("year", strconv.Itoa(c.Year))
+		}
+		field("volume", bibEscape.Replace(c.Volume))
+		field("number", bibEscape.Replace(c.Issue))
+		field("pages", bibEscape.Replace(c.Pages))
+		field("doi", c.DOI)
+		field("url", c.URL)
+		b.WriteString("\n}\n")
+	}
+	return b.String()
+}
+
+// --- CSL-JSON ---
+
+// cslString accepts CSL-JSON values that may be strings or numbers
+type cslString string
+
+func (s *cslString) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case string:
+		*s = cslString(v)
+	case float64:
+		*s = cslString(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return nil
+}
+
+type cslName struct {
+	Family  string `json:"family,omitempty"`
+	Given   string `json:"given,omitempty"`
+	Literal string `json:"literal,omitempty"`
+}
+
+type cslDate struct {
+	DateParts [][]interface{} `json:"date-parts,omitempty"`
+	Raw       string          `json:"raw,omitempty"`
+	Literal   string          `json:"literal,omitempty"`
+}
+
+// cslItem is the part of a CSL-JSON item citations keep
+type cslItem struct {
+	ID             cslString `json:"id"`
+	Type           string    `json:"type"`
+	Title          string    `json:"title,omitempty"`
+	Author         []cslName `json:"author,omitempty"`
+	Editor         []cslName `json:"editor,omitempty"`
+	Issued         *cslDate  `json:"issued,omitempty"`
+	ContainerTitle cslString `json:"container-title,omitempty"`
+	Publisher      string    `json:"publisher,omitempty"`
+	Volume         cslString `json:"volume,omitempty"`
+	Issue          cslString `json:"issue,omitempty"`
+	Page           cslString `json:"page,omitempty"`
+	DOI            string    `json:"DOI,omitempty"`
+	URL            string    `json:"URL,omitempty"`
+}
+
+// cslTypes maps CSL item types to BibTeX entry types. Types missing here
+// are misc.
+var cslTypes = map[string]string{
+	"article": "article", "article-journal": "article", "article-magazine": "article", "article-newspaper": "article",
+	"book": "book", "chapter": "incollection", "paper-conference": "inproceedings", "thesis": "phdthesis",
+	"report": "techreport", "manuscript": "unpublished",
+}
+
+// parseCSLJSON reads a CSL-JSON array of items, or a single item
+func parseCSLJSON(data []byte) ([]Citation, error) {
+	var items []cslItem
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		var item cslItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+		items = []cslItem{item}
+	} else if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	var out []Citation
+	for _, item := range items {
+		c := Citation{EntryType: cslTypes[item.Type], Title: item.Title, Publication: string(item.ContainerTitle), Publisher: item.Publisher,
+			Volume: string(item.Volume), Issue: string(item.Issue), Pages: string(item.Page), DOI: item.DOI, URL: item.URL}
+		// numeric ids are positions in the file, not keys worth keeping
+		if _, err := strconv.Atoi(string(item.ID)); err != nil {
+			c.CitationKey = string(item.ID)
+		}
+		if item.Issued != nil {
+			if len(item.Issued.DateParts) > 0 && len(item.Issued.DateParts[0]) > 0 {
+				c.Year = firstYear(fmt.Sprint(item.Issued.DateParts[0][0]))
+			} else {
+				c.Year = firstYear(item.Issued.Raw + " " + item.Issued.Literal)
+			}
+		}
+		names := item.Author
+		if len(names) == 0 {
+			names = item.Editor
+		}
+		var authors []string
+		for _, n := range names {
+			switch {
+			case n.Literal != "":
+				authors = append(authors, "{"+n.Literal+"}")
+			case n.Given != "":
+				authors = append(authors, n.Family+", "+n.Given)
+			case n.Family != "":
+				authors = append(authors, n.Family)
+			}
+		}
+		c.Authors = strings.Join(authors, " and ")
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// formatCSLJSON writes citations as CSL-JSON items
+func formatCSLJSON(citations []Citation) []cslItem {
+	bibTypes := map[string]string{}
+	for csl, bib := range cslTypes {
+		if _, ok := bibTypes[bib]; !ok || csl == "article-journal" {
+			bibTypes[bib] = csl
+		}
+	}
+	bibTypes["inbook"], bibTypes["inproceedings"], bibTypes["conference"] = "chapter", "paper-conference", "paper-conference"
+	bibTypes["mastersthesis"], bibTypes["proceedings"] = "thesis", "book"
+	out := []cslItem{}
+	for _, c := range citations {
+		item := cslItem{ID: cslString(c.CitationKey), Type: bibTypes[c.EntryType], Title: c.Title, ContainerTitle: cslString(c.Publication),
+			Publisher: c.Publisher, Volume: cslString(c.Volume), Issue: cslString(c.Issue), Page: cslString(c.Pages), DOI: c.DOI, URL: c.URL}
+		if item.Type == "" {
+			item.Type = "document"
+		}
+		if c.Year > 0 {
+			item.Issued = &cslDate{DateParts: [][]interface{}{{c.Year}}}
+		}
+		for _, n := range citationNames(c.Authors) {
+			if n.Literal {
+				item.Author = append(item.Author, cslName{Literal: n.Family})
+			} else {
+				item.Author = append(item.Author, cslName{Family: n.Family, Given: n.Given})
+			}
+		}
+		out = append(out, item)
+	}
+	return out
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testBibTeX = `@string{jacm = "Journal of the {ACM}"}
+
+Text outside entries is ignored.
+
+@article{knuth1974,
+  author = {Knuth, Donald E. and Moore, Ronald W.},
+  title = {An Analysis of {Alpha-Beta} Pruning},
+  journal = jacm,
+  year = 1974,
+  volume = {6},
+  number = {4},
+  pages = {293--326},
+  doi = {https://doi.org/10.1016/0004-3702(75)90019-3}
+}
+
+@book{godel,
+  author = "Kurt G{\"o}del",
+  title = {On Formally Undecidable Propositions},
+  publisher = {Basic Books},
+  year = {1962}
+}
+`
+
+func TestParseBibTeX(t *testing.T) {
+	entries, err := parseBibTeX(testBibTeX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	a := entries[0]
+	normalizeCitation(&a)
+	if a.CitationKey != "knuth1974" || a.EntryType != "article" || a.Publication != "Journal of the ACM" || a.Year != 1974 {
+		t.Fatalf("unexpected article: %+v", a)
+	}
+	if a.Title != "An Analysis of Alpha-Beta Pruning" || a.Pages != "293–326" || a.DOI != "10.1016/0004-3702(75)90019-3" {
+		t.Fatalf("unexpected article fields: %+v", a)
+	}
+	if entries[1].Authors != "Kurt Gödel" || entries[1].Publisher != "Basic Books" {
+		t.Fatalf("unexpected book: %+v", entries[1])
+	}
+
+	if _, err := parseBibTeX("@article{broken, title = {never closed"); err == nil {
+		t.Fatal("expected an error for an unterminated entry")
+	}
+}
+
+func TestFormatCitationStyles(t *testing.T) {
+	c := Citation{EntryType: "article", Authors: "Knuth, Donald E. and Moore, Ronald W.", Title: "An Analysis of Alpha-Beta Pruning",
+		Publication: "Artificial Intelligence", Year: 1975, Volume: "6", Issue: "4", Pages: "293–326"}
+	cases := map[string]string{
+		CitationStyleAPA:     "Knuth, D. E., &amp; Moore, R. W. (1975). An Analysis of Alpha-Beta Pruning. <em>Artificial Intelligence</em>, <em>6</em>(4), 293–326.",
+		CitationStyleMLA:     "Knuth, Donald E., and Ronald W. Moore. &ldquo;An Analysis of Alpha-Beta Pruning.&rdquo; <em>Artificial Intelligence</em>, vol. 6, no. 4, 1975, pp. 293–326.",
+		CitationStyleChicago: "Knuth, Donald E., and Ronald W. Moore. &ldquo;An Analysis of Alpha-Beta Pruning.&rdquo; <em>Artificial Intelligence</em> 6, no. 4 (1975): 293–326.",
+	}
+	for style, want := range cases {
+		if got := formatCitation(c, style); got != want {
+			t.Errorf("%s:\n got  %s\n want %s", style, got, want)
+		}
+	}
+}
+
+func TestCitationsImportExportAndRender(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "citations-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('site_a', 'Site A', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, metadata, created_at, modified_at) VALUES
+		('node_paper', 'note', 'site_a', 'paper.md', 'Paper', 'Body', 'text/markdown', '{"citation_style":"mla"}', 1, 1)`)
+
+	mux := setupRoutes()
+	do := func(method, url, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/api/citations?node_id=node_paper", "application/x-bibtex", testBibTeX)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("import: %d %s", rr.Code, rr.Body.String())
+	}
+	var result struct {
+		Imported int                  `json:"imported"`
+		Skipped  []CitationImportSkip `json:"skipped"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &result)
+	if result.Imported != 2 || len(result.Skipped) != 0 {
+		t.Fatalf("unexpected import result: %s", rr.Body.String())
+	}
+
+	// importing the file again updates the entries rather than adding copies
+	do("POST", "/api/citations?node_id=node_paper&format=bibtex", "", testBibTeX)
+	var citations []Citation
+	json.Unmarshal(do("GET", "/api/citations?node_id=node_paper", "", "").Body.Bytes(), &citations)
+	if len(citations) != 2 || citations[0].CitationKey != "godel" {
+		t.Fatalf("expected 2 citations sorted by author, got %+v", citations)
+	}
+
+	// a manual entry gets an author-year key
+	b, _ := json.Marshal(Citation{NodeID: "node_paper", Title: "Computing Machinery and Intelligence", Authors: "Turing, Alan", Year: 1950,
+		EntryType: "article", Publication: "Mind"})
+	rr = do("POST", "/api/citations", "application/json", string(b))
+	var turing Citation
+	json.Unmarshal(rr.Body.Bytes(), &turing)
+	if rr.Code != http.StatusCreated || turing.CitationKey != "turing1950" {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr = do("POST", "/api/citations", "application/json", `{"node_id":"node_paper","authors":"Nobody"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a missing title to be refused, got %d", rr.Code)
+	}
+
+	turing.Volume = "59"
+	b, _ = json.Marshal(turing)
+	if rr = do("PUT", "/api/citations", "application/json", string(b)); rr.Code != http.StatusOK {
+		t.Fatalf("update: %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do("GET", "/api/citations?node_id=node_paper&format=bibtex", "", "")
+	if !strings.Contains(rr.Body.String(), "@article{turing1950") || !strings.Contains(rr.Body.String(), "volume = {59}") {
+		t.Fatalf("unexpected BibTeX export: %s", rr.Body.String())
+	}
+	var items []map[string]interface{}
+	json.Unmarshal(do("GET", "/api/citations?node_id=node_paper&format=csl-json", "", "").Body.Bytes(), &items)
+	if len(items) != 3 || items[0]["type"] != "book" {
+		t.Fatalf("unexpected CSL-JSON export: %+v", items)
+	}
+
+	// the node's front matter picks MLA unless the request asks otherwise
+	var render CitationRender
+	json.Unmarshal(do("GET", "/api/citations/render?node_id=node_paper", "", "").Body.Bytes(), &render)
+	if render.Style != CitationStyleMLA || len(render.Entries) != 3 || !strings.Contains(render.HTML, "Works Cited") {
+		t.Fatalf("unexpected render: %+v", render)
+	}
+	json.Unmarshal(do("GET", "/api/citations/render?node_id=node_paper&style=apa", "", "").Body.Bytes(), &render)
+	if render.Entries[2] != "Turing, A. (1950). Computing Machinery and Intelligence. Mind, 59." {
+		t.Fatalf("unexpected APA entry: %q", render.Entries[2])
+	}
+	if rr = do("GET", "/api/citations/render?node_id=node_paper&style=ieee", "", ""); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown style to be refused, got %d", rr.Code)
+	}
+
+	rr = do("GET", "/preview/site_a/node_paper", "", "")
+	if !strings.Contains(rr.Body.String(), `<div class="csl-entry" id="ref-turing1950">`) {
+		t.Fatalf("expected the preview to end with the bibliography: %s", rr.Body.String())
+	}
+
+	if rr = do("DELETE", "/api/citations?id="+turing.ID, "", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rr.Code)
+	}
+	var count int
+	testDB.QueryRow(`SELECT COUNT(*) FROM citations WHERE node_id = 'node_paper'`).Scan(&count)
+	if count != 2 {
+		t.Fatalf("expected 2 citations after delete, got %d", count)
+	}
+}
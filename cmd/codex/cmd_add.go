@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"os"
 	"path/filepath"
 )
@@ -22,13 +23,13 @@ func runAdd(args []string) {
 		return
 	}
 	defer f.Close()
-	key, data, err := hashObject(f)
-	if err != nil {
-		fmt.Println("Error hashing file:", err)
-		return
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		ct = "application/octet-stream"
 	}
-	// write raw data as object
-	if err := writeObject(key, data); err != nil {
+	// stream the file into the object store
+	key, err := openRepo().PutObjectStreamWithFilename(f, ct, filepath.Base(path))
+	if err != nil {
 		fmt.Println("Error writing object:", err)
 		return
 	}
@@ -28,8 +28,11 @@ func runAnnotate(args []string) {
 	}
 	a := Annotation{TextURN: *text, EntityURN: *entity, Start: *start, End: *end, Certainty: *cert}
 	b, _ := json.MarshalIndent(a, "", "  ")
-	key, _, _ := hashObject(bytesReader(b))
-	_ = writeObject(key, b)
+	key, err := addObject(b, "")
+	if err != nil {
+		fmt.Println("Error writing object:", err)
+		return
+	}
 	_ = stageObject(key)
 	fmt.Printf("Annotated %s -> %s (object %s)\n", *text, *entity, key)
 }
@@ -1,50 +1,44 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"time"
+
+	codexpkg "veil/pkg/codex"
 )
 
 func runCommit(args []string) {
 	flags := flag.NewFlagSet("commit", flag.ExitOnError)
-	msg := flags.String("m", "", "Commit message")
+	msg := flags.String("m", "", "Commit message (or subject when a template is configured)")
+	typ := flags.String("type", "", "Conventional commit type used by the message template")
+	scope := flags.String("scope", "", "Conventional commit scope used by the message template")
+	body := flags.String("body", "", "Commit body used by the message template")
 	flags.Parse(args)
 	if *msg == "" {
-		fmt.Println("Usage: codex commit -m \"message\"")
+		fmt.Println("Usage: codex commit -m \"message\" [--type feat] [--scope nodes] [--body text]")
 		return
 	}
 	if err := ensureRepo(); err != nil {
 		fmt.Println(err)
 		return
 	}
-	idx, err := readIndex()
+	policy, err := codexpkg.LoadCommitPolicy(".")
 	if err != nil {
-		fmt.Println("Error reading index:", err)
+		fmt.Println("Error reading commit policy:", err)
 		return
 	}
-	parent, _ := getHEAD()
-	c := Commit{
-		Message:   *msg,
-		Parent:    parent,
-		Timestamp: time.Now().Unix(),
-		Objects:   idx,
+	if policy != nil && policy.Template != "" {
+		rendered, err := policy.Render(map[string]string{"type": *typ, "scope": *scope, "subject": *msg, "body": *body})
+		if err != nil {
+			fmt.Println("Error rendering commit template:", err)
+			return
+		}
+		*msg = rendered
 	}
-	b, _ := json.MarshalIndent(c, "", "  ")
-	hash, err := writeCommit(c)
+	c, err := commitIndex(*msg)
 	if err != nil {
-		fmt.Println("Error writing commit:", err)
-		return
-	}
-	if err := updateHeadCommit(hash); err != nil {
-		fmt.Println("Error updating HEAD:", err)
-		return
-	}
-	if err := clearIndex(); err != nil {
-		fmt.Println("Error clearing index:", err)
+		fmt.Println(err)
 		return
 	}
-	fmt.Printf("Committed %s\n", hash)
-	_ = b
+	fmt.Printf("Committed %s\n", c.Hash)
 }
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 )
 
 type Entity struct {
@@ -40,28 +39,14 @@ func runEntity(args []string) {
 			}
 		}
 		b, _ := json.MarshalIndent(e, "", "  ")
-		key, _, _ := hashObject(bytesReader(b))
-		_ = writeObject(key, b)
+		key, err := addObject(b, "")
+		if err != nil {
+			fmt.Println("Error writing object:", err)
+			return
+		}
 		_ = stageObject(key)
 		fmt.Printf("Added entity %s (object %s)\n", e.URN, key)
 	default:
 		fmt.Println("Unknown entity subcommand")
 	}
 }
-
-// helper to create io.Reader from bytes
-func bytesReader(b []byte) *readerWrapper { return &readerWrapper{data: b} }
-
-type readerWrapper struct {
-	data []byte
-	pos  int
-}
-
-func (r *readerWrapper) Read(p []byte) (int, error) {
-	if r.pos >= len(r.data) {
-		return 0, io.EOF
-	}
-	n := copy(p, r.data[r.pos:])
-	r.pos += n
-	return n, nil
-}
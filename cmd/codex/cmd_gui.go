@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"time"
+
+	codexpkg "veil/pkg/codex"
 )
 
 // runGUI starts a static-file server serving a small PWA and provides simple API endpoints
@@ -31,16 +34,7 @@ func runGUI(args []string) {
 	})
 
 	http.HandleFunc("/api/objects", func(w http.ResponseWriter, r *http.Request) {
-		// list object filenames
-		dir := filepath.Join(codexDir, "objects")
-		files, _ := ioutil.ReadDir(dir)
-		var keys []string
-		for _, f := range files {
-			name := f.Name()
-			if len(name) > 5 && name[len(name)-5:] == ".json" {
-				keys = append(keys, name[:len(name)-5])
-			}
-		}
+		keys, _ := openRepo().ListObjects("", 0, 0)
 		json.NewEncoder(w).Encode(keys)
 	})
 
@@ -54,12 +48,11 @@ func runGUI(args []string) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		key, _, err := hashObject(bytesReader(data))
+		key, err := addObject(data, "")
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		_ = writeObject(key, data)
 		_ = stageObject(key)
 		json.NewEncoder(w).Encode(map[string]string{"object": key})
 	})
@@ -74,12 +67,11 @@ func runGUI(args []string) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		key, _, err := hashObject(bytesReader(data))
+		key, err := addObject(data, "")
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		_ = writeObject(key, data)
 		_ = stageObject(key)
 		json.NewEncoder(w).Encode(map[string]string{"entity_object": key})
 	})
@@ -94,27 +86,23 @@ func runGUI(args []string) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		key, _, err := hashObject(bytesReader(data))
+		key, err := addObject(data, "")
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		_ = writeObject(key, data)
 		_ = stageObject(key)
 		json.NewEncoder(w).Encode(map[string]string{"annotation_object": key})
 	})
 
 	http.HandleFunc("/api/export", func(w http.ResponseWriter, r *http.Request) {
-		// Very small exporter: list commits and objects
+		// Very small exporter: list commits and JSON objects
 		commits, _ := listCommits()
-		dir := filepath.Join(codexDir, "objects")
-		files, _ := ioutil.ReadDir(dir)
+		repo := openRepo()
+		keys, _ := repo.ListObjects("", 0, 0)
 		var objs = map[string]json.RawMessage{}
-		for _, f := range files {
-			name := f.Name()
-			if len(name) > 5 && name[len(name)-5:] == ".json" {
-				key := name[:len(name)-5]
-				b, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		for _, key := range keys {
+			if b, err := repo.GetObject(key); err == nil && json.Valid(b) {
 				objs[key] = b
 			}
 		}
@@ -134,17 +122,17 @@ func runGUI(args []string) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		idx, _ := readIndex()
-		parent, _ := getHEAD()
-		c := Commit{Message: payload.Message, Parent: parent, Timestamp: time.Now().Unix(), Objects: idx}
-		hash, err := writeCommit(c)
+		c, err := commitIndex(payload.Message)
+		var msgErr *codexpkg.CommitMessageError
+		if errors.As(err, &msgErr) {
+			http.Error(w, msgErr.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		_ = updateHeadCommit(hash)
-		_ = clearIndex()
-		json.NewEncoder(w).Encode(map[string]string{"commit": hash})
+		json.NewEncoder(w).Encode(map[string]string{"commit": c.Hash})
 	})
 
 	// serve static files
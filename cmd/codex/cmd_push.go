@@ -1,50 +1,67 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"sort"
+
+	codexpkg "veil/pkg/codex"
 )
 
+// runPush replicates branches and tags to a codex remote: `codex server`, or
+// a veil instance at http://host:8080/api/codex/sync
 func runPush(args []string) {
-	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	runSync("push", args)
+}
+
+// runPull fetches branches and tags from a codex remote and fast-forwards
+// local refs
+func runPull(args []string) {
+	runSync("pull", args)
+}
+
+func runSync(cmd string, args []string) {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	token := flags.String("token", "", "Bearer token for the remote")
+	force := flags.Bool("force", false, "Move refs even when the update is not a fast-forward")
 	flags.Parse(args)
 	if flags.NArg() < 1 {
-		fmt.Println("Usage: codex push <remote-url>")
+		fmt.Printf("Usage: codex %s [-token T] [-force] <remote-url> [ref...]\n", cmd)
 		return
 	}
-	url := flags.Arg(0)
 	if err := ensureRepo(); err != nil {
 		fmt.Println(err)
 		return
 	}
-	head, err := getHEAD()
+	opts := codexpkg.SyncOptions{Token: *token, Force: *force, Refs: flags.Args()[1:]}
+	repo := openRepo()
+	run := repo.Push
+	if cmd == "pull" {
+		run = repo.Pull
+	}
+	res, err := run(flags.Arg(0), opts)
 	if err != nil {
-		fmt.Println("Error reading HEAD:", err)
+		fmt.Printf("Error during %s: %v\n", cmd, err)
 		return
 	}
-	if head == "" {
-		fmt.Println("Nothing to push: no commits")
-		return
+	fmt.Printf("%d commits, %d objects transferred (%d bytes)\n", res.Commits, res.Objects, res.Bytes)
+	if res.Chunks > 0 {
+		fmt.Printf("  %d chunks transferred, %d bytes of large objects already there\n", res.Chunks, res.Reused)
 	}
-	// read commit object
-	commitData, err := ioutil.ReadFile(".codex/objects/" + head + ".json")
-	if err != nil {
-		fmt.Println("Error reading commit object:", err)
-		return
+	var refs []string
+	for ref := range res.Updated {
+		refs = append(refs, ref)
 	}
-	// POST commit
-	resp, err := http.Post(url+"/push", "application/json", bytes.NewReader(commitData))
-	if err != nil {
-		fmt.Println("Error pushing to remote:", err)
-		return
+	sort.Strings(refs)
+	for _, ref := range refs {
+		fmt.Printf("  %s -> %s\n", ref, res.Updated[ref])
+	}
+	refs = refs[:0]
+	for ref := range res.Rejected {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		fmt.Printf("  ! %s: %s\n", ref, res.Rejected[ref])
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	var out map[string]interface{}
-	_ = json.Unmarshal(body, &out)
-	fmt.Println("Push response:", out)
 }
@@ -2,19 +2,46 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
-	"os"
+	"strings"
+
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
 )
 
+// runServer serves a repository as a codex remote (see codexpkg.NewServer for
+// the endpoints) so a headless box can receive pushes and serve pulls.
 func runServer(args []string) {
-	http.HandleFunc("/datasets", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"datasets": []string{"urn:codex:example/mvp@v1"}})
-	})
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "Listen address")
+	repoPath := flags.String("repo", ".", "Repository path")
+	token := flags.String("token", "", "Bearer token clients must present")
+	tokenFile := flags.String("token-file", "", "Read the bearer token from a file")
+	flags.Parse(args)
+
+	if *tokenFile != "" {
+		b, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Println("Error reading token file:", err)
+			return
+		}
+		*token = strings.TrimSpace(string(b))
+	}
+	if *token == "" {
+		log.Println("warning: serving without authentication; pass -token or -token-file")
+	}
 
-	http.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+	repo := codexpkg.NewRepository(fsstorage.New(*repoPath), *repoPath)
+	api := codexpkg.NewServer(repo, *token)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	// POST /push keeps `codex push` working: it stores a commit and moves main to it
+	mux.Handle("/push", codexpkg.RequireToken(*token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -24,28 +51,20 @@ func runServer(args []string) {
 			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		// store commit object
-		// compute key
-		key, data, err := hashObject(bytesReader(body))
+		c, err := codexpkg.UnmarshalCommit(body)
 		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			return
-		}
-		if err := os.MkdirAll(".codex/objects", 0o755); err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
+			http.Error(w, "bad request", http.StatusBadRequest)
 			return
 		}
-		if err := writeObject(key, data); err != nil {
+		if err := repo.PutCommit(c); err != nil {
 			http.Error(w, "internal error", http.StatusInternalServerError)
 			return
 		}
-		// update branch to this commit
-		_ = os.MkdirAll(".codex/refs/heads", 0o755)
-		_ = ioutil.WriteFile(".codex/refs/heads/main", []byte(key), 0o644)
+		_ = repo.SetRef(defaultHead, c.Hash)
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "commit": key})
-	})
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "commit": c.Hash})
+	})))
 
-	fmt.Println("Starting Codex mock server on :8080")
-	http.ListenAndServe(":8080", nil)
+	fmt.Printf("Serving codex repository %s on %s\n", *repoPath, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
 }
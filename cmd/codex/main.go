@@ -8,7 +8,7 @@ import (
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: codex <command> [args]")
-		fmt.Println("Commands: init, add, commit, status, entity, annotate, push, server")
+		fmt.Println("Commands: init, add, commit, status, entity, annotate, push, pull, server")
 		os.Exit(1)
 	}
 
@@ -28,6 +28,8 @@ func main() {
 		runAnnotate(os.Args[2:])
 	case "push":
 		runPush(os.Args[2:])
+	case "pull":
+		runPull(os.Args[2:])
 	case "server":
 		runServer(os.Args[2:])
 	case "gui":
@@ -1,23 +1,29 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
 )
 
 const codexDir = ".codex"
 
-type Commit struct {
-	Message   string   `json:"message"`
-	Parent    string   `json:"parent,omitempty"`
-	Timestamp int64    `json:"timestamp"`
-	Objects   []string `json:"objects"`
+// defaultHead is the branch ref new repositories point HEAD at
+const defaultHead = "refs/heads/main"
+
+// openRepo returns the pkg/codex repository rooted at the working directory,
+// so objects, commits and refs are shared with `veil serve`.
+func openRepo() *codexpkg.Repository {
+	return codexpkg.NewRepository(fsstorage.New("."), ".")
 }
 
 func ensureRepo() error {
@@ -34,15 +40,11 @@ func initRepo() error {
 	if err := os.MkdirAll(filepath.Join(codexDir, "objects"), 0o755); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Join(codexDir, "refs", "heads"), 0o755); err != nil {
-		return err
-	}
-	// create initial HEAD pointing to empty
-	if err := ioutil.WriteFile(filepath.Join(codexDir, "HEAD"), []byte("refs/heads/main"), 0o644); err != nil {
+	if err := os.MkdirAll(filepath.Join(codexDir, "refs"), 0o755); err != nil {
 		return err
 	}
-	// initial branch file
-	if err := ioutil.WriteFile(filepath.Join(codexDir, "refs", "heads", "main"), []byte(""), 0o644); err != nil {
+	// HEAD names the current branch ref; the ref itself is written on first commit
+	if err := ioutil.WriteFile(filepath.Join(codexDir, "HEAD"), []byte(defaultHead), 0o644); err != nil {
 		return err
 	}
 	// empty index
@@ -54,19 +56,13 @@ func initRepo() error {
 	return nil
 }
 
-func hashObject(r io.Reader) (string, []byte, error) {
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return "", nil, err
+// addObject stores data as a content-addressed object and returns its hash
+func addObject(data []byte, filename string) (string, error) {
+	ct := "application/json"
+	if !json.Valid(data) {
+		ct = http.DetectContentType(data)
 	}
-	h := sha256.Sum256(data)
-	key := hex.EncodeToString(h[:])
-	return key, data, nil
-}
-
-func writeObject(key string, data []byte) error {
-	dest := filepath.Join(codexDir, "objects", key+".json")
-	return ioutil.WriteFile(dest, data, 0o644)
+	return openRepo().PutObjectStreamWithFilename(bytes.NewReader(data), ct, filename)
 }
 
 func stageObject(key string) error {
@@ -101,71 +97,72 @@ func clearIndex() error {
 	return ioutil.WriteFile(filepath.Join(codexDir, "index.json"), b, 0o644)
 }
 
-func getHEAD() (string, error) {
-	headRef, err := ioutil.ReadFile(filepath.Join(codexDir, "HEAD"))
-	if err != nil {
-		return "", err
+// headRef returns the branch ref HEAD points at
+func headRef() string {
+	b, err := ioutil.ReadFile(filepath.Join(codexDir, "HEAD"))
+	if err != nil || strings.TrimSpace(string(b)) == "" {
+		return defaultHead
 	}
-	ref := string(headRef)
-	refPath := filepath.Join(codexDir, ref)
-	b, err := ioutil.ReadFile(refPath)
+	return strings.TrimSpace(string(b))
+}
+
+func getHEAD() (string, error) {
+	h, err := openRepo().GetRef(headRef())
 	if err != nil {
 		return "", nil // no commit yet
 	}
-	return string(b), nil
+	return h, nil
 }
 
 func updateHeadCommit(commitHash string) error {
-	headRef, err := ioutil.ReadFile(filepath.Join(codexDir, "HEAD"))
-	if err != nil {
-		return err
-	}
-	ref := string(headRef)
-	refPath := filepath.Join(codexDir, ref)
-	return ioutil.WriteFile(refPath, []byte(commitHash), 0o644)
+	return openRepo().SetRef(headRef(), commitHash)
 }
 
-func writeCommit(c Commit) (string, error) {
-	b, err := json.MarshalIndent(c, "", "  ")
+// commitIndex records the staged objects as a commit on top of HEAD and clears the index
+func commitIndex(message string) (*codexpkg.Commit, error) {
+	repo := openRepo()
+	if err := repo.ValidateCommitMessage(message); err != nil {
+		return nil, err
+	}
+	idx, err := readIndex()
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("reading index: %w", err)
 	}
-	h := sha256.Sum256(b)
-	key := hex.EncodeToString(h[:])
-	if err := writeObject(key, b); err != nil {
-		return "", err
+	c := &codexpkg.Commit{Message: message, Timestamp: time.Now().UTC(), Objects: idx}
+	if parent, _ := getHEAD(); parent != "" {
+		c.Parents = []string{parent}
 	}
-	return key, nil
-}
-
-// readObject returns raw bytes of an object by key
-func readObject(key string) ([]byte, error) {
-	p := filepath.Join(codexDir, "objects", key+".json")
-	return ioutil.ReadFile(p)
+	if err := repo.PutCommit(c); err != nil {
+		return nil, fmt.Errorf("writing commit: %w", err)
+	}
+	if err := updateHeadCommit(c.Hash); err != nil {
+		return nil, fmt.Errorf("updating HEAD: %w", err)
+	}
+	if err := clearIndex(); err != nil {
+		return nil, fmt.Errorf("clearing index: %w", err)
+	}
+	return c, nil
 }
 
-// listCommits walks commits from HEAD and returns Commit objects
-func listCommits() ([]Commit, error) {
+// listCommits walks first parents from HEAD and returns the commits
+func listCommits() ([]*codexpkg.Commit, error) {
 	head, err := getHEAD()
 	if err != nil {
 		return nil, err
 	}
-	if head == "" {
-		return []Commit{}, nil
-	}
-	var commits []Commit
+	commits := []*codexpkg.Commit{}
+	repo := openRepo()
 	cur := head
 	for cur != "" {
-		b, err := readObject(cur)
+		c, err := repo.GetCommit(cur)
 		if err != nil {
 			break
 		}
-		var c Commit
-		if err := json.Unmarshal(b, &c); err != nil {
-			break
-		}
 		commits = append(commits, c)
-		cur = c.Parent
+		cur = ""
+		if len(c.Parents) > 0 {
+			cur = c.Parents[0]
+		}
 	}
 	return commits, nil
 }
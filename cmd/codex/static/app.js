@@ -21,7 +21,7 @@ async function refreshCommits() {
     const d = document.createElement('div');
     d.style.padding = '6px';
     d.style.borderBottom = '1px solid rgba(255,255,255,0.02)';
-    d.innerHTML = `<strong>${c.message}</strong><div style="font-size:12px;color:#9aa7bf">${new Date(c.timestamp*1000).toLocaleString()}</div>`;
+    d.innerHTML = `<strong>${c.message}</strong><div style="font-size:12px;color:#9aa7bf">${new Date(c.timestamp).toLocaleString()}</div>`;
     el.appendChild(d);
   });
 }
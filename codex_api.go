@@ -1,24 +1,78 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"veil/pkg/apierror"
 	codexpkg "veil/pkg/codex"
 	fsstorage "veil/pkg/codex/storage/fs"
+	s3storage "veil/pkg/codex/storage/s3"
 )
 
+// codexCacheBytes caps the in-memory object/commit cache shared by the codex handlers
+var codexCacheBytes int64 = 64 << 20
+
+// codexS3 keeps codex objects and refs in an S3-compatible bucket instead of
+// ./.codex when set (see `veil serve --codex-s3-bucket`)
+var codexS3 *s3storage.Config
+
+// codexSyncToken enables /api/codex/sync/ for other veil instances and codex
+// clients; they must send it as a bearer token (see `veil serve --codex-sync-token`)
+var codexSyncToken string
+
+var (
+	codexReposMu sync.Mutex
+	codexRepos   = map[string]*codexpkg.Repository{}
+	codexTiers   = map[string]*coldTier{}
+)
+
+// codexRepo returns the shared repository for the working directory. Its storage
+// is wrapped in a read-through cache so hot objects and commits skip the disk,
+// and in a coldTier so unread blobs can move to cold storage.
+func codexRepo() *codexpkg.Repository {
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		dir = "."
+	}
+	codexReposMu.Lock()
+	defer codexReposMu.Unlock()
+	if repo, ok := codexRepos[dir]; ok {
+		return repo
+	}
+	var backend codexpkg.Storage = fsstorage.New(".")
+	if codexS3 != nil {
+		s3, err := s3storage.New(*codexS3)
+		if err != nil {
+			log.Printf("codex: S3 storage unavailable, using local .codex: %v", err)
+		} else {
+			backend = s3
+		}
+	}
+	tier := &coldTier{codexpkg.NewCachedStorage(backend, codexCacheBytes)}
+	repo := codexpkg.NewRepository(commitEvents{tier}, ".")
+	codexRepos[dir] = repo
+	codexTiers[dir] = tier
+	return repo
+}
+
 // GET /api/codex/status
 func handleCodexStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	repo := codexpkg.NewRepository(fsstorage.New("."), ".")
+	repo := codexRepo()
 	st, err := repo.Status()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	st["checked_at"] = time.Now().UTC().Format(time.RFC3339)
@@ -26,20 +80,26 @@ func handleCodexStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 // GET /api/codex/object?hash=...
+//
+// Objects are served with their hash as ETag and with byte ranges, so audio
+// and video players can seek.
 func handleCodexObject(w http.ResponseWriter, r *http.Request) {
-	fs := fsstorage.New(".")
+	repo := codexRepo()
 	switch r.Method {
 	case "GET":
 		h := r.URL.Query().Get("hash")
 		if h == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "hash required"})
+			apierror.Write(w, http.StatusBadRequest, "hash required")
+			return
+		}
+		rc, ct, err := repo.GetObjectStream(h)
+		var cold *ColdError
+		if errors.As(err, &cold) {
+			writeColdPending(w, cold)
 			return
 		}
-		rc, ct, err := fs.GetObjectStream(h)
 		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Write(w, http.StatusNotFound, err.Error())
 			return
 		}
 		defer rc.Close()
@@ -54,6 +114,29 @@ func handleCodexObject(w http.ResponseWriter, r *http.Request) {
 			// fallthrough to raw
 		}
 		w.Header().Set("Content-Type", ct)
+		w.Header().Set("ETag", `"`+h+`"`)
+		rs, ok := rc.(io.ReadSeeker)
+		if !ok && r.Header.Get("Range") != "" && isMediaStream(ct) {
+			// a backend that cannot seek, like S3, is spooled so the range
+			// can still be cut out of it
+			f, err := os.CreateTemp("", "veil-object-*")
+			if err == nil {
+				defer os.Remove(f.Name())
+				defer f.Close()
+				if _, err = io.Copy(f, rc); err == nil {
+					rs, ok = f, true
+				}
+			}
+			if err != nil {
+				w.Header().Set("Content-Type", "application/json")
+				apierror.Internal(w, r, err)
+				return
+			}
+		}
+		if ok {
+			http.ServeContent(w, r, "", time.Time{}, rs)
+			return
+		}
 		// stream raw bytes
 		_, _ = io.Copy(w, rc)
 	case "POST":
@@ -62,12 +145,25 @@ func handleCodexObject(w http.ResponseWriter, r *http.Request) {
 		if contentType == "" {
 			contentType = "application/octet-stream"
 		}
-		hash, err := fs.PutObjectStream(r.Body, contentType)
+		if limits.MaxMediaBytes > 0 && r.ContentLength > limits.MaxMediaBytes {
+			writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, r.ContentLength)
+			return
+		}
+		if !checkVaultRoom(w, r.ContentLength) {
+			return
+		}
+		limitMediaBody(w, r, 0)
+		cr := &countingBody{r: r.Body}
+		hash, err := repo.PutObjectStream(cr, contentType)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			if isBodyTooLarge(err) {
+				writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, cr.n)
+				return
+			}
+			apierror.Internal(w, r, err)
 			return
 		}
+		noteVaultWrite(cr.n)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]string{"status": "created", "hash": hash})
 	default:
@@ -75,6 +171,11 @@ func handleCodexObject(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// isMediaStream is true of audio and video content types
+func isMediaStream(contentType string) bool {
+	return strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/")
+}
+
 // POST /api/codex/query  { prefix: "" }
 func handleCodexQuery(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -82,34 +183,55 @@ func handleCodexQuery(w http.ResponseWriter, r *http.Request) {
 		Prefix string `json:"prefix"`
 	}
 	json.NewDecoder(r.Body).Decode(&req)
-	fs := fsstorage.New(".")
-	list, err := fs.ListObjects(req.Prefix)
+	list, err := codexRepo().ListObjects(req.Prefix, 0, 0)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(list), "objects": list})
 }
 
-// POST /api/codex/commit  (Commit JSON)
+// POST /api/codex/commit  (Commit JSON, optionally with "fields" rendered through the commit template)
 func handleCodexCommit(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var c codexpkg.Commit
-	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid commit payload"})
+	var req struct {
+		codexpkg.Commit
+		Fields map[string]string `json:"fields,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.Write(w, http.StatusBadRequest, "invalid commit payload")
 		return
 	}
+	c := req.Commit
 	if c.Hash == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "commit hash required"})
+		apierror.Write(w, http.StatusBadRequest, "commit hash required")
+		return
+	}
+	if !checkCommitObjects(w, len(c.Objects)) {
 		return
 	}
-	fs := fsstorage.New(".")
-	if err := fs.PutCommit(&c); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	repo := codexRepo()
+	policy, err := repo.CommitPolicy()
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	if c.Message == "" && len(req.Fields) > 0 {
+		msg, err := policy.Render(req.Fields)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Message = msg
+	}
+	if policy != nil {
+		if err := policy.Validate(c.Message); err != nil {
+			writeCommitMessageError(w, err)
+			return
+		}
+	}
+	if err := repo.PutCommit(&c); err != nil {
+		apierror.Internal(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
@@ -128,11 +250,10 @@ func handleCodexCommitsList(w http.ResponseWriter, r *http.Request) {
 	if o := q.Get("offset"); o != "" {
 		fmt.Sscanf(o, "%d", &offset)
 	}
-	repo := codexpkg.NewRepository(fsstorage.New("."), ".")
+	repo := codexRepo()
 	commits, err := repo.ListCommits(limit, offset)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(commits)
@@ -143,15 +264,12 @@ func handleCodexCommitGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	h := r.URL.Query().Get("hash")
 	if h == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "hash required"})
+		apierror.Write(w, http.StatusBadRequest, "hash required")
 		return
 	}
-	fs := fsstorage.New(".")
-	c, err := fs.GetCommit(h)
+	c, err := codexRepo().GetCommit(h)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Write(w, http.StatusNotFound, err.Error())
 		return
 	}
 	json.NewEncoder(w).Encode(c)
@@ -164,21 +282,21 @@ func handleCodexDiff(w http.ResponseWriter, r *http.Request) {
 	from := q.Get("from")
 	to := q.Get("to")
 	if from == "" || to == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "from and to required"})
+		apierror.Write(w, http.StatusBadRequest, "from and to required")
 		return
 	}
-	repo := codexpkg.NewRepository(fsstorage.New("."), ".")
+	repo := codexRepo()
 	diff, err := repo.DiffCommits(from, to)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	json.NewEncoder(w).Encode(diff)
 }
 
 // POST /api/codex/merge  { base:, ours:, theirs:, author:, message: }
+// A conflicting merge answers 409 with the conflicts and a merge_id to resolve
+// it through /api/codex/merges/{id} and /api/codex/merge/resolve.
 func handleCodexMerge(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	var req struct {
@@ -189,62 +307,302 @@ func handleCodexMerge(w http.ResponseWriter, r *http.Request) {
 		Message string `json:"message"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "invalid payload"})
+		apierror.Write(w, http.StatusBadRequest, "invalid payload")
 		return
 	}
-	repo := codexpkg.NewRepository(fsstorage.New("."), ".")
+	repo := codexRepo()
 	mcommit, conflicts, err := repo.MergeCommits(req.Base, req.Ours, req.Theirs, req.Author, req.Message)
+	var msgErr *codexpkg.CommitMessageError
+	if errors.As(err, &msgErr) {
+		writeCommitMessageError(w, msgErr)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	if len(conflicts) > 0 {
+		resp := map[string]interface{}{"conflicts": conflicts}
+		if st, err := createMergeState(r, req.Base, req.Ours, req.Theirs, req.Author, req.Message, conflicts); err == nil {
+			resp["merge_id"] = st.ID
+		} else {
+			log.Printf("codex merge: could not save merge state: %v", err)
+		}
 		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{"conflicts": conflicts})
+		json.NewEncoder(w).Encode(resp)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"hash": mcommit.Hash})
 }
 
+// POST /api/codex/merge/preview  { base:, ours:, theirs: }
+// Runs the merge without writing a commit so clients can show its effect first.
+func handleCodexMergePreview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		apierror.Write(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		Base   string `json:"base"`
+		Ours   string `json:"ours"`
+		Theirs string `json:"theirs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Ours == "" || req.Theirs == "" {
+		apierror.Write(w, http.StatusBadRequest, "ours and theirs required")
+		return
+	}
+	repo := codexRepo()
+	preview, err := repo.PreviewMerge(req.Base, req.Ours, req.Theirs)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(preview)
+}
+
+// POST /api/codex/merge/resolve  { base:, ours:, theirs:, author:, message:, resolutions: { urn: { choice: ours|theirs|custom, object: {...} } } }
+// or { merge_id:, resolutions:?, author:?, message:? } to finish a saved merge
+// with its recorded choices plus any given here. Choices for a saved merge
+// are kept when some conflicts are still unresolved.
+func handleCodexMergeResolve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		apierror.Write(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req struct {
+		MergeID     string                               `json:"merge_id"`
+		Base        string                               `json:"base"`
+		Ours        string                               `json:"ours"`
+		Theirs      string                               `json:"theirs"`
+		Author      string                               `json:"author"`
+		Message     string                               `json:"message"`
+		Resolutions map[string]codexpkg.ResolutionChoice `json:"resolutions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.MergeID == "" && (req.Ours == "" || req.Theirs == "")) {
+		apierror.Write(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	var st *MergeState
+	if req.MergeID != "" {
+		var err error
+		if st, err = loadMergeState(req.MergeID); err != nil {
+			apierror.Write(w, http.StatusNotFound, "merge not found")
+			return
+		}
+		if st.Status != mergeInProgress {
+			apierror.Write(w, http.StatusConflict, "merge is "+st.Status)
+			return
+		}
+		if err := st.applyChoices(req.Resolutions); err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Author != "" {
+			st.Author = req.Author
+		}
+		if req.Message != "" {
+			st.Message = req.Message
+		}
+		req.Base, req.Ours, req.Theirs, req.Author, req.Message = st.Base, st.Ours, st.Theirs, st.Author, st.Message
+		req.Resolutions = st.Resolutions
+	}
+	repo := codexRepo()
+	mcommit, unresolved, err := repo.ResolveMerge(req.Base, req.Ours, req.Theirs, req.Author, req.Message, req.Resolutions)
+	var msgErr *codexpkg.CommitMessageError
+	if errors.As(err, &msgErr) {
+		writeCommitMessageError(w, msgErr)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(unresolved) > 0 {
+		resp := map[string]interface{}{"conflicts": unresolved}
+		if st != nil {
+			saveMergeState(st)
+			resp["merge_id"] = st.ID
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if st != nil {
+		st.Status, st.Result = mergeResolved, mcommit.Hash
+		if err := saveMergeState(st); err != nil {
+			log.Printf("codex merge: could not record resolution of %s: %v", st.ID, err)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"hash": mcommit.Hash, "resolutions": mcommit.Resolutions})
+}
+
 // GET /api/codex/export?hash=&format=zip|jsonld
 func handleCodexExport(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	h := q.Get("hash")
 	if h == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "hash required"})
+		apierror.Write(w, http.StatusBadRequest, "hash required")
 		return
 	}
 	format := q.Get("format")
 	if format == "" {
 		format = "zip"
 	}
-	repo := codexpkg.NewRepository(fsstorage.New("."), ".")
+	// a commit never changes, so neither does its export
+	if notModified(w, r, etagOf(h, format), time.Time{}) {
+		return
+	}
+	repo := codexRepo()
 	switch format {
 	case "zip":
-		w.Header().Set("Content-Type", "application/zip")
-		w.Header().Set("Content-Disposition", "attachment; filename=codex-"+h+".zip")
-		if err := codexpkg.ExportCommitToZip(w, repo, h); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		buf := new(bytes.Buffer)
+		err := codexpkg.ExportCommitToZip(buf, repo, h)
+		var signed []byte
+		if err == nil {
+			signed, err = signZip(buf.Bytes())
+		}
+		if err != nil {
+			apierror.Internal(w, r, err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=codex-"+h+".zip")
+		w.Write(signed)
 	case "jsonld":
 		w.Header().Set("Content-Type", "application/ld+json")
 		b, err := codexpkg.ExportCommitToJSONLD(repo, h)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		w.Write(b)
 	default:
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "unsupported format"})
+		apierror.Write(w, http.StatusBadRequest, "unsupported format")
+	}
+}
+
+// GET /api/codex/stats?top=
+func handleCodexStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	top := 10
+	if t := r.URL.Query().Get("top"); t != "" {
+		fmt.Sscanf(t, "%d", &top)
+	}
+	repo := codexRepo()
+	st, err := repo.Stats(top)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// writeCommitMessageError reports commit policy violations with each problem listed
+func writeCommitMessageError(w http.ResponseWriter, err error) {
+	var msgErr *codexpkg.CommitMessageError
+	if errors.As(err, &msgErr) {
+		apierror.WriteWith(w, &apierror.Error{Status: http.StatusBadRequest, Code: "commit_policy", Message: msgErr.Error()},
+			map[string]interface{}{"problems": msgErr.Problems})
+		return
+	}
+	apierror.Write(w, http.StatusBadRequest, err.Error())
+}
+
+// handleCodexLinks lists links (GET) or creates/re-pins one (POST {name, url, commit})
+func handleCodexLinks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	repo := codexRepo()
+	switch r.Method {
+	case "GET":
+		links, err := repo.ListLinks()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(links)
+	case "POST":
+		var l codexpkg.Link
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+		if err := repo.SetLink(l); err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(l)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCodexRemote resolves ?ref=codex+<repo>#<urn>[@<commit>]. A token for
+// the remote can be passed in the X-Codex-Remote-Token header.
+func handleCodexRemote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u, err := codexpkg.ParseRemoteURN(r.URL.Query().Get("ref"))
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ent, err := codexRepo().ResolveRemote(u, r.Header.Get("X-Codex-Remote-Token"))
+	if err != nil {
+		apierror.Write(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(ent)
+}
+
+// handleCodexSync serves the vault's codex repository as a remote (see
+// codexpkg.NewServer) under /api/codex/sync/ so another instance can push to
+// and pull from it. It is disabled until a sync token is configured.
+func handleCodexSync(w http.ResponseWriter, r *http.Request) {
+	if codexSyncToken == "" {
+		w.Header().Set("Content-Type", "application/json")
+		apierror.Write(w, http.StatusNotFound, "codex sync is disabled; start the server with --codex-sync-token")
+		return
+	}
+	http.StripPrefix("/api/codex/sync", codexpkg.NewServer(codexRepo(), codexSyncToken)).ServeHTTP(w, r)
+}
+
+// POST /api/codex/push and /api/codex/pull {remote, token?, refs?, force?}
+// replicate branches and tags with another instance's /api/codex/sync
+func handleCodexPushPull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Remote string   `json:"remote"`
+		Token  string   `json:"token"`
+		Refs   []string `json:"refs"`
+		Force  bool     `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Remote == "" {
+		apierror.Write(w, http.StatusBadRequest, "remote required")
+		return
+	}
+	opts := codexpkg.SyncOptions{Token: req.Token, Refs: req.Refs, Force: req.Force}
+	run := codexRepo().Push
+	if strings.HasSuffix(r.URL.Path, "/pull") {
+		run = codexRepo().Pull
+	}
+	res, err := run(req.Remote, opts)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, codexpkg.ErrRefMoved) {
+			status = http.StatusConflict
+		}
+		apierror.WriteWith(w, &apierror.Error{Status: status, Message: err.Error()}, map[string]interface{}{"result": res})
+		return
 	}
+	json.NewEncoder(w).Encode(res)
 }
 
 func registerCodexHandlers(mux *http.ServeMux) {
@@ -256,5 +614,15 @@ func registerCodexHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/api/codex/commit/get", handleCodexCommitGet)
 	mux.HandleFunc("/api/codex/diff", handleCodexDiff)
 	mux.HandleFunc("/api/codex/merge", handleCodexMerge)
+	mux.HandleFunc("/api/codex/merge/preview", handleCodexMergePreview)
+	mux.HandleFunc("/api/codex/merge/resolve", handleCodexMergeResolve)
+	mux.HandleFunc("/api/codex/merges", handleCodexMerges)
+	mux.HandleFunc("/api/codex/merges/", handleCodexMerges)
 	mux.HandleFunc("/api/codex/export", handleCodexExport)
+	mux.HandleFunc("/api/codex/stats", handleCodexStats)
+	mux.HandleFunc("/api/codex/links", handleCodexLinks)
+	mux.HandleFunc("/api/codex/remote", handleCodexRemote)
+	mux.HandleFunc("/api/codex/sync/", handleCodexSync)
+	mux.HandleFunc("/api/codex/push", handleCodexPushPull)
+	mux.HandleFunc("/api/codex/pull", handleCodexPushPull)
 }
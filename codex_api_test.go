@@ -106,6 +106,8 @@ func TestCodexObjectUploadAndDownload(t *testing.T) {
 }
 
 func TestCodexMergeAPI(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
 	wd, _ := os.Getwd()
 	tmp, err := ioutil.TempDir("", "codex-api-merge-test-")
 	if err != nil {
@@ -169,6 +171,130 @@ func TestCodexMergeAPI(t *testing.T) {
 	}
 }
 
+func TestCodexMergeResumeAPI(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	tmp := t.TempDir()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	mux := http.NewServeMux()
+	registerCodexHandlers(mux)
+	do := func(method, path, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var out map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		return rr, out
+	}
+
+	objs := filepath.Join(tmp, ".codex", "objects")
+	os.MkdirAll(objs, 0755)
+	for name, body := range map[string]string{
+		"o1": `{"urn":"urn:node:1","title":"v1"}`, "o1a": `{"urn":"urn:node:1","title":"ours"}`, "o1b": `{"urn":"urn:node:1","title":"theirs"}`,
+		"o2": `{"urn":"urn:node:2","title":"v1"}`, "o2a": `{"urn":"urn:node:2","title":"ours"}`, "o2b": `{"urn":"urn:node:2","title":"theirs"}`,
+	} {
+		ioutil.WriteFile(filepath.Join(objs, name+".json"), []byte(body), 0644)
+	}
+	fs := fsstorage.New(tmp)
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"o1", "o2"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-30 * time.Minute), Objects: []string{"o1a", "o2a"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"o1b", "o2b"}})
+
+	rr, out := do("POST", "/api/codex/merge", `{"base":"c1","ours":"c2","theirs":"c3","author":"m","message":"merge"}`)
+	id, _ := out["merge_id"].(string)
+	if rr.Code != http.StatusConflict || id == "" {
+		t.Fatalf("expected a saved conflicting merge, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// choose one side now, come back for the other later
+	rr, _ = do("PUT", "/api/codex/merges/"+id, `{"resolutions":{"urn:node:1":{"choice":"theirs"}}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr, _ := do("PUT", "/api/codex/merges/"+id, `{"resolutions":{"urn:node:9":{"choice":"ours"}}}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a URN without a conflict, got %d", rr.Code)
+	}
+	var st MergeState
+	rr, _ = do("GET", "/api/codex/merges/"+id, "")
+	json.Unmarshal(rr.Body.Bytes(), &st)
+	if st.Status != mergeInProgress || len(st.Remaining) != 1 || st.Remaining[0] != "urn:node:2" {
+		t.Fatalf("unexpected saved state: %+v", st)
+	}
+	if rr, _ := do("POST", "/api/codex/merge/resolve", `{"merge_id":"`+id+`"}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 while urn:node:2 is unresolved, got %d", rr.Code)
+	}
+
+	rr, out = do("POST", "/api/codex/merge/resolve", `{"merge_id":"`+id+`","resolutions":{"urn:node:2":{"choice":"custom","object":{"urn":"urn:node:2","title":"both"}}}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("resolve: %d %s", rr.Code, rr.Body.String())
+	}
+	merged, err := fs.GetCommit(out["hash"].(string))
+	if err != nil || len(merged.Resolutions) != 2 || merged.Parents[0] != "c2" {
+		t.Fatalf("unexpected merge commit: %+v %v", merged, err)
+	}
+	rr, _ = do("GET", "/api/codex/merges?status=resolved", "")
+	var list []MergeState
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Result != merged.Hash {
+		t.Fatalf("expected the merge to be recorded as resolved: %s", rr.Body.String())
+	}
+	if rr, _ := do("DELETE", "/api/codex/merges/"+id, ""); rr.Code != http.StatusConflict {
+		t.Fatalf("a resolved merge cannot be aborted, got %d", rr.Code)
+	}
+}
+
+func TestCodexMergePreviewAPI(t *testing.T) {
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "codex-api-preview-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	mux := http.NewServeMux()
+	registerCodexHandlers(mux)
+
+	objs := filepath.Join(tmp, ".codex", "objects")
+	os.MkdirAll(objs, 0755)
+	ioutil.WriteFile(filepath.Join(objs, "o1.json"), []byte(`{"urn":"urn:node:1","title":"v1"}`), 0644)
+	ioutil.WriteFile(filepath.Join(objs, "o1a.json"), []byte(`{"urn":"urn:node:1","title":"v2"}`), 0644)
+	ioutil.WriteFile(filepath.Join(objs, "o1b.json"), []byte(`{"urn":"urn:node:1","title":"v3"}`), 0644)
+	ioutil.WriteFile(filepath.Join(objs, "o2.json"), []byte(`{"urn":"urn:node:2","title":"two"}`), 0644)
+	fs := fsstorage.New(tmp)
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"o1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-30 * time.Minute), Objects: []string{"o1a", "o2"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"o1b"}})
+
+	before, _ := fs.ListObjects("")
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/codex/merge/preview", strings.NewReader(`{"ours":"c2","theirs":"c3"}`))
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 for preview, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var preview codex.MergePreview
+	json.NewDecoder(rr.Body).Decode(&preview)
+	if preview.Base != "c1" {
+		t.Fatalf("expected discovered base c1, got %q", preview.Base)
+	}
+	if len(preview.Conflicts) != 1 || preview.Conflicts[0].URN != "urn:node:1" {
+		t.Fatalf("expected conflict on urn:node:1, got %+v", preview.Conflicts)
+	}
+	if len(preview.Objects) != 1 || preview.Objects[0] != "o2" {
+		t.Fatalf("expected would-be objects [o2], got %v", preview.Objects)
+	}
+
+	after, _ := fs.ListObjects("")
+	if len(after) != len(before) {
+		t.Fatalf("preview must not write objects or commits: %d -> %d", len(before), len(after))
+	}
+}
+
 func TestCodexExportAPI(t *testing.T) {
 	wd, _ := os.Getwd()
 	tmp, err := ioutil.TempDir("", "codex-api-export-test-")
@@ -254,3 +380,131 @@ func TestCodexCommitsAndDiffEndpoints(t *testing.T) {
 		t.Fatalf("diff failed: %d %s", rr.Code, rr.Body.String())
 	}
 }
+
+func TestCodexSyncBetweenInstances(t *testing.T) {
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "codex-api-sync-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	defer func(tok string) { codexSyncToken = tok }(codexSyncToken)
+
+	mux := http.NewServeMux()
+	registerCodexHandlers(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	codexSyncToken = ""
+	resp, _ := http.Get(srv.URL + "/api/codex/sync/status")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected sync to be disabled without a token, got %d", resp.StatusCode)
+	}
+	codexSyncToken = "s3cret"
+
+	// another machine's repository with one commit on main
+	peerDir := filepath.Join(tmp, "peer")
+	peer := codex.NewRepository(fsstorage.New(peerDir), peerDir)
+	h, _ := peer.PutObjectStream(strings.NewReader(`{"urn":"urn:note:1","title":"Hi"}`), "application/json")
+	c := &codex.Commit{Timestamp: time.Now().UTC(), Message: "hi", Objects: []string{h}}
+	peer.PutCommit(c)
+	peer.SetRef("refs/heads/main", c.Hash)
+
+	if _, err := peer.Push(srv.URL+"/api/codex/sync", codex.SyncOptions{Token: "nope"}); err == nil {
+		t.Fatalf("expected push with the wrong token to fail")
+	}
+	if _, err := peer.Push(srv.URL+"/api/codex/sync", codex.SyncOptions{Token: "s3cret"}); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if got, _ := codexRepo().GetRef("refs/heads/main"); got != c.Hash {
+		t.Fatalf("vault main = %q, want %s", got, c.Hash)
+	}
+
+	// and back out through /api/codex/pull into a third repository served elsewhere
+	other := codex.NewRepository(fsstorage.New(filepath.Join(tmp, "other")), "")
+	otherSrv := httptest.NewServer(codex.NewServer(other, ""))
+	defer otherSrv.Close()
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/codex/push", strings.NewReader(`{"remote":"`+otherSrv.URL+`"}`)))
+	var res codex.SyncResult
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || res.Updated["refs/heads/main"] != c.Hash {
+		t.Fatalf("push via API: %d %+v", rr.Code, res)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/codex/pull", strings.NewReader(`{"remote":"`+otherSrv.URL+`"}`)))
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || len(res.UpToDate) != 1 {
+		t.Fatalf("pull via API: %d %+v", rr.Code, res)
+	}
+}
+
+func TestCodexObjectRanges(t *testing.T) {
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "codex-range-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	// small enough that the large video skips the cache and is read from disk
+	defer func(n int64) { codexCacheBytes = n }(codexCacheBytes)
+	codexCacheBytes = 8 << 10
+
+	mux := http.NewServeMux()
+	registerCodexHandlers(mux)
+	put := func(body, contentType string) string {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/codex/object", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		mux.ServeHTTP(rr, req)
+		var out map[string]string
+		json.Unmarshal(rr.Body.Bytes(), &out)
+		if rr.Code != http.StatusCreated || out["hash"] == "" {
+			t.Fatalf("put object: %d %s", rr.Code, rr.Body.String())
+		}
+		return out["hash"]
+	}
+	get := func(hash string, headers map[string]string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/api/codex/object?hash="+hash, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	small := put("0123456789", "audio/mpeg")
+	large := put(strings.Repeat("frame-", 1000), "video/mp4")
+	for _, c := range []struct {
+		hash, rng, want, contentRange string
+	}{
+		{small, "bytes=3-5", "345", "bytes 3-5/10"},
+		{small, "bytes=-2", "89", "bytes 8-9/10"},
+		{large, "bytes=5994-", "frame-", "bytes 5994-5999/6000"},
+	} {
+		rr := get(c.hash, map[string]string{"Range": c.rng})
+		if rr.Code != http.StatusPartialContent || rr.Body.String() != c.want || rr.Header().Get("Content-Range") != c.contentRange {
+			t.Fatalf("%s: %d %q %q", c.rng, rr.Code, rr.Body.String(), rr.Header().Get("Content-Range"))
+		}
+	}
+
+	rr := get(large, nil)
+	if rr.Code != http.StatusOK || rr.Body.Len() != 6000 || rr.Header().Get("Accept-Ranges") != "bytes" || rr.Header().Get("Content-Type") != "video/mp4" {
+		t.Fatalf("whole object: %d %d %v", rr.Code, rr.Body.Len(), rr.Header())
+	}
+	// a stale If-Range gets the whole object back
+	if rr := get(small, map[string]string{"Range": "bytes=0-1", "If-Range": `"other"`}); rr.Code != http.StatusOK || rr.Body.Len() != 10 {
+		t.Fatalf("stale If-Range: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := get(small, map[string]string{"If-None-Match": `"` + small + `"`}); rr.Code != http.StatusNotModified {
+		t.Fatalf("an object should revalidate by its hash: %d", rr.Code)
+	}
+	if rr := get(small, map[string]string{"Range": "bytes=50-60"}); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("a range past the end: %d", rr.Code)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	codexpkg "veil/pkg/codex"
+	"veil/pkg/ids"
+)
+
+// === In-progress Merges ===
+// A conflicting POST /api/codex/merge is saved as a merge state. Clients
+// record choices with PUT /api/codex/merges/{id} as the user works through the
+// conflicts and finish with POST /api/codex/merge/resolve {merge_id}, so a
+// resolution can be resumed after a reload or by another editor.
+
+const (
+	mergeInProgress = "in_progress"
+	mergeResolved   = "resolved"
+	mergeAborted    = "aborted"
+)
+
+// MergeState is a merge waiting for its conflicts to be resolved
+type MergeState struct {
+	ID          string                               `json:"id"`
+	Base        string                               `json:"base"`
+	Ours        string                               `json:"ours"`
+	Theirs      string                               `json:"theirs"`
+	Author      string                               `json:"author"`
+	Message     string                               `json:"message"`
+	Conflicts   []codexpkg.Conflict                  `json:"conflicts"`
+	Resolutions map[string]codexpkg.ResolutionChoice `json:"resolutions"`
+	// Remaining lists the conflicting URNs that have no choice yet
+	Remaining []string `json:"remaining"`
+	Status    string   `json:"status"`
+	Result    string   `json:"result,omitempty"` // merge commit once resolved
+	CreatedBy string   `json:"created_by,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+// fillRemaining recomputes Remaining from Conflicts and Resolutions
+func (st *MergeState) fillRemaining() {
+	st.Remaining = []string{}
+	for _, c := range st.Conflicts {
+		if _, ok := st.Resolutions[c.URN]; !ok {
+			st.Remaining = append(st.Remaining, c.URN)
+		}
+	}
+}
+
+// applyChoices merges choices into the state. An empty choice clears a URN.
+func (st *MergeState) applyChoices(choices map[string]codexpkg.ResolutionChoice) error {
+	conflicting := map[string]struct{}{}
+	for _, c := range st.Conflicts {
+		conflicting[c.URN] = struct{}{}
+	}
+	for urn, ch := range choices {
+		if _, ok := conflicting[urn]; !ok {
+			return fmt.Errorf("no conflict for %s", urn)
+		}
+		switch ch.Choice {
+		case "":
+			delete(st.Resolutions, urn)
+			continue
+		case codexpkg.ResolveOurs, codexpkg.ResolveTheirs:
+		case codexpkg.ResolveCustom:
+			if len(ch.Object) == 0 {
+				return fmt.Errorf("custom choice for %s needs an object", urn)
+			}
+		default:
+			return fmt.Errorf("invalid choice %q for %s (want ours, theirs or custom)", ch.Choice, urn)
+		}
+		st.Resolutions[urn] = ch
+	}
+	st.fillRemaining()
+	return nil
+}
+
+const mergeStateColumns = `id, COALESCE(base, ''), ours, theirs, COALESCE(author, ''), COALESCE(message, ''), conflicts,
+	COALESCE(resolutions, ''), status, COALESCE(result, ''), COALESCE(created_by, ''), created_at, updated_at`
+
+func scanMergeState(scan func(dest ...interface{}) error) (*MergeState, error) {
+	var st MergeState
+	var conflicts, resolutions string
+	if err := scan(&st.ID, &st.Base, &st.Ours, &st.Theirs, &st.Author, &st.Message, &conflicts,
+		&resolutions, &st.Status, &st.Result, &st.CreatedBy, &st.CreatedAt, &st.UpdatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(conflicts), &st.Conflicts)
+	st.Resolutions = map[string]codexpkg.ResolutionChoice{}
+	if resolutions != "" {
+		json.Unmarshal([]byte(resolutions), &st.Resolutions)
+	}
+	st.fillRemaining()
+	return &st, nil
+}
+
+func loadMergeState(id string) (*MergeState, error) {
+	return scanMergeState(db.QueryRow(`SELECT `+mergeStateColumns+` FROM codex_merges WHERE id = ?`, id).Scan)
+}
+
+// createMergeState saves a conflicting merge so it can be resolved later
+func createMergeState(r *http.Request, base, ours, theirs, author, message string, conflicts []codexpkg.Conflict) (*MergeState, error) {
+	now := time.Now().Unix()
+	st := &MergeState{
+		ID: ids.New("merge"), Base: base, Ours: ours, Theirs: theirs,
+		Author: author, Message: message, Conflicts: conflicts,
+		Resolutions: map[string]codexpkg.ResolutionChoice{}, Status: mergeInProgress,
+		CreatedBy: currentUserID(r), CreatedAt: now, UpdatedAt: now,
+	}
+	st.fillRemaining()
+	cb, _ := json.Marshal(conflicts)
+	_, err := db.Exec(`INSERT INTO codex_merges (id, base, ours, theirs, author, message, conflicts, resolutions, status, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, '{}', ?, ?, ?, ?)`,
+		st.ID, base, ours, theirs, author, message, string(cb), st.Status, st.CreatedBy, now, now)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// saveMergeState writes back choices, status and result
+func saveMergeState(st *MergeState) error {
+	st.UpdatedAt = time.Now().Unix()
+	rb, _ := json.Marshal(st.Resolutions)
+	_, err := db.Exec(`UPDATE codex_merges SET author = ?, message = ?, resolutions = ?, status = ?, result = ?, updated_at = ? WHERE id = ?`,
+		st.Author, st.Message, string(rb), st.Status, st.Result, st.UpdatedAt, st.ID)
+	return err
+}
+
+// /api/codex/merges?status=  lists saved merges, newest first.
+// /api/codex/merges/{id}: GET returns one, PUT {author?, message?,
+// resolutions: {urn: {choice, object}}} records choices (choice "" clears
+// one), DELETE aborts the merge.
+func handleCodexMerges(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/codex/merges"), "/")
+	if id == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := `SELECT ` + mergeStateColumns + ` FROM codex_merges`
+		var args []interface{}
+		if status := r.URL.Query().Get("status"); status != "" {
+			query += ` WHERE status = ?`
+			args = append(args, status)
+		}
+		rows, err := db.Query(query+` ORDER BY created_at DESC`, args...)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		defer rows.Close()
+		merges := []*MergeState{}
+		for rows.Next() {
+			if st, err := scanMergeState(rows.Scan); err == nil {
+				merges = append(merges, st)
+			}
+		}
+		json.NewEncoder(w).Encode(merges)
+		return
+	}
+
+	st, err := loadMergeState(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		apierror.Write(w, http.StatusNotFound, "merge not found")
+		return
+	} else if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(st)
+	case "PUT", "DELETE":
+		if st.Status != mergeInProgress {
+			apierror.Write(w, http.StatusConflict, "merge is "+st.Status)
+			return
+		}
+		if r.Method == "DELETE" {
+			st.Status = mergeAborted
+		} else {
+			var req struct {
+				Author      *string                              `json:"author"`
+				Message     *string                              `json:"message"`
+				Resolutions map[string]codexpkg.ResolutionChoice `json:"resolutions"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				apierror.Write(w, http.StatusBadRequest, "invalid payload")
+				return
+			}
+			if err := st.applyChoices(req.Resolutions); err != nil {
+				apierror.Write(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.Author != nil {
+				st.Author = *req.Author
+			}
+			if req.Message != nil {
+				st.Message = *req.Message
+			}
+		}
+		if err := saveMergeState(st); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(st)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
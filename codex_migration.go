@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	codexpkg "veil/pkg/codex"
+)
+
+// === Vault to Codex Migration ===
+// Nodes from vaults that predate the codex, or imported straight into
+// veil.db, have versions but no codex history. veil migrate codex replays
+// each such node's versions as a chain of codex commits under its URN,
+// dated from the versions and authored by the node's owner, the way the
+// node handlers would have written them. Nodes that already have codex
+// history are left alone, so the migration can be run again after an
+// interruption. A verification pass then walks each new chain and checks
+// its commit count and object hashes against the database.
+
+// CodexMigrationReport describes a vault-to-codex migration
+type CodexMigrationReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Nodes    int      `json:"nodes"`   // nodes without codex history
+	Commits  int      `json:"commits"` // commits written, or to write on a dry run
+	Skipped  int      `json:"skipped"` // nodes already in the codex
+	Verified int      `json:"verified"`
+	Failed   []string `json:"failed"` // nodes whose codex history doesn't match
+}
+
+// codexMigrationNode is a node row and the snapshots to commit for it
+type codexMigrationNode struct {
+	id, typ, parentID, path, title, content, mimeType, siteID, metadata, author string
+	createdAt, modifiedAt                                                       int64
+	snapshots                                                                   []codexSnapshot
+}
+
+// codexSnapshot is one state of a node: a version, or its current row when
+// that differs from its latest version
+type codexSnapshot struct {
+	title, content string
+	at             int64
+}
+
+// object returns the codex object for the node as it was at s, shaped like
+// the one the node handlers store
+func (n *codexMigrationNode) object(s codexSnapshot) []byte {
+	nodeData := map[string]interface{}{
+		"id":          n.id,
+		"type":        n.typ,
+		"parent_id":   n.parentID,
+		"path":        n.path,
+		"title":       s.title,
+		"content":     s.content,
+		"mime_type":   n.mimeType,
+		"site_id":     n.siteID,
+		"created_at":  n.createdAt,
+		"modified_at": s.at,
+		"urn":         nodeURN(n.id),
+	}
+	if n.metadata != "" && json.Valid([]byte(n.metadata)) {
+		nodeData["metadata"] = json.RawMessage(n.metadata)
+	}
+	b, _ := json.Marshal(nodeData)
+	return b
+}
+
+// loadCodexMigrationNodes reads the nodes without codex history and their
+// versions, oldest first
+func loadCodexMigrationNodes() ([]*codexMigrationNode, int, error) {
+	var skipped int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE id IN (SELECT node_id FROM node_codex_links)`).Scan(&skipped); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`SELECT n.id, n.type, n.parent_id, n.path, n.title, n.content, n.mime_type, n.site_id, n.metadata,
+		n.created_at, n.modified_at, u.username
+		FROM nodes n LEFT JOIN users u ON u.id = n.owner_id
+		WHERE n.id NOT IN (SELECT node_id FROM node_codex_links)
+		ORDER BY n.created_at, n.id`)
+	if err != nil {
+		return nil, 0, err
+	}
+	var nodes []*codexMigrationNode
+	for rows.Next() {
+		var n codexMigrationNode
+		var parentID, title, content, mimeType, siteID, metadata, author sql.NullString
+		if err := rows.Scan(&n.id, &n.typ, &parentID, &n.path, &title, &content, &mimeType, &siteID, &metadata,
+			&n.createdAt, &n.modifiedAt, &author); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		n.parentID, n.title, n.content, n.mimeType = parentID.String, title.String, content.String, mimeType.String
+		n.siteID, n.metadata, n.author = siteID.String, metadata.String, author.String
+		if n.author == "" {
+			n.author = "Veil System"
+		}
+		nodes = append(nodes, &n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for _, n := range nodes {
+		vrows, err := db.Query(`SELECT title, content, created_at FROM versions WHERE node_id = ? ORDER BY version_number`, n.id)
+		if err != nil {
+			return nil, 0, err
+		}
+		for vrows.Next() {
+			var title, content sql.NullString
+			var at int64
+			if err := vrows.Scan(&title, &content, &at); err != nil {
+				vrows.Close()
+				return nil, 0, err
+			}
+			n.snapshots = append(n.snapshots, codexSnapshot{title: title.String, content: content.String, at: at})
+		}
+		vrows.Close()
+		if err := vrows.Err(); err != nil {
+			return nil, 0, err
+		}
+		// the current row, when it was changed without a version
+		if last := len(n.snapshots) - 1; last < 0 || n.snapshots[last].title != n.title || n.snapshots[last].content != n.content {
+			at := n.modifiedAt
+			if last >= 0 && at < n.snapshots[last].at {
+				at = n.snapshots[last].at
+			}
+			n.snapshots = append(n.snapshots, codexSnapshot{title: n.title, content: n.content, at: at})
+		}
+	}
+	return nodes, skipped, nil
+}
+
+// migrateVaultToCodex writes codex history for every node that has none.
+// On a dry run it only counts what it would write.
+func migrateVaultToCodex(dryRun bool) (*CodexMigrationReport, error) {
+	nodes, skipped, err := loadCodexMigrationNodes()
+	if err != nil {
+		return nil, err
+	}
+	report := &CodexMigrationReport{DryRun: dryRun, Nodes: len(nodes), Skipped: skipped, Failed: []string{}}
+	if dryRun {
+		for _, n := range nodes {
+			report.Commits += len(n.snapshots)
+		}
+		return report, nil
+	}
+
+	repo := codexRepo()
+	for _, n := range nodes {
+		parents := []string{}
+		for i, s := range n.snapshots {
+			hash, err := repo.PutObjectStream(bytes.NewReader(n.object(s)), "application/json")
+			if err != nil {
+				return report, fmt.Errorf("node %s: %v", n.id, err)
+			}
+			message := fmt.Sprintf("Update node: %s", s.title)
+			if i == 0 {
+				message = fmt.Sprintf("Create node: %s", s.title)
+			}
+			commit := &codexpkg.Commit{
+				Parents:   parents,
+				Author:    n.author,
+				Timestamp: time.Unix(s.at, 0),
+				Message:   message,
+				Objects:   []string{hash},
+			}
+			if err := repo.PutCommit(commit); err != nil {
+				return report, fmt.Errorf("node %s: %v", n.id, err)
+			}
+			if err := recordNodeCodexCommit(n.id, hash, commit.Hash, s.at); err != nil {
+				return report, fmt.Errorf("node %s: %v", n.id, err)
+			}
+			parents = []string{commit.Hash}
+			report.Commits++
+		}
+	}
+
+	for _, n := range nodes {
+		if err := verifyNodeCodexHistory(repo, n); err != nil {
+			log.Printf("codex migration: node %s: %v", n.id, err)
+			report.Failed = append(report.Failed, n.id)
+			continue
+		}
+		report.Verified++
+	}
+	return report, nil
+}
+
+// verifyNodeCodexHistory walks a migrated node's commits from its head and
+// checks them against its snapshots and its recorded codex commits
+func verifyNodeCodexHistory(repo *codexpkg.Repository, n *codexMigrationNode) error {
+	var recorded int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM node_codex_commits WHERE node_id = ?`, n.id).Scan(&recorded); err != nil {
+		return err
+	}
+	if recorded != len(n.snapshots) {
+		return fmt.Errorf("%d codex commits recorded for %d versions", recorded, len(n.snapshots))
+	}
+	var headCommit, headObject string
+	if err := db.QueryRow(`SELECT head_commit, head_object FROM node_codex_links WHERE node_id = ?`, n.id).Scan(&headCommit, &headObject); err != nil {
+		return err
+	}
+
+	hash := headCommit
+	for i := len(n.snapshots) - 1; i >= 0; i-- {
+		if hash == "" {
+			return fmt.Errorf("history ends %d commits early", i+1)
+		}
+		c, err := repo.GetCommit(hash)
+		if err != nil {
+			return fmt.Errorf("commit %s: %v", hash, err)
+		}
+		sum := sha256.Sum256(n.object(n.snapshots[i]))
+		want := hex.EncodeToString(sum[:])
+		if len(c.Objects) != 1 || c.Objects[0] != want {
+			return fmt.Errorf("commit %s does not hold version %d", hash, i+1)
+		}
+		if i == len(n.snapshots)-1 && headObject != want {
+			return fmt.Errorf("head object %s, want %s", headObject, want)
+		}
+		b, err := repo.GetObject(want)
+		if err != nil {
+			return fmt.Errorf("object %s: %v", want, err)
+		}
+		if got := sha256.Sum256(b); hex.EncodeToString(got[:]) != want {
+			return fmt.Errorf("object %s does not match its hash", want)
+		}
+		hash = ""
+		if len(c.Parents) > 0 {
+			hash = c.Parents[0]
+		}
+	}
+	if hash != "" {
+		return fmt.Errorf("history continues past the first version")
+	}
+	return nil
+}
+
+// migrateCodexCommand is `veil migrate codex [--dry-run] [--json] [--vault NAME|PATH]`
+func migrateCodexCommand(args []string) {
+	usage := "Usage: veil migrate codex [--dry-run] [--json] [--vault NAME|PATH]"
+	vault := "."
+	dryRun, asJSON := false, false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--dry-run":
+			dryRun = true
+		case args[i] == "--json":
+			asJSON = true
+		case args[i] == "--vault" && i+1 < len(args):
+			i++
+			vault = args[i]
+			if v, ok := lookupVault(vault); ok {
+				vault = v.Path
+			}
+		default:
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+	}
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+
+	report, err := migrateVaultToCodex(dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		verb := "migrated"
+		if dryRun {
+			verb = "would migrate"
+		}
+		fmt.Printf("%s %d nodes as %d codex commits (%d already in the codex)\n", verb, report.Nodes, report.Commits, report.Skipped)
+		if !dryRun {
+			fmt.Printf("verified %d nodes\n", report.Verified)
+		}
+		if len(report.Failed) > 0 {
+			fmt.Printf("FAILED: %s\n", strings.Join(report.Failed, ", "))
+		}
+	}
+	if len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMigrateVaultToCodex(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	db.Exec(`INSERT INTO users (id, username, created_at) VALUES ('u1', 'ada', 1)`)
+	db.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at, owner_id) VALUES
+		('cm1', 'note', 'a.md', 'Third', 'three', 100, 300, 'u1'),
+		('cm2', 'note', 'b.md', 'Edited', 'no version for this', 50, 400, NULL)`)
+	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, created_at, modified_at) VALUES
+		('cmv1', 'cm1', 1, 'one', 'First', 100, 100),
+		('cmv2', 'cm1', 2, 'two', 'Second', 200, 200),
+		('cmv3', 'cm1', 3, 'three', 'Third', 300, 300),
+		('cmv4', 'cm2', 1, 'original', 'Original', 50, 50)`)
+	// a node already in the codex is left alone
+	db.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES ('cm3', 'note', 'c.md', 'C', 'c', 1, 1)`)
+	recordNodeCodexCommit("cm3", "obj", "commit", 1)
+
+	report, err := migrateVaultToCodex(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Nodes != 2 || report.Commits != 5 || report.Skipped != 1 || nodeCodexHead("cm1") != "" {
+		t.Fatalf("unexpected dry run: %+v", report)
+	}
+
+	if report, err = migrateVaultToCodex(false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Commits != 5 || report.Verified != 2 || len(report.Failed) != 0 {
+		t.Fatalf("unexpected migration: %+v", report)
+	}
+
+	repo := codexRepo()
+	var contents []string
+	for hash := nodeCodexHead("cm1"); hash != ""; {
+		c, err := repo.GetCommit(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Author != "ada" {
+			t.Fatalf("commit author %q, want the node's owner", c.Author)
+		}
+		b, _ := repo.GetObject(c.Objects[0])
+		var obj map[string]interface{}
+		json.Unmarshal(b, &obj)
+		contents = append(contents, obj["content"].(string))
+		if want := time.Unix(int64(obj["modified_at"].(float64)), 0); !c.Timestamp.Equal(want) {
+			t.Fatalf("commit at %v, want the version's time %v", c.Timestamp, want)
+		}
+		hash = ""
+		if len(c.Parents) > 0 {
+			hash = c.Parents[0]
+		}
+	}
+	if len(contents) != 3 || contents[0] != "three" || contents[2] != "one" {
+		t.Fatalf("cm1 history %v", contents)
+	}
+
+	// the current row of cm2 differs from its only version
+	var n int
+	var at int64
+	db.QueryRow(`SELECT COUNT(*), MAX(created_at) FROM node_codex_commits WHERE node_id = 'cm2'`).Scan(&n, &at)
+	c, _ := repo.GetCommit(nodeCodexHead("cm2"))
+	if n != 2 || at != 400 || c == nil || c.Author != "Veil System" {
+		t.Fatalf("cm2: %d commits, last at %d, head %+v", n, at, c)
+	}
+
+	if report, _ = migrateVaultToCodex(false); report.Nodes != 0 || report.Skipped != 3 {
+		t.Fatalf("migrating again should find nothing to do: %+v", report)
+	}
+}
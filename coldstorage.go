@@ -0,0 +1,606 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+	codexpkg "veil/pkg/codex"
+	s3storage "veil/pkg/codex/storage/s3"
+)
+
+// === Cold Storage ===
+// Media files and codex blobs that nobody has read for --cold-after-months
+// move to a secondary bucket, typically one in an archive class such as S3
+// Glacier (--cold-s3-storage-class GLACIER). A row in cold_objects stays
+// behind as the stub. Reading a tiered object asks the bucket for a restore
+// and answers 202 with state "restoring" until the restore has finished;
+// the next read, or the next sweep, brings the object back and drops the
+// stub. JSON objects (entities and commits) never move, since queries read
+// them all the time.
+
+// Cold object kinds
+const (
+	ColdKindMedia = "media"
+	ColdKindCodex = "codex"
+)
+
+// Cold object states; an object that is back has no stub at all
+const (
+	ColdStateCold      = "cold"
+	ColdStateRestoring = "restoring"
+)
+
+// coldStore is the secondary backend tiered objects move to
+type coldStore interface {
+	PutFile(key string, data []byte, contentType string) error
+	GetFile(key string) (io.ReadCloser, error)
+	DeleteFile(key string) error
+	RestoreFile(key string, days int) error
+	RestoreState(key string) (string, error)
+}
+
+var _ coldStore = (*s3storage.S3Storage)(nil)
+
+// ColdStorageConfig holds the tiering policy
+type ColdStorageConfig struct {
+	// After is how long an object goes unread before it moves; 0 turns
+	// tiering off, though tiered objects can still be brought back
+	After time.Duration
+	// RestoreDays is how long the bucket keeps a restored copy readable
+	RestoreDays int
+}
+
+// coldConfig is configured by --cold-after-months and --cold-restore-days
+var coldConfig = ColdStorageConfig{RestoreDays: 7}
+
+// coldBackend is opened from the bucket the --cold-s3-* flags name at
+// startup; tests set it directly.
+var coldBackend coldStore
+
+// coldSweepInterval is how often unread objects are looked for
+const coldSweepInterval = 6 * time.Hour
+
+// coldRetryAfter is what a read of a restoring object is told to wait
+const coldRetryAfter = 15 * time.Minute
+
+// coldMu serialises moving objects out and back
+var coldMu sync.Mutex
+
+// ColdObject is the stub of a tiered object
+type ColdObject struct {
+	Kind               string     `json:"kind"`
+	Key                string     `json:"key"`
+	Size               int64      `json:"size"`
+	ContentType        string     `json:"content_type,omitempty"`
+	State              string     `json:"state"`
+	TieredAt           time.Time  `json:"tiered_at"`
+	RestoreRequestedAt *time.Time `json:"restore_requested_at,omitempty"`
+	LastError          string     `json:"last_error,omitempty"`
+}
+
+// ColdError is returned when a tiered object isn't back yet
+type ColdError struct {
+	Kind  string
+	Key   string
+	State string
+}
+
+func (e *ColdError) Error() string {
+	return fmt.Sprintf("%s %s is in cold storage (%s)", e.Kind, e.Key, e.State)
+}
+
+// coldKey is where an object lives in the cold bucket
+func coldKey(kind, key string) string {
+	return kind + "/" + key
+}
+
+// coldAccess buffers reads until the next sweep writes them to object_access
+var coldAccess = struct {
+	sync.Mutex
+	seen map[[2]string]int64
+}{seen: map[[2]string]int64{}}
+
+// noteAccess records a read of an object while tiering is on
+func noteAccess(kind, key string) {
+	if coldBackend == nil || coldConfig.After <= 0 {
+		return
+	}
+	coldAccess.Lock()
+	coldAccess.seen[[2]string{kind, key}] = time.Now().Unix()
+	coldAccess.Unlock()
+}
+
+// flushAccess writes the buffered reads to object_access
+func flushAccess() {
+	coldAccess.Lock()
+	seen := coldAccess.seen
+	coldAccess.seen = map[[2]string]int64{}
+	coldAccess.Unlock()
+	for k, at := range seen {
+		touchAccess(k[0], k[1], at)
+	}
+}
+
+func touchAccess(kind, key string, at int64) {
+	db.Exec(`INSERT INTO object_access (kind, key, last_access_at) VALUES (?, ?, ?)
+		ON CONFLICT(kind, key) DO UPDATE SET last_access_at = CASE WHEN excluded.last_access_at > object_access.last_access_at
+			THEN excluded.last_access_at ELSE object_access.last_access_at END`, kind, key, at)
+}
+
+// lastAccess returns when an object was last read, or 0 if it never was
+func lastAccess(kind, key string) int64 {
+	var at int64
+	db.QueryRow(`SELECT last_access_at FROM object_access WHERE kind = ? AND key = ?`, kind, key).Scan(&at)
+	return at
+}
+
+// coldState returns the state of a tiered object, or "" for one that's here
+func coldState(kind, key string) string {
+	var state string
+	db.QueryRow(`SELECT state FROM cold_objects WHERE kind = ? AND key = ?`, kind, key).Scan(&state)
+	return state
+}
+
+// tierOut uploads an object to the cold bucket and swaps it for a stub;
+// remove deletes the local copy
+func tierOut(kind, key, contentType string, data []byte, remove func() error) error {
+	coldMu.Lock()
+	defer coldMu.Unlock()
+	if err := coldBackend.PutFile(coldKey(kind, key), data, contentType); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`INSERT INTO cold_objects (kind, key, size, content_type, state, tiered_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(kind, key) DO UPDATE SET size = excluded.size, content_type = excluded.content_type, state = excluded.state,
+			tiered_at = excluded.tiered_at, restore_requested_at = NULL, last_error = NULL`,
+		kind, key, len(data), contentType, ColdStateCold, time.Now().Unix()); err != nil {
+		return err
+	}
+	if err := remove(); err != nil {
+		db.Exec(`DELETE FROM cold_objects WHERE kind = ? AND key = ?`, kind, key)
+		return err
+	}
+	db.Exec(`DELETE FROM object_access WHERE kind = ? AND key = ?`, kind, key)
+	return nil
+}
+
+// fetchCold brings a tiered object back through put. Until the bucket can
+// serve it, it asks for a restore and returns a *ColdError with the state.
+// Objects that aren't tiered give sql.ErrNoRows.
+func fetchCold(kind, key string, put func(r io.Reader, contentType string) error) error {
+	if db == nil {
+		return sql.ErrNoRows
+	}
+	coldMu.Lock()
+	defer coldMu.Unlock()
+	var contentType, state string
+	if err := db.QueryRow(`SELECT COALESCE(content_type, ''), state FROM cold_objects WHERE kind = ? AND key = ?`, kind, key).Scan(&contentType, &state); err != nil {
+		return sql.ErrNoRows
+	}
+	if coldBackend == nil {
+		return &ColdError{Kind: kind, Key: key, State: state}
+	}
+	fail := func(err error) error {
+		db.Exec(`UPDATE cold_objects SET last_error = ? WHERE kind = ? AND key = ?`, err.Error(), kind, key)
+		return err
+	}
+	remote, err := coldBackend.RestoreState(coldKey(kind, key))
+	if err != nil {
+		return fail(err)
+	}
+	if remote == s3storage.StateArchived {
+		if err := coldBackend.RestoreFile(coldKey(kind, key), coldConfig.RestoreDays); err != nil {
+			return fail(err)
+		}
+		remote = s3storage.StateRestoring
+	}
+	if remote == s3storage.StateRestoring {
+		if state != ColdStateRestoring {
+			db.Exec(`UPDATE cold_objects SET state = ?, restore_requested_at = ?, last_error = NULL WHERE kind = ? AND key = ?`,
+				ColdStateRestoring, time.Now().Unix(), kind, key)
+		}
+		return &ColdError{Kind: kind, Key: key, State: ColdStateRestoring}
+	}
+	rc, err := coldBackend.GetFile(coldKey(kind, key))
+	if err != nil {
+		return fail(err)
+	}
+	defer rc.Close()
+	if err := put(rc, contentType); err != nil {
+		return fail(err)
+	}
+	db.Exec(`DELETE FROM cold_objects WHERE kind = ? AND key = ?`, kind, key)
+	// a fresh read, so it doesn't go straight back
+	touchAccess(kind, key, time.Now().Unix())
+	if err := coldBackend.DeleteFile(coldKey(kind, key)); err != nil {
+		log.Printf("cold storage: %s stays in the bucket: %v", coldKey(kind, key), err)
+	}
+	return nil
+}
+
+// coldPut returns how an object of kind is put back in place
+func coldPut(kind, key string) func(io.Reader, string) error {
+	if kind == ColdKindCodex {
+		return func(r io.Reader, contentType string) error {
+			return codexColdTier().putBack(key, r, contentType)
+		}
+	}
+	return func(r io.Reader, _ string) error {
+		p := filepath.Join("media", filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(p + ".part")
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(p + ".part")
+			return err
+		}
+		return os.Rename(p+".part", p)
+	}
+}
+
+// coldTier wraps the codex storage: it notes reads for the tiering policy
+// and brings tiered objects back when they are read
+type coldTier struct {
+	codexpkg.Storage
+}
+
+func (t *coldTier) GetObject(hash string) ([]byte, error) {
+	b, err := t.Storage.GetObject(hash)
+	if err != nil {
+		if werr := t.warm(hash); werr != nil {
+			return nil, coldOr(werr, err)
+		}
+		b, err = t.Storage.GetObject(hash)
+	}
+	if err == nil {
+		noteAccess(ColdKindCodex, hash)
+	}
+	return b, err
+}
+
+func (t *coldTier) GetObjectStream(hash string) (io.ReadCloser, string, error) {
+	rc, contentType, err := t.Storage.GetObjectStream(hash)
+	if err != nil {
+		if werr := t.warm(hash); werr != nil {
+			return nil, "", coldOr(werr, err)
+		}
+		rc, contentType, err = t.Storage.GetObjectStream(hash)
+	}
+	if err == nil {
+		noteAccess(ColdKindCodex, hash)
+	}
+	return rc, contentType, err
+}
+
+func (t *coldTier) PutObject(hash string, payload []byte) error {
+	err := t.Storage.PutObject(hash, payload)
+	if err == nil {
+		noteAccess(ColdKindCodex, hash)
+	}
+	return err
+}
+
+// PutObjectStream also drops the stub of an object that is stored again,
+// as a peer does when a sync finds the object missing here
+func (t *coldTier) PutObjectStream(r io.Reader, contentType string) (string, error) {
+	hash, err := t.Storage.PutObjectStream(r, contentType)
+	if err == nil && coldBackend != nil {
+		noteAccess(ColdKindCodex, hash)
+		if res, _ := db.Exec(`DELETE FROM cold_objects WHERE kind = ? AND key = ?`, ColdKindCodex, hash); res != nil {
+			if n, _ := res.RowsAffected(); n > 0 {
+				coldBackend.DeleteFile(coldKey(ColdKindCodex, hash))
+			}
+		}
+	}
+	return hash, err
+}
+
+// warm brings a tiered object back, if it is one
+func (t *coldTier) warm(hash string) error {
+	return fetchCold(ColdKindCodex, hash, func(r io.Reader, contentType string) error {
+		return t.putBack(hash, r, contentType)
+	})
+}
+
+// putBack stores a restored object, making sure it is the one asked for
+func (t *coldTier) putBack(hash string, r io.Reader, contentType string) error {
+	got, err := t.Storage.PutObjectStream(r, contentType)
+	if err != nil {
+		return err
+	}
+	if got != hash {
+		t.Storage.DeleteObject(got)
+		return fmt.Errorf("restored object %s hashes to %s", hash, got)
+	}
+	return nil
+}
+
+// moveOut sends a codex blob to the cold bucket; JSON objects stay
+func (t *coldTier) moveOut(hash string) (bool, error) {
+	rc, contentType, err := t.Storage.GetObjectStream(hash)
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(contentType, "json") {
+		rc.Close()
+		return false, nil
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return false, err
+	}
+	return true, tierOut(ColdKindCodex, hash, contentType, data, func() error { return t.Storage.DeleteObject(hash) })
+}
+
+// coldOr returns the tiering error for an object that is tiered, else the
+// storage's own error
+func coldOr(coldErr, err error) error {
+	if errors.Is(coldErr, sql.ErrNoRows) {
+		return err
+	}
+	return coldErr
+}
+
+// codexColdTier returns the tiering wrapper of the working directory's
+// codex repository
+func codexColdTier() *coldTier {
+	codexRepo()
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		dir = "."
+	}
+	codexReposMu.Lock()
+	defer codexReposMu.Unlock()
+	return codexTiers[dir]
+}
+
+// tierColdObjects brings back restores that have finished, then moves media
+// files and codex blobs unread since now - coldConfig.After to the cold
+// bucket. It returns how many objects moved out.
+func tierColdObjects(now time.Time) (int, error) {
+	if coldBackend == nil {
+		return 0, nil
+	}
+	flushAccess()
+	finishRestores()
+	if coldConfig.After <= 0 {
+		return 0, nil
+	}
+	cutoff := now.Add(-coldConfig.After).Unix()
+	moved := 0
+
+	// media files count from their upload until first read
+	filepath.WalkDir("media", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(p, ".part") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel("media", p)
+		key := filepath.ToSlash(rel)
+		last := lastAccess(ColdKindMedia, key)
+		if last == 0 {
+			last = info.ModTime().Unix()
+		}
+		if last >= cutoff {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err == nil {
+			contentType := mime.TypeByExtension(filepath.Ext(p))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			err = tierOut(ColdKindMedia, key, contentType, data, func() error { return os.Remove(p) })
+		}
+		if err != nil {
+			log.Printf("cold storage: %s: %v", p, err)
+			return nil
+		}
+		moved++
+		return nil
+	})
+
+	// codex objects carry no upload time, so their clock starts when the
+	// sweep first sees them
+	tier := codexColdTier()
+	hashes, err := tier.Storage.ListObjects("")
+	if err != nil {
+		return moved, err
+	}
+	for _, h := range hashes {
+		last := lastAccess(ColdKindCodex, h)
+		if last == 0 {
+			touchAccess(ColdKindCodex, h, now.Unix())
+			continue
+		}
+		if last >= cutoff {
+			continue
+		}
+		ok, err := tier.moveOut(h)
+		if err != nil {
+			log.Printf("cold storage: codex object %s: %v", h, err)
+			continue
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// finishRestores brings back the objects whose restore has finished, so the
+// next read doesn't have to
+func finishRestores() {
+	rows, err := db.Query(`SELECT kind, key FROM cold_objects WHERE state = ?`, ColdStateRestoring)
+	if err != nil {
+		return
+	}
+	var pending [][2]string
+	for rows.Next() {
+		var kind, key string
+		if rows.Scan(&kind, &key) == nil {
+			pending = append(pending, [2]string{kind, key})
+		}
+	}
+	rows.Close()
+	for _, p := range pending {
+		var ce *ColdError
+		if err := fetchCold(p[0], p[1], coldPut(p[0], p[1])); err != nil && !errors.As(err, &ce) {
+			log.Printf("cold storage: restoring %s: %v", coldKey(p[0], p[1]), err)
+		}
+	}
+}
+
+// watchColdStorage sweeps now and every interval until the returned stop is
+// called
+func watchColdStorage(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	sweep := func(now time.Time) {
+		moved, err := tierColdObjects(now)
+		if err != nil {
+			log.Printf("cold storage: %v", err)
+		} else if moved > 0 {
+			log.Printf("cold storage: moved %d objects unread for %s", moved, coldConfig.After)
+		}
+	}
+	go func() {
+		sweep(time.Now())
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				sweep(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// writeColdPending answers a read of an object that is still in cold
+// storage with 202 and when to try again
+func writeColdPending(w http.ResponseWriter, e *ColdError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprint(int(coldRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"kind": e.Kind, "key": e.Key, "state": e.State, "message": e.Error()})
+}
+
+// GET /api/cold-storage?kind=&state= lists the stubs of tiered objects
+func handleColdStorage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can see cold storage")
+		return
+	}
+	where, args := []string{"1 = 1"}, []interface{}{}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		where, args = append(where, "kind = ?"), append(args, kind)
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		where, args = append(where, "state = ?"), append(args, state)
+	}
+	rows, err := db.Query(`SELECT kind, key, size, COALESCE(content_type, ''), state, tiered_at, restore_requested_at, COALESCE(last_error, '')
+		FROM cold_objects WHERE `+strings.Join(where, " AND ")+` ORDER BY tiered_at DESC, key`, args...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+	list := []ColdObject{}
+	for rows.Next() {
+		var o ColdObject
+		var tiered int64
+		var requested sql.NullInt64
+		if rows.Scan(&o.Kind, &o.Key, &o.Size, &o.ContentType, &o.State, &tiered, &requested, &o.LastError) != nil {
+			continue
+		}
+		o.TieredAt = time.Unix(tiered, 0)
+		if requested.Valid {
+			t := time.Unix(requested.Int64, 0)
+			o.RestoreRequestedAt = &t
+		}
+		list = append(list, o)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// POST /api/cold-storage/restore?kind=&key= asks for an object back ahead of
+// its next read: 200 once it is back, 202 while the bucket restores it
+func handleColdStorageRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can restore from cold storage")
+		return
+	}
+	kind, key := r.URL.Query().Get("kind"), r.URL.Query().Get("key")
+	err := fetchCold(kind, key, coldPut(kind, key))
+	var ce *ColdError
+	switch {
+	case err == nil:
+		json.NewEncoder(w).Encode(map[string]string{"kind": kind, "key": key, "state": "available"})
+	case errors.As(err, &ce):
+		writeColdPending(w, ce)
+	case errors.Is(err, sql.ErrNoRows):
+		apierror.Write(w, http.StatusNotFound, "not in cold storage")
+	default:
+		apierror.Write(w, http.StatusBadGateway, err.Error())
+	}
+}
+
+// POST /api/cold-storage/sweep runs the tiering policy now
+func handleColdStorageSweep(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can run the cold storage sweep")
+		return
+	}
+	if coldBackend == nil {
+		apierror.Write(w, http.StatusConflict, "cold storage is off; start the server with --cold-s3-endpoint and --cold-s3-bucket")
+		return
+	}
+	moved, err := tierColdObjects(time.Now())
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"moved": moved})
+}
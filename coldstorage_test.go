@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	s3storage "veil/pkg/codex/storage/s3"
+)
+
+// fakeColdStore archives everything put in it until asked for a restore,
+// which finishes when the test says so
+type fakeColdStore struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	state map[string]string
+}
+
+func (f *fakeColdStore) PutFile(key string, data []byte, contentType string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[key] = data
+	f.state[key] = s3storage.StateArchived
+	return nil
+}
+
+func (f *fakeColdStore) GetFile(key string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state[key] != s3storage.StateAvailable {
+		return nil, errors.New("InvalidObjectState")
+	}
+	return io.NopCloser(bytes.NewReader(f.files[key])), nil
+}
+
+func (f *fakeColdStore) DeleteFile(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.files, key)
+	delete(f.state, key)
+	return nil
+}
+
+func (f *fakeColdStore) RestoreFile(key string, days int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state[key] == s3storage.StateArchived {
+		f.state[key] = s3storage.StateRestoring
+	}
+	return nil
+}
+
+func (f *fakeColdStore) RestoreState(key string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[key]; !ok {
+		return "", errors.New("not found")
+	}
+	return f.state[key], nil
+}
+
+// finish completes the restore of key
+func (f *fakeColdStore) finish(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state[key] = s3storage.StateAvailable
+}
+
+func TestColdStorage(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+	cold := &fakeColdStore{files: map[string][]byte{}, state: map[string]string{}}
+	coldBackend = cold
+	defer func(c ColdStorageConfig) { coldBackend, coldConfig = nil, c }(coldConfig)
+	coldConfig = ColdStorageConfig{After: 30 * 24 * time.Hour, RestoreDays: 2}
+
+	mux := setupRoutes()
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+	stubs := func(query string) []ColdObject {
+		var out []ColdObject
+		json.NewDecoder(do("GET", "/api/cold-storage"+query).Body).Decode(&out)
+		return out
+	}
+
+	os.MkdirAll("media", 0755)
+	os.WriteFile("media/old.png", []byte("old pixels"), 0644)
+	os.WriteFile("media/new.png", []byte("new pixels"), 0644)
+	longAgo := time.Now().Add(-90 * 24 * time.Hour)
+	os.Chtimes("media/old.png", longAgo, longAgo)
+	testDB.Exec(`INSERT INTO media (id, filename, storage_url, mime_type, file_size, created_at) VALUES ('m1', 'old.png', 'media/old.png', 'image/png', 10, 1)`)
+	repo := codexRepo()
+	blob, _ := repo.PutObjectStream(strings.NewReader("a large recording"), "audio/ogg")
+	entity, _ := repo.PutObjectStream(strings.NewReader(`{"urn":"urn:note:1"}`), "application/json")
+
+	// only the file unread for 90 days goes; the blob was just written
+	now := time.Now()
+	if moved, err := tierColdObjects(now); err != nil || moved != 1 {
+		t.Fatalf("expected one file moved: %d %v", moved, err)
+	}
+	if _, err := os.Stat("media/old.png"); !os.IsNotExist(err) {
+		t.Fatal("a tiered file should leave the disk")
+	}
+	if got := stubs(""); len(got) != 1 || got[0].Kind != ColdKindMedia || got[0].Key != "old.png" || got[0].State != ColdStateCold || got[0].ContentType != "image/png" {
+		t.Fatalf("expected a stub for old.png: %+v", got)
+	}
+	var media MediaFile
+	json.NewDecoder(do("GET", "/api/media?id=m1").Body).Decode(&media)
+	if media.ColdState != ColdStateCold {
+		t.Fatalf("the media record should say it is cold: %+v", media)
+	}
+
+	// reading it asks for a restore and says so until the restore finishes
+	for range 2 {
+		rr := do("GET", "/media/old.png")
+		var body map[string]string
+		json.NewDecoder(rr.Body).Decode(&body)
+		if rr.Code != http.StatusAccepted || body["state"] != ColdStateRestoring || rr.Header().Get("Retry-After") == "" {
+			t.Fatalf("a cold read should answer 202 restoring: %d %v", rr.Code, body)
+		}
+	}
+	if got := stubs("?state=restoring"); len(got) != 1 || got[0].RestoreRequestedAt == nil {
+		t.Fatalf("the stub should be restoring: %+v", got)
+	}
+	cold.finish("media/old.png")
+	rr := do("GET", "/media/old.png")
+	if rr.Code != http.StatusOK || rr.Body.String() != "old pixels" || rr.Header().Get("ETag") == "" {
+		t.Fatalf("a finished restore should serve the file: %d %q", rr.Code, rr.Body.String())
+	}
+	if len(stubs("")) != 0 || len(cold.files) != 0 {
+		t.Fatal("a file that is back should lose its stub and its bucket copy")
+	}
+
+	// two months on with nothing read, both files and the blob go; the
+	// entity stays
+	if moved, err := tierColdObjects(now.Add(60 * 24 * time.Hour)); err != nil || moved != 3 {
+		t.Fatalf("expected the files and the blob moved: %d %v", moved, err)
+	}
+	if _, err := repo.GetObject(entity); err != nil {
+		t.Fatalf("JSON objects never move: %v", err)
+	}
+	rr = do("GET", "/api/codex/object?hash="+blob)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("a cold blob should be restoring: %d %s", rr.Code, rr.Body.String())
+	}
+	var ce *ColdError
+	if _, err := repo.GetObject(blob); !errors.As(err, &ce) || ce.State != ColdStateRestoring {
+		t.Fatalf("the repository should report the restore: %v", err)
+	}
+	// the sweep brings finished restores back without waiting for a read
+	cold.finish("codex/" + blob)
+	finishRestores()
+	if got := stubs("?kind=codex"); len(got) != 0 {
+		t.Fatalf("the blob should be back: %+v", got)
+	}
+	if b, err := repo.GetObject(blob); err != nil || string(b) != "a large recording" {
+		t.Fatalf("restored blob: %q %v", b, err)
+	}
+
+	if rr := do("POST", "/api/cold-storage/restore?kind=media&key=new.png"); rr.Code != http.StatusAccepted {
+		t.Fatalf("restoring ahead of a read: %d", rr.Code)
+	}
+	cold.finish("media/new.png")
+	if rr := do("POST", "/api/cold-storage/restore?kind=media&key=new.png"); rr.Code != http.StatusOK {
+		t.Fatalf("a finished restore should put the file back: %d", rr.Code)
+	}
+	if b, _ := os.ReadFile("media/new.png"); string(b) != "new pixels" {
+		t.Fatalf("restored file: %q", b)
+	}
+	if rr := do("POST", "/api/cold-storage/restore?kind=media&key=nope.png"); rr.Code != http.StatusNotFound {
+		t.Fatalf("restoring something that isn't cold: %d", rr.Code)
+	}
+	if rr := do("GET", "/media/nope.png"); rr.Code != http.StatusNotFound {
+		t.Fatalf("a missing file is still a 404: %d", rr.Code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Conditional Requests ===
+// Nodes, media and exports carry an ETag (and Last-Modified where there is a
+// time to give) so clients can revalidate with If-None-Match or
+// If-Modified-Since and get 304 Not Modified instead of the whole body again.
+// A node's ETag also guards its updates: PUT /api/node-update with If-Match
+// set to the ETag the editor read is refused with 412 once someone else has
+// changed the node, so two editors can't silently overwrite each other.
+
+// requireIfMatch makes If-Match mandatory on node updates (the serve flag
+// --require-if-match); without it updates that don't send one still go through
+var requireIfMatch bool
+
+// nodeWriteMu keeps a node update's If-Match check and its write together
+var nodeWriteMu sync.Mutex
+
+// etagOf is a strong ETag over parts
+func etagOf(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+// nodeETag is the ETag of a node's stored state. It changes with anything
+// GET /api/node/{id} shows, not only modified_at, which has one-second
+// resolution.
+func nodeETag(n Node) string {
+	archived := ""
+	if n.ArchivedAt != nil {
+		archived = strconv.FormatInt(n.ArchivedAt.Unix(), 10)
+	}
+	return etagOf(n.ID, strconv.FormatInt(n.ModifiedAt.Unix(), 10), n.Type, n.ParentID, n.Path, n.Title, n.Content, n.MimeType, n.OwnerID, n.Metadata, archived)
+}
+
+// loadNodeETag is the ETag of a live node as stored now
+func loadNodeETag(id string) (string, bool) {
+	var n Node
+	var modified int64
+	var archived sql.NullInt64
+	err := db.QueryRow(`SELECT id, type, COALESCE(parent_id, ''), path, COALESCE(title, ''), COALESCE(content, ''), COALESCE(mime_type, ''), modified_at,
+		COALESCE(owner_id, ''), archived_at, COALESCE(metadata, '') FROM nodes WHERE id = ? AND deleted_at IS NULL`, id).
+		Scan(&n.ID, &n.Type, &n.ParentID, &n.Path, &n.Title, &n.Content, &n.MimeType, &modified, &n.OwnerID, &archived, &n.Metadata)
+	if err != nil {
+		return "", false
+	}
+	n.ModifiedAt = time.Unix(modified, 0)
+	if archived.Valid {
+		t := time.Unix(archived.Int64, 0)
+		n.ArchivedAt = &t
+	}
+	return nodeETag(n), true
+}
+
+// etagListed reports whether a list of entity tags (If-Match or
+// If-None-Match) names etag. If-None-Match compares weak tags by their
+// opaque part; If-Match is strong and never matches a weak tag.
+func etagListed(header, etag string, strong bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if !strong {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag and Last-Modified headers of a GET response and
+// answers 304 when the client's copy is current; lastMod may be zero. If
+// it answered, the handler is done.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastMod time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastMod.IsZero() {
+		w.Header().Set("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagListed(match, etag, false) {
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || lastMod.IsZero() || lastMod.Truncate(time.Second).After(since) {
+		return false
+	}
+	// a 304 has no body, so no content type either
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// writeJSONCached encodes v as the response, tagged with the hash of its
+// encoding so an unchanged answer revalidates to 304
+func writeJSONCached(w http.ResponseWriter, r *http.Request, v interface{}) {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(v)
+	if notModified(w, r, etagOf(buf.String()), time.Time{}) {
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// checkIfMatch applies a node update's preconditions against the node's
+// current ETag: If-Match must name it, and If-Unmodified-Since must not be
+// older than the node. It answers 412 with the current ETag, or 428 when
+// requireIfMatch is set and no If-Match was sent, and reports whether the
+// update may go ahead.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	match := r.Header.Get("If-Match")
+	if match == "" && requireIfMatch {
+		apierror.Write(w, http.StatusPreconditionRequired, "send If-Match with the node's ETag")
+		return false
+	}
+	failed := match != "" && !etagListed(match, etag, true)
+	if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); match == "" && err == nil && modified.Truncate(time.Second).After(since) {
+		failed = true
+	}
+	if failed {
+		w.Header().Set("ETag", etag)
+		apierror.WriteWith(w, &apierror.Error{Status: http.StatusPreconditionFailed, Message: "the node was changed since it was read"}, map[string]interface{}{"etag": etag})
+		return false
+	}
+	return true
+}
+
+// mediaFiles serves /media/ with ETags from each file's size and
+// modification time; http.FileServer does the revalidation and byte ranges
+// (If-Range included) itself once the header is set. Files in cold storage
+// are brought back on their first read.
+func mediaFiles(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.FromSlash(filepath.Clean("/" + r.URL.Path))
+		key := filepath.ToSlash(strings.TrimPrefix(name, string(filepath.Separator)))
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) && (r.Method == "GET" || r.Method == "HEAD") {
+			var cold *ColdError
+			switch cerr := fetchCold(ColdKindMedia, key, coldPut(ColdKindMedia, key)); {
+			case cerr == nil:
+				fi, err = os.Stat(filepath.Join(dir, name))
+			case errors.As(cerr, &cold):
+				writeColdPending(w, cold)
+				return
+			case !errors.Is(cerr, sql.ErrNoRows):
+				w.Header().Set("Content-Type", "application/json")
+				apierror.Write(w, http.StatusBadGateway, cerr.Error())
+				return
+			}
+		}
+		if err == nil && !fi.IsDir() {
+			w.Header().Set("ETag", `"`+strconv.FormatInt(fi.Size(), 36)+"-"+strconv.FormatInt(fi.ModTime().UnixNano(), 36)+`"`)
+			noteAccess(ColdKindMedia, key)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// siteExportETag stands for a site export made with the given options: it
+// changes whenever a node of the site does, so the zip isn't rebuilt for
+// clients that have it
+func siteExportETag(siteID, options string) (string, time.Time) {
+	var count, modified, archived, deleted, siteModified int64
+	db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(modified_at), 0), COALESCE(MAX(archived_at), 0), COALESCE(MAX(deleted_at), 0) FROM nodes WHERE site_id = ?`, siteID).
+		Scan(&count, &modified, &archived, &deleted)
+	db.QueryRow(`SELECT modified_at FROM sites WHERE id = ?`, siteID).Scan(&siteModified)
+	last := max(modified, archived, deleted, siteModified)
+	parts := []string{siteID, options}
+	for _, n := range []int64{count, modified, archived, deleted, siteModified} {
+		parts = append(parts, strconv.FormatInt(n, 10))
+	}
+	return etagOf(parts...), time.Unix(last, 0)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+	defer func() { requireIfMatch = false }()
+
+	mux := setupRoutes()
+	do := func(method, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, parent_id, site_id, path, title, content, mime_type, status, created_at, modified_at) VALUES ('n1', 'post', NULL, 's1', 'a.md', 'A', 'hello', 'text/markdown', 'published', 1, 1)`)
+
+	rr := do("GET", "/api/node/n1", nil, "")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || etag == "" || rr.Header().Get("Last-Modified") == "" {
+		t.Fatalf("a node should carry an ETag and Last-Modified: %d %v", rr.Code, rr.Header())
+	}
+	if rr := do("GET", "/api/node/n1", map[string]string{"If-None-Match": etag}, ""); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Fatalf("a current ETag should revalidate: %d", rr.Code)
+	}
+	if rr := do("GET", "/api/node/n1", map[string]string{"If-None-Match": "W/" + etag}, ""); rr.Code != http.StatusNotModified {
+		t.Fatalf("a weak If-None-Match should revalidate too: %d", rr.Code)
+	}
+	if rr := do("GET", "/api/node/n1", map[string]string{"If-Modified-Since": time.Unix(1, 0).UTC().Format(http.TimeFormat)}, ""); rr.Code != http.StatusNotModified {
+		t.Fatalf("an unchanged node since its modification time should revalidate: %d", rr.Code)
+	}
+	if rr := do("GET", "/api/node/n1", map[string]string{"If-Modified-Since": time.Unix(0, 0).UTC().Format(http.TimeFormat)}, ""); rr.Code != http.StatusOK {
+		t.Fatalf("a node changed since should be sent: %d", rr.Code)
+	}
+
+	// two editors read the same node; the second save must not clobber the first
+	update := func(title, ifMatch string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"id": "n1", "type": "post", "path": "a.md", "title": title, "content": "hello", "mime_type": "text/markdown", "site_id": "s1"})
+		headers := map[string]string{"Content-Type": "application/json"}
+		if ifMatch != "" {
+			headers["If-Match"] = ifMatch
+		}
+		return do("PUT", "/api/node-update", headers, string(body))
+	}
+	rr = update("First", etag)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("an update with the current ETag should go through: %d %s", rr.Code, rr.Body.String())
+	}
+	newTag := rr.Header().Get("ETag")
+	if newTag == "" || newTag == etag {
+		t.Fatalf("an update should return the node's new ETag, got %q", newTag)
+	}
+	rr = update("Second", etag)
+	var conflict map[string]string
+	json.NewDecoder(rr.Body).Decode(&conflict)
+	if rr.Code != http.StatusPreconditionFailed || conflict["etag"] != newTag {
+		t.Fatalf("a stale If-Match should be refused with the current ETag: %d %v", rr.Code, conflict)
+	}
+	var title string
+	testDB.QueryRow(`SELECT title FROM nodes WHERE id = 'n1'`).Scan(&title)
+	if title != "First" {
+		t.Fatalf("a refused update should change nothing, title is %q", title)
+	}
+	if rr := do("GET", "/api/node/n1", map[string]string{"If-None-Match": etag}, ""); rr.Code != http.StatusOK || rr.Header().Get("ETag") != newTag {
+		t.Fatalf("an old ETag should get the changed node: %d", rr.Code)
+	}
+	if rr := update("Whatever", ""); rr.Code != http.StatusOK {
+		t.Fatalf("without --require-if-match an update needn't send If-Match: %d", rr.Code)
+	}
+	requireIfMatch = true
+	if rr := update("Blind", ""); rr.Code != http.StatusPreconditionRequired {
+		t.Fatalf("with --require-if-match an update without If-Match should get 428: %d", rr.Code)
+	}
+	requireIfMatch = false
+
+	// lists revalidate on their encoding
+	rr = do("GET", "/api/nodes", nil, "")
+	if rr := do("GET", "/api/nodes", map[string]string{"If-None-Match": rr.Header().Get("ETag")}, ""); rr.Code != http.StatusNotModified {
+		t.Fatalf("an unchanged list should revalidate: %d", rr.Code)
+	}
+
+	// media files are tagged by size and modification time
+	os.MkdirAll("media", 0755)
+	os.WriteFile("media/pic.txt", []byte("pixels"), 0644)
+	rr = do("GET", "/media/pic.txt", nil, "")
+	mediaTag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || mediaTag == "" {
+		t.Fatalf("a media file should carry an ETag: %d %v", rr.Code, rr.Header())
+	}
+	if rr := do("GET", "/media/pic.txt", map[string]string{"If-None-Match": mediaTag}, ""); rr.Code != http.StatusNotModified {
+		t.Fatalf("an unchanged media file should revalidate: %d", rr.Code)
+	}
+	// and serve byte ranges, so players can seek
+	rr = do("GET", "/media/pic.txt", map[string]string{"Range": "bytes=2-4", "If-Range": mediaTag}, "")
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "xel" || rr.Header().Get("Content-Range") != "bytes 2-4/6" {
+		t.Fatalf("a media file should serve a range: %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	// a site export is only rebuilt when the site changes
+	rr = do("GET", "/api/export?site_id=s1&format=zip", nil, "")
+	exportTag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || exportTag == "" {
+		t.Fatalf("an export should carry an ETag: %d", rr.Code)
+	}
+	if rr := do("GET", "/api/export?site_id=s1&format=zip", map[string]string{"If-None-Match": exportTag}, ""); rr.Code != http.StatusNotModified {
+		t.Fatalf("an unchanged site should revalidate its export: %d", rr.Code)
+	}
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, status, created_at, modified_at) VALUES ('n2', 'post', 's1', 'b.md', 'B', '', 'published', 1, 1)`)
+	rr = do("GET", "/api/export?site_id=s1&format=zip", map[string]string{"If-None-Match": exportTag}, "")
+	if rr.Code != http.StatusOK || !bytes.HasPrefix(rr.Body.Bytes(), []byte("PK")) {
+		t.Fatalf("a new node should change the export: %d", rr.Code)
+	}
+}
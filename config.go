@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	s3storage "veil/pkg/codex/storage/s3"
+	"veil/pkg/logging"
+	plugins "veil/pkg/plugins"
+	"veil/pkg/store"
+)
+
+// === Configuration File ===
+// veil serve and veil gui read their settings from veil.yaml or veil.toml,
+// a YAML or TOML document whose sections nest as the dotted keys do.
+// Every setting has a dotted key, server.port for port under
+// [server], and a VEIL_* environment variable, VEIL_SERVER_PORT, that
+// overrides the file. Command-line flags, parsed by parseFlags, override
+// both; use then hands the result to the handlers. Plugin settings
+// live under plugins.<slug> and are the defaults the plugin is started
+// with, below the configuration saved for it in the vault.
+
+// Config is veil's configuration
+type Config struct {
+	Path       string // the file it was read from, empty when there is none
+	Vault      string
+	Database   string // postgres:// URL, empty for the vault's veil.db
+	Server     ServerConfig
+	JobWorkers int
+	LogFormat  string                            // text or json
+	LogLevel   string                            // debug, info, warn or error
+	Plugins    map[string]map[string]interface{} // by plugin slug
+
+	OpenRegistration bool
+	RequireIfMatch   bool
+	ReadOnly         bool
+	Limits           Limits
+	Security         SecurityConfig
+	Images           ImageVariantConfig
+	SummaryPlugin    string
+	CodexCacheBytes  int64
+	CodexSyncToken   string
+	CodexS3          *s3storage.Config // nil keeps codex objects in the vault
+	Cold             ColdStorageConfig
+	ColdS3           *s3storage.Config // nil turns cold storage off
+	TrashRetention   time.Duration
+	Alerts           AlertConfig
+	Backups          BackupConfig
+
+	// Sources says where each setting that isn't a default came from: the
+	// file or the environment variable
+	Sources map[string]string
+}
+
+// DefaultConfig is the configuration without a file or environment: the
+// settings veil's handlers start with
+func DefaultConfig() *Config {
+	return &Config{
+		Server:          DefaultServerConfig(),
+		JobWorkers:      plugins.DefaultJobQueueConfig().Workers,
+		LogFormat:       "text",
+		LogLevel:        "info",
+		Plugins:         map[string]map[string]interface{}{},
+		Sources:         map[string]string{},
+		Limits:          limits,
+		Security:        securityConfig,
+		Images:          imageVariantConfig,
+		SummaryPlugin:   summaryPlugin,
+		CodexCacheBytes: codexCacheBytes,
+		CodexSyncToken:  codexSyncToken,
+		Cold:            coldConfig,
+		TrashRetention:  trashRetention,
+		Alerts:          alertConfig,
+		Backups:         backupConfig,
+	}
+}
+
+// jobQueue is the job queue configuration, with c's number of workers
+func (c *Config) jobQueue() plugins.JobQueueConfig {
+	q := plugins.DefaultJobQueueConfig()
+	q.Workers = c.JobWorkers
+	return q
+}
+
+// use makes c the settings veil's handlers, workers and plugins read
+func (c *Config) use() {
+	openRegistration, requireIfMatch, readOnly = c.OpenRegistration, c.RequireIfMatch, c.ReadOnly
+	limits, securityConfig, imageVariantConfig, summaryPlugin = c.Limits, c.Security, c.Images, c.SummaryPlugin
+	codexCacheBytes, codexSyncToken, codexS3 = c.CodexCacheBytes, c.CodexSyncToken, c.CodexS3
+	coldConfig, trashRetention, alertConfig, backupConfig = c.Cold, c.TrashRetention, c.Alerts, c.Backups
+	plugins.SetPluginDefaults(c.pluginDefaults())
+}
+
+// configSetting is one dotted key of the configuration
+type configSetting struct {
+	key string
+	get func(c *Config) string
+	set func(c *Config, v string) error
+}
+
+func stringSetting(key string, field func(c *Config) *string) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return *field(c) },
+		func(c *Config, v string) error { *field(c) = v; return nil }}
+}
+
+func boolSetting(key string, field func(c *Config) *bool) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return strconv.FormatBool(*field(c)) },
+		func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("must be true or false")
+			}
+			*field(c) = b
+			return nil
+		}}
+}
+
+// intSetting is a count, 0 or more
+func intSetting(key string, field func(c *Config) *int) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return strconv.Itoa(*field(c)) },
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a number")
+			}
+			*field(c) = n
+			return nil
+		}}
+}
+
+// sizeSetting is a byte count given in KB (shift 10) or MB (shift 20)
+func sizeSetting(key string, shift uint, field func(c *Config) *int64) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return strconv.FormatInt(*field(c)>>shift, 10) },
+		func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a number")
+			}
+			*field(c) = n << shift
+			return nil
+		}}
+}
+
+func percentSetting(key string, field func(c *Config) *float64) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return strconv.FormatFloat(*field(c), 'g', -1, 64) },
+		func(c *Config, v string) error {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n < 0 || n > 100 {
+				return fmt.Errorf("must be a percentage")
+			}
+			*field(c) = n
+			return nil
+		}}
+}
+
+// durationSetting is a whole number of units, "seconds" or the like
+func durationSetting(key string, unit time.Duration, units string, field func(c *Config) *time.Duration) configSetting {
+	return configSetting{key,
+		func(c *Config) string { return strconv.Itoa(int(*field(c) / unit)) },
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("must be a number of %s", units)
+			}
+			*field(c) = time.Duration(n) * unit
+			return nil
+		}}
+}
+
+func secondsSetting(key string, field func(c *Config) *time.Duration) configSetting {
+	return durationSetting(key, time.Second, "seconds", field)
+}
+
+// s3Setting is one setting of a bucket: endpoint, bucket, region, prefix,
+// path_style or storage_class. Setting any of them configures the bucket.
+func s3Setting(key string, field func(c *Config) **s3storage.Config) configSetting {
+	name := strings.ReplaceAll(key[strings.LastIndex(key, ".s3_")+len(".s3_"):], "_", "-")
+	return configSetting{key,
+		func(c *Config) string { return s3Value(*field(c), name) },
+		func(c *Config, v string) error { s3Flag(field(c), name, v); return nil }}
+}
+
+// configSettings are the settings veil knows, in the order they're shown
+var configSettings = []configSetting{
+	stringSetting("vault", func(c *Config) *string { return &c.Vault }),
+	{"database",
+		func(c *Config) string { return redactedDatabaseURL(c.Database) },
+		func(c *Config, v string) error {
+			if v != "" {
+				if _, err := store.ParsePostgresURL(v); err != nil {
+					return fmt.Errorf("must be a postgres:// URL")
+				}
+			}
+			c.Database = v
+			return nil
+		}},
+	stringSetting("server.host", func(c *Config) *string { return &c.Server.Host }),
+	stringSetting("server.port", func(c *Config) *string { return &c.Server.Port }),
+	secondsSetting("server.read_timeout", func(c *Config) *time.Duration { return &c.Server.ReadTimeout }),
+	secondsSetting("server.write_timeout", func(c *Config) *time.Duration { return &c.Server.WriteTimeout }),
+	secondsSetting("server.idle_timeout", func(c *Config) *time.Duration { return &c.Server.IdleTimeout }),
+	secondsSetting("server.shutdown_timeout", func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+	stringSetting("server.tls_cert", func(c *Config) *string { return &c.Server.TLSCert }),
+	stringSetting("server.tls_key", func(c *Config) *string { return &c.Server.TLSKey }),
+	{"server.acme_domains",
+		func(c *Config) string { return strings.Join(c.Server.ACMEDomains, ", ") },
+		func(c *Config, v string) error { c.Server.ACMEDomains = frontMatterList(v); return nil }},
+	stringSetting("server.acme_email", func(c *Config) *string { return &c.Server.ACMEEmail }),
+	stringSetting("server.acme_directory", func(c *Config) *string { return &c.Server.ACMEDirectory }),
+	stringSetting("server.acme_cache", func(c *Config) *string { return &c.Server.ACMECache }),
+	stringSetting("server.http_port", func(c *Config) *string { return &c.Server.HTTPPort }),
+	boolSetting("server.read_only", func(c *Config) *bool { return &c.ReadOnly }),
+	boolSetting("server.require_if_match", func(c *Config) *bool { return &c.RequireIfMatch }),
+	boolSetting("auth.open_registration", func(c *Config) *bool { return &c.OpenRegistration }),
+	stringSetting("security.csp", func(c *Config) *string { return &c.Security.CSP }),
+	stringSetting("security.frame_options", func(c *Config) *string { return &c.Security.FrameOptions }),
+	stringSetting("security.referrer_policy", func(c *Config) *string { return &c.Security.ReferrerPolicy }),
+	intSetting("security.hsts_max_age", func(c *Config) *int { return &c.Security.HSTSMaxAge }),
+	sizeSetting("limits.max_node_kb", 10, func(c *Config) *int64 { return &c.Limits.MaxNodeBytes }),
+	sizeSetting("limits.max_media_mb", 20, func(c *Config) *int64 { return &c.Limits.MaxMediaBytes }),
+	intSetting("limits.max_commit_objects", func(c *Config) *int { return &c.Limits.MaxObjectsPerCommit }),
+	sizeSetting("limits.max_vault_mb", 20, func(c *Config) *int64 { return &c.Limits.MaxVaultBytes }),
+	{"images.widths",
+		func(c *Config) string { return joinInts(c.Images.Widths) },
+		func(c *Config, v string) error { c.Images.Widths = parseImageWidths(v); return nil }},
+	intSetting("images.thumbnail_size", func(c *Config) *int { return &c.Images.Thumbnail }),
+	stringSetting("summary_plugin", func(c *Config) *string { return &c.SummaryPlugin }),
+	sizeSetting("codex.cache_mb", 20, func(c *Config) *int64 { return &c.CodexCacheBytes }),
+	{"codex.sync_token",
+		func(c *Config) string { return redactedSecret(c.CodexSyncToken) },
+		func(c *Config, v string) error { c.CodexSyncToken = v; return nil }},
+	s3Setting("codex.s3_endpoint", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	s3Setting("codex.s3_bucket", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	s3Setting("codex.s3_region", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	s3Setting("codex.s3_prefix", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	s3Setting("codex.s3_path_style", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	s3Setting("codex.s3_storage_class", func(c *Config) **s3storage.Config { return &c.CodexS3 }),
+	durationSetting("cold.after_months", 30*24*time.Hour, "months", func(c *Config) *time.Duration { return &c.Cold.After }),
+	intSetting("cold.restore_days", func(c *Config) *int { return &c.Cold.RestoreDays }),
+	s3Setting("cold.s3_endpoint", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	s3Setting("cold.s3_bucket", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	s3Setting("cold.s3_region", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	s3Setting("cold.s3_prefix", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	s3Setting("cold.s3_path_style", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	s3Setting("cold.s3_storage_class", func(c *Config) **s3storage.Config { return &c.ColdS3 }),
+	durationSetting("trash.retention_days", 24*time.Hour, "days", func(c *Config) *time.Duration { return &c.TrashRetention }),
+	intSetting("alerts.publish_failures", func(c *Config) *int { return &c.Alerts.PublishFailures }),
+	percentSetting("alerts.disk_free_percent", func(c *Config) *float64 { return &c.Alerts.DiskFreePercent }),
+	percentSetting("alerts.vault_percent", func(c *Config) *float64 { return &c.Alerts.VaultPercent }),
+	durationSetting("alerts.repeat_minutes", time.Minute, "minutes", func(c *Config) *time.Duration { return &c.Alerts.Repeat }),
+	{"backups.schedule",
+		func(c *Config) string { return c.Backups.Schedule },
+		func(c *Config, v string) error {
+			if v != "" {
+				if _, err := parseCron(v); err != nil {
+					return err
+				}
+			}
+			c.Backups.Schedule = v
+			return nil
+		}},
+	stringSetting("backups.dir", func(c *Config) *string { return &c.Backups.Dir }),
+	intSetting("backups.keep_daily", func(c *Config) *int { return &c.Backups.KeepDaily }),
+	intSetting("backups.keep_weekly", func(c *Config) *int { return &c.Backups.KeepWeekly }),
+	s3Setting("backups.s3_endpoint", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	s3Setting("backups.s3_bucket", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	s3Setting("backups.s3_region", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	s3Setting("backups.s3_prefix", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	s3Setting("backups.s3_path_style", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	s3Setting("backups.s3_storage_class", func(c *Config) **s3storage.Config { return &c.Backups.S3 }),
+	{"backups.sftp",
+		func(c *Config) string { return c.Backups.SFTP },
+		func(c *Config, v string) error {
+			if host, dir, ok := strings.Cut(v, ":"); v != "" && (!ok || host == "" || dir == "") {
+				return fmt.Errorf("must be user@host:dir")
+			}
+			c.Backups.SFTP = v
+			return nil
+		}},
+	stringSetting("backups.sftp_port", func(c *Config) *string { return &c.Backups.SFTPPort }),
+	stringSetting("backups.sftp_identity", func(c *Config) *string { return &c.Backups.SFTPIdentity }),
+	{"jobs.workers",
+		func(c *Config) string { return strconv.Itoa(c.JobWorkers) },
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("must be a positive number")
+			}
+			c.JobWorkers = n
+			return nil
+		}},
+	{"log.format",
+		func(c *Config) string { return c.LogFormat },
+		func(c *Config, v string) error {
+			if v != "text" && v != "json" {
+				return fmt.Errorf("must be text or json")
+			}
+			c.LogFormat = v
+			return nil
+		}},
+	{"log.level",
+		func(c *Config) string { return c.LogLevel },
+		func(c *Config, v string) error {
+			if _, err := logging.ParseLevel(v); err != nil {
+				return fmt.Errorf("must be debug, info, warn or error")
+			}
+			c.LogLevel = v
+			return nil
+		}},
+}
+
+// redactedDatabaseURL is a database URL fit to show, without its password
+func redactedDatabaseURL(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	return u.Redacted()
+}
+
+// redactedSecret shows whether a secret is set, not what it is
+func redactedSecret(v string) string {
+	if v == "" {
+		return ""
+	}
+	return "xxxxx"
+}
+
+func joinInts(ns []int) string {
+	parts := make([]string, len(ns))
+	for i, n := range ns {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ",")
+}
+
+func findConfigSetting(key string) *configSetting {
+	for i := range configSettings {
+		if configSettings[i].key == key {
+			return &configSettings[i]
+		}
+	}
+	return nil
+}
+
+// configEnvVar is the environment variable overriding key
+func configEnvVar(key string) string {
+	return "VEIL_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// s3Flag applies one of the --<x>-s3-endpoint|bucket|region|prefix|path-style|
+// storage-class flags, given without its prefix, to *cfg
+func s3Flag(cfg **s3storage.Config, name, val string) {
+	if *cfg == nil {
+		// credentials come from the environment so they stay out of process listings
+		*cfg = &s3storage.Config{AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"), SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), PathStyle: true}
+	}
+	switch name {
+	case "endpoint":
+		(*cfg).Endpoint = val
+	case "bucket":
+		(*cfg).Bucket = val
+	case "region":
+		(*cfg).Region = val
+	case "prefix":
+		(*cfg).Prefix = val
+	case "path-style":
+		(*cfg).PathStyle = val != "false"
+	case "storage-class":
+		(*cfg).StorageClass = val
+	}
+}
+
+// s3Value is the s3Flag setting name of cfg, "" without a bucket
+func s3Value(cfg *s3storage.Config, name string) string {
+	if cfg == nil {
+		return ""
+	}
+	switch name {
+	case "endpoint":
+		return cfg.Endpoint
+	case "bucket":
+		return cfg.Bucket
+	case "region":
+		return cfg.Region
+	case "prefix":
+		return cfg.Prefix
+	case "path-style":
+		return strconv.FormatBool(cfg.PathStyle)
+	case "storage-class":
+		return cfg.StorageClass
+	}
+	return ""
+}
+
+// configFlag is a command-line flag for a setting
+type configFlag struct{ name, key string }
+
+// serveFlags are the flags of veil serve. The boolean ones take no value.
+var serveFlags = []configFlag{
+	{"vault", "vault"}, {"host", "server.host"}, {"port", "server.port"},
+	{"read-timeout", "server.read_timeout"}, {"write-timeout", "server.write_timeout"},
+	{"idle-timeout", "server.idle_timeout"}, {"shutdown-timeout", "server.shutdown_timeout"},
+	{"tls-cert", "server.tls_cert"}, {"tls-key", "server.tls_key"},
+	{"acme-domain", "server.acme_domains"}, {"acme-email", "server.acme_email"},
+	{"acme-directory", "server.acme_directory"}, {"acme-cache", "server.acme_cache"}, {"http-port", "server.http_port"},
+	{"read-only", "server.read_only"}, {"require-if-match", "server.require_if_match"},
+	{"open-registration", "auth.open_registration"},
+	{"log-format", "log.format"}, {"log-level", "log.level"}, {"job-workers", "jobs.workers"},
+	{"csp", "security.csp"}, {"frame-options", "security.frame_options"},
+	{"referrer-policy", "security.referrer_policy"}, {"hsts-max-age", "security.hsts_max_age"},
+	{"max-node-kb", "limits.max_node_kb"}, {"max-media-mb", "limits.max_media_mb"},
+	{"max-commit-objects", "limits.max_commit_objects"}, {"max-vault-mb", "limits.max_vault_mb"},
+	{"image-widths", "images.widths"}, {"thumbnail-size", "images.thumbnail_size"},
+	{"summary-plugin", "summary_plugin"},
+	{"codex-cache-mb", "codex.cache_mb"}, {"codex-sync-token", "codex.sync_token"},
+	{"codex-s3-endpoint", "codex.s3_endpoint"}, {"codex-s3-bucket", "codex.s3_bucket"},
+	{"codex-s3-region", "codex.s3_region"}, {"codex-s3-prefix", "codex.s3_prefix"},
+	{"codex-s3-path-style", "codex.s3_path_style"}, {"codex-s3-storage-class", "codex.s3_storage_class"},
+	{"cold-after-months", "cold.after_months"}, {"cold-restore-days", "cold.restore_days"},
+	{"cold-s3-endpoint", "cold.s3_endpoint"}, {"cold-s3-bucket", "cold.s3_bucket"},
+	{"cold-s3-region", "cold.s3_region"}, {"cold-s3-prefix", "cold.s3_prefix"},
+	{"cold-s3-path-style", "cold.s3_path_style"}, {"cold-s3-storage-class", "cold.s3_storage_class"},
+	{"trash-retention-days", "trash.retention_days"},
+	{"alert-publish-failures", "alerts.publish_failures"}, {"alert-disk-free-percent", "alerts.disk_free_percent"},
+	{"alert-vault-percent", "alerts.vault_percent"}, {"alert-repeat-minutes", "alerts.repeat_minutes"},
+	{"backup-schedule", "backups.schedule"}, {"backup-dir", "backups.dir"},
+	{"backup-keep-daily", "backups.keep_daily"}, {"backup-keep-weekly", "backups.keep_weekly"},
+	{"backup-s3-endpoint", "backups.s3_endpoint"}, {"backup-s3-bucket", "backups.s3_bucket"},
+	{"backup-s3-region", "backups.s3_region"}, {"backup-s3-prefix", "backups.s3_prefix"},
+	{"backup-s3-path-style", "backups.s3_path_style"}, {"backup-s3-storage-class", "backups.s3_storage_class"},
+	{"backup-sftp", "backups.sftp"}, {"backup-sftp-port", "backups.sftp_port"}, {"backup-sftp-identity", "backups.sftp_identity"},
+}
+
+var boolFlags = map[string]bool{"read-only": true, "require-if-match": true, "open-registration": true}
+
+// guiFlags are the flags of veil gui
+var guiFlags = []configFlag{{"vault", "vault"}, {"log-format", "log.format"}, {"log-level", "log.level"}}
+
+// parseFlags applies the flags of command in args over c, recording each
+// as the source of its setting. --config names the file c was loaded from.
+func (c *Config) parseFlags(command string, args []string, flags []configFlag) error {
+	fs := flag.NewFlagSet("veil "+command, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.String("config", "", "configuration file")
+	for _, f := range flags {
+		s, name := findConfigSetting(f.key), f.name
+		set := func(v string) error {
+			if err := s.set(c, v); err != nil {
+				return err
+			}
+			c.Sources[s.key] = "--" + name
+			return nil
+		}
+		if boolFlags[name] {
+			fs.BoolFunc(name, s.key, set)
+		} else {
+			fs.Func(name, s.key, set)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("veil %s: %v", command, err)
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("veil %s: unexpected argument %s", command, fs.Arg(0))
+	}
+	return nil
+}
+
+// configFileFlag returns the value of --config in args, if any
+func configFileFlag(args []string) string {
+	for i, arg := range args {
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// userConfigFile is veil.yaml in the user config dir, beside vaults.json
+func userConfigFile() string {
+	return filepath.Join(filepath.Dir(vaultRegistryFile()), "veil.yaml")
+}
+
+// findConfigFile is path, else $VEIL_CONFIG, else the first of veil.yaml,
+// veil.yml and veil.toml in the current directory, else the user's
+// veil.yaml. It returns "" when none of those exists.
+func findConfigFile(path string) string {
+	if path != "" {
+		return path
+	}
+	if p := os.Getenv("VEIL_CONFIG"); p != "" {
+		return p
+	}
+	for _, p := range []string{"veil.yaml", "veil.yml", "veil.toml", userConfigFile()} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// loadConfig reads the configuration file findConfigFile picks for path,
+// then applies VEIL_* environment variables. A path given explicitly must
+// exist.
+func loadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	file := findConfigFile(path)
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.apply(values, file); err != nil {
+			return nil, err
+		}
+		cfg.Path = file
+	}
+	for _, s := range configSettings {
+		env := configEnvVar(s.key)
+		if v, ok := os.LookupEnv(env); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("%s: %v", env, err)
+			}
+			cfg.Sources[s.key] = env
+		}
+	}
+	return cfg, nil
+}
+
+// apply sets the dotted settings in values, read from source
+func (c *Config) apply(values map[string]interface{}, source string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if slug, name, ok := pluginConfigKey(key); ok {
+			if c.Plugins[slug] == nil {
+				c.Plugins[slug] = map[string]interface{}{}
+			}
+			c.Plugins[slug][name] = values[key]
+			c.Sources[key] = source
+			continue
+		}
+		s := findConfigSetting(key)
+		if s == nil {
+			return fmt.Errorf("%s: unknown setting %s", source, key)
+		}
+		if err := s.set(c, frontMatterString(values[key])); err != nil {
+			return fmt.Errorf("%s: %s %v", source, key, err)
+		}
+		c.Sources[key] = source
+	}
+	return nil
+}
+
+// pluginConfigKey splits plugins.<slug>.<name>
+func pluginConfigKey(key string) (slug, name string, ok bool) {
+	rest, ok := strings.CutPrefix(key, "plugins.")
+	if !ok {
+		return "", "", false
+	}
+	slug, name, ok = strings.Cut(rest, ".")
+	return slug, name, ok && slug != "" && name != ""
+}
+
+// readConfigFile reads a YAML or TOML configuration file into dotted keys
+func readConfigFile(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := ""
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	case ".toml":
+		format = "toml"
+	default:
+		return nil, fmt.Errorf("%s: configuration files are .yaml, .yml or .toml", path)
+	}
+	parsed, err := decodeDocument(format, string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := map[string]interface{}{}
+	flattenConfig(values, "", parsed)
+	return values, nil
+}
+
+// flattenConfig adds the values in m to values under dotted keys. Sections
+// nest to any depth, plugins.<slug> ones too, but a plugin setting is kept
+// whole.
+func flattenConfig(values map[string]interface{}, prefix string, m map[string]interface{}) {
+	for k, v := range m {
+		key := prefix + k
+		if v == nil {
+			continue // an empty section or value
+		}
+		section, ok := v.(map[string]interface{})
+		if _, _, plugin := pluginConfigKey(key); !ok || plugin {
+			values[key] = v
+			continue
+		}
+		flattenConfig(values, key+".", section)
+	}
+}
+
+// writeConfigFile writes dotted keys to path in its format, as nested
+// sections
+func writeConfigFile(path string, values map[string]interface{}) error {
+	doc := map[string]interface{}{}
+	for key, v := range values {
+		parts := strings.Split(key, ".")
+		if slug, name, ok := pluginConfigKey(key); ok {
+			parts = []string{"plugins", slug, name}
+		}
+		section := doc
+		for _, name := range parts[:len(parts)-1] {
+			next, ok := section[name].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				section[name] = next
+			}
+			section = next
+		}
+		section[parts[len(parts)-1]] = v
+	}
+	var out bytes.Buffer
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		enc := toml.NewEncoder(&out)
+		enc.Indent = ""
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	} else {
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+		enc.Close()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// configScalar is a value from the command line as YAML reads it: a number,
+// true or false, or else the text
+func configScalar(value string) interface{} {
+	var v interface{}
+	if yaml.Unmarshal([]byte(value), &v) == nil {
+		switch v.(type) {
+		case int, float64, bool:
+			return frontMatterValue(v)
+		}
+	}
+	return value
+}
+
+// pluginDefaults are the plugin settings as plugins expect them, numbers
+// as float64 the way they come out of a saved JSON configuration
+func (c *Config) pluginDefaults() map[string]map[string]interface{} {
+	out := map[string]map[string]interface{}{}
+	for slug, settings := range c.Plugins {
+		b, _ := json.Marshal(settings)
+		var m map[string]interface{}
+		json.Unmarshal(b, &m)
+		out[slug] = m
+	}
+	return out
+}
+
+// configCommand is `veil config show [--json]` and `veil config set KEY VALUE`,
+// both taking --config FILE
+func configCommand() {
+	usage := "Usage: veil config show [--json] [--config FILE]\n       veil config set KEY VALUE [--config FILE]"
+	if len(os.Args) < 3 {
+		fmt.Println(usage)
+		return
+	}
+	path := configFileFlag(os.Args)
+	var args []string
+	asJSON := false
+	for i := 3; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--config":
+			i++
+		case "--json":
+			asJSON = true
+		default:
+			args = append(args, os.Args[i])
+		}
+	}
+
+	switch os.Args[2] {
+	case "show":
+		cfg, err := loadConfig(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		printConfig(cfg, asJSON)
+	case "set":
+		if len(args) != 2 {
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+		file, err := setConfigValue(path, args[0], args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s = %s in %s\n", args[0], args[1], file)
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// setConfigValue sets key in the configuration file for path, the user's
+// veil.yaml when there is none yet, and returns the file written
+func setConfigValue(path, key, value string) (string, error) {
+	file := findConfigFile(path)
+	if file == "" {
+		file = userConfigFile()
+	}
+	values, err := readConfigFile(file)
+	if os.IsNotExist(err) {
+		values, err = map[string]interface{}{}, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, _, ok := pluginConfigKey(key); !ok {
+		s := findConfigSetting(key)
+		if s == nil {
+			return "", fmt.Errorf("unknown setting %s; see veil config show", key)
+		}
+		if err := s.set(DefaultConfig(), value); err != nil {
+			return "", fmt.Errorf("%s %v", key, err)
+		}
+	}
+	values[key] = configScalar(value)
+	return file, writeConfigFile(file, values)
+}
+
+func printConfig(cfg *Config, asJSON bool) {
+	type entry struct {
+		Key    string      `json:"key"`
+		Value  interface{} `json:"value"`
+		Source string      `json:"source"`
+	}
+	var entries []entry
+	for _, s := range configSettings {
+		source := cfg.Sources[s.key]
+		if source == "" {
+			source = "default"
+		}
+		entries = append(entries, entry{s.key, s.get(cfg), source})
+	}
+	var pluginKeys []string
+	for slug, settings := range cfg.Plugins {
+		for name := range settings {
+			pluginKeys = append(pluginKeys, "plugins."+slug+"."+name)
+		}
+	}
+	sort.Strings(pluginKeys)
+	for _, key := range pluginKeys {
+		slug, name, _ := pluginConfigKey(key)
+		entries = append(entries, entry{key, cfg.Plugins[slug][name], cfg.Sources[key]})
+	}
+
+	if asJSON {
+		b, _ := json.MarshalIndent(map[string]interface{}{"file": cfg.Path, "settings": entries}, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	if cfg.Path == "" {
+		fmt.Println("# no configuration file; veil config set writes " + userConfigFile())
+	} else {
+		fmt.Println("# " + cfg.Path)
+	}
+	for _, e := range entries {
+		line := fmt.Sprintf("%s = %s", e.Key, frontMatterString(e.Value))
+		if e.Source != "default" && e.Source != cfg.Path {
+			line += "  # " + e.Source
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// === Hugo and Jekyll Export ===
+// With Format "hugo" or "jekyll" a site exports as Markdown for an existing
+// Hugo or Jekyll site instead of as HTML. Each published node becomes a file
+// of the content tree whose front matter is built from the node: its
+// metadata (including any front matter its content had), then title, slug,
+// publish date, modification date, tags, aliases and description. Media the
+// content links to is copied where the generator serves it from /media/, so
+// links keep working. Nothing else of the generator's site is written; the
+// theme and config stay the user's.
+//
+// Hugo: posts go to content/posts/<slug>.md, pages to content/<slug>.md and
+// other types to content/<type>/<slug>.md, with media under static/media/.
+// Jekyll: posts go to _posts/<date>-<slug>.md, every other node to
+// <slug>.md with a permalink, and media to media/.
+
+// isContentTreeFormat reports whether an export format writes a content tree
+func isContentTreeFormat(format string) bool {
+	return format == "hugo" || format == "jekyll"
+}
+
+// contentTreeNode is a node with what its front matter needs
+type contentTreeNode struct {
+	Node
+	Description string
+	Published   time.Time
+	Tags        []string
+}
+
+// planContentTree lists the files of a site's Hugo or Jekyll export
+func planContentTree(opts ExportOptions) ([]*siteFile, error) {
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, opts.SiteID).Scan(&exists); err != nil || exists == 0 {
+		return nil, fmt.Errorf("site not found: %s", opts.SiteID)
+	}
+
+	// The publish date is the blog post's, else that of the first published
+	// version, else the front matter's, else the node's creation
+	archived := ` AND n.archived_at IS NULL`
+	if opts.IncludeArchived {
+		archived = ""
+	}
+	rows, err := db.Query(`
+		SELECT n.id, n.type, COALESCE(n.title, ''), COALESCE(n.content, ''), COALESCE(n.slug, ''),
+			COALESCE(n.metadata, ''), COALESCE(n.mime_type, ''), COALESCE(n.meta_description, ''), n.created_at, n.modified_at,
+			COALESCE((SELECT MIN(bp.publish_date) FROM blog_posts bp WHERE bp.node_id = n.id),
+				(SELECT MIN(v.published_at) FROM versions v WHERE v.node_id = n.id), 0)
+		FROM nodes n
+		WHERE n.site_id = ? AND (n.status = 'published' OR n.status = 'public') AND n.deleted_at IS NULL`+archived+`
+		ORDER BY n.created_at, n.id
+	`, opts.SiteID)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*contentTreeNode
+	byID := map[string]*contentTreeNode{}
+	for rows.Next() {
+		n := &contentTreeNode{}
+		var created, modified, published int64
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Content, &n.Slug, &n.Metadata, &n.MimeType, &n.Description, &created, &modified, &published); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		n.CreatedAt, n.ModifiedAt, n.Published = time.Unix(created, 0).UTC(), time.Unix(modified, 0).UTC(), time.Unix(published, 0).UTC()
+		if published == 0 {
+			n.Published = n.CreatedAt
+			if fm := frontMatterFields(n.Metadata); fm != nil && fm.Date != nil {
+				n.Published = *fm.Date
+			}
+		}
+		nodes = append(nodes, n)
+		byID[n.ID] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT nt.node_id, t.name FROM node_tags nt JOIN tags t ON t.id = nt.tag_id ORDER BY t.name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var nodeID, name string
+		if err := rows.Scan(&nodeID, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if n, ok := byID[nodeID]; ok {
+			n.Tags = append(n.Tags, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var files []*siteFile
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		n := n
+		name := contentTreeFileName(opts.Format, n)
+		for i := 2; seen[name]; i++ {
+			name = strings.TrimSuffix(contentTreeFileName(opts.Format, n), ".md") + fmt.Sprintf("-%d.md", i)
+		}
+		seen[name] = true
+		key := []string{opts.Format, n.ID, n.Type, n.Title, n.Content, n.Slug, n.Metadata, n.Description,
+			fmt.Sprint(n.Published.Unix(), n.ModifiedAt.Unix())}
+		key = append(key, n.Tags...)
+		files = append(files, &siteFile{Path: name, Key: buildKey(key...), Deps: []string{n.ID}, render: func() ([]byte, error) {
+			return renderContentTreeNode(opts.Format, n), nil
+		}})
+		if !opts.IncludeAssets {
+			continue
+		}
+		mediaDir := "media/"
+		if opts.Format == "hugo" {
+			mediaDir = "static/media/"
+		}
+		for _, m := range mediaRef.FindAllStringSubmatch(n.Content, -1) {
+			if seen[mediaDir+m[1]] {
+				continue
+			}
+			if data, err := os.ReadFile(filepath.Join("media", m[1])); err == nil {
+				seen[mediaDir+m[1]] = true
+				sum := sha256.Sum256(data)
+				files = append(files, &siteFile{Path: mediaDir + m[1], Key: hex.EncodeToString(sum[:16]), Deps: []string{n.ID}, render: func() ([]byte, error) {
+					return data, nil
+				}})
+			}
+		}
+	}
+	return files, nil
+}
+
+// contentTreeSlug is the part of a node's file name after any date
+func contentTreeSlug(n *contentTreeNode) string {
+	if s := slugify(n.Slug); s != "" {
+		return s
+	}
+	if s := slugify(n.Title); s != "" {
+		return s
+	}
+	return n.ID
+}
+
+// contentTreeFileName is where a node goes in a Hugo or Jekyll site
+func contentTreeFileName(format string, n *contentTreeNode) string {
+	slug := contentTreeSlug(n)
+	if format == "jekyll" {
+		if n.Type == "post" {
+			return "_posts/" + n.Published.Format("2006-01-02") + "-" + slug + ".md"
+		}
+		return slug + ".md"
+	}
+	switch n.Type {
+	case "post":
+		return "content/posts/" + slug + ".md"
+	case "page":
+		return "content/" + slug + ".md"
+	}
+	return "content/" + slugify(n.Type) + "/" + slug + ".md"
+}
+
+// renderContentTreeNode is a node's Markdown file, front matter first
+func renderContentTreeNode(format string, n *contentTreeNode) []byte {
+	meta := map[string]interface{}{}
+	json.Unmarshal([]byte(n.Metadata), &meta)
+	delete(meta, "draft")
+
+	tags := append([]string{}, n.Tags...)
+	for _, t := range frontMatterStrings(meta["tags"]) {
+		if !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	aliases := frontMatterStrings(meta["aliases"])
+	if aliases == nil {
+		aliases = frontMatterStrings(meta["alias"])
+	}
+	delete(meta, "alias")
+	if n.Title != "" {
+		meta["title"] = n.Title
+	}
+	if n.Description != "" {
+		meta["description"] = n.Description
+	}
+	if len(tags) > 0 {
+		meta["tags"] = tags
+	}
+	slug := contentTreeSlug(n)
+
+	// the fields set from the node come first, in this order
+	first := []string{"title", "date"}
+	dates := map[string]time.Time{"date": n.Published}
+	if format == "jekyll" {
+		delete(meta, "aliases")
+		if len(aliases) > 0 {
+			meta["redirect_from"] = aliases // jekyll-redirect-from
+		}
+		if _, ok := meta["layout"]; !ok {
+			meta["layout"] = "page"
+			if n.Type == "post" {
+				meta["layout"] = "post"
+			}
+		}
+		if n.Type != "post" {
+			if _, ok := meta["permalink"]; !ok {
+				meta["permalink"] = "/" + slug + "/"
+			}
+		}
+		dates["last_modified_at"] = n.ModifiedAt
+		first = append(first, "last_modified_at", "layout", "permalink")
+	} else {
+		if len(aliases) > 0 {
+			meta["aliases"] = aliases
+		}
+		meta["slug"] = slug
+		meta["draft"] = false
+		dates["lastmod"] = n.ModifiedAt
+		first = append(first, "lastmod", "slug", "draft")
+	}
+	for k := range dates {
+		delete(meta, k)
+	}
+	first = append(first, "description", "tags", "aliases", "redirect_from")
+
+	var keys []string
+	for k := range meta {
+		if !slices.Contains(first, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	for _, k := range append(first, keys...) {
+		if t, ok := dates[k]; ok {
+			fmt.Fprintf(&b, "%s: %s\n", yamlKey(k), t.Format(time.RFC3339))
+			continue
+		}
+		v, ok := meta[k]
+		if !ok {
+			continue
+		}
+		value, err := json.Marshal(v) // JSON is YAML
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\n", yamlKey(k), value)
+	}
+	b.WriteString("---\n\n")
+	content := stripFrontMatter(n.Content)
+	if n.Type == NodeTypeTable {
+		// the generators render Markdown tables, not CSV
+		if t, err := parseTable(n.Content, n.MimeType, n.Metadata); err == nil {
+			content = tableMarkdown(t)
+		}
+	}
+	b.WriteString(strings.TrimLeft(content, "\r\n"))
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+// yamlKey quotes a key YAML would not read back as written
+func yamlKey(k string) string {
+	for _, r := range k {
+		if !(r == '_' || r == '-' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			b, _ := json.Marshal(k)
+			return string(b)
+		}
+	}
+	return k
+}
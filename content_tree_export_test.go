@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContentTreeExport(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "content-tree-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	os.MkdirAll("media", 0755)
+	os.WriteFile(filepath.Join("media", "cat.png"), []byte("png"), 0644)
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, metadata, meta_description, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'Hello: World', '---
+title: Hello
+draft: true
+---
+Body with ![cat](/media/cat.png)', 'hello', '{"title": "Hello", "draft": true, "series": "intro", "aliases": ["/old/hello"]}', 'A greeting', 'published', 1700000000, 1700000500),
+		('b', 'page', 's1', 'about.md', 'About', 'About me', 'about', '', '', 'published', 1700000000, 1700000000),
+		('c', 'post', 's1', 'c.md', 'Draft', 'not yet', 'draft', '', '', 'draft', 1, 1)`)
+	testDB.Exec(`INSERT INTO blog_posts (id, node_id, slug, publish_date) VALUES ('bp1', 'a', 'hello', 1704067200)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'Go Notes')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1')`)
+
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("expected %s: %v", path, err)
+		}
+		return string(data)
+	}
+
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", IncludeAssets: true, Format: "hugo"}, "hugo"); err != nil {
+		t.Fatal(err)
+	}
+	post := read(filepath.Join("hugo", "content", "posts", "hello.md"))
+	for _, want := range []string{
+		"---\ntitle: \"Hello: World\"\ndate: 2024-01-01T00:00:00Z\nlastmod: 2023-11-14T22:21:40Z\nslug: \"hello\"\ndraft: false\n",
+		`description: "A greeting"`, `tags: ["Go Notes"]`, `aliases: ["/old/hello"]`, `series: "intro"`,
+		"---\n\nBody with ![cat](/media/cat.png)\n",
+	} {
+		if !strings.Contains(post, want) {
+			t.Fatalf("hugo post is missing %q:\n%s", want, post)
+		}
+	}
+	if strings.Count(post, "---") != 2 {
+		t.Fatalf("the node's own front matter should be replaced, not kept:\n%s", post)
+	}
+	read(filepath.Join("hugo", "content", "about.md"))
+	if read(filepath.Join("hugo", "static", "media", "cat.png")) != "png" {
+		t.Fatal("media the content links to should be copied")
+	}
+	if _, err := os.Stat(filepath.Join("hugo", "content", "posts", "draft.md")); err == nil {
+		t.Fatal("drafts should not be exported")
+	}
+
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", IncludeAssets: true, Format: "jekyll"}, "jekyll"); err != nil {
+		t.Fatal(err)
+	}
+	post = read(filepath.Join("jekyll", "_posts", "2024-01-01-hello.md"))
+	if !strings.Contains(post, `layout: "post"`) || !strings.Contains(post, `redirect_from: ["/old/hello"]`) || strings.Contains(post, "draft") {
+		t.Fatalf("unexpected jekyll post:\n%s", post)
+	}
+	if page := read(filepath.Join("jekyll", "about.md")); !strings.Contains(page, `permalink: "/about/"`) || !strings.Contains(page, `layout: "page"`) {
+		t.Fatalf("unexpected jekyll page:\n%s", page)
+	}
+	read(filepath.Join("jekyll", "media", "cat.png"))
+
+	// a content tree builds incrementally like a static site
+	opts := ExportOptions{SiteID: "s1", IncludeAssets: true, Format: "hugo"}
+	BuildSite(opts, "tree", false)
+	testDB.Exec(`UPDATE nodes SET content = 'About us', modified_at = 1700000900 WHERE id = 'b'`)
+	report, err := BuildSite(opts, "tree", false)
+	if err != nil || len(report.Written) != 1 || report.Written[0] != "content/about.md" {
+		t.Fatalf("only the edited page should be rewritten: %+v %v", report, err)
+	}
+}
@@ -3,325 +3,805 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"html/template"
 	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 // === Static Site Export ===
+// A site exports as plain files: a page per published node rendered through
+// an html/template theme, plus index.html, the theme's static files, media
+// the pages use, feed.xml, sitemap.xml, api.json and manifest.json. Every
+// page gets an Open Graph image of its title under og/.
+//
+// A theme is a directory. base.html and files named _*.html hold shared
+// templates, index.html renders the home page and every other top level
+// .html file is a layout. A node uses the layout named by "layout" in its
+// metadata, else the one named after its type, else node.html. Everything
+// else in the directory (style.css, print.css, img/...) is copied as is. A
+// custom theme is laid over the built-in one, so it only needs the files it
+// changes. An optional theme.json configures the theme: {"per_page": N}
+// paginates the index and tag pages. Templates can call the functions in
+// theme_funcs.go.
+
+//go:embed themes/default
+var defaultTheme embed.FS
 
 type ExportOptions struct {
 	SiteID        string
 	IncludeAssets bool
-	Theme         string
-	Format        string // "zip", "html", "json", "rss"
+	Theme         string // "default" or a theme directory
+	Format        string // "zip", "html", "json", "rss", or "hugo" and "jekyll" for a content tree
+	// BaseURL is where the site will be served. sitemap.xml and canonical
+	// links need it and are left out without it.
+	BaseURL string
+	// IncludeArchived exports archived nodes too
+	IncludeArchived bool
+}
+
+// themeConfig is a theme's theme.json
+type themeConfig struct {
+	// PerPage paginates the index and tag pages; 0 puts every page on one
+	PerPage int `json:"per_page"`
+}
+
+// ThemePage is a node as theme templates see it
+type ThemePage struct {
+	ID          string
+	Type        string
+	Title       string
+	Slug        string
+	Path        string
+	ParentID    string
+	URL         string
+	Description string
+	Excerpt     string
+	Content     template.HTML
+	Tags        []TagLink
+	Metadata    map[string]interface{}
+	Created     time.Time
+	Modified    time.Time
+	layout      string
+	node        Node
+}
+
+// TagLink is a tag and its page
+type TagLink struct {
+	Name string
+	URL  string
+}
+
+// renderContent fills in Content, which is left until the page is built
+func (p *ThemePage) renderContent() {
+	if p.Content != "" {
+		return
+	}
+	content := markdownToHTML(p.node.Content)
+	if p.Type == "shader" || p.Type == "canvas" || p.Type == NodeTypeTable {
+		content = renderedBody(p.node)
+	}
+	content += nodeBibliography(p.node)
+	content = strings.ReplaceAll(content, `="/media/`, `="media/`)
+	content = responsiveImages(content, "media/")
+	content = strings.ReplaceAll(content, `src="/shader-runner.js"`, `src="shader-runner.js"`)
+	content = strings.ReplaceAll(content, `src="/table-sort.js"`, `src="table-sort.js"`)
+	p.Content = template.HTML(content)
+}
+
+// NavItem is an entry of the navigation tree built from node parents
+type NavItem struct {
+	Title    string
+	URL      string
+	Active   bool
+	Children []*NavItem
+}
+
+// ThemeData is what a theme template is executed with. Page is set on node
+// pages and Tag on tag pages, where Pages holds the tagged pages.
+type ThemeData struct {
+	Site        Site
+	Page        *ThemePage
+	Tag         string
+	Pages       []*ThemePage
+	Nav         []*NavItem
+	Description string
+	Canonical   string
+	CSP         string
+	Styles      template.HTML
+	Scripts     template.HTML
+	Generated   string
+	// The site's assets by name, its fonts, and its icon and logo if it has
+	// them. URLs are relative to the export.
+	Assets map[string]SiteAsset
+	Fonts  []SiteAsset
+	Icon   *SiteAsset
+	Logo   *SiteAsset
+	// Icons are the sized PNG icons, and OGImage the page's social image,
+	// absolute when the export has a base URL
+	Icons   []SiteAsset
+	OGImage string
+	// Pager is set on the pages of a paginated index or tag list, where
+	// AllPages still holds every page
+	Pager    *Pager
+	AllPages []*ThemePage
+}
+
+// siteOutput receives the files of an exported site
+type siteOutput interface {
+	WriteFile(name string, data []byte) error
+}
+
+type zipOutput struct{ zw *zip.Writer }
+
+func (z zipOutput) WriteFile(name string, data []byte) error {
+	f, err := z.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// dirOutput writes into a directory, replacing files already there and
+// refusing names that would land outside it
+type dirOutput string
+
+func (d dirOutput) WriteFile(name string, data []byte) error {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("%s is outside the export directory", name)
+	}
+	p := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// siteTheme is a parsed theme
+type siteTheme struct {
+	hash    string
+	config  themeConfig
+	shared  *template.Template
+	layouts map[string]string
+	static  map[string][]byte
+}
+
+// loadTheme reads the built-in theme and lays dir over it
+func loadTheme(dir string) (*siteTheme, error) {
+	files := map[string][]byte{}
+	read := func(fsys fs.FS) error {
+		return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || strings.HasPrefix(path.Base(p), ".") {
+				return err
+			}
+			data, err := fs.ReadFile(fsys, p)
+			files[p] = data
+			return err
+		})
+	}
+	builtin, _ := fs.Sub(defaultTheme, "themes/default")
+	if err := read(builtin); err != nil {
+		return nil, err
+	}
+	if dir != "" && dir != "default" {
+		if err := read(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("theme %s: %v", dir, err)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	th := &siteTheme{shared: template.New("").Funcs(themeFuncs), layouts: map[string]string{}, static: map[string][]byte{}}
+	var all []string
+	for _, name := range names {
+		all = append(all, name, string(files[name]))
+	}
+	th.hash = buildKey(all...)
+	for _, name := range names {
+		switch {
+		case name == "theme.json":
+			if err := json.Unmarshal(files[name], &th.config); err != nil {
+				return nil, fmt.Errorf("theme.json: %v", err)
+			}
+		case strings.Contains(name, "/") || !strings.HasSuffix(name, ".html"):
+			th.static[name] = files[name]
+		case name == "base.html" || strings.HasPrefix(name, "_"):
+			if _, err := th.shared.New(name).Parse(string(files[name])); err != nil {
+				return nil, fmt.Errorf("theme: %v", err)
+			}
+		default:
+			th.layouts[strings.TrimSuffix(name, ".html")] = string(files[name])
+		}
+	}
+	return th, nil
+}
+
+// render executes a layout with the shared templates
+func (th *siteTheme) render(layout string, data ThemeData) ([]byte, error) {
+	t, err := th.shared.Clone()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.New(layout).Parse(th.layouts[layout]); err != nil {
+		return nil, fmt.Errorf("theme: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, layout, data); err != nil {
+		return nil, fmt.Errorf("theme: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// layoutFor picks a node's layout: its metadata's "layout", else one named
+// after its type, else node. index and tag are for the pages of those names.
+func (th *siteTheme) layoutFor(p *ThemePage) (string, error) {
+	if name, _ := p.Metadata["layout"].(string); name != "" {
+		if _, ok := th.layouts[name]; !ok || name == "index" || name == "tag" {
+			return "", fmt.Errorf("node %s: theme has no %s.html layout", p.ID, name)
+		}
+		return name, nil
+	}
+	if _, ok := th.layouts[p.Type]; ok && p.Type != "index" && p.Type != "tag" {
+		return p.Type, nil
+	}
+	return "node", nil
 }
 
-// ExportSiteAsStatic generates a complete static website from a site
+// buildNav arranges pages by parent_id, in path order. Pages whose parent is
+// not exported are top level.
+func buildNav(pages []*ThemePage, current string) []*NavItem {
+	sorted := append([]*ThemePage{}, pages...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	items := map[string]*NavItem{}
+	for _, p := range sorted {
+		items[p.ID] = &NavItem{Title: p.Title, URL: p.URL, Active: p.ID == current}
+	}
+	var roots []*NavItem
+	for _, p := range sorted {
+		if parent, ok := items[p.ParentID]; ok && p.ParentID != p.ID {
+			parent.Children = append(parent.Children, items[p.ID])
+		} else {
+			roots = append(roots, items[p.ID])
+		}
+	}
+	return roots
+}
+
+// mediaRef finds media files a node's content links to
+var mediaRef = regexp.MustCompile(`/media/([A-Za-z0-9._-]+)`)
+
+// pageFileName is a node's page in the export
+func pageFileName(n Node) string {
+	if n.Slug != "" {
+		return n.Slug + ".html"
+	}
+	return n.ID + ".html"
+}
+
+// tagFileName is the page listing a tag's nodes
+func tagFileName(tag string) string {
+	return "tag-" + slugify(tag) + ".html"
+}
+
+// ExportSiteAsStatic exports a site as a zip archive
 func ExportSiteAsStatic(opts ExportOptions) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	zw := zip.NewWriter(buf)
+	if err := exportSite(opts, zipOutput{zw}); err != nil {
+		return nil, err
+	}
+	zw.Close()
+	return buf.Bytes(), nil
+}
+
+// ExportSiteToDir exports a site into dir, ready to deploy
+func ExportSiteToDir(opts ExportOptions, dir string) error {
+	return exportSite(opts, dirOutput(dir))
+}
+
+func exportSite(opts ExportOptions, out siteOutput) error {
+	files, err := planSite(opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		data, err := f.render()
+		if err != nil {
+			return err
+		}
+		if err := out.WriteFile(f.Path, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// siteFile is one file of an exported site. Key changes whenever the file's
+// content would, which lets incremental builds skip it otherwise. Deps are
+// the nodes it is built from.
+type siteFile struct {
+	Path   string
+	Key    string
+	Deps   []string
+	render func() ([]byte, error)
+}
 
-	// Get site info
+// buildKey hashes the inputs of a file
+func buildKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		io.WriteString(h, p)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// planSite loads a site and lists the files of its export, unrendered
+func planSite(opts ExportOptions) ([]*siteFile, error) {
+	if isContentTreeFormat(opts.Format) {
+		return planContentTree(opts)
+	}
 	var site Site
+	var description *string
 	err := db.QueryRow(`SELECT id, name, description FROM sites WHERE id = ?`, opts.SiteID).
-		Scan(&site.ID, &site.Name, &site.Description)
+		Scan(&site.ID, &site.Name, &description)
 	if err != nil {
 		return nil, fmt.Errorf("site not found: %v", err)
 	}
+	if description != nil {
+		site.Description = *description
+	}
+	theme, err := loadTheme(opts.Theme)
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(opts.BaseURL, "/")
 
 	// Get all published nodes
+	archived := ` AND archived_at IS NULL`
+	if opts.IncludeArchived {
+		archived = ""
+	}
 	rows, err := db.Query(`
-		SELECT id, type, path, title, content, slug, canonical_uri, body, metadata, status
+		SELECT id, type, COALESCE(parent_id, ''), path, COALESCE(title, ''), COALESCE(content, ''), COALESCE(slug, ''),
+			COALESCE(canonical_uri, ''), COALESCE(body, ''), COALESCE(metadata, ''), COALESCE(mime_type, ''), COALESCE(status, ''), created_at, modified_at
 		FROM nodes 
-		WHERE site_id = ? AND (status = 'published' OR status = 'public')
+		WHERE site_id = ? AND (status = 'published' OR status = 'public') AND deleted_at IS NULL`+archived+`
 		ORDER BY created_at DESC
 	`, opts.SiteID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
 	var nodes []Node
+	var pages []*ThemePage
+	byID := map[string]*ThemePage{}
 	for rows.Next() {
 		var n Node
-		rows.Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.Content, &n.Slug, &n.CanonicalURI, &n.Body, &n.Metadata, &n.Status)
+		var created, modified int64
+		if err := rows.Scan(&n.ID, &n.Type, &n.ParentID, &n.Path, &n.Title, &n.Content, &n.Slug, &n.CanonicalURI, &n.Body, &n.Metadata, &n.MimeType, &n.Status, &created, &modified); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		n.CreatedAt, n.ModifiedAt = time.Unix(created, 0), time.Unix(modified, 0)
 		nodes = append(nodes, n)
+
+		p := &ThemePage{ID: n.ID, Type: n.Type, Title: n.Title, Slug: n.Slug, Path: n.Path, ParentID: n.ParentID,
+			URL: pageFileName(n), Excerpt: truncateString(stripFrontMatter(n.Content), 200), Tags: []TagLink{},
+			Metadata: map[string]interface{}{}, Created: n.CreatedAt, Modified: n.ModifiedAt, node: n}
+		if p.Title == "" {
+			p.Title = strings.TrimSuffix(p.URL, ".html")
+		}
+		json.Unmarshal([]byte(n.Metadata), &p.Metadata)
+		pages = append(pages, p)
+		byID[p.ID] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Generate index.html
-	indexHTML := generateIndexPage(site, nodes)
-	f, _ := zw.Create("index.html")
-	io.WriteString(f, indexHTML)
+	// Tags, each with a page listing its nodes
+	tagged := map[string][]*ThemePage{}
+	rows, err = db.Query(`SELECT nt.node_id, t.name FROM node_tags nt JOIN tags t ON t.id = nt.tag_id ORDER BY t.name`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var nodeID, name string
+		if err := rows.Scan(&nodeID, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if p, ok := byID[nodeID]; ok && slugify(name) != "" {
+			p.Tags = append(p.Tags, TagLink{Name: name, URL: tagFileName(name)})
+			tagged[name] = append(tagged[name], p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	tagNames := make([]string, 0, len(tagged))
+	for name := range tagged {
+		tagNames = append(tagNames, name)
+	}
+	sort.Strings(tagNames)
 
-	// Generate individual pages
-	for _, node := range nodes {
-		pageHTML := generateNodePage(site, node)
-		filename := fmt.Sprintf("%s.html", node.Slug)
-		if node.Slug == "" {
-			filename = fmt.Sprintf("%s.html", node.ID)
+	// A page's key covers the node and its assets. The structure key covers
+	// what every page shows: the theme, the site and the navigation.
+	csp := pageCSP(site.ID)
+	assets := map[string][]NodeAsset{}
+	nodeKeys := map[string]string{}
+	structure := []string{theme.hash, site.Name, site.Description, csp, base}
+	var allKeys, allIDs []string
+	for _, p := range pages {
+		if p.layout, err = theme.layoutFor(p); err != nil {
+			return nil, err
+		}
+		n := p.node
+		key := []string{n.ID, n.Type, n.ParentID, n.Path, n.Title, n.Content, n.Slug, n.Metadata, n.MimeType, n.Status, fmt.Sprint(n.ModifiedAt.Unix()), p.layout}
+		for _, t := range p.Tags {
+			key = append(key, "tag", t.Name)
+			// tagCloud and relatedNodes show other pages' tags
+			structure = append(structure, "tag", t.Name)
+		}
+		if assets[p.ID], err = nodeAssets(p.ID); err != nil {
+			return nil, err
+		}
+		for _, a := range assets[p.ID] {
+			key = append(key, "asset", a.URL, a.Integrity)
+		}
+		nodeKeys[p.ID] = buildKey(key...)
+		allKeys = append(allKeys, nodeKeys[p.ID])
+		allIDs = append(allIDs, p.ID)
+		structure = append(structure, p.ID, p.Title, p.URL, p.ParentID, p.Path)
+	}
+	structure = append(structure, tagNames...)
+	siteFiles, err := siteAssets(site.ID)
+	if err != nil {
+		return nil, err
+	}
+	themeAssets := map[string]SiteAsset{}
+	var fonts []SiteAsset
+	var icon, logo *SiteAsset
+	for i := range siteFiles {
+		a := &siteFiles[i]
+		a.URL = "site-assets/" + a.Name
+		structure = append(structure, "site-asset", a.Name, a.Kind, a.Family, a.Weight, a.Style, a.Hash)
+		themeAssets[a.Name] = *a
+		switch {
+		case a.Kind == "font":
+			fonts = append(fonts, *a)
+		case a.Kind == "icon" && icon == nil:
+			icon = a
+		case a.Kind == "logo" && logo == nil:
+			logo = a
+		}
+	}
+	icons := siteIcons(siteFiles)
+	ogSite := siteSocialImage(siteFiles)
+	structureKey := buildKey(structure...)
+	allKey := buildKey(allKeys...)
+
+	var files []*siteFile
+	seen := map[string]bool{}
+	add := func(f *siteFile) {
+		if !seen[f.Path] {
+			seen[f.Path] = true
+			files = append(files, f)
+		}
+	}
+	static := func(name string, data []byte, deps ...string) {
+		add(&siteFile{Path: name, Key: buildKey(string(data)), Deps: deps, render: func() ([]byte, error) { return data, nil }})
+	}
+	generated := time.Now().Format("2006-01-02")
+	absolute := func(name string) string {
+		if base == "" {
+			return name
+		}
+		return base + "/" + name
+	}
+	// Social images are the page's title over the theme's background with
+	// the site's mark; the index and tag pages use the site's own og-image
+	// when it has one
+	ogParts := []string{site.Name, string(theme.static["og-background.png"])}
+	for _, a := range siteFiles {
+		if a.Kind == "logo" || a.Kind == "icon" {
+			ogParts = append(ogParts, a.Name, a.Hash)
+		}
+	}
+	ogKey := buildKey(ogParts...)
+	pageOG := func(name, title string, deps ...string) string {
+		file := "og/" + strings.TrimSuffix(name, ".html") + ".png"
+		add(&siteFile{Path: file, Key: buildKey("og", title, ogKey), Deps: deps, render: func() ([]byte, error) {
+			return socialImage(site.ID, site.Name, title, theme.static)
+		}})
+		return absolute(file)
+	}
+	siteOG := func() string {
+		if ogSite != nil {
+			return absolute(ogSite.URL)
+		}
+		return pageOG("index.html", site.Name)
+	}
+	page := func(name, layout string, data ThemeData) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			if data.Page != nil {
+				data.Page.renderContent()
+				data.Page.Description = data.Description
+			}
+			if data.Pages == nil {
+				data.Pages = pages
+			}
+			data.AllPages = pages
+			data.Site, data.CSP, data.Generated = site, csp, generated
+			data.Assets, data.Fonts, data.Icon, data.Logo, data.Icons = themeAssets, fonts, icon, logo, icons
+			if base != "" {
+				data.Canonical = base + "/" + name
+			}
+			return theme.render(layout, data)
+		}
+	}
+
+	chunks, pagers := paginate("index.html", pages, theme.config.PerPage)
+	for i, chunk := range chunks {
+		name := pagedFileName("index.html", i+1)
+		add(&siteFile{Path: name, Key: buildKey(name, structureKey, allKey), Deps: allIDs,
+			render: page(name, "index", ThemeData{Pages: chunk, Pager: pagers[i], Nav: buildNav(pages, ""), Description: site.Description, OGImage: siteOG()})})
+	}
+
+	// Pages, and the files they load
+	for _, p := range pages {
+		p := p
+		for _, a := range assets[p.ID] {
+			name := strings.TrimPrefix(a.URL, "/media/")
+			if data, err := os.ReadFile(filepath.Join("media", name)); err == nil {
+				static("assets/"+name, data, p.ID)
+			}
+		}
+		if opts.IncludeAssets {
+			for _, m := range mediaRef.FindAllStringSubmatch(p.node.Content, -1) {
+				if data, err := os.ReadFile(filepath.Join("media", m[1])); err == nil {
+					static("media/"+m[1], data, p.ID)
+				}
+				for _, name := range variantFiles(m[1]) {
+					if data, err := os.ReadFile(filepath.Join("media", name)); err == nil {
+						static("media/"+name, data, p.ID)
+					}
+				}
+			}
+		}
+		if p.Type == "shader" {
+			if data, err := webUI.ReadFile("web/shader-runner.js"); err == nil {
+				static("shader-runner.js", data)
+			}
+		}
+		if p.Type == NodeTypeTable {
+			if data, err := webUI.ReadFile("web/table-sort.js"); err == nil {
+				static("table-sort.js", data)
+			}
+		}
+
+		styles, scripts := assetTags(assets[p.ID], func(a NodeAsset) string {
+			return "assets/" + strings.TrimPrefix(a.URL, "/media/")
+		})
+		add(&siteFile{Path: p.URL, Key: buildKey(p.URL, structureKey, nodeKeys[p.ID]), Deps: []string{p.ID},
+			render: page(p.URL, p.layout, ThemeData{Page: p, Nav: buildNav(pages, p.ID), Description: metaDescription(p.ID, p.node.Content),
+				Styles: template.HTML(styles), Scripts: template.HTML(scripts), OGImage: pageOG(p.URL, p.Title, p.ID)})})
+	}
+
+	for _, name := range tagNames {
+		var keys, deps []string
+		for _, p := range tagged[name] {
+			keys = append(keys, nodeKeys[p.ID])
+			deps = append(deps, p.ID)
+		}
+		chunks, pagers := paginate(tagFileName(name), tagged[name], theme.config.PerPage)
+		for i, chunk := range chunks {
+			file := pagedFileName(tagFileName(name), i+1)
+			add(&siteFile{Path: file, Key: buildKey(name, file, structureKey, buildKey(keys...)), Deps: deps,
+				render: page(file, "tag", ThemeData{Tag: name, Pages: chunk, Pager: pagers[i], Nav: buildNav(pages, ""),
+					Description: fmt.Sprintf("Pages tagged %s", name), OGImage: siteOG()})})
 		}
-		f, _ := zw.Create(filename)
-		io.WriteString(f, pageHTML)
 	}
 
-	// Add CSS
-	cssFile, _ := zw.Create("style.css")
-	io.WriteString(cssFile, getDefaultCSS())
+	names := make([]string, 0, len(theme.static))
+	for name := range theme.static {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		static(name, theme.static[name])
+	}
+	for _, a := range siteFiles {
+		if data, err := os.ReadFile(siteAssetPath(site.ID, a.Name)); err == nil {
+			static(a.URL, data)
+		}
+	}
+	if len(fonts) > 0 {
+		static("site-assets/fonts.css", []byte(fontFaceCSS(fonts)))
+	}
 
-	// Add RSS feed
-	rssFile, _ := zw.Create("feed.xml")
-	io.WriteString(rssFile, generateRSSFeed(site, nodes))
+	siteKey := buildKey(site.Name, site.Description)
+	add(&siteFile{Path: "feed.xml", Key: buildKey("feed", siteKey, allKey), Deps: allIDs,
+		render: func() ([]byte, error) { return []byte(generateRSSFeed(site, nodes)), nil }})
+	if base != "" {
+		add(&siteFile{Path: "sitemap.xml", Key: buildKey("sitemap", base, structureKey, allKey), Deps: allIDs,
+			render: func() ([]byte, error) { return renderSitemap(base, pages), nil }})
+	}
 
 	// Add JSON API
-	jsonFile, _ := zw.Create("api.json")
-	jsonData, _ := json.Marshal(map[string]interface{}{
-		"site":  site,
-		"nodes": nodes,
-	})
-	io.WriteString(jsonFile, string(jsonData))
+	add(&siteFile{Path: "api.json", Key: buildKey("api", siteKey, allKey), Deps: allIDs, render: func() ([]byte, error) {
+		return json.Marshal(map[string]interface{}{
+			"site":  site,
+			"nodes": nodes,
+		})
+	}})
 
 	// Add manifest
-	manifestFile, _ := zw.Create("manifest.json")
-	manifest := map[string]interface{}{
-		"name":             site.Name,
-		"short_name":       site.Name,
-		"description":      site.Description,
-		"start_url":        "/",
-		"display":          "standalone",
-		"background_color": "#ffffff",
-		"theme_color":      "#4f46e5",
-	}
-	manifestData, _ := json.Marshal(manifest)
-	io.WriteString(manifestFile, string(manifestData))
-
-	zw.Close()
-	return buf.Bytes(), nil
+	manifestIcons := []map[string]string{}
+	iconKey := []string{}
+	for _, a := range icons {
+		manifestIcons = append(manifestIcons, map[string]string{"src": a.URL, "sizes": a.Sizes, "type": a.MimeType})
+		iconKey = append(iconKey, a.Name, a.Hash)
+	}
+	add(&siteFile{Path: "manifest.json", Key: buildKey("manifest", siteKey, buildKey(iconKey...)), render: func() ([]byte, error) {
+		return json.Marshal(map[string]interface{}{
+			"name":             site.Name,
+			"short_name":       site.Name,
+			"description":      site.Description,
+			"start_url":        "index.html",
+			"display":          "standalone",
+			"background_color": "#ffffff",
+			"theme_color":      siteThemeColor,
+			"icons":            manifestIcons,
+		})
+	}})
+	return files, nil
 }
 
-func generateIndexPage(site Site, nodes []Node) string {
-	var nodesList strings.Builder
-	for _, node := range nodes {
-		slug := node.Slug
-		if slug == "" {
-			slug = node.ID
-		}
-		excerpt := truncateString(node.Content, 200)
-		nodesList.WriteString(fmt.Sprintf(`
-			<article class="card">
-				<h2><a href="%s.html">%s</a></h2>
-				<p>%s</p>
-				<div class="meta">Type: %s</div>
-			</article>
-		`, slug, node.Title, excerpt, node.Type))
-	}
-
-	return fmt.Sprintf(`<!DOCTYPE html>
-<html lang="en">
-<head>
-	<meta charset="UTF-8">
-	<meta name="viewport" content="width=device-width, initial-scale=1.0">
-	<title>%s</title>
-	<meta name="description" content="%s">
-	<link rel="stylesheet" href="style.css">
-	<link rel="alternate" type="application/rss+xml" title="%s Feed" href="feed.xml">
-	<link rel="manifest" href="manifest.json">
-</head>
-<body>
-	<header>
-		<h1>%s</h1>
-		<p class="tagline">%s</p>
-		<nav>
-			<a href="/">Home</a>
-			<a href="feed.xml">RSS</a>
-			<a href="api.json">API</a>
-		</nav>
-	</header>
-	<main>
-		<div class="content-grid">
-			%s
-		</div>
-	</main>
-	<footer>
-		<p>Generated by Veil • %s</p>
-	</footer>
-</body>
-</html>`, site.Name, site.Description, site.Name, site.Name, site.Description, nodesList.String(), time.Now().Format("2006-01-02"))
-}
+// exportStaticSite is `veil export --site ID [--out DIR|FILE.zip] [--theme DIR]
+// [--base-url URL] [--format hugo|jekyll] [--incremental] [--include-archived]`
+func exportStaticSite(args []string) {
+	opts := ExportOptions{IncludeAssets: true, Theme: "default", Format: "html"}
+	outPath := "dist"
+	incremental := false
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--incremental" {
+			incremental = true
+			continue
+		}
+		if args[i] == "--include-archived" {
+			opts.IncludeArchived = true
+			continue
+		}
+		if i+1 >= len(args) {
+			break
+		}
+		switch args[i] {
+		case "--site":
+			opts.SiteID = args[i+1]
+		case "--out":
+			outPath = args[i+1]
+		case "--theme":
+			opts.Theme = args[i+1]
+		case "--base-url":
+			opts.BaseURL = args[i+1]
+		case "--format":
+			opts.Format = args[i+1]
+		}
+		i++
+	}
+	if opts.SiteID == "" || opts.Format != "html" && !isContentTreeFormat(opts.Format) {
+		fmt.Println("Usage: veil export --site <site-id> [--out ./dist|site.zip] [--theme <dir>] [--base-url https://example.com] [--format hugo|jekyll] [--incremental] [--include-archived]")
+		return
+	}
+	if err := openVault("."); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open vault: %v\n", err)
+		return
+	}
+	defer db.Close()
 
-func generateNodePage(site Site, node Node) string {
-	content := markdownToHTML(node.Content)
-
-	return fmt.Sprintf(`<!DOCTYPE html>
-<html lang="en">
-<head>
-	<meta charset="UTF-8">
-	<meta name="viewport" content="width=device-width, initial-scale=1.0">
-	<title>%s - %s</title>
-	<meta name="description" content="%s">
-	<link rel="stylesheet" href="style.css">
-	<link rel="canonical" href="%s">
-</head>
-<body>
-	<header>
-		<h1><a href="/">%s</a></h1>
-		<nav>
-			<a href="/">Home</a>
-			<a href="feed.xml">RSS</a>
-		</nav>
-	</header>
-	<main>
-		<article class="post">
-			<h1>%s</h1>
-			<div class="meta">Type: %s | URI: %s</div>
-			<div class="content">
-				%s
-			</div>
-		</article>
-	</main>
-	<footer>
-		<p><a href="/">← Back to %s</a></p>
-		<p>Generated by Veil • %s</p>
-	</footer>
-</body>
-</html>`, node.Title, site.Name, truncateString(node.Content, 200), node.CanonicalURI,
-		site.Name, node.Title, node.Type, node.CanonicalURI, content, site.Name, time.Now().Format("2006-01-02"))
+	switch {
+	case strings.HasSuffix(outPath, ".zip"):
+		if !isContentTreeFormat(opts.Format) {
+			opts.Format = "zip"
+		}
+		data, err := ExportSiteAsStatic(opts)
+		if err == nil {
+			data, err = signZip(data)
+		}
+		if err == nil {
+			err = os.WriteFile(outPath, data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+			return
+		}
+	case incremental:
+		report, err := BuildSite(opts, outPath, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+			return
+		}
+		fmt.Printf("%d written, %d removed, %d unchanged\n", len(report.Written), len(report.Removed), report.Unchanged)
+	default:
+		if err := ExportSiteToDir(opts, outPath); err != nil {
+			fmt.Fprintf(os.Stderr, "export error: %v\n", err)
+			return
+		}
+	}
+	fmt.Printf("Exported site %s -> %s\n", opts.SiteID, outPath)
+	if opts.BaseURL == "" && !isContentTreeFormat(opts.Format) {
+		fmt.Println("No --base-url given, so sitemap.xml and canonical links were left out")
+	}
 }
 
-func getDefaultCSS() string {
-	return `
-* { margin: 0; padding: 0; box-sizing: border-box; }
-body {
-	font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-	line-height: 1.6;
-	color: #1e293b;
-	background: #f8fafc;
-}
-header {
-	background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
-	color: white;
-	padding: 3rem 2rem;
-	text-align: center;
-}
-header h1 { font-size: 2.5rem; margin-bottom: 0.5rem; }
-header h1 a { color: white; text-decoration: none; }
-.tagline { opacity: 0.9; font-size: 1.1rem; }
-nav { margin-top: 1.5rem; }
-nav a {
-	color: white;
-	text-decoration: none;
-	margin: 0 1rem;
-	padding: 0.5rem 1rem;
-	border: 1px solid rgba(255,255,255,0.3);
-	border-radius: 4px;
-	transition: all 0.3s;
-}
-nav a:hover { background: rgba(255,255,255,0.2); }
-main {
-	max-width: 1200px;
-	margin: 2rem auto;
-	padding: 0 2rem;
-}
-.content-grid {
-	display: grid;
-	grid-template-columns: repeat(auto-fill, minmax(350px, 1fr));
-	gap: 2rem;
-	margin: 2rem 0;
-}
-.card {
-	background: white;
-	padding: 2rem;
-	border-radius: 8px;
-	box-shadow: 0 1px 3px rgba(0,0,0,0.1);
-	transition: all 0.3s;
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
 }
-.card:hover {
-	box-shadow: 0 4px 12px rgba(0,0,0,0.15);
-	transform: translateY(-2px);
-}
-.card h2 { margin-bottom: 0.5rem; font-size: 1.5rem; }
-.card h2 a { color: #4f46e5; text-decoration: none; }
-.card h2 a:hover { text-decoration: underline; }
-.card p { color: #64748b; margin-bottom: 1rem; }
-.meta {
-	font-size: 0.875rem;
-	color: #94a3b8;
-	margin-top: 1rem;
-}
-.post {
-	background: white;
-	padding: 3rem;
-	border-radius: 8px;
-	box-shadow: 0 1px 3px rgba(0,0,0,0.1);
-	max-width: 800px;
-	margin: 0 auto;
-}
-.post h1 { font-size: 2.5rem; margin-bottom: 1rem; color: #0f172a; }
-.content { margin-top: 2rem; }
-.content h1, .content h2, .content h3 { margin: 2rem 0 1rem; }
-.content p { margin-bottom: 1rem; }
-.content a { color: #4f46e5; }
-.content code {
-	background: #f1f5f9;
-	padding: 0.2rem 0.4rem;
-	border-radius: 3px;
-	font-family: 'Courier New', monospace;
-}
-.content pre {
-	background: #1e293b;
-	color: #e2e8f0;
-	padding: 1rem;
-	border-radius: 6px;
-	overflow-x: auto;
-	margin: 1rem 0;
-}
-.content img { max-width: 100%; height: auto; border-radius: 6px; margin: 1rem 0; }
-footer {
-	text-align: center;
-	padding: 3rem 2rem;
-	color: #64748b;
-	border-top: 1px solid #e2e8f0;
-	margin-top: 4rem;
-}
-footer a { color: #4f46e5; text-decoration: none; }
-footer a:hover { text-decoration: underline; }
-@media (max-width: 768px) {
-	.content-grid { grid-template-columns: 1fr; }
-	header h1 { font-size: 2rem; }
-	.post { padding: 2rem 1rem; }
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
 }
-`
+
+// renderSitemap lists the index and every page under base
+func renderSitemap(base string, pages []*ThemePage) []byte {
+	set := sitemapURLSet{URLs: []sitemapURL{{Loc: base + "/"}}}
+	for _, p := range pages {
+		set.URLs = append(set.URLs, sitemapURL{Loc: base + "/" + p.URL, LastMod: p.Modified.UTC().Format("2006-01-02")})
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	enc.Encode(set)
+	return buf.Bytes()
 }
 
 func generateRSSFeed(site Site, nodes []Node) string {
-	var items strings.Builder
+	var items []FeedItem
+	now := time.Now()
 	for _, node := range nodes {
 		if node.Type == "post" || node.Type == "page" {
-			items.WriteString(fmt.Sprintf(`
-		<item>
-			<title>%s</title>
-			<link>%s</link>
-			<description>%s</description>
-			<guid>%s</guid>
-			<pubDate>%s</pubDate>
-		</item>
-			`, node.Title, node.Slug+".html", truncateString(node.Content, 300),
-				node.CanonicalURI, time.Now().Format(time.RFC1123Z)))
-		}
-	}
-
-	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" ?>
-<rss version="2.0">
-	<channel>
-		<title>%s</title>
-		<description>%s</description>
-		<link>./</link>
-		<lastBuildDate>%s</lastBuildDate>
-		%s
-	</channel>
-</rss>`, site.Name, site.Description, time.Now().Format(time.RFC1123Z), items.String())
+			name := node.Slug
+			if name == "" {
+				name = node.ID
+			}
+			guid := node.CanonicalURI
+			if guid == "" {
+				guid = fmt.Sprintf("veil://%s/%s/%s", site.ID, node.Type, name)
+			}
+			items = append(items, FeedItem{
+				ID:        node.ID,
+				Title:     node.Title,
+				Link:      name + ".html",
+				GUID:      guid,
+				Excerpt:   excerpt(node.Content, feedExcerptLen),
+				Published: now,
+				Updated:   now,
+			})
+		}
+	}
+	return string(renderRSS(site, "./", "", items))
 }
 
 func truncateString(s string, maxLen int) string {
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportSiteToDir(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "site-export-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	os.MkdirAll("media", 0755)
+	ioutil.WriteFile(filepath.Join("media", "media_1_cat.png"), []byte("PNG"), 0644)
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Docs', 'All the docs', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, parent_id, site_id, path, title, content, slug, metadata, mime_type, status, created_at, modified_at) VALUES
+		('guide', 'page', NULL, 's1', 'guide.md', 'Guide', 'Start here', 'guide', NULL, 'text/markdown', 'published', 1, 86400),
+		('install', 'page', 'guide', 's1', 'guide/install.md', 'Install', 'See [the cat](/media/media_1_cat.png)', 'install', NULL, 'text/markdown', 'published', 2, 2),
+		('wide', 'page', NULL, 's1', 'wide.md', 'Wide', 'Lots of room', 'wide', '{"layout": "wide"}', 'text/markdown', 'published', 3, 3),
+		('hello', 'post', NULL, 's1', 'hello.md', 'Hello', 'A post', 'hello', NULL, 'text/markdown', 'published', 4, 4),
+		('draft', 'page', NULL, 's1', 'draft.md', 'Draft', 'Not yet', 'draft', NULL, 'text/markdown', 'draft', 5, 5)`)
+
+	// A theme that only adds a wide layout, a post layout and an image
+	theme := filepath.Join(tmp, "theme")
+	os.MkdirAll(filepath.Join(theme, "img"), 0755)
+	ioutil.WriteFile(filepath.Join(theme, "wide.html"), []byte(`{{template "base" .}}{{define "main"}}<div class="wide">{{.Page.Content}}</div>{{end}}`), 0644)
+	ioutil.WriteFile(filepath.Join(theme, "post.html"), []byte(`{{template "base" .}}{{define "main"}}<article class="blog">{{.Page.Title}}</article>{{end}}`), 0644)
+	ioutil.WriteFile(filepath.Join(theme, "img", "logo.svg"), []byte("<svg/>"), 0644)
+
+	out := filepath.Join(tmp, "dist")
+	opts := ExportOptions{SiteID: "s1", IncludeAssets: true, Theme: theme, BaseURL: "https://docs.example.com/"}
+	if err := ExportSiteToDir(opts, out); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("%s missing from export: %v", name, err)
+		}
+		return string(data)
+	}
+
+	install := read("install.html")
+	if !strings.Contains(install, `<a href="media/media_1_cat.png">the cat</a>`) || read("media/media_1_cat.png") != "PNG" {
+		t.Fatalf("media should be copied and linked relatively: %s", install)
+	}
+	// navigation follows parent_id, with the current page marked
+	nav := install[strings.Index(install, `<aside class="site-nav">`):]
+	if !strings.Contains(nav, `<a href="guide.html">Guide</a><ul>`) || !strings.Contains(nav, `<li class="active"><a href="install.html">Install</a>`) {
+		t.Fatalf("unexpected navigation: %s", nav)
+	}
+	if !strings.Contains(install, `<link rel="canonical" href="https://docs.example.com/install.html">`) ||
+		!strings.Contains(install, `http-equiv="Content-Security-Policy" content="default-src &#39;self&#39;`) {
+		t.Fatalf("missing canonical link or CSP: %s", install)
+	}
+
+	if !strings.Contains(read("wide.html"), `<div class="wide">`) || !strings.Contains(read("hello.html"), `<article class="blog">Hello</article>`) {
+		t.Fatalf("pages should use the layout from their metadata or type")
+	}
+	if !strings.Contains(read("guide.html"), `<article class="post">`) {
+		t.Fatalf("pages without a layout should fall back to node.html")
+	}
+	if read("img/logo.svg") != "<svg/>" || !strings.Contains(read("style.css"), ".site-nav") {
+		t.Fatalf("theme and built-in static files should both be copied")
+	}
+	if _, err := os.Stat(filepath.Join(out, "draft.html")); err == nil {
+		t.Fatalf("unpublished nodes should not be exported")
+	}
+
+	sitemap := read("sitemap.xml")
+	if !strings.Contains(sitemap, "<loc>https://docs.example.com/</loc>") ||
+		!strings.Contains(sitemap, "<loc>https://docs.example.com/guide.html</loc>\n    <lastmod>1970-01-02</lastmod>") {
+		t.Fatalf("unexpected sitemap: %s", sitemap)
+	}
+	if !strings.Contains(read("index.html"), `<h2><a href="hello.html">Hello</a></h2>`) {
+		t.Fatalf("index should list the pages")
+	}
+
+	testDB.Exec(`UPDATE nodes SET metadata = '{"layout": "missing"}' WHERE id = 'guide'`)
+	if err := ExportSiteToDir(opts, out); err == nil || !strings.Contains(err.Error(), "missing.html") {
+		t.Fatalf("an unknown layout should fail the export, got %v", err)
+	}
+}
+
+func TestDirOutputStaysInside(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "dist")
+	for _, name := range []string{"../x.html", "a/../../x.html", "/tmp/x.html"} {
+		if err := dirOutput(out).WriteFile(name, []byte("x")); err == nil {
+			t.Fatalf("%s should be refused", name)
+		}
+	}
+	if err := dirOutput(out).WriteFile("a/b.html", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+}
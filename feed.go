@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Feeds ===
+
+// feedExcerptLen bounds generated excerpts when a post has none of its own
+const feedExcerptLen = 300
+
+// FeedItem is one published entry in a site feed
+type FeedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	GUID      string // canonical veil:// URI
+	Excerpt   string
+	Published time.Time
+	Updated   time.Time
+}
+
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr,omitempty"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Generator     string    `xml:"generator"`
+	Self          *atomLink `xml:"atom:link,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title     string   `xml:"title"`
+	ID        string   `xml:"id"`
+	Link      atomLink `xml:"link"`
+	Published string   `xml:"published"`
+	Updated   string   `xml:"updated"`
+	Summary   string   `xml:"summary"`
+}
+
+// renderRSS encodes items as an RSS 2.0 document. self is the feed's own URL.
+func renderRSS(site Site, link, self string, items []FeedItem) []byte {
+	doc := rssDoc{Version: "2.0", Channel: rssChannel{
+		Title:       site.Name,
+		Link:        link,
+		Description: site.Description,
+		Generator:   "Veil",
+	}}
+	if self != "" {
+		doc.Atom = "http://www.w3.org/2005/Atom"
+		doc.Channel.Self = &atomLink{Href: self, Rel: "self", Type: "application/rss+xml"}
+	}
+	for i, it := range items {
+		if i == 0 {
+			doc.Channel.LastBuildDate = it.Updated.UTC().Format(time.RFC1123Z)
+		}
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       it.Title,
+			Link:        it.Link,
+			Description: it.Excerpt,
+			GUID:        rssGUID{Value: it.GUID},
+			PubDate:     it.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+	return buf.Bytes()
+}
+
+// renderAtom encodes items as an Atom 1.0 document
+func renderAtom(site Site, link, self string, items []FeedItem, updated time.Time) []byte {
+	feed := atomFeed{
+		Title:   site.Name,
+		ID:      fmt.Sprintf("veil://%s", site.ID),
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: link}},
+	}
+	if self != "" {
+		feed.Links = append(feed.Links, atomLink{Href: self, Rel: "self", Type: "application/atom+xml"})
+	}
+	for _, it := range items {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     it.Title,
+			ID:        it.GUID,
+			Link:      atomLink{Href: it.Link},
+			Published: it.Published.UTC().Format(time.RFC3339),
+			Updated:   it.Updated.UTC().Format(time.RFC3339),
+			Summary:   it.Excerpt,
+		})
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	enc.Encode(feed)
+	return buf.Bytes()
+}
+
+// loadFeedItems returns a site's published, non-private nodes, newest first.
+// A node counts as published when its status is "published" or any of its
+// versions was published; the date comes from its blog post, then its latest
+// published version, then its modification time.
+func loadFeedItems(siteID, baseURL string, limit int) ([]FeedItem, error) {
+	rows, err := db.Query(`
+		SELECT n.id, n.type, COALESCE(n.title, ''), COALESCE(n.content, ''), COALESCE(n.slug, ''), COALESCE(n.canonical_uri, ''),
+		       n.modified_at, COALESCE(MAX(b.excerpt), ''), MAX(b.publish_date), MAX(v.published_at)
+		FROM nodes n
+		LEFT JOIN blog_posts b ON b.node_id = n.id
+		LEFT JOIN versions v ON v.node_id = n.id AND v.status = 'published'
+		WHERE n.site_id = ? AND n.deleted_at IS NULL AND COALESCE(n.visibility, 'public') != 'private'
+		GROUP BY n.id
+		HAVING COALESCE(n.status, '') = 'published' OR MAX(v.published_at) IS NOT NULL
+		ORDER BY COALESCE(MAX(b.publish_date), MAX(v.published_at), n.modified_at) DESC
+		LIMIT ?`, siteID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []FeedItem
+	for rows.Next() {
+		var id, typ, title, content, slug, canonical, postExcerpt string
+		var modified int64
+		var postDate, versionDate sql.NullInt64
+		if err := rows.Scan(&id, &typ, &title, &content, &slug, &canonical, &modified, &postExcerpt, &postDate, &versionDate); err != nil {
+			return nil, err
+		}
+		if slug == "" {
+			slug = id
+		}
+		if canonical == "" {
+			canonical = fmt.Sprintf("veil://%s/%s/%s", siteID, typ, slug)
+		}
+		published := time.Unix(modified, 0)
+		if postDate.Valid {
+			published = time.Unix(postDate.Int64, 0)
+		} else if versionDate.Valid {
+			published = time.Unix(versionDate.Int64, 0)
+		}
+		updated := time.Unix(modified, 0)
+		if updated.Before(published) {
+			updated = published
+		}
+		if postExcerpt == "" {
+			postExcerpt = excerpt(content, feedExcerptLen)
+		}
+		items = append(items, FeedItem{
+			ID:        id,
+			Title:     title,
+			Link:      fmt.Sprintf("%s/preview/%s/%s", baseURL, siteID, id),
+			GUID:      canonical,
+			Excerpt:   postExcerpt,
+			Published: published,
+			Updated:   updated,
+		})
+	}
+	return items, rows.Err()
+}
+
+// requestBaseURL is the scheme and host the request was made to
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// GET /api/rss-feed?site_id=&format=rss|atom&limit=
+func handleRSSFeed(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	siteID := q.Get("site_id")
+	if siteID == "" {
+		apierror.Write(w, http.StatusBadRequest, "site_id required")
+		return
+	}
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		fmt.Sscanf(l, "%d", &limit)
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	var site Site
+	var desc sql.NullString
+	if err := db.QueryRow(`SELECT id, name, description FROM sites WHERE id = ?`, siteID).Scan(&site.ID, &site.Name, &desc); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	site.Description = desc.String
+
+	base := requestBaseURL(r)
+	items, err := loadFeedItems(siteID, base, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var lastMod time.Time
+	for _, it := range items {
+		if it.Updated.After(lastMod) {
+			lastMod = it.Updated
+		}
+	}
+	if lastMod.IsZero() {
+		lastMod = time.Unix(0, 0)
+	}
+
+	self := base + r.URL.RequestURI()
+	link := fmt.Sprintf("%s/preview/%s/", base, siteID)
+	var body []byte
+	if q.Get("format") == "atom" {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		body = renderAtom(site, link, self, items, lastMod)
+	} else {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		body = renderRSS(site, link, self, items)
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if match == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastMod.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRSSAndAtomFeeds(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog & Notes', 'desc', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, status, created_at, modified_at) VALUES
+		('n1', 'post', 's1', 'a.md', 'First <post>', '# Hello', 'first', 'published', 100, 100),
+		('n2', 'post', 's1', 'b.md', 'Second', 'text', 'second', 'draft', 200, 200),
+		('n3', 'post', 's1', 'c.md', 'Draft', 'text', 'draft', 'draft', 300, 300)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, status, visibility, created_at, modified_at) VALUES
+		('n4', 'post', 's1', 'd.md', 'Hidden', 'text', 'published', 'private', 400, 400)`)
+	testDB.Exec(`INSERT INTO versions (id, node_id, version_number, status, published_at, created_at, modified_at, is_current) VALUES ('v2', 'n2', 1, 'published', 250, 200, 200, 1)`)
+	testDB.Exec(`INSERT INTO blog_posts (id, node_id, slug, excerpt, publish_date) VALUES ('b2', 'n2', 'second', 'Hand-written excerpt', 260)`)
+
+	mux := setupRoutes()
+	req := httptest.NewRequest("GET", "/api/rss-feed?site_id=s1", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var rss struct {
+		Channel struct {
+			Title string `xml:"title"`
+			Items []struct {
+				Title       string `xml:"title"`
+				GUID        string `xml:"guid"`
+				Description string `xml:"description"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &rss); err != nil {
+		t.Fatalf("invalid RSS: %v\n%s", err, rr.Body.String())
+	}
+	items := rss.Channel.Items
+	if rss.Channel.Title != "Blog & Notes" || len(items) != 2 {
+		t.Fatalf("unexpected feed: %+v", rss)
+	}
+	if items[0].Title != "Second" || items[0].Description != "Hand-written excerpt" || items[0].GUID != "veil://s1/post/second" {
+		t.Fatalf("unexpected first item: %+v", items[0])
+	}
+	if items[1].Title != "First <post>" || items[1].Description != "Hello" {
+		t.Fatalf("unexpected second item: %+v", items[1])
+	}
+
+	etag := rr.Header().Get("ETag")
+	if etag == "" || rr.Header().Get("Last-Modified") == "" || !strings.Contains(rr.Header().Get("Cache-Control"), "max-age") {
+		t.Fatalf("missing caching headers: %v", rr.Header())
+	}
+	req = httptest.NewRequest("GET", "/api/rss-feed?site_id=s1", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/rss-feed?site_id=s1&format=atom", nil)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	var atom struct {
+		Entries []struct {
+			ID string `xml:"id"`
+		} `xml:"entry"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &atom); err != nil || len(atom.Entries) != 2 {
+		t.Fatalf("unexpected atom feed: %v %s", err, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "application/atom+xml") {
+		t.Fatalf("unexpected atom content type %q", rr.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"veil/pkg/validate"
+)
+
+// === Front Matter ===
+// Node content may open with front matter, YAML between --- lines or TOML
+// between +++ lines, as Obsidian, Jekyll and Hugo notes do. When a node is
+// created or updated it is parsed into the node's metadata: keys the old
+// front matter set and the new one doesn't are dropped, the rest of the
+// metadata is kept. Its tags are added to the node, and date, tags, aliases
+// and draft are exposed typed as the node's front_matter. The content keeps
+// the block, so editing round-trips, but rendered HTML, excerpts and
+// descriptions leave it out.
+
+// FrontMatter is the typed view of the fields Veil understands
+type FrontMatter struct {
+	Date    *time.Time `json:"date,omitempty"`
+	Tags    []string   `json:"tags,omitempty"`
+	Aliases []string   `json:"aliases,omitempty"`
+	Draft   *bool      `json:"draft,omitempty"`
+}
+
+// cutFrontMatter splits a leading front matter block from content
+func cutFrontMatter(content string) (format, block, body string, ok bool) {
+	doc := strings.TrimPrefix(content, "\ufeff")
+	var fence string
+	switch {
+	case strings.HasPrefix(doc, "---\n") || strings.HasPrefix(doc, "---\r\n"):
+		format, fence = "yaml", "---"
+	case strings.HasPrefix(doc, "+++\n") || strings.HasPrefix(doc, "+++\r\n"):
+		format, fence = "toml", "+++"
+	default:
+		return "", "", content, false
+	}
+	lines := strings.Split(doc, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == fence || (format == "yaml" && line == "...") {
+			return format, strings.Join(lines[1:i], "\n"), strings.TrimLeft(strings.Join(lines[i+1:], "\n"), "\r\n"), true
+		}
+	}
+	return "", "", content, false // never closed, so not front matter
+}
+
+// parseFrontMatter returns the values of content's front matter, nil when it
+// has none, and the content after it. Front matter that is not valid YAML or
+// TOML is an error.
+func parseFrontMatter(content string) (map[string]interface{}, string, error) {
+	format, block, body, ok := cutFrontMatter(content)
+	if !ok {
+		return nil, content, nil
+	}
+	values, err := decodeDocument(format, block)
+	if err != nil {
+		return nil, body, fmt.Errorf("%s front matter: %v", format, err)
+	}
+	return values, body, nil
+}
+
+// stripFrontMatter is content without its front matter, which is left out
+// even when it doesn't parse
+func stripFrontMatter(content string) string {
+	_, _, body, _ := cutFrontMatter(content)
+	return body
+}
+
+// decodeDocument parses a YAML or TOML document, front matter or a
+// configuration file, into values that marshal to JSON
+func decodeDocument(format, doc string) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	var err error
+	if format == "toml" {
+		_, err = toml.Decode(doc, &out)
+	} else {
+		err = yaml.Unmarshal([]byte(doc), &out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range out {
+		out[k] = frontMatterValue(v)
+	}
+	return out, nil
+}
+
+// frontMatterValue is a decoded value as JSON holds it: integers as int64,
+// maps keyed by strings, dates as text and numbers JSON can't hold as text
+func frontMatterValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return int64(v)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return strconv.FormatFloat(v, 'g', -1, 64)
+		}
+	case time.Time:
+		// TOML's local dates and times carry no zone, so keep them as written
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format("2006-01-02")
+		case "datetime-local":
+			return v.Format("2006-01-02 15:04:05")
+		case "time-local":
+			return v.Format("15:04:05")
+		}
+		// YAML reads a bare date as midnight UTC
+		if h, m, sec := v.Clock(); v.Location() == time.UTC && h+m+sec+v.Nanosecond() == 0 {
+			return v.Format("2006-01-02")
+		}
+		return v.Format(time.RFC3339)
+	case []interface{}:
+		for i := range v {
+			v[i] = frontMatterValue(v[i])
+		}
+	case []map[string]interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = frontMatterValue(v[i])
+		}
+		return out
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = frontMatterValue(v[k])
+		}
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[fmt.Sprint(k)] = frontMatterValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+// frontMatterString is a value as text, lists joined with ", "
+func frontMatterString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, frontMatterString(item))
+		}
+		return strings.Join(parts, ", ")
+	case map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// frontMatterStrings reads a list, or a comma separated string, of names;
+// tags lose a leading #
+func frontMatterStrings(v interface{}) []string {
+	var items []string
+	switch v := v.(type) {
+	case string:
+		items = frontMatterList(v)
+	case []interface{}:
+		for _, item := range v {
+			items = append(items, frontMatterString(item))
+		}
+	}
+	var out []string
+	for _, s := range items {
+		if s = strings.TrimPrefix(strings.TrimSpace(s), "#"); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// frontMatterFields is the typed view of a node's metadata, nil when it has
+// none of the fields
+func frontMatterFields(metadata string) *FrontMatter {
+	var meta map[string]interface{}
+	if metadata == "" || json.Unmarshal([]byte(metadata), &meta) != nil {
+		return nil
+	}
+	fm := &FrontMatter{Tags: frontMatterStrings(meta["tags"]), Aliases: frontMatterStrings(meta["aliases"])}
+	if fm.Aliases == nil {
+		fm.Aliases = frontMatterStrings(meta["alias"])
+	}
+	if s, ok := meta["date"].(string); ok {
+		if unix, ok := parseImportDate(s); ok {
+			t := time.Unix(unix, 0).UTC()
+			fm.Date = &t
+		}
+	}
+	switch d := meta["draft"].(type) {
+	case bool:
+		fm.Draft = &d
+	case string:
+		if d == "true" || d == "false" {
+			draft := d == "true"
+			fm.Draft = &draft
+		}
+	}
+	if fm.Date == nil && fm.Tags == nil && fm.Aliases == nil && fm.Draft == nil {
+		return nil
+	}
+	return fm
+}
+
+// applyFrontMatter parses node.Content's front matter into node.Metadata.
+// base is the metadata to start from and oldContent the content it was last
+// parsed from, whose front matter keys are dropped first. The front matter's
+// tags join node.Tags and its title fills an empty one.
+func applyFrontMatter(node *Node, base, oldContent string) error {
+	// front matter saved before it had to parse has no keys to drop
+	old, _, _ := parseFrontMatter(oldContent)
+	values, _, err := parseFrontMatter(node.Content)
+	if err != nil {
+		return validate.Errors{{Field: "content", Message: err.Error()}}
+	}
+	if values == nil && old == nil {
+		node.Metadata = base
+		node.FrontMatter = frontMatterFields(base)
+		return nil
+	}
+	meta := map[string]interface{}{}
+	if base != "" {
+		if err := json.Unmarshal([]byte(base), &meta); err != nil {
+			return validate.Errors{{Field: "metadata", Message: "must be a JSON object"}}
+		}
+	}
+	for k := range old {
+		delete(meta, k)
+	}
+	for k, v := range values {
+		meta[k] = v
+	}
+	node.Metadata = ""
+	if len(meta) > 0 {
+		b, _ := json.Marshal(meta)
+		node.Metadata = string(b)
+	}
+
+	if title, ok := values["title"].(string); ok && node.Title == "" {
+		node.Title = title
+	}
+	seen := map[string]bool{}
+	for _, tag := range node.Tags {
+		seen[tag] = true
+	}
+	for _, tag := range frontMatterStrings(values["tags"]) {
+		if !seen[tag] {
+			seen[tag] = true
+			node.Tags = append(node.Tags, tag)
+		}
+	}
+	node.FrontMatter = frontMatterFields(node.Metadata)
+	return nil
+}
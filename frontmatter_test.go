@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	yaml := "---\ntitle: \"Trip: Lisbon\"\ndate: 2024-03-01\ndraft: false\nweight: 3 # order\ntags: [travel, \"#food\"]\naliases:\n  - lisbon\n  - /old/lisbon\nparams:\n  mood: good\n---\n\n# Lisbon\n"
+	values, body, err := parseFrontMatter(yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"title": "Trip: Lisbon", "date": "2024-03-01", "draft": false, "weight": int64(3),
+		"tags": []interface{}{"travel", "#food"}, "aliases": []interface{}{"lisbon", "/old/lisbon"},
+		"params": map[string]interface{}{"mood": "good"},
+	}
+	if !reflect.DeepEqual(values, want) || body != "# Lisbon\n" {
+		t.Fatalf("unexpected YAML front matter: %#v %q", values, body)
+	}
+
+	toml := "+++\ntitle = 'Lisbon'\ndraft = true\ntags = [\n  \"travel\",\n  \"food\",\n]\n[params]\nmood = \"good\"\n+++\nBody"
+	if values, body, err = parseFrontMatter(toml); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{
+		"title": "Lisbon", "draft": true, "tags": []interface{}{"travel", "food"},
+		"params": map[string]interface{}{"mood": "good"},
+	}
+	if !reflect.DeepEqual(values, want) || body != "Body" {
+		t.Fatalf("unexpected TOML front matter: %#v %q", values, body)
+	}
+
+	for _, doc := range []string{"# Title\n---\n", "---\nnever closed\n", "--- \nx: y\n---\n"} {
+		if values, body, err := parseFrontMatter(doc); values != nil || body != doc || err != nil {
+			t.Fatalf("%q has no front matter: %v %q %v", doc, values, body, err)
+		}
+	}
+
+	// block scalars are read whole, not as keys
+	values, _, err = parseFrontMatter("---\nsummary: >\n  Note: text\n  goes on\n---\n")
+	if err != nil || !reflect.DeepEqual(values, map[string]interface{}{"summary": "Note: text goes on"}) {
+		t.Fatalf("unexpected folded summary: %#v %v", values, err)
+	}
+	for _, doc := range []string{"---\ntitle: [unclosed\n---\n", "---\n- a list\n---\n", "+++\ntitle = bare words\n+++\n"} {
+		if _, body, err := parseFrontMatter(doc); err == nil || body != "" {
+			t.Fatalf("%q should be refused: %q %v", doc, body, err)
+		}
+	}
+}
+
+func TestNodeFrontMatter(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "frontmatter-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) (*httptest.ResponseRecorder, Node) {
+		b, _ := json.Marshal(body)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		var node Node
+		json.Unmarshal(rr.Body.Bytes(), &node)
+		return rr, node
+	}
+
+	content := "---\ntitle: Lisbon\ndate: 2024-03-01\ntags: [travel, \"#food\"]\naliases: [lisbon]\ndraft: true\n---\n# Lisbon\n\nPastéis de nata."
+	rr, node := do("POST", "/api/node-create", map[string]interface{}{
+		"type": "note", "path": "lisbon.md", "content": content, "mime_type": "text/markdown", "metadata": `{"rating":5}`,
+	})
+	if rr.Code != 201 {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	fm := node.FrontMatter
+	if node.Title != "Lisbon" || node.Content != content || fm == nil || fm.Date == nil || fm.Date.Format("2006-01-02") != "2024-03-01" ||
+		strings.Join(fm.Tags, ",") != "travel,food" || strings.Join(fm.Aliases, ",") != "lisbon" || fm.Draft == nil || !*fm.Draft {
+		t.Fatalf("unexpected node: %+v %+v", node, fm)
+	}
+	var meta map[string]interface{}
+	json.Unmarshal([]byte(node.Metadata), &meta)
+	if meta["rating"] != float64(5) || meta["title"] != "Lisbon" {
+		t.Fatalf("front matter should be merged into the metadata: %s", node.Metadata)
+	}
+	var tags int
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_tags WHERE node_id = ?`, node.ID).Scan(&tags)
+	if tags != 2 {
+		t.Fatalf("front matter tags should be added to the node, got %d", tags)
+	}
+
+	// keys the new front matter drops are removed, the rest of the metadata stays
+	rr, _ = do("PUT", "/api/node-update", map[string]interface{}{
+		"id": node.ID, "type": "note", "path": "lisbon.md", "title": "Lisbon", "content": "+++\ndraft = false\n+++\n# Lisbon", "mime_type": "text/markdown",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("update: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/node/"+node.ID, nil))
+	node = Node{}
+	json.Unmarshal(rr.Body.Bytes(), &node)
+	if node.Metadata != `{"draft":false,"rating":5}` || node.FrontMatter == nil || node.FrontMatter.Draft == nil || *node.FrontMatter.Draft || node.FrontMatter.Tags != nil {
+		t.Fatalf("unexpected node after update: %s %+v", node.Metadata, node.FrontMatter)
+	}
+
+	if html := markdownToHTML(content); strings.Contains(html, "aliases") || !strings.Contains(html, "<h1>Lisbon</h1>") {
+		t.Fatalf("front matter should not be rendered: %s", html)
+	}
+	if got := excerpt(content, 100); got != "Lisbon" {
+		t.Fatalf("excerpts should skip front matter: %q", got)
+	}
+	if rr, _ := do("POST", "/api/node-create", map[string]interface{}{
+		"type": "note", "path": "bad.md", "content": content, "metadata": "[1]",
+	}); rr.Code != 400 {
+		t.Fatalf("metadata that isn't an object should be rejected: %d", rr.Code)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"veil/pkg/store"
+)
+
+// === Vault Consistency ===
+// veil fsck cross-checks the vault database the way codex keeps its own
+// objects honest: rows pointing at nodes, tags or sites that are gone, media
+// rows whose files are missing, URIs claimed twice, and nodes whose codex
+// object has gone missing. Without --repair it only reports; with it every
+// problem that has a safe fix is fixed in one transaction. Missing codex
+// objects and a failing SQLite integrity check need a person, typically a
+// restore from backup, and are only reported.
+
+// FsckIssue is one problem fsck found
+type FsckIssue struct {
+	Check    string `json:"check"`
+	Table    string `json:"table"`
+	ID       string `json:"id"`
+	Detail   string `json:"detail"`
+	Repair   string `json:"repair,omitempty"` // what --repair does, "" when it can't
+	Repaired bool   `json:"repaired,omitempty"`
+
+	fix []string // statements run with ID
+}
+
+// FsckReport is the outcome of a run
+type FsckReport struct {
+	Issues   []FsckIssue `json:"issues"`
+	Repaired int         `json:"repaired"`
+}
+
+// fsckCheck is a check done in SQL: query selects the id and a description
+// of each bad row, fix repairs one by id
+type fsckCheck struct {
+	name, table, query string
+	repair             string
+	fix                []string
+}
+
+var fsckChecks = []fsckCheck{
+	{"orphan_versions", "versions",
+		`SELECT v.id, 'version ' || v.version_number || ' of missing node ' || v.node_id
+		FROM versions v LEFT JOIN nodes n ON n.id = v.node_id WHERE n.id IS NULL`,
+		"delete the version", []string{`DELETE FROM versions WHERE id = ?`}},
+	{"dangling_node_tags", "node_tags",
+		`SELECT nt.id, CASE WHEN t.id IS NULL THEN 'missing tag ' || nt.tag_id ELSE 'missing node ' || nt.node_id END
+		FROM node_tags nt LEFT JOIN tags t ON t.id = nt.tag_id LEFT JOIN nodes n ON n.id = nt.node_id
+		WHERE t.id IS NULL OR n.id IS NULL`,
+		"delete the tag link", []string{`DELETE FROM node_tags WHERE id = ?`}},
+	{"dangling_references", "node_references",
+		`SELECT r.id, 'link from ' || r.source_node_id || ' to ' || r.target_node_id || ' with a missing end'
+		FROM node_references r LEFT JOIN nodes s ON s.id = r.source_node_id LEFT JOIN nodes t ON t.id = r.target_node_id
+		WHERE s.id IS NULL OR t.id IS NULL`,
+		"delete the link", []string{`DELETE FROM node_references WHERE id = ?`}},
+	{"dangling_visibility", "node_visibility",
+		`SELECT v.id, 'visibility of missing node ' || v.node_id
+		FROM node_visibility v LEFT JOIN nodes n ON n.id = v.node_id WHERE n.id IS NULL`,
+		"delete the row", []string{`DELETE FROM node_visibility WHERE id = ?`}},
+	{"dangling_uris", "node_uris",
+		`SELECT u.id, u.uri || ' of missing node ' || u.node_id
+		FROM node_uris u LEFT JOIN nodes n ON n.id = u.node_id WHERE n.id IS NULL`,
+		"delete the URI", []string{`DELETE FROM node_uris WHERE id = ?`}},
+	{"duplicate_primary_uris", "node_uris",
+		`SELECT u.id, 'second primary URI ' || u.uri || ' of node ' || u.node_id FROM node_uris u
+		WHERE u.is_primary = 1 AND EXISTS (SELECT 1 FROM node_uris o WHERE o.node_id = u.node_id AND o.is_primary = 1
+			AND (o.created_at < u.created_at OR (o.created_at = u.created_at AND o.id < u.id)))`,
+		"keep it as an alias", []string{`UPDATE node_uris SET is_primary = 0 WHERE id = ?`}},
+	{"conflicting_uris", "node_uris",
+		`SELECT u.id, u.uri || ' of node ' || u.node_id || ' is the canonical URI of ' || n.id
+		FROM node_uris u JOIN nodes n ON n.canonical_uri = u.uri AND n.id != u.node_id AND n.deleted_at IS NULL`,
+		"delete the URI", []string{`DELETE FROM node_uris WHERE id = ?`}},
+	{"duplicate_canonical_uris", "nodes",
+		`SELECT n.id, 'canonical URI ' || n.canonical_uri || ' is also claimed by an older node' FROM nodes n
+		WHERE COALESCE(n.canonical_uri, '') != '' AND n.deleted_at IS NULL AND EXISTS (SELECT 1 FROM nodes o
+			WHERE o.canonical_uri = n.canonical_uri AND o.deleted_at IS NULL
+			AND (o.created_at < n.created_at OR (o.created_at = n.created_at AND o.id < n.id)))`,
+		"clear the newer node's canonical URI", []string{`UPDATE nodes SET canonical_uri = NULL WHERE id = ?`}},
+	{"dangling_parents", "nodes",
+		`SELECT n.id, 'parent ' || n.parent_id || ' is missing'
+		FROM nodes n LEFT JOIN nodes p ON p.id = n.parent_id WHERE COALESCE(n.parent_id, '') != '' AND p.id IS NULL`,
+		"move the node to the top level", []string{`UPDATE nodes SET parent_id = NULL WHERE id = ?`}},
+	{"dangling_sites", "nodes",
+		`SELECT n.id, 'site ' || n.site_id || ' is missing'
+		FROM nodes n LEFT JOIN sites s ON s.id = n.site_id WHERE COALESCE(n.site_id, '') != '' AND s.id IS NULL`,
+		"detach the node from the site", []string{`UPDATE nodes SET site_id = NULL WHERE id = ?`}},
+}
+
+// fsckVault checks the open vault, repairing what it can when repair is set
+func fsckVault(repair bool) (*FsckReport, error) {
+	report := &FsckReport{Issues: []FsckIssue{}}
+	integrity, err := store.For(db).IntegrityCheck(db)
+	if err != nil {
+		return nil, err
+	}
+	if integrity != "ok" {
+		report.Issues = append(report.Issues, FsckIssue{Check: "sqlite_integrity", Detail: integrity})
+	}
+
+	for _, c := range fsckChecks {
+		issues, err := fsckQuery(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.name, err)
+		}
+		report.Issues = append(report.Issues, issues...)
+	}
+
+	// media rows whose file is gone
+	rows, err := db.Query(`SELECT id, COALESCE(filename, ''), COALESCE(storage_url, '') FROM media`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, filename, storageURL string
+		if err := rows.Scan(&id, &filename, &storageURL); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if storageURL == "" || strings.Contains(storageURL, "://") {
+			continue // stored elsewhere
+		}
+		if diskPath, _ := mediaFile(storageURL); !fileExists(diskPath) {
+			report.Issues = append(report.Issues, FsckIssue{Check: "missing_media_files", Table: "media", ID: id,
+				Detail: fmt.Sprintf("%s: %s does not exist", filename, diskPath), Repair: "delete the media row and its attachments",
+				fix: []string{`DELETE FROM node_assets WHERE media_id = ?`, `DELETE FROM media_library WHERE media_id = ?`, `DELETE FROM media_variants WHERE media_id = ?`, `DELETE FROM media WHERE id = ?`}})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// nodes whose codex object is gone
+	repo := codexRepo()
+	rows, err = db.Query(`SELECT node_id, COALESCE(head_object, '') FROM node_codex_links WHERE COALESCE(head_object, '') != ''`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var nodeID, object string
+		if err := rows.Scan(&nodeID, &object); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rc, _, err := repo.GetObjectStream(object)
+		if err != nil {
+			report.Issues = append(report.Issues, FsckIssue{Check: "missing_codex_objects", Table: "node_codex_links", ID: nodeID,
+				Detail: "codex object " + object + " is missing"})
+			continue
+		}
+		rc.Close()
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if repair {
+		if err := fsckRepair(report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func fsckQuery(c fsckCheck) ([]FsckIssue, error) {
+	rows, err := db.Query(c.query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FsckIssue
+	for rows.Next() {
+		issue := FsckIssue{Check: c.name, Table: c.table, Repair: c.repair, fix: c.fix}
+		if err := rows.Scan(&issue.ID, &issue.Detail); err != nil {
+			return nil, err
+		}
+		out = append(out, issue)
+	}
+	return out, rows.Err()
+}
+
+// fsckRepair fixes every repairable issue in one transaction
+func fsckRepair(report *FsckReport) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		for _, stmt := range issue.fix {
+			if _, err := tx.Exec(stmt, issue.ID); err != nil {
+				return fmt.Errorf("repairing %s %s: %v", issue.Table, issue.ID, err)
+			}
+		}
+		if len(issue.fix) > 0 {
+			issue.Repaired = true
+			report.Repaired++
+		}
+	}
+	return tx.Commit()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func fsckCommand() {
+	// Usage: veil fsck [--repair] [--json] [--vault NAME|PATH]
+	vault := "."
+	repair, asJSON := false, false
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--repair":
+			repair = true
+		case "--json":
+			asJSON = true
+		case "--vault":
+			if i+1 < len(args) {
+				i++
+				vault = args[i]
+				if v, ok := lookupVault(vault); ok {
+					vault = v.Path
+				}
+			}
+		default:
+			fmt.Println("Usage: veil fsck [--repair] [--json] [--vault NAME|PATH]")
+			return
+		}
+	}
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+
+	report, err := fsckVault(repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+	left := len(report.Issues) - report.Repaired
+	if asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		for _, issue := range report.Issues {
+			action := issue.Repair
+			switch {
+			case issue.Repaired:
+				action = "repaired: " + action
+			case action == "":
+				action = "needs attention"
+			}
+			fmt.Printf("  %-24s %-16s %s  %s (%s)\n", issue.Check, issue.Table, issue.ID, issue.Detail, action)
+		}
+		switch {
+		case len(report.Issues) == 0:
+			fmt.Println("No problems found")
+		case repair:
+			fmt.Printf("%d problem(s), %d repaired, %d left\n", len(report.Issues), report.Repaired, left)
+		default:
+			fixable := 0
+			for _, issue := range report.Issues {
+				if len(issue.fix) > 0 {
+					fixable++
+				}
+			}
+			fmt.Printf("%d problem(s); --repair fixes %d of them\n", len(report.Issues), fixable)
+		}
+	}
+	if left > 0 {
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFsckVault(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "fsck-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	os.MkdirAll("media", 0755)
+	ioutil.WriteFile(filepath.Join("media", "media_1_here.png"), []byte("PNG"), 0644)
+	// a vault from before foreign keys were enforced
+	testDB.Exec(`PRAGMA foreign_keys = OFF`)
+	for _, q := range []string{
+		`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'site', '', 'blog', 1, 1)`,
+		`INSERT INTO nodes (id, type, site_id, parent_id, path, title, content, canonical_uri, created_at, modified_at) VALUES
+			('a', 'note', 's1', '', 'a.md', 'A', '', 'veil://s1/note/a', 1, 1),
+			('b', 'note', 'gone', 'missing', 'b.md', 'B', '', 'veil://s1/note/a', 2, 2)`,
+		`INSERT INTO versions (id, node_id, version_number, created_at, modified_at) VALUES ('v1', 'a', 1, 1, 1), ('v2', 'deleted', 1, 1, 1)`,
+		`INSERT INTO tags (id, name) VALUES ('t1', 'kept')`,
+		`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1'), ('nt2', 'a', 'dropped')`,
+		`INSERT INTO node_uris (id, node_id, uri, is_primary, created_at) VALUES
+			('u1', 'a', 'veil://s1/a-1', 1, 1), ('u2', 'a', 'veil://s1/a-2', 1, 2), ('u3', 'b', 'veil://s1/note/a', 0, 2)`,
+		`INSERT INTO media (id, filename, storage_url, created_at) VALUES ('m1', 'here.png', 'media/media_1_here.png', 1), ('m2', 'gone.png', '/media/media_2_gone.png', 1)`,
+		`INSERT INTO node_assets (id, node_id, media_id, kind, integrity, created_at) VALUES ('na1', 'a', 'm2', 'style', 'sha384-x', 1)`,
+	} {
+		if _, err := testDB.Exec(q); err != nil {
+			t.Fatalf("%v: %s", err, q)
+		}
+	}
+	testDB.Exec(`PRAGMA foreign_keys = ON`)
+
+	report, err := fsckVault(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, issue := range report.Issues {
+		found[issue.Check] = issue.ID
+	}
+	want := map[string]string{
+		"orphan_versions": "v2", "dangling_node_tags": "nt2", "duplicate_primary_uris": "u2", "conflicting_uris": "u3",
+		"duplicate_canonical_uris": "b", "dangling_parents": "b", "dangling_sites": "b", "missing_media_files": "m2",
+	}
+	for check, id := range want {
+		if found[check] != id {
+			t.Fatalf("%s should flag %s: %+v", check, id, report.Issues)
+		}
+	}
+	if len(report.Issues) != len(want) || report.Repaired != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	report, err = fsckVault(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != len(want) {
+		t.Fatalf("every issue should be repaired: %+v", report)
+	}
+	var n int
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_assets`).Scan(&n)
+	if n != 0 {
+		t.Fatal("attachments of missing media should go with it")
+	}
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_uris WHERE node_id = 'a' AND is_primary = 1`).Scan(&n)
+	if n != 1 {
+		t.Fatalf("a node should keep one primary URI, has %d", n)
+	}
+	if report, _ := fsckVault(false); len(report.Issues) != 0 {
+		t.Fatalf("a repaired vault should be clean: %+v", report.Issues)
+	}
+}
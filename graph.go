@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"veil/pkg/apierror"
+)
+
+// === Knowledge Graph ===
+// /api/graph returns nodes and the references between them for graph views.
+// With node_id it returns only the neighbourhood within depth links of that
+// node, following links in either direction. Deleted nodes and nodes the
+// caller cannot read are left out, along with their edges.
+
+const (
+	graphDefaultDepth = 1
+	graphMaxDepth     = 5
+)
+
+// GraphNode is a vertex of the knowledge graph
+type GraphNode struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Path   string `json:"path"`
+	SiteID string `json:"site_id,omitempty"`
+	// Degree counts the edges touching the node in the returned graph
+	Degree int `json:"degree"`
+	// Distance is the number of links from the requested node_id
+	Distance *int `json:"distance,omitempty"`
+}
+
+// GraphEdge is a reference from Source to Target
+type GraphEdge struct {
+	ID       string `json:"id"`
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	LinkType string `json:"link_type"`
+	LinkText string `json:"link_text,omitempty"`
+}
+
+// Graph is the D3 shaped answer: nodes plus edges that name them by id
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// loadGraph reads the nodes of siteID ("" for every site) that canRead
+// allows, and the references between them
+func loadGraph(siteID string, canRead func(siteID, visibility string) bool) (*Graph, error) {
+	query := `SELECT n.id, n.type, COALESCE(n.title, ''), COALESCE(n.path, ''), COALESCE(n.site_id, ''), COALESCE(v.visibility, '')
+		FROM nodes n LEFT JOIN node_visibility v ON v.node_id = n.id WHERE n.deleted_at IS NULL`
+	var args []interface{}
+	if siteID != "" {
+		query += ` AND n.site_id = ?`
+		args = append(args, siteID)
+	}
+	rows, err := db.Query(query+` ORDER BY n.path, n.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	g := &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	index := map[string]int{}
+	for rows.Next() {
+		var n GraphNode
+		var vis string
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Path, &n.SiteID, &vis); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, dup := index[n.ID]; dup || !canRead(n.SiteID, vis) {
+			continue
+		}
+		index[n.ID] = len(g.Nodes)
+		g.Nodes = append(g.Nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`SELECT id, source_node_id, target_node_id, COALESCE(link_type, ''), COALESCE(link_text, '')
+		FROM node_references ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e GraphEdge
+		if err := rows.Scan(&e.ID, &e.Source, &e.Target, &e.LinkType, &e.LinkText); err != nil {
+			return nil, err
+		}
+		s, okS := index[e.Source]
+		t, okT := index[e.Target]
+		if !okS || !okT {
+			continue
+		}
+		g.Edges = append(g.Edges, e)
+		g.Nodes[s].Degree++
+		if t != s {
+			g.Nodes[t].Degree++
+		}
+	}
+	return g, rows.Err()
+}
+
+// neighbourhood keeps the nodes within depth links of start, and the edges
+// among them. ok is false when start is not in the graph.
+func (g *Graph) neighbourhood(start string, depth int) (sub *Graph, ok bool) {
+	adjacent := map[string][]string{}
+	for _, e := range g.Edges {
+		adjacent[e.Source] = append(adjacent[e.Source], e.Target)
+		adjacent[e.Target] = append(adjacent[e.Target], e.Source)
+	}
+	found := false
+	for _, n := range g.Nodes {
+		found = found || n.ID == start
+	}
+	if !found {
+		return nil, false
+	}
+
+	dist := map[string]int{start: 0}
+	frontier := []string{start}
+	for d := 1; d <= depth && len(frontier) > 0; d++ {
+		var next []string
+		for _, id := range frontier {
+			for _, other := range adjacent[id] {
+				if _, seen := dist[other]; !seen {
+					dist[other] = d
+					next = append(next, other)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	sub = &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	degree := map[string]int{}
+	for _, e := range g.Edges {
+		_, okS := dist[e.Source]
+		_, okT := dist[e.Target]
+		if okS && okT {
+			sub.Edges = append(sub.Edges, e)
+			degree[e.Source]++
+			if e.Target != e.Source {
+				degree[e.Target]++
+			}
+		}
+	}
+	for _, n := range g.Nodes {
+		if d, in := dist[n.ID]; in {
+			n.Distance = &d
+			n.Degree = degree[n.ID]
+			sub.Nodes = append(sub.Nodes, n)
+		}
+	}
+	sort.SliceStable(sub.Nodes, func(i, j int) bool { return *sub.Nodes[i].Distance < *sub.Nodes[j].Distance })
+	return sub, true
+}
+
+// cytoscape reshapes the graph as Cytoscape.js elements
+func (g *Graph) cytoscape() map[string]interface{} {
+	nodes := make([]map[string]interface{}, len(g.Nodes))
+	for i, n := range g.Nodes {
+		nodes[i] = map[string]interface{}{"data": n}
+	}
+	edges := make([]map[string]interface{}, len(g.Edges))
+	for i, e := range g.Edges {
+		edges[i] = map[string]interface{}{"data": e}
+	}
+	return map[string]interface{}{"elements": map[string]interface{}{"nodes": nodes, "edges": edges}}
+}
+
+// GET /api/graph?site_id=&node_id=&depth=1&orphans=true&format=d3|cytoscape
+func handleGraph(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "d3" && format != "cytoscape" {
+		apierror.Write(w, http.StatusBadRequest, "format must be d3 or cytoscape")
+		return
+	}
+	depth := graphDefaultDepth
+	if v := q.Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > graphMaxDepth {
+			apierror.Write(w, http.StatusBadRequest, "depth must be between 0 and "+strconv.Itoa(graphMaxDepth))
+			return
+		}
+		depth = n
+	}
+
+	g, err := loadGraph(q.Get("site_id"), nodeReadFilter(r))
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	if nodeID := q.Get("node_id"); nodeID != "" {
+		sub, ok := g.neighbourhood(nodeID, depth)
+		if !ok {
+			apierror.Write(w, http.StatusNotFound, "node not found")
+			return
+		}
+		g = sub
+	} else if q.Get("orphans") == "false" {
+		linked := g.Nodes[:0]
+		for _, n := range g.Nodes {
+			if n.Degree > 0 {
+				linked = append(linked, n)
+			}
+		}
+		g.Nodes = linked
+	}
+
+	if format == "cytoscape" {
+		json.NewEncoder(w).Encode(g.cytoscape())
+		return
+	}
+	json.NewEncoder(w).Encode(g)
+}
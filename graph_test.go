@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGraphAPI(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Notes', 'project', 1, 1), ('s2', 'Other', 'project', 1, 1)`)
+	// a -> b -> c -> d, plus e alone and a deleted node linked from a
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, created_at, modified_at) VALUES
+		('a', 'note', 's1', 'a.md', 'A', '', 'text/markdown', 1, 1),
+		('b', 'note', 's1', 'b.md', 'B', '', 'text/markdown', 1, 1),
+		('c', 'page', 's1', 'c.md', 'C', '', 'text/markdown', 1, 1),
+		('d', 'note', 's1', 'd.md', 'D', '', 'text/markdown', 1, 1),
+		('e', 'note', 's1', 'e.md', 'E', '', 'text/markdown', 1, 1),
+		('gone', 'note', 's1', 'gone.md', 'Gone', '', 'text/markdown', 1, 1),
+		('other', 'note', 's2', 'o.md', 'Other', '', 'text/markdown', 1, 1)`)
+	testDB.Exec(`UPDATE nodes SET deleted_at = 5 WHERE id = 'gone'`)
+	testDB.Exec(`INSERT INTO node_references (id, source_node_id, target_node_id, link_type, link_text, created_at) VALUES
+		('r1', 'a', 'b', 'wiki', 'B', 1), ('r2', 'b', 'c', 'markdown', 'C', 2), ('r3', 'c', 'd', 'uri', 'D', 3),
+		('r4', 'a', 'gone', 'wiki', 'Gone', 4)`)
+
+	mux := setupRoutes()
+	get := func(path string) (int, Graph) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var g Graph
+		json.NewDecoder(rr.Body).Decode(&g)
+		return rr.Code, g
+	}
+
+	_, g := get("/api/graph?site_id=s1")
+	if len(g.Nodes) != 5 || len(g.Edges) != 3 {
+		t.Fatalf("expected 5 nodes and 3 edges, got %d and %d", len(g.Nodes), len(g.Edges))
+	}
+	if g.Edges[1].Source != "b" || g.Edges[1].Target != "c" || g.Edges[1].LinkType != "markdown" {
+		t.Fatalf("unexpected edge: %+v", g.Edges[1])
+	}
+
+	_, g = get("/api/graph?site_id=s1&orphans=false")
+	if len(g.Nodes) != 4 {
+		t.Fatalf("expected orphan e to be dropped, got %+v", g.Nodes)
+	}
+
+	_, g = get("/api/graph?node_id=b&depth=1")
+	if len(g.Nodes) != 3 || len(g.Edges) != 2 || g.Nodes[0].ID != "b" || *g.Nodes[0].Distance != 0 {
+		t.Fatalf("unexpected depth-1 neighbourhood: %+v %+v", g.Nodes, g.Edges)
+	}
+	_, g = get("/api/graph?node_id=a&depth=2")
+	if len(g.Nodes) != 3 || *g.Nodes[2].Distance != 2 {
+		t.Fatalf("unexpected depth-2 neighbourhood: %+v", g.Nodes)
+	}
+
+	if code, _ := get("/api/graph?node_id=gone"); code != http.StatusNotFound {
+		t.Fatalf("deleted node should be 404, got %d", code)
+	}
+	if code, _ := get("/api/graph?depth=9&node_id=a"); code != http.StatusBadRequest {
+		t.Fatalf("depth over the limit should be 400, got %d", code)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/graph?site_id=s2&format=cytoscape", nil))
+	var cy struct {
+		Elements struct {
+			Nodes []struct {
+				Data GraphNode `json:"data"`
+			} `json:"nodes"`
+		} `json:"elements"`
+	}
+	json.NewDecoder(rr.Body).Decode(&cy)
+	if len(cy.Elements.Nodes) != 1 || cy.Elements.Nodes[0].Data.ID != "other" {
+		t.Fatalf("unexpected cytoscape output: %+v", cy)
+	}
+}
@@ -6,63 +6,268 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"veil/pkg/apierror"
 	codexpkg "veil/pkg/codex"
-	fsstorage "veil/pkg/codex/storage/fs"
+	"veil/pkg/events"
+	"veil/pkg/ids"
 	plugins "veil/pkg/plugins"
+	"veil/pkg/store"
+	"veil/pkg/validate"
 )
 
 // === API Handlers - Core ===
+
+// maxNodePage bounds a page of /api/nodes
+const maxNodePage = 1000
+
+// nodeListFields are the fields /api/nodes can return, by JSON name
+var nodeListFields = []string{"id", "type", "parent_id", "path", "title", "content", "mime_type", "created_at", "modified_at",
+	"owner_id", "site_id", "visibility", "backlink_count", "metadata", "front_matter"}
+
+// nodeListSorts maps the sort keys of /api/nodes to columns
+var nodeListSorts = map[string]string{"path": "n.path", "title": "n.title", "type": "n.type", "created_at": "n.created_at", "modified_at": "n.modified_at"}
+
+// nodePage is the LIMIT and OFFSET of a page of nodes, none for limit 0
+// and offset 0. PostgreSQL has no LIMIT -1, so the dialect says how to
+// skip rows without a limit.
+func nodePage(limit, offset int) string {
+	switch {
+	case limit > 0:
+		return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	case offset > 0:
+		return fmt.Sprintf(" LIMIT %s OFFSET %d", store.For(db).NoLimit(), offset)
+	}
+	return ""
+}
+
+// GET /api/nodes lists the live nodes the caller can read, by path. Filters:
+// type (comma separated), site_id, tag, modified_since (unix, RFC 3339 or
+// YYYY-MM-DD) and archived. sort=FIELD or -FIELD orders them, limit and
+// offset page them, and fields=id,title,... trims each node to those fields
+// (leaving content out of the query unless asked for). X-Total-Count has how
+// many match in all; Link has the next and previous pages.
 func handleNodes(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method == "GET" {
-		rows, _ := db.Query(`SELECT id, type, COALESCE(parent_id, ''), path, title, content, mime_type, created_at, modified_at
-			FROM nodes WHERE deleted_at IS NULL ORDER BY path`)
+		q := r.URL.Query()
+		var verrs validate.Errors
+		where := "n.deleted_at IS NULL" + archivedClause(r, "n.")
+		cond, args := nodeReadSQL(r)
+		where += " AND " + cond
+		if t := q.Get("type"); t != "" {
+			types := strings.Split(t, ",")
+			where += " AND n.type IN (?" + strings.Repeat(", ?", len(types)-1) + ")"
+			for _, t := range types {
+				args = append(args, strings.TrimSpace(t))
+			}
+		}
+		if site := q.Get("site_id"); site != "" {
+			where += " AND n.site_id = ?"
+			args = append(args, site)
+		}
+		if path := q.Get("path"); path != "" {
+			where += " AND n.path = ?"
+			args = append(args, path)
+		}
+		if tag := q.Get("tag"); tag != "" {
+			where += " AND EXISTS (SELECT 1 FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = n.id AND t.name = ?)"
+			args = append(args, tag)
+		}
+		if since := q.Get("modified_since"); since != "" {
+			if at, err := parseAsOf(since); err != nil {
+				verrs.Add("modified_since", "must be a unix time, RFC 3339 or YYYY-MM-DD")
+			} else {
+				where += " AND n.modified_at >= ?"
+				args = append(args, at.Unix())
+			}
+		}
+
+		order := "n.path, n.id"
+		if s := q.Get("sort"); s != "" {
+			col, ok := nodeListSorts[strings.TrimPrefix(s, "-")]
+			if !ok {
+				verrs.Add("sort", "must be one of path, title, type, created_at, modified_at, optionally with a leading -")
+			} else if strings.HasPrefix(s, "-") {
+				order = col + " DESC, n.id DESC"
+			} else {
+				order = col + ", n.id"
+			}
+		}
+		limit, offset := 0, 0
+		if l := q.Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 || n > maxNodePage {
+				verrs.Add("limit", fmt.Sprintf("must be between 1 and %d", maxNodePage))
+			}
+			limit = n
+		}
+		if o := q.Get("offset"); o != "" {
+			n, err := strconv.Atoi(o)
+			if err != nil || n < 0 {
+				verrs.Add("offset", "must be a non-negative number")
+			}
+			offset = n
+		}
+		var fields []string
+		if f := q.Get("fields"); f != "" {
+			for _, name := range strings.Split(f, ",") {
+				name = strings.TrimSpace(name)
+				if !slices.Contains(nodeListFields, name) {
+					verrs.Add("fields", "unknown field "+name+"; fields are "+strings.Join(nodeListFields, ", "))
+					break
+				}
+				fields = append(fields, name)
+			}
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+
+		const from = ` FROM nodes n LEFT JOIN node_visibility v ON v.node_id = n.id WHERE `
+		var total int
+		if err := db.QueryRow(`SELECT COUNT(*)`+from+where, args...).Scan(&total); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		content := "n.content"
+		if fields != nil && !slices.Contains(fields, "content") {
+			content = "''"
+		}
+		rows, err := db.Query(`SELECT n.id, n.type, COALESCE(n.parent_id, ''), n.path, n.title, `+content+`, COALESCE(n.mime_type, ''), n.created_at, n.modified_at,
+			COALESCE(n.owner_id, ''), COALESCE(n.site_id, ''), COALESCE(v.visibility, ''), n.backlink_count, COALESCE(n.metadata, '')`+
+			from+where+` ORDER BY `+order+nodePage(limit, offset), args...)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
 		defer rows.Close()
 
-		var nodes []Node
+		nodes := []interface{}{}
 		for rows.Next() {
 			var node Node
 			var created, modified int64
-			rows.Scan(&node.ID, &node.Type, &node.ParentID, &node.Path, &node.Title,
-				&node.Content, &node.MimeType, &created, &modified)
+			if err := rows.Scan(&node.ID, &node.Type, &node.ParentID, &node.Path, &node.Title,
+				&node.Content, &node.MimeType, &created, &modified, &node.OwnerID, &node.SiteID, &node.Visibility, &node.BacklinkCount, &node.Metadata); err != nil {
+				apierror.Internal(w, r, err)
+				return
+			}
 			node.CreatedAt = time.Unix(created, 0)
 			node.ModifiedAt = time.Unix(modified, 0)
-			nodes = append(nodes, node)
+			node.FrontMatter = frontMatterFields(node.Metadata)
+			if fields == nil {
+				nodes = append(nodes, node)
+				continue
+			}
+			var all map[string]json.RawMessage
+			b, _ := json.Marshal(node)
+			json.Unmarshal(b, &all)
+			picked := map[string]json.RawMessage{}
+			for _, f := range fields {
+				if v, ok := all[f]; ok {
+					picked[f] = v
+				}
+			}
+			nodes = append(nodes, picked)
+		}
+		if err := rows.Err(); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		if limit > 0 {
+			page := func(off int) string {
+				u := *r.URL
+				pq := u.Query()
+				pq.Set("offset", strconv.Itoa(off))
+				u.RawQuery = pq.Encode()
+				return u.RequestURI()
+			}
+			var links []string
+			if offset+limit < total {
+				links = append(links, fmt.Sprintf(`<%s>; rel="next"`, page(offset+limit)))
+			}
+			if offset > 0 {
+				links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, page(max(0, offset-limit))))
+			}
+			if links != nil {
+				w.Header().Set("Link", strings.Join(links, ", "))
+			}
 		}
-		json.NewEncoder(w).Encode(nodes)
+		writeJSONCached(w, r, nodes)
 	}
 }
 
 func handleNode(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	nodeID := strings.TrimPrefix(r.URL.Path, "/api/node/")
+	if strings.HasSuffix(nodeID, "/history") {
+		handleNodeHistory(w, r, strings.TrimSuffix(nodeID, "/history"))
+		return
+	}
+	if id, rest, ok := strings.Cut(nodeID, "/seo"); ok && (rest == "" || rest == "/regenerate") {
+		handleNodeSEO(w, r, id, rest == "/regenerate")
+		return
+	}
+	if id, ok := strings.CutSuffix(nodeID, "/archive"); ok {
+		handleNodeArchive(w, r, id, true)
+		return
+	}
+	if id, ok := strings.CutSuffix(nodeID, "/export"); ok {
+		handleNodeExport(w, r, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(nodeID, "/unarchive"); ok {
+		handleNodeArchive(w, r, id, false)
+		return
+	}
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		handleNodeAsOf(w, r, nodeID, asOf)
+		return
+	}
 
 	var node Node
 	var created, modified int64
-	err := db.QueryRow(`SELECT id, type, COALESCE(parent_id, ''), path, title, content, mime_type, created_at, modified_at
-		FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+	var archived sql.NullInt64
+	err := db.QueryRow(`SELECT id, type, COALESCE(parent_id, ''), path, title, content, mime_type, created_at, modified_at, COALESCE(owner_id, ''), archived_at,
+		COALESCE(metadata, '') FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
 		Scan(&node.ID, &node.Type, &node.ParentID, &node.Path, &node.Title,
-			&node.Content, &node.MimeType, &created, &modified)
+			&node.Content, &node.MimeType, &created, &modified, &node.OwnerID, &archived, &node.Metadata)
 
-	if err != nil {
+	if err != nil || !canReadNode(r, node.ID) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
 	node.CreatedAt = time.Unix(created, 0)
 	node.ModifiedAt = time.Unix(modified, 0)
+	if etag, ok := loadNodeETag(node.ID); ok && notModified(w, r, etag, node.ModifiedAt) {
+		return
+	}
+	if archived.Valid {
+		t := time.Unix(archived.Int64, 0)
+		node.ArchivedAt = &t
+	}
+	node.FrontMatter = frontMatterFields(node.Metadata)
 	json.NewEncoder(w).Encode(node)
 }
 
+// POST /api/node-create[?template=slug] creates a node. With a template the
+// body may leave out anything the template provides, or be empty.
 func handleNodeCreate(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
@@ -71,13 +276,92 @@ func handleNodeCreate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var node Node
-	json.NewDecoder(r.Body).Decode(&node)
-	node.ID = fmt.Sprintf("node_%d", time.Now().UnixNano())
+	if slug := r.URL.Query().Get("template"); slug != "" {
+		tmpl, err := loadTemplate(slug)
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, "template not found")
+			return
+		}
+		// the body is checked once the template has filled it in
+		if err := json.NewDecoder(r.Body).Decode(&node); err != nil && err != io.EOF {
+			validate.WriteError(w, validate.Errors{{Message: "invalid JSON: " + err.Error()}})
+			return
+		}
+		if err := applyTemplate(tmpl, &node, time.Now()); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if err := validate.Struct(&node).Err(); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+	} else if err := validate.DecodeJSON(r.Body, &node); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	if err := applyFrontMatter(&node, node.Metadata, ""); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	if node.Type == NodeTypeTable {
+		if node.MimeType == "" {
+			node.MimeType = "text/csv"
+		}
+		if !checkTable(w, node) {
+			return
+		}
+	}
+	if !checkNodeSize(w, node) || !checkVaultRoom(w, int64(len(node.Content)+len(node.Body))) {
+		return
+	}
+	if !canCreateInSite(r, node.SiteID) {
+		apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+		return
+	}
+	if err := nodeParentErrors(node).Err(); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	node.OwnerID = currentUserID(r)
+	if err := insertNode(&node, commitAuthor(r)); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(node)
+}
+
+// nodeParentErrors checks that a new node's site and parent exist, which
+// the foreign keys on nodes would otherwise refuse with a bare SQL error
+func nodeParentErrors(node Node) validate.Errors {
+	var errs validate.Errors
+	var n int
+	if node.SiteID != "" {
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, node.SiteID).Scan(&n); err != nil {
+			log.Printf("site %s: %v", node.SiteID, err)
+		} else if n == 0 {
+			errs.Add("site_id", "no such site")
+		}
+	}
+	if node.ParentID != "" {
+		if err := db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE id = ?`, node.ParentID).Scan(&n); err != nil {
+			log.Printf("node %s: %v", node.ParentID, err)
+		} else if n == 0 {
+			errs.Add("parent_id", "no such node")
+		}
+	}
+	return errs
+}
+
+// insertNode stores a new node: its codex object and first commit, its row,
+// tags, first version and visibility, and its references
+func insertNode(node *Node, author string) error {
+	node.ID = ids.New("node")
 	now := time.Now().Unix()
+	node.CreatedAt, node.ModifiedAt = time.Unix(now, 0), time.Unix(now, 0)
 
 	// Store node content in Codex
-	storage := fsstorage.New(".")
-	repo := codexpkg.NewRepository(storage, ".")
+	repo := codexRepo()
 
 	// Create node object for Codex
 	nodeData := map[string]interface{}{
@@ -91,51 +375,66 @@ func handleNodeCreate(w http.ResponseWriter, r *http.Request) {
 		"site_id":     node.SiteID,
 		"created_at":  now,
 		"modified_at": now,
-		"urn":         fmt.Sprintf("urn:veil:node:%s", node.ID),
+		"urn":         nodeURN(node.ID),
+	}
+	if node.Metadata != "" {
+		nodeData["metadata"] = json.RawMessage(node.Metadata)
 	}
 
 	nodeJSON, _ := json.Marshal(nodeData)
 	hash, err := repo.PutObjectStream(bytes.NewReader(nodeJSON), "application/json")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to store in Codex"})
-		return
+		return errors.New("Failed to store in Codex")
 	}
 
 	// Create initial commit for the node
 	commit := &codexpkg.Commit{
 		Hash:      "",
 		Parents:   []string{},
-		Author:    "Veil System",
+		Author:    author,
 		Timestamp: time.Unix(now, 0),
 		Message:   fmt.Sprintf("Create node: %s", node.Title),
 		Objects:   []string{hash},
 	}
 
 	if err := repo.PutCommit(commit); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create commit"})
-		return
+		return errors.New("Failed to create commit")
 	}
 
-	// Store metadata in database
-	db.Exec(`INSERT INTO nodes (id, type, parent_id, path, title, content, mime_type, site_id, created_at, modified_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		node.ID, node.Type, node.ParentID, node.Path, node.Title, node.Content, node.MimeType, node.SiteID, now, now)
+	// Store the node, its first version and its visibility together
+	err = writeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`INSERT INTO nodes (id, type, parent_id, path, title, content, mime_type, site_id, metadata, created_at, modified_at, owner_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			node.ID, node.Type, nullString(node.ParentID), node.Path, node.Title, node.Content, node.MimeType, nullString(node.SiteID),
+			nullString(node.Metadata), now, now, nullString(node.OwnerID)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			ids.New("v"), node.ID, 1, node.Content, node.Title, "draft", now, now, 1); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO node_visibility (id, node_id, visibility, created_at)
+			VALUES (?, ?, ?, ?)`,
+			ids.New("vis"), node.ID, "private", now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	tagNode(node.ID, node.Tags)
 
-	// Create initial version
-	versionID := fmt.Sprintf("v_%d", time.Now().UnixNano())
-	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		versionID, node.ID, 1, node.Content, node.Title, "draft", now, now, 1)
+	// Link the node to its codex URN and commit
+	if err := recordNodeCodexCommit(node.ID, hash, commit.Hash, now); err != nil {
+		log.Printf("codex link for node %s: %v", node.ID, err)
+	}
 
-	// Set visibility
-	db.Exec(`INSERT INTO node_visibility (id, node_id, visibility, created_at)
-		VALUES (?, ?, ?, ?)`,
-		fmt.Sprintf("vis_%d", time.Now().UnixNano()), node.ID, "private", now)
+	if err := syncNodeReferences(node.ID, node.SiteID, node.Content); err != nil {
+		log.Printf("references for node %s: %v", node.ID, err)
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(node)
+	publishNodeEvent(events.NodeCreated, *node)
+	return nil
 }
 
 func handleNodeUpdate(w http.ResponseWriter, r *http.Request) {
@@ -146,22 +445,55 @@ func handleNodeUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var node Node
-	json.NewDecoder(r.Body).Decode(&node)
+	verrs, _ := validate.DecodeJSON(r.Body, &node).(validate.Errors)
+	if node.ID == "" {
+		verrs.Add("id", "is required")
+	}
+	if len(verrs) > 0 {
+		validate.WriteError(w, verrs)
+		return
+	}
 	now := time.Now().Unix()
 
-	// Get current node data from DB
+	if !canModifyNode(r, node.ID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's owner can edit it")
+		return
+	}
+	if !checkNodeSize(w, node) || !checkVaultRoom(w, int64(len(node.Content)+len(node.Body))) {
+		return
+	}
+
+	// Get current node data from DB, checked against what the editor read
+	nodeWriteMu.Lock()
+	defer nodeWriteMu.Unlock()
 	var currentNode Node
-	var created int64
-	err := db.QueryRow(`SELECT id, type, parent_id, path, title, content, mime_type, site_id, created_at FROM nodes WHERE id = ?`, node.ID).
-		Scan(&currentNode.ID, &currentNode.Type, &currentNode.ParentID, &currentNode.Path, &currentNode.Title, &currentNode.Content, &currentNode.MimeType, &currentNode.SiteID, &created)
-	if err != nil {
+	var created, modified int64
+	err := db.QueryRow(`SELECT id, type, COALESCE(parent_id, ''), path, title, content, mime_type, COALESCE(site_id, ''), created_at, modified_at, COALESCE(metadata, '') FROM nodes WHERE id = ?`, node.ID).
+		Scan(&currentNode.ID, &currentNode.Type, &currentNode.ParentID, &currentNode.Path, &currentNode.Title, &currentNode.Content, &currentNode.MimeType, &currentNode.SiteID, &created, &modified, &currentNode.Metadata)
+	etag, live := loadNodeETag(node.ID)
+	if err != nil || !live {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if !checkIfMatch(w, r, etag, time.Unix(modified, 0)) {
+		return
+	}
+
+	// Metadata the request leaves out is kept, less what the old front matter set
+	base := node.Metadata
+	if base == "" {
+		base = currentNode.Metadata
+	}
+	if err := applyFrontMatter(&node, base, currentNode.Content); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	if currentNode.Type == NodeTypeTable && !checkTable(w, Node{Content: node.Content, MimeType: currentNode.MimeType, Metadata: node.Metadata}) {
+		return
+	}
 
 	// Store updated node content in Codex
-	storage := fsstorage.New(".")
-	repo := codexpkg.NewRepository(storage, ".")
+	repo := codexRepo()
 
 	// Create updated node object for Codex
 	nodeData := map[string]interface{}{
@@ -175,75 +507,128 @@ func handleNodeUpdate(w http.ResponseWriter, r *http.Request) {
 		"site_id":     node.SiteID,
 		"created_at":  created,
 		"modified_at": now,
-		"urn":         fmt.Sprintf("urn:veil:node:%s", node.ID),
+		"urn":         nodeURN(node.ID),
+	}
+	if node.Metadata != "" {
+		nodeData["metadata"] = json.RawMessage(node.Metadata)
 	}
 
 	nodeJSON, _ := json.Marshal(nodeData)
 	hash, err := repo.PutObjectStream(bytes.NewReader(nodeJSON), "application/json")
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to store in Codex"})
+		apierror.Write(w, http.StatusInternalServerError, "Failed to store in Codex")
 		return
 	}
 
-	// Get the latest commit for this node to create a new commit
-	// For simplicity, we'll create a new commit with the updated object
+	// Chain onto the node's previous codex commit when one is known
+	parents := []string{}
+	if head := nodeCodexHead(node.ID); head != "" {
+		parents = append(parents, head)
+	}
 	commit := &codexpkg.Commit{
 		Hash:      "",
-		Parents:   []string{}, // Could track parent commits here
-		Author:    "Veil System",
+		Parents:   parents,
+		Author:    commitAuthor(r),
 		Timestamp: time.Unix(now, 0),
 		Message:   fmt.Sprintf("Update node: %s", node.Title),
 		Objects:   []string{hash},
 	}
 
 	if err := repo.PutCommit(commit); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create commit"})
+		apierror.Write(w, http.StatusInternalServerError, "Failed to create commit")
 		return
 	}
 
-	// Update metadata in database
-	db.Exec(`UPDATE nodes SET title = ?, content = ?, modified_at = ? WHERE id = ?`,
-		node.Title, node.Content, now, node.ID)
-
-	// Create new version
-	var versionNumber int
-	db.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, node.ID).Scan(&versionNumber)
-	versionNumber++
+	// Update the row and add the new current version together
+	err = writeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE nodes SET title = ?, content = ?, metadata = ?, modified_at = ? WHERE id = ?`,
+			node.Title, node.Content, nullString(node.Metadata), now, node.ID); err != nil {
+			return err
+		}
+		var versionNumber int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, node.ID).Scan(&versionNumber); err != nil {
+			return err
+		}
+		versionID := ids.New("v")
+		if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			versionID, node.ID, versionNumber+1, node.Content, node.Title, "draft", now, now, 1); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ? AND id != ?`, node.ID, versionID)
+		return err
+	})
+	if err != nil {
+		apierror.WriteError(w, r, err)
+		return
+	}
+	tagNode(node.ID, node.Tags)
 
-	versionID := fmt.Sprintf("v_%d", time.Now().UnixNano())
-	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		versionID, node.ID, versionNumber, node.Content, node.Title, "draft", now, now, 1)
+	if err := recordNodeCodexCommit(node.ID, hash, commit.Hash, now); err != nil {
+		log.Printf("codex link for node %s: %v", node.ID, err)
+	}
 
-	db.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ? AND id != ?`, node.ID, versionID)
+	if err := syncNodeReferences(node.ID, currentNode.SiteID, node.Content); err != nil {
+		log.Printf("references for node %s: %v", node.ID, err)
+	}
 
+	publishNodeEvent(events.NodeUpdated, node)
+	if etag, ok := loadNodeETag(node.ID); ok {
+		w.Header().Set("ETag", etag)
+	}
 	json.NewEncoder(w).Encode(node)
 }
 
 func handleNodeDelete(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	nodeID := r.URL.Query().Get("id")
-	db.Exec(`UPDATE nodes SET deleted_at = ? WHERE id = ?`, time.Now().Unix(), nodeID)
+	if !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's owner can delete it")
+		return
+	}
+	if err := deleteNode(nodeID); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteNode moves a node to the trash
+func deleteNode(nodeID string) error {
+	if _, err := db.Exec(`UPDATE nodes SET deleted_at = ? WHERE id = ?`, time.Now().Unix(), nodeID); err != nil {
+		return err
+	}
+	targets, err := backlinkTargets(db, nodeID)
+	if err != nil {
+		return err
+	}
+	if err := recountBacklinks(db, targets); err != nil {
+		return err
+	}
+	siteID, _, _ := nodeAccess(nodeID)
+	publishNodeEvent(events.NodeDeleted, Node{ID: nodeID, SiteID: siteID})
+	return nil
+}
+
 // === API Handlers - Versions ===
-func handleVersions(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleVersions(w http.ResponseWriter, r *http.Request) error {
 	nodeID := r.URL.Query().Get("node_id")
 
-	rows, _ := db.Query(`SELECT id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current
+	rows, err := db.Query(`SELECT id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current
 		FROM versions WHERE node_id = ? ORDER BY version_number DESC`, nodeID)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var versions []Version
+	versions := []Version{}
 	for rows.Next() {
 		var v Version
 		var created, modified int64
 		var published sql.NullInt64
-		rows.Scan(&v.ID, &v.NodeID, &v.VersionNumber, &v.Content, &v.Title, &v.Status, &published, &created, &modified, &v.IsCurrent)
+		if err := rows.Scan(&v.ID, &v.NodeID, &v.VersionNumber, &v.Content, &v.Title, &v.Status, &published, &created, &modified, &v.IsCurrent); err != nil {
+			return err
+		}
 		v.CreatedAt = time.Unix(created, 0)
 		v.ModifiedAt = time.Unix(modified, 0)
 		if published.Valid {
@@ -252,53 +637,86 @@ func handleVersions(w http.ResponseWriter, r *http.Request) {
 		}
 		versions = append(versions, v)
 	}
-	json.NewEncoder(w).Encode(versions)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(versions)
 }
 
-func handlePublish(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handlePublish(w http.ResponseWriter, r *http.Request) error {
 	nodeID := r.URL.Query().Get("node_id")
-	now := time.Now().Unix()
 
-	db.Exec(`
+	if !canModifyNode(r, nodeID) {
+		return apierror.New(http.StatusForbidden, "editor role required to publish")
+	}
+
+	if _, err := publishCurrentVersion(nodeID); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"status": "published"})
+}
+
+// publishCurrentVersion marks a node's current version published, fills in
+// its descriptions and returns the version's ID, "" when it has none
+func publishCurrentVersion(nodeID string) (string, error) {
+	var versionID string
+	err := db.QueryRow(`SELECT id FROM versions WHERE node_id = ? AND is_current = 1`, nodeID).Scan(&versionID)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if _, err := db.Exec(`
 	UPDATE 
 		versions 
 	SET 
 		status = 'published', 
 		published_at = ? 
 	WHERE node_id = ? AND is_current = 1`,
-		now, nodeID)
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "published"})
+		time.Now().Unix(), nodeID); err != nil {
+		return "", err
+	}
+	fillDescriptions(nodeID, false)
+	return versionID, nil
 }
 
-func handleRollback(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleRollback(w http.ResponseWriter, r *http.Request) error {
 	versionID := r.URL.Query().Get("version_id")
 
 	var version Version
-	db.QueryRow(`SELECT id, node_id, content, title FROM versions WHERE id = ?`, versionID).
+	err := db.QueryRow(`SELECT id, node_id, content, title FROM versions WHERE id = ?`, versionID).
 		Scan(&version.ID, &version.NodeID, &version.Content, &version.Title)
+	if err == sql.ErrNoRows {
+		return apierror.New(http.StatusNotFound, "version not found")
+	}
+	if err != nil {
+		return err
+	}
 
-	now := time.Now().Unix()
-	db.Exec(`UPDATE nodes SET content = ?, title = ?, modified_at = ? WHERE id = ?`,
-		version.Content, version.Title, now, version.NodeID)
+	if !canModifyNode(r, version.NodeID) {
+		return apierror.New(http.StatusForbidden, "editor role required to roll back")
+	}
 
-	json.NewEncoder(w).Encode(version)
-}
+	now := time.Now().Unix()
+	if _, err := db.Exec(`UPDATE nodes SET content = ?, title = ?, modified_at = ? WHERE id = ?`,
+		version.Content, version.Title, now, version.NodeID); err != nil {
+		return err
+	}
+	siteID, _, _ := nodeAccess(version.NodeID)
+	if err := syncNodeReferences(version.NodeID, siteID, version.Content); err != nil {
+		log.Printf("references for node %s: %v", version.NodeID, err)
+	}
 
-func handleSnapshots(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(version)
 }
 
 // === API Handlers - References ===
-func handleReferences(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleReferences(w http.ResponseWriter, r *http.Request) error {
 	sourceNodeID := r.URL.Query().Get("source")
 
-	fmt.Printf("%s", sourceNodeID)
-	rows, _ := db.Query(`
+	rows, err := db.Query(`
 		SELECT 
 			id, 
 			source_node_id, 
@@ -309,32 +727,49 @@ func handleReferences(w http.ResponseWriter, r *http.Request) {
 			node_references 
 		WHERE source_node_id = ?`,
 		sourceNodeID)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var references []Reference
+	references := []Reference{}
 	for rows.Next() {
 		var ref Reference
-		rows.Scan(&ref.ID, &ref.SourceNodeID, &ref.TargetNodeID, &ref.LinkType, &ref.LinkText)
+		if err := rows.Scan(&ref.ID, &ref.SourceNodeID, &ref.TargetNodeID, &ref.LinkType, &ref.LinkText); err != nil {
+			return err
+		}
 		references = append(references, ref)
 	}
-	json.NewEncoder(w).Encode(references)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(references)
 }
 
-func handleBacklinks(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleBacklinks(w http.ResponseWriter, r *http.Request) error {
 	targetNodeID := strings.TrimPrefix(r.URL.Path, "/api/backlinks/")
 
-	rows, _ := db.Query(`SELECT id, source_node_id, target_node_id, link_type, link_text
+	rows, err := db.Query(`SELECT id, source_node_id, target_node_id, link_type, link_text
 		FROM node_references WHERE target_node_id = ?`, targetNodeID)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var backlinks []Reference
+	backlinks := []Reference{}
 	for rows.Next() {
 		var ref Reference
-		rows.Scan(&ref.ID, &ref.SourceNodeID, &ref.TargetNodeID, &ref.LinkType, &ref.LinkText)
+		if err := rows.Scan(&ref.ID, &ref.SourceNodeID, &ref.TargetNodeID, &ref.LinkType, &ref.LinkText); err != nil {
+			return err
+		}
 		backlinks = append(backlinks, ref)
 	}
-	json.NewEncoder(w).Encode(backlinks)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(backlinks)
 }
 
 func handleResolveLink(w http.ResponseWriter, r *http.Request) {
@@ -347,20 +782,28 @@ func handleResolveLink(w http.ResponseWriter, r *http.Request) {
 		Scan(&uri.ID, &uri.NodeID, &uri.URI, &uri.IsPrimary, &uri.CreatedAt)
 	if err == nil {
 		var node Node
-		db.QueryRow(`SELECT id, path, title FROM nodes WHERE id = ?`, uri.NodeID).Scan(&node.ID, &node.Path, &node.Title)
+		if err := db.QueryRow(`SELECT id, path, title FROM nodes WHERE id = ?`, uri.NodeID).Scan(&node.ID, &node.Path, &node.Title); err != nil && err != sql.ErrNoRows {
+			apierror.Internal(w, r, err)
+			return
+		}
 		json.NewEncoder(w).Encode(node)
 		return
 	}
 
 	// Fallback: search by canonical_uri or partial path/title
 	var node Node
-	db.QueryRow(`SELECT id, path, title FROM nodes WHERE canonical_uri = ? OR path LIKE ? OR title LIKE ?`, linkText, "%"+linkText+"%", "%"+linkText+"%").
+	err = db.QueryRow(`SELECT id, path, title FROM nodes WHERE canonical_uri = ? OR lower(path) LIKE lower(?) OR lower(title) LIKE lower(?)`, linkText, "%"+linkText+"%", "%"+linkText+"%").
 		Scan(&node.ID, &node.Path, &node.Title)
+	if err != nil && err != sql.ErrNoRows {
+		apierror.Internal(w, r, err)
+		return
+	}
 	json.NewEncoder(w).Encode(node)
 }
 
 func handleUniversalURI(w http.ResponseWriter, r *http.Request) {
-	// Extract URI from path: /veil/note/{id} or /veil/{siteName}/{path}
+	// Extract URI from path: /veil/note/{id} or /veil/{siteName}/{path},
+	// with ?view=print or ?view=reader rendering the node in place
 	path := strings.TrimPrefix(r.URL.Path, "/veil/")
 	parts := strings.Split(path, "/")
 
@@ -375,16 +818,25 @@ func handleUniversalURI(w http.ResponseWriter, r *http.Request) {
 		nodeID := parts[1]
 
 		// Find site for this node
+		// a historical citation may point at a node deleted since
+		query := `SELECT COALESCE(site_id, '') FROM nodes WHERE id = ? AND deleted_at IS NULL`
+		if r.URL.Query().Get("as_of") != "" {
+			query = `SELECT COALESCE(site_id, '') FROM nodes WHERE id = ?`
+		}
 		var siteID string
-		err := db.QueryRow(`SELECT site_id FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).Scan(&siteID)
+		err := db.QueryRow(query, nodeID).Scan(&siteID)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			w.Write([]byte("Node not found"))
 			return
 		}
+		if view := r.URL.Query().Get("view"); view != "" {
+			handleNodeView(w, r, siteID, nodeID, view)
+			return
+		}
 
 		// Redirect to preview
-		http.Redirect(w, r, fmt.Sprintf("/preview/%s/%s", siteID, nodeID), http.StatusFound)
+		http.Redirect(w, r, previewURL(siteID, nodeID, r), http.StatusFound)
 		return
 	}
 
@@ -412,9 +864,22 @@ func handleUniversalURI(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Node not found"))
 		return
 	}
+	if view := r.URL.Query().Get("view"); view != "" {
+		handleNodeView(w, r, site.ID, node.ID, view)
+		return
+	}
 
 	// Redirect to preview
-	http.Redirect(w, r, fmt.Sprintf("/preview/%s/%s", site.ID, node.ID), http.StatusFound)
+	http.Redirect(w, r, previewURL(site.ID, node.ID, r), http.StatusFound)
+}
+
+// previewURL is a node's preview page, keeping ?as_of from the request
+func previewURL(siteID, nodeID string, r *http.Request) string {
+	u := fmt.Sprintf("/preview/%s/%s", siteID, nodeID)
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		u += "?as_of=" + url.QueryEscape(asOf)
+	}
+	return u
 }
 
 func renderNodeAsHTML(w http.ResponseWriter, node Node, site Site) {
@@ -444,175 +909,52 @@ func renderNodeAsHTML(w http.ResponseWriter, node Node, site Site) {
 	w.Write([]byte(html))
 }
 
-func renderShaderDemo(w http.ResponseWriter, node Node) {
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-    <title>%s - Shader Demo</title>
-    <script src="https://cdnjs.cloudflare.com/ajax/libs/three.js/r128/three.min.js"></script>
-</head>
-<body>
-    <canvas id="shaderCanvas" style="width: 100%%; height: 100vh; display: block;"></canvas>
-    <script>
-        %s
-    </script>
-</body>
-</html>`, node.Title, node.Content)
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
-}
-
-func renderCanvas(w http.ResponseWriter, node Node) {
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head>
-    <title>%s - Canvas</title>
-</head>
-<body>
-    <div style="text-align: center;">
-        %s
-    </div>
-</body>
-</html>`, node.Title, node.Content)
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(html))
-}
-
-// === API Handlers - Plugin Registry ===
-func handlePluginsRegistry(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	if r.Method == "GET" {
-		rows, _ := db.Query(`SELECT id, name, slug, manifest, enabled, created_at, updated_at FROM plugins_registry ORDER BY name`)
-		defer rows.Close()
-
-		var out []PluginManifest
-		for rows.Next() {
-			var p PluginManifest
-			var createdAt, updatedAt sql.NullInt64
-			var enabled int
-			rows.Scan(&p.ID, &p.Name, &p.Slug, &p.Manifest, &enabled, &createdAt, &updatedAt)
-			p.Enabled = enabled == 1
-			if createdAt.Valid {
-				p.CreatedAt = time.Unix(createdAt.Int64, 0)
-			}
-			if updatedAt.Valid {
-				p.UpdatedAt = time.Unix(updatedAt.Int64, 0)
-			}
-			out = append(out, p)
-		}
-		json.NewEncoder(w).Encode(out)
-		return
-	}
-
-	if r.Method == "POST" {
-		var req PluginManifest
-		json.NewDecoder(r.Body).Decode(&req)
-		req.ID = fmt.Sprintf("plugin_%d", time.Now().UnixNano())
-		now := time.Now().Unix()
-		enabled := 0
-		if req.Enabled {
-			enabled = 1
-		}
-		_, err := db.Exec(`INSERT INTO plugins_registry (id, name, slug, manifest, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`, req.ID, req.Name, req.Slug, req.Manifest, enabled, now, now)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
-		}
-		json.NewEncoder(w).Encode(req)
-		return
-	}
-
-	if r.Method == "PUT" {
-		var req PluginManifest
-		json.NewDecoder(r.Body).Decode(&req)
-		now := time.Now().Unix()
-		enabled := 0
-		if req.Enabled {
-			enabled = 1
-		}
-		_, err := db.Exec(`UPDATE plugins_registry SET name = ?, manifest = ?, enabled = ?, updated_at = ? WHERE slug = ? OR id = ?`, req.Name, req.Manifest, enabled, now, req.Slug, req.ID)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
-		}
-		// Runtime registration/unregistration
-		if req.Enabled {
-			p := plugins.InstantiatePluginBySlug(req.Slug)
-			if p != nil {
-				var cfg map[string]interface{}
-				if req.Manifest != "" {
-					json.Unmarshal([]byte(req.Manifest), &cfg)
-				}
-				if err := p.Initialize(cfg); err != nil {
-					log.Printf("plugin init failed for %s: %v", req.Slug, err)
-				} else if err := plugins.GetRegistry().Register(p); err != nil {
-					log.Printf("plugin register failed for %s: %v", req.Slug, err)
-				} else {
-					log.Printf("plugin %s enabled and registered", req.Slug)
-				}
-			}
-		} else {
-			// Try by slug first, then name
-			if err := plugins.GetRegistry().Unregister(req.Slug); err != nil {
-				if req.Name != "" {
-					plugins.GetRegistry().Unregister(req.Name)
-				}
-			}
-		}
-
-		json.NewEncoder(w).Encode(map[string]string{"updated": req.Slug})
-		return
-	}
-
-	if r.Method == "DELETE" {
-		id := r.URL.Query().Get("id")
-		_, err := db.Exec(`DELETE FROM plugins_registry WHERE id = ? OR slug = ?`, id, id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-			return
-		}
-		json.NewEncoder(w).Encode(map[string]string{"deleted": id})
-		return
-	}
-}
-
 // === API Handlers - Tags ===
-func handleTags(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	rows, _ := db.Query(`SELECT id, name, color FROM tags ORDER BY name`)
+func handleTags(w http.ResponseWriter, r *http.Request) error {
+	rows, err := db.Query(`SELECT id, name, color FROM tags ORDER BY name`)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var tags []Tag
+	tags := []Tag{}
 	for rows.Next() {
 		var tag Tag
-		rows.Scan(&tag.ID, &tag.Name, &tag.Color)
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color); err != nil {
+			return err
+		}
 		tags = append(tags, tag)
 	}
-	json.NewEncoder(w).Encode(tags)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(tags)
 }
 
-func handleNodeTags(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleNodeTags(w http.ResponseWriter, r *http.Request) error {
 	nodeID := r.URL.Query().Get("node_id")
 
-	rows, _ := db.Query(`SELECT t.id, t.name, t.color FROM tags t
+	rows, err := db.Query(`SELECT t.id, t.name, t.color FROM tags t
 		JOIN node_tags nt ON t.id = nt.tag_id WHERE nt.node_id = ?`, nodeID)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var tags []Tag
+	tags := []Tag{}
 	for rows.Next() {
 		var tag Tag
-		rows.Scan(&tag.ID, &tag.Name, &tag.Color)
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color); err != nil {
+			return err
+		}
 		tags = append(tags, tag)
 	}
-	json.NewEncoder(w).Encode(tags)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(tags)
 }
 
 // === API Handlers - Media ===
@@ -622,20 +964,30 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseMultipartForm(32 << 20) // 32 MB max
+	limitMediaBody(w, r, 1<<20)
+	err := r.ParseMultipartForm(32 << 20) // 32 MB in memory, the rest spills to disk
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to parse form"})
+		if isBodyTooLarge(err) {
+			writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, r.ContentLength)
+			return
+		}
+		apierror.Write(w, http.StatusBadRequest, "failed to parse form")
 		return
 	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "no file uploaded"})
+		apierror.Write(w, http.StatusBadRequest, "no file uploaded")
 		return
 	}
 	defer file.Close()
+	if limits.MaxMediaBytes > 0 && handler.Size > limits.MaxMediaBytes {
+		writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, handler.Size)
+		return
+	}
+	if !checkVaultRoom(w, handler.Size) {
+		return
+	}
 
 	buf := new(bytes.Buffer)
 	io.Copy(buf, file)
@@ -644,7 +996,7 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request) {
 	hash := md5.Sum(content)
 	hashStr := fmt.Sprintf("%x", hash)
 
-	mediaID := fmt.Sprintf("media_%d", time.Now().UnixNano())
+	mediaID := ids.New("media")
 	now := time.Now().Unix()
 
 	// Ensure media dir exists and write file to disk
@@ -653,20 +1005,38 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request) {
 	fpath := filepath.Join("media", filename)
 	os.WriteFile(fpath, content, 0644)
 
-	_, err = db.Exec(`INSERT INTO media (id, filename, storage_url, checksum, mime_type, size, uploaded_by, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		mediaID, handler.Filename, fpath, hashStr, handler.Header.Get("Content-Type"), len(content), "", now)
+	ownerID := currentUserID(r)
+	var owner interface{}
+	if ownerID != "" {
+		owner = ownerID
+	}
+	_, err = db.Exec(`INSERT INTO media (id, filename, storage_url, hash, mime_type, file_size, uploaded_by, owner_id, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		mediaID, handler.Filename, fpath, hashStr, handler.Header.Get("Content-Type"), len(content), ownerID, owner, now)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
+	noteVaultWrite(int64(len(content)))
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"id":       mediaID,
 		"url":      "/media/" + filename,
 		"filename": handler.Filename,
-	})
+	}
+	if width, height, variants := makeImageVariants(mediaID, filename, content); width > 0 {
+		resp["width"], resp["height"] = width, height
+		resp["variants"] = variants
+		if srcset := imageSrcset("/media/"+filename, width, variants, "/media/"); srcset != "" {
+			resp["srcset"], resp["sizes"] = srcset, imageSizes
+		}
+		for _, v := range variants {
+			if v.Name == "thumb" {
+				resp["thumbnail_url"] = v.URL
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleMedia(w http.ResponseWriter, r *http.Request) {
@@ -674,58 +1044,91 @@ func handleMedia(w http.ResponseWriter, r *http.Request) {
 	mediaID := r.URL.Query().Get("id")
 
 	var media MediaFile
-	db.QueryRow(`SELECT id, node_id, filename, storage_url, checksum, mime_type, size, uploaded_by, created_at FROM media WHERE id = ?`, mediaID).
-		Scan(&media.ID, &media.NodeID, &media.Filename, &media.StorageURL, &media.Checksum, &media.MimeType, &media.FileSize, &media.UploadedBy, &media.CreatedAt)
+	var created int64
+	db.QueryRow(`SELECT id, COALESCE(node_id, ''), COALESCE(filename, ''), COALESCE(storage_url, ''), COALESCE(hash, ''), COALESCE(mime_type, ''),
+		COALESCE(file_size, 0), COALESCE(uploaded_by, ''), COALESCE(owner_id, ''), created_at FROM media WHERE id = ?`, mediaID).
+		Scan(&media.ID, &media.NodeID, &media.Filename, &media.StorageURL, &media.Checksum, &media.MimeType, &media.FileSize, &media.UploadedBy, &media.OwnerID, &created)
+	media.CreatedAt = time.Unix(created, 0)
+	if media.StorageURL != "" {
+		media.ColdState = coldState(ColdKindMedia, strings.TrimPrefix(filepath.ToSlash(media.StorageURL), "media/"))
+		fillMediaVariants(&media)
+	}
 
-	json.NewEncoder(w).Encode(media)
+	writeJSONCached(w, r, media)
 }
 
-func handleMediaLibrary(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleMediaLibrary(w http.ResponseWriter, r *http.Request) error {
 	userID := r.URL.Query().Get("user_id")
 
-	rows, _ := db.Query(`SELECT m.id, m.node_id, m.filename, m.storage_url, m.checksum, m.mime_type, m.size, m.uploaded_by FROM media m JOIN media_library ml ON m.id = ml.media_id WHERE ml.user_id = ?`, userID)
+	rows, err := db.Query(`SELECT m.id, m.node_id, m.filename, m.storage_url, m.checksum, m.mime_type, m.size, m.uploaded_by FROM media m JOIN media_library ml ON m.id = ml.media_id WHERE ml.user_id = ?`, userID)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var media []MediaFile
+	media := []MediaFile{}
 	for rows.Next() {
 		var m MediaFile
-		rows.Scan(&m.ID, &m.NodeID, &m.Filename, &m.StorageURL, &m.Checksum, &m.MimeType, &m.FileSize, &m.UploadedBy)
+		if err := rows.Scan(&m.ID, &m.NodeID, &m.Filename, &m.StorageURL, &m.Checksum, &m.MimeType, &m.FileSize, &m.UploadedBy); err != nil {
+			return err
+		}
 		media = append(media, m)
 	}
-	json.NewEncoder(w).Encode(media)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(media)
 }
 
 // === API Handlers - Blog ===
-func handleBlogPosts(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	rows, _ := db.Query(`SELECT id, node_id, slug, excerpt, publish_date, category FROM blog_posts ORDER BY publish_date DESC`)
+func handleBlogPosts(w http.ResponseWriter, r *http.Request) error {
+	rows, err := db.Query(`SELECT id, node_id, slug, excerpt, publish_date, category FROM blog_posts ORDER BY publish_date DESC`)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var posts []BlogPost
+	posts := []BlogPost{}
 	for rows.Next() {
 		var post BlogPost
 		var pubDate sql.NullInt64
-		rows.Scan(&post.ID, &post.NodeID, &post.Slug, &post.Excerpt, &pubDate, &post.Category)
+		if err := rows.Scan(&post.ID, &post.NodeID, &post.Slug, &post.Excerpt, &pubDate, &post.Category); err != nil {
+			return err
+		}
 		if pubDate.Valid {
 			t := time.Unix(pubDate.Int64, 0)
 			post.PublishDate = &t
 		}
 		posts = append(posts, post)
 	}
-	json.NewEncoder(w).Encode(posts)
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(posts)
 }
 
-func handleBlogPost(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func handleBlogPost(w http.ResponseWriter, r *http.Request) error {
 	slug := r.URL.Query().Get("slug")
 
 	var post BlogPost
-	db.QueryRow(`SELECT id, node_id, slug, excerpt, publish_date, category FROM blog_posts WHERE slug = ?`, slug).
-		Scan(&post.ID, &post.NodeID, &post.Slug, &post.Excerpt, &post.PublishDate, &post.Category)
+	var pubDate sql.NullInt64
+	err := db.QueryRow(`SELECT id, node_id, slug, excerpt, publish_date, category FROM blog_posts WHERE slug = ?`, slug).
+		Scan(&post.ID, &post.NodeID, &post.Slug, &post.Excerpt, &pubDate, &post.Category)
+	if err == sql.ErrNoRows {
+		return apierror.New(http.StatusNotFound, "blog post not found")
+	}
+	if err != nil {
+		return err
+	}
+	if pubDate.Valid {
+		t := time.Unix(pubDate.Int64, 0)
+		post.PublishDate = &t
+	}
 
-	json.NewEncoder(w).Encode(post)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(post)
 }
 
 // === API Handlers - Export ===
@@ -734,22 +1137,36 @@ func handleExport(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node_id")
 	format := r.URL.Query().Get("format")
 
-	if format == "zip" || format == "static" {
+	if format == "zip" || format == "static" || isContentTreeFormat(format) {
 		// Full site export
 		if siteID != "" {
 			w.Header().Set("Content-Type", "application/zip")
 
+			if !isContentTreeFormat(format) {
+				format = "zip"
+			}
+			// the zip only changes with the site, so a client holding it
+			// gets 304 before anything is built
+			etag, lastMod := siteExportETag(siteID, r.URL.RawQuery)
+			if notModified(w, r, etag, lastMod) {
+				return
+			}
 			opts := ExportOptions{
 				SiteID:        siteID,
 				IncludeAssets: true,
 				Theme:         "default",
-				Format:        "zip",
+				Format:        format,
+				BaseURL:       r.URL.Query().Get("base_url"),
+				// archived nodes only on request
+				IncludeArchived: r.URL.Query().Get("include_archived") == "true",
 			}
 
 			zipData, err := ExportSiteAsStatic(opts)
+			if err == nil {
+				zipData, err = signZip(zipData)
+			}
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				apierror.Internal(w, r, err)
 				return
 			}
 
@@ -779,21 +1196,341 @@ func handleExport(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.WriteHeader(http.StatusBadRequest)
-	json.NewEncoder(w).Encode(map[string]string{"error": "Missing site_id or node_id parameter"})
+	apierror.Write(w, http.StatusBadRequest, "Missing site_id or node_id parameter")
+}
+
+// handleNodeExport is GET /api/node/{id}/export?format=zip|html|json|rss|md,
+// the node as `veil export` writes it
+func handleNodeExport(w http.ResponseWriter, r *http.Request, nodeID string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	node, err := findNode(nodeID)
+	if err == sql.ErrNoRows || (err == nil && !canReadNode(r, node.ID)) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	data, err := exportNodeAs(node, format)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", nodeExportTypes[format])
+	w.Write(data)
 }
 
-func handleRSSFeed(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/rss+xml")
+// nodeExportTypes are the content types of the node export formats
+var nodeExportTypes = map[string]string{
+	"zip":  "application/zip",
+	"html": "text/html; charset=utf-8",
+	"json": "application/json",
+	"rss":  "application/rss+xml",
+	"md":   "text/markdown; charset=utf-8",
 }
 
 // === API Handlers - Publishing ===
+
+// scanChannel reads a publishing_channels row
+func scanChannel(scan func(dest ...interface{}) error) (PublishingChannel, error) {
+	var c PublishingChannel
+	var config sql.NullString
+	var active int
+	if err := scan(&c.ID, &c.Name, &c.Type, &config, &active, &c.CreatedAt); err != nil {
+		return c, err
+	}
+	c.Active = active == 1
+	c.Config = map[string]interface{}{}
+	if config.Valid && config.String != "" {
+		json.Unmarshal([]byte(config.String), &c.Config)
+	}
+	return c, nil
+}
+
+func getChannel(id string) (PublishingChannel, error) {
+	return scanChannel(db.QueryRow(`SELECT id, name, type, config, active, created_at FROM publishing_channels WHERE id = ?`, id).Scan)
+}
+
+// canManageChannel reports whether the request may create, change or delete
+// a channel whose config is config: admins may, and so may whoever manages
+// the site it publishes
+func canManageChannel(r *http.Request, config map[string]interface{}) bool {
+	if isAdminRequest(r) {
+		return true
+	}
+	siteID, _ := config["site_id"].(string)
+	return siteID != "" && canManageSite(r, siteID)
+}
+
+// redactedChannel is c fit to show: config values named like secrets, and
+// the passwords of URLs, are hidden
+func redactedChannel(c PublishingChannel) PublishingChannel {
+	config := map[string]interface{}{}
+	for k, v := range c.Config {
+		config[k] = redactedChannelValue(k, v)
+	}
+	c.Config = config
+	return c
+}
+
+func redactedChannelValue(key string, v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return v
+	}
+	for _, secret := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, secret) {
+			return redactedSecret(s)
+		}
+	}
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// handlePublishingChannels lists channels (GET, ?type= filters) and creates
+// them (POST {name, type, config, active}). Configs are validated against the
+// channel type's schema, see GET /api/publishing-channels/schema.
 func handlePublishingChannels(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		query := `SELECT id, name, type, config, active, created_at FROM publishing_channels`
+		var args []interface{}
+		if t := r.URL.Query().Get("type"); t != "" {
+			query += ` WHERE type = ?`
+			args = append(args, t)
+		}
+		rows, err := db.Query(query+` ORDER BY name`, args...)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		defer rows.Close()
+		channels := []PublishingChannel{}
+		for rows.Next() {
+			if c, err := scanChannel(rows.Scan); err == nil {
+				channels = append(channels, redactedChannel(c))
+			}
+		}
+		json.NewEncoder(w).Encode(channels)
+	case "POST":
+		var req struct {
+			Name   string                 `json:"name"`
+			Type   string                 `json:"type"`
+			Config map[string]interface{} `json:"config"`
+			Active *bool                  `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			apierror.Write(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if req.Config == nil {
+			req.Config = map[string]interface{}{}
+		}
+		if err := plugins.ValidateChannelConfig(req.Type, req.Config); err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !canManageChannel(r, req.Config) {
+			apierror.Write(w, http.StatusForbidden, "admin or site owner required to add a channel")
+			return
+		}
+		c := PublishingChannel{
+			ID:        ids.New("channel"),
+			Name:      req.Name,
+			Type:      req.Type,
+			Config:    req.Config,
+			Active:    req.Active == nil || *req.Active,
+			CreatedAt: time.Now().Unix(),
+		}
+		config, _ := json.Marshal(c.Config)
+		if _, err := db.Exec(`INSERT INTO publishing_channels (id, name, type, config, active, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			c.ID, c.Name, c.Type, string(config), boolToInt(c.Active), c.CreatedAt); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(redactedChannel(c))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePublishingChannelDetail serves /api/publishing-channels/{id}:
+// GET reads a channel, PUT changes any of name, config and active (the type
+// is fixed), DELETE removes it; changes need canManageChannel. Secrets in
+// the config are redacted, and a redacted value sent back keeps the stored
+// one. /api/publishing-channels/schema lists the config schema of each
+// channel type.
+func handlePublishingChannelDetail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.TrimPrefix(r.URL.Path, "/api/publishing-channels/")
+	if id == "schema" {
+		json.NewEncoder(w).Encode(plugins.ChannelSchemas())
+		return
+	}
+
+	c, err := getChannel(id)
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, "channel not found")
+		return
+	}
+
+	if r.Method != "GET" && !canManageChannel(r, c.Config) {
+		apierror.Write(w, http.StatusForbidden, "admin or site owner required to change this channel")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(redactedChannel(c))
+	case "PUT":
+		var req struct {
+			Name   *string                `json:"name"`
+			Config map[string]interface{} `json:"config"`
+			Active *bool                  `json:"active"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid payload")
+			return
+		}
+		if req.Name != nil {
+			if strings.TrimSpace(*req.Name) == "" {
+				apierror.Write(w, http.StatusBadRequest, "name is required")
+				return
+			}
+			c.Name = *req.Name
+		}
+		if req.Config != nil {
+			for k, v := range req.Config {
+				if s, ok := v.(string); ok && s != c.Config[k] && s == redactedChannelValue(k, c.Config[k]) {
+					req.Config[k] = c.Config[k]
+				}
+			}
+			if err := plugins.ValidateChannelConfig(c.Type, req.Config); err != nil {
+				apierror.Write(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !canManageChannel(r, req.Config) {
+				apierror.Write(w, http.StatusForbidden, "admin or site owner required to move a channel to that site")
+				return
+			}
+			c.Config = req.Config
+		}
+		if req.Active != nil {
+			c.Active = *req.Active
+		}
+		config, _ := json.Marshal(c.Config)
+		if _, err := db.Exec(`UPDATE publishing_channels SET name = ?, config = ?, active = ? WHERE id = ?`,
+			c.Name, string(config), boolToInt(c.Active), c.ID); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(redactedChannel(c))
+	case "DELETE":
+		var pending int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM publish_jobs WHERE channel_id = ? AND status IN ('queued', 'publishing')`, id).Scan(&pending); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if pending > 0 {
+			apierror.Write(w, http.StatusConflict, "channel has publish jobs in progress")
+			return
+		}
+		db.Exec(`DELETE FROM publishing_channels WHERE id = ?`, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// PublishJobEntry is a publish job as listed in the publish history
+type PublishJobEntry struct {
+	PublishJob
+	ChannelName string `json:"channel_name"`
+	ChannelType string `json:"channel_type"`
+	RetriedBy   string `json:"retried_by,omitempty"`
 }
 
+// GET /api/publish-history?node_id=&channel_id=&status=&limit=
+// lists publish jobs newest first. Failed jobs can be re-run with
+// POST /api/publish-job/{id}/retry.
 func handlePublishHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	where := []string{"1 = 1"}
+	var args []interface{}
+	for _, f := range []struct{ param, column string }{
+		{"node_id", "j.node_id"},
+		{"channel_id", "j.channel_id"},
+		{"status", "j.status"},
+	} {
+		if v := q.Get(f.param); v != "" {
+			where = append(where, f.column+" = ?")
+			args = append(args, v)
+		}
+	}
+	limit := 100
+	if l := q.Get("limit"); l != "" {
+		fmt.Sscanf(l, "%d", &limit)
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	rows, err := db.Query(`
+		SELECT j.id, j.node_id, COALESCE(j.version_id, ''), j.channel_id, j.status, COALESCE(j.progress, 0),
+		       COALESCE(j.result, ''), COALESCE(j.error, ''), j.created_at, j.completed_at, COALESCE(j.retry_of, ''),
+		       COALESCE(c.name, ''), COALESCE(c.type, ''),
+		       COALESCE((SELECT MAX(r.id) FROM publish_jobs r WHERE r.retry_of = j.id), '')
+		FROM publish_jobs j
+		LEFT JOIN publishing_channels c ON c.id = j.channel_id
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY j.created_at DESC, j.id DESC
+		LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+
+	jobs := []PublishJobEntry{}
+	for rows.Next() {
+		var j PublishJobEntry
+		var result string
+		var completed sql.NullInt64
+		if err := rows.Scan(&j.ID, &j.NodeID, &j.VersionID, &j.ChannelID, &j.Status, &j.Progress,
+			&result, &j.Error, &j.CreatedAt, &completed, &j.RetryOf,
+			&j.ChannelName, &j.ChannelType, &j.RetriedBy); err != nil {
+			continue
+		}
+		if result != "" && result != "null" {
+			var v interface{}
+			if json.Unmarshal([]byte(result), &v) == nil {
+				j.Result = v
+			}
+		}
+		if completed.Valid {
+			c := completed.Int64
+			j.CompletedAt = &c
+		}
+		jobs = append(jobs, j)
+	}
+	json.NewEncoder(w).Encode(jobs)
 }
 
 // === API Handlers - Permissions ===
@@ -803,49 +1540,62 @@ func handleVisibility(w http.ResponseWriter, r *http.Request) {
 	visibility := r.URL.Query().Get("visibility")
 
 	if r.Method == "PUT" {
+		if !canModifyNode(r, nodeID) {
+			apierror.Write(w, http.StatusForbidden, "only the node's owner can change its visibility")
+			return
+		}
 		db.Exec(`UPDATE node_visibility SET visibility = ? WHERE node_id = ?`, visibility, nodeID)
 	}
 
 	var vis string
-	db.QueryRow(`SELECT visibility FROM node_visibility WHERE node_id = ?`, nodeID).Scan(&vis)
+	if err := db.QueryRow(`SELECT visibility FROM node_visibility WHERE node_id = ?`, nodeID).Scan(&vis); err != nil && err != sql.ErrNoRows {
+		apierror.Internal(w, r, err)
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"visibility": vis})
 }
 
 // === API Handlers - Search ===
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	query := r.URL.Query().Get("q")
-
-	rows, _ := db.Query(`SELECT id, type, path, title, content FROM nodes 
-		WHERE deleted_at IS NULL AND (title LIKE ? OR content LIKE ?) ORDER BY path`,
-		"%"+query+"%", "%"+query+"%")
+// handleSearch is GET /api/search?q=...[&site_id=][&limit=N]
+func handleSearch(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	query := q.Get("q")
+
+	where := `deleted_at IS NULL AND (lower(title) LIKE lower(?) OR lower(content) LIKE lower(?))` + archivedClause(r, "")
+	args := []interface{}{"%" + query + "%", "%" + query + "%"}
+	if site := q.Get("site_id"); site != "" {
+		where += ` AND site_id = ?`
+		args = append(args, site)
+	}
+	order := ` ORDER BY path`
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return apierror.New(http.StatusBadRequest, "limit must be a positive number")
+		}
+		order += ` LIMIT ?`
+		args = append(args, n)
+	}
+	rows, err := db.Query(`SELECT id, type, path, title, content, COALESCE(site_id, '') FROM nodes 
+		WHERE `+where+order, args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var results []Node
+	results := []Node{}
 	for rows.Next() {
 		var node Node
-		rows.Scan(&node.ID, &node.Type, &node.Path, &node.Title, &node.Content)
+		if err := rows.Scan(&node.ID, &node.Type, &node.Path, &node.Title, &node.Content, &node.SiteID); err != nil {
+			return err
+		}
 		results = append(results, node)
 	}
-	json.NewEncoder(w).Encode(results)
-}
-
-// === API Handlers - Citations ===
-func handleCitations(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	nodeID := r.URL.Query().Get("node_id")
-
-	rows, _ := db.Query(`SELECT id, node_id, citation_key, authors, title, year, publisher, url, doi, citation_format, raw_bibtex
-		FROM citations WHERE node_id = ?`, nodeID)
-	defer rows.Close()
-
-	var citations []Citation
-	for rows.Next() {
-		var c Citation
-		rows.Scan(&c.ID, &c.NodeID, &c.CitationKey, &c.Authors, &c.Title, &c.Year, &c.Publisher, &c.URL, &c.DOI, &c.CitationFormat, &c.RawBibtex)
-		citations = append(citations, c)
+	if err := rows.Err(); err != nil {
+		return err
 	}
-	json.NewEncoder(w).Encode(citations)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
 }
 
 func handleNodeVersions(w http.ResponseWriter, r *http.Request, siteID, nodeID string) {
@@ -857,8 +1607,7 @@ func handleNodeVersions(w http.ResponseWriter, r *http.Request, siteID, nodeID s
 			FROM versions WHERE node_id = ? ORDER BY version_number DESC
 		`, nodeID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		defer rows.Close()
@@ -868,7 +1617,10 @@ func handleNodeVersions(w http.ResponseWriter, r *http.Request, siteID, nodeID s
 			var v Version
 			var created, modified int64
 			var published sql.NullInt64
-			rows.Scan(&v.ID, &v.NodeID, &v.VersionNumber, &v.Content, &v.Title, &v.Status, &published, &created, &modified, &v.IsCurrent)
+			if err := rows.Scan(&v.ID, &v.NodeID, &v.VersionNumber, &v.Content, &v.Title, &v.Status, &published, &created, &modified, &v.IsCurrent); err != nil {
+				apierror.Internal(w, r, err)
+				return
+			}
 			v.CreatedAt = time.Unix(created, 0)
 			v.ModifiedAt = time.Unix(modified, 0)
 			if published.Valid {
@@ -877,6 +1629,10 @@ func handleNodeVersions(w http.ResponseWriter, r *http.Request, siteID, nodeID s
 			}
 			versions = append(versions, v)
 		}
+		if err := rows.Err(); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
 		json.NewEncoder(w).Encode(versions)
 	}
 }
@@ -886,12 +1642,21 @@ func handleNodePublish(w http.ResponseWriter, r *http.Request, siteID, nodeID st
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method == "POST" {
-		var req map[string]interface{}
-		json.NewDecoder(r.Body).Decode(&req)
+		if !canModifyNode(r, nodeID) {
+			apierror.Write(w, http.StatusForbidden, "editor role required to publish")
+			return
+		}
+		var req struct {
+			Visibility string `json:"visibility" validate:"oneof=public|private|draft"`
+		}
+		if err := validate.DecodeOptionalJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
 
 		visibility := "public"
-		if v, ok := req["visibility"].(string); ok {
-			visibility = v
+		if req.Visibility != "" {
+			visibility = req.Visibility
 		}
 
 		now := time.Now().Unix()
@@ -904,8 +1669,7 @@ func handleNodePublish(w http.ResponseWriter, r *http.Request, siteID, nodeID st
 		`, visibility, now, nodeID, siteID)
 
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 
@@ -915,6 +1679,8 @@ func handleNodePublish(w http.ResponseWriter, r *http.Request, siteID, nodeID st
 			SET status = 'published', published_at = ?
 			WHERE node_id = ? AND is_current = 1
 		`, now, nodeID)
+		fillDescriptions(nodeID, false)
+		queueStaticRebuilds(siteID, nodeID)
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":     "published",
@@ -933,8 +1699,7 @@ func handleNodeTagsNested(w http.ResponseWriter, r *http.Request, siteID, nodeID
 
 		tagName := req["name"]
 		if tagName == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "tag name required"})
+			apierror.Write(w, http.StatusBadRequest, "tag name required")
 			return
 		}
 
@@ -942,19 +1707,18 @@ func handleNodeTagsNested(w http.ResponseWriter, r *http.Request, siteID, nodeID
 		var tagID string
 		err := db.QueryRow(`SELECT id FROM tags WHERE name = ?`, tagName).Scan(&tagID)
 		if err != nil {
-			tagID = fmt.Sprintf("tag_%d", time.Now().UnixNano())
+			tagID = ids.New("tag")
 			db.Exec(`INSERT INTO tags (id, name) VALUES (?, ?)`, tagID, tagName)
 		}
 
 		// Link tag to node
-		ntID := fmt.Sprintf("nt_%d", time.Now().UnixNano())
+		ntID := ids.New("nt")
 		_, err = db.Exec(`
-			INSERT OR IGNORE INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?)
+			INSERT INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING
 		`, ntID, nodeID, tagID)
 
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 
@@ -979,35 +1743,15 @@ func handleNodeMedia(w http.ResponseWriter, r *http.Request, siteID, nodeID stri
 // Handle node backlinks for a specific site/node
 func handleNodeBacklinks(w http.ResponseWriter, r *http.Request, siteID, nodeID string) {
 	w.Header().Set("Content-Type", "application/json")
-	rows, err := db.Query(`
-SELECT DISTINCT n.id, n.title, n.type, n.path
-FROM nodes n
-INNER JOIN node_references nr ON n.id = nr.source_node_id
-WHERE nr.target_node_id = ? AND n.deleted_at IS NULL
-`, nodeID)
-
+	found, err := readableBacklinks(r, []string{nodeID})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
-	defer rows.Close()
-
-	var backlinks []map[string]interface{}
-	for rows.Next() {
-		var id, title, nodeType, path string
-		rows.Scan(&id, &title, &nodeType, &path)
-		backlinks = append(backlinks, map[string]interface{}{
-			"id":    id,
-			"title": title,
-			"type":  nodeType,
-			"path":  path,
-		})
-	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"node_id":   nodeID,
-		"backlinks": backlinks,
+		"backlinks": found[nodeID],
 	})
 }
 
@@ -1022,8 +1766,7 @@ WHERE nr.source_node_id = ? AND n.deleted_at IS NULL
 `, nodeID)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	defer rows.Close()
@@ -1031,7 +1774,10 @@ WHERE nr.source_node_id = ? AND n.deleted_at IS NULL
 	var references []map[string]interface{}
 	for rows.Next() {
 		var id, title, nodeType, path, linkType, linkText string
-		rows.Scan(&id, &title, &nodeType, &path, &linkType, &linkText)
+		if err := rows.Scan(&id, &title, &nodeType, &path, &linkType, &linkText); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
 		references = append(references, map[string]interface{}{
 			"id":        id,
 			"title":     title,
@@ -1041,6 +1787,10 @@ WHERE nr.source_node_id = ? AND n.deleted_at IS NULL
 			"link_text": linkText,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"node_id":    nodeID,
@@ -1056,13 +1806,12 @@ func handleSiteNodes(w http.ResponseWriter, r *http.Request, siteID string) {
 SELECT id, type, COALESCE(parent_id, ''), path, title, content, 
        COALESCE(slug, ''), mime_type, created_at, modified_at
 FROM nodes 
-WHERE site_id = ? AND deleted_at IS NULL 
+WHERE site_id = ? AND deleted_at IS NULL`+archivedClause(r, "")+`
 ORDER BY created_at DESC
 `, siteID)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 	defer rows.Close()
@@ -1103,8 +1852,7 @@ SELECT content, title FROM versions WHERE id = ? AND node_id = ?
 `, versionID, nodeID).Scan(&content, &title)
 
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "version not found"})
+		apierror.Write(w, http.StatusNotFound, "version not found")
 		return
 	}
 
@@ -1117,23 +1865,29 @@ WHERE id = ? AND site_id = ?
 `, content, title, now, nodeID, siteID)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Internal(w, r, err)
 		return
 	}
 
 	// Create new version from rollback
 	var versionNumber int
-	db.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, nodeID).Scan(&versionNumber)
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, nodeID).Scan(&versionNumber); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
 	versionNumber++
 
-	newVersionID := fmt.Sprintf("v_%d", time.Now().UnixNano())
+	newVersionID := ids.New("v")
 	db.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ?`, nodeID)
 	db.Exec(`
 INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 `, newVersionID, nodeID, versionNumber, content, title, "draft", now, now, 1)
 
+	if err := syncNodeReferences(nodeID, siteID, content); err != nil {
+		log.Printf("references for node %s: %v", nodeID, err)
+	}
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":     "rolled_back",
 		"version_id": newVersionID,
@@ -1150,15 +1904,13 @@ func handleMediaUploadImpl(w http.ResponseWriter, r *http.Request) {
 	// Parse multipart form (max 50MB)
 	err := r.ParseMultipartForm(50 << 20)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to parse form"})
+		apierror.Write(w, http.StatusBadRequest, "Failed to parse form")
 		return
 	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "No file uploaded"})
+		apierror.Write(w, http.StatusBadRequest, "No file uploaded")
 		return
 	}
 	defer file.Close()
@@ -1171,27 +1923,25 @@ func handleMediaUploadImpl(w http.ResponseWriter, r *http.Request) {
 
 	// Generate unique filename
 	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%d%s", time.Now().UnixNano(), ext)
+	mediaID := ids.New("media")
+	filename := mediaID + ext
 	filePath := filepath.Join(mediaDir, filename)
 
 	// Save file
 	dst, err := os.Create(filePath)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save file"})
+		apierror.Write(w, http.StatusInternalServerError, "Failed to save file")
 		return
 	}
 	defer dst.Close()
 
 	_, err = io.Copy(dst, file)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save file"})
+		apierror.Write(w, http.StatusInternalServerError, "Failed to save file")
 		return
 	}
 
 	// Create media record
-	mediaID := fmt.Sprintf("media_%d", time.Now().UnixNano())
 	now := time.Now().Unix()
 
 	_, err = db.Exec(`
@@ -1200,8 +1950,7 @@ VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 `, mediaID, nodeID, filename, header.Filename, header.Header.Get("Content-Type"), header.Size, "/media/"+filename, now)
 
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save media record"})
+		apierror.Write(w, http.StatusInternalServerError, "Failed to save media record")
 		return
 	}
 
@@ -1220,8 +1969,7 @@ func handleSites(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		rows, err := db.Query(`SELECT id, name, description, type, created_at, modified_at FROM sites ORDER BY name`)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		defer rows.Close()
@@ -1230,26 +1978,40 @@ func handleSites(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var s Site
 			var created, modified int64
-			rows.Scan(&s.ID, &s.Name, &s.Description, &s.Type, &created, &modified)
+			if err := rows.Scan(&s.ID, &s.Name, &s.Description, &s.Type, &created, &modified); err != nil {
+				apierror.Internal(w, r, err)
+				return
+			}
 			s.CreatedAt = time.Unix(created, 0)
 			s.ModifiedAt = time.Unix(modified, 0)
 			sites = append(sites, s)
 		}
+		if err := rows.Err(); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
 		json.NewEncoder(w).Encode(sites)
 	} else if r.Method == "POST" {
 		var site Site
-		json.NewDecoder(r.Body).Decode(&site)
-		site.ID = fmt.Sprintf("site_%d", time.Now().UnixNano())
+		if err := validate.DecodeJSON(r.Body, &site); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		site.ID = ids.New("site")
 		now := time.Now().Unix()
 
 		_, err := db.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?)`,
 			site.ID, site.Name, site.Description, site.Type, now, now)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 
+		// the creator owns the site, which turns on its access control
+		if uid := currentUserID(r); uid != "" {
+			addSiteMember(site.ID, uid, RoleOwner)
+		}
+
 		site.CreatedAt = time.Unix(now, 0)
 		site.ModifiedAt = time.Unix(now, 0)
 		w.WriteHeader(http.StatusCreated)
@@ -1259,7 +2021,29 @@ func handleSites(w http.ResponseWriter, r *http.Request) {
 
 func handleSitesDetail(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	siteID := strings.TrimPrefix(r.URL.Path, "/api/sites/")
+	siteID, rest := splitSitePath(r.URL.Path)
+	switch rest {
+	case "members":
+		handleSiteMembers(w, r, siteID)
+		return
+	case "build-hooks":
+		handleBuildHooks(w, r, siteID)
+		return
+	case "build-hook":
+		handleBuildHookTrigger(w, r, siteID)
+		return
+	case "publish-hooks":
+		handlePublishHooks(w, r, siteID)
+		return
+	}
+	if parts := strings.Split(rest, "/"); len(parts) == 3 && parts[0] == "nodes" && parts[2] == "publish" {
+		handleNodePublish(w, r, siteID, parts[1])
+		return
+	}
+	if (r.Method == "PUT" || r.Method == "DELETE") && !canManageSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "only site owners can change a site")
+		return
+	}
 
 	if r.Method == "GET" {
 		var site Site
@@ -1275,22 +2059,28 @@ func handleSitesDetail(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(site)
 	} else if r.Method == "PUT" {
 		var site Site
-		json.NewDecoder(r.Body).Decode(&site)
+		if err := validate.DecodeJSON(r.Body, &site); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		site.ID = siteID
 		now := time.Now().Unix()
 
 		_, err := db.Exec(`UPDATE sites SET name = ?, description = ?, type = ?, modified_at = ? WHERE id = ?`,
 			site.Name, site.Description, site.Type, now, siteID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(site)
 	} else if r.Method == "DELETE" {
 		_, err := db.Exec(`DELETE FROM sites WHERE id = ?`, siteID)
+		if isForeignKey(err) {
+			apierror.Write(w, http.StatusConflict, "site still has nodes, members, assets or hooks")
+			return
+		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
@@ -1311,36 +2101,86 @@ func handlePreview(w http.ResponseWriter, r *http.Request) {
 
 	siteID := parts[0]
 	nodeID := parts[1]
+	var siteName string
+	db.QueryRow(`SELECT name FROM sites WHERE id = ?`, siteID).Scan(&siteName)
 
 	// Get node
 	var node Node
 	var created, modified int64
-	err := db.QueryRow(`SELECT id, type, path, title, content, mime_type, created_at, modified_at FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
-		Scan(&node.ID, &node.Type, &node.Path, &node.Title, &node.Content, &node.MimeType, &created, &modified)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Node not found"))
+	footer, desc := "", ""
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		at, err := parseAsOf(asOf)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		past, err := nodeAsOf(nodeID, at)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Node not found at that time"))
+			return
+		}
+		node = past.Node
+		w.Header().Set("Memento-Datetime", past.RecordedAt.UTC().Format(http.TimeFormat))
+		footer = fmt.Sprintf(" - As of %s (saved %s)", at.UTC().Format(time.RFC3339), past.RecordedAt.UTC().Format(time.RFC3339))
+		desc = excerpt(node.Content, metaDescriptionLen)
+	} else {
+		err := db.QueryRow(`SELECT id, type, path, title, content, mime_type, COALESCE(metadata, ''), created_at, modified_at FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+			Scan(&node.ID, &node.Type, &node.Path, &node.Title, &node.Content, &node.MimeType, &node.Metadata, &created, &modified)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Node not found"))
+			return
+		}
+		desc = metaDescription(node.ID, node.Content)
+	}
+
+	// /preview/site_id/node_id/og.png is the page's social image
+	if len(parts) > 2 && parts[2] == "og.png" {
+		data, err := socialImage(siteID, siteName, node.Title, nil)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
 		return
 	}
 
-	// Render as HTML
+	// Render as HTML, with the node's assets linked under the site's CSP
+	nodeFiles, err := nodeAssets(node.ID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	siteFiles, err := siteAssets(siteID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	styles, scripts := assetTags(nodeFiles, func(a NodeAsset) string { return a.URL })
 	html := fmt.Sprintf(`<!DOCTYPE html>
 <html>
 <head>
 <meta charset="utf-8">
 <title>%s</title>
-<style>
+%s
+%s%s<style>
 body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto; max-width: 800px; margin: 0 auto; padding: 20px; }
 h1 { border-bottom: 2px solid #333; }
 </style>
-</head>
+%s</head>
 <body>
 <h1>%s</h1>
 <div>%s</div>
-<p><small>Preview - Site: %s</small></p>
-</body>
-</html>`, node.Title, node.Title, node.Content, siteID)
+<p><small>Preview - Site: %s%s</small></p>
+%s</body>
+</html>`, node.Title, metaDescriptionTag(desc), iconLinkTags(siteFiles),
+		socialMetaTags(siteName, node.Title, desc, requestBaseURL(r)+r.URL.Path, requestBaseURL(r)+"/preview/"+siteID+"/"+nodeID+"/og.png"), styles, node.Title, renderedBody(node)+nodeBibliography(node), siteID, footer, scripts)
 
+	w.Header().Set("Content-Security-Policy", pageCSP(siteID))
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
 }
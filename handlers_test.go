@@ -4,20 +4,29 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+
+	fsstorage "veil/pkg/codex/storage/fs"
+	plugins "veil/pkg/plugins"
 )
 
 func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	t.Helper()
 	// Use in-memory SQLite for tests
-	testDB, err := sql.Open("sqlite", ":memory:")
+	testDB, err := openDB(":memory:")
 	if err != nil {
 		t.Fatalf("failed to open in-memory db: %v", err)
 	}
 	db = testDB
+	// the URI resolver and the plugins package hold their own handles; rebind
+	// them to this test's database
+	initURIResolver()
+	plugins.SetDB(testDB)
 	if err := applyMigrations(db); err != nil {
 		t.Fatalf("applyMigrations failed: %v", err)
 	}
@@ -96,12 +105,12 @@ func TestPluginsRegistryCRUD(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Fatalf("expected 200 on get, got %d", rr.Code)
 	}
-	var plugins []PluginManifest
-	if err := json.NewDecoder(rr.Body).Decode(&plugins); err != nil {
+	var list []plugins.PluginManifest
+	if err := json.NewDecoder(rr.Body).Decode(&list); err != nil {
 		t.Fatalf("failed to decode plugins list: %v", err)
 	}
 	found := false
-	for _, p := range plugins {
+	for _, p := range list {
 		if p.Slug == "dummy" {
 			found = true
 			break
@@ -112,7 +121,7 @@ func TestPluginsRegistryCRUD(t *testing.T) {
 	}
 
 	// Enable the plugin via PUT
-	updated := plugins[0]
+	updated := list[0]
 	updated.Enabled = true
 	b, _ = json.Marshal(updated)
 	req = httptest.NewRequest("PUT", "/api/plugins-registry", bytes.NewReader(b))
@@ -132,9 +141,259 @@ func TestPluginsRegistryCRUD(t *testing.T) {
 	if enabled != 1 {
 		t.Fatalf("expected enabled=1, got %d", enabled)
 	}
+
+	// the registry and the running plugins agree: adding an enabled plugin
+	// starts it and deleting it stops it
+	running := func() map[string]bool {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/plugins", nil))
+		var resp struct {
+			Plugins []string `json:"plugins"`
+		}
+		json.NewDecoder(rr.Body).Decode(&resp)
+		out := map[string]bool{}
+		for _, name := range resp.Plugins {
+			out[name] = true
+		}
+		return out
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/plugins-registry", strings.NewReader(`{"name": "Code", "slug": "code", "enabled": true}`)))
+	var added plugins.PluginManifest
+	json.NewDecoder(rr.Body).Decode(&added)
+	if rr.Code != http.StatusOK || !added.Running || !running()["code"] {
+		t.Fatalf("an enabled plugin should start when added: %d %+v", rr.Code, added)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/plugins-registry", strings.NewReader(`{"name": "Code", "slug": "code"}`)))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a duplicate slug, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/plugins-registry?id=code", nil))
+	if rr.Code != http.StatusOK || running()["code"] {
+		t.Fatalf("a deleted plugin should stop running: %d", rr.Code)
+	}
 }
 
 // Ensure tests run against GOPATH when formatting or linters run
 func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
+
+func TestNodeHistoryIncludesCodexCommits(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "node-history-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	mux := setupRoutes()
+
+	// Create node
+	b, _ := json.Marshal(map[string]string{"type": "note", "path": "a.md", "title": "A", "content": "one"})
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/node-create", bytes.NewReader(b)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var node Node
+	json.NewDecoder(rr.Body).Decode(&node)
+
+	// Update node
+	b, _ = json.Marshal(map[string]string{"id": node.ID, "type": "note", "path": "a.md", "title": "A", "content": "two"})
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/node-update", bytes.NewReader(b)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on update, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// History
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/node/"+node.ID+"/history", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 on history, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var res struct {
+		URN      string            `json:"urn"`
+		Versions []Version         `json:"versions"`
+		Codex    []NodeCodexCommit `json:"codex"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode history: %v", err)
+	}
+	if res.URN != "urn:veil:node:"+node.ID {
+		t.Fatalf("unexpected urn: %s", res.URN)
+	}
+	if len(res.Versions) != 2 || len(res.Codex) != 2 {
+		t.Fatalf("expected 2 versions and 2 codex commits, got %d and %d", len(res.Versions), len(res.Codex))
+	}
+
+	// The update commit should chain onto the create commit
+	latest, err := fsstorage.New(".").GetCommit(res.Codex[0].CommitHash)
+	if err != nil {
+		t.Fatalf("latest codex commit missing: %v", err)
+	}
+	if len(latest.Parents) != 1 || latest.Parents[0] != res.Codex[1].CommitHash {
+		t.Fatalf("expected update commit parent %s, got %v", res.Codex[1].CommitHash, latest.Parents)
+	}
+}
+
+func TestRequestBodiesAreValidated(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	do := func(method, path, body string) (int, map[string]string) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var out struct {
+			Fields map[string]string `json:"fields"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return rr.Code, out.Fields
+	}
+
+	cases := []struct {
+		method, path, body string
+		fields             []string
+	}{
+		{"POST", "/api/node-create", `{}`, []string{"type", "path"}},
+		{"POST", "/api/node-create", `{"type":"note","path":"a.md","visibility":"everyone"}`, []string{"visibility"}},
+		{"POST", "/api/node-create", `{"type":"note","path":7}`, []string{"path"}},
+		{"PUT", "/api/node-update", `{"type":"note","path":"a.md"}`, []string{"id"}},
+		{"POST", "/api/sites", `{"description":"no name"}`, []string{"name"}},
+		{"POST", "/api/node-uris", `{"node_id":"n1"}`, []string{"uri"}},
+		{"POST", "/api/plugin-execute", `{"plugin":"todo"}`, []string{"action"}},
+		{"POST", "/api/publish-job", `{"node_id":"n1"}`, []string{"channel_id"}},
+	}
+	for _, c := range cases {
+		code, fields := do(c.method, c.path, c.body)
+		if code != http.StatusBadRequest {
+			t.Errorf("%s %s %s: expected 400, got %d", c.method, c.path, c.body, code)
+			continue
+		}
+		for _, f := range c.fields {
+			if fields[f] == "" {
+				t.Errorf("%s %s %s: no error for %s in %v", c.method, c.path, c.body, f, fields)
+			}
+		}
+	}
+	if code, _ := do("POST", "/api/node-create", ""); code != http.StatusBadRequest {
+		t.Errorf("empty node body: expected 400, got %d", code)
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	do := func(path string) (int, string, string) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var out struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return rr.Code, out.Error.Code, out.Error.Message
+	}
+
+	if code, errCode, _ := do("/api/no-such-thing"); code != http.StatusNotFound || errCode != "not_found" {
+		t.Fatalf("unknown endpoint: %d %q", code, errCode)
+	}
+	if code, errCode, _ := do("/api/rollback?version_id=missing"); code != http.StatusNotFound || errCode != "not_found" {
+		t.Fatalf("missing version: %d %q", code, errCode)
+	}
+	if code, errCode, _ := do("/api/blog-post?slug=missing"); code != http.StatusNotFound || errCode != "not_found" {
+		t.Fatalf("missing blog post: %d %q", code, errCode)
+	}
+
+	// a broken database is a 500, not an empty list, and doesn't say why
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/tags", nil))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Fatalf("no tags should be an empty list: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := testDB.Exec(`DROP TABLE node_tags`); err != nil {
+		t.Fatal(err)
+	}
+	if code, errCode, msg := do("/api/node-tags?node_id=n1"); code != http.StatusInternalServerError || errCode != "internal_server_error" || msg != "internal error" {
+		t.Fatalf("database failure: %d %q %q", code, errCode, msg)
+	}
+}
+
+func TestNodeListPaging(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	get := func(path string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		var nodes []map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &nodes)
+		return rr, nodes
+	}
+	listed := func(nodes []map[string]interface{}) string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n["id"].(string))
+		}
+		return strings.Join(out, ",")
+	}
+
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'One', 'blog', 1, 1), ('s2', 'Two', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, created_at, modified_at) VALUES
+		('a', 'note', 's1', 'a.md', 'Zed', 'long content', 1, 1700000000),
+		('b', 'post', 's1', 'b.md', 'Alpha', '', 2, 1710000000),
+		('c', 'post', 's2', 'c.md', 'Mid', '', 3, 1720000000),
+		('d', 'page', 's1', 'd.md', 'Gone', '', 4, 1730000000)`)
+	testDB.Exec(`UPDATE nodes SET deleted_at = 5 WHERE id = 'd'`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'go')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1'), ('nt2', 'c', 't1')`)
+
+	rr, nodes := get("/api/nodes")
+	if listed(nodes) != "a,b,c" || rr.Header().Get("X-Total-Count") != "3" || rr.Header().Get("Link") != "" {
+		t.Fatalf("without paging every node should be listed: %s %v", listed(nodes), rr.Header())
+	}
+	rr, nodes = get("/api/nodes?limit=1&offset=1")
+	if listed(nodes) != "b" || rr.Header().Get("X-Total-Count") != "3" ||
+		rr.Header().Get("Link") != `</api/nodes?limit=1&offset=2>; rel="next", </api/nodes?limit=1&offset=0>; rel="prev"` {
+		t.Fatalf("unexpected page: %s %v", listed(nodes), rr.Header())
+	}
+	for path, want := range map[string]string{
+		"/api/nodes?type=post":                         "b,c",
+		"/api/nodes?type=note,post&site_id=s1":         "a,b",
+		"/api/nodes?tag=go":                            "a,c",
+		"/api/nodes?modified_since=2024-01-01":         "b,c",
+		"/api/nodes?sort=-modified_at":                 "c,b,a",
+		"/api/nodes?sort=title":                        "b,c,a",
+		"/api/nodes?offset=1":                          "b,c",
+		"/api/nodes?tag=go&sort=-created_at&limit=1":   "c",
+		"/api/nodes?modified_since=1710000000&type=xx": "",
+	} {
+		if _, nodes := get(path); listed(nodes) != want {
+			t.Fatalf("%s: expected %q, got %q", path, want, listed(nodes))
+		}
+	}
+
+	_, nodes = get("/api/nodes?fields=id,title&type=note")
+	if len(nodes) != 1 || len(nodes[0]) != 2 || nodes[0]["title"] != "Zed" {
+		t.Fatalf("fields should trim each node: %v", nodes)
+	}
+	for _, path := range []string{"/api/nodes?limit=0", "/api/nodes?limit=5000", "/api/nodes?offset=-1", "/api/nodes?sort=content", "/api/nodes?fields=id,password", "/api/nodes?modified_since=soon"} {
+		if rr, _ := get(path); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", path, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"veil/pkg/ids"
+	"veil/pkg/store"
+)
+
+// === ID Migration ===
+// Rows used to be keyed by a prefix and the creation time in nanoseconds
+// ("tag_1712345678901234567"), which collided when two rows were made at
+// once. veil ids migrate rewrites those ids to the ULIDs pkg/ids makes now,
+// dated from the old timestamp so rows keep their order, and updates every
+// column that refers to them: declared foreign keys plus the few references
+// the schema never declared. Nodes, sites and media keep their ids because
+// those appear outside the database, in codex history, URNs, links, published
+// URLs and media file names. Credential keys keep theirs because the id is
+// bound into the sealed check value. Ids inside JSON payloads are left as
+// they are.
+
+var legacyID = regexp.MustCompile(`^([a-z][a-z_]*?)_(\d{16,20})(_\d+)?$`)
+
+// idMigrationSkip lists tables whose ids are never rewritten
+var idMigrationSkip = map[string]bool{"nodes": true, "sites": true, "media": true, "credential_keys": true}
+
+// idReference is a column holding ids of another table's rows
+type idReference struct {
+	table, column, target string
+}
+
+// undeclaredIDReferences are references without a FOREIGN KEY clause
+var undeclaredIDReferences = []idReference{
+	{"publish_jobs", "version_id", "versions"},
+	{"publish_jobs", "channel_id", "publishing_channels"},
+	{"publish_jobs", "retry_of", "publish_jobs"},
+	{"publish_history", "version_id", "versions"},
+	{"publish_history", "channel_id", "publishing_channels"},
+	{"deployed_files", "channel_id", "publishing_channels"},
+	{"import_sessions", "owner_id", "users"},
+	{"media", "uploaded_by", "users"},
+	{"codex_merges", "created_by", "users"},
+	{"site_snapshots", "created_by", "users"},
+	{"site_snapshot_nodes", "snapshot_id", "site_snapshots"},
+	{"site_snapshot_nodes", "version_id", "versions"},
+}
+
+// IDMigrationReport counts what a migration rewrote, per table and per
+// referring column ("table.column")
+type IDMigrationReport struct {
+	DryRun     bool           `json:"dry_run"`
+	Tables     map[string]int `json:"tables"`
+	References map[string]int `json:"references"`
+}
+
+// migrateIDs rewrites legacy ids in the open vault in one transaction,
+// rolling it back when dryRun is set
+func migrateIDs(dryRun bool) (*IDMigrationReport, error) {
+	tables, err := idTables()
+	if err != nil {
+		return nil, err
+	}
+	refs, err := idReferences(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// references are rewritten before the ids they point at, so the
+	// foreign keys only need to hold again at commit
+	if err := store.For(db).DeferForeignKeys(tx); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`CREATE TEMP TABLE id_map (tbl TEXT NOT NULL, old TEXT NOT NULL, new TEXT NOT NULL, PRIMARY KEY (tbl, old))`); err != nil {
+		return nil, err
+	}
+
+	report := &IDMigrationReport{DryRun: dryRun, Tables: map[string]int{}, References: map[string]int{}}
+	for _, table := range tables {
+		rows, err := tx.Query(`SELECT id FROM "` + table + `" ORDER BY id`)
+		if err != nil {
+			return nil, err
+		}
+		var legacy []string
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			if legacyID.MatchString(id) {
+				legacy = append(legacy, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		for _, old := range legacy {
+			m := legacyID.FindStringSubmatch(old)
+			nanos, _ := strconv.ParseInt(m[2], 10, 64)
+			if _, err := tx.Exec(`INSERT INTO id_map (tbl, old, new) VALUES (?, ?, ?)`, table, old, ids.At(m[1], time.Unix(0, nanos))); err != nil {
+				return nil, err
+			}
+		}
+		if len(legacy) > 0 {
+			report.Tables[table] = len(legacy)
+		}
+	}
+
+	for _, ref := range refs {
+		res, err := tx.Exec(fmt.Sprintf(`UPDATE "%[1]s" SET "%[2]s" = (SELECT new FROM id_map WHERE tbl = ? AND old = "%[1]s"."%[2]s")
+			WHERE "%[2]s" IN (SELECT old FROM id_map WHERE tbl = ?)`, ref.table, ref.column), ref.target, ref.target)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", ref.table, ref.column, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			report.References[ref.table+"."+ref.column] += int(n)
+		}
+	}
+	for table := range report.Tables {
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE "%[1]s" SET id = (SELECT new FROM id_map WHERE tbl = ? AND old = "%[1]s".id)
+			WHERE id IN (SELECT old FROM id_map WHERE tbl = ?)`, table), table, table); err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+	}
+	// temp tables outlive the transaction on its connection
+	if _, err := tx.Exec(`DROP TABLE id_map`); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
+
+// idTables lists the tables keyed by a single TEXT id column
+func idTables() ([]string, error) {
+	dialect := store.For(db)
+	names, err := dialect.Tables(db)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, name := range names {
+		if idMigrationSkip[name] {
+			continue
+		}
+		cols, err := dialect.Columns(db, name)
+		if err != nil {
+			return nil, err
+		}
+		var pk []store.Column
+		for _, c := range cols {
+			if c.PK {
+				pk = append(pk, c)
+			}
+		}
+		if len(pk) == 1 && pk[0].Name == "id" && pk[0].Type == "TEXT" {
+			tables = append(tables, name)
+		}
+	}
+	return tables, nil
+}
+
+// idReferences lists the columns referring to ids of the given tables
+func idReferences(tables []string) ([]idReference, error) {
+	dialect := store.For(db)
+	migrated := map[string]bool{}
+	for _, t := range tables {
+		migrated[t] = true
+	}
+	keys, err := dialect.ForeignKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	var refs []idReference
+	for _, k := range keys {
+		if k.RefCol == "id" && migrated[k.RefTable] {
+			refs = append(refs, idReference{table: k.Table, column: k.Column, target: k.RefTable})
+		}
+	}
+	for _, ref := range undeclaredIDReferences {
+		cols, err := dialect.Columns(db, ref.table)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cols {
+			if c.Name == ref.column && migrated[ref.target] {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs, nil
+}
+
+func idsCommand() {
+	// Usage: veil ids migrate [--dry-run] [--json] [--vault NAME|PATH]
+	usage := "Usage: veil ids migrate [--dry-run] [--json] [--vault NAME|PATH]"
+	if len(os.Args) < 3 || os.Args[2] != "migrate" {
+		fmt.Println(usage)
+		return
+	}
+	vault := "."
+	dryRun, asJSON := false, false
+	args := os.Args[3:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--dry-run":
+			dryRun = true
+		case "--json":
+			asJSON = true
+		case "--vault":
+			if i+1 < len(args) {
+				i++
+				vault = args[i]
+				if v, ok := lookupVault(vault); ok {
+					vault = v.Path
+				}
+			}
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+
+	report, err := migrateIDs(dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	if len(report.Tables) == 0 {
+		fmt.Println("No legacy ids found")
+		return
+	}
+	total := 0
+	for _, table := range sortedCounts(report.Tables) {
+		fmt.Printf("  %-24s %d id(s)\n", table, report.Tables[table])
+		total += report.Tables[table]
+	}
+	for _, ref := range sortedCounts(report.References) {
+		fmt.Printf("  %-24s %d reference(s)\n", ref, report.References[ref])
+	}
+	if dryRun {
+		fmt.Printf("%d id(s) would be rewritten; run without --dry-run to apply\n", total)
+	} else {
+		fmt.Printf("Rewrote %d id(s)\n", total)
+	}
+}
+
+func sortedCounts(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateIDs(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, q := range []string{
+		`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES ('node_1712345678000000001', 'note', 'a.md', 'A', '', 1, 1)`,
+		`INSERT INTO tags (id, name) VALUES ('tag_1712345678000000002', 'early'), ('tag_1712345679000000000', 'late'), ('tag_01J0NEWSTYLE', 'new')`,
+		`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt_1712345678000000003', 'node_1712345678000000001', 'tag_1712345678000000002')`,
+		`INSERT INTO versions (id, node_id, version_number, created_at, modified_at) VALUES ('v_1712345678000000004', 'node_1712345678000000001', 1, 1, 1)`,
+		`INSERT INTO publishing_channels (id, name, type, created_at) VALUES ('channel_1712345678000000005', 'web', 'static', 1)`,
+		`INSERT INTO publish_jobs (id, node_id, version_id, channel_id, status, created_at) VALUES
+			('job_1712345678000000006', 'node_1712345678000000001', 'v_1712345678000000004', 'channel_1712345678000000005', 'done', 1)`,
+		`INSERT INTO node_references (id, source_node_id, target_node_id, link_type, created_at) VALUES
+			('ref_1712345678000000007_0', 'node_1712345678000000001', 'node_1712345678000000001', 'wiki', 1)`,
+	} {
+		if _, err := testDB.Exec(q); err != nil {
+			t.Fatalf("%v: %s", err, q)
+		}
+	}
+
+	report, err := migrateIDs(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tables["tags"] != 2 || report.References["node_tags.tag_id"] != 1 || report.References["publish_jobs.version_id"] != 1 {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+	var n int
+	testDB.QueryRow(`SELECT COUNT(*) FROM tags WHERE id = 'tag_1712345678000000002'`).Scan(&n)
+	if n != 1 {
+		t.Fatal("a dry run should change nothing")
+	}
+
+	if _, err := migrateIDs(false); err != nil {
+		t.Fatal(err)
+	}
+	var early, late, tagRef, versionID, versionRef, channelRef, refID string
+	testDB.QueryRow(`SELECT id FROM tags WHERE name = 'early'`).Scan(&early)
+	testDB.QueryRow(`SELECT id FROM tags WHERE name = 'late'`).Scan(&late)
+	testDB.QueryRow(`SELECT tag_id FROM node_tags`).Scan(&tagRef)
+	testDB.QueryRow(`SELECT id FROM versions`).Scan(&versionID)
+	testDB.QueryRow(`SELECT version_id, channel_id FROM publish_jobs`).Scan(&versionRef, &channelRef)
+	testDB.QueryRow(`SELECT id FROM node_references`).Scan(&refID)
+	if !strings.HasPrefix(early, "tag_") || len(early) != len("tag_")+26 || early >= late {
+		t.Fatalf("tags should get ULIDs in creation order: %s, %s", early, late)
+	}
+	if tagRef != early || versionRef != versionID || !strings.HasPrefix(channelRef, "channel_") || len(channelRef) != len("channel_")+26 {
+		t.Fatalf("references should follow the new ids: %s %s %s", tagRef, versionRef, channelRef)
+	}
+	if legacyID.MatchString(refID) {
+		t.Fatalf("suffixed ids should be migrated too: %s", refID)
+	}
+	testDB.QueryRow(`SELECT COUNT(*) FROM nodes WHERE id = 'node_1712345678000000001'`).Scan(&n)
+	if n != 1 {
+		t.Fatal("node ids should be kept")
+	}
+	testDB.QueryRow(`SELECT COUNT(*) FROM tags WHERE id = 'tag_01J0NEWSTYLE'`).Scan(&n)
+	if n != 1 {
+		t.Fatal("new style ids should be left alone")
+	}
+	if report, _ := migrateIDs(false); len(report.Tables) != 0 {
+		t.Fatalf("a second run should find nothing: %+v", report)
+	}
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Import Wizard ===
+// Imports run in two steps so a large import is never one irreversible shot.
+// Analyze parses an upload into items with proposed titles, slugs, paths,
+// sites and tags, flags collisions with existing nodes and saves the result
+// as an import session. Commit applies the mapping, with any edits the user
+// made, in one transaction. Sessions left uncommitted expire after a week.
+
+// importSessionTTL is how long an analyzed import waits for its commit
+const importSessionTTL = 7 * 24 * time.Hour
+
+// ImportSite is a site an import creates
+type ImportSite struct {
+	Name        string `json:"name" validate:"max=256"`
+	Description string `json:"description,omitempty" validate:"max=4096"`
+	Type        string `json:"type,omitempty" validate:"max=64"`
+}
+
+// newImportSite is the site_id of items going into the site the import creates
+const newImportSite = "new"
+
+// ImportCollision is an existing node, or an earlier item, an item clashed
+// with before its slug or path was changed
+type ImportCollision struct {
+	Field  string `json:"field"` // path, slug or duplicate
+	Value  string `json:"value"`
+	NodeID string `json:"node_id,omitempty"`
+}
+
+// ImportItem is one node an import would create
+type ImportItem struct {
+	Key        string           `json:"key"`
+	Source     string           `json:"source"`
+	Title      string           `json:"title"`
+	Slug       string           `json:"slug"`
+	Path       string           `json:"path"`
+	Type       string           `json:"type"`
+	SiteID     string           `json:"site_id,omitempty"`
+	Tags       []string         `json:"tags"`
+	Status     string           `json:"status"`
+	Action     string           `json:"action"` // create, replace or skip
+	Collision  *ImportCollision `json:"collision,omitempty"`
+	CreatedAt  int64            `json:"created_at,omitempty"`
+	ModifiedAt int64            `json:"modified_at,omitempty"`
+	Size       int              `json:"size"`
+	Excerpt    string           `json:"excerpt,omitempty"`
+	Content    string           `json:"content,omitempty"`
+}
+
+// ImportSession is an analyzed import and, once committed, its outcome
+type ImportSession struct {
+	ID          string         `json:"id"`
+	Format      string         `json:"format"`
+	Source      string         `json:"source"`
+	Status      string         `json:"status"` // analyzed, committed or discarded
+	SiteID      string         `json:"site_id,omitempty"`
+	NewSite     *ImportSite    `json:"new_site,omitempty"`
+	Items       []ImportItem   `json:"items"`
+	Tags        map[string]int `json:"tags"`
+	Collisions  int            `json:"collisions"`
+	Result      *ImportResult  `json:"result,omitempty"`
+	OwnerID     string         `json:"-"`
+	CreatedAt   int64          `json:"created_at"`
+	CommittedAt *int64         `json:"committed_at,omitempty"`
+}
+
+// ImportResult is what a commit did
+type ImportResult struct {
+	SiteID   string            `json:"site_id,omitempty"`
+	Created  int               `json:"created"`
+	Replaced int               `json:"replaced"`
+	Skipped  int               `json:"skipped"`
+	Nodes    map[string]string `json:"nodes"` // item key to node id
+}
+
+// ImportEdit changes one item before commit; unset fields keep the proposal
+type ImportEdit struct {
+	Key    string    `json:"key"`
+	Action *string   `json:"action"`
+	Title  *string   `json:"title"`
+	Slug   *string   `json:"slug"`
+	Path   *string   `json:"path"`
+	Type   *string   `json:"type"`
+	SiteID *string   `json:"site_id"`
+	Tags   *[]string `json:"tags"`
+	Status *string   `json:"status"`
+}
+
+// ImportCommit is the body of a commit
+type ImportCommit struct {
+	NewSite *ImportSite  `json:"new_site"`
+	Items   []ImportEdit `json:"items"`
+}
+
+// analyzeImport parses data and proposes where each item goes. siteID is
+// the site to import into, or "" to use the site the source proposes.
+func analyzeImport(format, name string, data []byte, siteID string) (*ImportSession, error) {
+	if format == "" {
+		format = detectImportFormat(name, data)
+	}
+	parse, ok := importers[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q (markdown, wordpress, notion or enex)", format)
+	}
+	parsed, err := parse(name, data)
+	if err != nil {
+		return nil, err
+	}
+	s := &ImportSession{Format: format, Source: name, Status: "analyzed", SiteID: siteID, Items: parsed.Items}
+	if siteID == "" && parsed.Site != nil {
+		s.NewSite = parsed.Site
+	}
+	for i := range s.Items {
+		it := &s.Items[i]
+		it.Key = strconv.Itoa(i + 1)
+		it.Action = "create"
+		if it.Type == "" {
+			it.Type = "note"
+		}
+		// slugs name exported files, so only slugify's characters are kept
+		it.Slug = slugify(it.Slug)
+		if it.Slug == "" {
+			it.Slug = slugify(it.Title)
+		}
+		if it.Slug == "" {
+			it.Slug = "untitled"
+		}
+		if it.Path == "" {
+			it.Path = it.Slug + ".md"
+			if it.Type == "post" {
+				it.Path = "posts/" + it.Slug + ".md"
+			}
+		}
+		it.SiteID = siteID
+		if s.NewSite != nil {
+			it.SiteID = newImportSite
+		}
+	}
+	proposeUnique(s.Items)
+	s.summarize()
+	return s, nil
+}
+
+// proposeUnique renames items whose path or slug is taken, by existing nodes
+// or by earlier items, recording the clash
+func proposeUnique(items []ImportItem) {
+	paths := map[string]bool{}
+	slugs := map[string]bool{} // site + "/" + slug
+	for i := range items {
+		it := &items[i]
+		if it.Action == "skip" || it.Action == "replace" {
+			continue
+		}
+		if id := nodeAtPath(it.Path); id != "" || paths[it.Path] {
+			it.Collision = &ImportCollision{Field: "path", Value: it.Path, NodeID: id}
+			if id == "" {
+				it.Collision.Field = "duplicate"
+			}
+			ext := path.Ext(it.Path)
+			for n := 2; nodeAtPath(it.Path) != "" || paths[it.Path]; n++ {
+				it.Path = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(it.Collision.Value, ext), n, ext)
+			}
+		}
+		paths[it.Path] = true
+		if id := nodeWithSlug(it.SiteID, it.Slug, it.Type); id != "" || slugs[it.SiteID+"/"+it.Slug] {
+			if it.Collision == nil {
+				it.Collision = &ImportCollision{Field: "slug", Value: it.Slug, NodeID: id}
+				if id == "" {
+					it.Collision.Field = "duplicate"
+				}
+			}
+			base := it.Slug
+			for n := 2; nodeWithSlug(it.SiteID, it.Slug, it.Type) != "" || slugs[it.SiteID+"/"+it.Slug]; n++ {
+				it.Slug = fmt.Sprintf("%s-%d", base, n)
+			}
+		}
+		slugs[it.SiteID+"/"+it.Slug] = true
+	}
+}
+
+// nodeAtPath returns the live node at p
+func nodeAtPath(p string) string {
+	var id string
+	db.QueryRow(`SELECT id FROM nodes WHERE path = ? AND deleted_at IS NULL`, p).Scan(&id)
+	return id
+}
+
+// nodeWithSlug returns the live node using slug in siteID; post slugs are
+// unique across the vault
+func nodeWithSlug(siteID, slug, typ string) string {
+	var id string
+	if siteID != newImportSite {
+		db.QueryRow(`SELECT id FROM nodes WHERE slug = ? AND COALESCE(site_id, '') = ? AND deleted_at IS NULL`, slug, siteID).Scan(&id)
+	}
+	if id == "" && typ == "post" {
+		db.QueryRow(`SELECT node_id FROM blog_posts WHERE slug = ?`, slug).Scan(&id)
+	}
+	return id
+}
+
+// summarize counts tags and collisions and fills in sizes and excerpts
+func (s *ImportSession) summarize() {
+	s.Tags = map[string]int{}
+	s.Collisions = 0
+	for i := range s.Items {
+		it := &s.Items[i]
+		it.Size = len(it.Content)
+		it.Excerpt = excerpt(it.Content, 200)
+		if it.Tags == nil {
+			it.Tags = []string{}
+		}
+		for _, t := range it.Tags {
+			s.Tags[t]++
+		}
+		if it.Collision != nil {
+			s.Collisions++
+		}
+	}
+}
+
+// view is the session as the API shows it, without item content
+func (s *ImportSession) view() *ImportSession {
+	v := *s
+	v.Items = make([]ImportItem, len(s.Items))
+	for i, it := range s.Items {
+		it.Content = ""
+		v.Items[i] = it
+	}
+	return &v
+}
+
+func saveImportSession(s *ImportSession) error {
+	items, err := json.Marshal(s.Items)
+	if err != nil {
+		return err
+	}
+	var newSite, result interface{}
+	if s.NewSite != nil {
+		b, _ := json.Marshal(s.NewSite)
+		newSite = string(b)
+	}
+	if s.Result != nil {
+		b, _ := json.Marshal(s.Result)
+		result = string(b)
+	}
+	_, err = db.Exec(`INSERT INTO import_sessions (id, format, source, status, site_id, new_site, items, result, owner_id, created_at, committed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET status = excluded.status, new_site = excluded.new_site, items = excluded.items,
+		result = excluded.result, committed_at = excluded.committed_at`,
+		s.ID, s.Format, s.Source, s.Status, s.SiteID, newSite, string(items), result, s.OwnerID, s.CreatedAt, s.CommittedAt)
+	return err
+}
+
+func loadImportSession(id string) (*ImportSession, error) {
+	s := &ImportSession{}
+	var items string
+	var newSite, result sql.NullString
+	var committed sql.NullInt64
+	err := db.QueryRow(`SELECT id, format, COALESCE(source, ''), status, COALESCE(site_id, ''), new_site, items, result,
+		COALESCE(owner_id, ''), created_at, committed_at FROM import_sessions WHERE id = ?`, id).
+		Scan(&s.ID, &s.Format, &s.Source, &s.Status, &s.SiteID, &newSite, &items, &result, &s.OwnerID, &s.CreatedAt, &committed)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(items), &s.Items); err != nil {
+		return nil, err
+	}
+	if newSite.Valid {
+		json.Unmarshal([]byte(newSite.String), &s.NewSite)
+	}
+	if result.Valid {
+		json.Unmarshal([]byte(result.String), &s.Result)
+	}
+	if committed.Valid {
+		s.CommittedAt = &committed.Int64
+	}
+	s.summarize()
+	return s, nil
+}
+
+// applyImportEdits lays the user's edits over the proposal
+func (s *ImportSession) applyImportEdits(req ImportCommit) error {
+	byKey := map[string]*ImportItem{}
+	for i := range s.Items {
+		byKey[s.Items[i].Key] = &s.Items[i]
+	}
+	for _, e := range req.Items {
+		it, ok := byKey[e.Key]
+		if !ok {
+			return fmt.Errorf("no item %q in this import", e.Key)
+		}
+		set := func(dst *string, v *string) {
+			if v != nil {
+				*dst = *v
+			}
+		}
+		set(&it.Action, e.Action)
+		set(&it.Title, e.Title)
+		if e.Slug != nil {
+			it.Slug = slugify(*e.Slug)
+		}
+		set(&it.Path, e.Path)
+		set(&it.Type, e.Type)
+		set(&it.SiteID, e.SiteID)
+		set(&it.Status, e.Status)
+		if e.Tags != nil {
+			it.Tags = *e.Tags
+		}
+		switch {
+		case it.Action != "create" && it.Action != "replace" && it.Action != "skip":
+			return fmt.Errorf("item %q: action must be create, replace or skip", e.Key)
+		case it.Status != "draft" && it.Status != "published":
+			return fmt.Errorf("item %q: status must be draft or published", e.Key)
+		case strings.TrimSpace(it.Title) == "":
+			return fmt.Errorf("item %q needs a title", e.Key)
+		}
+		if it.Action == "replace" && (it.Collision == nil || it.Collision.NodeID == "") {
+			return fmt.Errorf("item %q has no existing node to replace", e.Key)
+		}
+	}
+	if req.NewSite != nil {
+		s.NewSite = req.NewSite
+	}
+	return nil
+}
+
+// importConflict is an item that can't be created as mapped
+type importConflict struct {
+	Key    string `json:"key"`
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	NodeID string `json:"node_id,omitempty"`
+}
+
+// importConflicts checks the final mapping against the vault as it is now
+func (s *ImportSession) importConflicts() []importConflict {
+	var out []importConflict
+	paths := map[string]string{}
+	slugs := map[string]string{}
+	for _, it := range s.Items {
+		if it.Action != "create" {
+			continue
+		}
+		if it.Path == "" || it.Title == "" {
+			out = append(out, importConflict{Key: it.Key, Field: "path", Value: it.Path})
+			continue
+		}
+		if id := nodeAtPath(it.Path); id != "" {
+			out = append(out, importConflict{Key: it.Key, Field: "path", Value: it.Path, NodeID: id})
+		} else if other, ok := paths[it.Path]; ok {
+			out = append(out, importConflict{Key: it.Key, Field: "path", Value: it.Path, NodeID: "item:" + other})
+		}
+		paths[it.Path] = it.Key
+		if it.Slug == "" {
+			continue
+		}
+		if id := nodeWithSlug(it.SiteID, it.Slug, it.Type); id != "" {
+			out = append(out, importConflict{Key: it.Key, Field: "slug", Value: it.Slug, NodeID: id})
+		} else if other, ok := slugs[it.SiteID+"/"+it.Slug]; ok {
+			out = append(out, importConflict{Key: it.Key, Field: "slug", Value: it.Slug, NodeID: "item:" + other})
+		}
+		slugs[it.SiteID+"/"+it.Slug] = it.Key
+	}
+	return out
+}
+
+// commitImport writes the session's items in one transaction
+func commitImport(s *ImportSession, ownerID string) (*ImportResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	nextID := ids.New
+	var owner interface{}
+	if ownerID != "" {
+		owner = ownerID
+	}
+
+	res := &ImportResult{Nodes: map[string]string{}}
+	for _, it := range s.Items {
+		if it.SiteID == newImportSite && it.Action != "skip" {
+			res.SiteID = nextID("site")
+			if _, err := tx.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				res.SiteID, s.NewSite.Name, s.NewSite.Description, s.NewSite.Type, now, now); err != nil {
+				return nil, err
+			}
+			if ownerID != "" {
+				if _, err := tx.Exec(`INSERT INTO site_members (id, site_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+					nextID("member"), res.SiteID, ownerID, RoleOwner, now); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+	}
+
+	tagIDs := map[string]string{}
+	for _, it := range s.Items {
+		if it.Action == "skip" {
+			res.Skipped++
+			continue
+		}
+		var site interface{}
+		switch it.SiteID {
+		case "":
+		case newImportSite:
+			site = res.SiteID
+		default:
+			site = it.SiteID
+		}
+		created, modified := it.CreatedAt, it.ModifiedAt
+		if created == 0 {
+			created = now
+		}
+		if modified == 0 {
+			modified = created
+		}
+		var publishedAt interface{}
+		if it.Status == "published" {
+			publishedAt = modified
+		}
+
+		id := ""
+		if it.Action == "replace" {
+			id = it.Collision.NodeID
+			if _, err := tx.Exec(`UPDATE nodes SET title = ?, content = ?, status = ?, modified_at = ? WHERE id = ?`,
+				it.Title, it.Content, it.Status, now, id); err != nil {
+				return nil, err
+			}
+			var n int
+			if err := tx.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, id).Scan(&n); err != nil {
+				return nil, err
+			}
+			tx.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ?`, id)
+			if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`,
+				nextID("v"), id, n+1, it.Content, it.Title, it.Status, publishedAt, now, now); err != nil {
+				return nil, err
+			}
+			res.Replaced++
+		} else {
+			id = nextID("node")
+			if _, err := tx.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at, owner_id)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, it.Type, site, it.Path, it.Title, it.Content, it.Slug, "text/markdown", it.Status, created, modified, owner); err != nil {
+				return nil, fmt.Errorf("item %s: %v", it.Key, err)
+			}
+			if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current)
+				VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, 1)`,
+				nextID("v"), id, it.Content, it.Title, it.Status, publishedAt, created, modified); err != nil {
+				return nil, err
+			}
+			if _, err := tx.Exec(`INSERT INTO node_visibility (id, node_id, visibility, created_at) VALUES (?, ?, ?, ?)`,
+				nextID("vis"), id, "private", now); err != nil {
+				return nil, err
+			}
+			if it.Type == "post" {
+				if _, err := tx.Exec(`INSERT INTO blog_posts (id, node_id, slug, excerpt, publish_date) VALUES (?, ?, ?, ?, ?)`,
+					nextID("post"), id, it.Slug, excerpt(it.Content, feedExcerptLen), publishedAt); err != nil {
+					return nil, fmt.Errorf("item %s: %v", it.Key, err)
+				}
+			}
+			res.Created++
+		}
+		res.Nodes[it.Key] = id
+
+		for _, tag := range it.Tags {
+			tagID, ok := tagIDs[tag]
+			if !ok {
+				if tx.QueryRow(`SELECT id FROM tags WHERE name = ?`, tag).Scan(&tagID) != nil {
+					tagID = nextID("tag")
+					if _, err := tx.Exec(`INSERT INTO tags (id, name) VALUES (?, ?)`, tagID, tag); err != nil {
+						return nil, err
+					}
+				}
+				tagIDs[tag] = tagID
+			}
+			tx.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, nextID("nt"), id, tagID)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// links are resolved once every item exists, so items can link each other
+	rebuild := map[string]string{}
+	for _, it := range s.Items {
+		id, ok := res.Nodes[it.Key]
+		if !ok {
+			continue
+		}
+		siteID := it.SiteID
+		if siteID == newImportSite {
+			siteID = res.SiteID
+		}
+		if err := syncNodeReferences(id, siteID, it.Content); err != nil {
+			log.Printf("references for node %s: %v", id, err)
+		}
+		typ := events.NodeCreated
+		if it.Action == "replace" {
+			typ = events.NodeUpdated
+		}
+		publishNodeEvent(typ, Node{ID: id, Type: it.Type, Path: it.Path, Title: it.Title, SiteID: siteID})
+		if it.Status == "published" && siteID != "" {
+			rebuild[siteID] = id
+		}
+	}
+	for siteID, nodeID := range rebuild {
+		queueStaticRebuilds(siteID, nodeID)
+	}
+	return res, nil
+}
+
+// expireImportSessions drops analyzed imports nobody committed
+func expireImportSessions() {
+	db.Exec(`DELETE FROM import_sessions WHERE status = 'analyzed' AND created_at < ?`, time.Now().Add(-importSessionTTL).Unix())
+}
+
+// handleImport serves the import wizard:
+//
+//	POST   /api/import/analyze?format=&site_id=&filename=  upload (multipart "file" or the raw body)
+//	GET    /api/import/{id}                                the session and its items
+//	POST   /api/import/{id}/commit                         {new_site?, items: [edits]}
+//	DELETE /api/import/{id}                                discard it
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/import/"), "/")
+	if rest == "analyze" {
+		handleImportAnalyze(w, r)
+		return
+	}
+	id, commit := strings.CutSuffix(rest, "/commit")
+	s, err := loadImportSession(id)
+	if err != nil || (s.OwnerID != "" && s.OwnerID != currentUserID(r)) {
+		apierror.Write(w, http.StatusNotFound, "import not found")
+		return
+	}
+	switch {
+	case commit && r.Method == "POST":
+		handleImportCommit(w, r, s)
+	case !commit && r.Method == "GET":
+		json.NewEncoder(w).Encode(s.view())
+	case !commit && r.Method == "DELETE":
+		if s.Status == "analyzed" {
+			s.Status = "discarded"
+			s.Items = []ImportItem{}
+			saveImportSession(s)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"discarded": s.ID})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handleImportAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	siteID := r.URL.Query().Get("site_id")
+	if siteID != "" && !canCreateInSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+		return
+	}
+	limitMediaBody(w, r, 1<<20)
+	name := r.URL.Query().Get("filename")
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, ferr := r.FormFile("file")
+		if ferr != nil {
+			apierror.Write(w, http.StatusBadRequest, "file is required")
+			return
+		}
+		defer file.Close()
+		name = header.Filename
+		data, err = io.ReadAll(file)
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil || len(data) == 0 {
+		apierror.Write(w, http.StatusBadRequest, "nothing to import")
+		return
+	}
+
+	s, err := analyzeImport(r.URL.Query().Get("format"), name, data, siteID)
+	if err != nil {
+		apierror.Write(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	expireImportSessions()
+	s.ID = ids.New("import")
+	s.OwnerID = currentUserID(r)
+	s.CreatedAt = time.Now().Unix()
+	if err := saveImportSession(s); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.view())
+}
+
+func handleImportCommit(w http.ResponseWriter, r *http.Request, s *ImportSession) {
+	if s.Status != "analyzed" {
+		apierror.Write(w, http.StatusConflict, "import was already "+s.Status)
+		return
+	}
+	var req ImportCommit
+	if err := validate.DecodeOptionalJSON(r.Body, &req); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	if err := s.applyImportEdits(req); err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var size int64
+	sites := map[string]bool{}
+	for _, it := range s.Items {
+		if it.Action == "skip" {
+			continue
+		}
+		size += int64(len(it.Content))
+		if it.SiteID == newImportSite && (s.NewSite == nil || strings.TrimSpace(s.NewSite.Name) == "") {
+			apierror.Write(w, http.StatusBadRequest, "new_site needs a name")
+			return
+		}
+		if it.SiteID != newImportSite && !sites[it.SiteID] {
+			sites[it.SiteID] = true
+			if !canCreateInSite(r, it.SiteID) {
+				apierror.Write(w, http.StatusForbidden, "editor role required on site "+it.SiteID)
+				return
+			}
+		}
+		if it.Action == "replace" && !canModifyNode(r, it.Collision.NodeID) {
+			apierror.Write(w, http.StatusForbidden, "item "+it.Key+" would replace a node you can't edit")
+			return
+		}
+	}
+	if conflicts := s.importConflicts(); len(conflicts) > 0 {
+		sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Key < conflicts[j].Key })
+		apierror.WriteWith(w, &apierror.Error{Status: http.StatusConflict, Message: "some items collide with existing nodes or each other"},
+			map[string]interface{}{"conflicts": conflicts})
+		return
+	}
+	if !checkVaultRoom(w, size) {
+		return
+	}
+
+	res, err := commitImport(s, currentUserID(r))
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	now := time.Now().Unix()
+	s.Status, s.Result, s.CommittedAt = "committed", res, &now
+	if err := saveImportSession(s); err != nil {
+		log.Printf("import %s: failed to record the commit: %v", s.ID, err)
+	}
+	json.NewEncoder(w).Encode(res)
+}
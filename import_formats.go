@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// === Import Formats ===
+// Each importer turns an upload into items for the import wizard. They only
+// read: titles, tags and dates come from the source, and the wizard proposes
+// slugs, paths and sites and checks collisions.
+
+// Import formats
+const (
+	ImportMarkdown  = "markdown"
+	ImportWordPress = "wordpress"
+	ImportNotion    = "notion"
+	ImportENEX      = "enex"
+)
+
+// importParse is what an importer found in an upload
+type importParse struct {
+	Items []ImportItem
+	// Site is proposed as a new site when the source describes one
+	Site *ImportSite
+}
+
+// importers maps each format to its parser
+var importers = map[string]func(name string, data []byte) (*importParse, error){
+	ImportMarkdown:  parseMarkdownImport,
+	ImportWordPress: parseWordPressImport,
+	ImportNotion:    parseNotionImport,
+	ImportENEX:      parseENEXImport,
+}
+
+// notionID is the id Notion appends to exported file and folder names
+var notionID = regexp.MustCompile(` [0-9a-f]{32}$`)
+
+// detectImportFormat guesses the format of an upload from its name and bytes
+func detectImportFormat(name string, data []byte) string {
+	head := string(data[:min(len(data), 4096)])
+	switch {
+	case strings.HasSuffix(strings.ToLower(name), ".enex") || strings.Contains(head, "<en-export"):
+		return ImportENEX
+	case strings.Contains(head, "wordpress.org/export"):
+		return ImportWordPress
+	case bytes.HasPrefix(data, []byte("PK")):
+		if zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+			for _, f := range zr.File {
+				if notionID.MatchString(strings.TrimSuffix(path.Base(f.Name), path.Ext(f.Name))) {
+					return ImportNotion
+				}
+			}
+		}
+	}
+	return ImportMarkdown
+}
+
+// zipFiles lists the files of a zip upload worth importing, by cleaned name
+func zipFiles(data []byte, ext ...string) (map[string]*zip.File, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a zip archive: %v", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		name := path.Clean(strings.TrimPrefix(f.Name, "/"))
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "../") || strings.HasPrefix(name, "__MACOSX/") ||
+			strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		for _, e := range ext {
+			if strings.EqualFold(path.Ext(name), e) {
+				files[name] = f
+			}
+		}
+	}
+	return files, nil
+}
+
+func readZipFile(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	return string(b), err
+}
+
+// sortedKeys returns m's keys in order, so items come out stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseMarkdownImport reads one markdown file or a zip of them. YAML front
+// matter may set title, slug, type, tags, date and status (or draft).
+func parseMarkdownImport(name string, data []byte) (*importParse, error) {
+	docs := map[string]string{}
+	if bytes.HasPrefix(data, []byte("PK")) {
+		files, err := zipFiles(data, ".md", ".markdown")
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range sortedKeys(files) {
+			content, err := readZipFile(files[n])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", n, err)
+			}
+			docs[n] = content
+		}
+	} else {
+		if name == "" {
+			name = "import.md"
+		}
+		docs[path.Base(name)] = string(data)
+	}
+
+	res := &importParse{}
+	names := make([]string, 0, len(docs))
+	for n := range docs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		meta, body, err := splitFrontMatter(docs[n])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", n, err)
+		}
+		item := ImportItem{
+			Source:  n,
+			Title:   meta["title"],
+			Slug:    meta["slug"],
+			Type:    meta["type"],
+			Path:    strings.TrimSuffix(n, path.Ext(n)) + ".md",
+			Tags:    frontMatterList(meta["tags"]),
+			Status:  "draft",
+			Content: body,
+		}
+		if item.Title == "" {
+			item.Title = firstHeading(body)
+		}
+		if item.Title == "" {
+			item.Title = strings.TrimSuffix(path.Base(n), path.Ext(n))
+		}
+		if meta["status"] == "published" || meta["draft"] == "false" {
+			item.Status = "published"
+		}
+		if t, ok := parseImportDate(meta["date"]); ok {
+			item.CreatedAt, item.ModifiedAt = t, t
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// splitFrontMatter separates a leading front matter block from body, its
+// keys lower cased and values flattened to text, lists as "a, b"
+func splitFrontMatter(doc string) (map[string]string, string, error) {
+	meta := map[string]string{}
+	values, body, err := parseFrontMatter(strings.TrimPrefix(doc, "\ufeff"))
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range values {
+		meta[strings.ToLower(k)] = frontMatterString(v)
+	}
+	return meta, body, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// frontMatterList reads "[a, b]" or "a, b" into its items
+func frontMatterList(v string) []string {
+	v = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(v), "["), "]")
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = unquote(strings.TrimSpace(s)); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// firstHeading returns the text of a markdown document's first # heading
+func firstHeading(body string) string {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "# "))
+		}
+	}
+	return ""
+}
+
+// parseImportDate reads the date formats importers meet
+func parseImportDate(s string) (int64, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02", "20060102T150405Z"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(s)); err == nil {
+			return t.Unix(), true
+		}
+	}
+	return 0, false
+}
+
+// notionLink matches links between pages of a Notion export
+var notionLink = regexp.MustCompile(`\[([^\]]*)\]\(([^)\s]+\.md)\)`)
+
+// parseNotionImport reads a Notion "Markdown & CSV" export zip. Page ids are
+// dropped from names, and links between exported pages become wiki links.
+// Databases (the CSV files) are left out.
+func parseNotionImport(name string, data []byte) (*importParse, error) {
+	files, err := zipFiles(data, ".md")
+	if err != nil {
+		return nil, err
+	}
+	clean := func(p string) string {
+		parts := strings.Split(p, "/")
+		for i, part := range parts {
+			ext := path.Ext(part)
+			parts[i] = notionID.ReplaceAllString(strings.TrimSuffix(part, ext), "") + ext
+		}
+		return strings.Join(parts, "/")
+	}
+	res := &importParse{}
+	for _, n := range sortedKeys(files) {
+		content, err := readZipFile(files[n])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", n, err)
+		}
+		content = notionLink.ReplaceAllStringFunc(content, func(m string) string {
+			sub := notionLink.FindStringSubmatch(m)
+			if strings.Contains(sub[2], "://") {
+				return m
+			}
+			target, err := url.PathUnescape(sub[2])
+			if err != nil {
+				return m
+			}
+			title := strings.TrimSuffix(path.Base(clean(target)), ".md")
+			if sub[1] == title || sub[1] == "" {
+				return "[[" + title + "]]"
+			}
+			return "[[" + title + "|" + sub[1] + "]]"
+		})
+		item := ImportItem{Source: n, Path: clean(n), Title: firstHeading(content), Status: "draft", Content: content}
+		if item.Title == "" {
+			item.Title = strings.TrimSuffix(path.Base(item.Path), ".md")
+		}
+		// page properties follow the heading as "Name: value" lines
+		lines := strings.Split(content, "\n")
+		for _, line := range lines[1:min(len(lines), 12)] {
+			if k, v, ok := strings.Cut(line, ": "); ok && (k == "Tags" || k == "Multi-select") {
+				item.Tags = frontMatterList(v)
+			}
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// wxr is the part of a WordPress export (WXR) the importer reads
+type wxr struct {
+	Channel struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+		Items       []struct {
+			Title      string `xml:"title"`
+			Content    string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+			PostName   string `xml:"post_name"`
+			PostType   string `xml:"post_type"`
+			Status     string `xml:"status"`
+			Date       string `xml:"post_date_gmt"`
+			Modified   string `xml:"post_modified_gmt"`
+			Categories []struct {
+				Domain string `xml:"domain,attr"`
+				Name   string `xml:",chardata"`
+			} `xml:"category"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// parseWordPressImport reads a WordPress export. Posts and pages are kept,
+// published or as drafts; categories and tags become tags. The blog is
+// proposed as a new site.
+func parseWordPressImport(name string, data []byte) (*importParse, error) {
+	var doc wxr
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("not a WordPress export: %v", err)
+	}
+	res := &importParse{Site: &ImportSite{Name: doc.Channel.Title, Description: doc.Channel.Description, Type: "blog"}}
+	if res.Site.Name == "" {
+		res.Site.Name = "WordPress"
+	}
+	for i, it := range doc.Channel.Items {
+		if (it.PostType != "post" && it.PostType != "page") || it.Status == "trash" || it.Status == "auto-draft" {
+			continue
+		}
+		item := ImportItem{
+			Source:  fmt.Sprintf("item %d", i+1),
+			Title:   strings.TrimSpace(it.Title),
+			Slug:    it.PostName,
+			Type:    it.PostType,
+			Status:  "draft",
+			Content: strings.TrimSpace(it.Content),
+		}
+		if it.Status == "publish" {
+			item.Status = "published"
+		}
+		if item.Title == "" {
+			item.Title = "Untitled"
+		}
+		if t, ok := parseImportDate(it.Date); ok {
+			item.CreatedAt, item.ModifiedAt = t, t
+		}
+		if t, ok := parseImportDate(it.Modified); ok {
+			item.ModifiedAt = t
+		}
+		seen := map[string]bool{}
+		for _, c := range it.Categories {
+			if (c.Domain == "post_tag" || c.Domain == "category") && c.Name != "" && c.Name != "Uncategorized" && !seen[c.Name] {
+				seen[c.Name] = true
+				item.Tags = append(item.Tags, c.Name)
+			}
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
+
+// enex is an Evernote export
+type enex struct {
+	Notes []struct {
+		Title   string   `xml:"title"`
+		Content string   `xml:"content"`
+		Created string   `xml:"created"`
+		Updated string   `xml:"updated"`
+		Tags    []string `xml:"tag"`
+	} `xml:"note"`
+}
+
+var (
+	enmlWrapper = regexp.MustCompile(`(?s)^.*?<en-note[^>]*>|</en-note>\s*$`)
+	enmlMedia   = regexp.MustCompile(`<en-media[^>]*/>|<en-media[^>]*>.*?</en-media>`)
+	enmlTodo    = regexp.MustCompile(`<en-todo checked="true"\s*/>|<en-todo[^>]*/>`)
+)
+
+// parseENEXImport reads an Evernote export. Notes keep their HTML, without
+// attachments, under a folder named after the file (the notebook).
+func parseENEXImport(name string, data []byte) (*importParse, error) {
+	var doc enex
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("not an Evernote export: %v", err)
+	}
+	notebook := slugify(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	if notebook == "" {
+		notebook = "evernote"
+	}
+	res := &importParse{}
+	for i, n := range doc.Notes {
+		content := enmlWrapper.ReplaceAllString(n.Content, "")
+		content = enmlMedia.ReplaceAllString(content, "")
+		content = enmlTodo.ReplaceAllStringFunc(content, func(m string) string {
+			if strings.Contains(m, `checked="true"`) {
+				return "[x] "
+			}
+			return "[ ] "
+		})
+		item := ImportItem{
+			Source:  fmt.Sprintf("note %d", i+1),
+			Title:   strings.TrimSpace(n.Title),
+			Type:    "note",
+			Status:  "draft",
+			Tags:    n.Tags,
+			Content: strings.TrimSpace(content),
+		}
+		if item.Title == "" {
+			item.Title = "Untitled"
+		}
+		item.Path = notebook + "/" + slugify(item.Title) + ".md"
+		if t, ok := parseImportDate(n.Created); ok {
+			item.CreatedAt, item.ModifiedAt = t, t
+		}
+		if t, ok := parseImportDate(n.Updated); ok {
+			item.ModifiedAt = t
+		}
+		res.Items = append(res.Items, item)
+	}
+	return res, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testZip(files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		w, _ := zw.Create(name)
+		w.Write([]byte(body))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestImportWizard(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('existing', 'note', 'hello.md', 'Hello', 'old', 'hello', 'text/markdown', 'draft', 1, 1)`)
+	mux := setupRoutes()
+	analyze := func(query string, body []byte) ImportSession {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/import/analyze?"+query, bytes.NewReader(body)))
+		if rr.Code != 201 {
+			t.Fatalf("analyze %s: %d %s", query, rr.Code, rr.Body.String())
+		}
+		var s ImportSession
+		json.Unmarshal(rr.Body.Bytes(), &s)
+		return s
+	}
+	commit := func(id, body string) (int, string) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/import/"+id+"/commit", strings.NewReader(body)))
+		return rr.Code, rr.Body.String()
+	}
+
+	// markdown: proposals, collisions with the vault and within the upload
+	s := analyze("filename=notes.zip", testZip(map[string]string{
+		"hello.md":     "---\ntitle: Hello\ntags: [a, b]\n---\nnew body links [[World]]",
+		"world.md":     "# World\n\ncontent",
+		"dup/hello.md": "---\ntitle: Hello\nstatus: published\n---\nagain",
+	}))
+	if s.Format != ImportMarkdown || len(s.Items) != 3 || s.Collisions != 2 || s.Tags["a"] != 1 {
+		t.Fatalf("unexpected analysis: %+v", s)
+	}
+	bySource := map[string]ImportItem{}
+	for _, it := range s.Items {
+		if it.Content != "" {
+			t.Fatal("analysis shouldn't echo content")
+		}
+		bySource[it.Source] = it
+	}
+	first := bySource["hello.md"]
+	if first.Collision == nil || first.Collision.Field != "path" || first.Collision.NodeID != "existing" || first.Path != "hello-2.md" {
+		t.Fatalf("expected the vault collision renamed: %+v", first)
+	}
+
+	// an edit that collides is refused with the conflicting items
+	code, body := commit(s.ID, `{"items": [{"key": "`+first.Key+`", "path": "world.md"}]}`)
+	if code != 409 || !strings.Contains(body, `"conflicts"`) {
+		t.Fatalf("expected 409, got %d %s", code, body)
+	}
+	code, body = commit(s.ID, `{"items": [{"key": "`+first.Key+`", "action": "launch"}]}`)
+	if code != 400 {
+		t.Fatalf("expected a bad action refused, got %d %s", code, body)
+	}
+
+	// replace the existing node, skip the duplicate, keep the rest
+	dup := bySource["dup/hello.md"]
+	code, body = commit(s.ID, `{"items": [{"key": "`+first.Key+`", "action": "replace"}, {"key": "`+dup.Key+`", "action": "skip"}]}`)
+	var res ImportResult
+	json.Unmarshal([]byte(body), &res)
+	if code != 200 || res.Created != 1 || res.Replaced != 1 || res.Skipped != 1 || res.Nodes[first.Key] != "existing" {
+		t.Fatalf("commit: %d %s", code, body)
+	}
+	var content string
+	var versions int
+	testDB.QueryRow(`SELECT content FROM nodes WHERE id = 'existing'`).Scan(&content)
+	testDB.QueryRow(`SELECT COUNT(*) FROM versions WHERE node_id = 'existing' AND is_current = 1`).Scan(&versions)
+	if !strings.Contains(content, "new body") || versions != 1 {
+		t.Fatalf("existing node should be replaced: %q %d", content, versions)
+	}
+	var links int
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_references WHERE source_node_id = 'existing'`).Scan(&links)
+	if links != 1 {
+		t.Fatalf("links between imported items should resolve: %d", links)
+	}
+	if code, _ := commit(s.ID, `{}`); code != 409 {
+		t.Fatalf("a committed import can't be committed again: %d", code)
+	}
+
+	// WordPress proposes a site, which the commit creates
+	wp := analyze("", []byte(`<?xml version="1.0"?><rss xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:wp="http://wordpress.org/export/1.2/">
+		<channel><title>My Blog</title>
+		<item><title>First</title><content:encoded>Hi there</content:encoded><wp:post_name>first</wp:post_name>
+			<wp:post_type>post</wp:post_type><wp:status>publish</wp:status><category domain="post_tag">go</category></item>
+		<item><title>Menu</title><wp:post_type>nav_menu_item</wp:post_type></item>
+		</channel></rss>`))
+	if wp.Format != ImportWordPress || wp.NewSite == nil || wp.NewSite.Name != "My Blog" || len(wp.Items) != 1 || wp.Items[0].SiteID != newImportSite {
+		t.Fatalf("unexpected WordPress analysis: %+v", wp)
+	}
+	// an edited slug is slugified, as it names the exported page
+	code, body = commit(wp.ID, `{"new_site": {"name": "Imported Blog", "type": "blog"}, "items": [{"key": "1", "slug": "../../First Post"}]}`)
+	json.Unmarshal([]byte(body), &res)
+	var siteName, postSlug string
+	testDB.QueryRow(`SELECT name FROM sites WHERE id = ?`, res.SiteID).Scan(&siteName)
+	testDB.QueryRow(`SELECT slug FROM blog_posts WHERE node_id = ?`, res.Nodes["1"]).Scan(&postSlug)
+	if code != 200 || siteName != "Imported Blog" || postSlug != "first-post" {
+		t.Fatalf("WordPress commit: %d %s %q %q", code, body, siteName, postSlug)
+	}
+
+	// Notion ids are dropped and page links become wiki links
+	notion := analyze("format=notion", testZip(map[string]string{
+		"Home 0123456789abcdef0123456789abcdef.md":  "# Home\n\nSee [Plans](Plans%20fedcba9876543210fedcba9876543210.md)",
+		"Plans fedcba9876543210fedcba9876543210.md": "# Plans\nTags: x, y\n",
+	}))
+	if len(notion.Items) != 2 || notion.Items[0].Path != "Home.md" || notion.Items[1].Tags[1] != "y" {
+		t.Fatalf("unexpected Notion analysis: %+v", notion.Items)
+	}
+	_, body = commit(notion.ID, `{}`)
+	json.Unmarshal([]byte(body), &res)
+	testDB.QueryRow(`SELECT content FROM nodes WHERE id = ?`, res.Nodes["1"]).Scan(&content)
+	if !strings.Contains(content, "[[Plans]]") {
+		t.Fatalf("expected a wiki link: %q", content)
+	}
+
+	// Evernote notes land in a folder named after the notebook
+	en := analyze("filename=Work.enex", []byte(`<?xml version="1.0"?><en-export><note><title>Todo</title>
+		<content><![CDATA[<?xml version="1.0"?><en-note><div><en-todo checked="true"/>ship</div></en-note>]]></content>
+		<created>20240105T101500Z</created><tag>work</tag></note></en-export>`))
+	if en.Format != ImportENEX || len(en.Items) != 1 || en.Items[0].Path != "work/todo.md" || en.Items[0].CreatedAt == 0 {
+		t.Fatalf("unexpected Evernote analysis: %+v", en.Items)
+	}
+
+	// discarded imports can't be committed
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/import/"+en.ID, nil))
+	if code, _ := commit(en.ID, `{}`); rr.Code != 200 || code != 409 {
+		t.Fatalf("discard: %d, then commit %d", rr.Code, code)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/import/import_missing", nil))
+	if rr.Code != 404 {
+		t.Fatalf("expected 404 for an unknown import, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// Limits bounds what a vault accepts. Zero disables a limit.
+type Limits struct {
+	MaxNodeBytes        int64 `json:"max_node_bytes"`
+	MaxMediaBytes       int64 `json:"max_media_bytes"`
+	MaxObjectsPerCommit int   `json:"max_objects_per_commit"`
+	MaxVaultBytes       int64 `json:"max_vault_bytes"`
+}
+
+// limits is configured by the serve flags (--max-node-kb, --max-media-mb,
+// --max-commit-objects, --max-vault-mb)
+var limits = Limits{
+	MaxNodeBytes:        10 << 20,
+	MaxMediaBytes:       512 << 20,
+	MaxObjectsPerCommit: 10000,
+}
+
+// vaultUsageTTL is how long a measured vault size is trusted; writes in between
+// are added to it so back-to-back uploads cannot slip past the quota
+const vaultUsageTTL = 30 * time.Second
+
+var vaultUsageCache struct {
+	sync.Mutex
+	bytes int64
+	at    time.Time
+}
+
+// vaultUsage is the size of the database, the media directory and the codex repository
+func vaultUsage() int64 {
+	vaultUsageCache.Lock()
+	defer vaultUsageCache.Unlock()
+	if !vaultUsageCache.at.IsZero() && time.Since(vaultUsageCache.at) < vaultUsageTTL {
+		return vaultUsageCache.bytes
+	}
+	var total int64
+	if dbPath != "" {
+		if fi, err := os.Stat(dbPath); err == nil {
+			total += fi.Size()
+		}
+	}
+	filepath.Walk("media", func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if st, err := codexRepo().Stats(0); err == nil {
+		total += st.TotalSize
+	}
+	vaultUsageCache.bytes = total
+	vaultUsageCache.at = time.Now()
+	return total
+}
+
+// noteVaultWrite adds n bytes to the cached vault usage
+func noteVaultWrite(n int64) {
+	vaultUsageCache.Lock()
+	vaultUsageCache.bytes += n
+	vaultUsageCache.Unlock()
+}
+
+// writeLimitError sends a 413 naming the exceeded limit
+func writeLimitError(w http.ResponseWriter, limit string, max, size int64) {
+	apierror.WriteWith(w, &apierror.Error{Status: http.StatusRequestEntityTooLarge, Code: "limit_exceeded", Message: fmt.Sprintf("%s exceeded: %d > %d", limit, size, max)},
+		map[string]interface{}{"limit": limit, "max": max, "size": size})
+}
+
+// checkNodeSize rejects node payloads over MaxNodeBytes
+func checkNodeSize(w http.ResponseWriter, node Node) bool {
+	size := int64(len(node.Title) + len(node.Content) + len(node.Body) + len(node.Metadata))
+	if limits.MaxNodeBytes > 0 && size > limits.MaxNodeBytes {
+		writeLimitError(w, "max_node_bytes", limits.MaxNodeBytes, size)
+		return false
+	}
+	return true
+}
+
+// checkVaultRoom rejects writes that would take the vault past MaxVaultBytes
+func checkVaultRoom(w http.ResponseWriter, add int64) bool {
+	if limits.MaxVaultBytes <= 0 {
+		return true
+	}
+	if used := vaultUsage(); used+add > limits.MaxVaultBytes {
+		writeLimitError(w, "max_vault_bytes", limits.MaxVaultBytes, used+add)
+		return false
+	}
+	return true
+}
+
+// checkCommitObjects rejects commits listing more than MaxObjectsPerCommit objects
+func checkCommitObjects(w http.ResponseWriter, n int) bool {
+	if limits.MaxObjectsPerCommit > 0 && n > limits.MaxObjectsPerCommit {
+		writeLimitError(w, "max_objects_per_commit", int64(limits.MaxObjectsPerCommit), int64(n))
+		return false
+	}
+	return true
+}
+
+// limitMediaBody caps a media request body at MaxMediaBytes plus room for
+// multipart framing
+func limitMediaBody(w http.ResponseWriter, r *http.Request, slack int64) {
+	if limits.MaxMediaBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxMediaBytes+slack)
+	}
+}
+
+// isBodyTooLarge reports whether err came from a body capped by limitMediaBody
+func isBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// GET /api/limits
+func handleLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limits": limits,
+		"usage":  map[string]int64{"vault_bytes": vaultUsage()},
+	})
+}
+
+// countingBody counts bytes read from a request body
+type countingBody struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLimitsEnforced(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tmp, err := ioutil.TempDir("", "limits-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	saved := limits
+	defer func() { limits = saved }()
+	limits = Limits{MaxNodeBytes: 16, MaxMediaBytes: 8, MaxObjectsPerCommit: 1}
+
+	mux := setupRoutes()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/api/node-create", `{"type":"note","path":"a.md","content":"this content is too long"}`)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for large node, got %d", rr.Code)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&body)
+	if body["limit"] != "max_node_bytes" {
+		t.Fatalf("expected limit name in error, got %v", body)
+	}
+	if rr := do("POST", "/api/node-create", `{"type":"note","path":"a.md","content":"ok"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected small node to be created, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/codex/object", bytes.NewReader([]byte("0123456789")))
+	req.ContentLength = -1 // force the streaming check
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for large object, got %d", rr.Code)
+	}
+
+	if rr := do("POST", "/api/codex/commit", `{"hash":"c1","message":"m","objects":["a","b"]}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for too many objects, got %d", rr.Code)
+	}
+
+	rr = do("GET", "/api/limits", "")
+	var out struct {
+		Limits Limits `json:"limits"`
+	}
+	json.NewDecoder(rr.Body).Decode(&out)
+	if rr.Code != http.StatusOK || out.Limits.MaxMediaBytes != 8 {
+		t.Fatalf("unexpected limits response %d %+v", rr.Code, out)
+	}
+}
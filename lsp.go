@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// === Language Server ===
+// `veil lsp` is a language server for the markdown files of a vault, for
+// editors that speak LSP over stdio. A file stands for the node whose path is
+// the file's path inside the vault. It offers:
+//   - completion of [[ links from node titles, and of #tags
+//   - go to definition on links, to the linked node's file in the vault
+//   - hover previews of the linked node
+//   - warnings for links that match no node
+// Links are found and resolved as references.go does for backlinks.
+
+// lspWikiPrefix and lspTagPrefix match the text before the cursor while
+// typing a link or a tag
+var (
+	lspWikiPrefix = regexp.MustCompile(`\[\[([^\[\]|#]*)$`)
+	lspTagPrefix  = regexp.MustCompile(`(?:^|\s)#([\w/-]*)$`)
+	lspNotNewline = regexp.MustCompile(`[^\n]`)
+)
+
+// lspLink is a link in an open document; Start and End are byte offsets in
+// its line
+type lspLink struct {
+	Line, Start, End int
+	link             nodeLink
+}
+
+type lspServer struct {
+	rpcSession
+	root string
+	docs map[string]string // open documents by URI
+	w    io.Writer
+}
+
+func lspCommand() {
+	vault := "."
+	token := os.Getenv("VEIL_SESSION_TOKEN")
+	for i := 2; i < len(os.Args)-1; i++ {
+		switch os.Args[i] {
+		case "--vault":
+			vault = os.Args[i+1]
+			if v, ok := lookupVault(vault); ok {
+				vault = v.Path
+			}
+		case "--token":
+			token = os.Args[i+1]
+		}
+	}
+
+	// stdout carries the protocol; anything else printed goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+	if err := serveLSP(os.Stdin, out, currentVault, rpcSession{token: token}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveLSP answers LSP messages from in on out until exit or the end of in.
+// root is the vault directory document paths are taken relative to.
+func serveLSP(in io.Reader, out io.Writer, root string, session rpcSession) error {
+	s := &lspServer{rpcSession: session, root: root, docs: map[string]string{}, w: out}
+	r := bufio.NewReader(in)
+	for {
+		body, err := readLSPMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.send(rpcReply(json.RawMessage("null"), nil, &rpcError{Code: rpcParseError, Message: "parse error: " + err.Error()}))
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(req.Method, req.Params)
+		if req.ID == nil {
+			continue
+		}
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+			}
+			s.send(rpcReply(req.ID, nil, rerr))
+			continue
+		}
+		s.send(rpcReply(req.ID, result, nil))
+	}
+}
+
+// readLSPMessage reads one Content-Length framed message
+func readLSPMessage(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF || len(header) == 0 {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("lsp: bad Content-Length %q", header.Get("Content-Length"))
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return body, err
+}
+
+func (s *lspServer) send(msg interface{}) {
+	body, _ := json.Marshal(msg)
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspCompletionItem struct {
+	Label      string `json:"label"`
+	Kind       int    `json:"kind"`
+	Detail     string `json:"detail,omitempty"`
+	InsertText string `json:"insertText"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+// LSP completion item kinds and diagnostic severities used here
+const (
+	lspKindKeyword   = 14
+	lspKindReference = 18
+	lspWarning       = 2
+)
+
+func (s *lspServer) handle(method string, raw json.RawMessage) (interface{}, error) {
+	var p struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+		ContentChanges []struct {
+			Text string `json:"text"`
+		} `json:"contentChanges"`
+		Position lspPosition `json:"position"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+	}
+	uri := p.TextDocument.URI
+
+	switch method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   1, // full text on every change
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"[", "#"}},
+				"definitionProvider": true,
+				"hoverProvider":      true,
+			},
+			"serverInfo": map[string]string{"name": "veil"},
+		}, nil
+	case "initialized", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		s.docs[uri] = p.TextDocument.Text
+		s.publishDiagnostics(uri)
+		return nil, nil
+	case "textDocument/didChange":
+		if n := len(p.ContentChanges); n > 0 {
+			s.docs[uri] = p.ContentChanges[n-1].Text
+		}
+		s.publishDiagnostics(uri)
+		return nil, nil
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		s.send(map[string]interface{}{"jsonrpc": "2.0", "method": "textDocument/publishDiagnostics",
+			"params": map[string]interface{}{"uri": uri, "diagnostics": []lspDiagnostic{}}})
+		return nil, nil
+	case "textDocument/completion":
+		return s.complete(uri, p.Position)
+	case "textDocument/definition":
+		_, id := s.linkAt(uri, p.Position)
+		if id == "" {
+			return nil, nil
+		}
+		return lspLocation{URI: s.fileURI(rpcNodeSummary(id).Path)}, nil
+	case "textDocument/hover":
+		l, id := s.linkAt(uri, p.Position)
+		if id == "" {
+			return nil, nil
+		}
+		var title, path, content string
+		db.QueryRow(`SELECT COALESCE(title, ''), path, COALESCE(content, '') FROM nodes WHERE id = ?`, id).Scan(&title, &path, &content)
+		line := strings.Split(s.docs[uri], "\n")[l.Line]
+		return map[string]interface{}{
+			"contents": map[string]string{"kind": "markdown", "value": fmt.Sprintf("**%s**  \n`%s`\n\n%s", title, path, excerpt(content, 300))},
+			"range":    lspRange{Start: lspPosition{l.Line, utf16Len(line[:l.Start])}, End: lspPosition{l.Line, utf16Len(line[:l.End])}},
+		}, nil
+	}
+	if strings.HasPrefix(method, "$/") {
+		return nil, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + method}
+}
+
+// docNode finds the node a document stands for, by its path in the vault
+func (s *lspServer) docNode(uri string) (id, siteID string) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", ""
+	}
+	rel, err := filepath.Rel(s.root, filepath.FromSlash(u.Path))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", ""
+	}
+	db.QueryRow(`SELECT id, COALESCE(site_id, '') FROM nodes WHERE path = ? AND deleted_at IS NULL`, filepath.ToSlash(rel)).Scan(&id, &siteID)
+	return id, siteID
+}
+
+// fileURI is the file URI of a node path in the vault
+func (s *lspServer) fileURI(path string) string {
+	abs := filepath.Join(s.root, filepath.FromSlash(path))
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+}
+
+// complete offers node titles inside [[ and tag names after #
+func (s *lspServer) complete(uri string, pos lspPosition) (map[string]interface{}, error) {
+	items := []lspCompletionItem{}
+	lines := strings.Split(s.docs[uri], "\n")
+	if pos.Line >= len(lines) {
+		return map[string]interface{}{"isIncomplete": false, "items": items}, nil
+	}
+	line := lines[pos.Line]
+	col := byteOffset(line, pos.Character)
+	before, after := line[:col], line[col:]
+
+	if m := lspWikiPrefix.FindStringSubmatch(before); m != nil {
+		_, siteID := s.docNode(uri)
+		rows, err := db.Query(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, '') FROM nodes
+			WHERE deleted_at IS NULL AND archived_at IS NULL AND COALESCE(title, '') <> '' AND lower(title) LIKE lower(?)
+			ORDER BY (COALESCE(site_id, '') = ?) DESC, title`, "%"+m[1]+"%", siteID)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := s.readableNodes(rows, 50)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			insert := n.Title
+			if !strings.HasPrefix(after, "]]") {
+				insert += "]]"
+			}
+			items = append(items, lspCompletionItem{Label: n.Title, Kind: lspKindReference, Detail: n.Path, InsertText: insert})
+		}
+	} else if m := lspTagPrefix.FindStringSubmatch(before); m != nil {
+		rows, err := db.Query(`SELECT name FROM tags WHERE lower(name) LIKE lower(?) ORDER BY name LIMIT 50`, m[1]+"%")
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return nil, err
+			}
+			items = append(items, lspCompletionItem{Label: name, Kind: lspKindKeyword, InsertText: name})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"isIncomplete": false, "items": items}, nil
+}
+
+// linkAt returns the link under the cursor and the node it resolves to
+func (s *lspServer) linkAt(uri string, pos lspPosition) (lspLink, string) {
+	text, ok := s.docs[uri]
+	if !ok {
+		return lspLink{}, ""
+	}
+	lines := strings.Split(text, "\n")
+	if pos.Line >= len(lines) {
+		return lspLink{}, ""
+	}
+	col := byteOffset(lines[pos.Line], pos.Character)
+	_, siteID := s.docNode(uri)
+	for _, l := range lspLinks(text) {
+		if l.Line == pos.Line && col >= l.Start && col <= l.End {
+			id := resolveLink(siteID, l.link)
+			if id == "" || !canReadNode(s.request("GET", "/", nil), id) {
+				return l, ""
+			}
+			return l, id
+		}
+	}
+	return lspLink{}, ""
+}
+
+// publishDiagnostics warns about the links of a document that match no node
+func (s *lspServer) publishDiagnostics(uri string) {
+	text := s.docs[uri]
+	lines := strings.Split(text, "\n")
+	_, siteID := s.docNode(uri)
+	diags := []lspDiagnostic{}
+	for _, l := range lspLinks(text) {
+		if !isVaultLink(l.link) || resolveLink(siteID, l.link) != "" {
+			continue
+		}
+		line := lines[l.Line]
+		diags = append(diags, lspDiagnostic{
+			Range:    lspRange{Start: lspPosition{l.Line, utf16Len(line[:l.Start])}, End: lspPosition{l.Line, utf16Len(line[:l.End])}},
+			Severity: lspWarning,
+			Source:   "veil",
+			Message:  fmt.Sprintf("no node matches %q", l.link.Target),
+		})
+	}
+	s.send(map[string]interface{}{"jsonrpc": "2.0", "method": "textDocument/publishDiagnostics",
+		"params": map[string]interface{}{"uri": uri, "diagnostics": diags}})
+}
+
+// isVaultLink reports whether a link should point at a node: wiki links and
+// veil:// URIs always do, markdown links when they name a .md file or a
+// /veil/ path
+func isVaultLink(l nodeLink) bool {
+	if l.Type != "markdown" {
+		return true
+	}
+	href := l.Target
+	if i := strings.IndexAny(href, "?#"); i >= 0 {
+		href = href[:i]
+	}
+	return strings.HasPrefix(href, "veil://") || strings.HasPrefix(href, "/veil/") ||
+		(!strings.Contains(href, "://") && strings.HasSuffix(href, ".md"))
+}
+
+// lspLinks finds the links of a document with their positions. Like
+// extractLinks it skips code, blanking it out so offsets stay put.
+func lspLinks(text string) []lspLink {
+	blank := func(s string) string { return strings.Repeat(" ", len(s)) }
+	text = refFencedCode.ReplaceAllStringFunc(text, func(m string) string {
+		return lspNotNewline.ReplaceAllString(m, " ")
+	})
+	text = refInlineCode.ReplaceAllStringFunc(text, blank)
+
+	var links []lspLink
+	for i, line := range strings.Split(text, "\n") {
+		for _, m := range refWikiLink.FindAllStringSubmatchIndex(line, -1) {
+			target := strings.TrimSpace(line[m[2]:m[3]])
+			shown := target
+			if m[6] >= 0 {
+				if label := strings.TrimSpace(strings.TrimPrefix(line[m[6]:m[7]], "|")); label != "" {
+					shown = label
+				}
+			}
+			if target != "" {
+				links = append(links, lspLink{Line: i, Start: m[0], End: m[1], link: nodeLink{Type: "wiki", Target: target, Text: shown}})
+			}
+		}
+		line = refWikiLink.ReplaceAllStringFunc(line, blank)
+		for _, m := range refMarkdownLink.FindAllStringSubmatchIndex(line, -1) {
+			if m[3] == m[2] { // not an image
+				links = append(links, lspLink{Line: i, Start: m[0], End: m[1], link: nodeLink{Type: "markdown", Target: line[m[6]:m[7]], Text: line[m[4]:m[5]]}})
+			}
+		}
+		line = refMarkdownLink.ReplaceAllStringFunc(line, blank)
+		for _, m := range refVeilURI.FindAllStringIndex(line, -1) {
+			uri := strings.TrimRight(line[m[0]:m[1]], ".,;:!?")
+			links = append(links, lspLink{Line: i, Start: m[0], End: m[0] + len(uri), link: nodeLink{Type: "uri", Target: uri, Text: uri}})
+		}
+	}
+	return links
+}
+
+// utf16Len is the length of s in UTF-16 code units, which LSP positions count
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// byteOffset converts a UTF-16 column in line to a byte offset
+func byteOffset(line string, col int) int {
+	units := 0
+	for i, r := range line {
+		if units >= col {
+			return i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return len(line)
+}
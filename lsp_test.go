@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestServeLSP(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES
+		('ideas', 'note', 'notes/ideas.md', 'Ideas', 'Things to build', 1, 1),
+		('inbox', 'note', 'notes/inbox.md', 'Inbox', '', 2, 2)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'project'), ('t2', 'reading')`)
+
+	doc := "file:///vault/notes/inbox.md"
+	text := "See [[Ideas]] and [[Nowhere]].\n`[[Ignored]]` [gone](old.md) [site](https://example.com)\nNext: [[Id\n#pro"
+	var in bytes.Buffer
+	id := 0
+	send := func(method string, params interface{}, notify bool) {
+		msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+		if !notify {
+			id++
+			msg["id"] = id
+		}
+		body, _ := json.Marshal(msg)
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	pos := func(line, char int) map[string]interface{} {
+		return map[string]interface{}{"textDocument": map[string]string{"uri": doc}, "position": map[string]int{"line": line, "character": char}}
+	}
+	send("initialize", map[string]interface{}{}, false)                                                                     // 1
+	send("textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": doc, "text": text}}, true) // diagnostics
+	send("textDocument/completion", pos(2, 11), false)                                                                      // 2
+	send("textDocument/completion", pos(3, 4), false)                                                                       // 3
+	send("textDocument/definition", pos(0, 7), false)                                                                       // 4
+	send("textDocument/hover", pos(0, 7), false)                                                                            // 5
+	send("textDocument/definition", pos(0, 22), false)                                                                      // 6
+	send("shutdown", nil, false)                                                                                            // 7
+	send("exit", nil, true)
+
+	var out bytes.Buffer
+	if err := serveLSP(&in, &out, "/vault", rpcSession{}); err != nil {
+		t.Fatal(err)
+	}
+	replies := map[int]json.RawMessage{}
+	var diagnostics []lspDiagnostic
+	r := bufio.NewReader(&out)
+	for {
+		body, err := readLSPMessage(r)
+		if err != nil {
+			break
+		}
+		var msg struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+			Result json.RawMessage `json:"result"`
+		}
+		json.Unmarshal(body, &msg)
+		if msg.Method == "textDocument/publishDiagnostics" {
+			var p struct {
+				Diagnostics []lspDiagnostic `json:"diagnostics"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			diagnostics = p.Diagnostics
+			continue
+		}
+		replies[msg.ID] = msg.Result
+	}
+
+	if !strings.Contains(string(replies[1]), `"definitionProvider":true`) {
+		t.Fatalf("initialize: %s", replies[1])
+	}
+	// broken wiki and .md links are flagged; code and web links are not
+	if len(diagnostics) != 2 || diagnostics[0].Message != `no node matches "Nowhere"` || diagnostics[1].Message != `no node matches "old.md"` {
+		t.Fatalf("unexpected diagnostics: %+v", diagnostics)
+	}
+	if d := diagnostics[0].Range; d.Start != (lspPosition{0, 18}) || d.End != (lspPosition{0, 29}) {
+		t.Fatalf("diagnostic should cover the link: %+v", d)
+	}
+	if !strings.Contains(string(replies[2]), `"label":"Ideas","kind":18,"detail":"notes/ideas.md","insertText":"Ideas]]"`) {
+		t.Fatalf("link completion: %s", replies[2])
+	}
+	if !strings.Contains(string(replies[3]), `"label":"project"`) || strings.Contains(string(replies[3]), "reading") {
+		t.Fatalf("tag completion: %s", replies[3])
+	}
+	if !strings.Contains(string(replies[4]), `"uri":"file:///vault/notes/ideas.md"`) {
+		t.Fatalf("definition: %s", replies[4])
+	}
+	if !strings.Contains(string(replies[5]), `**Ideas**`) || !strings.Contains(string(replies[5]), "Things to build") {
+		t.Fatalf("hover: %s", replies[5])
+	}
+	if string(replies[6]) != "null" {
+		t.Fatalf("a broken link has no definition: %s", replies[6])
+	}
+}
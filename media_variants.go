@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Image Variants ===
+// Uploaded JPEG, PNG and GIF images get a thumbnail and a copy at each
+// responsive width narrower than the original, written next to it in ./media
+// as <name>.thumb.<ext> and <name>.<width>w.<ext>. JPEGs stay JPEGs and the
+// rest become PNGs. Uploads answer with the variants and a srcset, and
+// static exports give <img> tags of uploaded images a srcset and sizes so
+// browsers pick the smallest copy that fills the page.
+
+// ImageVariantConfig says which variants uploads get
+type ImageVariantConfig struct {
+	Widths    []int // responsive widths
+	Thumbnail int   // longest side of the thumbnail, 0 for none
+	Quality   int   // JPEG quality
+	MaxPixels int   // larger images are stored without variants
+}
+
+// imageVariantConfig is set by the serve flags --image-widths and
+// --thumbnail-size
+var imageVariantConfig = ImageVariantConfig{Widths: []int{320, 768, 1280}, Thumbnail: 200, Quality: 82, MaxPixels: 50_000_000}
+
+// imageSizes is the sizes attribute of exported images; pages are at most
+// 800px wide
+const imageSizes = "(max-width: 800px) 100vw, 800px"
+
+// MediaVariant is a resized copy of an uploaded image
+type MediaVariant struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileSize int64  `json:"file_size"`
+}
+
+// parseImageWidths reads --image-widths, a comma separated list where 0 or
+// nothing means none
+func parseImageWidths(s string) []int {
+	var widths []int
+	for _, f := range strings.Split(s, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(f)); err == nil && n > 0 {
+			widths = append(widths, n)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+// variantFileName is the stored name of a variant of the file stored as
+// filename
+func variantFileName(filename, name, ext string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename)) + "." + name + ext
+}
+
+// makeImageVariants writes the variants of an uploaded image stored as
+// ./media/<filename> and records them. It returns the original's size, zero
+// when content is not an image it can read, and the variants made.
+func makeImageVariants(mediaID, filename string, content []byte) (int, int, []MediaVariant) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || cfg.Width == 0 || cfg.Height == 0 {
+		return 0, 0, nil
+	}
+	db.Exec(`UPDATE media SET width = ?, height = ? WHERE id = ?`, cfg.Width, cfg.Height, mediaID)
+	if imageVariantConfig.MaxPixels > 0 && cfg.Width*cfg.Height > imageVariantConfig.MaxPixels {
+		return cfg.Width, cfg.Height, nil
+	}
+
+	type target struct {
+		name string
+		box  int // the width, or for the thumbnail its longest side
+	}
+	var targets []target
+	for _, w := range imageVariantConfig.Widths {
+		if w < cfg.Width {
+			targets = append(targets, target{strconv.Itoa(w) + "w", w})
+		}
+	}
+	if t := imageVariantConfig.Thumbnail; t > 0 && (cfg.Width > t || cfg.Height > t) {
+		targets = append(targets, target{"thumb", t})
+	}
+	if len(targets) == 0 {
+		return cfg.Width, cfg.Height, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return cfg.Width, cfg.Height, nil
+	}
+
+	ext, mimeType := ".png", "image/png"
+	if format == "jpeg" {
+		ext, mimeType = ".jpg", "image/jpeg"
+	}
+	// each copy is scaled from the last, largest first, so the original is
+	// only read once
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targetSize(targets[i].name, targets[i].box, cfg) > targetSize(targets[j].name, targets[j].box, cfg)
+	})
+	var variants []MediaVariant
+	now := time.Now().Unix()
+	for _, t := range targets {
+		var r image.Rectangle
+		if t.name == "thumb" {
+			r = fitRect(image.Rect(0, 0, t.box, t.box), src.Bounds(), false)
+			r = r.Sub(r.Min)
+		} else {
+			r = image.Rect(0, 0, t.box, max(1, src.Bounds().Dy()*t.box/src.Bounds().Dx()))
+		}
+		if r.Empty() {
+			continue
+		}
+		img := image.NewRGBA(r)
+		scaleInto(img, r, src)
+		var data []byte
+		if format == "jpeg" {
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: imageVariantConfig.Quality})
+			data = buf.Bytes()
+		} else {
+			data, err = encodePNG(img)
+		}
+		if err != nil {
+			continue
+		}
+		name := variantFileName(filename, t.name, ext)
+		fpath := filepath.Join("media", name)
+		if os.WriteFile(fpath, data, 0644) != nil {
+			continue
+		}
+		if _, err := db.Exec(`INSERT INTO media_variants (id, media_id, name, storage_url, mime_type, width, height, file_size, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(media_id, name) DO UPDATE SET storage_url = excluded.storage_url, mime_type = excluded.mime_type,
+				width = excluded.width, height = excluded.height, file_size = excluded.file_size, created_at = excluded.created_at`, ids.New("mvar"), mediaID, t.name, fpath, mimeType, r.Dx(), r.Dy(), len(data), now); err != nil {
+			os.Remove(fpath)
+			continue
+		}
+		noteVaultWrite(int64(len(data)))
+		variants = append(variants, MediaVariant{Name: t.name, URL: "/media/" + name, MimeType: mimeType, Width: r.Dx(), Height: r.Dy(), FileSize: int64(len(data))})
+		if t.name != "thumb" {
+			src = img
+		}
+	}
+	sortVariants(variants)
+	return cfg.Width, cfg.Height, variants
+}
+
+// targetSize is the width a variant will have
+func targetSize(name string, box int, cfg image.Config) int {
+	if name == "thumb" && cfg.Height > cfg.Width {
+		return box * cfg.Width / cfg.Height
+	}
+	return box
+}
+
+// sortVariants puts the thumbnail first, then the widths smallest first
+func sortVariants(vs []MediaVariant) {
+	sort.SliceStable(vs, func(i, j int) bool {
+		if (vs[i].Name == "thumb") != (vs[j].Name == "thumb") {
+			return vs[i].Name == "thumb"
+		}
+		return vs[i].Width < vs[j].Width
+	})
+}
+
+// mediaVariants lists the variants of a media file
+func mediaVariants(mediaID string) []MediaVariant {
+	rows, err := db.Query(`SELECT name, storage_url, COALESCE(mime_type, ''), width, height, file_size FROM media_variants WHERE media_id = ?`, mediaID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var out []MediaVariant
+	for rows.Next() {
+		var v MediaVariant
+		var storageURL string
+		if rows.Scan(&v.Name, &storageURL, &v.MimeType, &v.Width, &v.Height, &v.FileSize) == nil {
+			_, name := mediaFile(storageURL)
+			v.URL = "/media/" + name
+			out = append(out, v)
+		}
+	}
+	sortVariants(out)
+	return out
+}
+
+// imageSrcset is the srcset of an image width px wide at url with variants,
+// using prefix in place of /media/
+func imageSrcset(url string, width int, variants []MediaVariant, prefix string) string {
+	var parts []string
+	for _, v := range variants {
+		if v.Name != "thumb" && v.Width < width {
+			parts = append(parts, fmt.Sprintf("%s%s %dw", prefix, strings.TrimPrefix(v.URL, "/media/"), v.Width))
+		}
+	}
+	if len(parts) == 0 || width == 0 {
+		return ""
+	}
+	return strings.Join(append(parts, fmt.Sprintf("%s%s %dw", prefix, strings.TrimPrefix(url, "/media/"), width)), ", ")
+}
+
+// fillMediaVariants adds an image's size, thumbnail and srcset to m
+func fillMediaVariants(m *MediaFile) {
+	db.QueryRow(`SELECT COALESCE(width, 0), COALESCE(height, 0) FROM media WHERE id = ?`, m.ID).Scan(&m.Width, &m.Height)
+	m.Variants = mediaVariants(m.ID)
+	_, name := mediaFile(m.StorageURL)
+	m.Srcset = imageSrcset("/media/"+name, m.Width, m.Variants, "/media/")
+	for _, v := range m.Variants {
+		if v.Name == "thumb" {
+			m.ThumbnailURL = v.URL
+		}
+	}
+}
+
+// mediaImage matches the <img> tags markdownToHTML writes for media files,
+// once /media/ has become prefix
+func mediaImage(prefix string) *regexp.Regexp {
+	return regexp.MustCompile(`<img src="` + regexp.QuoteMeta(prefix) + `([A-Za-z0-9._-]+)"`)
+}
+
+// responsiveImages gives the <img> tags of uploaded images in content a
+// srcset of their variants, whose URLs start with prefix like the tags' own
+func responsiveImages(content, prefix string) string {
+	re := mediaImage(prefix)
+	return re.ReplaceAllStringFunc(content, func(tag string) string {
+		name := re.FindStringSubmatch(tag)[1]
+		var mediaID string
+		var width int
+		if db.QueryRow(`SELECT id, COALESCE(width, 0) FROM media WHERE storage_url = ?`, filepath.Join("media", name)).Scan(&mediaID, &width) != nil {
+			return tag
+		}
+		srcset := imageSrcset("/media/"+name, width, mediaVariants(mediaID), prefix)
+		if srcset == "" {
+			return tag
+		}
+		return tag + ` srcset="` + html.EscapeString(srcset) + `" sizes="` + imageSizes + `"`
+	})
+}
+
+// variantFiles lists the variant files of the media file stored as name
+func variantFiles(name string) []string {
+	rows, err := db.Query(`SELECT v.storage_url FROM media_variants v JOIN media m ON m.id = v.media_id WHERE m.storage_url = ?`, filepath.Join("media", name))
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var storageURL string
+		if rows.Scan(&storageURL) == nil {
+			_, file := mediaFile(storageURL)
+			out = append(out, file)
+		}
+	}
+	return out
+}
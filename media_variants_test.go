@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseImageWidths(t *testing.T) {
+	if got := parseImageWidths("1280, 320,768"); len(got) != 3 || got[0] != 320 || got[2] != 1280 {
+		t.Fatalf("unexpected widths: %v", got)
+	}
+	if got := parseImageWidths("0"); len(got) != 0 {
+		t.Fatalf("0 should mean no widths, got %v", got)
+	}
+}
+
+func TestImageVariantsOnUpload(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "media-variants-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for y := 0; y < 500; y++ {
+		for x := 0; x < 1000; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0x80, 0xff})
+		}
+	}
+	var photo bytes.Buffer
+	jpeg.Encode(&photo, img, nil)
+
+	mux := setupRoutes()
+	upload := func(name string, data []byte) map[string]interface{} {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", name)
+		fw.Write(data)
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/media-upload", body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("upload %s: %d %s", name, rr.Code, rr.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	resp := upload("photo.jpg", photo.Bytes())
+	id, _ := resp["id"].(string)
+	stored := strings.TrimPrefix(resp["url"].(string), "/media/")
+	base := strings.TrimSuffix(stored, ".jpg")
+	// 1280 is wider than the original, so only 320, 768 and the thumbnail
+	if resp["width"] != 1000.0 || resp["thumbnail_url"] != "/media/"+base+".thumb.jpg" {
+		t.Fatalf("unexpected upload response: %+v", resp)
+	}
+	want := "/media/" + base + ".320w.jpg 320w, /media/" + base + ".768w.jpg 768w, /media/" + stored + " 1000w"
+	if resp["srcset"] != want {
+		t.Fatalf("unexpected srcset:\n got  %v\n want %s", resp["srcset"], want)
+	}
+	for name, size := range map[string][2]int{base + ".320w.jpg": {320, 160}, base + ".768w.jpg": {768, 384}, base + ".thumb.jpg": {200, 100}} {
+		f, err := os.Open(filepath.Join("media", name))
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		cfg, format, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || format != "jpeg" || cfg.Width != size[0] || cfg.Height != size[1] {
+			t.Fatalf("%s: %s %dx%d, want jpeg %dx%d", name, format, cfg.Width, cfg.Height, size[0], size[1])
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/media?id="+id, nil))
+	var media MediaFile
+	json.Unmarshal(rr.Body.Bytes(), &media)
+	if media.Width != 1000 || media.Height != 500 || len(media.Variants) != 3 || media.Variants[0].Name != "thumb" || media.Srcset != want {
+		t.Fatalf("unexpected media record: %+v", media)
+	}
+
+	// files that are not images are stored as they are
+	if resp := upload("notes.txt", []byte("hello")); resp["variants"] != nil || resp["srcset"] != nil {
+		t.Fatalf("a text file should get no variants: %+v", resp)
+	}
+
+	// exported pages offer the variants, with relative URLs
+	got := responsiveImages(markdownToHTML("![a photo](/media/"+stored+")"), "/media/")
+	if !strings.Contains(got, `<img src="/media/`+stored+`" srcset="/media/`+base+`.320w.jpg 320w,`) || !strings.Contains(got, `sizes="`+imageSizes+`"`) {
+		t.Fatalf("unexpected responsive image: %s", got)
+	}
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Photos', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('album', 'page', 's1', 'album.md', 'Album', '![a photo](/media/` + stored + `)', 'album', 'text/markdown', 'published', 1, 1)`)
+	out := filepath.Join(tmp, "dist")
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", IncludeAssets: true, Theme: "default"}, out); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(out, "album.html"))
+	if !strings.Contains(string(page), `srcset="media/`+base+`.320w.jpg 320w, media/`+base+`.768w.jpg 768w, media/`+stored+` 1000w"`) {
+		t.Fatalf("exported page should have a relative srcset: %s", page)
+	}
+	if _, err := os.Stat(filepath.Join(out, "media", base+".768w.jpg")); err != nil {
+		t.Fatalf("variants should be copied into the export: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+-- Codex links
+-- Bridges SQLite nodes with the URNs and commits that materialize them in the codex repository
+
+CREATE TABLE IF NOT EXISTS node_codex_links (
+    node_id TEXT PRIMARY KEY,
+    urn TEXT NOT NULL UNIQUE,
+    head_commit TEXT,
+    head_object TEXT,
+    updated_at INTEGER NOT NULL,
+    FOREIGN KEY (node_id) REFERENCES nodes(id)
+);
+
+CREATE TABLE IF NOT EXISTS node_codex_commits (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    urn TEXT NOT NULL,
+    commit_hash TEXT NOT NULL,
+    object_hash TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (node_id) REFERENCES nodes(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_codex_links_urn ON node_codex_links(urn);
+CREATE INDEX IF NOT EXISTS idx_node_codex_commits_node_id ON node_codex_commits(node_id);
+CREATE INDEX IF NOT EXISTS idx_node_codex_commits_commit ON node_codex_commits(commit_hash);
@@ -0,0 +1,19 @@
+-- Authentication
+-- Login sessions for the users table, plus per-user ownership of nodes and media
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+ALTER TABLE nodes ADD COLUMN owner_id TEXT REFERENCES users(id);
+ALTER TABLE media ADD COLUMN owner_id TEXT REFERENCES users(id);
+
+CREATE INDEX IF NOT EXISTS idx_nodes_owner_id ON nodes(owner_id);
+CREATE INDEX IF NOT EXISTS idx_media_owner_id ON media(owner_id);
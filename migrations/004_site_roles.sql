@@ -0,0 +1,16 @@
+-- Site roles
+-- Per-site access control: owner, editor or viewer. Sites without members keep
+-- the per-node ownership rules.
+
+CREATE TABLE IF NOT EXISTS site_members (
+    id TEXT PRIMARY KEY,
+    site_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    role TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    UNIQUE (site_id, user_id),
+    FOREIGN KEY (site_id) REFERENCES sites(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_site_members_user_id ON site_members(user_id);
@@ -0,0 +1,8 @@
+-- Publish job retries
+-- A retried job is a new publish_jobs row pointing at the failed one.
+
+ALTER TABLE publish_jobs ADD COLUMN retry_of TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_node_id ON publish_jobs(node_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_channel_id ON publish_jobs(channel_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_retry_of ON publish_jobs(retry_of);
@@ -0,0 +1,12 @@
+-- Job queue
+-- publish_jobs doubles as the persistent job queue: kind selects the handler,
+-- payload carries its input and failed attempts are retried at next_run_at.
+
+ALTER TABLE publish_jobs ADD COLUMN kind TEXT DEFAULT 'publish';
+ALTER TABLE publish_jobs ADD COLUMN payload TEXT;
+ALTER TABLE publish_jobs ADD COLUMN attempts INTEGER DEFAULT 0;
+ALTER TABLE publish_jobs ADD COLUMN max_attempts INTEGER;
+ALTER TABLE publish_jobs ADD COLUMN next_run_at INTEGER DEFAULT 0;
+ALTER TABLE publish_jobs ADD COLUMN started_at INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_status ON publish_jobs(status, next_run_at);
@@ -0,0 +1,7 @@
+-- SEO descriptions
+-- meta_description is generated at publish time unless an editor wrote and
+-- locked one. excerpt_locked likewise keeps a hand-written blog excerpt.
+
+ALTER TABLE nodes ADD COLUMN meta_description TEXT;
+ALTER TABLE nodes ADD COLUMN meta_description_locked INTEGER DEFAULT 0;
+ALTER TABLE blog_posts ADD COLUMN excerpt_locked INTEGER DEFAULT 0;
@@ -0,0 +1,8 @@
+-- Plugin quarantine
+-- status is 'active' once a plugin started and 'quarantined' when its
+-- Initialize failed or panicked at startup. Quarantined plugins are skipped
+-- until they are enabled again through /api/plugins-registry.
+
+ALTER TABLE plugins_registry ADD COLUMN status TEXT DEFAULT '';
+ALTER TABLE plugins_registry ADD COLUMN status_error TEXT;
+ALTER TABLE plugins_registry ADD COLUMN quarantined_at INTEGER;
@@ -0,0 +1,21 @@
+-- In-progress codex merges
+-- A merge that hits conflicts is saved here with the choices made so far so
+-- a client can resolve it over several requests and resume later.
+
+CREATE TABLE IF NOT EXISTS codex_merges (
+    id TEXT PRIMARY KEY,
+    base TEXT,
+    ours TEXT NOT NULL,
+    theirs TEXT NOT NULL,
+    author TEXT,
+    message TEXT,
+    conflicts TEXT NOT NULL,
+    resolutions TEXT,
+    status TEXT DEFAULT 'in_progress',
+    result TEXT,
+    created_by TEXT,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_codex_merges_status ON codex_merges(status);
@@ -0,0 +1,18 @@
+-- Plugin permissions
+-- Per-plugin, per-action role requirements for /api/plugin-execute. Rows
+-- override the built-in matrix, and action '*' sets a plugin-wide default.
+-- Admins may run every action. The first account becomes the admin.
+
+ALTER TABLE users ADD COLUMN is_admin INTEGER DEFAULT 0;
+
+UPDATE users SET is_admin = 1
+    WHERE id = (SELECT id FROM users WHERE password_hash IS NOT NULL ORDER BY created_at, id LIMIT 1)
+    AND NOT EXISTS (SELECT 1 FROM users WHERE is_admin = 1);
+
+CREATE TABLE IF NOT EXISTS plugin_permissions (
+    plugin TEXT NOT NULL,
+    action TEXT NOT NULL,
+    role TEXT NOT NULL,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (plugin, action)
+);
@@ -0,0 +1,22 @@
+-- Node assets
+-- Stylesheets and scripts from the media library attached to a node and
+-- loaded by its rendered pages, in position order. integrity is the SRI hash
+-- taken when the file was attached. sites.script_sources lists the extra
+-- origins, space separated, that a site's pages may load scripts and styles from.
+
+CREATE TABLE IF NOT EXISTS node_assets (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    media_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    integrity TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    UNIQUE(node_id, media_id),
+    FOREIGN KEY (node_id) REFERENCES nodes(id),
+    FOREIGN KEY (media_id) REFERENCES media(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_assets_node ON node_assets(node_id);
+
+ALTER TABLE sites ADD COLUMN script_sources TEXT;
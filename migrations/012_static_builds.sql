@@ -0,0 +1,22 @@
+-- Static builds
+-- Every file of a static build directory with the key it was built from,
+-- so later builds rewrite only files whose inputs changed, and the nodes each
+-- file depends on. output_dir is an absolute path.
+
+CREATE TABLE IF NOT EXISTS build_outputs (
+    output_dir TEXT NOT NULL,
+    path TEXT NOT NULL,
+    site_id TEXT NOT NULL,
+    build_key TEXT NOT NULL,
+    built_at INTEGER NOT NULL,
+    PRIMARY KEY (output_dir, path)
+);
+
+CREATE TABLE IF NOT EXISTS build_output_nodes (
+    output_dir TEXT NOT NULL,
+    path TEXT NOT NULL,
+    node_id TEXT NOT NULL,
+    PRIMARY KEY (output_dir, path, node_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_build_output_nodes_node ON build_output_nodes(node_id);
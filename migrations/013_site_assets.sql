@@ -0,0 +1,20 @@
+-- Site assets
+-- Fonts, icons, logos and images a site's themes use, stored under
+-- site-assets/<site_id>/<name>. family, font_weight and font_style describe
+-- fonts for the generated @font-face rules.
+
+CREATE TABLE IF NOT EXISTS site_assets (
+    id TEXT PRIMARY KEY,
+    site_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    mime_type TEXT,
+    family TEXT,
+    font_weight TEXT,
+    font_style TEXT,
+    file_size INTEGER,
+    hash TEXT,
+    created_at INTEGER NOT NULL,
+    UNIQUE(site_id, name),
+    FOREIGN KEY (site_id) REFERENCES sites(id)
+);
@@ -0,0 +1,12 @@
+-- Site deploys
+-- The files each deploy channel (s3, sftp, rsync) last pushed, with the
+-- SHA256 of their content, so a deploy transfers only files that changed and
+-- removes those the site no longer has.
+
+CREATE TABLE IF NOT EXISTS deployed_files (
+    channel_id TEXT NOT NULL,
+    path TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    deployed_at INTEGER NOT NULL,
+    PRIMARY KEY (channel_id, path)
+);
@@ -0,0 +1,23 @@
+-- Credentials
+-- Secrets of the credential manager, each sealed with AES-GCM under the key
+-- in credential_keys it names. A key is derived from the master passphrase
+-- and its salt, and check is a known value sealed under it, so a wrong
+-- passphrase is caught when the vault opens. Only one key is active.
+
+CREATE TABLE IF NOT EXISTS credential_keys (
+    id TEXT PRIMARY KEY,
+    salt BLOB NOT NULL,
+    iterations INTEGER NOT NULL,
+    check_value BLOB NOT NULL,
+    active INTEGER NOT NULL DEFAULT 1,
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS credentials (
+    key TEXT PRIMARY KEY,
+    key_id TEXT NOT NULL,
+    value BLOB NOT NULL,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL,
+    FOREIGN KEY (key_id) REFERENCES credential_keys(id)
+);
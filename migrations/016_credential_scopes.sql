@@ -0,0 +1,17 @@
+-- Credential scopes
+-- A credential bound to a plugin can only be read by that plugin, and an
+-- empty plugin means the core. The binding is part of the sealed value's
+-- additional data. Every read is logged, with granted = 0 for a plugin
+-- reaching for a credential that is not its own.
+
+ALTER TABLE credentials ADD COLUMN plugin TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS credential_access_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    plugin TEXT NOT NULL,
+    key TEXT NOT NULL,
+    granted INTEGER NOT NULL,
+    accessed_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_credential_access_log_plugin ON credential_access_log(plugin, accessed_at);
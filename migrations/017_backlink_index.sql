@@ -0,0 +1,30 @@
+-- Backlink index
+-- One row per linking pair, kept in step with node_references whenever a
+-- node's references are rewritten, so backlink lookups need no grouping.
+-- nodes.backlink_count caches how many live nodes link to each node. The
+-- backfill below is a no-op once the index is in step.
+
+CREATE TABLE IF NOT EXISTS node_backlinks (
+    target_node_id TEXT NOT NULL,
+    source_node_id TEXT NOT NULL,
+    link_count INTEGER NOT NULL DEFAULT 1,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (target_node_id, source_node_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_node_backlinks_source ON node_backlinks(source_node_id);
+
+ALTER TABLE nodes ADD COLUMN backlink_count INTEGER NOT NULL DEFAULT 0;
+
+INSERT INTO node_backlinks (target_node_id, source_node_id, link_count, updated_at)
+    SELECT target_node_id, source_node_id, COUNT(*), MAX(created_at) FROM node_references WHERE true
+    GROUP BY target_node_id, source_node_id
+    ON CONFLICT DO NOTHING;
+
+UPDATE nodes SET backlink_count = (
+    SELECT COUNT(*) FROM node_backlinks b JOIN nodes s ON s.id = b.source_node_id
+    WHERE b.target_node_id = nodes.id AND s.deleted_at IS NULL
+) WHERE backlink_count <> (
+    SELECT COUNT(*) FROM node_backlinks b JOIN nodes s ON s.id = b.source_node_id
+    WHERE b.target_node_id = nodes.id AND s.deleted_at IS NULL
+);
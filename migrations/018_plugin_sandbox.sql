@@ -0,0 +1,24 @@
+-- Plugin sandbox
+-- Per-plugin execution limits, with 0 meaning the built-in default, and a
+-- history of plugin calls with how long each took and how it ended
+-- (success, error, timeout, canceled, panic or rejected by a limit).
+
+CREATE TABLE IF NOT EXISTS plugin_limits (
+    plugin TEXT PRIMARY KEY,
+    timeout_ms INTEGER NOT NULL DEFAULT 0,
+    max_concurrent INTEGER NOT NULL DEFAULT 0,
+    max_payload_bytes INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS plugin_executions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    plugin TEXT NOT NULL,
+    action TEXT NOT NULL,
+    started_at INTEGER NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    outcome TEXT NOT NULL,
+    error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_plugin_executions_plugin ON plugin_executions(plugin, id);
@@ -0,0 +1,8 @@
+-- Node archival
+-- An archived node is kept and still resolves by id, path and URI, but is
+-- left out of default lists, search and site exports. archived_at is when it
+-- was archived, NULL for live nodes.
+
+ALTER TABLE nodes ADD COLUMN archived_at INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_nodes_archived_at ON nodes(archived_at);
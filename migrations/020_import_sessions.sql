@@ -0,0 +1,21 @@
+-- Import sessions
+-- An import is analyzed first: the parsed items, with their proposed titles,
+-- slugs, paths, sites and tags, wait here until the mapping is committed or
+-- discarded. status is analyzed, committed or discarded. items holds the
+-- items as JSON, content included.
+
+CREATE TABLE IF NOT EXISTS import_sessions (
+    id TEXT PRIMARY KEY,
+    format TEXT NOT NULL,
+    source TEXT,
+    status TEXT NOT NULL DEFAULT 'analyzed',
+    site_id TEXT,
+    new_site TEXT,
+    items TEXT NOT NULL,
+    result TEXT,
+    owner_id TEXT,
+    created_at INTEGER NOT NULL,
+    committed_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_sessions_created ON import_sessions(created_at);
@@ -0,0 +1,20 @@
+-- Node templates
+-- Reusable skeletons for new nodes: a type, a default title and content,
+-- front-matter fields with their defaults (JSON object, stored as the new
+-- node's metadata) and tags (JSON array). Nodes are started from one with
+-- POST /api/node-create?template=<slug> or veil new --template <slug>.
+
+CREATE TABLE IF NOT EXISTS node_templates (
+    id TEXT PRIMARY KEY,
+    slug TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    description TEXT,
+    node_type TEXT NOT NULL,
+    title TEXT,
+    content TEXT,
+    mime_type TEXT,
+    fields TEXT,
+    tags TEXT,
+    created_at INTEGER NOT NULL,
+    modified_at INTEGER NOT NULL
+);
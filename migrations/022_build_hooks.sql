@@ -0,0 +1,31 @@
+-- Build hooks
+-- build_hooks are tokens external systems send to
+-- POST /api/sites/{id}/build-hook to rebuild and deploy a site. Only a hash
+-- of each token is kept. publish_hooks notify a CI pipeline after a publish
+-- job for the site succeeds: target is "owner/repo" for a GitHub Actions
+-- repository_dispatch and a URL for a plain webhook.
+
+CREATE TABLE IF NOT EXISTS build_hooks (
+    id TEXT PRIMARY KEY,
+    site_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    last_triggered_at INTEGER,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (site_id) REFERENCES sites(id)
+);
+
+CREATE TABLE IF NOT EXISTS publish_hooks (
+    id TEXT PRIMARY KEY,
+    site_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    target TEXT NOT NULL,
+    event_type TEXT,
+    api_url TEXT,
+    active INTEGER DEFAULT 1,
+    last_status TEXT,
+    last_error TEXT,
+    last_sent_at INTEGER,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY (site_id) REFERENCES sites(id)
+);
@@ -0,0 +1,88 @@
+-- Content changes
+-- An append-only log of changes to published content, served as a paged
+-- feed at /api/feed/changes.json. A node is listed while it belongs to a
+-- site, is published, and is neither private, archived nor deleted. The
+-- triggers record an add when a node becomes listed, a delete when it stops
+-- being listed and an update when a listed node's content changes. seq
+-- orders the log, and feed pages are fixed ranges of it. Title and URI are
+-- kept as they were at the time of the change, so entries for nodes deleted
+-- later still say what went.
+
+CREATE TABLE IF NOT EXISTS content_changes (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    node_id TEXT NOT NULL,
+    site_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    title TEXT,
+    uri TEXT NOT NULL,
+    changed_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_changes_site ON content_changes(site_id, seq);
+
+-- nodes already published when the log is created
+INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+SELECT id, site_id, 'add', title,
+    COALESCE(NULLIF(canonical_uri, ''), 'veil://' || site_id || '/' || type || '/' || COALESCE(NULLIF(slug, ''), id)), modified_at
+FROM nodes
+WHERE COALESCE(site_id, '') != '' AND status IN ('published', 'public') AND deleted_at IS NULL AND archived_at IS NULL
+    AND COALESCE(visibility, 'public') != 'private'
+    AND NOT EXISTS (SELECT 1 FROM content_changes)
+ORDER BY modified_at, id;
+
+CREATE TRIGGER IF NOT EXISTS content_changes_insert AFTER INSERT ON nodes
+WHEN COALESCE(NEW.site_id, '') != '' AND NEW.status IN ('published', 'public') AND NEW.deleted_at IS NULL
+    AND NEW.archived_at IS NULL AND COALESCE(NEW.visibility, 'public') != 'private'
+BEGIN
+    INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+    VALUES (NEW.id, NEW.site_id, 'add', NEW.title,
+        COALESCE(NULLIF(NEW.canonical_uri, ''), 'veil://' || NEW.site_id || '/' || NEW.type || '/' || COALESCE(NULLIF(NEW.slug, ''), NEW.id)),
+        CAST(strftime('%s', 'now') AS INTEGER));
+END;
+
+CREATE TRIGGER IF NOT EXISTS content_changes_update AFTER UPDATE ON nodes
+BEGIN
+    -- unlisted, or moved to another site
+    INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+    SELECT OLD.id, OLD.site_id, 'delete', OLD.title,
+        COALESCE(NULLIF(OLD.canonical_uri, ''), 'veil://' || OLD.site_id || '/' || OLD.type || '/' || COALESCE(NULLIF(OLD.slug, ''), OLD.id)),
+        CAST(strftime('%s', 'now') AS INTEGER)
+    WHERE COALESCE(OLD.site_id, '') != '' AND OLD.status IN ('published', 'public') AND OLD.deleted_at IS NULL
+        AND OLD.archived_at IS NULL AND COALESCE(OLD.visibility, 'public') != 'private'
+        AND (NOT (COALESCE(NEW.site_id, '') != '' AND NEW.status IN ('published', 'public') AND NEW.deleted_at IS NULL
+            AND NEW.archived_at IS NULL AND COALESCE(NEW.visibility, 'public') != 'private') OR OLD.site_id IS NOT NEW.site_id);
+
+    -- listed, or moved in from another site
+    INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+    SELECT NEW.id, NEW.site_id, 'add', NEW.title,
+        COALESCE(NULLIF(NEW.canonical_uri, ''), 'veil://' || NEW.site_id || '/' || NEW.type || '/' || COALESCE(NULLIF(NEW.slug, ''), NEW.id)),
+        CAST(strftime('%s', 'now') AS INTEGER)
+    WHERE COALESCE(NEW.site_id, '') != '' AND NEW.status IN ('published', 'public') AND NEW.deleted_at IS NULL
+        AND NEW.archived_at IS NULL AND COALESCE(NEW.visibility, 'public') != 'private'
+        AND (NOT (COALESCE(OLD.site_id, '') != '' AND OLD.status IN ('published', 'public') AND OLD.deleted_at IS NULL
+            AND OLD.archived_at IS NULL AND COALESCE(OLD.visibility, 'public') != 'private') OR OLD.site_id IS NOT NEW.site_id);
+
+    -- edited while listed
+    INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+    SELECT NEW.id, NEW.site_id, 'update', NEW.title,
+        COALESCE(NULLIF(NEW.canonical_uri, ''), 'veil://' || NEW.site_id || '/' || NEW.type || '/' || COALESCE(NULLIF(NEW.slug, ''), NEW.id)),
+        CAST(strftime('%s', 'now') AS INTEGER)
+    WHERE COALESCE(NEW.site_id, '') != '' AND NEW.status IN ('published', 'public') AND NEW.deleted_at IS NULL
+        AND NEW.archived_at IS NULL AND COALESCE(NEW.visibility, 'public') != 'private'
+        AND COALESCE(OLD.site_id, '') != '' AND OLD.status IN ('published', 'public') AND OLD.deleted_at IS NULL
+        AND OLD.archived_at IS NULL AND COALESCE(OLD.visibility, 'public') != 'private'
+        AND OLD.site_id IS NEW.site_id
+        AND (OLD.title IS NOT NEW.title OR OLD.content IS NOT NEW.content OR OLD.slug IS NOT NEW.slug
+            OR OLD.canonical_uri IS NOT NEW.canonical_uri OR OLD.metadata IS NOT NEW.metadata
+            OR OLD.meta_description IS NOT NEW.meta_description OR OLD.type IS NOT NEW.type);
+END;
+
+CREATE TRIGGER IF NOT EXISTS content_changes_delete AFTER DELETE ON nodes
+WHEN COALESCE(OLD.site_id, '') != '' AND OLD.status IN ('published', 'public') AND OLD.deleted_at IS NULL
+    AND OLD.archived_at IS NULL AND COALESCE(OLD.visibility, 'public') != 'private'
+BEGIN
+    INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+    VALUES (OLD.id, OLD.site_id, 'delete', OLD.title,
+        COALESCE(NULLIF(OLD.canonical_uri, ''), 'veil://' || OLD.site_id || '/' || OLD.type || '/' || COALESCE(NULLIF(OLD.slug, ''), OLD.id)),
+        CAST(strftime('%s', 'now') AS INTEGER));
+END;
@@ -0,0 +1,21 @@
+-- Notifications
+-- The in-app notification center: due reminders, failed publish jobs, failed
+-- publish hook deliveries and mentions, addressed to a user, or to everyone
+-- when user_id is empty (vaults without accounts, nodes without owners).
+-- source_id is what the notification is about (a reminder, a job, the node
+-- with a mention), so each is only recorded once per user.
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL,
+    source_id TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT,
+    node_id TEXT,
+    read_at INTEGER,
+    created_at INTEGER NOT NULL,
+    UNIQUE (user_id, kind, source_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, read_at, created_at);
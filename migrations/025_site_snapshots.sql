@@ -0,0 +1,33 @@
+-- Site snapshots
+-- A named copy of every live node of a site at one moment. Restoring one
+-- brings the site back to it: each node gets its saved state as a new
+-- version, and nodes added since go to the trash. version_id is the version
+-- that was current when the snapshot was taken.
+
+CREATE TABLE IF NOT EXISTS site_snapshots (
+    id TEXT PRIMARY KEY,
+    site_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    description TEXT,
+    node_count INTEGER NOT NULL DEFAULT 0,
+    created_by TEXT,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_site_snapshots_site ON site_snapshots(site_id, created_at);
+
+CREATE TABLE IF NOT EXISTS site_snapshot_nodes (
+    snapshot_id TEXT NOT NULL,
+    node_id TEXT NOT NULL,
+    version_id TEXT,
+    type TEXT NOT NULL,
+    parent_id TEXT,
+    path TEXT NOT NULL,
+    title TEXT,
+    content TEXT,
+    slug TEXT,
+    metadata TEXT,
+    mime_type TEXT,
+    status TEXT,
+    PRIMARY KEY (snapshot_id, node_id)
+);
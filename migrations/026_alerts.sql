@@ -0,0 +1,38 @@
+-- Alerts
+-- System alerts for whoever runs the vault: publish jobs failing, backups
+-- failing, the disk filling up, plugins turning unhealthy. An alert is open
+-- until its condition clears. While open, repeats of the same kind and key
+-- only bump count and last_at, so one broken channel is one alert and not a
+-- flood. alert_transports are where alerts are sent: email, a webhook or a
+-- plugin (a chat bot), each optionally limited to some kinds and to critical
+-- alerts. Transport secrets live in the credential store, not in config.
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id TEXT PRIMARY KEY,
+    kind TEXT NOT NULL,
+    key TEXT NOT NULL,
+    severity TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT,
+    count INTEGER NOT NULL DEFAULT 1,
+    first_at INTEGER NOT NULL,
+    last_at INTEGER NOT NULL,
+    sent_at INTEGER,
+    resolved_at INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_alerts_open ON alerts(kind, key, resolved_at);
+
+CREATE TABLE IF NOT EXISTS alert_transports (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL,
+    config TEXT NOT NULL DEFAULT '{}',
+    kinds TEXT NOT NULL DEFAULT '',
+    min_severity TEXT NOT NULL DEFAULT 'warning',
+    active INTEGER DEFAULT 1,
+    last_status TEXT,
+    last_error TEXT,
+    last_sent_at INTEGER,
+    created_at INTEGER NOT NULL
+);
@@ -0,0 +1,29 @@
+-- Cold Storage
+-- Media files and codex blobs nobody has read for a while move to a
+-- secondary bucket, usually one in an archive class such as S3 Glacier.
+-- cold_objects is the stub each leaves behind: kind is media (key is the
+-- path under ./media) or codex (key is the object hash). state is cold until
+-- a read asks the bucket for a restore, then restoring until the object is
+-- brought back and its row removed. object_access records when objects were
+-- last read, so the sweep knows which ones went unread.
+
+CREATE TABLE IF NOT EXISTS cold_objects (
+    kind TEXT NOT NULL,
+    key TEXT NOT NULL,
+    size INTEGER NOT NULL DEFAULT 0,
+    content_type TEXT,
+    state TEXT NOT NULL DEFAULT 'cold',
+    tiered_at INTEGER NOT NULL,
+    restore_requested_at INTEGER,
+    last_error TEXT,
+    PRIMARY KEY (kind, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_cold_objects_state ON cold_objects(state);
+
+CREATE TABLE IF NOT EXISTS object_access (
+    kind TEXT NOT NULL,
+    key TEXT NOT NULL,
+    last_access_at INTEGER NOT NULL,
+    PRIMARY KEY (kind, key)
+);
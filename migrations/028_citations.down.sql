@@ -0,0 +1,12 @@
+-- Undoes 028_citations, dropping the imported citation fields
+
+DROP INDEX IF EXISTS idx_citations_node_key;
+
+ALTER TABLE citations DROP COLUMN entry_type;
+ALTER TABLE citations DROP COLUMN publisher;
+ALTER TABLE citations DROP COLUMN volume;
+ALTER TABLE citations DROP COLUMN issue;
+ALTER TABLE citations DROP COLUMN pages;
+ALTER TABLE citations DROP COLUMN doi;
+ALTER TABLE citations DROP COLUMN raw_bibtex;
+ALTER TABLE citations DROP COLUMN modified_at;
@@ -0,0 +1,16 @@
+-- Citation fields for BibTeX and CSL-JSON
+-- entry_type is the BibTeX entry type (article, book, inproceedings...),
+-- publication the journal, book or proceedings an entry appeared in, and
+-- format where the entry came from (bibtex, csl-json or manual). raw_bibtex
+-- keeps an imported entry as it was written.
+
+ALTER TABLE citations ADD COLUMN entry_type TEXT;
+ALTER TABLE citations ADD COLUMN publisher TEXT;
+ALTER TABLE citations ADD COLUMN volume TEXT;
+ALTER TABLE citations ADD COLUMN issue TEXT;
+ALTER TABLE citations ADD COLUMN pages TEXT;
+ALTER TABLE citations ADD COLUMN doi TEXT;
+ALTER TABLE citations ADD COLUMN raw_bibtex TEXT;
+ALTER TABLE citations ADD COLUMN modified_at INTEGER;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_citations_node_key ON citations(node_id, citation_key);
@@ -0,0 +1,6 @@
+-- Undoes 029_media_variants. The variant files stay in ./media.
+
+DROP TABLE IF EXISTS media_variants;
+
+ALTER TABLE media DROP COLUMN width;
+ALTER TABLE media DROP COLUMN height;
@@ -0,0 +1,22 @@
+-- Thumbnails and responsive widths of uploaded images
+-- name is thumb or the width followed by w (320w). The files sit next to the
+-- original in ./media, and storage_url is where, like media.storage_url.
+
+ALTER TABLE media ADD COLUMN width INTEGER;
+ALTER TABLE media ADD COLUMN height INTEGER;
+
+CREATE TABLE IF NOT EXISTS media_variants (
+    id TEXT PRIMARY KEY,
+    media_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    storage_url TEXT NOT NULL,
+    mime_type TEXT,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    file_size INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    UNIQUE(media_id, name),
+    FOREIGN KEY (media_id) REFERENCES media(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_media_variants_media ON media_variants(media_id);
@@ -0,0 +1,61 @@
+-- Undoes 030_publish_jobs_keys, putting the foreign keys back. Jobs and
+-- history that don't meet them, such as queued jobs of other kinds, are
+-- dropped.
+
+CREATE TABLE IF NOT EXISTS publish_jobs_new (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    version_id TEXT,
+    channel_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    progress INTEGER DEFAULT 0,
+    result TEXT,
+    error TEXT,
+    created_at INTEGER NOT NULL,
+    completed_at INTEGER,
+    retry_of TEXT,
+    kind TEXT DEFAULT 'publish',
+    payload TEXT,
+    attempts INTEGER DEFAULT 0,
+    max_attempts INTEGER,
+    next_run_at INTEGER DEFAULT 0,
+    started_at INTEGER,
+    FOREIGN KEY (node_id) REFERENCES nodes(id),
+    FOREIGN KEY (channel_id) REFERENCES publishing_channels(id)
+);
+
+INSERT INTO publish_jobs_new (id, node_id, version_id, channel_id, status, progress, result, error, created_at, completed_at,
+    retry_of, kind, payload, attempts, max_attempts, next_run_at, started_at)
+SELECT id, node_id, version_id, channel_id, status, progress, result, error, created_at, completed_at,
+    retry_of, kind, payload, attempts, max_attempts, next_run_at, started_at FROM publish_jobs
+WHERE node_id IN (SELECT id FROM nodes) AND channel_id IN (SELECT id FROM publishing_channels);
+
+DROP TABLE publish_jobs;
+
+ALTER TABLE publish_jobs_new RENAME TO publish_jobs;
+
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_node_id ON publish_jobs(node_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_channel_id ON publish_jobs(channel_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_retry_of ON publish_jobs(retry_of);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_status ON publish_jobs(status, next_run_at);
+
+CREATE TABLE IF NOT EXISTS publish_history_new (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    channel_id TEXT NOT NULL,
+    version_id TEXT,
+    published_at INTEGER NOT NULL,
+    result TEXT,
+    FOREIGN KEY (node_id) REFERENCES nodes(id),
+    FOREIGN KEY (channel_id) REFERENCES publishing_channels(id)
+);
+
+INSERT INTO publish_history_new (id, node_id, channel_id, version_id, published_at, result)
+SELECT id, node_id, channel_id, version_id, published_at, result FROM publish_history
+WHERE node_id IN (SELECT id FROM nodes) AND channel_id IN (SELECT id FROM publishing_channels);
+
+DROP TABLE publish_history;
+
+ALTER TABLE publish_history_new RENAME TO publish_history;
+
+CREATE INDEX IF NOT EXISTS idx_publish_history_node_id ON publish_history(node_id);
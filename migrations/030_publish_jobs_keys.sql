@@ -0,0 +1,58 @@
+-- Publish jobs without foreign keys
+-- Vault connections enforce foreign keys now. publish_jobs is also the
+-- queue for jobs of other kinds, which have no node or channel, and a
+-- rebuild a build hook asks for has no node. publish_history keeps
+-- mentioning nodes and channels after they are gone. Both tables are
+-- rebuilt without the keys SQLite can't drop in place.
+
+CREATE TABLE IF NOT EXISTS publish_jobs_new (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    version_id TEXT,
+    channel_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    progress INTEGER DEFAULT 0,
+    result TEXT,
+    error TEXT,
+    created_at INTEGER NOT NULL,
+    completed_at INTEGER,
+    retry_of TEXT,
+    kind TEXT DEFAULT 'publish',
+    payload TEXT,
+    attempts INTEGER DEFAULT 0,
+    max_attempts INTEGER,
+    next_run_at INTEGER DEFAULT 0,
+    started_at INTEGER
+);
+
+INSERT INTO publish_jobs_new (id, node_id, version_id, channel_id, status, progress, result, error, created_at, completed_at,
+    retry_of, kind, payload, attempts, max_attempts, next_run_at, started_at)
+SELECT id, node_id, version_id, channel_id, status, progress, result, error, created_at, completed_at,
+    retry_of, kind, payload, attempts, max_attempts, next_run_at, started_at FROM publish_jobs;
+
+DROP TABLE publish_jobs;
+
+ALTER TABLE publish_jobs_new RENAME TO publish_jobs;
+
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_node_id ON publish_jobs(node_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_channel_id ON publish_jobs(channel_id);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_retry_of ON publish_jobs(retry_of);
+CREATE INDEX IF NOT EXISTS idx_publish_jobs_status ON publish_jobs(status, next_run_at);
+
+CREATE TABLE IF NOT EXISTS publish_history_new (
+    id TEXT PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    channel_id TEXT NOT NULL,
+    version_id TEXT,
+    published_at INTEGER NOT NULL,
+    result TEXT
+);
+
+INSERT INTO publish_history_new (id, node_id, channel_id, version_id, published_at, result)
+SELECT id, node_id, channel_id, version_id, published_at, result FROM publish_history;
+
+DROP TABLE publish_history;
+
+ALTER TABLE publish_history_new RENAME TO publish_history;
+
+CREATE INDEX IF NOT EXISTS idx_publish_history_node_id ON publish_history(node_id);
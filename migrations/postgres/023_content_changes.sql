@@ -0,0 +1,80 @@
+-- Content changes
+-- The PostgreSQL version of 023_content_changes.sql. The log is the same,
+-- and one trigger function does what the three SQLite triggers do.
+
+CREATE TABLE IF NOT EXISTS content_changes (
+    seq BIGSERIAL PRIMARY KEY,
+    node_id TEXT NOT NULL,
+    site_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    title TEXT,
+    uri TEXT NOT NULL,
+    changed_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_changes_site ON content_changes(site_id, seq);
+
+-- nodes already published when the log is created
+INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+SELECT id, site_id, 'add', title,
+    COALESCE(NULLIF(canonical_uri, ''), 'veil://' || site_id || '/' || type || '/' || COALESCE(NULLIF(slug, ''), id)), modified_at
+FROM nodes
+WHERE COALESCE(site_id, '') != '' AND status IN ('published', 'public') AND deleted_at IS NULL AND archived_at IS NULL
+    AND COALESCE(visibility, 'public') != 'private'
+    AND NOT EXISTS (SELECT 1 FROM content_changes)
+ORDER BY modified_at, id;
+
+CREATE OR REPLACE FUNCTION content_changes_log() RETURNS trigger AS $$
+DECLARE
+    was_listed BOOLEAN := false;
+    is_listed BOOLEAN := false;
+    moved BOOLEAN := false;
+    now_unix BIGINT := EXTRACT(EPOCH FROM now())::BIGINT;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        was_listed := COALESCE(OLD.site_id, '') != '' AND OLD.status IN ('published', 'public') AND OLD.deleted_at IS NULL
+            AND OLD.archived_at IS NULL AND COALESCE(OLD.visibility, 'public') != 'private';
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        is_listed := COALESCE(NEW.site_id, '') != '' AND NEW.status IN ('published', 'public') AND NEW.deleted_at IS NULL
+            AND NEW.archived_at IS NULL AND COALESCE(NEW.visibility, 'public') != 'private';
+    END IF;
+    IF TG_OP = 'UPDATE' THEN
+        moved := OLD.site_id IS DISTINCT FROM NEW.site_id;
+    END IF;
+
+    -- unlisted, deleted or moved to another site
+    IF was_listed AND (NOT is_listed OR moved) THEN
+        INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+        VALUES (OLD.id, OLD.site_id, 'delete', OLD.title,
+            COALESCE(NULLIF(OLD.canonical_uri, ''), 'veil://' || OLD.site_id || '/' || OLD.type || '/' || COALESCE(NULLIF(OLD.slug, ''), OLD.id)),
+            now_unix);
+    END IF;
+
+    -- listed, created listed or moved in from another site
+    IF is_listed AND (NOT was_listed OR moved) THEN
+        INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+        VALUES (NEW.id, NEW.site_id, 'add', NEW.title,
+            COALESCE(NULLIF(NEW.canonical_uri, ''), 'veil://' || NEW.site_id || '/' || NEW.type || '/' || COALESCE(NULLIF(NEW.slug, ''), NEW.id)),
+            now_unix);
+    END IF;
+
+    -- edited while listed
+    IF was_listed AND is_listed AND NOT moved THEN
+        IF OLD.title IS DISTINCT FROM NEW.title OR OLD.content IS DISTINCT FROM NEW.content OR OLD.slug IS DISTINCT FROM NEW.slug
+            OR OLD.canonical_uri IS DISTINCT FROM NEW.canonical_uri OR OLD.metadata IS DISTINCT FROM NEW.metadata
+            OR OLD.meta_description IS DISTINCT FROM NEW.meta_description OR OLD.type IS DISTINCT FROM NEW.type THEN
+            INSERT INTO content_changes (node_id, site_id, action, title, uri, changed_at)
+            VALUES (NEW.id, NEW.site_id, 'update', NEW.title,
+                COALESCE(NULLIF(NEW.canonical_uri, ''), 'veil://' || NEW.site_id || '/' || NEW.type || '/' || COALESCE(NULLIF(NEW.slug, ''), NEW.id)),
+                now_unix);
+        END IF;
+    END IF;
+    RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS content_changes_log ON nodes;
+
+CREATE TRIGGER content_changes_log AFTER INSERT OR UPDATE OR DELETE ON nodes
+FOR EACH ROW EXECUTE FUNCTION content_changes_log();
@@ -2,6 +2,8 @@ package main
 
 import (
 	"time"
+
+	plugins "veil/pkg/plugins"
 )
 
 // === Node Types ===
@@ -18,28 +20,35 @@ const (
 	NodeTypeDocument    = "document"
 	NodeTypeTodo        = "todo"
 	NodeTypeReminder    = "reminder"
+	NodeTypeTable       = "table"
 )
 
 // === Types ===
 type Node struct {
-	ID           string    `json:"id"`
-	Type         string    `json:"type"`
-	ParentID     string    `json:"parent_id,omitempty"`
-	Path         string    `json:"path"`
-	Title        string    `json:"title"`
-	Content      string    `json:"content"`
-	Slug         string    `json:"slug,omitempty"`
-	CanonicalURI string    `json:"canonical_uri,omitempty"`
-	Body         string    `json:"body,omitempty"`     // JSON structured body
-	Metadata     string    `json:"metadata,omitempty"` // JSON metadata
-	MimeType     string    `json:"mime_type"`
-	CreatedAt    time.Time `json:"created_at"`
-	ModifiedAt   time.Time `json:"modified_at"`
-	Tags         []string  `json:"tags,omitempty"`
-	References   []string  `json:"references,omitempty"`
-	Visibility   string    `json:"visibility,omitempty"`
-	Status       string    `json:"status,omitempty"`
-	SiteID       string    `json:"site_id,omitempty"`
+	ID           string       `json:"id"`
+	Type         string       `json:"type" validate:"required,max=64"`
+	ParentID     string       `json:"parent_id,omitempty" validate:"max=128"`
+	Path         string       `json:"path" validate:"required,max=1024"`
+	Title        string       `json:"title" validate:"max=500"`
+	Content      string       `json:"content"`
+	Slug         string       `json:"slug,omitempty" validate:"max=255"`
+	CanonicalURI string       `json:"canonical_uri,omitempty"`
+	Body         string       `json:"body,omitempty"`     // JSON structured body
+	Metadata     string       `json:"metadata,omitempty"` // JSON metadata
+	FrontMatter  *FrontMatter `json:"front_matter,omitempty"`
+	MimeType     string       `json:"mime_type"`
+	CreatedAt    time.Time    `json:"created_at"`
+	ModifiedAt   time.Time    `json:"modified_at"`
+	Tags         []string     `json:"tags,omitempty"`
+	References   []string     `json:"references,omitempty"`
+	Visibility   string       `json:"visibility,omitempty" validate:"oneof=public|private|draft"`
+	Status       string       `json:"status,omitempty"`
+	SiteID       string       `json:"site_id,omitempty" validate:"max=128"`
+	OwnerID      string       `json:"owner_id,omitempty"`
+	// BacklinkCount is how many live nodes link here, from the backlink index
+	BacklinkCount int `json:"backlink_count,omitempty"`
+	// ArchivedAt is set while the node is archived
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
 }
 
 type Version struct {
@@ -65,16 +74,23 @@ type BlogPost struct {
 }
 
 type MediaFile struct {
-	ID               string    `json:"id"`
-	NodeID           string    `json:"node_id"`
-	Filename         string    `json:"filename"`
-	OriginalFilename string    `json:"original_filename"`
-	MimeType         string    `json:"mime_type"`
-	FileSize         int64     `json:"file_size"`
-	Checksum         string    `json:"checksum"`
-	StorageURL       string    `json:"storage_url"`
-	UploadedBy       string    `json:"uploaded_by"`
-	CreatedAt        time.Time `json:"created_at"`
+	ID               string         `json:"id"`
+	NodeID           string         `json:"node_id"`
+	Filename         string         `json:"filename"`
+	OriginalFilename string         `json:"original_filename"`
+	MimeType         string         `json:"mime_type"`
+	FileSize         int64          `json:"file_size"`
+	Checksum         string         `json:"checksum"`
+	StorageURL       string         `json:"storage_url"`
+	UploadedBy       string         `json:"uploaded_by"`
+	OwnerID          string         `json:"owner_id,omitempty"`
+	ColdState        string         `json:"cold_state,omitempty"` // cold or restoring while in cold storage
+	Width            int            `json:"width,omitempty"`
+	Height           int            `json:"height,omitempty"`
+	ThumbnailURL     string         `json:"thumbnail_url,omitempty"`
+	Variants         []MediaVariant `json:"variants,omitempty"`
+	Srcset           string         `json:"srcset,omitempty"`
+	CreatedAt        time.Time      `json:"created_at"`
 }
 
 type Reference struct {
@@ -91,25 +107,32 @@ type Tag struct {
 	Color string `json:"color"`
 }
 
+// Citation is a bibliography entry of a node. Authors are in BibTeX form,
+// "Family, Given and Family, Given".
 type Citation struct {
 	ID             string `json:"id"`
 	NodeID         string `json:"node_id"`
-	CitationKey    string `json:"citation_key"`
-	Authors        string `json:"authors"`
-	Title          string `json:"title"`
+	CitationKey    string `json:"citation_key" validate:"max=255"`
+	EntryType      string `json:"entry_type" validate:"max=64"`
+	Authors        string `json:"authors" validate:"max=4000"`
+	Title          string `json:"title" validate:"required,max=1000"`
 	Year           int    `json:"year"`
-	Publisher      string `json:"publisher"`
-	URL            string `json:"url"`
-	DOI            string `json:"doi"`
+	Publication    string `json:"publication" validate:"max=1000"`
+	Publisher      string `json:"publisher" validate:"max=500"`
+	Volume         string `json:"volume" validate:"max=64"`
+	Issue          string `json:"issue" validate:"max=64"`
+	Pages          string `json:"pages" validate:"max=64"`
+	URL            string `json:"url" validate:"max=2048"`
+	DOI            string `json:"doi" validate:"max=255"`
 	CitationFormat string `json:"citation_format"`
-	RawBibtex      string `json:"raw_bibtex"`
+	RawBibtex      string `json:"raw_bibtex,omitempty"`
 }
 
 type Site struct {
 	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Type        string    `json:"type"` // project, portfolio, blog, etc
+	Name        string    `json:"name" validate:"required,max=200"`
+	Description string    `json:"description" validate:"max=2000"`
+	Type        string    `json:"type" validate:"max=64"` // project, portfolio, blog, etc
 	CreatedAt   time.Time `json:"created_at"`
 	ModifiedAt  time.Time `json:"modified_at"`
 }
@@ -122,12 +145,16 @@ type NodeURI struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-type PluginManifest struct {
+// Publishing channels and jobs are run by the plugins package
+type (
+	PublishingChannel = plugins.PublishingChannel
+	PublishJob        = plugins.PublishJob
+)
+
+type User struct {
 	ID        string    `json:"id"`
-	Name      string    `json:"name"`
-	Slug      string    `json:"slug"`
-	Manifest  string    `json:"manifest"`
-	Enabled   bool      `json:"enabled"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email,omitempty"`
+	IsAdmin   bool      `json:"is_admin,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Node Assets ===
+// A node can load stylesheets and scripts from the media library, such as the
+// code behind a shader demo or a canvas piece. Assets are linked from the
+// rendered page with subresource integrity, never inlined, so the page's CSP
+// (see pageCSP) can refuse inline script. Stylesheets are checked when they
+// are attached: imports, external urls and script hooks are refused.
+
+// NodeAsset is a stylesheet or script attached to a node
+type NodeAsset struct {
+	ID        string `json:"id"`
+	NodeID    string `json:"node_id" validate:"required,max=128"`
+	MediaID   string `json:"media_id" validate:"required,max=128"`
+	Kind      string `json:"kind"`
+	Position  int    `json:"position" validate:"min=0"`
+	Integrity string `json:"integrity"`
+	Filename  string `json:"filename"`
+	URL       string `json:"url"`
+}
+
+// nodeAssetMaxBytes bounds an attached stylesheet or script
+const nodeAssetMaxBytes = 2 << 20
+
+// mediaFile is where a media row's file lives on disk and the name it is
+// served under at /media/
+func mediaFile(storageURL string) (diskPath, name string) {
+	name = path.Base(strings.TrimPrefix(storageURL, "/"))
+	return filepath.Join("media", name), name
+}
+
+// assetKind is style or script for CSS and JavaScript files, "" otherwise
+func assetKind(mimeType, filename string) string {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	switch {
+	case mimeType == "text/css" || strings.HasSuffix(strings.ToLower(filename), ".css"):
+		return "style"
+	case mimeType == "text/javascript" || mimeType == "application/javascript" ||
+		strings.HasSuffix(strings.ToLower(filename), ".js") || strings.HasSuffix(strings.ToLower(filename), ".mjs"):
+		return "script"
+	}
+	return ""
+}
+
+var (
+	cssComment   = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssImport    = regexp.MustCompile(`(?i)@import`)
+	cssURL       = regexp.MustCompile(`(?i)url\(\s*['"]?([^'")]*)`)
+	cssScripting = regexp.MustCompile(`(?i)expression\s*\(|behavior\s*:|-moz-binding|javascript:|</style`)
+)
+
+// sanitizeCSS lists what makes a stylesheet unsafe to attach: @import,
+// url()s leaving the site (data: images aside) and legacy script hooks
+func sanitizeCSS(css string) []string {
+	css = cssComment.ReplaceAllString(css, "")
+	var problems []string
+	if cssImport.MatchString(css) {
+		problems = append(problems, "@import is not allowed, attach each stylesheet instead")
+	}
+	for _, m := range cssURL.FindAllStringSubmatch(css, -1) {
+		u := strings.ToLower(strings.TrimSpace(m[1]))
+		if strings.HasPrefix(u, "data:image/") || (!strings.Contains(u, ":") && !strings.HasPrefix(u, "//")) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("url(%s) leaves the site", m[1]))
+	}
+	if m := cssScripting.FindString(css); m != "" {
+		problems = append(problems, fmt.Sprintf("%q is not allowed", m))
+	}
+	return problems
+}
+
+// sriHash is the subresource integrity value for data
+func sriHash(data []byte) string {
+	sum := sha512.Sum384(data)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// nodeAssets lists a node's assets in load order
+func nodeAssets(nodeID string) ([]NodeAsset, error) {
+	rows, err := db.Query(`SELECT a.id, a.node_id, a.media_id, a.kind, a.position, a.integrity, COALESCE(m.filename, ''), COALESCE(m.storage_url, '')
+		FROM node_assets a JOIN media m ON m.id = a.media_id WHERE a.node_id = ? ORDER BY a.position, a.created_at, a.id`, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []NodeAsset
+	for rows.Next() {
+		var a NodeAsset
+		var storage string
+		if err := rows.Scan(&a.ID, &a.NodeID, &a.MediaID, &a.Kind, &a.Position, &a.Integrity, &a.Filename, &storage); err != nil {
+			return nil, err
+		}
+		_, name := mediaFile(storage)
+		a.URL = "/media/" + name
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// assetTags renders link tags for the stylesheets, for <head>, and script
+// tags for the scripts, for the end of <body>. url maps an asset to the
+// address the page should load it from.
+func assetTags(assets []NodeAsset, url func(NodeAsset) string) (styles, scripts string) {
+	var s, j strings.Builder
+	for _, a := range assets {
+		href := html.EscapeString(url(a))
+		switch a.Kind {
+		case "style":
+			fmt.Fprintf(&s, "<link rel=\"stylesheet\" href=\"%s\" integrity=\"%s\">\n", href, a.Integrity)
+		case "script":
+			fmt.Fprintf(&j, "<script src=\"%s\" integrity=\"%s\"></script>\n", href, a.Integrity)
+		}
+	}
+	return s.String(), j.String()
+}
+
+// shaderDemoBody renders a shader node. The GLSL source travels as JSON
+// data, not code: /shader-runner.js compiles it, and the node's script
+// assets can take over from there.
+func shaderDemoBody(node Node) string {
+	data, _ := json.Marshal(map[string]string{"title": node.Title, "fragment": node.Content})
+	return fmt.Sprintf(`<canvas id="shaderCanvas" style="width: 100%%; height: 80vh; display: block;"></canvas>
+<script type="application/json" id="node-content">%s</script>
+<script src="/shader-runner.js"></script>`, data)
+}
+
+var (
+	svgUnsafeElement = regexp.MustCompile(`(?is)<(script|foreignObject|iframe|embed|object)\b.*?(</\s*(script|foreignObject|iframe|embed|object)\s*>|/>)`)
+	svgEventAttr     = regexp.MustCompile(`(?i)\s+on[a-z]+\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+	svgScriptURL     = regexp.MustCompile(`(?i)((?:xlink:)?href\s*=\s*["']?)\s*javascript:[^"'\s>]*`)
+)
+
+// sanitizeSVG strips what would let canvas markup run code: script and
+// embedding elements, event handler attributes and javascript: links
+func sanitizeSVG(svg string) string {
+	svg = svgUnsafeElement.ReplaceAllString(svg, "")
+	svg = svgEventAttr.ReplaceAllString(svg, "")
+	return svgScriptURL.ReplaceAllString(svg, "${1}#")
+}
+
+// renderedBody is the page body for a node, by type
+func renderedBody(node Node) string {
+	switch node.Type {
+	case "shader":
+		return shaderDemoBody(node)
+	case "canvas":
+		return `<div style="text-align: center;">` + sanitizeSVG(node.Content) + `</div>`
+	case NodeTypeTable:
+		return tableBody(node)
+	}
+	return stripFrontMatter(node.Content)
+}
+
+// /api/node-assets: GET ?node_id= lists a node's assets, POST {node_id,
+// media_id, position} attaches a CSS or JavaScript file from the media
+// library, DELETE ?id= detaches one. Changes need edit rights on the node.
+func handleNodeAssets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		nodeID := r.URL.Query().Get("node_id")
+		if !canReadNode(r, nodeID) {
+			apierror.Write(w, http.StatusNotFound, "node not found")
+			return
+		}
+		assets, err := nodeAssets(nodeID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if assets == nil {
+			assets = []NodeAsset{}
+		}
+		json.NewEncoder(w).Encode(assets)
+	case "POST":
+		var a NodeAsset
+		if err := validate.DecodeJSON(r.Body, &a); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if !canModifyNode(r, a.NodeID) {
+			apierror.Write(w, http.StatusForbidden, "editor role required to change this node's assets")
+			return
+		}
+		var mimeType, storage string
+		if err := db.QueryRow(`SELECT COALESCE(mime_type, ''), COALESCE(filename, ''), COALESCE(storage_url, '') FROM media WHERE id = ?`, a.MediaID).
+			Scan(&mimeType, &a.Filename, &storage); err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "media_id", Message: "is not in the media library"}})
+			return
+		}
+		a.Kind = assetKind(mimeType, a.Filename)
+		if a.Kind == "" {
+			validate.WriteError(w, validate.Errors{{Field: "media_id", Message: "must be a CSS or JavaScript file"}})
+			return
+		}
+		diskPath, name := mediaFile(storage)
+		data, err := os.ReadFile(diskPath)
+		if err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "media_id", Message: "file is missing from the media folder"}})
+			return
+		}
+		if len(data) > nodeAssetMaxBytes {
+			validate.WriteError(w, validate.Errors{{Field: "media_id", Message: fmt.Sprintf("must be at most %d bytes", nodeAssetMaxBytes)}})
+			return
+		}
+		if a.Kind == "style" {
+			if problems := sanitizeCSS(string(data)); len(problems) > 0 {
+				validate.WriteError(w, validate.Errors{{Field: "media_id", Message: strings.Join(problems, "; ")}})
+				return
+			}
+		}
+		a.ID = ids.New("asset")
+		a.Integrity = sriHash(data)
+		a.URL = "/media/" + name
+		if _, err := db.Exec(`INSERT INTO node_assets (id, node_id, media_id, kind, position, integrity, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT(node_id, media_id) DO UPDATE SET position = excluded.position, integrity = excluded.integrity`,
+			a.ID, a.NodeID, a.MediaID, a.Kind, a.Position, a.Integrity, time.Now().Unix()); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		db.QueryRow(`SELECT id FROM node_assets WHERE node_id = ? AND media_id = ?`, a.NodeID, a.MediaID).Scan(&a.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		var nodeID string
+		if db.QueryRow(`SELECT node_id FROM node_assets WHERE id = ?`, id).Scan(&nodeID) != nil {
+			apierror.Write(w, http.StatusNotFound, "asset not found")
+			return
+		}
+		if !canModifyNode(r, nodeID) {
+			apierror.Write(w, http.StatusForbidden, "editor role required to change this node's assets")
+			return
+		}
+		db.Exec(`DELETE FROM node_assets WHERE id = ?`, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
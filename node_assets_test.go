@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeCSS(t *testing.T) {
+	if problems := sanitizeCSS(`body { background: url("bg.png") } i { background: url(data:image/png;base64,AA) } /* @import "x" */`); len(problems) != 0 {
+		t.Fatalf("safe stylesheet rejected: %v", problems)
+	}
+	for _, css := range []string{
+		`@import "https://evil.example/x.css";`,
+		`a { background: url(https://evil.example/track.png) }`,
+		`a { background: url(//evil.example/track.png) }`,
+		`a { width: expression(alert(1)) }`,
+		`a { -moz-binding: url(x.xml#y) }`,
+	} {
+		if len(sanitizeCSS(css)) == 0 {
+			t.Errorf("expected %q to be rejected", css)
+		}
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	out := sanitizeSVG(`<svg onload="alert(1)"><script>alert(2)</script><a xlink:href="javascript:alert(3)"><circle r="4" onclick='x()'/></a><foreignObject><p>x</p></foreignObject></svg>`)
+	for _, bad := range []string{"onload", "onclick", "<script", "javascript:", "foreignObject"} {
+		if strings.Contains(out, bad) {
+			t.Fatalf("%q survived sanitizing: %s", bad, out)
+		}
+	}
+	if !strings.Contains(out, `<circle r="4"/>`) {
+		t.Fatalf("safe markup was lost: %s", out)
+	}
+}
+
+func TestNodeAssets(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "assets-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	os.MkdirAll("media", 0755)
+	ioutil.WriteFile(filepath.Join("media", "media_1_demo.css"), []byte("canvas { border: 1px solid }"), 0644)
+	ioutil.WriteFile(filepath.Join("media", "media_2_demo.js"), []byte("veilShader.playing = false"), 0644)
+	ioutil.WriteFile(filepath.Join("media", "media_3_bad.css"), []byte("@import 'https://evil.example/x.css';"), 0644)
+	ioutil.WriteFile(filepath.Join("media", "media_4_cat.png"), []byte("PNG"), 0644)
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Demos', '', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, status, created_at, modified_at) VALUES
+		('n1', 'shader', 's1', 'wave.glsl', 'Wave', 'void main() { gl_FragColor = vec4(1.0); }', 'text/x-glsl', 'published', 1, 1)`)
+	testDB.Exec(`INSERT INTO media (id, filename, mime_type, storage_url, created_at) VALUES
+		('m1', 'demo.css', 'text/css', 'media/media_1_demo.css', 1),
+		('m2', 'demo.js', 'application/javascript', '/media/media_2_demo.js', 1),
+		('m3', 'bad.css', 'text/css', 'media/media_3_bad.css', 1),
+		('m4', 'cat.png', 'image/png', 'media/media_4_cat.png', 1)`)
+
+	mux := setupRoutes()
+	attach := func(mediaID string, position int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"node_id": "n1", "media_id": mediaID, "position": position})
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/node-assets", bytes.NewReader(body)))
+		return rr
+	}
+
+	rr := attach("m2", 1)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("attach script: %d %s", rr.Code, rr.Body.String())
+	}
+	var script NodeAsset
+	json.NewDecoder(rr.Body).Decode(&script)
+	if script.Kind != "script" || script.Integrity != sriHash([]byte("veilShader.playing = false")) {
+		t.Fatalf("unexpected asset: %+v", script)
+	}
+	if rr := attach("m1", 0); rr.Code != http.StatusCreated {
+		t.Fatalf("attach stylesheet: %d %s", rr.Code, rr.Body.String())
+	}
+	for _, id := range []string{"m3", "m4", "missing"} {
+		if rr := attach(id, 0); rr.Code != http.StatusBadRequest {
+			t.Fatalf("attaching %s should fail validation, got %d", id, rr.Code)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/node-assets?node_id=n1", nil))
+	var assets []NodeAsset
+	json.NewDecoder(rr.Body).Decode(&assets)
+	if len(assets) != 2 || assets[0].MediaID != "m1" || assets[1].MediaID != "m2" {
+		t.Fatalf("expected stylesheet then script, got %+v", assets)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/preview/s1/n1", nil))
+	page := rr.Body.String()
+	if !strings.Contains(page, `<link rel="stylesheet" href="/media/media_1_demo.css" integrity="sha384-`) ||
+		!strings.Contains(page, `<script src="/media/media_2_demo.js" integrity="`+script.Integrity+`"></script>`) ||
+		!strings.Contains(page, `<script src="/shader-runner.js"></script>`) {
+		t.Fatalf("preview is missing asset tags: %s", page)
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'self';") || !strings.Contains(csp, "object-src 'none'") {
+		t.Fatalf("unexpected CSP: %q", csp)
+	}
+
+	zipped, err := ExportSiteAsStatic(ExportOptions{SiteID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(zipped, []byte("assets/media_2_demo.js")) || !bytes.Contains(zipped, []byte("shader-runner.js")) {
+		t.Fatalf("static export is missing the node's assets")
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/node-assets?id="+script.ID, nil))
+	if left, _ := nodeAssets("n1"); rr.Code != http.StatusNoContent || len(left) != 1 {
+		t.Fatalf("detach: %d, %d assets left", rr.Code, len(left))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"veil/pkg/client"
+)
+
+func TestNodeCommands(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "node-cli-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', 'words', 'blog', 1, 1)`)
+	post := Node{Type: "post", Path: "posts/hello.md", Title: "Hello", Content: "# Hello\n\nA first post.", MimeType: "text/markdown", SiteID: "s1", Slug: "hello"}
+	note := Node{Type: "note", Path: "notes/ideas.md", Title: "Ideas", Content: "more posts", MimeType: "text/markdown"}
+	for _, n := range []*Node{&post, &note} {
+		if err := insertNode(n, "tester"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// by ID or by path
+	for _, ref := range []string{post.ID, post.Path} {
+		found, err := findNode(ref)
+		if err != nil || found.ID != post.ID || found.Content != post.Content || found.SiteID != "s1" {
+			t.Fatalf("findNode(%s) = %+v, %v", ref, found, err)
+		}
+	}
+	if _, err := findNode("nope"); err != sql.ErrNoRows {
+		t.Fatalf("a missing node should be sql.ErrNoRows, got %v", err)
+	}
+
+	nodes, err := searchNodes("post", "", 0)
+	if err != nil || len(nodes) != 2 || nodes[0].ID != note.ID {
+		t.Fatalf("searchNodes: %+v %v", nodes, err)
+	}
+	if nodes, _ := searchNodes("post", "s1", 0); len(nodes) != 1 || nodes[0].ID != post.ID {
+		t.Fatalf("searchNodes in s1: %+v", nodes)
+	}
+	if nodes, _ := searchNodes("post", "", 1); len(nodes) != 1 {
+		t.Fatalf("searchNodes with a limit: %+v", nodes)
+	}
+
+	versionID, err := publishCurrentVersion(post.ID)
+	if err != nil || versionID == "" {
+		t.Fatalf("publishCurrentVersion: %q %v", versionID, err)
+	}
+	var status string
+	testDB.QueryRow(`SELECT status FROM versions WHERE id = ?`, versionID).Scan(&status)
+	if status != "published" {
+		t.Fatalf("the current version should be published, is %q", status)
+	}
+
+	found, _ := findNode(post.ID)
+	exports := map[string]string{}
+	for _, format := range []string{"md", "json", "html", "rss", "zip"} {
+		data, err := exportNodeAs(found, format)
+		if err != nil {
+			t.Fatalf("export %s: %v", format, err)
+		}
+		exports[format] = string(data)
+	}
+	if exports["md"] != post.Content {
+		t.Fatalf("md export: %q", exports["md"])
+	}
+	var decoded Node
+	if err := json.Unmarshal([]byte(exports["json"]), &decoded); err != nil || decoded.ID != post.ID {
+		t.Fatalf("json export: %s %v", exports["json"], err)
+	}
+	if !strings.Contains(exports["html"], "<h1>Hello</h1>") || !strings.Contains(exports["html"], "Blog ·") {
+		t.Fatalf("html export: %s", exports["html"])
+	}
+	if !strings.Contains(exports["rss"], "<title>Hello</title>") || !strings.Contains(exports["rss"], "<title>Blog</title>") {
+		t.Fatalf("rss export: %s", exports["rss"])
+	}
+	zr, err := zip.NewReader(bytes.NewReader([]byte(exports["zip"])), int64(len(exports["zip"])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "hello.md" {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(b) != post.Content {
+				t.Fatalf("hello.md: %q", b)
+			}
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"hello.md", zipSignatureEntry}) {
+		t.Fatalf("zip export entries: %v", names)
+	}
+	if _, err := exportNodeAs(note, "rss"); err == nil {
+		t.Fatal("a note has no rss export")
+	}
+	if _, err := exportNodeAs(note, "pdf"); err == nil {
+		t.Fatal("pdf is not an export format")
+	}
+
+	if err := deleteNode(note.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := findNode(note.Path); err != sql.ErrNoRows {
+		t.Fatalf("a deleted node should not be found, got %v", err)
+	}
+	if nodes, _ := searchNodes("post", "", 0); len(nodes) != 1 {
+		t.Fatalf("search should skip deleted nodes: %+v", nodes)
+	}
+}
+
+func TestTakeDBFlag(t *testing.T) {
+	defer func(args []string) { os.Args, dbFlag, vaultDatabase = args, "", "" }(os.Args)
+
+	os.Args = []string{"veil", "list", "--db", "postgres://veil@localhost/veil", "--json"}
+	takeDBFlag()
+	if !reflect.DeepEqual(os.Args, []string{"veil", "list", "--json"}) || vaultDatabase != "postgres://veil@localhost/veil" {
+		t.Fatalf("takeDBFlag left %v, %q", os.Args, vaultDatabase)
+	}
+	setVaultDatabase(&Config{Database: "postgres://other@localhost/veil"})
+	if vaultDatabase != "postgres://veil@localhost/veil" {
+		t.Fatalf("--db should win over the database setting, got %q", vaultDatabase)
+	}
+}
+
+func TestRemoteBackend(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "node-remote-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	srv := httptest.NewServer(setupRoutes())
+	defer srv.Close()
+	backend := remoteBackend{client.New(srv.URL, "")}
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	node := Node{Path: "posts/remote.md", Title: "Remote", Content: "from afar", SiteID: "s1"}
+	if err := backend.Create(&node, ""); err != nil || node.ID == "" || node.Type != "note" {
+		t.Fatalf("Create: %+v %v", node, err)
+	}
+	found, err := backend.Find("posts/remote.md")
+	if err != nil || found.ID != node.ID || found.Content != "from afar" {
+		t.Fatalf("Find by path: %+v %v", found, err)
+	}
+	if _, err := backend.Find("nope"); !client.IsNotFound(err) {
+		t.Fatalf("a missing node should be a 404, got %v", err)
+	}
+	if nodes, err := backend.Search("afar", "s1", 1); err != nil || len(nodes) != 1 || nodes[0].SiteID != "s1" {
+		t.Fatalf("Search: %+v %v", nodes, err)
+	}
+	if nodes, err := backend.List("s1", ""); err != nil || len(nodes) != 1 {
+		t.Fatalf("List: %+v %v", nodes, err)
+	}
+	if _, err := backend.Publish(node.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	var status string
+	testDB.QueryRow(`SELECT status FROM versions WHERE node_id = ? AND is_current = 1`, node.ID).Scan(&status)
+	if status != "published" {
+		t.Fatalf("the current version should be published, is %q", status)
+	}
+	if b, err := backend.Export(found, "md"); err != nil || string(b) != "from afar" {
+		t.Fatalf("Export: %q %v", b, err)
+	}
+	if _, err := backend.Export(found, "pdf"); err == nil {
+		t.Fatal("pdf is not an export format")
+	}
+	if err := backend.Delete(node.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Find(node.ID); !client.IsNotFound(err) {
+		t.Fatalf("a deleted node should be a 404, got %v", err)
+	}
+}
+
+func TestTakeRemoteFlag(t *testing.T) {
+	defer func(args []string) { os.Args, remote = args, nil }(os.Args)
+
+	os.Args = []string{"veil", "--remote", "http://localhost:8080/", "show", "n1", "--token", "tok"}
+	takeRemoteFlag()
+	if !reflect.DeepEqual(os.Args, []string{"veil", "show", "n1"}) || remote == nil || remote.Base != "http://localhost:8080" || remote.Token != "tok" {
+		t.Fatalf("takeRemoteFlag left %v, %+v", os.Args, remote)
+	}
+
+	// --token without --remote is left for the command
+	remote = nil
+	os.Args = []string{"veil", "rpc", "--token", "tok"}
+	takeRemoteFlag()
+	if len(os.Args) != 4 || remote != nil {
+		t.Fatalf("takeRemoteFlag took %v", os.Args)
+	}
+}
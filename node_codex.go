@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+)
+
+// === Node <-> Codex Links ===
+// Nodes live in SQLite for fast querying while their content is materialized
+// into the codex repository. These helpers keep the two in step so a node can
+// be traced back to its URN and every commit that touched it.
+
+// NodeCodexCommit is a single codex commit that materialized a node
+type NodeCodexCommit struct {
+	CommitHash string    `json:"commit_hash"`
+	ObjectHash string    `json:"object_hash"`
+	Author     string    `json:"author,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// nodeURN returns the codex URN for a node ID
+func nodeURN(nodeID string) string {
+	return fmt.Sprintf("urn:veil:node:%s", nodeID)
+}
+
+// nodeCodexHead returns the last codex commit recorded for a node, or "" if none
+func nodeCodexHead(nodeID string) string {
+	var head sql.NullString
+	db.QueryRow(`SELECT head_commit FROM node_codex_links WHERE node_id = ?`, nodeID).Scan(&head)
+	return head.String
+}
+
+// recordNodeCodexCommit links a node to its URN and appends the commit to its codex history
+func recordNodeCodexCommit(nodeID, objectHash, commitHash string, at int64) error {
+	urn := nodeURN(nodeID)
+	_, err := db.Exec(`
+		INSERT INTO node_codex_links (node_id, urn, head_commit, head_object, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(node_id) DO UPDATE SET head_commit = excluded.head_commit, head_object = excluded.head_object, updated_at = excluded.updated_at
+	`, nodeID, urn, commitHash, objectHash, at)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO node_codex_commits (id, node_id, urn, commit_hash, object_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ids.New("ncc"), nodeID, urn, commitHash, objectHash, at)
+	return err
+}
+
+// handleNodeHistory returns SQLite versions and codex commits for a node side by side
+// GET /api/node/{id}/history
+func handleNodeHistory(w http.ResponseWriter, r *http.Request, nodeID string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM nodes WHERE id = ?`, nodeID).Scan(&exists); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	if exists == 0 {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current
+		FROM versions WHERE node_id = ? ORDER BY version_number DESC`, nodeID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	versions := []Version{}
+	for rows.Next() {
+		var v Version
+		var created, modified int64
+		var published sql.NullInt64
+		if err := rows.Scan(&v.ID, &v.NodeID, &v.VersionNumber, &v.Content, &v.Title, &v.Status, &published, &created, &modified, &v.IsCurrent); err != nil {
+			rows.Close()
+			apierror.Internal(w, r, err)
+			return
+		}
+		v.CreatedAt = time.Unix(created, 0)
+		v.ModifiedAt = time.Unix(modified, 0)
+		if published.Valid {
+			t := time.Unix(published.Int64, 0)
+			v.PublishedAt = &t
+		}
+		versions = append(versions, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	rows, err = db.Query(`SELECT commit_hash, object_hash, created_at FROM node_codex_commits
+		WHERE node_id = ? ORDER BY created_at DESC, id DESC`, nodeID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	repo := codexRepo()
+	commits := []NodeCodexCommit{}
+	for rows.Next() {
+		var c NodeCodexCommit
+		var created int64
+		if err := rows.Scan(&c.CommitHash, &c.ObjectHash, &created); err != nil {
+			rows.Close()
+			apierror.Internal(w, r, err)
+			return
+		}
+		c.Timestamp = time.Unix(created, 0)
+		// Enrich from the codex commit when it is still present in the repository
+		if cm, err := repo.GetCommit(c.CommitHash); err == nil {
+			c.Author = cm.Author
+			c.Message = cm.Message
+			c.Timestamp = cm.Timestamp
+		}
+		commits = append(commits, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":  nodeID,
+		"urn":      nodeURN(nodeID),
+		"versions": versions,
+		"codex":    commits,
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	plugins "veil/pkg/plugins"
+)
+
+// === Notifications ===
+// The notification center collects what a user should hear about while the
+// app is closed: due reminders, publish jobs that failed for good, publish
+// hook deliveries that failed for good, and @username mentions in nodes.
+// watchNotifications records them from the event bus. A notification goes
+// to the node's owner, else to the site's owners, else to everyone (user_id
+// ""). Each one is announced on the bus as notification.created with the
+// recipient's unread count, and marking read as notification.read, so the
+// GUI can poll /api/notifications/unread-count or listen on /ws.
+
+// Notification kinds
+const (
+	NotifyReminder      = "reminder"
+	NotifyPublishFailed = "publish_failed"
+	NotifyHookFailed    = "hook_failed"
+	NotifyMention       = "mention"
+)
+
+const notificationBuffer = 256
+
+// mentionRef is an @username not preceded by a word character, so e-mail
+// addresses don't count
+var mentionRef = regexp.MustCompile(`(?:^|[^\w@/])@([A-Za-z0-9_][A-Za-z0-9_.-]*)`)
+
+// Notification is one entry of a user's notification center
+type Notification struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id,omitempty"`
+	Kind      string `json:"kind"`
+	SourceID  string `json:"source_id"`
+	Title     string `json:"title"`
+	Body      string `json:"body,omitempty"`
+	NodeID    string `json:"node_id,omitempty"`
+	Read      bool   `json:"read"`
+	ReadAt    int64  `json:"read_at,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// watchNotifications records notifications from the event bus until the
+// returned stop is called
+func watchNotifications() (stop func()) {
+	sub := events.Subscribe(notificationBuffer, events.ReminderDue, events.JobProgress, events.NodeCreated, events.NodeUpdated)
+	go func() {
+		for ev := range sub.C {
+			notifyFromEvent(ev)
+		}
+	}()
+	return sub.Close
+}
+
+// notifyFromEvent records the notifications an event calls for
+func notifyFromEvent(ev events.Event) {
+	data, _ := ev.Data.(map[string]interface{})
+	str := func(key string) string {
+		s, _ := data[key].(string)
+		return s
+	}
+	send := func(siteID, ownerID string, n Notification) {
+		users, err := notificationRecipients(siteID, ownerID)
+		if err != nil {
+			log.Printf("notification %s: %v", n.SourceID, err)
+			return
+		}
+		notify(users, n)
+	}
+	switch ev.Type {
+	case events.ReminderDue:
+		siteID, owner, _ := nodeAccess(str("node_id"))
+		send(siteID, owner, Notification{Kind: NotifyReminder, SourceID: str("id"),
+			Title: "Reminder: " + str("title"), NodeID: str("node_id")})
+	case events.JobProgress:
+		if str("status") != "failed" {
+			return
+		}
+		switch str("kind") {
+		case plugins.JobKindPublish:
+			var channel string
+			db.QueryRow(`SELECT name FROM publishing_channels WHERE id = ?`, str("channel_id")).Scan(&channel)
+			if channel == "" {
+				channel = str("channel_id")
+			}
+			siteID, owner, _ := nodeAccess(str("node_id"))
+			title := "Publishing to " + channel + " failed"
+			if t := nodeTitle(str("node_id")); t != "" {
+				title = fmt.Sprintf("Publishing %q to %s failed", t, channel)
+			}
+			send(siteID, owner, Notification{Kind: NotifyPublishFailed, SourceID: str("id"),
+				Title: title, Body: str("error"), NodeID: str("node_id")})
+		case jobKindPublishHook:
+			var payload string
+			db.QueryRow(`SELECT COALESCE(payload, '') FROM publish_jobs WHERE id = ?`, str("id")).Scan(&payload)
+			var hook publishHookEvent
+			json.Unmarshal([]byte(payload), &hook)
+			var target string
+			db.QueryRow(`SELECT target FROM publish_hooks WHERE id = ?`, hook.HookID).Scan(&target)
+			if target == "" {
+				target = hook.HookID
+			}
+			send(hook.SiteID, "", Notification{Kind: NotifyHookFailed, SourceID: str("id"),
+				Title: "Publish hook to " + target + " failed", Body: str("error"), NodeID: hook.NodeID})
+		}
+	case events.NodeCreated, events.NodeUpdated:
+		notifyMentions(str("id"))
+	}
+}
+
+// notifyMentions notifies the users a node mentions, once per node. Owners
+// are not told about mentions in their own nodes.
+func notifyMentions(nodeID string) {
+	var title, content string
+	var owner sql.NullString
+	if err := db.QueryRow(`SELECT COALESCE(title, ''), COALESCE(content, ''), owner_id FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+		Scan(&title, &content, &owner); err != nil {
+		return
+	}
+	seen := map[string]bool{}
+	for _, m := range mentionRef.FindAllStringSubmatch(content, -1) {
+		name := strings.TrimRight(m[1], ".-")
+		if seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		var userID string
+		db.QueryRow(`SELECT id FROM users WHERE lower(username) = lower(?)`, name).Scan(&userID)
+		if userID == "" || userID == owner.String {
+			continue
+		}
+		notify([]string{userID}, Notification{Kind: NotifyMention, SourceID: nodeID,
+			Title: "You were mentioned in " + title, NodeID: nodeID})
+	}
+}
+
+// nodeTitle is a node's title, or "" when it has none or is gone
+func nodeTitle(nodeID string) string {
+	var title string
+	db.QueryRow(`SELECT COALESCE(title, '') FROM nodes WHERE id = ?`, nodeID).Scan(&title)
+	return title
+}
+
+// notificationRecipients is who hears about a node or site: its owner, else
+// the site's owners, else everyone ("")
+func notificationRecipients(siteID, ownerID string) ([]string, error) {
+	if ownerID != "" {
+		return []string{ownerID}, nil
+	}
+	var users []string
+	rows, err := db.Query(`SELECT user_id FROM site_members WHERE site_id = ? AND role = ? ORDER BY user_id`, siteID, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		users = append(users, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return []string{""}, nil
+	}
+	return users, nil
+}
+
+// notify records n for each user, skipping users it was already recorded
+// for, and announces the new ones
+func notify(users []string, n Notification) {
+	if n.SourceID == "" {
+		return
+	}
+	for _, userID := range users {
+		n.ID, n.UserID, n.CreatedAt = ids.New("ntf"), userID, time.Now().Unix()
+		res, err := db.Exec(`INSERT INTO notifications (id, user_id, kind, source_id, title, body, node_id, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`, n.ID, n.UserID, n.Kind, n.SourceID, n.Title, n.Body, n.NodeID, n.CreatedAt)
+		if err != nil {
+			continue
+		}
+		if added, _ := res.RowsAffected(); added == 0 {
+			continue
+		}
+		events.Publish(events.NotificationCreated, map[string]interface{}{
+			"user_id": userID, "notification": n, "unread": unreadNotifications(userID),
+		})
+	}
+}
+
+// notificationScope limits queries to the notifications userID sees: their
+// own and those for everyone. Without accounts every notification is shown.
+func notificationScope(r *http.Request) (string, []interface{}, bool) {
+	if !authEnabled() {
+		return `1 = 1`, nil, true
+	}
+	userID := currentUserID(r)
+	if userID == "" {
+		return "", nil, false
+	}
+	return `(user_id = ? OR user_id = '')`, []interface{}{userID}, true
+}
+
+// unreadNotifications counts what userID has not read. Without accounts
+// that is every unread notification.
+func unreadNotifications(userID string) int {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE read_at IS NULL AND (? = 0 OR user_id = ? OR user_id = '')`,
+		authEnabled(), userID).Scan(&n)
+	return n
+}
+
+// GET /api/notifications[?unread=true][&limit=N]
+func handleNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	scope, args, ok := notificationScope(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if r.URL.Query().Get("unread") == "true" {
+		scope += ` AND read_at IS NULL`
+	}
+	limit := 50
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	rows, err := db.Query(`SELECT id, user_id, kind, source_id, title, COALESCE(body, ''), COALESCE(node_id, ''), COALESCE(read_at, 0), created_at
+		FROM notifications WHERE `+scope+` ORDER BY created_at DESC, id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+	list := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.SourceID, &n.Title, &n.Body, &n.NodeID, &n.ReadAt, &n.CreatedAt); err != nil {
+			apierror.WriteError(w, r, err)
+			return
+		}
+		n.Read = n.ReadAt != 0
+		list = append(list, n)
+	}
+	if err := rows.Err(); err != nil {
+		apierror.WriteError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// GET /api/notifications/unread-count
+func handleNotificationsUnread(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	scope, args, ok := notificationScope(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE read_at IS NULL AND `+scope, args...).Scan(&n); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"unread": n})
+}
+
+// POST /api/notifications/read {"ids": [...]} or {"all": true}
+func handleNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	scope, args, ok := notificationScope(r)
+	if !ok {
+		apierror.Write(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	var req struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if !req.All && len(req.IDs) == 0 {
+		apierror.Write(w, http.StatusBadRequest, "ids or all is required")
+		return
+	}
+	if !req.All {
+		scope += ` AND id IN (?` + strings.Repeat(`, ?`, len(req.IDs)-1) + `)`
+		for _, id := range req.IDs {
+			args = append(args, id)
+		}
+	}
+	res, err := db.Exec(`UPDATE notifications SET read_at = ? WHERE read_at IS NULL AND `+scope, append([]interface{}{time.Now().Unix()}, args...)...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	marked, _ := res.RowsAffected()
+	userID := currentUserID(r)
+	unread := unreadNotifications(userID)
+	events.Publish(events.NotificationRead, map[string]interface{}{"user_id": userID, "unread": unread})
+	json.NewEncoder(w).Encode(map[string]int64{"marked": marked, "unread": int64(unread)})
+}
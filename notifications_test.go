@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"veil/pkg/events"
+	plugins "veil/pkg/plugins"
+)
+
+func TestNotifications(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	vault, err := ioutil.TempDir("", "notifications-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vault)
+	wd, _ := os.Getwd()
+	os.Chdir(vault)
+	defer os.Chdir(wd)
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func(token string) []Notification {
+		var out []Notification
+		json.NewDecoder(do("GET", "/api/notifications", token, nil).Body).Decode(&out)
+		return out
+	}
+	unread := func(token string) int {
+		var out map[string]int
+		json.NewDecoder(do("GET", "/api/notifications/unread-count", token, nil).Body).Decode(&out)
+		return out["unread"]
+	}
+
+	// without accounts everything goes to everyone
+	testDB.Exec(`INSERT INTO publishing_channels (id, name, type, config, active, created_at) VALUES ('ch1', 'Netlify', 'static', '{}', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES ('n1', 'note', 'n1.md', 'Launch', '', 1, 1)`)
+	failed := events.Event{Type: events.JobProgress, Data: map[string]interface{}{
+		"id": "job1", "kind": plugins.JobKindPublish, "status": "failed", "node_id": "n1", "channel_id": "ch1", "error": "deploy refused",
+	}}
+	notifyFromEvent(failed)
+	notifyFromEvent(failed) // recorded once
+	notifyFromEvent(events.Event{Type: events.JobProgress, Data: map[string]interface{}{"id": "job2", "kind": plugins.JobKindPublish, "status": "queued"}})
+	notifyFromEvent(events.Event{Type: events.ReminderDue, Data: map[string]interface{}{"id": "rem1", "node_id": "n1", "title": "Ship it"}})
+	got := list("")
+	if len(got) != 2 || unread("") != 2 {
+		t.Fatalf("expected a publish failure and a reminder, got %+v", got)
+	}
+	for _, n := range got {
+		if n.Kind == NotifyPublishFailed && (n.Title != `Publishing "Launch" to Netlify failed` || n.Body != "deploy refused" || n.NodeID != "n1") {
+			t.Fatalf("unexpected publish failure: %+v", n)
+		}
+	}
+	if rr := do("POST", "/api/notifications/read", "", map[string]interface{}{"ids": []string{got[0].ID}}); rr.Code != http.StatusOK || unread("") != 1 {
+		t.Fatalf("mark read: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/api/notifications/read", "", map[string]interface{}{}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("marking nothing read should be refused: %d", rr.Code)
+	}
+
+	// with accounts, mentions reach the user mentioned and only them
+	do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"})
+	login := func(user string) string {
+		rr := do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"})
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out.Token
+	}
+	ada := login("ada")
+	do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"})
+	bob := login("bob")
+	if rr := do("GET", "/api/notifications", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("notifications need a session once accounts exist: %d", rr.Code)
+	}
+
+	sub := events.Subscribe(16, events.NotificationCreated)
+	defer sub.Close()
+	stop := watchNotifications()
+	defer stop()
+	do("POST", "/api/node-create", ada, map[string]string{"type": "note", "path": "plan.md", "title": "Plan",
+		"content": "Ask @bob and @ada, not bob@example.com"})
+	select {
+	case ev := <-sub.C:
+		data := ev.Data.(map[string]interface{})
+		var me User
+		json.NewDecoder(do("GET", "/api/auth/me", bob, nil).Body).Decode(&me)
+		if data["user_id"] != me.ID || data["unread"] != 2 {
+			t.Fatalf("unexpected notification event: %+v", data)
+		}
+		if wsMayReceive(nil, "someone-else", ev) || !wsMayReceive(nil, me.ID, ev) {
+			t.Fatal("notification events should only reach their recipient over /ws")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("a mention should notify bob")
+	}
+
+	mentions := 0
+	for _, n := range list(bob) {
+		if n.Kind == NotifyMention {
+			mentions++
+		}
+	}
+	if mentions != 1 {
+		t.Fatalf("bob should have one mention: %+v", list(bob))
+	}
+	for _, n := range list(ada) {
+		if n.Kind == NotifyMention {
+			t.Fatal("mentions in your own nodes should not notify")
+		}
+	}
+	do("POST", "/api/notifications/read", bob, map[string]bool{"all": true})
+	if unread(bob) != 0 || unread(ada) != 0 {
+		t.Fatalf("read all: bob %d, ada %d", unread(bob), unread(ada))
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+)
+
+// === Onboarding ===
+
+// onboardingDoneKey is set in configs once sample content was seeded or skipped
+const onboardingDoneKey = "onboarding_completed"
+
+type seedNode struct {
+	key, typ, path, title, slug, content string
+	tags                                 []string
+	links                                []string // keys of nodes this one links to
+	publish                              bool
+}
+
+// sampleNodes is the tutorial content added by the onboarding seed. Nodes
+// link to each other by key.
+var sampleNodes = []seedNode{
+	{key: "welcome", typ: "note", path: "welcome.md", title: "Welcome to Veil", slug: "welcome",
+		tags: []string{"getting-started"}, links: []string{"linking", "tags", "post"},
+		content: "# Welcome to Veil\n\nThis vault was seeded with a few notes to show you around.\n\n" +
+			"- Read [[Linking Notes]] to connect ideas.\n- Read [[Organising with Tags]] to group them.\n" +
+			"- Open [[Hello, World]] to see a published blog post.\n\nDelete these notes whenever you like."},
+	{key: "linking", typ: "note", path: "guide/linking.md", title: "Linking Notes", slug: "linking-notes",
+		tags: []string{"getting-started", "guide"}, links: []string{"welcome"},
+		content: "# Linking Notes\n\nWrap a note's title in double brackets, like [[Welcome to Veil]], to link to it.\n\n" +
+			"Every link is recorded as a reference, so the target's backlinks show where it is mentioned."},
+	{key: "tags", typ: "note", path: "guide/tags.md", title: "Organising with Tags", slug: "organising-with-tags",
+		tags: []string{"getting-started", "guide"}, links: []string{"welcome"},
+		content: "# Organising with Tags\n\nTags group related nodes across sites. This note is tagged " +
+			"`getting-started` and `guide`; filter by either to find the other tutorial notes."},
+	{key: "post", typ: "post", path: "posts/hello-world.md", title: "Hello, World", slug: "hello-world",
+		tags: []string{"getting-started"}, publish: true,
+		content: "# Hello, World\n\nThis post is published: it has a published version and shows up in the " +
+			"site's RSS feed. Edit it and publish again to create a new version."},
+}
+
+// sampleTemplates are the node templates the onboarding seed adds
+var sampleTemplates = []NodeTemplate{
+	{Slug: "note", Name: "Note", Type: "note", MimeType: "text/markdown",
+		Content: "# {{title}}\n\n## Summary\n\n## Details\n\n## Links\n"},
+	{Slug: "blog-post", Name: "Blog post", Type: "post", MimeType: "text/markdown",
+		Content: "# {{title}}\n\n_Excerpt: one or two sentences for feeds and previews._\n\n## Introduction\n\n## Conclusion\n"},
+	{Slug: "page", Name: "Page", Type: "page", MimeType: "text/markdown",
+		Content: "# {{title}}\n\nIntroduce the page here.\n"},
+	{Slug: "meeting-notes", Name: "Meeting notes", Type: "note", MimeType: "text/markdown", Title: "Meeting {{date}}",
+		Fields: map[string]interface{}{"date": "{{date}}", "attendees": []interface{}{}}, Tags: []string{"meeting"},
+		Content: "# {{title}}\n\n## Attendees\n\n## Agenda\n\n## Decisions\n\n## Action items\n"},
+}
+
+// vaultIsEmpty reports whether a vault has no sites and no live nodes
+func vaultIsEmpty(database *sql.DB) bool {
+	var sites, nodes int
+	database.QueryRow(`SELECT COUNT(*) FROM sites`).Scan(&sites)
+	database.QueryRow(`SELECT COUNT(*) FROM nodes WHERE deleted_at IS NULL`).Scan(&nodes)
+	return sites == 0 && nodes == 0
+}
+
+func onboardingCompleted(database *sql.DB) bool {
+	var v string
+	database.QueryRow(`SELECT value FROM configs WHERE key = ?`, onboardingDoneKey).Scan(&v)
+	return v == "true"
+}
+
+func markOnboardingCompleted(database *sql.DB) {
+	now := time.Now().Unix()
+	database.Exec(`INSERT INTO configs (id, key, value, created_at, updated_at) VALUES (?, ?, 'true', ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		"config_"+onboardingDoneKey, onboardingDoneKey, now, now)
+}
+
+// SeedResult lists what the onboarding seed created
+type SeedResult struct {
+	SiteID    string   `json:"site_id"`
+	Nodes     []string `json:"nodes"`
+	Templates []string `json:"templates"`
+}
+
+// seedSampleContent adds a sample site with tutorial nodes, tags, links, a
+// published post and default templates in one transaction. ownerID may be "".
+func seedSampleContent(database *sql.DB, ownerID string) (*SeedResult, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	nextID := ids.New
+	var owner interface{}
+	if ownerID != "" {
+		owner = ownerID
+	}
+
+	res := &SeedResult{SiteID: nextID("site"), Nodes: []string{}, Templates: []string{}}
+	if _, err := tx.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		res.SiteID, "My First Site", "Sample site created during onboarding", "blog", now, now); err != nil {
+		return nil, err
+	}
+
+	nodeIDs := map[string]string{}
+	tagIDs := map[string]string{}
+	for _, n := range sampleNodes {
+		id := nextID("node")
+		nodeIDs[n.key] = id
+		res.Nodes = append(res.Nodes, id)
+		status := "draft"
+		if n.publish {
+			status = "published"
+		}
+		if _, err := tx.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, status, created_at, modified_at, owner_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, n.typ, res.SiteID, n.path, n.title, n.content, n.slug, status, now, now, owner); err != nil {
+			return nil, err
+		}
+
+		var publishedAt interface{}
+		if n.publish {
+			publishedAt = now
+		}
+		if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, published_at, created_at, modified_at, is_current)
+			VALUES (?, ?, 1, ?, ?, ?, ?, ?, ?, 1)`,
+			nextID("v"), id, n.content, n.title, status, publishedAt, now, now); err != nil {
+			return nil, err
+		}
+		if n.typ == "post" {
+			if _, err := tx.Exec(`INSERT INTO blog_posts (id, node_id, slug, excerpt, publish_date) VALUES (?, ?, ?, ?, ?)`,
+				nextID("post"), id, n.slug, excerpt(n.content, feedExcerptLen), publishedAt); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, tag := range n.tags {
+			tagID, ok := tagIDs[tag]
+			if !ok {
+				if tx.QueryRow(`SELECT id FROM tags WHERE name = ?`, tag).Scan(&tagID) != nil {
+					tagID = nextID("tag")
+					if _, err := tx.Exec(`INSERT INTO tags (id, name) VALUES (?, ?)`, tagID, tag); err != nil {
+						return nil, err
+					}
+				}
+				tagIDs[tag] = tagID
+			}
+			tx.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, nextID("nt"), id, tagID)
+		}
+	}
+
+	byKey := map[string]seedNode{}
+	for _, n := range sampleNodes {
+		byKey[n.key] = n
+	}
+	for _, n := range sampleNodes {
+		for _, target := range n.links {
+			if _, err := tx.Exec(`INSERT INTO node_references (id, source_node_id, target_node_id, link_type, link_text, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				nextID("ref"), nodeIDs[n.key], nodeIDs[target], "wiki", byKey[target].title, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// templates already in the vault keep their slugs
+	for _, t := range sampleTemplates {
+		var exists int
+		if tx.QueryRow(`SELECT 1 FROM node_templates WHERE slug = ?`, t.Slug).Scan(&exists) == nil {
+			continue
+		}
+		t.ID, t.CreatedAt, t.ModifiedAt = nextID("tpl"), now, now
+		if err := saveTemplate(tx, &t); err != nil {
+			return nil, err
+		}
+		res.Templates = append(res.Templates, t.ID)
+	}
+
+	if ownerID != "" {
+		if _, err := tx.Exec(`INSERT INTO site_members (id, site_id, user_id, role, created_at) VALUES (?, ?, ?, ?, ?)`,
+			nextID("member"), res.SiteID, ownerID, RoleOwner, now); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, id := range nodeIDs {
+		indexBacklinks(database, id)
+	}
+	markOnboardingCompleted(database)
+	return res, nil
+}
+
+// GET /api/onboarding reports whether the vault is empty and onboarding done
+func handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	empty := vaultIsEmpty(db)
+	done := onboardingCompleted(db)
+	json.NewEncoder(w).Encode(map[string]bool{
+		"empty":     empty,
+		"completed": done,
+		"suggested": empty && !done,
+	})
+}
+
+// POST /api/onboarding/seed {skip?} seeds an empty vault with sample content,
+// or with skip set only records that onboarding was dismissed
+func handleOnboardingSeed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Skip bool `json:"skip"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Skip {
+		markOnboardingCompleted(db)
+		json.NewEncoder(w).Encode(map[string]string{"status": "skipped"})
+		return
+	}
+	if !vaultIsEmpty(db) {
+		apierror.Write(w, http.StatusConflict, "sample content can only be added to an empty vault")
+		return
+	}
+	res, err := seedSampleContent(db, currentUserID(r))
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOnboardingSeed(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	status := func() map[string]bool {
+		var out map[string]bool
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/onboarding", nil))
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out
+	}
+	seed := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/onboarding/seed", bytes.NewBufferString(body)))
+		return rr
+	}
+
+	if s := status(); !s["empty"] || !s["suggested"] {
+		t.Fatalf("expected onboarding to be suggested on an empty vault: %v", s)
+	}
+
+	rr := seed(`{}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("seed: %d %s", rr.Code, rr.Body.String())
+	}
+	var res SeedResult
+	json.NewDecoder(rr.Body).Decode(&res)
+	if res.SiteID == "" || len(res.Nodes) != 4 || len(res.Templates) != len(sampleTemplates) {
+		t.Fatalf("unexpected seed result: %+v", res)
+	}
+
+	var refs, tagged, templates int
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_references`).Scan(&refs)
+	testDB.QueryRow(`SELECT COUNT(DISTINCT node_id) FROM node_tags`).Scan(&tagged)
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_templates`).Scan(&templates)
+	if refs == 0 || tagged != 4 || templates != len(sampleTemplates) {
+		t.Fatalf("expected links, tags and templates; got refs=%d tagged=%d templates=%d", refs, tagged, templates)
+	}
+
+	items, err := loadFeedItems(res.SiteID, "http://localhost", 10)
+	if err != nil || len(items) != 1 || items[0].Title != "Hello, World" {
+		t.Fatalf("expected the sample post in the site feed, got %+v %v", items, err)
+	}
+
+	if s := status(); s["empty"] || !s["completed"] || s["suggested"] {
+		t.Fatalf("unexpected status after seeding: %v", s)
+	}
+	if rr := seed(`{}`); rr.Code != http.StatusConflict {
+		t.Fatalf("expected seeding a non-empty vault to conflict, got %d", rr.Code)
+	}
+}
+
+func TestOnboardingSkip(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/onboarding/seed", bytes.NewBufferString(`{"skip":true}`)))
+	if rr.Code != http.StatusOK || !vaultIsEmpty(db) || !onboardingCompleted(db) {
+		t.Fatalf("expected skip to mark onboarding done without content: %d", rr.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/validate"
+)
+
+// === Page Policy ===
+// Rendered pages (previews and static exports) carry a Content Security
+// Policy. Scripts and styles load from the server itself unless the site
+// lists extra origins in script_sources, e.g. a CDN its shader demos use.
+// Inline script is never allowed, so content cannot run code of its own.
+
+// siteScriptSources is the site's list of extra script and style origins
+func siteScriptSources(siteID string) []string {
+	var sources sql.NullString
+	db.QueryRow(`SELECT script_sources FROM sites WHERE id = ?`, siteID).Scan(&sources)
+	return strings.Fields(sources.String)
+}
+
+// pageCSP is the Content-Security-Policy for a rendered page of siteID
+func pageCSP(siteID string) string {
+	extra := ""
+	if sources := siteScriptSources(siteID); len(sources) > 0 {
+		extra = " " + strings.Join(sources, " ")
+	}
+	return "default-src 'self'; script-src 'self'" + extra +
+		"; style-src 'self' 'unsafe-inline'" + extra +
+		"; img-src 'self' data: https:; media-src 'self' https:; object-src 'none'; base-uri 'none'; form-action 'self'"
+}
+
+// validScriptSource reports whether s may go in a CSP source list: an
+// https origin, optionally with a path
+func validScriptSource(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.User == nil && u.RawQuery == "" && u.Fragment == "" &&
+		!strings.ContainsAny(s, " ;,'\"")
+}
+
+// SitePolicy is a site's page policy settings
+type SitePolicy struct {
+	SiteID        string   `json:"site_id"`
+	ScriptSources []string `json:"script_sources" validate:"max=20"`
+	CSP           string   `json:"csp"`
+}
+
+// /api/site-policy?site_id=: GET shows the site's script sources and the
+// resulting CSP, PUT {script_sources} replaces them (site owners only)
+func handleSitePolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	siteID := r.URL.Query().Get("site_id")
+	var exists int
+	if db.QueryRow(`SELECT 1 FROM sites WHERE id = ?`, siteID).Scan(&exists) != nil {
+		apierror.Write(w, http.StatusNotFound, "site not found")
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		if !canManageSite(r, siteID) {
+			apierror.Write(w, http.StatusForbidden, "owner role required to change the site's policy")
+			return
+		}
+		var req SitePolicy
+		verrs, _ := validate.DecodeJSON(r.Body, &req).(validate.Errors)
+		for i, s := range req.ScriptSources {
+			if !validScriptSource(s) {
+				verrs.Add(fmt.Sprintf("script_sources.%d", i), "must be an https origin such as https://cdn.example.com")
+			}
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		if _, err := db.Exec(`UPDATE sites SET script_sources = ?, modified_at = ? WHERE id = ?`,
+			strings.Join(req.ScriptSources, " "), time.Now().Unix(), siteID); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(SitePolicy{SiteID: siteID, ScriptSources: append([]string{}, siteScriptSources(siteID)...), CSP: pageCSP(siteID)})
+}
+
+// === Security Headers ===
+// securityHeaders adds the browser hardening headers to every response.
+// Pages set their own CSP (pageCSP), files under /media/ are sandboxed so an
+// uploaded SVG or HTML file cannot script the app, and everything else,
+// the web UI and the API, gets SecurityConfig.CSP. The UI uses inline event
+// handlers and Tailwind's runtime styles, hence its 'unsafe-inline'.
+
+// SecurityConfig holds the header values, set by serve flags
+type SecurityConfig struct {
+	CSP            string
+	FrameOptions   string
+	ReferrerPolicy string
+	// HSTSMaxAge is in seconds, 0 leaves Strict-Transport-Security out.
+	// It is only sent on https requests, directly or via a proxy.
+	HSTSMaxAge int
+}
+
+// DefaultSecurityConfig is used unless serve flags say otherwise
+func DefaultSecurityConfig() SecurityConfig {
+	return SecurityConfig{
+		CSP: "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob: https:; " +
+			"media-src 'self' blob: https:; font-src 'self' data:; connect-src 'self' ws: wss:; frame-src 'self'; " +
+			"object-src 'none'; base-uri 'self'; form-action 'self'; frame-ancestors 'self'",
+		FrameOptions:   "SAMEORIGIN",
+		ReferrerPolicy: "strict-origin-when-cross-origin",
+		HSTSMaxAge:     0,
+	}
+}
+
+var securityConfig = DefaultSecurityConfig()
+
+// mediaCSP confines files served from the media folder
+const mediaCSP = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if securityConfig.FrameOptions != "" {
+			h.Set("X-Frame-Options", securityConfig.FrameOptions)
+		}
+		if securityConfig.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", securityConfig.ReferrerPolicy)
+		}
+		if securityConfig.HSTSMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", securityConfig.HSTSMaxAge))
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/media/"), strings.HasPrefix(r.URL.Path, "/site-assets/"):
+			h.Set("Content-Security-Policy", mediaCSP)
+		case strings.HasPrefix(r.URL.Path, "/preview/"):
+			// handlePreview sets the site's page CSP
+		case securityConfig.CSP != "":
+			h.Set("Content-Security-Policy", securityConfig.CSP)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
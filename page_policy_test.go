@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSitePolicy(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Demos', 'project', 1, 1)`)
+	mux := setupRoutes()
+
+	put := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("PUT", "/api/site-policy?site_id=s1", strings.NewReader(body)))
+		return rr
+	}
+	if rr := put(`{"script_sources": ["http://cdn.example.com", "https://ok.example.com 'unsafe-inline'"]}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad sources should be rejected, got %d", rr.Code)
+	}
+	rr := put(`{"script_sources": ["https://cdn.jsdelivr.net"]}`)
+	var policy SitePolicy
+	json.NewDecoder(rr.Body).Decode(&policy)
+	if rr.Code != http.StatusOK || !strings.Contains(policy.CSP, "script-src 'self' https://cdn.jsdelivr.net;") {
+		t.Fatalf("unexpected policy: %d %+v", rr.Code, policy)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/site-policy?site_id=nope", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown site should be 404, got %d", rr.Code)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	testDB.Exec(`INSERT INTO sites (id, name, type, script_sources, created_at, modified_at) VALUES ('s1', 'Demos', 'project', 'https://cdn.jsdelivr.net', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, created_at, modified_at) VALUES
+		('n1', 'note', 's1', 'n.md', 'N', 'hi', 'text/markdown', 1, 1)`)
+	saved := securityConfig
+	defer func() { securityConfig = saved }()
+	securityConfig.HSTSMaxAge = 600
+	handler := securityHeaders(requireAuth(setupRoutes()))
+
+	get := func(path string, https bool) http.Header {
+		req := httptest.NewRequest("GET", path, nil)
+		if https {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header()
+	}
+
+	h := get("/", false)
+	if h.Get("Content-Security-Policy") != securityConfig.CSP || h.Get("X-Frame-Options") != "SAMEORIGIN" ||
+		h.Get("Referrer-Policy") != "strict-origin-when-cross-origin" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("unexpected UI headers: %v", h)
+	}
+	if h.Get("Strict-Transport-Security") != "" {
+		t.Fatalf("HSTS should only be sent over https")
+	}
+	if got := get("/api/sites", true).Get("Strict-Transport-Security"); got != "max-age=600; includeSubDomains" {
+		t.Fatalf("unexpected HSTS header: %q", got)
+	}
+
+	h = get("/preview/s1/n1", false)
+	if csp := h.Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'self' https://cdn.jsdelivr.net;") {
+		t.Fatalf("preview should carry the site's page CSP, got %q", csp)
+	}
+	if h.Get("X-Frame-Options") != "SAMEORIGIN" {
+		t.Fatalf("preview is missing X-Frame-Options")
+	}
+	if csp := get("/media/upload.svg", false).Get("Content-Security-Policy"); !strings.HasSuffix(csp, "sandbox") {
+		t.Fatalf("media should be sandboxed, got %q", csp)
+	}
+
+	securityConfig.FrameOptions = ""
+	if _, set := get("/", false)["X-Frame-Options"]; set {
+		t.Fatalf("an empty setting should leave the header out")
+	}
+}
@@ -0,0 +1,130 @@
+// Package apierror writes the JSON error responses of veil's HTTP API. Every
+// failure answers with the same envelope:
+//
+//	{"error": {"code": "not_found", "message": "node not found"}}
+//
+// The code is derived from the status, not_found for 404, unless the
+// handler names a more specific one. Details a client may act on, such as
+// the fields of a validation error, sit beside "error" at the top level.
+//
+// Handlers that return an error instead of writing one are adapted with
+// Handler: an *Error answers with its status, anything else is an internal
+// failure, logged with the request and answered with a 500 that doesn't
+// repeat it.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// Error is an API failure and the status it answers with
+type Error struct {
+	Status  int
+	Code    string // derived from Status when empty
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New returns an Error with the code for status
+func New(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// Code is the error code for a status: its text in snake case
+func Code(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-':
+			return '_'
+		}
+		return -1
+	}, text)
+}
+
+// Write answers status with msg in the error envelope
+func Write(w http.ResponseWriter, status int, msg string) {
+	WriteWith(w, &Error{Status: status, Message: msg}, nil)
+}
+
+// WriteWith answers with e, adding extra beside the envelope
+func WriteWith(w http.ResponseWriter, e *Error, extra map[string]interface{}) {
+	code := e.Code
+	if code == "" {
+		code = Code(e.Status)
+	}
+	body := map[string]interface{}{"error": map[string]string{"code": code, "message": e.Message}}
+	for k, v := range extra {
+		if k != "error" {
+			body[k] = v
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// WriteError answers with err: an *Error with its own status, anything
+// else as Internal
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		WriteWith(w, e, nil)
+		return
+	}
+	Internal(w, r, err)
+}
+
+// Internal answers with a 500 for err, a database or other internal
+// failure. err is logged along with the request; the client only learns
+// that something went wrong, not what.
+func Internal(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	Write(w, http.StatusInternalServerError, "internal error")
+}
+
+// Handler adapts a handler that returns its failure. It must not have
+// written a response when it returns a non-nil error.
+func Handler(h func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			WriteError(w, r, err)
+		}
+	}
+}
+
+// Recover turns a panic in next into a logged 500, so a bug in one handler
+// answers in the envelope instead of dropping the connection
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.ErrorContext(r.Context(), "handler panicked", "method", r.Method, "path", r.URL.Path,
+				"panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			Write(w, http.StatusInternalServerError, "internal error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,101 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type envelope struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Fields map[string]string `json:"fields"`
+}
+
+func decode(t *testing.T, rr *httptest.ResponseRecorder) envelope {
+	t.Helper()
+	var out envelope
+	if err := json.NewDecoder(rr.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q", ct)
+	}
+	return out
+}
+
+func TestWrite(t *testing.T) {
+	for status, code := range map[int]string{
+		http.StatusNotFound:              "not_found",
+		http.StatusInternalServerError:   "internal_server_error",
+		http.StatusRequestEntityTooLarge: "request_entity_too_large",
+		http.StatusTeapot:                "im_a_teapot",
+		599:                              "error",
+	} {
+		if got := Code(status); got != code {
+			t.Errorf("Code(%d) = %q, want %q", status, got, code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	Write(rr, http.StatusForbidden, "editor role required")
+	if out := decode(t, rr); rr.Code != 403 || out.Error.Code != "forbidden" || out.Error.Message != "editor role required" {
+		t.Fatalf("unexpected response %d %+v", rr.Code, out)
+	}
+
+	rr = httptest.NewRecorder()
+	WriteWith(rr, &Error{Status: 400, Code: "invalid", Message: "name is required"},
+		map[string]interface{}{"fields": map[string]string{"name": "is required"}, "error": "ignored"})
+	if out := decode(t, rr); out.Error.Code != "invalid" || out.Fields["name"] != "is required" {
+		t.Fatalf("extra details should sit beside the envelope: %+v", out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler(func(w http.ResponseWriter, r *http.Request) error {
+		switch r.URL.Query().Get("fail") {
+		case "missing":
+			return fmt.Errorf("loading: %w", New(http.StatusNotFound, "node %s not found", "n1"))
+		case "db":
+			return errors.New("no such table: tags")
+		}
+		w.Write([]byte("[]"))
+		return nil
+	})
+	for query, want := range map[string]struct {
+		status int
+		code   string
+		msg    string
+	}{
+		"missing": {404, "not_found", "node n1 not found"},
+		"db":      {500, "internal_server_error", "internal error"},
+	} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/x?fail="+query, nil))
+		if out := decode(t, rr); rr.Code != want.status || out.Error.Code != want.code || out.Error.Message != want.msg {
+			t.Fatalf("%s: %d %+v", query, rr.Code, out)
+		}
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/x", nil))
+	if rr.Code != 200 || rr.Body.String() != "[]" {
+		t.Fatalf("success: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/api/x", nil))
+	if out := decode(t, rr); rr.Code != 500 || out.Error.Code != "internal_server_error" {
+		t.Fatalf("a panic should answer 500: %d %+v", rr.Code, out)
+	}
+}
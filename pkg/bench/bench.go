@@ -0,0 +1,263 @@
+// Package bench measures veil's performance so regressions show up as
+// numbers. Seed fills a server with a synthetic vault of nodes, links and
+// media through its HTTP API, Run times the API against it (reads, writes,
+// search, queries, media and exports), and Codex times codex operations
+// directly against a storage backend. A Report is saved as JSON, and
+// Compare lists what got slower since a baseline.
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config sizes the synthetic vault and the measurements
+type Config struct {
+	// Nodes is how many nodes the vault gets (default 500)
+	Nodes int `json:"nodes"`
+	// Links is how many links run between them (default 3 per node)
+	Links int `json:"links"`
+	// Media is how many media files are uploaded (default 10), each
+	// MediaBytes long (default 256 KiB)
+	Media      int `json:"media"`
+	MediaBytes int `json:"media_bytes"`
+	// Requests is how many requests each API measurement makes (default 200)
+	Requests int `json:"requests"`
+	// Exports is how many site exports are timed (default 3)
+	Exports int `json:"exports"`
+	// Concurrency is how many clients run at once (default 8)
+	Concurrency int `json:"concurrency"`
+	// Seed makes the vault reproducible (default 1)
+	Seed int64 `json:"seed"`
+}
+
+// WithDefaults fills in the zero fields
+func (c Config) WithDefaults() Config {
+	if c.Nodes <= 0 {
+		c.Nodes = 500
+	}
+	if c.Links <= 0 {
+		c.Links = 3 * c.Nodes
+	}
+	if c.Media < 0 {
+		c.Media = 0
+	} else if c.Media == 0 {
+		c.Media = 10
+	}
+	if c.MediaBytes <= 0 {
+		c.MediaBytes = 256 << 10
+	}
+	if c.Requests <= 0 {
+		c.Requests = 200
+	}
+	if c.Exports <= 0 {
+		c.Exports = 3
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 8
+	}
+	if c.Seed == 0 {
+		c.Seed = 1
+	}
+	return c
+}
+
+// Result summarises one measurement. Latencies are in milliseconds.
+type Result struct {
+	Name       string  `json:"name"`
+	Ops        int     `json:"ops"`
+	Errors     int     `json:"errors"`
+	FirstError string  `json:"first_error,omitempty"`
+	Seconds    float64 `json:"seconds"`
+	OpsPerSec  float64 `json:"ops_per_sec"`
+	MeanMS     float64 `json:"mean_ms"`
+	P50MS      float64 `json:"p50_ms"`
+	P95MS      float64 `json:"p95_ms"`
+	P99MS      float64 `json:"p99_ms"`
+	MaxMS      float64 `json:"max_ms"`
+	// Bytes is how much data the operations moved, where that matters
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// Report is one benchmark run
+type Report struct {
+	Target    string    `json:"target"`
+	StartedAt time.Time `json:"started_at"`
+	Config    Config    `json:"config"`
+	Results   []Result  `json:"results"`
+}
+
+// Measure runs op ops times, workers at a time, and summarises the
+// latencies. op gets the operation's index and returns the bytes it moved.
+func Measure(name string, ops, workers int, op func(i int) (int64, error)) Result {
+	if workers < 1 {
+		workers = 1
+	}
+	latencies := make([]time.Duration, ops)
+	var mu sync.Mutex
+	res := Result{Name: name, Ops: ops}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(workers, max(ops, 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				n, err := op(i)
+				latencies[i] = time.Since(t)
+				mu.Lock()
+				res.Bytes += n
+				if err != nil {
+					res.Errors++
+					if res.FirstError == "" {
+						res.FirstError = err.Error()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range ops {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	res.Seconds = elapsed.Seconds()
+	if ops == 0 {
+		return res
+	}
+	res.OpsPerSec = float64(ops) / elapsed.Seconds()
+	sort.Slice(latencies, func(a, b int) bool { return latencies[a] < latencies[b] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	ms := func(d time.Duration) float64 { return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000 }
+	at := func(p float64) time.Duration { return latencies[min(len(latencies)-1, int(p*float64(len(latencies))))] }
+	res.MeanMS = ms(total / time.Duration(ops))
+	res.P50MS = ms(at(0.50))
+	res.P95MS = ms(at(0.95))
+	res.P99MS = ms(at(0.99))
+	res.MaxMS = ms(latencies[len(latencies)-1])
+	return res
+}
+
+// Regression is a measurement that got worse than its baseline
+type Regression struct {
+	Name string `json:"name"`
+	// Metric is p95_ms or ops_per_sec
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline"`
+	Current  float64 `json:"current"`
+	// Change is the relative change, 0.25 for 25% worse
+	Change float64 `json:"change"`
+}
+
+// noiseMS is the p95 difference below which latency changes are ignored
+const noiseMS = 1.0
+
+// Compare lists the results of cur that are worse than in base by more than
+// tolerance (0.2 for 20%): a higher p95 latency, or for runs too fast to
+// have one worth comparing, a lower throughput. Results only in one of the
+// reports are skipped, as are results with errors.
+func Compare(base, cur *Report, tolerance float64) []Regression {
+	prev := map[string]Result{}
+	for _, r := range base.Results {
+		prev[r.Name] = r
+	}
+	var out []Regression
+	for _, r := range cur.Results {
+		b, ok := prev[r.Name]
+		if !ok || b.Errors > 0 || r.Errors > 0 {
+			continue
+		}
+		if b.P95MS >= noiseMS || r.P95MS >= noiseMS {
+			if r.P95MS-b.P95MS >= noiseMS && r.P95MS > b.P95MS*(1+tolerance) {
+				out = append(out, Regression{Name: r.Name, Metric: "p95_ms", Baseline: b.P95MS, Current: r.P95MS, Change: r.P95MS/b.P95MS - 1})
+			}
+			continue
+		}
+		if b.OpsPerSec > 0 && r.OpsPerSec < b.OpsPerSec/(1+tolerance) {
+			out = append(out, Regression{Name: r.Name, Metric: "ops_per_sec", Baseline: b.OpsPerSec, Current: r.OpsPerSec, Change: b.OpsPerSec/r.OpsPerSec - 1})
+		}
+	}
+	return out
+}
+
+// Table renders results as aligned text
+func Table(results []Result) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-28s %7s %6s %9s %9s %9s %9s %10s\n", "benchmark", "ops", "errors", "mean ms", "p50 ms", "p95 ms", "p99 ms", "ops/s")
+	for _, r := range results {
+		fmt.Fprintf(&b, "%-28s %7d %6d %9.2f %9.2f %9.2f %9.2f %10.1f\n", r.Name, r.Ops, r.Errors, r.MeanMS, r.P50MS, r.P95MS, r.P99MS, r.OpsPerSec)
+	}
+	return b.String()
+}
+
+// Client talks to a veil server
+type Client struct {
+	// Base is the server's URL, like http://localhost:8080
+	Base string
+	// Token is a session token, needed once the server has accounts
+	Token string
+	HTTP  *http.Client
+}
+
+// NewClient returns a client for base
+func NewClient(base, token string) *Client {
+	return &Client{Base: strings.TrimRight(base, "/"), Token: token, HTTP: &http.Client{Timeout: 5 * time.Minute}}
+}
+
+// Do sends a request and reads the whole response, returning its size. A
+// status of 400 or more is an error. out, when set, gets the decoded body.
+func (c *Client) Do(method, path, contentType string, body []byte, out interface{}) (int64, error) {
+	req, err := http.NewRequest(method, c.Base+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	if resp.StatusCode >= 400 {
+		return int64(len(data)), fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return int64(len(data)), fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return int64(len(data)), nil
+}
+
+// JSON sends in as a JSON body
+func (c *Client) JSON(method, path string, in, out interface{}) (int64, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	return c.Do(method, path, "application/json", body, out)
+}
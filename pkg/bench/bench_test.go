@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	fsstorage "veil/pkg/codex/storage/fs"
+)
+
+func TestBench(t *testing.T) {
+	// latencies of 1..100ms put the percentiles on known operations
+	r := Measure("sleep", 100, 4, func(i int) (int64, error) {
+		time.Sleep(time.Duration(i+1) * 100 * time.Microsecond)
+		if i == 42 {
+			return 0, errors.New("boom")
+		}
+		return 10, nil
+	})
+	if r.Ops != 100 || r.Errors != 1 || r.FirstError != "boom" || r.Bytes != 990 {
+		t.Fatalf("unexpected counts: %+v", r)
+	}
+	if !(r.P50MS <= r.P95MS && r.P95MS <= r.P99MS && r.P99MS <= r.MaxMS) || r.P50MS < 5 || r.MaxMS < 10 || r.OpsPerSec <= 0 {
+		t.Fatalf("unexpected latencies: %+v", r)
+	}
+	if empty := Measure("none", 0, 4, nil); empty.Ops != 0 || empty.P95MS != 0 {
+		t.Fatalf("no operations should measure nothing: %+v", empty)
+	}
+
+	base := &Report{Results: []Result{
+		{Name: "slow", P95MS: 10},
+		{Name: "fast", P95MS: 0.2, OpsPerSec: 1000},
+		{Name: "noisy", P95MS: 0.1},
+		{Name: "steady", P95MS: 20},
+		{Name: "failing", P95MS: 1},
+	}}
+	cur := &Report{Results: []Result{
+		{Name: "slow", P95MS: 15},
+		{Name: "fast", P95MS: 0.3, OpsPerSec: 500},
+		{Name: "noisy", P95MS: 0.9},
+		{Name: "steady", P95MS: 22},
+		{Name: "failing", P95MS: 90, Errors: 1},
+		{Name: "new", P95MS: 90},
+	}}
+	regs := Compare(base, cur, 0.2)
+	if len(regs) != 2 || regs[0].Name != "slow" || regs[0].Metric != "p95_ms" || regs[0].Change != 0.5 ||
+		regs[1].Name != "fast" || regs[1].Metric != "ops_per_sec" || regs[1].Change != 1 {
+		t.Fatalf("unexpected regressions: %+v", regs)
+	}
+	if table := Table(cur.Results); !strings.Contains(table, "p95 ms") || strings.Count(table, "\n") != 7 {
+		t.Fatalf("unexpected table:\n%s", table)
+	}
+
+	results := Codex("fs", fsstorage.New(t.TempDir()), Config{Requests: 20, Media: -1, MediaBytes: 1024})
+	var names []string
+	for _, r := range results {
+		if r.Errors > 0 {
+			t.Fatalf("%s failed: %s", r.Name, r.FirstError)
+		}
+		names = append(names, r.Name)
+	}
+	if got := strings.Join(names, " "); got != "codex.fs.put_json codex.fs.put_blob codex.fs.get codex.fs.commit codex.fs.list" {
+		t.Fatalf("unexpected codex results: %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+
+	"veil/pkg/codex"
+)
+
+// Codex times codex operations against a storage backend: storing small
+// JSON objects and media-sized blobs, reading them back, committing and
+// listing. Results are named codex.<backend>.<operation>.
+func Codex(backend string, s codex.Storage, cfg Config) []Result {
+	cfg = cfg.WithDefaults()
+	rng := rand.New(rand.NewSource(cfg.Seed + 2))
+	repo := codex.NewRepository(s, "")
+	name := func(op string) string { return "codex." + backend + "." + op }
+	// every run writes new objects, so a backend that keeps its contents
+	// between runs doesn't turn puts into no-ops
+	run := time.Now().UnixNano()
+
+	objects := make([]string, cfg.Requests)
+	text := paragraph(rng, words(rng, 50), 60)
+	results := []Result{Measure(name("put_json"), cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+		body := fmt.Sprintf(`{"urn":"urn:bench:%d:%d","title":"Object %d","body":%q}`, run, i, i, text)
+		h, err := repo.PutObjectStream(bytes.NewReader([]byte(body)), "application/json")
+		objects[i] = h
+		return int64(len(body)), err
+	})}
+
+	blobs := min(cfg.Requests, max(cfg.Media, 10))
+	payload := make([]byte, cfg.MediaBytes)
+	rng.Read(payload)
+	results = append(results, Measure(name("put_blob"), blobs, cfg.Concurrency, func(i int) (int64, error) {
+		blob := append(fmt.Appendf(nil, "%d:%d:", run, i), payload...)
+		_, err := repo.PutObjectStream(bytes.NewReader(blob), "application/octet-stream")
+		return int64(len(blob)), err
+	}))
+
+	results = append(results, Measure(name("get"), cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+		h := objects[(i*7)%len(objects)]
+		if h == "" {
+			return 0, fmt.Errorf("object %d was not stored", (i*7)%len(objects))
+		}
+		rc, _, err := repo.GetObjectStream(h)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.Copy(io.Discard, rc)
+	}))
+
+	// commits of ten objects each, one after another as on a branch
+	commits := max(cfg.Requests/10, 1)
+	parent := ""
+	ref := fmt.Sprintf("refs/heads/bench-%d", run)
+	results = append(results, Measure(name("commit"), commits, 1, func(i int) (int64, error) {
+		c := &codex.Commit{Timestamp: time.Now().UTC(), Author: "bench", Message: fmt.Sprint("bench commit ", i)}
+		if parent != "" {
+			c.Parents = []string{parent}
+		}
+		for k := range 10 {
+			c.Objects = append(c.Objects, objects[(i*10+k)%len(objects)])
+		}
+		if err := repo.PutCommit(c); err != nil {
+			return 0, err
+		}
+		parent = c.Hash
+		return 0, repo.SetRef(ref, c.Hash)
+	}))
+
+	results = append(results, Measure(name("list"), max(cfg.Exports, 1), 1, func(i int) (int64, error) {
+		_, err := repo.ListObjects("", 0, 0)
+		return 0, err
+	}))
+	return results
+}
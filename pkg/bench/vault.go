@@ -0,0 +1,201 @@
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"mime/multipart"
+	"net/url"
+	"strings"
+)
+
+// Vault is the synthetic vault Seed made
+type Vault struct {
+	SiteID string
+	Nodes  []SeedNode
+	// Media are the uploaded files' URLs
+	Media []string
+	// Words are search terms the nodes contain
+	Words []string
+}
+
+// SeedNode is a node Seed created
+type SeedNode struct {
+	ID    string `json:"id"`
+	Path  string `json:"path"`
+	Title string `json:"title"`
+}
+
+// words builds a vocabulary of made-up words
+func words(rng *rand.Rand, n int) []string {
+	syllables := []string{"ka", "lo", "mi", "ven", "tor", "sa", "ri", "dun", "el", "pha", "qu", "zo", "bri", "nex", "ul", "at"}
+	seen := map[string]bool{}
+	var out []string
+	for len(out) < n {
+		var w strings.Builder
+		for range 2 + rng.Intn(3) {
+			w.WriteString(syllables[rng.Intn(len(syllables))])
+		}
+		if !seen[w.String()] {
+			seen[w.String()] = true
+			out = append(out, w.String())
+		}
+	}
+	return out
+}
+
+// paragraph returns n random words
+func paragraph(rng *rand.Rand, vocab []string, n int) string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = vocab[rng.Intn(len(vocab))]
+	}
+	return strings.Join(out, " ")
+}
+
+// Seed creates a site with cfg.Nodes nodes in folders, then rewrites them
+// with cfg.Links wiki and markdown links between them, and uploads
+// cfg.Media files. Creating, updating and uploading are timed as they go,
+// one request at a time.
+func Seed(c *Client, cfg Config) (*Vault, []Result, error) {
+	cfg = cfg.WithDefaults()
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	vocab := words(rng, 200)
+	v := &Vault{Words: vocab[:20]}
+
+	var site struct {
+		ID string `json:"id"`
+	}
+	if _, err := c.JSON("POST", "/api/sites", map[string]string{"name": fmt.Sprintf("Bench %d", cfg.Seed), "type": "project"}, &site); err != nil {
+		return nil, nil, err
+	}
+	v.SiteID = site.ID
+
+	// node contents are fixed up front so the workers don't share rng
+	type draft struct {
+		path, title, body string
+	}
+	drafts := make([]draft, cfg.Nodes)
+	for i := range drafts {
+		drafts[i] = draft{
+			path:  fmt.Sprintf("%s/%s-%d.md", vocab[20+i%10], vocab[rng.Intn(len(vocab))], i),
+			title: strings.ToUpper(vocab[i%len(vocab)][:1]) + vocab[i%len(vocab)][1:] + fmt.Sprint(" ", i),
+			body:  paragraph(rng, vocab, 40+rng.Intn(200)),
+		}
+	}
+	v.Nodes = make([]SeedNode, cfg.Nodes)
+	// writes go one at a time: SQLite takes a single writer, so concurrent
+	// writers measure lock contention rather than the handlers
+	var results []Result
+	results = append(results, Measure("api.node_create", cfg.Nodes, 1, func(i int) (int64, error) {
+		var n SeedNode
+		size, err := c.JSON("POST", "/api/node-create", map[string]string{
+			"type": "note", "site_id": v.SiteID, "path": drafts[i].path, "title": drafts[i].title,
+			"content": drafts[i].body, "mime_type": "text/markdown",
+		}, &n)
+		v.Nodes[i] = n
+		return size, err
+	}))
+
+	links := make([][]int, cfg.Nodes)
+	for range cfg.Links {
+		from := rng.Intn(cfg.Nodes)
+		links[from] = append(links[from], rng.Intn(cfg.Nodes))
+	}
+	contents := make([]string, cfg.Nodes)
+	for i, d := range drafts {
+		var b strings.Builder
+		b.WriteString(d.body)
+		for k, to := range links[i] {
+			target := drafts[to]
+			if k%2 == 0 {
+				fmt.Fprintf(&b, "\n\nSee [[%s]].", strings.TrimSuffix(target.path, ".md"))
+			} else {
+				fmt.Fprintf(&b, "\n\nSee [%s](/%s).", target.title, target.path)
+			}
+		}
+		contents[i] = b.String()
+	}
+	results = append(results, Measure("api.node_update", cfg.Nodes, 1, func(i int) (int64, error) {
+		if v.Nodes[i].ID == "" {
+			return 0, fmt.Errorf("node %d was not created", i)
+		}
+		return c.JSON("PUT", "/api/node-update", map[string]string{
+			"id": v.Nodes[i].ID, "type": "note", "site_id": v.SiteID, "path": drafts[i].path, "title": drafts[i].title,
+			"content": contents[i], "mime_type": "text/markdown",
+		}, nil)
+	}))
+
+	v.Media = make([]string, cfg.Media)
+	payload := make([]byte, cfg.MediaBytes)
+	rng.Read(payload)
+	results = append(results, Measure("api.media_upload", cfg.Media, 1, func(i int) (int64, error) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		part, _ := w.CreateFormFile("file", fmt.Sprintf("bench-%d.bin", i))
+		part.Write(payload)
+		w.Close()
+		var up struct {
+			URL string `json:"url"`
+		}
+		_, err := c.Do("POST", "/api/media-upload", w.FormDataContentType(), body.Bytes(), &up)
+		v.Media[i] = up.URL
+		return int64(body.Len()), err
+	}))
+	return v, results, nil
+}
+
+// Run times the API against a seeded vault: reading nodes, lists, the tree
+// and backlinks, searching, querying, serving media and exporting the site
+func Run(c *Client, v *Vault, cfg Config) []Result {
+	cfg = cfg.WithDefaults()
+	rng := rand.New(rand.NewSource(cfg.Seed + 1))
+	// the nodes each request picks are fixed up front so runs compare
+	picks := make([]int, cfg.Requests)
+	for i := range picks {
+		picks[i] = rng.Intn(max(len(v.Nodes), 1))
+	}
+	node := func(i int) SeedNode {
+		if len(v.Nodes) == 0 {
+			return SeedNode{}
+		}
+		return v.Nodes[picks[i]]
+	}
+	site := url.QueryEscape(v.SiteID)
+	get := func(path string) (int64, error) { return c.Do("GET", path, "", nil, nil) }
+
+	results := []Result{
+		Measure("api.node_get", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get("/api/node/" + url.PathEscape(node(i).ID))
+		}),
+		Measure("api.nodes_list", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get(fmt.Sprintf("/api/nodes?site_id=%s&limit=50&offset=%d", site, (i*50)%max(len(v.Nodes), 1)))
+		}),
+		Measure("api.tree", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get("/api/tree?site_id=" + site)
+		}),
+		Measure("api.backlinks", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get("/api/backlinks/" + url.PathEscape(node(i).ID))
+		}),
+		Measure("search", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get("/api/search?q=" + url.QueryEscape(v.Words[i%len(v.Words)]))
+		}),
+		Measure("query", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			q := "SELECT title, modified_at FROM nodes WHERE title LIKE '%" + v.Words[i%len(v.Words)] + "%' ORDER BY modified_at DESC LIMIT 20"
+			if i%2 == 1 {
+				q = "SELECT type, COUNT(*) FROM nodes GROUP BY type ORDER BY count DESC"
+			}
+			return c.JSON("POST", "/api/query", map[string]string{"query": q}, nil)
+		}),
+	}
+	if len(v.Media) > 0 {
+		results = append(results, Measure("media_get", cfg.Requests, cfg.Concurrency, func(i int) (int64, error) {
+			return get(v.Media[i%len(v.Media)])
+		}))
+	}
+	// exports are heavy, so one at a time
+	results = append(results, Measure("export.zip", cfg.Exports, 1, func(i int) (int64, error) {
+		return get("/api/export?site_id=" + site + "&format=zip")
+	}))
+	return results
+}
@@ -0,0 +1,370 @@
+// Package client is a typed Go client for veil's HTTP API, for scripts,
+// plugins and `veil --remote`. A Client carries a session token once the
+// server has accounts; get one with Login. Failures come back as *Error,
+// with the API's error code and message:
+//
+//	c := client.New("http://localhost:8080", os.Getenv("VEIL_SESSION_TOKEN"))
+//	nodes, total, err := c.ListNodes(client.ListOptions{Type: "post", Limit: 20})
+//	if client.IsNotFound(err) { ... }
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to a veil server
+type Client struct {
+	// Base is the server's URL, like http://localhost:8080
+	Base string
+	// Token is a session token, needed once the server has accounts
+	Token string
+	HTTP  *http.Client
+}
+
+// New returns a client for base
+func New(base, token string) *Client {
+	return &Client{Base: strings.TrimRight(base, "/"), Token: token, HTTP: &http.Client{Timeout: time.Minute}}
+}
+
+// Error is a failed request: the status and the error envelope's code and
+// message. Fields names what was wrong with each invalid field of a 400.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  map[string]string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	return e.Message
+}
+
+// IsNotFound reports whether err is a 404 from the server
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Status == http.StatusNotFound
+}
+
+// Node is a note, post or any other node
+type Node struct {
+	ID            string                 `json:"id"`
+	Type          string                 `json:"type"`
+	ParentID      string                 `json:"parent_id,omitempty"`
+	Path          string                 `json:"path"`
+	Title         string                 `json:"title"`
+	Content       string                 `json:"content"`
+	Slug          string                 `json:"slug,omitempty"`
+	CanonicalURI  string                 `json:"canonical_uri,omitempty"`
+	Body          string                 `json:"body,omitempty"`
+	Metadata      string                 `json:"metadata,omitempty"`
+	FrontMatter   map[string]interface{} `json:"front_matter,omitempty"`
+	MimeType      string                 `json:"mime_type"`
+	CreatedAt     time.Time              `json:"created_at"`
+	ModifiedAt    time.Time              `json:"modified_at"`
+	Tags          []string               `json:"tags,omitempty"`
+	Visibility    string                 `json:"visibility,omitempty"`
+	Status        string                 `json:"status,omitempty"`
+	SiteID        string                 `json:"site_id,omitempty"`
+	OwnerID       string                 `json:"owner_id,omitempty"`
+	BacklinkCount int                    `json:"backlink_count,omitempty"`
+	ArchivedAt    *time.Time             `json:"archived_at,omitempty"`
+	// ETag is the node's version as Node read it, for UpdateNode
+	ETag string `json:"-"`
+}
+
+// Version is one saved version of a node
+type Version struct {
+	ID            string     `json:"id"`
+	NodeID        string     `json:"node_id"`
+	VersionNumber int        `json:"version_number"`
+	Content       string     `json:"content"`
+	Title         string     `json:"title"`
+	Status        string     `json:"status"`
+	PublishedAt   *time.Time `json:"published_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ModifiedAt    time.Time  `json:"modified_at"`
+	IsCurrent     bool       `json:"is_current"`
+}
+
+// Site groups nodes into a blog, project or portfolio
+type Site struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Type        string    `json:"type"`
+	CreatedAt   time.Time `json:"created_at"`
+	ModifiedAt  time.Time `json:"modified_at"`
+}
+
+// PublishJob sends a node's version to a publishing channel
+type PublishJob struct {
+	ID        string `json:"id"`
+	NodeID    string `json:"node_id"`
+	VersionID string `json:"version_id"`
+	ChannelID string `json:"channel_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// ListOptions filter, sort and page ListNodes; the zero value lists every
+// readable node by path
+type ListOptions struct {
+	SiteID string
+	// Type is one type, or several separated by commas
+	Type string
+	Tag  string
+	Path string
+	// Sort is path, title, type, created_at or modified_at, with a leading
+	// - for descending
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// SearchOptions narrow Search
+type SearchOptions struct {
+	SiteID string
+	Limit  int
+}
+
+// Login signs in and keeps the session token for later requests
+func (c *Client) Login(username, password string) error {
+	var out struct {
+		Token string `json:"token"`
+	}
+	if _, err := c.do("POST", "/api/auth/login", map[string]string{"username": username, "password": password}, &out, nil); err != nil {
+		return err
+	}
+	c.Token = out.Token
+	return nil
+}
+
+// ListNodes returns a page of nodes and how many match across all pages
+func (c *Client) ListNodes(opts ListOptions) ([]Node, int, error) {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("site_id", opts.SiteID)
+	set("type", opts.Type)
+	set("tag", opts.Tag)
+	set("path", opts.Path)
+	set("sort", opts.Sort)
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		q.Set("offset", strconv.Itoa(opts.Offset))
+	}
+	var nodes []Node
+	resp, err := c.do("GET", withQuery("/api/nodes", q), nil, &nodes, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, _ := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	return nodes, total, nil
+}
+
+// Node gets a node by ID
+func (c *Client) Node(id string) (*Node, error) {
+	var node Node
+	resp, err := c.do("GET", "/api/node/"+url.PathEscape(id), nil, &node, nil)
+	if err != nil {
+		return nil, err
+	}
+	node.ETag = resp.Header.Get("ETag")
+	return &node, nil
+}
+
+// FindNode gets a node by ID, or else by path
+func (c *Client) FindNode(ref string) (*Node, error) {
+	node, err := c.Node(ref)
+	if !IsNotFound(err) {
+		return node, err
+	}
+	nodes, _, lerr := c.ListNodes(ListOptions{Path: ref, Limit: 1})
+	if lerr != nil {
+		return nil, lerr
+	}
+	if len(nodes) == 0 {
+		return nil, err
+	}
+	return c.Node(nodes[0].ID)
+}
+
+// CreateNode creates a node, from the template with slug template when
+// that's set, and returns it as stored
+func (c *Client) CreateNode(node Node, template string) (*Node, error) {
+	path := "/api/node-create"
+	if template != "" {
+		path = withQuery(path, url.Values{"template": {template}})
+	}
+	var out Node
+	if _, err := c.do("POST", path, node, &out, nil); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UpdateNode saves a node. With node.ETag set, the server refuses the save
+// (412) when the node changed since it was read.
+func (c *Client) UpdateNode(node Node) (*Node, error) {
+	var header http.Header
+	if node.ETag != "" {
+		header = http.Header{"If-Match": {node.ETag}}
+	}
+	var out Node
+	resp, err := c.do("PUT", "/api/node-update", node, &out, header)
+	if err != nil {
+		return nil, err
+	}
+	out.ETag = resp.Header.Get("ETag")
+	return &out, nil
+}
+
+// DeleteNode moves a node to the trash
+func (c *Client) DeleteNode(id string) error {
+	_, err := c.do("DELETE", withQuery("/api/node-delete", url.Values{"id": {id}}), nil, nil, nil)
+	return err
+}
+
+// Search finds nodes whose title or content contains query
+func (c *Client) Search(query string, opts SearchOptions) ([]Node, error) {
+	q := url.Values{"q": {query}}
+	if opts.SiteID != "" {
+		q.Set("site_id", opts.SiteID)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var nodes []Node
+	_, err := c.do("GET", withQuery("/api/search", q), nil, &nodes, nil)
+	return nodes, err
+}
+
+// Versions lists a node's versions, newest first
+func (c *Client) Versions(nodeID string) ([]Version, error) {
+	var versions []Version
+	_, err := c.do("GET", withQuery("/api/versions", url.Values{"node_id": {nodeID}}), nil, &versions, nil)
+	return versions, err
+}
+
+// Publish publishes a node's current version
+func (c *Client) Publish(nodeID string) error {
+	_, err := c.do("POST", withQuery("/api/publish", url.Values{"node_id": {nodeID}}), nil, nil, nil)
+	return err
+}
+
+// QueuePublishJob queues a job sending a node to a publishing channel, at
+// versionID when that's set
+func (c *Client) QueuePublishJob(nodeID, versionID, channelID string) (*PublishJob, error) {
+	var job PublishJob
+	in := PublishJob{NodeID: nodeID, VersionID: versionID, ChannelID: channelID}
+	if _, err := c.do("POST", "/api/publish-job", in, &job, nil); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ExportNode renders a node as zip, html, json, rss or md
+func (c *Client) ExportNode(id, format string) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := c.do("GET", withQuery("/api/node/"+url.PathEscape(id)+"/export", url.Values{"format": {format}}), nil, &out, nil)
+	return out.Bytes(), err
+}
+
+// Sites lists the sites
+func (c *Client) Sites() ([]Site, error) {
+	var sites []Site
+	_, err := c.do("GET", "/api/sites", nil, &sites, nil)
+	return sites, err
+}
+
+// do sends in as JSON and decodes the answer into out, or copies it when
+// out is a *bytes.Buffer. A status of 400 or more is an *Error.
+func (c *Client) do(method, path string, in, out interface{}, header http.Header) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.Base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode >= 400 {
+		return resp, decodeError(resp.StatusCode, data)
+	}
+	switch out := out.(type) {
+	case nil:
+	case *bytes.Buffer:
+		out.Write(data)
+	default:
+		if err := json.Unmarshal(data, out); err != nil {
+			return resp, fmt.Errorf("%s %s: %w", method, path, err)
+		}
+	}
+	return resp, nil
+}
+
+// decodeError reads the API's error envelope, falling back to the body
+// for answers without one
+func decodeError(status int, data []byte) *Error {
+	var env struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Fields map[string]string `json:"fields"`
+	}
+	e := &Error{Status: status}
+	if json.Unmarshal(data, &env) == nil && env.Error.Message != "" {
+		e.Code, e.Message, e.Fields = env.Error.Code, env.Error.Message, env.Fields
+		return e
+	}
+	e.Message = strings.TrimSpace(string(data))
+	return e
+}
+
+func withQuery(path string, q url.Values) string {
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClient(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		switch {
+		case r.URL.Path == "/api/nodes":
+			switch r.URL.Query().Get("path") {
+			case "":
+			case "notes/a.md":
+				w.Header().Set("X-Total-Count", "1")
+				json.NewEncoder(w).Encode([]Node{{ID: "n1", Path: "notes/a.md"}})
+				return
+			default:
+				w.Header().Set("X-Total-Count", "0")
+				w.Write([]byte("[]"))
+				return
+			}
+			w.Header().Set("X-Total-Count", "7")
+			json.NewEncoder(w).Encode([]Node{{ID: "n1"}, {ID: "n2"}})
+		case r.URL.Path == "/api/node/n1":
+			w.Header().Set("ETag", `"v1"`)
+			json.NewEncoder(w).Encode(Node{ID: "n1", Path: "notes/a.md", Title: "A"})
+		case r.URL.Path == "/api/node/n1/export":
+			w.Write([]byte("# A as " + r.URL.Query().Get("format")))
+		case r.URL.Path == "/api/node-create":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"code": "invalid", "message": "path is required"}, "fields": {"path": "is required"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL+"/", "tok")
+
+	nodes, total, err := c.ListNodes(ListOptions{Type: "note", Limit: 2})
+	if err != nil || total != 7 || len(nodes) != 2 {
+		t.Fatalf("ListNodes: %+v %d %v", nodes, total, err)
+	}
+	node, err := c.FindNode("notes/a.md")
+	if err != nil || node.ID != "n1" || node.Title != "A" || node.ETag != `"v1"` {
+		t.Fatalf("FindNode by path: %+v %v", node, err)
+	}
+	if _, err := c.FindNode("missing"); !IsNotFound(err) {
+		t.Fatalf("a missing node should be a 404, got %v", err)
+	}
+	if b, err := c.ExportNode("n1", "md"); err != nil || string(b) != "# A as md" {
+		t.Fatalf("ExportNode: %q %v", b, err)
+	}
+
+	_, err = c.CreateNode(Node{Type: "note"}, "")
+	e, ok := err.(*Error)
+	if !ok || e.Status != 400 || e.Code != "invalid" || e.Error() != "path is required" ||
+		!reflect.DeepEqual(e.Fields, map[string]string{"path": "is required"}) {
+		t.Fatalf("CreateNode error: %#v", err)
+	}
+	for _, a := range auth {
+		if a != "Bearer tok" {
+			t.Fatalf("requests should carry the token, got %q", a)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package codex
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+)
+
+// CachedStorage is a read-through LRU cache in front of another Storage.
+// Objects and commits are cached by hash up to maxBytes of payload; writes
+// through the cache invalidate the affected entries. Objects larger than an
+// eighth of the cap are streamed straight from the backend and never cached.
+// Object streams can seek when the backend's can, so they can serve ranges.
+type CachedStorage struct {
+	Storage
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // front = most recently used
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+}
+
+type cacheEntry struct {
+	key         string
+	data        []byte
+	contentType string
+}
+
+// CacheStats reports cache effectiveness
+type CacheStats struct {
+	Entries  int   `json:"entries"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+// NewCachedStorage wraps s with an LRU cache holding at most maxBytes of payload
+func NewCachedStorage(s Storage, maxBytes int64) *CachedStorage {
+	return &CachedStorage{Storage: s, maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Stats returns hit/miss counters and current usage
+func (c *CachedStorage) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.entries), Bytes: c.size, MaxBytes: c.maxBytes, Hits: c.hits, Misses: c.misses}
+}
+
+func (c *CachedStorage) maxEntry() int64 {
+	return c.maxBytes / 8
+}
+
+func (c *CachedStorage) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.hits++
+		return el.Value.(*cacheEntry), true
+	}
+	c.misses++
+	return nil, false
+}
+
+func (c *CachedStorage) put(key string, data []byte, contentType string) {
+	if int64(len(data)) > c.maxEntry() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= int64(len(el.Value.(*cacheEntry).data))
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, data: data, contentType: contentType})
+	c.size += int64(len(data))
+	for c.size > c.maxBytes {
+		el := c.order.Back()
+		e := el.Value.(*cacheEntry)
+		c.order.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= int64(len(e.data))
+	}
+}
+
+func (c *CachedStorage) invalidate(hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range []string{"object:" + hash, "commit:" + hash} {
+		if el, ok := c.entries[key]; ok {
+			c.size -= int64(len(el.Value.(*cacheEntry).data))
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// GetObject returns a copy of the object payload, reading through the cache
+func (c *CachedStorage) GetObject(hash string) ([]byte, error) {
+	if e, ok := c.get("object:" + hash); ok {
+		return append([]byte(nil), e.data...), nil
+	}
+	b, err := c.Storage.GetObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	c.put("object:"+hash, append([]byte(nil), b...), "")
+	return b, nil
+}
+
+// GetObjectStream serves cached objects from memory. On a miss, objects that fit
+// in a cache entry are buffered and cached; larger ones continue streaming.
+func (c *CachedStorage) GetObjectStream(hash string) (io.ReadCloser, string, error) {
+	if e, ok := c.get("object:" + hash); ok && e.contentType != "" {
+		return bytesReadCloser{bytes.NewReader(e.data)}, e.contentType, nil
+	}
+	rc, ct, err := c.Storage.GetObjectStream(hash)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, rc, c.maxEntry()+1)
+	if err == io.EOF {
+		rc.Close()
+		c.put("object:"+hash, buf.Bytes(), ct)
+		return bytesReadCloser{bytes.NewReader(buf.Bytes())}, ct, nil
+	}
+	if err != nil {
+		rc.Close()
+		return nil, "", err
+	}
+	// too large to cache: a seekable stream goes back to its start
+	if s, ok := rc.(io.ReadSeekCloser); ok {
+		if _, err := s.Seek(0, io.SeekStart); err == nil {
+			return s, ct, nil
+		}
+	}
+	// otherwise replay what was read, then continue from the backend
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf.Bytes()[:n]), rc), rc}, ct, nil
+}
+
+// bytesReadCloser is a cached object's stream, which can seek
+type bytesReadCloser struct{ *bytes.Reader }
+
+func (bytesReadCloser) Close() error { return nil }
+
+// GetCommit returns a decoded copy of the commit, reading through the cache
+func (c *CachedStorage) GetCommit(hash string) (*Commit, error) {
+	if e, ok := c.get("commit:" + hash); ok {
+		return UnmarshalCommit(e.data)
+	}
+	cm, err := c.Storage.GetCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := MarshalCommit(cm); err == nil {
+		c.put("commit:"+hash, b, "")
+	}
+	return cm, nil
+}
+
+func (c *CachedStorage) PutObject(hash string, payload []byte) error {
+	defer c.invalidate(hash)
+	return c.Storage.PutObject(hash, payload)
+}
+
+func (c *CachedStorage) PutObjectStream(r io.Reader, contentType string) (string, error) {
+	hash, err := c.Storage.PutObjectStream(r, contentType)
+	if err == nil {
+		c.invalidate(hash)
+	}
+	return hash, err
+}
+
+func (c *CachedStorage) PutCommit(cm *Commit) error {
+	defer c.invalidate(cm.Hash)
+	return c.Storage.PutCommit(cm)
+}
+
+func (c *CachedStorage) DeleteObject(hash string) error {
+	defer c.invalidate(hash)
+	return c.Storage.DeleteObject(hash)
+}
@@ -0,0 +1,92 @@
+package codex_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestCachedStorage_ReadThroughAndEviction(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("o1", []byte(`{"urn":"urn:node:1"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now(), Objects: []string{"o1"}})
+
+	cache := codex.NewCachedStorage(fs, 1024)
+	r := codex.NewRepository(cache, tmpdir)
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetObject("o1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.GetCommit("c1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := cache.Stats()
+	if st.Misses != 2 || st.Hits != 4 {
+		t.Fatalf("expected 2 misses / 4 hits, got %+v", st)
+	}
+
+	// Writes through the cache invalidate the cached payload
+	_ = r.PutObject("o1", []byte(`{"urn":"urn:node:1","v":2}`))
+	if b, _ := r.GetObject("o1"); !strings.Contains(string(b), `"v":2`) {
+		t.Fatalf("expected fresh payload after write, got %s", b)
+	}
+
+	// Filling past the cap evicts least recently used entries
+	for i := 0; i < 20; i++ {
+		h, err := r.PutObjectStream(strings.NewReader(strings.Repeat("x", 100)+string(rune('a'+i))), "text/plain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, ct, err := r.GetObjectStream(h)
+		if err != nil || ct != "text/plain" {
+			t.Fatalf("stream %s: ct=%q err=%v", h, ct, err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if len(b) != 101 {
+			t.Fatalf("unexpected streamed length %d", len(b))
+		}
+	}
+	if st := cache.Stats(); st.Bytes > st.MaxBytes {
+		t.Fatalf("cache exceeded its cap: %+v", st)
+	}
+
+	// Objects larger than an entry still stream in full without being cached
+	big := strings.Repeat("y", 4096)
+	h, _ := r.PutObjectStream(strings.NewReader(big), "text/plain")
+	rc, _, err := r.GetObjectStream(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != big {
+		t.Fatalf("large object corrupted through cache: %d bytes", len(b))
+	}
+
+	// Streams of cached and uncached objects can both seek, for ranges
+	for _, hash := range []string{h, "o1"} {
+		rc, _, err := r.GetObjectStream(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rc.(io.ReadSeeker); !ok {
+			t.Fatalf("stream of %s cannot seek: %T", hash, rc)
+		}
+		rc.Close()
+	}
+}
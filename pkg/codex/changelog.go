@@ -0,0 +1,140 @@
+package codex
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChangelogEntry is one page in a changelog
+type ChangelogEntry struct {
+	URN   string `json:"urn,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Title string `json:"title"`
+	Path  string `json:"path,omitempty"`
+	Hash  string `json:"hash"`
+	Link  string `json:"link,omitempty"` // filled in by the caller, see Changelog.Markdown
+}
+
+// Changelog summarises what changed between two commits for readers: which
+// pages were added, changed or removed
+type Changelog struct {
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	FromTime time.Time        `json:"from_time"`
+	ToTime   time.Time        `json:"to_time"`
+	Added    []ChangelogEntry `json:"added"`
+	Changed  []ChangelogEntry `json:"changed"`
+	Removed  []ChangelogEntry `json:"removed"`
+}
+
+// ResolveRevision turns a commit hash, tag or branch name, or full ref into a
+// commit hash. Tags are tried before branches.
+func (r *Repository) ResolveRevision(rev string) (string, error) {
+	if rev == "" {
+		return "", fmt.Errorf("empty revision")
+	}
+	if _, err := r.storage.GetCommit(rev); err == nil {
+		return rev, nil
+	}
+	for _, ref := range []string{"refs/tags/" + rev, "refs/heads/" + rev, rev} {
+		if h, err := r.storage.GetRef(ref); err == nil && h != "" {
+			if _, err := r.storage.GetCommit(h); err == nil {
+				return h, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown revision %q", rev)
+}
+
+// Changelog compares two revisions (see ResolveRevision). Objects are matched
+// by URN as in DiffCommits; entries are sorted by title.
+func (r *Repository) Changelog(fromRev, toRev string) (*Changelog, error) {
+	from, err := r.ResolveRevision(fromRev)
+	if err != nil {
+		return nil, err
+	}
+	to, err := r.ResolveRevision(toRev)
+	if err != nil {
+		return nil, err
+	}
+	diff, err := r.DiffCommits(from, to)
+	if err != nil {
+		return nil, err
+	}
+	cl := &Changelog{From: from, To: to, Added: []ChangelogEntry{}, Changed: []ChangelogEntry{}, Removed: []ChangelogEntry{}}
+	if c, err := r.storage.GetCommit(from); err == nil {
+		cl.FromTime = c.Timestamp
+	}
+	if c, err := r.storage.GetCommit(to); err == nil {
+		cl.ToTime = c.Timestamp
+	}
+
+	for _, m := range diff.Added {
+		cl.Added = append(cl.Added, r.changelogEntry(m["hash"].(string)))
+	}
+	for _, m := range diff.Removed {
+		cl.Removed = append(cl.Removed, r.changelogEntry(m["hash"].(string)))
+	}
+	for _, m := range diff.Modified {
+		cl.Changed = append(cl.Changed, r.changelogEntry(m["to"].(string)))
+	}
+	for _, list := range [][]ChangelogEntry{cl.Added, cl.Changed, cl.Removed} {
+		sort.SliceStable(list, func(i, j int) bool { return strings.ToLower(list[i].Title) < strings.ToLower(list[j].Title) })
+	}
+	return cl, nil
+}
+
+// changelogEntry describes an object by its title, falling back to its name,
+// path, URN and finally its hash
+func (r *Repository) changelogEntry(hash string) ChangelogEntry {
+	e := ChangelogEntry{Hash: hash}
+	side := r.loadSide(hash)
+	if side == nil {
+		e.Title = hash
+		return e
+	}
+	str := func(k string) string { s, _ := side.Fields[k].(string); return s }
+	e.URN, e.Type, e.Path = str("urn"), str("type"), str("path")
+	for _, k := range []string{"title", "name", "path", "urn"} {
+		if e.Title = str(k); e.Title != "" {
+			break
+		}
+	}
+	if e.Title == "" {
+		e.Title = hash
+	}
+	return e
+}
+
+// Markdown renders the changelog as a markdown document headed by title.
+// Entries with a Link are rendered as links.
+func (c *Changelog) Markdown(title string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	if !c.FromTime.IsZero() && !c.ToTime.IsZero() {
+		fmt.Fprintf(&b, "Changes from %s to %s.\n\n", c.FromTime.UTC().Format("2006-01-02"), c.ToTime.UTC().Format("2006-01-02"))
+	}
+	section := func(heading string, entries []ChangelogEntry) {
+		if len(entries) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "## %s\n\n", heading)
+		for _, e := range entries {
+			if e.Link != "" {
+				fmt.Fprintf(&b, "- [%s](%s)\n", e.Title, e.Link)
+			} else {
+				fmt.Fprintf(&b, "- %s\n", e.Title)
+			}
+		}
+		b.WriteString("\n")
+	}
+	section("Added", c.Added)
+	section("Changed", c.Changed)
+	section("Removed", c.Removed)
+	if len(c.Added)+len(c.Changed)+len(c.Removed) == 0 {
+		b.WriteString("No pages changed.\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package codex_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestChangelogBetweenTags(t *testing.T) {
+	fs := fsadapter.New(t.TempDir())
+	_ = fs.PutObject("a1", []byte(`{"urn":"urn:page:about","type":"page","title":"About","content":"v1"}`))
+	_ = fs.PutObject("a2", []byte(`{"urn":"urn:page:about","type":"page","title":"About","content":"v2"}`))
+	_ = fs.PutObject("old", []byte(`{"urn":"urn:page:old","type":"page","path":"old.md"}`))
+	_ = fs.PutObject("new", []byte(`{"urn":"urn:post:hello","type":"post","title":"Hello"}`))
+	_ = fs.PutObject("same", []byte(`{"urn":"urn:page:home","type":"page","title":"Home"}`))
+
+	c1 := &codex.Commit{Hash: "c1", Timestamp: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Objects: []string{"a1", "old", "same"}}
+	c2 := &codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), Objects: []string{"a2", "new", "same"}}
+	fs.PutCommit(c1)
+	fs.PutCommit(c2)
+	r := codex.NewRepository(fs, "")
+	r.SetRef("refs/tags/v1", "c1")
+	r.SetRef("refs/heads/main", "c2")
+
+	if _, err := r.Changelog("v0", "main"); err == nil {
+		t.Fatalf("expected unknown revision to fail")
+	}
+	cl, err := r.Changelog("v1", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.From != "c1" || cl.To != "c2" {
+		t.Fatalf("revisions not resolved: %s..%s", cl.From, cl.To)
+	}
+	if len(cl.Added) != 1 || cl.Added[0].Title != "Hello" ||
+		len(cl.Changed) != 1 || cl.Changed[0].URN != "urn:page:about" ||
+		len(cl.Removed) != 1 || cl.Removed[0].Title != "old.md" {
+		t.Fatalf("unexpected changelog: %+v", cl)
+	}
+
+	cl.Added[0].Link = "/posts/hello"
+	md := cl.Markdown("Release notes")
+	for _, want := range []string{"# Release notes", "2026-01-01 to 2026-02-01", "## Added\n\n- [Hello](/posts/hello)", "## Changed\n\n- About", "## Removed\n\n- old.md"} {
+		if !strings.Contains(md, want) {
+			t.Fatalf("markdown missing %q:\n%s", want, md)
+		}
+	}
+}
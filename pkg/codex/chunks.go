@@ -0,0 +1,326 @@
+package codex
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// === Delta Sync ===
+// Large content objects, media mostly, are synced in chunks so an edit to a
+// big file only moves the chunks it changed. Chunk boundaries come from the
+// content itself (a gear rolling hash), so an insertion shifts only the
+// chunks around it. Both sides keep an index of the chunks inside their
+// large objects. The sender asks which chunks the receiver lacks, sends
+// those as ordinary content objects, and has the receiver assemble the
+// object from its chunks and verify the whole hash. Chunks that arrived
+// before an interrupted sync are still there the next time, so the sync
+// resumes where it stopped. Loose chunk objects are unreachable once the
+// object is assembled, and GC reclaims them.
+
+// Chunker names the chunking scheme; both sides of a delta sync must agree
+const Chunker = "gear-1m"
+
+// DeltaMinSize is the size from which objects are synced in chunks
+const DeltaMinSize = 4 << 20
+
+const (
+	chunkMin  = 256 << 10
+	chunkMax  = 4 << 20
+	chunkMask = 1<<20 - 1 // about one boundary per MB
+)
+
+// ErrMissingChunks is returned by Assemble when chunks aren't present
+var ErrMissingChunks = errors.New("chunks missing")
+
+// gearTable drives the rolling hash; it is fixed so every instance cuts
+// content the same way
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// ChunkRef is one chunk of an object
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ChunkManifest lists the chunks an object is made of, in order
+type ChunkManifest struct {
+	Hash        string     `json:"hash"`
+	Size        int64      `json:"size"`
+	ContentType string     `json:"content_type,omitempty"`
+	Chunker     string     `json:"chunker"`
+	Chunks      []ChunkRef `json:"chunks"`
+}
+
+func (m *ChunkManifest) chunkHashes() []string {
+	hashes := make([]string, len(m.Chunks))
+	for i, c := range m.Chunks {
+		hashes[i] = c.Hash
+	}
+	return hashes
+}
+
+// chunkContent cuts rd into content-defined chunks, calling emit with each
+func chunkContent(rd io.Reader, emit func(data []byte) error) error {
+	br := bufio.NewReaderSize(rd, 1<<16)
+	buf := make([]byte, 0, chunkMax)
+	var h uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		h = h<<1 + gearTable[b]
+		if (len(buf) >= chunkMin && h&chunkMask == 0) || len(buf) >= chunkMax {
+			if err := emit(buf); err != nil {
+				return err
+			}
+			buf, h = buf[:0], 0
+		}
+	}
+	if len(buf) > 0 {
+		return emit(buf)
+	}
+	return nil
+}
+
+func chunkHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// chunkLoc is where a chunk's bytes sit inside an object
+type chunkLoc struct {
+	object string
+	offset int64
+	size   int64
+}
+
+// chunkIndex maps the chunks of a repository's large objects to where they
+// are. It is built as objects are first chunked and kept in memory for the
+// life of the Repository.
+type chunkIndex struct {
+	mu        sync.Mutex
+	manifests map[string]*ChunkManifest // object -> manifest, nil for objects not chunked
+	locs      map[string]chunkLoc
+}
+
+func (ci *chunkIndex) add(m *ChunkManifest) {
+	if ci.locs == nil {
+		ci.locs = map[string]chunkLoc{}
+	}
+	var off int64
+	for _, c := range m.Chunks {
+		if _, ok := ci.locs[c.Hash]; !ok {
+			ci.locs[c.Hash] = chunkLoc{object: m.Hash, offset: off, size: c.Size}
+		}
+		off += c.Size
+	}
+}
+
+// ChunkManifest chunks a content object, or returns its manifest from an
+// earlier pass
+func (r *Repository) ChunkManifest(hash string) (*ChunkManifest, error) {
+	r.chunks.mu.Lock()
+	m, ok := r.chunks.manifests[hash]
+	r.chunks.mu.Unlock()
+	if ok && m != nil {
+		return m, nil
+	}
+	rc, ct, err := r.storage.GetObjectStream(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	m = &ChunkManifest{Hash: hash, ContentType: ct, Chunker: Chunker, Chunks: []ChunkRef{}}
+	err = chunkContent(rc, func(data []byte) error {
+		m.Chunks = append(m.Chunks, ChunkRef{Hash: chunkHash(data), Size: int64(len(data))})
+		m.Size += int64(len(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.remember(hash, m)
+	return m, nil
+}
+
+// remember indexes the chunks of large objects
+func (r *Repository) remember(hash string, m *ChunkManifest) {
+	r.chunks.mu.Lock()
+	defer r.chunks.mu.Unlock()
+	if r.chunks.manifests == nil {
+		r.chunks.manifests = map[string]*ChunkManifest{}
+	}
+	if m.Size < DeltaMinSize {
+		r.chunks.manifests[hash] = nil
+		return
+	}
+	r.chunks.manifests[hash] = m
+	r.chunks.add(m)
+}
+
+// deltaManifest returns hash's manifest when it is a content object large
+// enough to sync in chunks, or nil when it is sent whole
+func (r *Repository) deltaManifest(hash string) (*ChunkManifest, error) {
+	r.chunks.mu.Lock()
+	m, done := r.chunks.manifests[hash]
+	r.chunks.mu.Unlock()
+	if done || !isContentHash(hash) {
+		return m, nil
+	}
+	rc, ct, err := r.storage.GetObjectStream(hash)
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	if ct == "application/json" {
+		// commits and JSON payloads are small and sent whole
+		r.remember(hash, &ChunkManifest{Hash: hash})
+		return nil, nil
+	}
+	if m, err = r.ChunkManifest(hash); err != nil || m.Size < DeltaMinSize {
+		return nil, err
+	}
+	return m, nil
+}
+
+// indexChunks chunks every large content object not yet indexed
+func (r *Repository) indexChunks() error {
+	hashes, err := r.storage.ListObjects("")
+	if err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		r.deltaManifest(h)
+	}
+	return nil
+}
+
+// MissingChunks returns the chunks among hashes that are neither loose
+// objects nor inside an indexed object
+func (r *Repository) MissingChunks(hashes []string) ([]string, error) {
+	if err := r.indexChunks(); err != nil {
+		return nil, err
+	}
+	objs, err := r.storage.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]struct{}, len(objs))
+	for _, h := range objs {
+		present[h] = struct{}{}
+	}
+	r.chunks.mu.Lock()
+	defer r.chunks.mu.Unlock()
+	missing := []string{}
+	for _, h := range hashes {
+		if _, ok := present[h]; ok {
+			continue
+		}
+		if loc, ok := r.chunks.locs[h]; ok {
+			if _, ok := present[loc.object]; ok {
+				continue
+			}
+		}
+		missing = append(missing, h)
+	}
+	return missing, nil
+}
+
+// OpenChunk reads a chunk from a loose object or from inside an indexed one
+func (r *Repository) OpenChunk(hash string) (io.ReadCloser, error) {
+	r.chunks.mu.Lock()
+	loc, ok := r.chunks.locs[hash]
+	r.chunks.mu.Unlock()
+	if ok {
+		rc, _, err := r.storage.GetObjectStream(loc.object)
+		if err == nil {
+			if s, isSeeker := rc.(io.Seeker); isSeeker {
+				_, err = s.Seek(loc.offset, io.SeekStart)
+			} else {
+				_, err = io.CopyN(ioutil.Discard, rc, loc.offset)
+			}
+			if err != nil {
+				rc.Close()
+				return nil, err
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(rc, loc.size), rc}, nil
+		}
+	}
+	rc, _, err := r.storage.GetObjectStream(hash)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", hash, os.ErrNotExist)
+	}
+	return rc, nil
+}
+
+// Assemble stores the object m describes from chunks already present and
+// checks it hashes to m.Hash
+func (r *Repository) Assemble(m *ChunkManifest) error {
+	if m.Chunker != Chunker {
+		return fmt.Errorf("unknown chunker %q", m.Chunker)
+	}
+	missing, err := r.MissingChunks(m.chunkHashes())
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %d of %d", ErrMissingChunks, len(missing), len(m.Chunks))
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range m.Chunks {
+			rc, err := r.OpenChunk(c.Hash)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			n, err := io.Copy(pw, rc)
+			rc.Close()
+			if err == nil && n != c.Size {
+				err = fmt.Errorf("chunk %s is %d bytes, expected %d", c.Hash, n, c.Size)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	got, err := r.storage.PutObjectStream(pr, m.ContentType)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	if got != m.Hash {
+		return fmt.Errorf("assembled object hashes to %s, expected %s", got, m.Hash)
+	}
+	r.remember(m.Hash, m)
+	return nil
+}
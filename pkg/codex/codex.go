@@ -22,6 +22,8 @@ type Commit struct {
 	Timestamp time.Time `json:"timestamp"`
 	Message   string    `json:"message,omitempty"`
 	Objects   []string  `json:"objects,omitempty"`
+	// Resolutions records how conflicts were settled when this is a resolved merge commit
+	Resolutions []Resolution `json:"resolutions,omitempty"`
 }
 
 // Storage is the interface for pluggable storage backends
@@ -48,12 +50,16 @@ type Storage interface {
 	PutRef(ref string, hash string) error
 	GetRef(ref string) (string, error)
 	ListRefs(prefix string) ([]string, error)
+
+	// DeleteObject removes an object and any sidecar metadata (used by GC)
+	DeleteObject(hash string) error
 }
 
 // Repository is a lightweight wrapper around a storage backend
 type Repository struct {
 	storage Storage
 	path    string // optional filesystem path for repo (for status/debug)
+	chunks  chunkIndex
 }
 
 // NewRepository creates a Repository over the provided storage backend
@@ -183,7 +189,9 @@ type DiffResult struct {
 	Modified []map[string]interface{} `json:"modified"`
 }
 
-// DiffCommits computes differences between two commits by object hashes
+// DiffCommits computes differences between two commits. Objects sharing a URN
+// across the commits are reported as modified, with changes rendered by the
+// DiffRenderer registered for their entity type; the rest are added or removed.
 func (r *Repository) DiffCommits(fromHash, toHash string) (*DiffResult, error) {
 	fromC, err := r.storage.GetCommit(fromHash)
 	if err != nil {
@@ -201,35 +209,40 @@ func (r *Repository) DiffCommits(fromHash, toHash string) (*DiffResult, error) {
 	for _, h := range toC.Objects {
 		toSet[h] = struct{}{}
 	}
-	res := &DiffResult{}
-	// Added: in toSet not in fromSet
+	var added, removed []string
 	for _, h := range toC.Objects {
 		if _, ok := fromSet[h]; !ok {
-			// attempt preview
-			if b, err := r.storage.GetObject(h); err == nil {
-				var v map[string]interface{}
-				if json.Unmarshal(b, &v) == nil {
-					res.Added = append(res.Added, map[string]interface{}{"hash": h, "preview": v})
-					continue
-				}
-			}
-			res.Added = append(res.Added, map[string]interface{}{"hash": h})
+			added = append(added, h)
 		}
 	}
-	// Removed
 	for _, h := range fromC.Objects {
 		if _, ok := toSet[h]; !ok {
-			if b, err := r.storage.GetObject(h); err == nil {
-				var v map[string]interface{}
-				if json.Unmarshal(b, &v) == nil {
-					res.Removed = append(res.Removed, map[string]interface{}{"hash": h, "preview": v})
-					continue
-				}
+			removed = append(removed, h)
+		}
+	}
+	res := &DiffResult{}
+	var used map[string]struct{}
+	res.Modified, used = r.renderModified(added, removed)
+	entry := func(h string) map[string]interface{} {
+		// attempt preview
+		if b, err := r.storage.GetObject(h); err == nil {
+			var v map[string]interface{}
+			if json.Unmarshal(b, &v) == nil {
+				return map[string]interface{}{"hash": h, "preview": v}
 			}
-			res.Removed = append(res.Removed, map[string]interface{}{"hash": h})
+		}
+		return map[string]interface{}{"hash": h}
+	}
+	for _, h := range added {
+		if _, ok := used[h]; !ok {
+			res.Added = append(res.Added, entry(h))
+		}
+	}
+	for _, h := range removed {
+		if _, ok := used[h]; !ok {
+			res.Removed = append(res.Removed, entry(h))
 		}
 	}
-	// Modified: none in content-addressed store (hash change considered add/remove)
 	return res, nil
 }
 
@@ -239,6 +252,9 @@ type Conflict struct {
 	Base   string `json:"base"`
 	Ours   string `json:"ours"`
 	Theirs string `json:"theirs"`
+	// Fields lists the JSON fields changed differently on both sides, when
+	// the objects could be compared field by field
+	Fields []string `json:"fields,omitempty"`
 }
 
 // FindCommonAncestor finds a common ancestor commit between two commits by
@@ -299,14 +315,25 @@ func parseURN(b []byte) (string, bool) {
 	return "", false
 }
 
-// MergeCommits performs a three-way merge between base, ours and theirs commits.
-// If base is empty, the repository will attempt to discover a common ancestor.
-// It returns the merged Commit (stored in repo) or a list of Conflicts if any were detected.
-func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, message string) (*Commit, []Conflict, error) {
+// MergePreview is the outcome of a three-way merge before it is committed.
+// Objects holds the merged object set (excluding conflicting URNs), including
+// the objects in Merged, which are only stored once the merge is committed.
+type MergePreview struct {
+	Base      string         `json:"base"`
+	Ours      string         `json:"ours"`
+	Theirs    string         `json:"theirs"`
+	Objects   []string       `json:"objects"`
+	Conflicts []Conflict     `json:"conflicts"`
+	Merged    []ContentMerge `json:"merged,omitempty"`
+}
+
+// PreviewMerge runs the three-way merge between base, ours and theirs without
+// writing anything. If base is empty, a common ancestor is discovered.
+func (r *Repository) PreviewMerge(baseHash, oursHash, theirsHash string) (*MergePreview, error) {
 	if baseHash == "" {
 		a, err := r.FindCommonAncestor(oursHash, theirsHash)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		baseHash = a
 	}
@@ -314,11 +341,11 @@ func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, messag
 	baseC, _ := r.storage.GetCommit(baseHash)
 	oursC, err := r.storage.GetCommit(oursHash)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	theirsC, err := r.storage.GetCommit(theirsHash)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Build URN maps for base/ours/theirs when available
@@ -360,6 +387,7 @@ func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, messag
 	}
 
 	conflicts := []Conflict{}
+	contentMerges := []ContentMerge{}
 	mergedObjects := map[string]struct{}{}
 
 	// Resolve URN-based objects
@@ -379,9 +407,14 @@ func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, messag
 		case t != "" && o == "":
 			mergedObjects[t] = struct{}{}
 		default:
-			// conflict if both changed and differ
+			// both changed and differ: merge the JSON fields if they allow it
 			if o != t {
-				conflicts = append(conflicts, Conflict{URN: u, Base: b, Ours: o, Theirs: t})
+				if m, fields := r.mergeContent(b, o, t); m != nil {
+					contentMerges = append(contentMerges, *m)
+					mergedObjects[m.Object] = struct{}{}
+				} else {
+					conflicts = append(conflicts, Conflict{URN: u, Base: b, Ours: o, Theirs: t, Fields: fields})
+				}
 			}
 		}
 	}
@@ -414,24 +447,43 @@ func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, messag
 	addHashUnion(oursC.Objects)
 	addHashUnion(theirsC.Objects)
 
-	if len(conflicts) > 0 {
-		return nil, conflicts, nil
-	}
-
-	// create merged commit
 	objs := []string{}
 	for h := range mergedObjects {
 		objs = append(objs, h)
 	}
-	// deterministic sort
+	// deterministic order
 	sort.Strings(objs)
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].URN < conflicts[j].URN })
+	sort.Slice(contentMerges, func(i, j int) bool { return contentMerges[i].URN < contentMerges[j].URN })
+	return &MergePreview{Base: baseHash, Ours: oursHash, Theirs: theirsHash, Objects: objs, Conflicts: conflicts, Merged: contentMerges}, nil
+}
+
+// MergeCommits performs a three-way merge between base, ours and theirs commits.
+// If base is empty, the repository will attempt to discover a common ancestor.
+// It returns the merged Commit (stored in repo) or a list of Conflicts if any were detected.
+func (r *Repository) MergeCommits(baseHash, oursHash, theirsHash, author, message string) (*Commit, []Conflict, error) {
+	if err := r.ValidateCommitMessage(message); err != nil {
+		return nil, nil, err
+	}
+	preview, err := r.PreviewMerge(baseHash, oursHash, theirsHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(preview.Conflicts) > 0 {
+		return nil, preview.Conflicts, nil
+	}
+	if err := r.storeContentMerges(preview.Merged); err != nil {
+		return nil, nil, err
+	}
+
+	// create merged commit
 	mcommit := &Commit{
 		Hash:      "", // hash may be set externally; leave for PutCommit
 		Parents:   []string{oursHash, theirsHash},
 		Author:    author,
 		Timestamp: time.Now().UTC(),
 		Message:   message,
-		Objects:   objs,
+		Objects:   preview.Objects,
 	}
 	// compute commit hash deterministically and set it
 	mcommit.Hash = computeCommitHash(mcommit)
@@ -0,0 +1,191 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// DefaultConventionalTypes are the commit types accepted when a policy enables
+// conventional commits without listing its own types.
+var DefaultConventionalTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+var conventionalSubject = regexp.MustCompile(`^([a-z]+)(\(([^()]+)\))?(!)?: (\S.*)$`)
+var trailerLine = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9-]*): (\S.*)$`)
+
+// CommitPolicy describes how commit messages are built and validated.
+// It is loaded from <repo>/.codex/commit_policy.json when present.
+type CommitPolicy struct {
+	// Template is a text/template used to render messages from fields such as
+	// .type, .scope, .subject and .body.
+	Template string `json:"template,omitempty"`
+	// Conventional requires "<type>(<scope>): <subject>" subject lines.
+	Conventional bool `json:"conventional,omitempty"`
+	// Types restricts the allowed conventional types (defaults to DefaultConventionalTypes).
+	Types []string `json:"types,omitempty"`
+	// RequiredTrailers lists trailer keys (e.g. "Reviewed-by") that must appear in the final paragraph.
+	RequiredTrailers []string `json:"required_trailers,omitempty"`
+	// MaxSubjectLength limits the first line of the message when > 0.
+	MaxSubjectLength int `json:"max_subject_length,omitempty"`
+}
+
+// CommitMessageError is returned when a message violates the commit policy
+type CommitMessageError struct {
+	Message  string
+	Problems []string
+}
+
+func (e *CommitMessageError) Error() string {
+	return fmt.Sprintf("commit message rejected: %s", strings.Join(e.Problems, "; "))
+}
+
+// commitPolicyPath returns the location of the policy file for a repository path
+func commitPolicyPath(repoPath string) string {
+	return filepath.Join(repoPath, ".codex", "commit_policy.json")
+}
+
+// LoadCommitPolicy reads the commit policy for the repository at repoPath.
+// It returns nil (and no error) when no policy has been configured.
+func LoadCommitPolicy(repoPath string) (*CommitPolicy, error) {
+	b, err := ioutil.ReadFile(commitPolicyPath(repoPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var p CommitPolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid commit policy: %w", err)
+	}
+	return &p, nil
+}
+
+// SaveCommitPolicy writes the commit policy for the repository at repoPath
+func SaveCommitPolicy(repoPath string, p *CommitPolicy) error {
+	if err := os.MkdirAll(filepath.Join(repoPath, ".codex"), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(commitPolicyPath(repoPath), b, 0o644)
+}
+
+// Render builds a commit message from fields using the policy template.
+// Without a template the "subject" and "body" fields are joined as-is.
+func (p *CommitPolicy) Render(fields map[string]string) (string, error) {
+	if p == nil || p.Template == "" {
+		msg := fields["subject"]
+		if body := fields["body"]; body != "" {
+			msg += "\n\n" + body
+		}
+		return msg, nil
+	}
+	t, err := template.New("commit").Option("missingkey=zero").Parse(p.Template)
+	if err != nil {
+		return "", fmt.Errorf("invalid commit template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, fields); err != nil {
+		return "", fmt.Errorf("render commit template: %w", err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Validate checks msg against the policy and returns a *CommitMessageError
+// listing every problem found. A nil policy accepts any non-empty message.
+func (p *CommitPolicy) Validate(msg string) error {
+	msg = strings.TrimSpace(msg)
+	if msg == "" {
+		return &CommitMessageError{Message: msg, Problems: []string{"message is empty"}}
+	}
+	if p == nil {
+		return nil
+	}
+
+	var problems []string
+	subject := strings.SplitN(msg, "\n", 2)[0]
+
+	if p.MaxSubjectLength > 0 && len(subject) > p.MaxSubjectLength {
+		problems = append(problems, fmt.Sprintf("subject is %d characters, limit is %d", len(subject), p.MaxSubjectLength))
+	}
+
+	if p.Conventional {
+		m := conventionalSubject.FindStringSubmatch(subject)
+		if m == nil {
+			problems = append(problems, fmt.Sprintf(`subject %q does not follow conventional commits; expected "<type>(<scope>): <subject>", e.g. "feat(nodes): add history endpoint"`, subject))
+		} else {
+			types := p.Types
+			if len(types) == 0 {
+				types = DefaultConventionalTypes
+			}
+			allowed := false
+			for _, t := range types {
+				if t == m[1] {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				problems = append(problems, fmt.Sprintf("unknown commit type %q; allowed types: %s", m[1], strings.Join(types, ", ")))
+			}
+		}
+	}
+
+	if len(p.RequiredTrailers) > 0 {
+		trailers := parseTrailers(msg)
+		for _, key := range p.RequiredTrailers {
+			if _, ok := trailers[strings.ToLower(key)]; !ok {
+				problems = append(problems, fmt.Sprintf(`missing required trailer "%s: <value>" in the last paragraph`, key))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &CommitMessageError{Message: msg, Problems: problems}
+	}
+	return nil
+}
+
+// parseTrailers returns the "Key: value" trailers of the message's final paragraph keyed by lower-cased key
+func parseTrailers(msg string) map[string]string {
+	out := map[string]string{}
+	paras := strings.Split(strings.TrimSpace(msg), "\n\n")
+	if len(paras) < 2 {
+		return out
+	}
+	for _, line := range strings.Split(paras[len(paras)-1], "\n") {
+		if m := trailerLine.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			out[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	return out
+}
+
+// CommitPolicy returns the commit policy configured for the repository, if any
+func (r *Repository) CommitPolicy() (*CommitPolicy, error) {
+	if r.path == "" {
+		return nil, nil
+	}
+	return LoadCommitPolicy(r.path)
+}
+
+// ValidateCommitMessage checks msg against the repository's commit policy
+func (r *Repository) ValidateCommitMessage(msg string) error {
+	p, err := r.CommitPolicy()
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	return p.Validate(msg)
+}
@@ -0,0 +1,82 @@
+package codex_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestCommitPolicyValidate(t *testing.T) {
+	p := &codex.CommitPolicy{Conventional: true, RequiredTrailers: []string{"Reviewed-by"}, MaxSubjectLength: 50}
+
+	cases := []struct {
+		msg string
+		ok  bool
+	}{
+		{"feat(nodes): add history\n\nReviewed-by: alice", true},
+		{"fix: handle empty body\n\nSome detail.\n\nReviewed-by: bob", true},
+		{"add history\n\nReviewed-by: alice", false},
+		{"wat(nodes): add history\n\nReviewed-by: alice", false},
+		{"feat(nodes): add history", false},
+		{"feat: " + strings.Repeat("x", 60) + "\n\nReviewed-by: alice", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		err := p.Validate(c.msg)
+		if c.ok && err != nil {
+			t.Fatalf("expected %q to pass, got %v", c.msg, err)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("expected %q to be rejected", c.msg)
+		}
+	}
+}
+
+func TestCommitPolicyRender(t *testing.T) {
+	p := &codex.CommitPolicy{Template: "{{.type}}{{if .scope}}({{.scope}}){{end}}: {{.subject}}"}
+	msg, err := p.Render(map[string]string{"type": "docs", "scope": "readme", "subject": "explain policies"})
+	if err != nil {
+		t.Fatalf("render error: %v", err)
+	}
+	if msg != "docs(readme): explain policies" {
+		t.Fatalf("unexpected message: %q", msg)
+	}
+	msg, _ = p.Render(map[string]string{"type": "fix", "subject": "no scope"})
+	if msg != "fix: no scope" {
+		t.Fatalf("unexpected message without scope: %q", msg)
+	}
+}
+
+func TestMergeCommits_EnforcesCommitPolicy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-policy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("o1", []byte(`{"urn":"urn:node:1"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"o1"}})
+	_ = fs.PutObject("o2", []byte(`{"urn":"urn:node:2"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"o1", "o2"}})
+
+	if err := codex.SaveCommitPolicy(tmpdir, &codex.CommitPolicy{Conventional: true}); err != nil {
+		t.Fatalf("save policy: %v", err)
+	}
+
+	r := codex.NewRepository(fs, tmpdir)
+	_, _, err = r.MergeCommits("c1", "c1", "c2", "m", "merge stuff")
+	var msgErr *codex.CommitMessageError
+	if !errors.As(err, &msgErr) {
+		t.Fatalf("expected CommitMessageError, got %v", err)
+	}
+	if _, _, err := r.MergeCommits("c1", "c1", "c2", "m", "chore: merge c2"); err != nil {
+		t.Fatalf("expected conventional merge message to pass: %v", err)
+	}
+}
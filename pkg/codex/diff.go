@@ -0,0 +1,218 @@
+package codex
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiffSide is one version of an entity handed to a DiffRenderer
+type DiffSide struct {
+	Hash    string
+	Payload []byte
+	Fields  map[string]interface{} // decoded JSON payload
+}
+
+// DiffRenderer describes the change between two versions of an entity in a
+// form meant for people (line diffs, field changes, size deltas, ...)
+type DiffRenderer func(from, to *DiffSide) interface{}
+
+// FieldChange is a changed top-level field of a structured entity
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+// LineChange is a removed ("-") or added ("+") line in a text diff
+type LineChange struct {
+	Op   string `json:"op"`
+	Line int    `json:"line"` // 1-based line in the old text for "-", new text for "+"
+	Text string `json:"text"`
+}
+
+// maxDiffLines bounds the line diff; longer texts only report line counts
+const maxDiffLines = 2000
+
+var (
+	diffRenderersMu sync.RWMutex
+	diffRenderers   = map[string]DiffRenderer{}
+)
+
+// RegisterDiffRenderer sets the renderer used for entities whose "type" field
+// equals entityType, replacing any previous one. The "*" type is the fallback.
+func RegisterDiffRenderer(entityType string, fn DiffRenderer) {
+	diffRenderersMu.Lock()
+	defer diffRenderersMu.Unlock()
+	diffRenderers[entityType] = fn
+}
+
+func diffRendererFor(entityType string) DiffRenderer {
+	diffRenderersMu.RLock()
+	defer diffRenderersMu.RUnlock()
+	if fn, ok := diffRenderers[entityType]; ok {
+		return fn
+	}
+	return diffRenderers["*"]
+}
+
+func init() {
+	for _, t := range []string{"text", "note", "page", "post", "code"} {
+		RegisterDiffRenderer(t, TextDiffRenderer)
+	}
+	for _, t := range []string{"media", "image", "video", "audio"} {
+		RegisterDiffRenderer(t, MediaDiffRenderer)
+	}
+	RegisterDiffRenderer("*", FieldDiffRenderer)
+}
+
+// FieldDiffRenderer lists changed top-level fields
+func FieldDiffRenderer(from, to *DiffSide) interface{} {
+	return map[string]interface{}{"fields": fieldChanges(from.Fields, to.Fields, "")}
+}
+
+// TextDiffRenderer line-diffs the "content" field and lists other changed fields
+func TextDiffRenderer(from, to *DiffSide) interface{} {
+	out := map[string]interface{}{"fields": fieldChanges(from.Fields, to.Fields, "content")}
+	a, _ := from.Fields["content"].(string)
+	b, _ := to.Fields["content"].(string)
+	if a != b {
+		out["lines"] = lineDiff(a, b)
+	}
+	return out
+}
+
+// MediaDiffRenderer lists changed metadata fields and the size delta. The size
+// comes from a "size" field when present, otherwise from the object itself.
+func MediaDiffRenderer(from, to *DiffSide) interface{} {
+	size := func(s *DiffSide) int64 {
+		if v, ok := s.Fields["size"].(float64); ok {
+			return int64(v)
+		}
+		return int64(len(s.Payload))
+	}
+	a, b := size(from), size(to)
+	return map[string]interface{}{
+		"fields": fieldChanges(from.Fields, to.Fields, ""),
+		"size":   map[string]int64{"from": a, "to": b, "delta": b - a},
+	}
+}
+
+// fieldChanges compares top-level fields, skipping "urn" and skip
+func fieldChanges(a, b map[string]interface{}, skip string) []FieldChange {
+	keys := map[string]struct{}{}
+	for k := range a {
+		keys[k] = struct{}{}
+	}
+	for k := range b {
+		keys[k] = struct{}{}
+	}
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		if k != "urn" && k != skip {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	changes := []FieldChange{}
+	for _, k := range names {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changes = append(changes, FieldChange{Field: k, From: a[k], To: b[k]})
+		}
+	}
+	return changes
+}
+
+// lineDiff returns removed and added lines using a longest-common-subsequence walk
+func lineDiff(a, b string) interface{} {
+	al := strings.Split(a, "\n")
+	bl := strings.Split(b, "\n")
+	if len(al) > maxDiffLines || len(bl) > maxDiffLines {
+		return map[string]int{"from_lines": len(al), "to_lines": len(bl)}
+	}
+	n, m := len(al), len(bl)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	changes := []LineChange{}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && al[i] == bl[j]:
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			changes = append(changes, LineChange{Op: "-", Line: i + 1, Text: al[i]})
+			i++
+		default:
+			changes = append(changes, LineChange{Op: "+", Line: j + 1, Text: bl[j]})
+			j++
+		}
+	}
+	return changes
+}
+
+// loadSide reads a JSON object for diffing; nil if it is missing or not JSON
+func (r *Repository) loadSide(h string) *DiffSide {
+	b, err := r.storage.GetObject(h)
+	if err != nil {
+		return nil
+	}
+	var v map[string]interface{}
+	if json.Unmarshal(b, &v) != nil {
+		return nil
+	}
+	return &DiffSide{Hash: h, Payload: b, Fields: v}
+}
+
+// renderModified pairs objects that share a URN across the two commits and
+// renders their change with the renderer registered for the entity type.
+// It returns the modified entries and the hashes it consumed.
+func (r *Repository) renderModified(added, removed []string) ([]map[string]interface{}, map[string]struct{}) {
+	load := r.loadSide
+	oldByURN := map[string]*DiffSide{}
+	for _, h := range removed {
+		if s := load(h); s != nil {
+			if urn, _ := s.Fields["urn"].(string); urn != "" {
+				oldByURN[urn] = s
+			}
+		}
+	}
+	used := map[string]struct{}{}
+	modified := []map[string]interface{}{}
+	for _, h := range added {
+		to := load(h)
+		if to == nil {
+			continue
+		}
+		urn, _ := to.Fields["urn"].(string)
+		from, ok := oldByURN[urn]
+		if urn == "" || !ok {
+			continue
+		}
+		typ, _ := to.Fields["type"].(string)
+		entry := map[string]interface{}{"urn": urn, "type": typ, "from": from.Hash, "to": to.Hash}
+		if fn := diffRendererFor(typ); fn != nil {
+			entry["changes"] = fn(from, to)
+		}
+		modified = append(modified, entry)
+		used[from.Hash] = struct{}{}
+		used[to.Hash] = struct{}{}
+		delete(oldByURN, urn)
+	}
+	return modified, used
+}
@@ -0,0 +1,89 @@
+package codex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestDiffCommits_RenderersByType(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("t1", []byte(`{"urn":"urn:note:1","type":"note","title":"A","content":"one\ntwo\nthree"}`))
+	_ = fs.PutObject("t2", []byte(`{"urn":"urn:note:1","type":"note","title":"B","content":"one\n2\nthree"}`))
+	_ = fs.PutObject("m1", []byte(`{"urn":"urn:media:1","type":"image","size":100,"mime":"image/png"}`))
+	_ = fs.PutObject("m2", []byte(`{"urn":"urn:media:1","type":"image","size":250,"mime":"image/png"}`))
+	_ = fs.PutObject("s1", []byte(`{"urn":"urn:entity:1","type":"person","name":"Ada"}`))
+	_ = fs.PutObject("s2", []byte(`{"urn":"urn:entity:1","type":"person","name":"Ada","born":1815}`))
+	_ = fs.PutObject("x", []byte(`{"urn":"urn:gone","type":"note"}`))
+
+	c1 := &codex.Commit{Hash: "c1", Author: "a", Timestamp: time.Now().Add(-time.Hour), Message: "first", Objects: []string{"t1", "m1", "s1", "x"}}
+	c2 := &codex.Commit{Hash: "c2", Parents: []string{"c1"}, Author: "a", Timestamp: time.Now(), Message: "second", Objects: []string{"t2", "m2", "s2"}}
+	_ = fs.PutCommit(c1)
+	_ = fs.PutCommit(c2)
+
+	r := codex.NewRepository(fs, tmpdir)
+	diff, err := r.DiffCommits("c1", "c2")
+	if err != nil {
+		t.Fatalf("diff commits: %v", err)
+	}
+	if len(diff.Added) != 0 || len(diff.Removed) != 1 || len(diff.Modified) != 3 {
+		t.Fatalf("unexpected diff shape: %+v", diff)
+	}
+
+	byURN := map[string]map[string]interface{}{}
+	for _, m := range diff.Modified {
+		byURN[m["urn"].(string)] = m["changes"].(map[string]interface{})
+	}
+
+	lines := byURN["urn:note:1"]["lines"].([]codex.LineChange)
+	if len(lines) != 2 || lines[0].Op != "-" || lines[0].Text != "two" || lines[1].Op != "+" || lines[1].Text != "2" {
+		t.Fatalf("unexpected line diff: %+v", lines)
+	}
+	if f := byURN["urn:note:1"]["fields"].([]codex.FieldChange); len(f) != 1 || f[0].Field != "title" {
+		t.Fatalf("unexpected text field changes: %+v", f)
+	}
+
+	size := byURN["urn:media:1"]["size"].(map[string]int64)
+	if size["delta"] != 150 {
+		t.Fatalf("unexpected media size delta: %+v", size)
+	}
+
+	if f := byURN["urn:entity:1"]["fields"].([]codex.FieldChange); len(f) != 1 || f[0].Field != "born" {
+		t.Fatalf("unexpected field diff: %+v", f)
+	}
+}
+
+func TestRegisterDiffRenderer(t *testing.T) {
+	codex.RegisterDiffRenderer("widget", func(from, to *codex.DiffSide) interface{} {
+		return "custom"
+	})
+	tmpdir, err := ioutil.TempDir("", "codex-diff-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("w1", []byte(`{"urn":"urn:w","type":"widget","v":1}`))
+	_ = fs.PutObject("w2", []byte(`{"urn":"urn:w","type":"widget","v":2}`))
+	_ = fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now(), Objects: []string{"w1"}})
+	_ = fs.PutCommit(&codex.Commit{Hash: "c2", Timestamp: time.Now(), Objects: []string{"w2"}})
+
+	diff, err := codex.NewRepository(fs, tmpdir).DiffCommits("c1", "c2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Modified) != 1 || diff.Modified[0]["changes"] != "custom" {
+		t.Fatalf("custom renderer not used: %+v", diff.Modified)
+	}
+}
@@ -0,0 +1,89 @@
+package codex
+
+import (
+	"sort"
+)
+
+// GCReport describes what a garbage collection pass found (and removed)
+type GCReport struct {
+	DryRun           bool     `json:"dry_run"`
+	Commits          int      `json:"commits"`
+	Reachable        int      `json:"reachable"`
+	Unreachable      []string `json:"unreachable"`
+	ReclaimableBytes int64    `json:"reclaimable_bytes"`
+	Removed          int      `json:"removed"`
+}
+
+// GC removes objects that no commit or ref refers to. Commits themselves are
+// always kept, so history is never rewritten; only orphaned content (uploads
+// that were never committed, superseded payloads) is pruned. With dryRun the
+// report lists what would be removed without touching storage.
+//
+// Objects uploaded for a commit that has not been written yet are unreachable
+// too, so avoid running GC concurrently with imports or uploads.
+func (r *Repository) GC(dryRun bool) (*GCReport, error) {
+	hashes, err := r.storage.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{DryRun: dryRun, Unreachable: []string{}}
+	reachable := map[string]struct{}{}
+	sizes := map[string]int64{}
+	for _, h := range hashes {
+		if _, ok := sizes[h]; ok {
+			continue
+		}
+		st, err := r.statObject(h)
+		if err != nil {
+			continue
+		}
+		sizes[h] = st.Size
+		if !st.IsCommit {
+			continue
+		}
+		c, err := r.storage.GetCommit(h)
+		if err != nil {
+			continue
+		}
+		report.Commits++
+		reachable[h] = struct{}{}
+		for _, o := range c.Objects {
+			reachable[o] = struct{}{}
+		}
+		for _, res := range c.Resolutions {
+			reachable[res.Object] = struct{}{}
+		}
+	}
+
+	refs, err := r.storage.ListRefs("")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		if h, err := r.storage.GetRef(ref); err == nil && h != "" {
+			reachable[h] = struct{}{}
+		}
+	}
+
+	for h, size := range sizes {
+		if _, ok := reachable[h]; ok {
+			report.Reachable++
+			continue
+		}
+		report.Unreachable = append(report.Unreachable, h)
+		report.ReclaimableBytes += size
+	}
+	sort.Strings(report.Unreachable)
+
+	if dryRun {
+		return report, nil
+	}
+	for _, h := range report.Unreachable {
+		if err := r.storage.DeleteObject(h); err != nil {
+			return report, err
+		}
+		report.Removed++
+	}
+	return report, nil
+}
@@ -0,0 +1,60 @@
+package codex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestGC_RemovesOnlyUnreachableObjects(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-gc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("o1", []byte(`{"urn":"urn:node:1"}`))
+	_ = fs.PutObject("o2", []byte(`{"urn":"urn:node:2"}`))
+	_ = fs.PutObject("orphan", []byte(`{"urn":"urn:node:3"}`))
+	streamed, err := fs.PutObjectStream(strings.NewReader("never committed"), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now(), Objects: []string{"o1"}})
+	_ = fs.PutRef("refs/tags/keep", "o2")
+
+	r := codex.NewRepository(fs, tmpdir)
+	report, err := r.GC(true)
+	if err != nil {
+		t.Fatalf("gc dry run: %v", err)
+	}
+	if len(report.Unreachable) != 2 || report.ReclaimableBytes != int64(len(`{"urn":"urn:node:3"}`)+len("never committed")) {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+	if objs, _ := fs.ListObjects(""); len(objs) != 5 {
+		t.Fatalf("dry run must not remove objects, have %v", objs)
+	}
+
+	report, err = r.GC(false)
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if report.Removed != 2 || report.Commits != 1 {
+		t.Fatalf("unexpected gc report: %+v", report)
+	}
+	objs, _ := fs.ListObjects("")
+	for _, h := range objs {
+		if h == "orphan" || h == streamed {
+			t.Fatalf("expected %s to be removed, still have %v", h, objs)
+		}
+	}
+	if len(objs) != 3 {
+		t.Fatalf("expected commit and referenced objects to remain, have %v", objs)
+	}
+}
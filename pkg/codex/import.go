@@ -0,0 +1,192 @@
+package codex
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ImportItem is a single object fed to ImportObjects. Open is called lazily so
+// large imports never hold more than one object's stream at a time.
+type ImportItem struct {
+	Name        string
+	ContentType string
+	Open        func() (io.ReadCloser, error)
+}
+
+// ObjectIterator yields import items until it returns io.EOF
+type ObjectIterator func() (*ImportItem, error)
+
+// ImportProgress is reported to ImportCommit.Progress after every batch
+type ImportProgress struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	Batches int   `json:"batches"`
+}
+
+// ImportCommit describes the commit produced by ImportObjects.
+// When Message is empty it is rendered from Fields through the repository's
+// commit policy template; "count" and "bytes" are added to Fields.
+type ImportCommit struct {
+	Author    string
+	Message   string
+	Fields    map[string]string
+	Parents   []string
+	Ref       string    // optional ref updated to the new commit, e.g. refs/heads/main
+	Timestamp time.Time // defaults to now; set it for reproducible commit hashes
+	BatchSize int       // items between progress reports (default 100)
+	Progress  func(ImportProgress)
+}
+
+// ImportObjects streams every item from next into storage and records them in a
+// single commit. Object hashes are sorted so the same input always produces the
+// same object list regardless of iteration order.
+func (r *Repository) ImportObjects(next ObjectIterator, meta ImportCommit) (*Commit, error) {
+	batch := meta.BatchSize
+	if batch <= 0 {
+		batch = 100
+	}
+
+	seen := map[string]struct{}{}
+	var prog ImportProgress
+	inBatch := 0
+	for {
+		item, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rc, err := item.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", item.Name, err)
+		}
+		counter := &countingReader{r: rc}
+		hash, err := r.PutObjectStreamWithFilename(counter, item.ContentType, item.Name)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("import %s: %w", item.Name, err)
+		}
+		seen[hash] = struct{}{}
+		prog.Objects++
+		prog.Bytes += counter.n
+		inBatch++
+		if inBatch == batch {
+			prog.Batches++
+			inBatch = 0
+			if meta.Progress != nil {
+				meta.Progress(prog)
+			}
+		}
+	}
+	if inBatch > 0 {
+		prog.Batches++
+		if meta.Progress != nil {
+			meta.Progress(prog)
+		}
+	}
+	if prog.Objects == 0 {
+		return nil, fmt.Errorf("nothing to import")
+	}
+
+	msg := meta.Message
+	if msg == "" {
+		fields := map[string]string{}
+		for k, v := range meta.Fields {
+			fields[k] = v
+		}
+		fields["count"] = strconv.Itoa(prog.Objects)
+		fields["bytes"] = strconv.FormatInt(prog.Bytes, 10)
+		policy, err := r.CommitPolicy()
+		if err != nil {
+			return nil, err
+		}
+		if msg, err = policy.Render(fields); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.ValidateCommitMessage(msg); err != nil {
+		return nil, err
+	}
+
+	objs := make([]string, 0, len(seen))
+	for h := range seen {
+		objs = append(objs, h)
+	}
+	sort.Strings(objs)
+	ts := meta.Timestamp
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	c := &Commit{Parents: meta.Parents, Author: meta.Author, Timestamp: ts, Message: msg, Objects: objs}
+	c.Hash = computeCommitHash(c)
+	if err := r.storage.PutCommit(c); err != nil {
+		return nil, err
+	}
+	if meta.Ref != "" {
+		if err := r.SetRef(meta.Ref, c.Hash); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// DirIterator yields every regular file under root in lexical path order.
+// Item names are slash-separated paths relative to root; dot-directories are skipped.
+func DirIterator(root string) (ObjectIterator, error) {
+	var paths []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if p != root && len(info.Name()) > 1 && info.Name()[0] == '.' {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	i := 0
+	return func() (*ImportItem, error) {
+		if i >= len(paths) {
+			return nil, io.EOF
+		}
+		p := paths[i]
+		i++
+		rel, _ := filepath.Rel(root, p)
+		ct := mime.TypeByExtension(filepath.Ext(p))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		return &ImportItem{
+			Name:        filepath.ToSlash(rel),
+			ContentType: ct,
+			Open:        func() (io.ReadCloser, error) { return os.Open(p) },
+		}, nil
+	}, nil
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
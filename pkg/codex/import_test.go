@@ -0,0 +1,75 @@
+package codex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestImportObjects_DirectoryToSingleCommit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-import-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	src := filepath.Join(tmpdir, "vault")
+	os.MkdirAll(filepath.Join(src, "notes"), 0o755)
+	os.MkdirAll(filepath.Join(src, ".obsidian"), 0o755)
+	ioutil.WriteFile(filepath.Join(src, "index.md"), []byte("# Home"), 0o644)
+	ioutil.WriteFile(filepath.Join(src, "notes", "a.md"), []byte("alpha"), 0o644)
+	ioutil.WriteFile(filepath.Join(src, "notes", "b.md"), []byte("bravo"), 0o644)
+	ioutil.WriteFile(filepath.Join(src, ".obsidian", "app.json"), []byte("{}"), 0o644)
+
+	repoDir := filepath.Join(tmpdir, "repo")
+	r := codex.NewRepository(fsadapter.New(repoDir), repoDir)
+	if err := codex.SaveCommitPolicy(repoDir, &codex.CommitPolicy{Template: "import: {{.count}} objects from {{.source}}"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []codex.ImportProgress
+	meta := codex.ImportCommit{
+		Author:    "importer",
+		Fields:    map[string]string{"source": "vault"},
+		Ref:       "refs/heads/main",
+		Timestamp: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		BatchSize: 2,
+		Progress:  func(p codex.ImportProgress) { reports = append(reports, p) },
+	}
+	it, err := codex.DirIterator(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := r.ImportObjects(it, meta)
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if len(c.Objects) != 3 {
+		t.Fatalf("expected 3 objects (dot-dirs skipped), got %v", c.Objects)
+	}
+	if c.Message != "import: 3 objects from vault" {
+		t.Fatalf("unexpected rendered message: %q", c.Message)
+	}
+	if len(reports) != 2 || reports[1].Objects != 3 || reports[1].Bytes != 16 {
+		t.Fatalf("unexpected progress reports: %+v", reports)
+	}
+	if head, _ := r.GetRef("refs/heads/main"); head != c.Hash {
+		t.Fatalf("expected ref to point at import commit, got %q", head)
+	}
+
+	// Re-importing the same input produces the same commit
+	it, _ = codex.DirIterator(src)
+	meta.Progress = nil
+	again, err := r.ImportObjects(it, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Hash != c.Hash {
+		t.Fatalf("expected deterministic commit hash, got %s and %s", c.Hash, again.Hash)
+	}
+}
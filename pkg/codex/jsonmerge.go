@@ -0,0 +1,195 @@
+package codex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// MergeStrategy combines concurrent edits of one JSON object. base is nil
+// when both sides added the URN independently. It returns the merged object,
+// or the paths of the fields that conflict (dotted for nested objects). A nil
+// object with no paths means the objects conflict as a whole.
+type MergeStrategy interface {
+	MergeObjects(base, ours, theirs map[string]interface{}) (merged map[string]interface{}, conflicts []string, err error)
+}
+
+// MergeStrategyFunc adapts a function to MergeStrategy
+type MergeStrategyFunc func(base, ours, theirs map[string]interface{}) (map[string]interface{}, []string, error)
+
+func (f MergeStrategyFunc) MergeObjects(base, ours, theirs map[string]interface{}) (map[string]interface{}, []string, error) {
+	return f(base, ours, theirs)
+}
+
+// FieldMergeStrategy is the default: fields changed on one side only are
+// taken from that side, nested objects are merged the same way, and a field
+// is a conflict only when both sides changed it to different values. Arrays
+// and scalars are compared as whole values.
+var FieldMergeStrategy MergeStrategy = MergeStrategyFunc(mergeFields)
+
+// WholeObjectStrategy treats any concurrent change as a conflict, as merges
+// did before field merging; register it for types that must not be combined
+var WholeObjectStrategy MergeStrategy = MergeStrategyFunc(func(base, ours, theirs map[string]interface{}) (map[string]interface{}, []string, error) {
+	if reflect.DeepEqual(ours, theirs) {
+		return ours, nil, nil
+	}
+	return nil, nil, nil
+})
+
+var (
+	mergeStrategiesMu sync.RWMutex
+	mergeStrategies   = map[string]MergeStrategy{}
+)
+
+// RegisterMergeStrategy sets how objects whose "type" field is objectType are
+// merged. Types without a strategy use FieldMergeStrategy.
+func RegisterMergeStrategy(objectType string, s MergeStrategy) {
+	mergeStrategiesMu.Lock()
+	defer mergeStrategiesMu.Unlock()
+	mergeStrategies[objectType] = s
+}
+
+func mergeStrategyFor(obj map[string]interface{}) MergeStrategy {
+	t, _ := obj["type"].(string)
+	mergeStrategiesMu.RLock()
+	defer mergeStrategiesMu.RUnlock()
+	if s, ok := mergeStrategies[t]; ok {
+		return s
+	}
+	return FieldMergeStrategy
+}
+
+// ContentMerge is a URN whose concurrent edits were combined automatically.
+// The merged payload is stored as Object when the merge is committed.
+type ContentMerge struct {
+	URN     string          `json:"urn"`
+	Object  string          `json:"object"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// decodeObject reads a JSON object payload keeping numbers exact
+func decodeObject(b []byte) (map[string]interface{}, bool) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var m map[string]interface{}
+	if dec.Decode(&m) != nil || m == nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// mergeContent tries to merge the objects stored at base, ours and theirs
+// (base may be empty). On success it returns the merged payload; otherwise
+// the conflicting field paths, which are empty when the payloads could not be
+// merged at all.
+func (r *Repository) mergeContent(base, ours, theirs string) (*ContentMerge, []string) {
+	ob, err1 := r.storage.GetObject(ours)
+	tb, err2 := r.storage.GetObject(theirs)
+	if err1 != nil || err2 != nil {
+		return nil, nil
+	}
+	o, ok1 := decodeObject(ob)
+	t, ok2 := decodeObject(tb)
+	if !ok1 || !ok2 {
+		return nil, nil
+	}
+	var b map[string]interface{}
+	if base != "" {
+		bb, err := r.storage.GetObject(base)
+		if err != nil {
+			return nil, nil
+		}
+		if b, ok1 = decodeObject(bb); !ok1 {
+			return nil, nil
+		}
+	}
+	if ot, _ := o["type"].(string); ot != "" {
+		if tt, _ := t["type"].(string); tt != ot {
+			return nil, []string{"type"}
+		}
+	}
+	merged, conflicts, err := mergeStrategyFor(o).MergeObjects(b, o, t)
+	if err != nil || len(conflicts) > 0 || merged == nil {
+		return nil, conflicts
+	}
+	payload, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil
+	}
+	urn, _ := parseURN(ob)
+	if mu, ok := parseURN(payload); !ok || mu != urn {
+		return nil, []string{"urn"}
+	}
+	sum := sha256.Sum256(payload)
+	return &ContentMerge{URN: urn, Object: hex.EncodeToString(sum[:]), Payload: payload}, nil
+}
+
+// mergeFields is FieldMergeStrategy
+func mergeFields(base, ours, theirs map[string]interface{}) (map[string]interface{}, []string, error) {
+	merged := map[string]interface{}{}
+	var conflicts []string
+	mergeMaps("", base, ours, theirs, merged, &conflicts)
+	sort.Strings(conflicts)
+	return merged, conflicts, nil
+}
+
+func mergeMaps(prefix string, base, ours, theirs, out map[string]interface{}, conflicts *[]string) {
+	keys := map[string]struct{}{}
+	for _, m := range []map[string]interface{}{base, ours, theirs} {
+		for k := range m {
+			keys[k] = struct{}{}
+		}
+	}
+	for k := range keys {
+		b, hasB := base[k]
+		o, hasO := ours[k]
+		t, hasT := theirs[k]
+		same := func(v1 interface{}, ok1 bool, v2 interface{}, ok2 bool) bool {
+			return ok1 == ok2 && reflect.DeepEqual(v1, v2)
+		}
+		switch {
+		case same(o, hasO, t, hasT):
+			if hasO {
+				out[k] = o
+			}
+		case same(b, hasB, o, hasO):
+			if hasT {
+				out[k] = t
+			}
+		case same(b, hasB, t, hasT):
+			if hasO {
+				out[k] = o
+			}
+		default:
+			om, okO := o.(map[string]interface{})
+			tm, okT := t.(map[string]interface{})
+			bm, okB := b.(map[string]interface{})
+			if okO && okT && (okB || !hasB) {
+				sub := map[string]interface{}{}
+				mergeMaps(prefix+k+".", bm, om, tm, sub, conflicts)
+				out[k] = sub
+				continue
+			}
+			*conflicts = append(*conflicts, prefix+k)
+		}
+	}
+}
+
+// storeContentMerges writes the payloads of automatically merged objects
+func (r *Repository) storeContentMerges(merges []ContentMerge) error {
+	for _, m := range merges {
+		h, err := r.storage.PutObjectStream(bytes.NewReader(m.Payload), "application/json")
+		if err != nil {
+			return err
+		}
+		if h != m.Object {
+			return fmt.Errorf("merged object for %s stored as %s, expected %s", m.URN, h, m.Object)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package codex_test
+
+import (
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestMergeCommits_MergesJSONFields(t *testing.T) {
+	tmpdir := t.TempDir()
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("n0", []byte(`{"urn":"urn:node:1","type":"page","title":"v1","body":"text","meta":{"tags":["a"],"lang":"en"},"views":12345678901234567}`))
+	_ = fs.PutObject("n1", []byte(`{"urn":"urn:node:1","type":"page","title":"ours","body":"text","meta":{"tags":["a"],"lang":"fr"},"views":12345678901234567}`))
+	_ = fs.PutObject("n2", []byte(`{"urn":"urn:node:1","type":"page","title":"v1","body":"theirs","meta":{"tags":["a","b"],"lang":"en"},"views":12345678901234567,"draft":true}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"n0"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-time.Minute), Objects: []string{"n1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"n2"}})
+	r := codex.NewRepository(fs, tmpdir)
+
+	preview, err := r.PreviewMerge("c1", "c2", "c3")
+	if err != nil || len(preview.Conflicts) != 0 || len(preview.Merged) != 1 {
+		t.Fatalf("expected a clean field merge, got %+v %v", preview, err)
+	}
+	if _, err := fs.GetObject(preview.Merged[0].Object); err == nil {
+		t.Fatalf("preview must not store the merged object")
+	}
+
+	c, conflicts, err := r.MergeCommits("c1", "c2", "c3", "m", "merge")
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("merge failed: %+v %v", conflicts, err)
+	}
+	if len(c.Objects) != 1 || c.Objects[0] != preview.Merged[0].Object {
+		t.Fatalf("merge commit should hold the merged object: %v", c.Objects)
+	}
+	b, err := fs.GetObject(c.Objects[0])
+	want := `{"body":"theirs","draft":true,"meta":{"lang":"fr","tags":["a","b"]},"title":"ours","type":"page","urn":"urn:node:1","views":12345678901234567}`
+	if err != nil || string(b) != want {
+		t.Fatalf("merged object = %s %v", b, err)
+	}
+}
+
+func TestPreviewMerge_ReportsConflictingFields(t *testing.T) {
+	tmpdir := t.TempDir()
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("n0", []byte(`{"urn":"urn:node:1","title":"v1","meta":{"lang":"en"},"body":"x"}`))
+	_ = fs.PutObject("n1", []byte(`{"urn":"urn:node:1","title":"ours","meta":{"lang":"fr"},"body":"y"}`))
+	_ = fs.PutObject("n2", []byte(`{"urn":"urn:node:1","title":"theirs","meta":{"lang":"de"},"body":"x"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"n0"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-time.Minute), Objects: []string{"n1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"n2"}})
+	r := codex.NewRepository(fs, tmpdir)
+
+	preview, err := r.PreviewMerge("c1", "c2", "c3")
+	if err != nil || len(preview.Conflicts) != 1 {
+		t.Fatalf("expected one conflict, got %+v %v", preview, err)
+	}
+	if f := preview.Conflicts[0].Fields; len(f) != 2 || f[0] != "meta.lang" || f[1] != "title" {
+		t.Fatalf("unexpected conflicting fields: %v", f)
+	}
+}
+
+func TestRegisterMergeStrategy_PerType(t *testing.T) {
+	codex.RegisterMergeStrategy("locked-test", codex.WholeObjectStrategy)
+	tmpdir := t.TempDir()
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("n0", []byte(`{"urn":"urn:node:1","type":"locked-test","a":1,"b":1}`))
+	_ = fs.PutObject("n1", []byte(`{"urn":"urn:node:1","type":"locked-test","a":2,"b":1}`))
+	_ = fs.PutObject("n2", []byte(`{"urn":"urn:node:1","type":"locked-test","a":1,"b":2}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"n0"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-time.Minute), Objects: []string{"n1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"n2"}})
+	r := codex.NewRepository(fs, tmpdir)
+
+	_, conflicts, err := r.MergeCommits("c1", "c2", "c3", "m", "merge")
+	if err != nil || len(conflicts) != 1 || len(conflicts[0].Fields) != 0 {
+		t.Fatalf("whole-object strategy should conflict on any concurrent edit: %+v %v", conflicts, err)
+	}
+}
@@ -0,0 +1,214 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// defaultBranchRef is the ref remotes resolve when no commit is pinned
+const defaultBranchRef = "refs/heads/main"
+
+// linkRefPrefix holds one ref per link, pointing at the link's descriptor object
+const linkRefPrefix = "refs/links/"
+
+// remoteURNScheme prefixes the string form of a RemoteURN
+const remoteURNScheme = "codex+"
+
+// Link is a submodule-style pointer to another codex repository, pinned at a
+// commit. Links are stored as objects under refs/links/<name>, so they travel
+// with the repository; credentials never are.
+type Link struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Commit string `json:"commit"`
+}
+
+// RemoteURN addresses an entity in another repository. Repo is a remote URL or
+// the name of a Link; Commit pins the version and defaults to the link's pin.
+// The string form is "codex+<repo>#<urn>[@<commit>]".
+type RemoteURN struct {
+	Repo   string `json:"repo"`
+	URN    string `json:"urn"`
+	Commit string `json:"commit,omitempty"`
+}
+
+// RemoteEntity is a resolved RemoteURN
+type RemoteEntity struct {
+	Repo   string          `json:"repo"`
+	URN    string          `json:"urn"`
+	Commit string          `json:"commit"`
+	Hash   string          `json:"hash"`
+	Object json.RawMessage `json:"object"`
+}
+
+// ParseRemoteURN parses "codex+<repo>#<urn>[@<commit>]"
+func ParseRemoteURN(s string) (RemoteURN, error) {
+	var u RemoteURN
+	if !strings.HasPrefix(s, remoteURNScheme) {
+		return u, fmt.Errorf("remote urn must start with %q", remoteURNScheme)
+	}
+	rest := strings.TrimPrefix(s, remoteURNScheme)
+	i := strings.LastIndex(rest, "#")
+	if i <= 0 || i == len(rest)-1 {
+		return u, fmt.Errorf("remote urn must look like codex+<repo>#<urn>[@<commit>]")
+	}
+	u.Repo, u.URN = rest[:i], rest[i+1:]
+	if j := strings.LastIndex(u.URN, "@"); j >= 0 {
+		u.URN, u.Commit = u.URN[:j], u.URN[j+1:]
+	}
+	if u.URN == "" {
+		return u, fmt.Errorf("remote urn has an empty urn")
+	}
+	return u, nil
+}
+
+// String formats the remote URN
+func (u RemoteURN) String() string {
+	s := remoteURNScheme + u.Repo + "#" + u.URN
+	if u.Commit != "" {
+		s += "@" + u.Commit
+	}
+	return s
+}
+
+// SetLink creates or re-pins a link
+func (r *Repository) SetLink(l Link) error {
+	if l.Name == "" || strings.ContainsAny(l.Name, "/\\#@") || strings.HasPrefix(l.Name, ".") {
+		return fmt.Errorf("invalid link name %q", l.Name)
+	}
+	if !strings.Contains(l.URL, "://") {
+		return fmt.Errorf("link url must be absolute")
+	}
+	if l.Commit == "" {
+		return fmt.Errorf("link must pin a commit")
+	}
+	b, _ := json.Marshal(l)
+	hash, err := r.storage.PutObjectStream(bytes.NewReader(b), "application/json")
+	if err != nil {
+		return err
+	}
+	return r.storage.PutRef(linkRefPrefix+l.Name, hash)
+}
+
+// GetLink returns the named link
+func (r *Repository) GetLink(name string) (*Link, error) {
+	hash, err := r.storage.GetRef(linkRefPrefix + name)
+	if err != nil || hash == "" {
+		return nil, fmt.Errorf("link %q not found", name)
+	}
+	b, err := r.storage.GetObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	var l Link
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, fmt.Errorf("link %q: %w", name, err)
+	}
+	return &l, nil
+}
+
+// ListLinks returns every link in the repository
+func (r *Repository) ListLinks() ([]Link, error) {
+	refs, err := r.storage.ListRefs(strings.TrimSuffix(linkRefPrefix, "/"))
+	if err != nil {
+		return nil, err
+	}
+	links := []Link{}
+	for _, ref := range refs {
+		if l, err := r.GetLink(strings.TrimPrefix(ref, linkRefPrefix)); err == nil {
+			links = append(links, *l)
+		}
+	}
+	return links, nil
+}
+
+// FindURN returns the hash of the object carrying urn in the given commit
+func (r *Repository) FindURN(commitHash, urn string) (string, error) {
+	c, err := r.storage.GetCommit(commitHash)
+	if err != nil {
+		return "", err
+	}
+	for _, h := range c.Objects {
+		rc, _, err := r.storage.GetObjectStream(h)
+		if err != nil {
+			continue
+		}
+		var sniff bytes.Buffer
+		n, _ := io.Copy(&limitedBuffer{buf: &sniff, limit: statsSniffLimit}, rc)
+		rc.Close()
+		if n > statsSniffLimit {
+			continue
+		}
+		if u, ok := parseURN(sniff.Bytes()); ok && u == urn {
+			return h, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in commit %s", urn, commitHash)
+}
+
+// remoteResolutions remembers which object a remote URN resolved to so a
+// pinned reference is only negotiated with the remote once per process
+var (
+	remoteResolutionsMu sync.Mutex
+	remoteResolutions   = map[string]string{}
+)
+
+// ResolveRemote resolves a remote URN lazily: the owning remote is asked
+// (through its /resolve endpoint) which object holds the URN at the pinned
+// commit, and that object is fetched, verified and kept in local storage so
+// later lookups work offline (GC may reclaim it; it is then fetched again).
+// token authenticates against the remote.
+func (r *Repository) ResolveRemote(u RemoteURN, token string) (*RemoteEntity, error) {
+	repoURL, commit := u.Repo, u.Commit
+	if !strings.Contains(repoURL, "://") {
+		l, err := r.GetLink(u.Repo)
+		if err != nil {
+			return nil, err
+		}
+		repoURL = l.URL
+		if commit == "" {
+			commit = l.Commit
+		}
+	}
+	remote := NewRemote(repoURL, token)
+	if commit == "" {
+		h, err := remote.GetRef(defaultBranchRef)
+		if err != nil {
+			return nil, err
+		}
+		commit = h
+	}
+
+	key := repoURL + "#" + u.URN + "@" + commit
+	remoteResolutionsMu.Lock()
+	hash := remoteResolutions[key]
+	remoteResolutionsMu.Unlock()
+
+	if hash != "" {
+		if b, err := r.storage.GetObject(hash); err == nil {
+			return &RemoteEntity{Repo: repoURL, URN: u.URN, Commit: commit, Hash: hash, Object: b}, nil
+		}
+	}
+	hash, err := remote.Resolve(u.URN, commit)
+	if err != nil {
+		return nil, err
+	}
+	b, err := remote.GetObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if got, ok := parseURN(b); !ok || got != u.URN {
+		return nil, fmt.Errorf("remote returned object %s without urn %s", hash, u.URN)
+	}
+	if err := r.storage.PutObject(hash, b); err != nil {
+		return nil, err
+	}
+	remoteResolutionsMu.Lock()
+	remoteResolutions[key] = hash
+	remoteResolutionsMu.Unlock()
+	return &RemoteEntity{Repo: repoURL, URN: u.URN, Commit: commit, Hash: hash, Object: b}, nil
+}
@@ -0,0 +1,89 @@
+package codex_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestParseRemoteURN(t *testing.T) {
+	u, err := codex.ParseRemoteURN("codex+https://kb.example/repo#urn:note:1@abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Repo != "https://kb.example/repo" || u.URN != "urn:note:1" || u.Commit != "abc" {
+		t.Fatalf("unexpected parse: %+v", u)
+	}
+	if u.String() != "codex+https://kb.example/repo#urn:note:1@abc" {
+		t.Fatalf("unexpected round trip: %s", u.String())
+	}
+	if _, err := codex.ParseRemoteURN("urn:note:1"); err == nil {
+		t.Fatalf("expected error for plain urn")
+	}
+}
+
+func TestLinkResolveRemote(t *testing.T) {
+	remoteDir, err := ioutil.TempDir("", "codex-link-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+	localDir, err := ioutil.TempDir("", "codex-link-local-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+
+	remote := codex.NewRepository(fsadapter.New(remoteDir), remoteDir)
+	v1, _ := remote.PutObjectStream(strings.NewReader(`{"urn":"urn:note:1","title":"v1"}`), "application/json")
+	c1 := &codex.Commit{Hash: "c1", Timestamp: time.Now(), Objects: []string{v1}}
+	remote.PutCommit(c1)
+	v2, _ := remote.PutObjectStream(strings.NewReader(`{"urn":"urn:note:1","title":"v2"}`), "application/json")
+	c2 := &codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{v2}}
+	remote.PutCommit(c2)
+	remote.SetRef("refs/heads/main", "c2")
+
+	srv := httptest.NewServer(codex.NewServer(remote, "tok"))
+	defer srv.Close()
+
+	local := codex.NewRepository(fsadapter.New(localDir), localDir)
+	if err := local.SetLink(codex.Link{Name: "kb", URL: srv.URL, Commit: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	links, _ := local.ListLinks()
+	if len(links) != 1 || links[0].Commit != "c1" {
+		t.Fatalf("unexpected links: %+v", links)
+	}
+
+	// pinned through the link
+	ent, err := local.ResolveRemote(codex.RemoteURN{Repo: "kb", URN: "urn:note:1"}, "tok")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if ent.Hash != v1 || !strings.Contains(string(ent.Object), "v1") {
+		t.Fatalf("expected pinned v1, got %+v", ent)
+	}
+	if _, err := local.GetObject(v1); err != nil {
+		t.Fatalf("resolved object should be kept locally: %v", err)
+	}
+
+	// explicit URL without a commit follows the remote's main branch
+	ent, err = local.ResolveRemote(codex.RemoteURN{Repo: srv.URL, URN: "urn:note:1"}, "tok")
+	if err != nil || ent.Hash != v2 {
+		t.Fatalf("expected v2 from main, got %+v %v", ent, err)
+	}
+
+	if _, err := local.ResolveRemote(codex.RemoteURN{Repo: "kb", URN: "urn:note:1"}, "wrong"); err != nil {
+		// cached resolution does not need the remote again
+		t.Fatalf("expected cached resolution, got %v", err)
+	}
+	if _, err := local.ResolveRemote(codex.RemoteURN{Repo: "kb", URN: "urn:missing"}, "tok"); err == nil {
+		t.Fatalf("expected error for unknown urn")
+	}
+}
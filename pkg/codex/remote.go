@@ -0,0 +1,301 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Remote is a client for a repository served by NewServer
+type Remote struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// NewRemote returns a client for the codex remote at baseURL
+func NewRemote(baseURL, token string) *Remote {
+	return &Remote{URL: strings.TrimRight(baseURL, "/"), Token: token, Client: &http.Client{Timeout: 60 * time.Second}}
+}
+
+func (rm *Remote) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, rm.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if rm.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rm.Token)
+	}
+	resp, err := rm.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := readRemoteError(resp)
+		return nil, fmt.Errorf("remote %s %s: %s", method, path, msg)
+	}
+	return resp, nil
+}
+
+// readRemoteError reads a failed response's message, and the ref a ref
+// update failed on. Servers answer in the {"error": {"code", "message"}}
+// envelope; older ones with a bare {"error": "..."}.
+func readRemoteError(resp *http.Response) (msg, ref string) {
+	var body struct {
+		Error json.RawMessage `json:"error"`
+		Ref   string          `json:"ref"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	var env struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body.Error, &env) == nil {
+		msg = env.Message
+	} else {
+		json.Unmarshal(body.Error, &msg)
+	}
+	if msg == "" {
+		msg = resp.Status
+	}
+	return msg, body.Ref
+}
+
+func (rm *Remote) getJSON(path string, v interface{}) error {
+	resp, err := rm.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GetRef resolves a ref on the remote
+func (rm *Remote) GetRef(ref string) (string, error) {
+	var out struct {
+		Hash string `json:"hash"`
+	}
+	if err := rm.getJSON("/refs/"+ref, &out); err != nil {
+		return "", err
+	}
+	return out.Hash, nil
+}
+
+// GetCommit fetches a commit from the remote
+func (rm *Remote) GetCommit(hash string) (*Commit, error) {
+	var c Commit
+	if err := rm.getJSON("/commits/"+url.PathEscape(hash), &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetObject downloads an object and checks it against its hash: the sha256 of
+// the content, or for commits the commit hash. Other names are returned as served.
+func (rm *Remote) GetObject(hash string) ([]byte, error) {
+	b, _, err := rm.fetchObject(hash)
+	return b, err
+}
+
+// fetchObject is GetObject that also returns the served content type
+func (rm *Remote) fetchObject(hash string) ([]byte, string, error) {
+	resp, err := rm.do("GET", "/objects/"+url.PathEscape(hash), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if isContentHash(hash) && !matchesHash(hash, b) {
+		return nil, "", fmt.Errorf("remote object %s failed hash verification", hash)
+	}
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+// Refs returns the remote's refs under prefix
+func (rm *Remote) Refs(prefix string) (map[string]string, error) {
+	refs := map[string]string{}
+	err := rm.getJSON("/refs?prefix="+url.QueryEscape(prefix), &refs)
+	return refs, err
+}
+
+// Sync sends the hashes the caller has and returns those the remote lacks,
+// along with the remote's refs
+func (rm *Remote) Sync(have []string) (*SyncResponse, error) {
+	b, _ := json.Marshal(SyncRequest{Have: have})
+	resp, err := rm.do("POST", "/sync", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out SyncResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PutObject uploads an object. Named objects (commits and other objects not
+// addressed by their content hash) are stored verbatim under hash.
+func (rm *Remote) PutObject(hash string, body io.Reader, contentType string, named bool) error {
+	path := "/objects/" + url.PathEscape(hash)
+	if named {
+		path += "?named=1"
+	}
+	req, err := http.NewRequest("PUT", rm.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if rm.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rm.Token)
+	}
+	resp, err := rm.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := readRemoteError(resp)
+		return fmt.Errorf("remote PUT %s: %s", path, msg)
+	}
+	return nil
+}
+
+// UpdateRefs applies ref updates on the remote all at once; if any update's
+// Old no longer matches, none are applied and ErrRefMoved is returned
+func (rm *Remote) UpdateRefs(updates []RefUpdate) error {
+	b, _ := json.Marshal(map[string][]RefUpdate{"updates": updates})
+	req, err := http.NewRequest("POST", rm.URL+"/refs", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rm.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rm.Token)
+	}
+	resp, err := rm.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, ref := readRemoteError(resp)
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%w: %s", ErrRefMoved, ref)
+		}
+		return fmt.Errorf("remote ref update: %s", msg)
+	}
+	return nil
+}
+
+// errNoDelta means the remote predates chunked sync
+var errNoDelta = errors.New("remote does not support chunked sync")
+
+// postJSON posts v and decodes the reply into out; a 404 means the remote
+// lacks the endpoint and is reported as errNoDelta
+func (rm *Remote) postJSON(path string, v, out interface{}) error {
+	b, _ := json.Marshal(v)
+	req, err := http.NewRequest("POST", rm.URL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if rm.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rm.Token)
+	}
+	resp, err := rm.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoDelta
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := readRemoteError(resp)
+		if resp.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%w: %s", ErrMissingChunks, msg)
+		}
+		return fmt.Errorf("remote POST %s: %s", path, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// MissingChunks returns the chunks among hashes the remote lacks
+func (rm *Remote) MissingChunks(hashes []string) ([]string, error) {
+	var out struct {
+		Missing []string `json:"missing"`
+	}
+	err := rm.postJSON("/chunks", ChunksRequest{Chunker: Chunker, Hashes: hashes}, &out)
+	return out.Missing, err
+}
+
+// Manifests returns the chunk manifests of those hashes the remote syncs in
+// chunks; the others are fetched whole
+func (rm *Remote) Manifests(hashes []string) (map[string]*ChunkManifest, error) {
+	var out struct {
+		Manifests map[string]*ChunkManifest `json:"manifests"`
+	}
+	err := rm.postJSON("/manifests", ChunksRequest{Chunker: Chunker, Hashes: hashes}, &out)
+	return out.Manifests, err
+}
+
+// GetChunk downloads a chunk and checks it against its hash
+func (rm *Remote) GetChunk(hash string) ([]byte, error) {
+	resp, err := rm.do("GET", "/chunks/"+url.PathEscape(hash), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, chunkMax+1))
+	if err != nil {
+		return nil, err
+	}
+	if chunkHash(b) != hash {
+		return nil, fmt.Errorf("remote chunk %s failed hash verification", hash)
+	}
+	return b, nil
+}
+
+// Assemble has the remote build m's object from chunks it already holds
+func (rm *Remote) Assemble(m *ChunkManifest) error {
+	var out map[string]string
+	return rm.postJSON("/assemble", m, &out)
+}
+
+// Resolve asks the remote which object holds urn at commit
+func (rm *Remote) Resolve(urn, commit string) (string, error) {
+	q := url.Values{"urn": {urn}}
+	if commit != "" {
+		q.Set("commit", commit)
+	}
+	var out struct {
+		Hash string `json:"hash"`
+	}
+	if err := rm.getJSON("/resolve?"+q.Encode(), &out); err != nil {
+		return "", err
+	}
+	return out.Hash, nil
+}
+
+// isContentHash reports whether hash looks like a sha256 content address
+func isContentHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
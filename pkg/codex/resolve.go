@@ -0,0 +1,115 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Resolution choices for a conflicting URN
+const (
+	ResolveOurs   = "ours"
+	ResolveTheirs = "theirs"
+	ResolveCustom = "custom"
+)
+
+// ResolutionChoice is a caller's decision for a single conflicting URN.
+// Object carries the replacement payload when Choice is "custom".
+type ResolutionChoice struct {
+	Choice string          `json:"choice"`
+	Object json.RawMessage `json:"object,omitempty"`
+}
+
+// Resolution is the recorded outcome for a conflicting URN in a merge commit
+type Resolution struct {
+	URN    string `json:"urn"`
+	Choice string `json:"choice"`
+	Object string `json:"object"`
+}
+
+// ResolveMerge completes a conflicting merge using per-URN choices. Every
+// conflict reported by PreviewMerge must have a choice; otherwise the
+// unresolved conflicts are returned and nothing is written. Custom payloads
+// are stored as new objects and must carry the conflicting URN. The decisions
+// are recorded in the merge commit's Resolutions.
+func (r *Repository) ResolveMerge(baseHash, oursHash, theirsHash, author, message string, choices map[string]ResolutionChoice) (*Commit, []Conflict, error) {
+	if err := r.ValidateCommitMessage(message); err != nil {
+		return nil, nil, err
+	}
+	preview, err := r.PreviewMerge(baseHash, oursHash, theirsHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conflicting := map[string]struct{}{}
+	unresolved := []Conflict{}
+	for _, c := range preview.Conflicts {
+		conflicting[c.URN] = struct{}{}
+		if _, ok := choices[c.URN]; !ok {
+			unresolved = append(unresolved, c)
+		}
+	}
+	if len(unresolved) > 0 {
+		return nil, unresolved, nil
+	}
+	for urn := range choices {
+		if _, ok := conflicting[urn]; !ok {
+			return nil, nil, fmt.Errorf("no conflict for %s", urn)
+		}
+	}
+
+	if err := r.storeContentMerges(preview.Merged); err != nil {
+		return nil, nil, err
+	}
+	objects := map[string]struct{}{}
+	for _, h := range preview.Objects {
+		objects[h] = struct{}{}
+	}
+	resolutions := []Resolution{}
+	for _, c := range preview.Conflicts {
+		ch := choices[c.URN]
+		var hash string
+		switch ch.Choice {
+		case ResolveOurs:
+			hash = c.Ours
+		case ResolveTheirs:
+			hash = c.Theirs
+		case ResolveCustom:
+			if urn, ok := parseURN(ch.Object); !ok || urn != c.URN {
+				return nil, nil, fmt.Errorf("custom object for %s must be JSON with a matching urn", c.URN)
+			}
+			hash, err = r.storage.PutObjectStream(bytes.NewReader(ch.Object), "application/json")
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, fmt.Errorf("invalid choice %q for %s (want ours, theirs or custom)", ch.Choice, c.URN)
+		}
+		// an empty side means the URN was deleted there; keeping that side drops it
+		if hash != "" {
+			objects[hash] = struct{}{}
+		}
+		resolutions = append(resolutions, Resolution{URN: c.URN, Choice: ch.Choice, Object: hash})
+	}
+
+	objs := []string{}
+	for h := range objects {
+		objs = append(objs, h)
+	}
+	sort.Strings(objs)
+	mcommit := &Commit{
+		Parents:     []string{preview.Ours, preview.Theirs},
+		Author:      author,
+		Timestamp:   time.Now().UTC(),
+		Message:     message,
+		Objects:     objs,
+		Resolutions: resolutions,
+	}
+	mcommit.Hash = computeCommitHash(mcommit)
+	if err := r.storage.PutCommit(mcommit); err != nil {
+		return nil, nil, err
+	}
+	return mcommit, nil, nil
+}
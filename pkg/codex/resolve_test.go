@@ -0,0 +1,73 @@
+package codex_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestResolveMerge_RecordsResolutions(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-resolve-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("a0", []byte(`{"urn":"urn:node:a","title":"v1"}`))
+	_ = fs.PutObject("b0", []byte(`{"urn":"urn:node:b","title":"v1"}`))
+	_ = fs.PutObject("a1", []byte(`{"urn":"urn:node:a","title":"ours"}`))
+	_ = fs.PutObject("b1", []byte(`{"urn":"urn:node:b","title":"ours"}`))
+	_ = fs.PutObject("a2", []byte(`{"urn":"urn:node:a","title":"theirs"}`))
+	_ = fs.PutObject("b2", []byte(`{"urn":"urn:node:b","title":"theirs"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Timestamp: time.Now().Add(-time.Hour), Objects: []string{"a0", "b0"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Parents: []string{"c1"}, Timestamp: time.Now().Add(-time.Minute), Objects: []string{"a1", "b1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"a2", "b2"}})
+
+	r := codex.NewRepository(fs, tmpdir)
+
+	// Missing a choice leaves the merge unresolved
+	partial := map[string]codex.ResolutionChoice{"urn:node:a": {Choice: codex.ResolveOurs}}
+	c, unresolved, err := r.ResolveMerge("c1", "c2", "c3", "m", "merge", partial)
+	if err != nil || c != nil || len(unresolved) != 1 || unresolved[0].URN != "urn:node:b" {
+		t.Fatalf("expected urn:node:b unresolved, got commit=%v conflicts=%+v err=%v", c, unresolved, err)
+	}
+
+	choices := map[string]codex.ResolutionChoice{
+		"urn:node:a": {Choice: codex.ResolveOurs},
+		"urn:node:b": {Choice: codex.ResolveCustom, Object: json.RawMessage(`{"urn":"urn:node:b","title":"both"}`)},
+	}
+	c, unresolved, err = r.ResolveMerge("c1", "c2", "c3", "m", "merge", choices)
+	if err != nil || len(unresolved) != 0 {
+		t.Fatalf("resolve failed: conflicts=%+v err=%v", unresolved, err)
+	}
+	stored, err := r.GetCommit(c.Hash)
+	if err != nil {
+		t.Fatalf("merged commit not stored: %v", err)
+	}
+	if len(stored.Resolutions) != 2 || stored.Resolutions[0].Choice != codex.ResolveOurs || stored.Resolutions[0].Object != "a1" {
+		t.Fatalf("unexpected recorded resolutions: %+v", stored.Resolutions)
+	}
+	custom := stored.Resolutions[1].Object
+	b, err := fs.GetObject(custom)
+	if err != nil || string(b) != `{"urn":"urn:node:b","title":"both"}` {
+		t.Fatalf("custom object not stored: %s %v", b, err)
+	}
+	if len(stored.Objects) != 2 {
+		t.Fatalf("expected 2 merged objects, got %v", stored.Objects)
+	}
+
+	// Custom payloads must target the conflicting URN
+	bad := map[string]codex.ResolutionChoice{
+		"urn:node:a": {Choice: codex.ResolveTheirs},
+		"urn:node:b": {Choice: codex.ResolveCustom, Object: json.RawMessage(`{"urn":"urn:node:x"}`)},
+	}
+	if _, _, err := r.ResolveMerge("c1", "c2", "c3", "m", "merge", bad); err == nil {
+		t.Fatalf("expected mismatched custom urn to be rejected")
+	}
+}
@@ -0,0 +1,479 @@
+package codex
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"veil/pkg/apierror"
+)
+
+// maxNamedObjectSize bounds objects uploaded verbatim under a caller-chosen name
+const maxNamedObjectSize = 16 << 20
+
+// RefUpdate is the body of PUT <mount>/refs/<ref>, and with Ref set one entry
+// of POST <mount>/refs. When Old is set the update only succeeds if the ref
+// currently points at Old.
+type RefUpdate struct {
+	Ref  string `json:"ref,omitempty"`
+	Hash string `json:"hash"`
+	Old  string `json:"old,omitempty"`
+}
+
+// SyncRequest lists hashes a client has; the response names those the server lacks
+type SyncRequest struct {
+	Have []string `json:"have"`
+}
+
+// SyncResponse is returned by POST <mount>/sync
+type SyncResponse struct {
+	Missing []string          `json:"missing"`
+	Refs    map[string]string `json:"refs"`
+}
+
+// NewServer returns an http.Handler exposing the repository as a codex remote:
+//
+//	GET  /status                   object count and refs
+//	GET  /objects?prefix=          list object hashes
+//	GET  /objects/{hash}           stream an object
+//	PUT  /objects/{hash}           upload an object (verified against its content hash;
+//	                               ?named=1 stores JSON verbatim, e.g. commits)
+//	GET  /commits?limit=&offset=   list commits
+//	GET  /commits/{hash}           fetch a commit
+//	GET  /refs?prefix=             map of ref -> hash
+//	POST /refs                     update several refs at once ({updates: [{ref, hash, old}]});
+//	                               all or none are applied
+//	GET  /refs/{ref}               resolve a ref
+//	PUT  /refs/{ref}               update a ref ({hash, old} compare-and-swap)
+//	POST /sync                     negotiate which objects the server is missing
+//	POST /chunks                   negotiate which chunks the server is missing ({chunker, hashes})
+//	GET  /chunks/{hash}            stream a chunk, loose or from inside a larger object
+//	POST /manifests                chunk manifests of the objects ({hashes}) large enough to sync in chunks
+//	POST /assemble                 build an object from a chunk manifest (verified against its hash)
+//	GET  /resolve?urn=&commit=     find the object holding urn at commit (default refs/heads/main)
+//
+// Objects of DeltaMinSize and more are synced through the chunk endpoints so
+// only the chunks a side lacks are sent (see Push and Pull).
+//
+// When token is non-empty every request must carry "Authorization: Bearer <token>".
+func NewServer(r *Repository, token string) http.Handler {
+	s := &server{repo: r}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/objects", s.handleObjects)
+	mux.HandleFunc("/objects/", s.handleObject)
+	mux.HandleFunc("/commits", s.handleCommits)
+	mux.HandleFunc("/commits/", s.handleCommit)
+	mux.HandleFunc("/refs", s.handleRefs)
+	mux.HandleFunc("/refs/", s.handleRef)
+	mux.HandleFunc("/sync", s.handleSync)
+	mux.HandleFunc("/chunks", s.handleChunks)
+	mux.HandleFunc("/chunks/", s.handleChunk)
+	mux.HandleFunc("/manifests", s.handleManifests)
+	mux.HandleFunc("/assemble", s.handleAssemble)
+	mux.HandleFunc("/resolve", s.handleResolve)
+	return RequireToken(token, mux)
+}
+
+// refLocks serialises compare-and-swap ref updates
+var refLocks sync.Mutex
+
+type server struct {
+	repo *Repository
+}
+
+// RequireToken rejects requests without "Authorization: Bearer <token>".
+// An empty token disables the check.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, "invalid or missing token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError answers in the API's {"error": {"code", "message"}} envelope
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	apierror.Write(w, status, msg)
+}
+
+// refMap resolves every ref under prefix
+func (s *server) refMap(prefix string) (map[string]string, error) {
+	refs, err := s.repo.ListRefs(prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	for _, ref := range refs {
+		if h, err := s.repo.GetRef(ref); err == nil {
+			out[ref] = h
+		}
+	}
+	return out, nil
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	objs, err := s.repo.ListObjects("", 0, 0)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	refs, err := s.refMap("")
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"objects": len(objs), "refs": refs})
+}
+
+func (s *server) handleObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	objs, err := s.repo.ListObjects(r.URL.Query().Get("prefix"), 0, 0)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"objects": objs})
+}
+
+func (s *server) handleObject(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/objects/")
+	if hash == "" || strings.ContainsAny(hash, "/\\") || strings.HasPrefix(hash, ".") {
+		writeJSONError(w, http.StatusBadRequest, "invalid object hash")
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		rc, ct, err := s.repo.GetObjectStream(hash)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", ct)
+		if r.Method == "GET" {
+			io.Copy(w, rc)
+		}
+	case "PUT":
+		ct := r.Header.Get("Content-Type")
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		if r.URL.Query().Get("named") == "1" {
+			b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxNamedObjectSize+1))
+			if err != nil || len(b) > maxNamedObjectSize || !json.Valid(b) {
+				writeJSONError(w, http.StatusBadRequest, "named objects must be JSON under 16MB")
+				return
+			}
+			if existing, err := s.repo.GetObject(hash); err == nil {
+				if !bytes.Equal(existing, b) {
+					writeJSONError(w, http.StatusConflict, "object already exists with different content")
+					return
+				}
+				writeJSON(w, http.StatusOK, map[string]string{"hash": hash})
+				return
+			}
+			if err := s.repo.PutObject(hash, b); err != nil {
+				apierror.Internal(w, r, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, map[string]string{"hash": hash})
+			return
+		}
+		got, err := s.repo.PutObjectStream(r.Body, ct)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if got != hash {
+			// the upload is kept under its real hash; GC reclaims it if unused
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("content hash %s does not match %s", got, hash))
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]string{"hash": hash})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *server) handleCommits(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, offset := 50, 0
+	fmt.Sscanf(q.Get("limit"), "%d", &limit)
+	fmt.Sscanf(q.Get("offset"), "%d", &offset)
+	commits, err := s.repo.ListCommits(limit, offset)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, commits)
+}
+
+func (s *server) handleCommit(w http.ResponseWriter, r *http.Request) {
+	c, err := s.repo.GetCommit(strings.TrimPrefix(r.URL.Path, "/commits/"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *server) handleRefs(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		s.handleRefsUpdate(w, r)
+		return
+	}
+	refs, err := s.refMap(r.URL.Query().Get("prefix"))
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, refs)
+}
+
+// handleRefsUpdate checks every update before applying any, so a push that
+// moves several branches and tags either lands whole or not at all
+func (s *server) handleRefsUpdate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Updates []RefUpdate `json:"updates"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Updates) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "updates required")
+		return
+	}
+	for _, u := range req.Updates {
+		if u.Ref == "" || strings.Contains(u.Ref, "..") || u.Hash == "" {
+			writeJSONError(w, http.StatusBadRequest, "every update needs a valid ref and hash")
+			return
+		}
+		if _, err := s.repo.GetCommit(u.Hash); err != nil {
+			apierror.WriteWith(w, apierror.New(http.StatusBadRequest, "ref target must be a commit present on the server"), map[string]interface{}{"ref": u.Ref})
+			return
+		}
+	}
+	refLocks.Lock()
+	defer refLocks.Unlock()
+	for _, u := range req.Updates {
+		if u.Old != "" {
+			if cur, _ := s.repo.GetRef(u.Ref); cur != u.Old {
+				apierror.WriteWith(w, apierror.New(http.StatusConflict, "ref has moved"), map[string]interface{}{"ref": u.Ref, "current": cur})
+				return
+			}
+		}
+	}
+	out := map[string]string{}
+	for _, u := range req.Updates {
+		if err := s.repo.SetRef(u.Ref, u.Hash); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		out[u.Ref] = u.Hash
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) handleRef(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/refs/")
+	if ref == "" || strings.Contains(ref, "..") {
+		writeJSONError(w, http.StatusBadRequest, "invalid ref")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		h, err := s.repo.GetRef(ref)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "ref not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"ref": ref, "hash": h})
+	case "PUT":
+		var upd RefUpdate
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil || upd.Hash == "" {
+			writeJSONError(w, http.StatusBadRequest, "hash required")
+			return
+		}
+		if _, err := s.repo.GetCommit(upd.Hash); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "ref target must be a commit present on the server")
+			return
+		}
+		refLocks.Lock()
+		defer refLocks.Unlock()
+		if upd.Old != "" {
+			if cur, _ := s.repo.GetRef(ref); cur != upd.Old {
+				apierror.WriteWith(w, apierror.New(http.StatusConflict, "ref has moved"), map[string]interface{}{"current": cur})
+				return
+			}
+		}
+		if err := s.repo.SetRef(ref, upd.Hash); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"ref": ref, "hash": upd.Hash})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req SyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	objs, err := s.repo.ListObjects("", 0, 0)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	present := make(map[string]struct{}, len(objs))
+	for _, h := range objs {
+		present[h] = struct{}{}
+	}
+	resp := SyncResponse{Missing: []string{}}
+	for _, h := range req.Have {
+		if _, ok := present[h]; !ok {
+			resp.Missing = append(resp.Missing, h)
+		}
+	}
+	if resp.Refs, err = s.refMap(""); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// ChunksRequest is the body of POST <mount>/chunks
+type ChunksRequest struct {
+	Chunker string   `json:"chunker"`
+	Hashes  []string `json:"hashes"`
+}
+
+func (s *server) handleChunks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req ChunksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	if req.Chunker != Chunker {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("unsupported chunker %q, this server uses %q", req.Chunker, Chunker))
+		return
+	}
+	missing, err := s.repo.MissingChunks(req.Hashes)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"missing": missing})
+}
+
+func (s *server) handleChunk(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/chunks/")
+	if !isContentHash(hash) {
+		writeJSONError(w, http.StatusBadRequest, "invalid chunk hash")
+		return
+	}
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rc, err := s.repo.OpenChunk(hash)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, rc)
+}
+
+func (s *server) handleManifests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req ChunksRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid payload")
+		return
+	}
+	out := map[string]*ChunkManifest{}
+	for _, h := range req.Hashes {
+		if m, err := s.repo.deltaManifest(h); err == nil && m != nil {
+			out[h] = m
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"manifests": out})
+}
+
+func (s *server) handleAssemble(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var m ChunkManifest
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil || !isContentHash(m.Hash) || len(m.Chunks) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "a manifest with hash and chunks is required")
+		return
+	}
+	if err := s.repo.Assemble(&m); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrMissingChunks) {
+			status = http.StatusConflict
+		}
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"hash": m.Hash})
+}
+
+func (s *server) handleResolve(w http.ResponseWriter, r *http.Request) {
+	urn := r.URL.Query().Get("urn")
+	commit := r.URL.Query().Get("commit")
+	if urn == "" {
+		writeJSONError(w, http.StatusBadRequest, "urn required")
+		return
+	}
+	if commit == "" {
+		h, err := s.repo.GetRef(defaultBranchRef)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, "no commit given and "+defaultBranchRef+" is not set")
+			return
+		}
+		commit = h
+	}
+	hash, err := s.repo.FindURN(commit, urn)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"urn": urn, "commit": commit, "hash": hash})
+}
@@ -0,0 +1,113 @@
+package codex_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestServer_AuthObjectsRefsAndSync(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-server-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	r := codex.NewRepository(fsadapter.New(tmpdir), tmpdir)
+	srv := httptest.NewServer(codex.NewServer(r, "tok"))
+	defer srv.Close()
+
+	do := func(method, path, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do("GET", "/status", "", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+
+	payload := `{"urn":"urn:node:1"}`
+	sum := sha256.Sum256([]byte(payload))
+	hash := hex.EncodeToString(sum[:])
+	if resp := do("PUT", "/objects/"+hash, payload, "tok"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 for object upload, got %d", resp.StatusCode)
+	}
+	if resp := do("PUT", "/objects/deadbeef", payload, "tok"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for mismatched content hash, got %d", resp.StatusCode)
+	}
+
+	c := &codex.Commit{Hash: "c1", Timestamp: time.Now().UTC(), Objects: []string{hash}}
+	cb, _ := codex.MarshalCommit(c)
+	if resp := do("PUT", "/objects/c1?named=1", string(cb), "tok"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201 for named commit upload, got %d", resp.StatusCode)
+	}
+
+	if resp := do("PUT", "/refs/refs/heads/main", `{"hash":"c1"}`, "tok"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 for ref update, got %d", resp.StatusCode)
+	}
+	moved := do("PUT", "/refs/refs/heads/main", `{"hash":"c1","old":"stale"}`, "tok")
+	var env struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Current string `json:"current"`
+	}
+	json.NewDecoder(moved.Body).Decode(&env)
+	moved.Body.Close()
+	if moved.StatusCode != http.StatusConflict || env.Error.Code != "conflict" || env.Error.Message != "ref has moved" || env.Current != "c1" {
+		t.Fatalf("expected a 409 envelope for stale compare-and-swap, got %d %+v", moved.StatusCode, env)
+	}
+
+	resp := do("POST", "/sync", `{"have":["c1","`+hash+`","other"]}`, "tok")
+	var sync codex.SyncResponse
+	json.NewDecoder(resp.Body).Decode(&sync)
+	resp.Body.Close()
+	if len(sync.Missing) != 1 || sync.Missing[0] != "other" || sync.Refs["refs/heads/main"] != "c1" {
+		t.Fatalf("unexpected sync response: %+v", sync)
+	}
+
+	resp = do("GET", "/objects/"+hash, "", "tok")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != payload {
+		t.Fatalf("unexpected object body %q", b)
+	}
+}
+
+func TestRemote_ErrorBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		if strings.HasSuffix(r.URL.Path, "/old") {
+			w.Write([]byte(`{"error": "ref not found here"}`))
+			return
+		}
+		w.Write([]byte(`{"error": {"code": "not_found", "message": "ref not found"}}`))
+	}))
+	defer srv.Close()
+	rm := codex.NewRemote(srv.URL, "")
+	// servers answer in the envelope, older ones with a bare message
+	if _, err := rm.GetRef("refs/heads/main"); err == nil || !strings.HasSuffix(err.Error(), ": ref not found") {
+		t.Fatalf("expected the envelope's message, got %v", err)
+	}
+	if _, err := rm.GetRef("refs/heads/old"); err == nil || !strings.HasSuffix(err.Error(), ": ref not found here") {
+		t.Fatalf("expected the bare message, got %v", err)
+	}
+}
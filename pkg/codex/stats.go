@@ -0,0 +1,233 @@
+package codex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsSniffLimit is how much of each object is buffered to detect commits
+const statsSniffLimit = 1 << 20
+
+// ObjectStat describes a single stored object
+type ObjectStat struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	IsCommit  bool      `json:"is_commit,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Timestamp time.Time `json:"timestamp,omitempty"`
+}
+
+// AuthorStat is a commit count for a single author
+type AuthorStat struct {
+	Author  string `json:"author"`
+	Commits int    `json:"commits"`
+}
+
+// WeekStat is a commit count for an ISO week (e.g. "2025-W07")
+type WeekStat struct {
+	Week    string `json:"week"`
+	Commits int    `json:"commits"`
+}
+
+// RepoStats summarises repository contents for dashboards
+type RepoStats struct {
+	ObjectCount    int          `json:"object_count"`
+	TotalSize      int64        `json:"total_size"`
+	CommitCount    int          `json:"commit_count"`
+	BranchCount    int          `json:"branch_count"`
+	TagCount       int          `json:"tag_count"`
+	TopAuthors     []AuthorStat `json:"top_authors"`
+	CommitsPerWeek []WeekStat   `json:"commits_per_week"`
+	LargestObjects []ObjectStat `json:"largest_objects"`
+	Scanned        int          `json:"scanned"` // objects examined on this call (the rest came from cache)
+	ComputedAt     time.Time    `json:"computed_at"`
+}
+
+// statsCache is the persisted per-object index that makes Stats incremental
+type statsCache struct {
+	Objects map[string]ObjectStat `json:"objects"`
+}
+
+// in-memory caches keyed by repository path, shared across Repository values
+var (
+	statsMu     sync.Mutex
+	statsCaches = map[string]*statsCache{}
+)
+
+func statsCachePath(repoPath string) string {
+	return filepath.Join(repoPath, ".codex", "stats_cache.json")
+}
+
+func loadStatsCache(repoPath string) *statsCache {
+	key := repoPath
+	if abs, err := filepath.Abs(repoPath); err == nil && repoPath != "" {
+		key = abs
+	}
+	if c, ok := statsCaches[key]; ok {
+		return c
+	}
+	c := &statsCache{Objects: map[string]ObjectStat{}}
+	if repoPath != "" {
+		if b, err := ioutil.ReadFile(statsCachePath(repoPath)); err == nil {
+			_ = json.Unmarshal(b, c)
+			if c.Objects == nil {
+				c.Objects = map[string]ObjectStat{}
+			}
+		}
+	}
+	statsCaches[key] = c
+	return c
+}
+
+// statObject measures an object and detects whether it is a commit
+func (r *Repository) statObject(hash string) (ObjectStat, error) {
+	st := ObjectStat{Hash: hash}
+	var sniff bytes.Buffer
+	if rc, _, err := r.storage.GetObjectStream(hash); err == nil {
+		n, err := io.Copy(&limitedBuffer{buf: &sniff, limit: statsSniffLimit}, rc)
+		rc.Close()
+		if err != nil {
+			return st, err
+		}
+		st.Size = n
+	} else {
+		b, err := r.storage.GetObject(hash)
+		if err != nil {
+			return st, err
+		}
+		st.Size = int64(len(b))
+		sniff.Write(b)
+	}
+	if st.Size <= statsSniffLimit {
+		if c, err := UnmarshalCommit(sniff.Bytes()); err == nil {
+			st.IsCommit = true
+			st.Author = c.Author
+			st.Timestamp = c.Timestamp
+		}
+	}
+	return st, nil
+}
+
+// Stats returns repository statistics. Per-object measurements are cached in
+// memory and under .codex/stats_cache.json so only objects added since the
+// previous call are read; removed objects are dropped from the cache.
+func (r *Repository) Stats(top int) (*RepoStats, error) {
+	if top <= 0 {
+		top = 10
+	}
+	hashes, err := r.storage.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	cache := loadStatsCache(r.path)
+
+	present := map[string]struct{}{}
+	scanned := 0
+	for _, h := range hashes {
+		if _, dup := present[h]; dup {
+			continue
+		}
+		present[h] = struct{}{}
+		if _, ok := cache.Objects[h]; ok {
+			continue
+		}
+		st, err := r.statObject(h)
+		if err != nil {
+			continue
+		}
+		cache.Objects[h] = st
+		scanned++
+	}
+	pruned := false
+	for h := range cache.Objects {
+		if _, ok := present[h]; !ok {
+			delete(cache.Objects, h)
+			pruned = true
+		}
+	}
+	if (scanned > 0 || pruned) && r.path != "" {
+		if b, err := json.Marshal(cache); err == nil {
+			_ = ioutil.WriteFile(statsCachePath(r.path), b, 0o644)
+		}
+	}
+
+	out := &RepoStats{Scanned: scanned, ComputedAt: time.Now().UTC()}
+	authors := map[string]int{}
+	weeks := map[string]int{}
+	all := make([]ObjectStat, 0, len(cache.Objects))
+	for _, st := range cache.Objects {
+		out.ObjectCount++
+		out.TotalSize += st.Size
+		all = append(all, st)
+		if st.IsCommit {
+			out.CommitCount++
+			authors[st.Author]++
+			y, w := st.Timestamp.UTC().ISOWeek()
+			weeks[fmt.Sprintf("%04d-W%02d", y, w)]++
+		}
+	}
+
+	for a, n := range authors {
+		out.TopAuthors = append(out.TopAuthors, AuthorStat{Author: a, Commits: n})
+	}
+	sort.Slice(out.TopAuthors, func(i, j int) bool {
+		if out.TopAuthors[i].Commits != out.TopAuthors[j].Commits {
+			return out.TopAuthors[i].Commits > out.TopAuthors[j].Commits
+		}
+		return out.TopAuthors[i].Author < out.TopAuthors[j].Author
+	})
+	if len(out.TopAuthors) > top {
+		out.TopAuthors = out.TopAuthors[:top]
+	}
+
+	for wk, n := range weeks {
+		out.CommitsPerWeek = append(out.CommitsPerWeek, WeekStat{Week: wk, Commits: n})
+	}
+	sort.Slice(out.CommitsPerWeek, func(i, j int) bool { return out.CommitsPerWeek[i].Week < out.CommitsPerWeek[j].Week })
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Size != all[j].Size {
+			return all[i].Size > all[j].Size
+		}
+		return all[i].Hash < all[j].Hash
+	})
+	if len(all) > top {
+		all = all[:top]
+	}
+	out.LargestObjects = all
+
+	if branches, err := r.storage.ListRefs("refs/heads"); err == nil {
+		out.BranchCount = len(branches)
+	}
+	if tags, err := r.storage.ListRefs("refs/tags"); err == nil {
+		out.TagCount = len(tags)
+	}
+	return out, nil
+}
+
+// limitedBuffer keeps the first limit bytes written and discards the rest
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); room > 0 {
+		if len(p) <= room {
+			l.buf.Write(p)
+		} else {
+			l.buf.Write(p[:room])
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,63 @@
+package codex_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestRepositoryStats_Incremental(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "codex-stats-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	fs := fsadapter.New(tmpdir)
+	_ = fs.PutObject("o1", []byte(`{"urn":"urn:node:1"}`))
+	_ = fs.PutObject("o2", []byte(`{"urn":"urn:node:2","body":"a much longer body than the first"}`))
+	fs.PutCommit(&codex.Commit{Hash: "c1", Author: "alice", Timestamp: time.Now().Add(-14 * 24 * time.Hour), Objects: []string{"o1"}})
+	fs.PutCommit(&codex.Commit{Hash: "c2", Author: "alice", Parents: []string{"c1"}, Timestamp: time.Now(), Objects: []string{"o1", "o2"}})
+	fs.PutCommit(&codex.Commit{Hash: "c3", Author: "bob", Parents: []string{"c2"}, Timestamp: time.Now(), Objects: []string{"o2"}})
+	_ = fs.PutRef("refs/heads/main", "c3")
+	_ = fs.PutRef("refs/heads/dev", "c2")
+	_ = fs.PutRef("refs/tags/v1", "c1")
+
+	r := codex.NewRepository(fs, tmpdir)
+	st, err := r.Stats(5)
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if st.ObjectCount != 5 || st.CommitCount != 3 {
+		t.Fatalf("expected 5 objects / 3 commits, got %d / %d", st.ObjectCount, st.CommitCount)
+	}
+	if st.BranchCount != 2 || st.TagCount != 1 {
+		t.Fatalf("expected 2 branches / 1 tag, got %d / %d", st.BranchCount, st.TagCount)
+	}
+	if len(st.TopAuthors) == 0 || st.TopAuthors[0].Author != "alice" || st.TopAuthors[0].Commits != 2 {
+		t.Fatalf("unexpected top authors: %+v", st.TopAuthors)
+	}
+	if len(st.CommitsPerWeek) != 2 {
+		t.Fatalf("expected commits in 2 weeks, got %+v", st.CommitsPerWeek)
+	}
+	if st.Scanned != 5 || st.TotalSize <= 0 {
+		t.Fatalf("expected full scan on first call, got scanned=%d size=%d", st.Scanned, st.TotalSize)
+	}
+
+	// A fresh Repository re-uses the cache and only reads new objects
+	_ = fs.PutObject("o3", []byte(`{"urn":"urn:node:3"}`))
+	st, err = codex.NewRepository(fs, tmpdir).Stats(5)
+	if err != nil {
+		t.Fatalf("stats error: %v", err)
+	}
+	if st.Scanned != 1 || st.ObjectCount != 6 {
+		t.Fatalf("expected 1 object scanned of 6, got scanned=%d count=%d", st.Scanned, st.ObjectCount)
+	}
+	if _, err := os.Stat(tmpdir + "/.codex/stats_cache.json"); err != nil {
+		t.Fatalf("expected persisted stats cache: %v", err)
+	}
+}
@@ -10,14 +10,19 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"veil/pkg/codex"
 )
 
 // FSStorage implements codex.Storage using the local filesystem under a path
-// It stores objects under <base>/.codex/objects/<hash>.json
+// It stores objects under <base>/.codex/objects/<hash>.json, or in packfiles
+// under .codex/objects/pack once repacked (see Repack)
 type FSStorage struct {
 	base string
+
+	packMu sync.Mutex
+	packs  *packSet
 }
 
 // New creates a new FSStorage rooted at base
@@ -57,10 +62,13 @@ func (fsys *FSStorage) GetObject(hash string) ([]byte, error) {
 	// Fallback to raw data file
 	dataPath := filepath.Join(fsys.objectsDir(), fmt.Sprintf("%s.data", hash))
 	b, err := ioutil.ReadFile(dataPath)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		return b, nil
 	}
-	return b, nil
+	if e, ok := fsys.packed(hash, "json", "data"); ok {
+		return fsys.readPacked(e)
+	}
+	return nil, err
 }
 
 // ListObjects lists filenames in objectsDir optionally filtered by prefix
@@ -73,27 +81,61 @@ func (fsys *FSStorage) ListObjects(prefix string) ([]string, error) {
 		return nil, err
 	}
 	var out []string
+	seen := map[string]struct{}{}
 	for _, e := range entries {
 		if e.IsDir() {
 			continue
 		}
 		name := e.Name()
 		// strip known suffixes
-		if strings.HasSuffix(name, ".json") {
+		if strings.HasSuffix(name, ".meta.json") || strings.HasPrefix(name, "tmpobj-") {
+			// skip metadata sidecars and in-flight uploads
+			continue
+		} else if strings.HasSuffix(name, ".json") {
 			name = strings.TrimSuffix(name, ".json")
 		} else if strings.HasSuffix(name, ".data") {
 			name = strings.TrimSuffix(name, ".data")
-		} else if strings.HasSuffix(name, ".meta.json") {
-			// skip metadata files
-			continue
 		}
 		if prefix == "" || strings.HasPrefix(name, prefix) {
 			out = append(out, name)
+			seen[name] = struct{}{}
+		}
+	}
+	ps := fsys.loadPacks()
+	for h := range ps.entries {
+		if _, ok := seen[h]; ok || (prefix != "" && !strings.HasPrefix(h, prefix)) {
+			continue
+		}
+		if len(ps.live(h)) > 0 {
+			out = append(out, h)
 		}
 	}
 	return out, nil
 }
 
+// DeleteObject removes the legacy JSON file, data file and meta sidecar for
+// hash, and marks it deleted in any pack holding it
+func (fsys *FSStorage) DeleteObject(hash string) error {
+	removed := false
+	for _, name := range []string{hash + ".json", hash + ".data", hash + ".meta.json"} {
+		err := os.Remove(filepath.Join(fsys.objectsDir(), name))
+		if err == nil {
+			removed = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if ok, err := fsys.deletePacked(hash); err != nil {
+		return err
+	} else if ok {
+		removed = true
+	}
+	if !removed {
+		return fmt.Errorf("object not found: %s", hash)
+	}
+	return nil
+}
+
 // PutObjectStream stores an object by streaming data from r. It computes the SHA256
 // hash of the content which is used as the object id. It writes a `.data` file and
 // a `.meta.json` file containing content-type and size.
@@ -155,6 +197,23 @@ func (fsys *FSStorage) GetObjectStream(hash string) (io.ReadCloser, string, erro
 	if f, err := os.Open(jsonPath); err == nil {
 		return f, "application/json", nil
 	}
+	if e, ok := fsys.packed(hash, "data", "json"); ok {
+		ct := "application/json"
+		if e.kind == "data" {
+			ct = "application/octet-stream"
+			var m map[string]interface{}
+			if json.Unmarshal(e.meta, &m) == nil {
+				if s, ok := m["content_type"].(string); ok && s != "" {
+					ct = s
+				}
+			}
+		}
+		rc, err := fsys.openPacked(e)
+		if err != nil {
+			return nil, "", err
+		}
+		return rc, ct, nil
+	}
 	return nil, "", fmt.Errorf("object not found: %s", hash)
 }
 
@@ -0,0 +1,394 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Packfiles keep large repositories from needing one file per object.
+// Repack appends loose objects to .codex/objects/pack/pack-<sha>.pack and
+// writes a pack-<sha>.idx next to it, one tab-separated line per object:
+//
+//	<hash> <offset> <size> <json|data> <meta sidecar JSON or ->
+//
+// A pack only becomes visible once its index exists. Packs are never edited:
+// DeleteObject records "<pack> <hash>" lines in pack/deleted and the space
+// is reclaimed by the next Repack(true).
+
+const (
+	packMagic       = "VEILPACK1\n"
+	packIndexHeader = "# veil codex pack index v1"
+)
+
+// packEntry locates one object inside a pack
+type packEntry struct {
+	pack   string // pack file name without extension
+	offset int64
+	size   int64
+	kind   string // "json" for PutObject payloads, "data" for streamed objects
+	meta   []byte // the .meta.json sidecar of a data object, if any
+}
+
+// packSet is every pack index loaded into memory
+type packSet struct {
+	stamp   string
+	entries map[string][]packEntry
+	deleted map[string]struct{} // "<pack> <hash>"
+}
+
+// RepackReport describes what Repack wrote and removed
+type RepackReport struct {
+	Pack    string `json:"pack,omitempty"`
+	Objects int    `json:"objects"` // objects in the new pack
+	Loose   int    `json:"loose"`   // loose objects moved into it
+	Merged  int    `json:"merged"`  // older packs folded into it
+	Dropped int    `json:"dropped"` // deleted objects left behind
+	Bytes   int64  `json:"bytes"`
+}
+
+func (fsys *FSStorage) packDir() string {
+	return filepath.Join(fsys.objectsDir(), "pack")
+}
+
+func (fsys *FSStorage) deletedPath() string {
+	return filepath.Join(fsys.packDir(), "deleted")
+}
+
+// packStamp changes whenever a pack is added or removed or an object deleted
+func (fsys *FSStorage) packStamp() string {
+	var parts []string
+	for _, p := range []string{fsys.packDir(), fsys.deletedPath()} {
+		if fi, err := os.Stat(p); err == nil {
+			parts = append(parts, fmt.Sprintf("%d:%d", fi.ModTime().UnixNano(), fi.Size()))
+		} else {
+			parts = append(parts, "-")
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// loadPacks returns the pack indexes, rereading them when another process
+// has repacked or deleted objects since they were loaded
+func (fsys *FSStorage) loadPacks() *packSet {
+	fsys.packMu.Lock()
+	defer fsys.packMu.Unlock()
+	stamp := fsys.packStamp()
+	if fsys.packs != nil && fsys.packs.stamp == stamp {
+		return fsys.packs
+	}
+	ps := &packSet{stamp: stamp, entries: map[string][]packEntry{}, deleted: map[string]struct{}{}}
+	idxs, _ := filepath.Glob(filepath.Join(fsys.packDir(), "pack-*.idx"))
+	for _, idx := range idxs {
+		entries, err := readPackIndex(idx)
+		if err != nil {
+			continue
+		}
+		for h, e := range entries {
+			ps.entries[h] = append(ps.entries[h], e...)
+		}
+	}
+	if b, err := ioutil.ReadFile(fsys.deletedPath()); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				ps.deleted[line] = struct{}{}
+			}
+		}
+	}
+	fsys.packs = ps
+	return ps
+}
+
+func readPackIndex(path string) (map[string][]packEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pack := strings.TrimSuffix(filepath.Base(path), ".idx")
+	out := map[string][]packEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	if !sc.Scan() || sc.Text() != packIndexHeader {
+		return nil, fmt.Errorf("%s: not a pack index", path)
+	}
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), "\t", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s: malformed line %q", path, sc.Text())
+		}
+		e := packEntry{pack: pack, kind: fields[3]}
+		if e.offset, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if e.size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if fields[4] != "-" {
+			e.meta = []byte(fields[4])
+		}
+		out[fields[0]] = append(out[fields[0]], e)
+	}
+	return out, sc.Err()
+}
+
+// live returns hash's packed entries that have not been deleted
+func (ps *packSet) live(hash string) []packEntry {
+	var out []packEntry
+	for _, e := range ps.entries[hash] {
+		if _, gone := ps.deleted[e.pack+" "+hash]; !gone {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// packed finds hash in a pack, preferring the kinds in the order given
+func (fsys *FSStorage) packed(hash string, kinds ...string) (packEntry, bool) {
+	entries := fsys.loadPacks().live(hash)
+	for _, k := range kinds {
+		for _, e := range entries {
+			if e.kind == k {
+				return e, true
+			}
+		}
+	}
+	return packEntry{}, false
+}
+
+// packReader streams one object out of a pack file
+type packReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (p packReader) Close() error { return p.f.Close() }
+
+func (fsys *FSStorage) openPacked(e packEntry) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(fsys.packDir(), e.pack+".pack"))
+	if err != nil {
+		return nil, err
+	}
+	return packReader{io.NewSectionReader(f, e.offset, e.size), f}, nil
+}
+
+func (fsys *FSStorage) readPacked(e packEntry) ([]byte, error) {
+	rc, err := fsys.openPacked(e)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// repackItem is an object on its way into a new pack
+type repackItem struct {
+	hash  string
+	kind  string
+	meta  []byte
+	loose string     // path of a loose file, or
+	from  *packEntry // an object in an older pack
+}
+
+// Repack moves every loose object into a new pack and removes the loose
+// files. With all, existing packs are merged into the new one as well and
+// objects deleted from them are dropped for good. Objects written while
+// Repack runs stay loose until the next run; like GC, avoid deleting
+// objects while Repack(true) runs.
+func (fsys *FSStorage) Repack(all bool) (*RepackReport, error) {
+	if err := ensureDir(fsys.packDir()); err != nil {
+		return nil, err
+	}
+	report := &RepackReport{}
+	entries, err := ioutil.ReadDir(fsys.objectsDir())
+	if err != nil {
+		return nil, err
+	}
+	var items []repackItem
+	have := map[string]struct{}{}
+	for _, fi := range entries {
+		name := fi.Name()
+		if fi.IsDir() || strings.HasPrefix(name, "tmpobj-") || strings.HasSuffix(name, ".meta.json") {
+			continue
+		}
+		it := repackItem{loose: filepath.Join(fsys.objectsDir(), name)}
+		switch {
+		case strings.HasSuffix(name, ".json"):
+			it.hash, it.kind = strings.TrimSuffix(name, ".json"), "json"
+		case strings.HasSuffix(name, ".data"):
+			it.hash, it.kind = strings.TrimSuffix(name, ".data"), "data"
+			it.meta, _ = ioutil.ReadFile(filepath.Join(fsys.objectsDir(), it.hash+".meta.json"))
+		default:
+			continue
+		}
+		items = append(items, it)
+		have[it.hash+" "+it.kind] = struct{}{}
+	}
+	report.Loose = len(items)
+
+	var oldPacks []string
+	if all {
+		ps := fsys.loadPacks()
+		idxs, _ := filepath.Glob(filepath.Join(fsys.packDir(), "pack-*.idx"))
+		for _, idx := range idxs {
+			oldPacks = append(oldPacks, strings.TrimSuffix(filepath.Base(idx), ".idx"))
+		}
+		for h := range ps.entries {
+			for _, e := range ps.live(h) {
+				if _, ok := have[h+" "+e.kind]; ok {
+					continue
+				}
+				e := e
+				items = append(items, repackItem{hash: h, kind: e.kind, meta: e.meta, from: &e})
+				have[h+" "+e.kind] = struct{}{}
+			}
+		}
+		report.Dropped = len(ps.deleted)
+	}
+	if len(items) == 0 {
+		// nothing live is left in the old packs either
+		for _, old := range oldPacks {
+			os.Remove(filepath.Join(fsys.packDir(), old+".idx"))
+			os.Remove(filepath.Join(fsys.packDir(), old+".pack"))
+			report.Merged++
+		}
+		if all {
+			os.Remove(fsys.deletedPath())
+		}
+		fsys.resetPacks()
+		return report, nil
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].hash != items[j].hash {
+			return items[i].hash < items[j].hash
+		}
+		return items[i].kind < items[j].kind
+	})
+
+	tmp, err := ioutil.TempFile(fsys.packDir(), "tmppack-*")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { tmp.Close(); os.Remove(tmp.Name()) }()
+	hasher := sha256.New()
+	w := io.MultiWriter(tmp, hasher)
+	if _, err := io.WriteString(w, packMagic); err != nil {
+		return nil, err
+	}
+	offset := int64(len(packMagic))
+	var idx bytes.Buffer
+	idx.WriteString(packIndexHeader + "\n")
+	for _, it := range items {
+		var src io.ReadCloser
+		if it.from != nil {
+			src, err = fsys.openPacked(*it.from)
+		} else {
+			src, err = os.Open(it.loose)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("repack %s: %w", it.hash, err)
+		}
+		n, err := io.Copy(w, src)
+		src.Close()
+		if err != nil {
+			return nil, fmt.Errorf("repack %s: %w", it.hash, err)
+		}
+		meta := "-"
+		if len(it.meta) > 0 {
+			meta = strings.ReplaceAll(string(bytes.TrimSpace(it.meta)), "\n", " ")
+		}
+		fmt.Fprintf(&idx, "%s\t%d\t%d\t%s\t%s\n", it.hash, offset, n, it.kind, meta)
+		offset += n
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	name := "pack-" + hex.EncodeToString(hasher.Sum(nil))
+	packPath := filepath.Join(fsys.packDir(), name+".pack")
+	if err := os.Rename(tmp.Name(), packPath); err != nil {
+		return nil, err
+	}
+	// the index goes last: until it exists the pack is invisible
+	idxTmp := filepath.Join(fsys.packDir(), "tmpidx-"+name)
+	if err := ioutil.WriteFile(idxTmp, idx.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(idxTmp, filepath.Join(fsys.packDir(), name+".idx")); err != nil {
+		return nil, err
+	}
+	report.Pack, report.Objects, report.Bytes = name, len(items), offset
+
+	for _, it := range items {
+		if it.loose != "" {
+			os.Remove(it.loose)
+			if it.kind == "data" {
+				os.Remove(filepath.Join(fsys.objectsDir(), it.hash+".meta.json"))
+			}
+		}
+	}
+	for _, old := range oldPacks {
+		if old == name {
+			continue
+		}
+		os.Remove(filepath.Join(fsys.packDir(), old+".idx"))
+		os.Remove(filepath.Join(fsys.packDir(), old+".pack"))
+		report.Merged++
+	}
+	if all {
+		os.Remove(fsys.deletedPath())
+	}
+	fsys.resetPacks()
+	return report, nil
+}
+
+func (fsys *FSStorage) resetPacks() {
+	fsys.packMu.Lock()
+	fsys.packs = nil
+	fsys.packMu.Unlock()
+}
+
+// deletePacked records hash as deleted from every pack that holds it
+func (fsys *FSStorage) deletePacked(hash string) (bool, error) {
+	ps := fsys.loadPacks()
+	entries := ps.live(hash)
+	if len(entries) == 0 {
+		return false, nil
+	}
+	f, err := os.OpenFile(fsys.deletedPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(f, "%s %s\n", e.pack, hash); err != nil {
+			f.Close()
+			return false, err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	// update the loaded set in place so a GC deleting many objects does not
+	// reread every index after each one
+	fsys.packMu.Lock()
+	if fsys.packs == ps {
+		for _, e := range entries {
+			ps.deleted[e.pack+" "+hash] = struct{}{}
+		}
+		ps.stamp = fsys.packStamp()
+	}
+	fsys.packMu.Unlock()
+	return true, nil
+}
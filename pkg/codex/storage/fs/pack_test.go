@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRepackMovesLooseObjectsIntoPack(t *testing.T) {
+	base := t.TempDir()
+	s := New(base)
+	if err := s.PutObject("commit1", []byte(`{"hash":"commit1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.PutObjectStream(strings.NewReader("binary payload"), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Repack(false)
+	if err != nil {
+		t.Fatalf("repack: %v", err)
+	}
+	if report.Objects != 2 || report.Loose != 2 || report.Pack == "" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	loose, _ := filepath.Glob(filepath.Join(base, ".codex", "objects", "*.*"))
+	if len(loose) != 0 {
+		t.Fatalf("loose files should be gone: %v", loose)
+	}
+
+	// a fresh handle, as another process would have, reads from the pack
+	for _, st := range []*FSStorage{s, New(base)} {
+		if b, err := st.GetObject("commit1"); err != nil || string(b) != `{"hash":"commit1"}` {
+			t.Fatalf("GetObject: %q %v", b, err)
+		}
+		rc, ct, err := st.GetObjectStream(blob)
+		if err != nil {
+			t.Fatalf("GetObjectStream: %v", err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(b) != "binary payload" || ct != "image/png" {
+			t.Fatalf("stream: %q %s", b, ct)
+		}
+		list, _ := st.ListObjects("")
+		sort.Strings(list)
+		if want := sortedCopy([]string{blob, "commit1"}); strings.Join(list, ",") != strings.Join(want, ",") {
+			t.Fatalf("ListObjects = %v", list)
+		}
+	}
+
+	// new objects stay loose until the next repack, which adds a second pack
+	s.PutObject("commit2", []byte(`{"hash":"commit2"}`))
+	if report, _ = s.Repack(false); report.Objects != 1 {
+		t.Fatalf("expected only the new object to be packed: %+v", report)
+	}
+	packs, _ := filepath.Glob(filepath.Join(base, ".codex", "objects", "pack", "*.idx"))
+	if len(packs) != 2 {
+		t.Fatalf("expected 2 packs, got %v", packs)
+	}
+
+	// deleting a packed object hides it, and a full repack drops it
+	if err := s.DeleteObject("commit1"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := New(base).GetObject("commit1"); err == nil {
+		t.Fatalf("deleted object should not be readable")
+	}
+	if err := s.DeleteObject("commit1"); err == nil {
+		t.Fatalf("deleting twice should report a missing object")
+	}
+	report, err = s.Repack(true)
+	if err != nil || report.Objects != 2 || report.Merged != 2 || report.Dropped != 1 {
+		t.Fatalf("full repack: %+v %v", report, err)
+	}
+	packs, _ = filepath.Glob(filepath.Join(base, ".codex", "objects", "pack", "*.idx"))
+	if len(packs) != 1 {
+		t.Fatalf("expected 1 pack after a full repack, got %v", packs)
+	}
+	if _, err := os.Stat(filepath.Join(base, ".codex", "objects", "pack", "deleted")); !os.IsNotExist(err) {
+		t.Fatalf("tombstones should be cleared by a full repack")
+	}
+	if b, err := s.GetObject("commit2"); err != nil || string(b) != `{"hash":"commit2"}` {
+		t.Fatalf("commit2 after full repack: %q %v", b, err)
+	}
+
+	// an object written again after deletion is visible loose and once repacked
+	s.PutObject("commit1", []byte(`{"hash":"commit1"}`))
+	s.Repack(false)
+	if _, err := s.GetObject("commit1"); err != nil {
+		t.Fatalf("re-added object: %v", err)
+	}
+}
+
+func sortedCopy(in []string) []string {
+	out := append([]string{}, in...)
+	sort.Strings(out)
+	return out
+}
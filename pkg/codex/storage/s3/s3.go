@@ -0,0 +1,385 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"veil/pkg/codex"
+)
+
+// Config describes an S3-compatible bucket (AWS, MinIO, Backblaze B2, ...)
+type Config struct {
+	// Endpoint is the service URL, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every key so several repositories can share a bucket
+	Prefix string
+	// PathStyle addresses the bucket as <endpoint>/<bucket>/<key> (needed by MinIO
+	// and most self-hosted services) instead of <bucket>.<endpoint>/<key>
+	PathStyle bool
+	// StorageClass, when set, is sent with every upload, e.g. GLACIER or
+	// DEEP_ARCHIVE for a bucket used as a cold tier
+	StorageClass string
+}
+
+// S3Storage implements codex.Storage against an S3-compatible object store.
+// Objects are stored under <prefix>objects/<hash> with their content type as
+// the object's Content-Type; refs under <prefix>refs/<ref>.
+type S3Storage struct {
+	cfg    Config
+	base   *url.URL
+	client *http.Client
+}
+
+// New creates an S3Storage for cfg
+func New(cfg Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	u, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("s3: invalid endpoint: %w", err)
+	}
+	if !cfg.PathStyle {
+		u.Host = cfg.Bucket + "." + u.Host
+	}
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	return &S3Storage{cfg: cfg, base: u, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (s *S3Storage) objectKey(hash string) string { return s.cfg.Prefix + "objects/" + hash }
+func (s *S3Storage) refKey(ref string) string     { return s.cfg.Prefix + "refs/" + ref }
+
+// keyURL returns the request URL for key (empty key addresses the bucket)
+func (s *S3Storage) keyURL(key string, q url.Values) *url.URL {
+	u := *s.base
+	p := "/"
+	if s.cfg.PathStyle {
+		p += s.cfg.Bucket + "/"
+	}
+	p += key
+	u.Path = p
+	u.RawPath = encodePath(p)
+	if q != nil {
+		u.RawQuery = canonicalQuery(q)
+	}
+	return &u
+}
+
+// do signs and sends a request. body must be re-readable from the start and
+// payloadHash must be its hex SHA256.
+func (s *S3Storage) do(method, key string, q url.Values, body io.Reader, size int64, payloadHash, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.keyURL(key, q).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if method == "PUT" && s.cfg.StorageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", s.cfg.StorageClass)
+	}
+	signV4(req, payloadHash, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("s3: not found: %s", key)
+		}
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *S3Storage) put(key string, payload []byte, contentType string) error {
+	sum := sha256.Sum256(payload)
+	resp, err := s.do("PUT", key, nil, bytes.NewReader(payload), int64(len(payload)), hex.EncodeToString(sum[:]), contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// list returns every key under prefix, following continuation tokens
+func (s *S3Storage) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil, 0, emptyPayloadHash, "")
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: invalid list response: %w", err)
+		}
+		for _, c := range out.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !out.IsTruncated || out.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+// PutObject stores payload under hash as JSON
+func (s *S3Storage) PutObject(hash string, payload []byte) error {
+	return s.put(s.objectKey(hash), payload, "application/json")
+}
+
+// GetObject reads the object for hash
+func (s *S3Storage) GetObject(hash string) ([]byte, error) {
+	b, err := s.get(s.objectKey(hash))
+	if err != nil {
+		return nil, fmt.Errorf("object not found: %s", hash)
+	}
+	return b, nil
+}
+
+// ListObjects lists object hashes optionally filtered by prefix
+func (s *S3Storage) ListObjects(prefix string) ([]string, error) {
+	base := s.objectKey("")
+	keys, err := s.list(base + prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, strings.TrimPrefix(k, base))
+	}
+	return out, nil
+}
+
+// PutCommit stores commit as an object (using commit.Hash as key)
+func (s *S3Storage) PutCommit(c *codex.Commit) error {
+	if c.Hash == "" {
+		return fmt.Errorf("commit hash required")
+	}
+	b, err := codex.MarshalCommit(c)
+	if err != nil {
+		return err
+	}
+	return s.PutObject(c.Hash, b)
+}
+
+// GetCommit reads a commit object
+func (s *S3Storage) GetCommit(hash string) (*codex.Commit, error) {
+	b, err := s.GetObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	return codex.UnmarshalCommit(b)
+}
+
+// PutObjectStream spools r to a temp file while hashing it, then uploads it
+// under its SHA256. The content hash doubles as the signed payload hash.
+func (s *S3Storage) PutObjectStream(r io.Reader, contentType string) (string, error) {
+	tmp, err := ioutil.TempFile("", "codex-s3-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() { tmp.Close(); os.Remove(tmp.Name()) }()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(hasher, tmp), r)
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	resp, err := s.do("PUT", s.objectKey(hash), nil, tmp, size, hash, contentType)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return hash, nil
+}
+
+// GetObjectStream returns a reader over the object body and its content type
+func (s *S3Storage) GetObjectStream(hash string) (io.ReadCloser, string, error) {
+	resp, err := s.do("GET", s.objectKey(hash), nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return nil, "", fmt.Errorf("object not found: %s", hash)
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	return resp.Body, ct, nil
+}
+
+// PutRef writes a ref with the given hash
+func (s *S3Storage) PutRef(ref string, hash string) error {
+	return s.put(s.refKey(ref), []byte(hash), "text/plain")
+}
+
+// GetRef reads a ref and returns the hash
+func (s *S3Storage) GetRef(ref string) (string, error) {
+	b, err := s.get(s.refKey(ref))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ListRefs lists ref names optionally filtered by prefix
+func (s *S3Storage) ListRefs(prefix string) ([]string, error) {
+	base := s.refKey("")
+	keys, err := s.list(base + prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, strings.TrimPrefix(k, base))
+	}
+	return out, nil
+}
+
+// DeleteObject removes the object for hash
+func (s *S3Storage) DeleteObject(hash string) error {
+	resp, err := s.do("DELETE", s.objectKey(hash), nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutFile stores data under <prefix>key, for callers that use the bucket as a
+// plain file store, like static site deploys
+func (s *S3Storage) PutFile(key string, data []byte, contentType string) error {
+	return s.put(s.cfg.Prefix+key, data, contentType)
+}
+
+// ListFiles lists the keys under <prefix>dir, without the bucket's prefix
+func (s *S3Storage) ListFiles(dir string) ([]string, error) {
+	keys, err := s.list(s.cfg.Prefix + dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		keys[i] = strings.TrimPrefix(k, s.cfg.Prefix)
+	}
+	return keys, nil
+}
+
+// DeleteFile removes <prefix>key
+func (s *S3Storage) DeleteFile(key string) error {
+	resp, err := s.do("DELETE", s.cfg.Prefix+key, nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Restore states reported by RestoreState
+const (
+	StateAvailable = "available"
+	StateArchived  = "archived"
+	StateRestoring = "restoring"
+)
+
+// GetFile opens <prefix>key. Objects in an archive class can't be read
+// until a restore has finished.
+func (s *S3Storage) GetFile(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.cfg.Prefix+key, nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// RestoreFile asks for an archived <prefix>key to be readable for days days.
+// Asking again while a restore is running is not an error.
+func (s *S3Storage) RestoreFile(key string, days int) error {
+	body := []byte(fmt.Sprintf("<RestoreRequest><Days>%d</Days></RestoreRequest>", days))
+	sum := sha256.Sum256(body)
+	resp, err := s.do("POST", s.cfg.Prefix+key, url.Values{"restore": {""}}, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:]), "application/xml")
+	if err != nil {
+		if strings.Contains(err.Error(), "RestoreAlreadyInProgress") {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RestoreState reports whether <prefix>key can be read now, is archived, or
+// is being restored, going by its storage class and x-amz-restore header
+func (s *S3Storage) RestoreState(key string) (string, error) {
+	resp, err := s.do("HEAD", s.cfg.Prefix+key, nil, nil, 0, emptyPayloadHash, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	restore := resp.Header.Get("X-Amz-Restore")
+	switch {
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return StateRestoring, nil
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return StateAvailable, nil
+	}
+	switch resp.Header.Get("X-Amz-Storage-Class") {
+	case "GLACIER", "DEEP_ARCHIVE":
+		return StateArchived, nil
+	}
+	return StateAvailable, nil
+}
+
+var _ codex.Storage = (*S3Storage)(nil)
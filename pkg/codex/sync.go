@@ -0,0 +1,445 @@
+package codex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrRefMoved is returned when a ref changed on the remote while pushing
+var ErrRefMoved = errors.New("remote ref has moved")
+
+// syncRefPrefixes are the refs Push and Pull replicate by default
+var syncRefPrefixes = []string{"refs/heads", "refs/tags"}
+
+// SyncOptions controls Push and Pull
+type SyncOptions struct {
+	Token string
+	// Refs limits the sync to these refs; default is every branch and tag
+	Refs []string
+	// Force moves refs even when the update is not a fast-forward
+	Force bool
+}
+
+// SyncResult reports what a Push or Pull transferred and which refs moved.
+// Bytes counts the object content sent or received, Chunks the chunks of
+// large objects among it, and Reused the bytes of those large objects the
+// other side already had. Rejected maps a ref to the reason it was left alone.
+type SyncResult struct {
+	Objects  int               `json:"objects"`
+	Commits  int               `json:"commits"`
+	Chunks   int               `json:"chunks"`
+	Bytes    int64             `json:"bytes"`
+	Reused   int64             `json:"bytes_reused"`
+	Updated  map[string]string `json:"updated"`
+	UpToDate []string          `json:"up_to_date"`
+	Rejected map[string]string `json:"rejected"`
+}
+
+func newSyncResult() *SyncResult {
+	return &SyncResult{Updated: map[string]string{}, UpToDate: []string{}, Rejected: map[string]string{}}
+}
+
+// wantRef reports whether ref is replicated under opts
+func (opts SyncOptions) wantRef(ref string) bool {
+	if len(opts.Refs) > 0 {
+		for _, r := range opts.Refs {
+			if r == ref {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range syncRefPrefixes {
+		if strings.HasPrefix(ref, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// localRefs resolves the refs replicated under opts
+func (r *Repository) localRefs(opts SyncOptions) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range syncRefPrefixes {
+		refs, err := r.storage.ListRefs(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if h, err := r.storage.GetRef(ref); err == nil && h != "" && opts.wantRef(ref) {
+				out[ref] = h
+			}
+		}
+	}
+	for _, ref := range opts.Refs {
+		if _, ok := out[ref]; !ok {
+			if h, err := r.storage.GetRef(ref); err == nil && h != "" {
+				out[ref] = h
+			}
+		}
+	}
+	return out, nil
+}
+
+// reachableCommits walks parent links from heads and returns the commits it
+// finds, parents before children
+func (r *Repository) reachableCommits(heads []string) []*Commit {
+	seen := map[string]struct{}{}
+	var order []*Commit
+	queue := append([]string{}, heads...)
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[cur]; ok || cur == "" {
+			continue
+		}
+		seen[cur] = struct{}{}
+		c, err := r.storage.GetCommit(cur)
+		if err != nil {
+			continue
+		}
+		order = append(order, c)
+		queue = append(queue, c.Parents...)
+	}
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
+
+// isAncestor reports whether ancestor is desc or one of its ancestors
+func (r *Repository) isAncestor(ancestor, desc string) bool {
+	seen := map[string]struct{}{}
+	queue := []string{desc}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		if cur == ancestor {
+			return true
+		}
+		if _, ok := seen[cur]; ok || cur == "" {
+			continue
+		}
+		seen[cur] = struct{}{}
+		if c, err := r.storage.GetCommit(cur); err == nil {
+			queue = append(queue, c.Parents...)
+		}
+	}
+	return false
+}
+
+// Push replicates branches and tags to a codex remote (see NewServer). The
+// remote is told every commit and object reachable from the pushed refs, the
+// ones it lacks are uploaded (large objects as the chunks it lacks), and then
+// all refs move in one atomic update.
+// Refs whose remote value is not an ancestor of the local one are rejected
+// unless opts.Force is set.
+func (r *Repository) Push(remoteURL string, opts SyncOptions) (*SyncResult, error) {
+	rm := NewRemote(remoteURL, opts.Token)
+	refs, err := r.localRefs(opts)
+	if err != nil {
+		return nil, err
+	}
+	res := newSyncResult()
+	if len(refs) == 0 {
+		return res, nil
+	}
+
+	var heads []string
+	for _, h := range refs {
+		heads = append(heads, h)
+	}
+	commits := r.reachableCommits(heads)
+	isCommit := map[string]bool{}
+	var have []string
+	seen := map[string]struct{}{}
+	for _, c := range commits {
+		isCommit[c.Hash] = true
+		for _, h := range c.Objects {
+			if _, ok := seen[h]; !ok {
+				seen[h] = struct{}{}
+				have = append(have, h)
+			}
+		}
+	}
+	// commits go last so the remote never holds a commit without its objects
+	for _, c := range commits {
+		have = append(have, c.Hash)
+	}
+
+	neg, err := rm.Sync(have)
+	if err != nil {
+		return nil, err
+	}
+	missing := map[string]struct{}{}
+	for _, h := range neg.Missing {
+		missing[h] = struct{}{}
+	}
+
+	var updates []RefUpdate
+	names := make([]string, 0, len(refs))
+	for ref := range refs {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		local, remote := refs[ref], neg.Refs[ref]
+		switch {
+		case local == remote:
+			res.UpToDate = append(res.UpToDate, ref)
+		case remote != "" && !opts.Force && !r.isAncestor(remote, local):
+			res.Rejected[ref] = "non-fast-forward: the remote has commits that are not here; pull first"
+		default:
+			updates = append(updates, RefUpdate{Ref: ref, Hash: local, Old: remote})
+		}
+	}
+
+	for _, h := range have {
+		if _, ok := missing[h]; !ok {
+			continue
+		}
+		if isCommit[h] || !isContentHash(h) {
+			b, err := r.storage.GetObject(h)
+			if err != nil {
+				return res, fmt.Errorf("read %s: %w", h, err)
+			}
+			if err := rm.PutObject(h, bytes.NewReader(b), "application/json", true); err != nil {
+				return res, err
+			}
+		} else if sent, err := r.pushChunked(rm, h, res); err != nil {
+			return res, err
+		} else if !sent {
+			rc, ct, err := r.storage.GetObjectStream(h)
+			if err != nil {
+				return res, fmt.Errorf("read %s: %w", h, err)
+			}
+			cr := &countingReader{r: rc}
+			err = rm.PutObject(h, cr, ct, false)
+			rc.Close()
+			if err != nil {
+				return res, err
+			}
+			res.Bytes += cr.n
+		}
+		if isCommit[h] {
+			res.Commits++
+		} else {
+			res.Objects++
+		}
+	}
+
+	if len(updates) > 0 {
+		if err := rm.UpdateRefs(updates); err != nil {
+			return res, err
+		}
+		for _, u := range updates {
+			res.Updated[u.Ref] = u.Hash
+		}
+	}
+	return res, nil
+}
+
+// Pull fetches branches and tags from a codex remote. Missing commits and
+// objects are downloaded (and verified against their hashes), large objects
+// as the chunks not already here, then local refs are fast-forwarded. A ref
+// that has diverged is rejected unless opts.Force is set; its commits are
+// still fetched so it can be merged.
+func (r *Repository) Pull(remoteURL string, opts SyncOptions) (*SyncResult, error) {
+	rm := NewRemote(remoteURL, opts.Token)
+	remoteRefs, err := rm.Refs("")
+	if err != nil {
+		return nil, err
+	}
+	res := newSyncResult()
+
+	local := map[string]struct{}{}
+	if objs, err := r.storage.ListObjects(""); err == nil {
+		for _, h := range objs {
+			local[h] = struct{}{}
+		}
+	}
+	delta := true
+	fetch := func(h string) ([]byte, error) {
+		b, ct, err := rm.fetchObject(h)
+		if err != nil {
+			return nil, err
+		}
+		res.Bytes += int64(len(b))
+		if isContentHash(h) {
+			if _, err := UnmarshalCommit(b); err != nil {
+				got, err := r.storage.PutObjectStream(bytes.NewReader(b), ct)
+				if err != nil {
+					return nil, err
+				}
+				if got != h {
+					return nil, fmt.Errorf("object %s stored as %s", h, got)
+				}
+				local[h] = struct{}{}
+				return b, nil
+			}
+		}
+		if err := r.storage.PutObject(h, b); err != nil {
+			return nil, err
+		}
+		local[h] = struct{}{}
+		return b, nil
+	}
+
+	names := make([]string, 0, len(remoteRefs))
+	for ref := range remoteRefs {
+		if opts.wantRef(ref) {
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	for _, ref := range names {
+		queue := []string{remoteRefs[ref]}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			if _, ok := local[cur]; ok || cur == "" {
+				continue
+			}
+			b, _, err := rm.fetchObject(cur)
+			if err != nil {
+				return res, err
+			}
+			c, err := UnmarshalCommit(b)
+			if err != nil {
+				return res, fmt.Errorf("remote commit %s: %w", cur, err)
+			}
+			var need []string
+			for _, h := range c.Objects {
+				if _, ok := local[h]; !ok && isContentHash(h) {
+					need = append(need, h)
+				}
+			}
+			var manifests map[string]*ChunkManifest
+			if delta && len(need) > 0 {
+				manifests, err = rm.Manifests(need)
+				if errors.Is(err, errNoDelta) {
+					delta = false
+				} else if err != nil {
+					return res, err
+				}
+			}
+			for _, h := range c.Objects {
+				if _, ok := local[h]; ok {
+					continue
+				}
+				if m := manifests[h]; m != nil && m.Hash == h {
+					if err := r.pullChunked(rm, m, res); err != nil {
+						return res, err
+					}
+					local[h] = struct{}{}
+				} else if _, err := fetch(h); err != nil {
+					return res, err
+				}
+				res.Objects++
+			}
+			// store the commit once its objects are in place
+			if err := r.storage.PutCommit(c); err != nil {
+				return res, err
+			}
+			local[cur] = struct{}{}
+			res.Commits++
+			queue = append(queue, c.Parents...)
+		}
+	}
+
+	refLocks.Lock()
+	defer refLocks.Unlock()
+	for _, ref := range names {
+		remote := remoteRefs[ref]
+		cur, _ := r.storage.GetRef(ref)
+		switch {
+		case cur == remote:
+			res.UpToDate = append(res.UpToDate, ref)
+		case cur != "" && !opts.Force && !r.isAncestor(cur, remote):
+			if r.isAncestor(remote, cur) {
+				// local is ahead; nothing to pull
+				res.UpToDate = append(res.UpToDate, ref)
+				continue
+			}
+			res.Rejected[ref] = "diverged: remote is at " + remote + "; merge it to continue"
+		default:
+			if err := r.storage.PutRef(ref, remote); err != nil {
+				return res, err
+			}
+			res.Updated[ref] = remote
+		}
+	}
+	return res, nil
+}
+
+// pushChunked sends a large object as the chunks the remote lacks and has
+// the remote assemble it. It reports false when the object should be sent
+// whole: it is small, or the remote predates chunked sync.
+func (r *Repository) pushChunked(rm *Remote, hash string, res *SyncResult) (bool, error) {
+	m, err := r.deltaManifest(hash)
+	if err != nil || m == nil {
+		return false, err
+	}
+	missing, err := rm.MissingChunks(m.chunkHashes())
+	if errors.Is(err, errNoDelta) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	need := map[string]struct{}{}
+	for _, h := range missing {
+		need[h] = struct{}{}
+	}
+	for _, c := range m.Chunks {
+		if _, ok := need[c.Hash]; !ok {
+			res.Reused += c.Size
+			continue
+		}
+		delete(need, c.Hash)
+		rc, err := r.OpenChunk(c.Hash)
+		if err != nil {
+			return false, err
+		}
+		err = rm.PutObject(c.Hash, rc, "application/octet-stream", false)
+		rc.Close()
+		if err != nil {
+			return false, err
+		}
+		res.Chunks++
+		res.Bytes += c.Size
+	}
+	return true, rm.Assemble(m)
+}
+
+// pullChunked downloads the chunks of m not already here, keeping each as a
+// loose object so an interrupted pull resumes, then assembles the object
+func (r *Repository) pullChunked(rm *Remote, m *ChunkManifest, res *SyncResult) error {
+	missing, err := r.MissingChunks(m.chunkHashes())
+	if err != nil {
+		return err
+	}
+	need := map[string]struct{}{}
+	for _, h := range missing {
+		need[h] = struct{}{}
+	}
+	for _, c := range m.Chunks {
+		if _, ok := need[c.Hash]; !ok {
+			res.Reused += c.Size
+			continue
+		}
+		delete(need, c.Hash)
+		b, err := rm.GetChunk(c.Hash)
+		if err != nil {
+			return err
+		}
+		if _, err := r.storage.PutObjectStream(bytes.NewReader(b), "application/octet-stream"); err != nil {
+			return err
+		}
+		res.Chunks++
+		res.Bytes += int64(len(b))
+	}
+	return r.Assemble(m)
+}
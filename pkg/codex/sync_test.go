@@ -0,0 +1,214 @@
+package codex_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func commitObjects(t *testing.T, r *codex.Repository, parent string, payloads ...string) string {
+	var objs []string
+	for _, p := range payloads {
+		h, err := r.PutObjectStream(bytes.NewReader([]byte(p)), "application/json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, h)
+	}
+	c := &codex.Commit{Timestamp: time.Now().UTC(), Message: "c", Objects: objs}
+	if parent != "" {
+		c.Parents = []string{parent}
+	}
+	if err := r.PutCommit(c); err != nil {
+		t.Fatal(err)
+	}
+	return c.Hash
+}
+
+func TestPushPullBetweenRepositories(t *testing.T) {
+	a := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	b := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	srv := httptest.NewServer(codex.NewServer(b, "tok"))
+	defer srv.Close()
+
+	c1 := commitObjects(t, a, "", `{"urn":"urn:1","title":"One"}`)
+	c2 := commitObjects(t, a, c1, `{"urn":"urn:1","title":"One"}`, `{"urn":"urn:2","title":"Two"}`)
+	a.SetRef("refs/heads/main", c2)
+	a.SetRef("refs/tags/v1", c1)
+
+	if _, err := a.Push(srv.URL, codex.SyncOptions{Token: "wrong"}); err == nil {
+		t.Fatalf("expected push with a bad token to fail")
+	}
+	res, err := a.Push(srv.URL, codex.SyncOptions{Token: "tok"})
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if res.Commits != 2 || res.Objects != 2 || res.Updated["refs/heads/main"] != c2 || res.Updated["refs/tags/v1"] != c1 {
+		t.Fatalf("unexpected push result: %+v", res)
+	}
+	if h, _ := b.GetRef("refs/heads/main"); h != c2 {
+		t.Fatalf("remote main = %q, want %s", h, c2)
+	}
+	if diff, err := b.DiffCommits(c1, c2); err != nil || len(diff.Added) != 1 {
+		t.Fatalf("remote should hold both commits and their objects: %+v %v", diff, err)
+	}
+
+	// pushing again transfers nothing
+	res, _ = a.Push(srv.URL, codex.SyncOptions{Token: "tok"})
+	if res.Commits != 0 || res.Objects != 0 || len(res.UpToDate) != 2 {
+		t.Fatalf("expected nothing to push: %+v", res)
+	}
+
+	// a fresh clone pulls everything
+	c := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	res, err = c.Pull(srv.URL, codex.SyncOptions{Token: "tok"})
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if res.Commits != 2 || res.Objects != 2 || res.Updated["refs/heads/main"] != c2 {
+		t.Fatalf("unexpected pull result: %+v", res)
+	}
+	if _, err := c.FindURN(c2, "urn:2"); err != nil {
+		t.Fatalf("pulled commit should resolve urn:2: %v", err)
+	}
+
+	// the remote moves ahead: a's push is rejected, a's pull fast-forwards
+	c3 := commitObjects(t, c, c2, `{"urn":"urn:3","title":"Three"}`)
+	c.SetRef("refs/heads/main", c3)
+	if _, err := c.Push(srv.URL, codex.SyncOptions{Token: "tok"}); err != nil {
+		t.Fatalf("push from clone: %v", err)
+	}
+	a4 := commitObjects(t, a, c2, `{"urn":"urn:4","title":"Four"}`)
+	a.SetRef("refs/heads/main", a4)
+	res, _ = a.Push(srv.URL, codex.SyncOptions{Token: "tok"})
+	if res.Rejected["refs/heads/main"] == "" {
+		t.Fatalf("expected diverged push to be rejected: %+v", res)
+	}
+	res, _ = a.Pull(srv.URL, codex.SyncOptions{Token: "tok"})
+	if res.Rejected["refs/heads/main"] == "" || res.Commits != 1 {
+		t.Fatalf("expected diverged pull to fetch but not move main: %+v", res)
+	}
+	if _, err := a.GetCommit(c3); err != nil {
+		t.Fatalf("diverged commit should be fetched for merging: %v", err)
+	}
+	if res, err = a.Push(srv.URL, codex.SyncOptions{Token: "tok", Force: true}); err != nil || res.Updated["refs/heads/main"] != a4 {
+		t.Fatalf("forced push: %+v %v", res, err)
+	}
+}
+
+func TestRemoteUpdateRefsIsAtomic(t *testing.T) {
+	b := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	srv := httptest.NewServer(codex.NewServer(b, ""))
+	defer srv.Close()
+	c1 := commitObjects(t, b, "", `{"urn":"urn:1"}`)
+	c2 := commitObjects(t, b, c1, `{"urn":"urn:2"}`)
+	b.SetRef("refs/heads/main", c1)
+
+	rm := codex.NewRemote(srv.URL, "")
+	err := rm.UpdateRefs([]codex.RefUpdate{
+		{Ref: "refs/tags/v2", Hash: c2},
+		{Ref: "refs/heads/main", Hash: c2, Old: "stale"},
+	})
+	if !errors.Is(err, codex.ErrRefMoved) {
+		t.Fatalf("expected ErrRefMoved, got %v", err)
+	}
+	if _, err := b.GetRef("refs/tags/v2"); err == nil {
+		t.Fatalf("no ref should change when one update fails")
+	}
+	if err := rm.UpdateRefs([]codex.RefUpdate{{Ref: "refs/tags/v2", Hash: c2}, {Ref: "refs/heads/main", Hash: c2, Old: c1}}); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := b.GetRef("refs/heads/main"); h != c2 {
+		t.Fatalf("main = %q, want %s", h, c2)
+	}
+}
+
+func TestChunkedSyncSendsOnlyChangedChunks(t *testing.T) {
+	a := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	b := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	srv := httptest.NewServer(codex.NewServer(b, "tok"))
+	defer srv.Close()
+
+	video := make([]byte, 12<<20)
+	rand.New(rand.NewSource(1)).Read(video)
+	commitMedia := func(r *codex.Repository, parent string, content []byte) (string, string) {
+		h, err := r.PutObjectStream(bytes.NewReader(content), "video/mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &codex.Commit{Timestamp: time.Now().UTC(), Message: "media", Objects: []string{h}}
+		if parent != "" {
+			c.Parents = []string{parent}
+		}
+		if err := r.PutCommit(c); err != nil {
+			t.Fatal(err)
+		}
+		r.SetRef("refs/heads/main", c.Hash)
+		return c.Hash, h
+	}
+	c1, h1 := commitMedia(a, "", video)
+
+	// a server already holding some chunks, as after an interrupted push,
+	// is only sent the rest
+	m, err := a.ChunkManifest(h1)
+	if err != nil || len(m.Chunks) < 4 {
+		t.Fatalf("expected a 12MB object to be cut into several chunks: %+v %v", m, err)
+	}
+	rm := codex.NewRemote(srv.URL, "tok")
+	var partial int64
+	for _, c := range m.Chunks[:2] {
+		rc, err := a.OpenChunk(c.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rm.PutObject(c.Hash, rc, "application/octet-stream", false); err != nil {
+			t.Fatal(err)
+		}
+		rc.Close()
+		partial += c.Size
+	}
+	res, err := a.Push(srv.URL, codex.SyncOptions{Token: "tok"})
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if res.Bytes != int64(len(video))-partial || res.Reused != partial || res.Objects != 1 {
+		t.Fatalf("the push should resume after the chunks already sent: %+v", res)
+	}
+	if got, err := b.GetObject(h1); err != nil || !bytes.Equal(got, video) {
+		t.Fatalf("remote should assemble the object: %v", err)
+	}
+
+	// a small edit sends only the chunks around it
+	edited := append([]byte{}, video...)
+	copy(edited[6<<20:], "a few changed bytes")
+	_, h2 := commitMedia(a, c1, edited)
+	res, err = a.Push(srv.URL, codex.SyncOptions{Token: "tok"})
+	if err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if res.Objects != 1 || res.Bytes == 0 || res.Bytes > 2*4<<20 || res.Reused < int64(len(edited))-res.Bytes {
+		t.Fatalf("expected only the edited chunks sent: %+v", res)
+	}
+	if got, err := b.GetObject(h2); err != nil || !bytes.Equal(got, edited) {
+		t.Fatalf("remote should hold the edited object: %v", err)
+	}
+
+	// pulling both versions downloads the shared chunks once
+	c := codex.NewRepository(fsadapter.New(t.TempDir()), "")
+	res, err = c.Pull(srv.URL, codex.SyncOptions{Token: "tok"})
+	if err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if res.Objects != 2 || res.Bytes >= int64(len(video))+4<<20 || res.Reused == 0 {
+		t.Fatalf("expected the second version to reuse the first's chunks: %+v", res)
+	}
+	if got, err := c.GetObject(h2); err != nil || !bytes.Equal(got, edited) {
+		t.Fatalf("pulled object differs: %v", err)
+	}
+}
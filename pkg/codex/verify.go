@@ -0,0 +1,68 @@
+package codex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+)
+
+// VerifyReport is the outcome of checking objects against their hashes
+type VerifyReport struct {
+	Checked int      `json:"checked"`
+	Skipped int      `json:"skipped"` // named objects, which have no hash to check
+	Corrupt []string `json:"corrupt"`
+}
+
+// VerifyObjects reads every object named by a sha256 and checks it hashes to
+// its name, or for commits to the commit hash. Objects that can't be read
+// count as corrupt.
+func (r *Repository) VerifyObjects() (*VerifyReport, error) {
+	hashes, err := r.storage.ListObjects("")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(hashes)
+	report := &VerifyReport{Corrupt: []string{}}
+	for _, h := range hashes {
+		if !isContentHash(h) {
+			report.Skipped++
+			continue
+		}
+		report.Checked++
+		if !r.verifyObject(h) {
+			report.Corrupt = append(report.Corrupt, h)
+		}
+	}
+	return report, nil
+}
+
+// verifyObject streams the object through sha256, rereading it as a commit
+// only when the content hash differs
+func (r *Repository) verifyObject(hash string) bool {
+	rc, _, err := r.storage.GetObjectStream(hash)
+	if err != nil {
+		return false
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, rc)
+	rc.Close()
+	if err != nil {
+		return false
+	}
+	if hex.EncodeToString(h.Sum(nil)) == hash {
+		return true
+	}
+	b, err := r.storage.GetObject(hash)
+	return err == nil && matchesHash(hash, b)
+}
+
+// matchesHash reports whether b is the content or the commit named hash
+func matchesHash(hash string, b []byte) bool {
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) == hash {
+		return true
+	}
+	c, err := UnmarshalCommit(b)
+	return err == nil && computeCommitHash(c) == hash
+}
@@ -0,0 +1,43 @@
+package codex_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsadapter "veil/pkg/codex/storage/fs"
+)
+
+func TestVerifyObjects(t *testing.T) {
+	dir := t.TempDir()
+	fs := fsadapter.New(dir)
+	r := codex.NewRepository(fs, dir)
+	good, _ := fs.PutObjectStream(strings.NewReader("intact"), "text/plain")
+	bad, _ := fs.PutObjectStream(strings.NewReader("original"), "text/plain")
+	commit := &codex.Commit{Author: "a", Timestamp: time.Now().UTC(), Message: "m", Objects: []string{good}}
+	if err := r.PutCommit(commit); err != nil {
+		t.Fatal(err)
+	}
+	fs.PutObject("named-config", []byte(`{"a":1}`))
+	os.WriteFile(filepath.Join(dir, ".codex", "objects", bad+".data"), []byte("tampered"), 0o644)
+
+	report, err := r.VerifyObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || report.Skipped != 1 || len(report.Corrupt) != 1 || report.Corrupt[0] != bad {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	// packed objects are checked too
+	os.WriteFile(filepath.Join(dir, ".codex", "objects", bad+".data"), []byte("original"), 0o644)
+	if _, err := fs.Repack(false); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := r.VerifyObjects(); report.Checked != 3 || len(report.Corrupt) != 0 {
+		t.Fatalf("unexpected report after repack: %+v", report)
+	}
+}
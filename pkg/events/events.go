@@ -0,0 +1,148 @@
+// Package events is an in-process publish/subscribe bus for changes the web
+// UI and external tools want to hear about as they happen. The server relays
+// it over the /ws WebSocket endpoint.
+package events
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types
+const (
+	NodeCreated = "node.created"
+	NodeUpdated = "node.updated"
+	NodeDeleted = "node.deleted"
+	JobProgress = "job.progress"
+	ReminderDue = "reminder.due"
+	CodexCommit = "codex.commit"
+	// NodeArchived and NodeUnarchived follow a node in and out of the archive
+	NodeArchived   = "node.archived"
+	NodeUnarchived = "node.unarchived"
+	// NodeRestored is a deleted node taken back out of the trash
+	NodeRestored = "node.restored"
+	// NodeMoved is a node given a new parent and path
+	NodeMoved = "node.moved"
+	// PresenceUpdated and PresenceLeft carry who is on which node
+	PresenceUpdated = "presence.updated"
+	PresenceLeft    = "presence.left"
+	// NotificationCreated and NotificationRead carry a user's notifications
+	// and unread count
+	NotificationCreated = "notification.created"
+	NotificationRead    = "notification.read"
+	// AlertRaised and AlertResolved carry system alerts as they are sent
+	AlertRaised   = "alert.raised"
+	AlertResolved = "alert.resolved"
+)
+
+// Event is one change. Data is encoded as JSON for subscribers.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber
+// whose buffer is full misses the event and has Dropped incremented.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	seq  uint64
+}
+
+// Subscription receives the events matching its filters on C
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	filters []string
+	dropped uint64
+	bus     *Bus
+	once    sync.Once
+}
+
+// NewBus returns an empty bus
+func NewBus() *Bus {
+	return &Bus{subs: map[*Subscription]struct{}{}}
+}
+
+// Default is the server's bus
+var Default = NewBus()
+
+// Publish sends an event on the default bus
+func Publish(typ string, data interface{}) { Default.Publish(typ, data) }
+
+// Subscribe subscribes to the default bus
+func Subscribe(buffer int, filters ...string) *Subscription {
+	return Default.Subscribe(buffer, filters...)
+}
+
+// Publish sends an event to every matching subscriber
+func (b *Bus) Publish(typ string, data interface{}) {
+	ev := Event{ID: atomic.AddUint64(&b.seq, 1), Type: typ, Time: time.Now().Unix(), Data: data}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for s := range b.subs {
+		if !s.matches(typ) {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a subscription buffering up to buffer events. Filters
+// are event types or prefixes ending in "*" such as "node.*"; none means
+// every event.
+func (b *Bus) Subscribe(buffer int, filters ...string) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, c: c, bus: b}
+	for _, f := range filters {
+		if f = strings.TrimSpace(f); f != "" {
+			s.filters = append(s.filters, f)
+		}
+	}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Subscribers is the number of open subscriptions
+func (b *Bus) Subscribers() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.subs)
+}
+
+// Close ends the subscription and closes C
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.mu.Lock()
+		delete(s.bus.subs, s)
+		s.bus.mu.Unlock()
+		close(s.c)
+	})
+}
+
+// Dropped counts events missed because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) matches(typ string) bool {
+	if len(s.filters) == 0 {
+		return true
+	}
+	for _, f := range s.filters {
+		if f == typ || f == "*" || (strings.HasSuffix(f, "*") && strings.HasPrefix(typ, strings.TrimSuffix(f, "*"))) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package events
+
+import "testing"
+
+func TestBusFiltersAndDrops(t *testing.T) {
+	b := NewBus()
+	nodes := b.Subscribe(1, "node.*")
+	all := b.Subscribe(4)
+	defer all.Close()
+
+	b.Publish(NodeCreated, map[string]string{"id": "n1"})
+	b.Publish(CodexCommit, map[string]string{"hash": "c1"})
+	b.Publish(NodeUpdated, map[string]string{"id": "n1"})
+
+	if ev := <-nodes.C; ev.Type != NodeCreated || ev.ID != 1 {
+		t.Fatalf("unexpected first node event: %+v", ev)
+	}
+	if nodes.Dropped() != 1 {
+		t.Fatalf("the second node event should be dropped by a full buffer, dropped=%d", nodes.Dropped())
+	}
+	if len(all.C) != 3 {
+		t.Fatalf("unfiltered subscriber should see every event, got %d", len(all.C))
+	}
+
+	nodes.Close()
+	nodes.Close()
+	if _, ok := <-nodes.C; ok {
+		t.Fatalf("closed subscription should have a closed channel")
+	}
+	if b.Subscribers() != 1 {
+		t.Fatalf("expected 1 subscriber after close, got %d", b.Subscribers())
+	}
+}
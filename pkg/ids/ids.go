@@ -0,0 +1,127 @@
+// Package ids generates row identifiers: a short type prefix, an underscore
+// and a ULID, like "node_01JA2Y7Q9G3XK4W5M6N7P8R9ST". ULIDs start with the
+// creation time in milliseconds, so ids of one type sort by when they were
+// made, and end in 80 random bits, so concurrent creates don't collide.
+// Within a millisecond the generator counts up from the last random part,
+// keeping ids made by one process in order.
+//
+// VEIL_ID_FORMAT=uuidv7 switches to UUIDv7, which has the same properties in
+// the form other tools expect.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Generator makes the unique part of an id for the given time
+type Generator interface {
+	Generate(t time.Time) string
+}
+
+var (
+	mu        sync.Mutex
+	generator Generator = &ULID{}
+)
+
+// New returns a fresh id with the given prefix
+func New(prefix string) string {
+	return At(prefix, time.Now())
+}
+
+// At returns an id with the given prefix that sorts as if made at t
+func At(prefix string, t time.Time) string {
+	mu.Lock()
+	g := generator
+	mu.Unlock()
+	return prefix + "_" + g.Generate(t)
+}
+
+// SetGenerator replaces the generator used by New and At
+func SetGenerator(g Generator) {
+	mu.Lock()
+	generator = g
+	mu.Unlock()
+}
+
+// ByName returns the generator for a format name: "ulid" (the default) or
+// "uuidv7"
+func ByName(name string) (Generator, error) {
+	switch name {
+	case "", "ulid":
+		return &ULID{}, nil
+	case "uuidv7":
+		return &UUIDv7{}, nil
+	}
+	return nil, fmt.Errorf("unknown id format %q (want ulid or uuidv7)", name)
+}
+
+// crockford is the base32 alphabet ULIDs are written in
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULID generates monotonic ULIDs
+type ULID struct {
+	mu     sync.Mutex
+	lastMS uint64
+	last   [10]byte
+}
+
+// Generate returns the 26 character ULID for t
+func (u *ULID) Generate(t time.Time) string {
+	ms := uint64(t.UnixMilli())
+	u.mu.Lock()
+	var entropy [10]byte
+	if ms == u.lastMS && increment(u.last[:]) {
+		entropy = u.last
+	} else {
+		rand.Read(entropy[:])
+		u.lastMS, u.last = ms, entropy
+	}
+	u.mu.Unlock()
+
+	var b [16]byte
+	b[0], b[1], b[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	b[3], b[4], b[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	copy(b[6:], entropy[:])
+
+	// 128 bits as 26 base32 digits, the first holding only 3 bits
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// increment adds one to a big-endian number, reporting false on overflow
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UUIDv7 generates RFC 9562 version 7 UUIDs
+type UUIDv7 struct{}
+
+// Generate returns the UUIDv7 for t in its usual dashed form
+func (UUIDv7) Generate(t time.Time) string {
+	ms := uint64(t.UnixMilli())
+	var b [16]byte
+	rand.Read(b[6:])
+	b[0], b[1], b[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	b[3], b[4], b[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
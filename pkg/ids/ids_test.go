@@ -0,0 +1,67 @@
+package ids
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestULIDOrderAndUniqueness(t *testing.T) {
+	u := &ULID{}
+	at := time.UnixMilli(1469918176385)
+	if id := u.Generate(at); !strings.HasPrefix(id, "01ARYZ6S41") || len(id) != 26 {
+		t.Fatalf("ULID should start with the encoded time: %s", id)
+	}
+
+	// one millisecond: counts up instead of drawing new randomness
+	var made []string
+	for i := 0; i < 1000; i++ {
+		made = append(made, u.Generate(at))
+	}
+	if !sort.StringsAreSorted(made) {
+		t.Fatal("ULIDs within a millisecond should stay in order")
+	}
+	if later := u.Generate(at.Add(time.Millisecond)); later <= made[len(made)-1] {
+		t.Fatalf("a later ULID should sort after: %s <= %s", later, made[len(made)-1])
+	}
+
+	seen := map[string]bool{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				id := New("node")
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("duplicate id %s", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestUUIDv7(t *testing.T) {
+	g, err := ByName("uuidv7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetGenerator(g)
+	defer SetGenerator(&ULID{})
+
+	id := At("v", time.UnixMilli(0x017F22E279B0))
+	if !regexp.MustCompile(`^v_017f22e2-79b0-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("not a UUIDv7 id: %s", id)
+	}
+	if _, err := ByName("snowflake"); err == nil {
+		t.Fatal("unknown formats should be rejected")
+	}
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(prev)
+
+	h := RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.ErrorContext(r.Context(), "plugin failed", "plugin", "media")
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("the recorder should still flush")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream down"))
+	}))
+	req := httptest.NewRequest("POST", "/api/plugins/media/execute", nil)
+	req.Header.Set(RequestIDHeader, "req_abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Header().Get(RequestIDHeader) != "req_abc" {
+		t.Fatalf("the incoming request id should be echoed: %q", w.Header().Get(RequestIDHeader))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want the handler's line and the request line, got %q", buf.String())
+	}
+	var inner, entry map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &inner)
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if inner["request_id"] != "req_abc" || inner["plugin"] != "media" {
+		t.Fatalf("logs made with the request context should carry its id: %v", inner)
+	}
+	if entry["msg"] != "request" || entry["level"] != "ERROR" || entry["method"] != "POST" || entry["path"] != "/api/plugins/media/execute" ||
+		entry["status"] != float64(502) || entry["bytes"] != float64(13) || entry["request_id"] != "req_abc" {
+		t.Fatalf("unexpected request line: %v", entry)
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Fatal("the request line should carry its duration")
+	}
+
+	buf.Reset()
+	w = httptest.NewRecorder()
+	h = RequestLogger(http.NotFoundHandler())
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	if id := w.Header().Get(RequestIDHeader); !strings.HasPrefix(id, "req_") || !strings.Contains(buf.String(), `"level":"INFO"`) {
+		t.Fatalf("a fresh id should be made: %q %s", id, buf.String())
+	}
+}
+
+func TestSetup(t *testing.T) {
+	prevSlog, prevFlags, prevOut := slog.Default(), log.Flags(), log.Writer()
+	defer func() {
+		slog.SetDefault(prevSlog)
+		log.SetFlags(prevFlags)
+		log.SetOutput(prevOut)
+	}()
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, "text", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("hidden")
+	slog.Warn("shown", "plugin", "ipfs")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "level=WARN") || !strings.Contains(out, "plugin=ipfs") {
+		t.Fatalf("text output at warn: %q", out)
+	}
+
+	for _, bad := range [][2]string{{"xml", "info"}, {"json", "loud"}} {
+		if err := Setup(&buf, bad[0], bad[1]); err == nil {
+			t.Fatalf("%v should be refused", bad)
+		}
+	}
+}
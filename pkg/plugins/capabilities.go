@@ -0,0 +1,190 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sort"
+)
+
+// === Plugin Capabilities ===
+// A plugin declares what it needs beyond computing on its payload, through
+// Capabilities() for built-in plugins or "capabilities" in a WASM or exec
+// manifest, and gets nothing else. The registry checks the declaration when
+// the plugin registers and carries the grant in the context of every call,
+// where the helpers plugins use for outside access check it: pluginCommand
+// for exec, pluginHTTP for network and pluginDB for db:read and db:write.
+// Credentials reach only plugins that declare credentials, which are the
+// only ones handed a PluginContext. Code outside a plugin call, such as
+// Initialize or a plugin's own background loop, is not restricted.
+
+// Capabilities a plugin may declare
+const (
+	CapNetwork     = "network"
+	CapExec        = "exec"
+	CapDBRead      = "db:read"
+	CapDBWrite     = "db:write"
+	CapCredentials = "credentials"
+	CapWASI        = "wasi" // WASM plugins only
+)
+
+// knownCapabilities are the capabilities any manifest may name
+var knownCapabilities = map[string]bool{
+	CapNetwork: true, CapExec: true, CapDBRead: true, CapDBWrite: true, CapCredentials: true, CapWASI: true,
+}
+
+// ErrCapabilityDenied refuses access a plugin didn't declare
+var ErrCapabilityDenied = errors.New("capability not granted")
+
+// CapabilityDeclarer is implemented by plugins that need capabilities; a
+// plugin without it is granted none
+type CapabilityDeclarer interface {
+	Capabilities() []string
+}
+
+// declaredCapabilities returns p's capabilities, sorted, refusing any the
+// registry doesn't know
+func declaredCapabilities(p Plugin) ([]string, error) {
+	cd, ok := p.(CapabilityDeclarer)
+	if !ok {
+		return []string{}, nil
+	}
+	seen := map[string]bool{}
+	caps := []string{}
+	for _, c := range cd.Capabilities() {
+		if !knownCapabilities[c] {
+			return nil, fmt.Errorf("unknown capability %q", c)
+		}
+		if !seen[c] {
+			seen[c] = true
+			caps = append(caps, c)
+		}
+	}
+	sort.Strings(caps)
+	return caps, nil
+}
+
+func hasCapability(p Plugin, capability string) bool {
+	caps, _ := declaredCapabilities(p)
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the capabilities granted to each registered plugin
+func (pr *PluginRegistry) Capabilities() map[string][]string {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	out := make(map[string][]string, len(pr.granted))
+	for name, caps := range pr.granted {
+		out[name] = caps
+	}
+	return out
+}
+
+// grant is the capability set a plugin call runs with
+type grant struct {
+	plugin string
+	caps   map[string]bool
+}
+
+type grantKey struct{}
+
+// withGrant marks ctx as a call into plugin, limited to its capabilities
+func (pr *PluginRegistry) withGrant(ctx context.Context, plugin string) context.Context {
+	pr.mu.RLock()
+	caps := pr.granted[plugin]
+	pr.mu.RUnlock()
+	g := &grant{plugin: plugin, caps: map[string]bool{}}
+	for _, c := range caps {
+		g.caps[c] = true
+	}
+	return context.WithValue(ctx, grantKey{}, g)
+}
+
+// requireCapability refuses capability unless ctx is outside any plugin call
+// or the plugin it belongs to declared it
+func requireCapability(ctx context.Context, capability string) error {
+	g, ok := ctx.Value(grantKey{}).(*grant)
+	if !ok || g.caps[capability] {
+		return nil
+	}
+	slog.WarnContext(ctx, "plugin refused a capability", "plugin", g.plugin, "capability", capability)
+	return fmt.Errorf("%w: plugin %s does not declare %q", ErrCapabilityDenied, g.plugin, capability)
+}
+
+// pluginCommand is exec.CommandContext for plugins; without the exec
+// capability the command fails to start
+func pluginCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if err := requireCapability(ctx, CapExec); err != nil {
+		cmd.Err = err
+	}
+	return cmd
+}
+
+// deniedTransport fails every request with the capability error
+type deniedTransport struct{ err error }
+
+func (t deniedTransport) RoundTrip(*http.Request) (*http.Response, error) { return nil, t.err }
+
+// pluginHTTP is the HTTP client for plugins; without the network
+// capability every request fails
+func pluginHTTP(ctx context.Context) *http.Client {
+	if err := requireCapability(ctx, CapNetwork); err != nil {
+		return &http.Client{Transport: deniedTransport{err}}
+	}
+	return http.DefaultClient
+}
+
+// PluginDB is the database as a plugin call sees it: reads need db:read and
+// writes db:write
+type PluginDB struct {
+	ctx context.Context
+}
+
+// pluginDB returns the database for the plugin call in ctx
+func pluginDB(ctx context.Context) *PluginDB {
+	return &PluginDB{ctx: ctx}
+}
+
+// pluginRow is sql.Row for PluginDB, carrying a refusal to Scan
+type pluginRow struct {
+	row *sql.Row
+	err error
+}
+
+func (r *pluginRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Scan(dest...)
+}
+
+func (d *PluginDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	if err := requireCapability(d.ctx, CapDBRead); err != nil {
+		return nil, err
+	}
+	return db.Query(query, args...)
+}
+
+func (d *PluginDB) QueryRow(query string, args ...interface{}) *pluginRow {
+	if err := requireCapability(d.ctx, CapDBRead); err != nil {
+		return &pluginRow{err: err}
+	}
+	return &pluginRow{row: db.QueryRow(query, args...)}
+}
+
+func (d *PluginDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if err := requireCapability(d.ctx, CapDBWrite); err != nil {
+		return nil, err
+	}
+	return db.Exec(query, args...)
+}
@@ -0,0 +1,92 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// probePlugin reaches outside through the guarded helpers on request
+type probePlugin struct {
+	name string
+	caps []string
+}
+
+func (p *probePlugin) Name() string                                   { return p.name }
+func (p *probePlugin) Version() string                                { return "0.0.1" }
+func (p *probePlugin) Capabilities() []string                         { return p.caps }
+func (p *probePlugin) Initialize(config map[string]interface{}) error { return nil }
+func (p *probePlugin) Validate() error                                { return nil }
+func (p *probePlugin) Shutdown() error                                { return nil }
+func (p *probePlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	switch action {
+	case "read":
+		var n int
+		return n, pluginDB(ctx).QueryRow(`SELECT COUNT(*) FROM plugins_registry`).Scan(&n)
+	case "write":
+		_, err := pluginDB(ctx).Exec(`DELETE FROM plugins_registry WHERE slug = 'nothing'`)
+		return nil, err
+	case "exec":
+		return nil, pluginCommand(ctx, "true").Run()
+	case "network":
+		// nothing listens on port 1, so a granted call fails to connect
+		_, err := pluginHTTP(ctx).Get("http://127.0.0.1:1/")
+		return nil, err
+	}
+	return nil, nil
+}
+
+func TestPluginCapabilities(t *testing.T) {
+	SetDB(setupPluginsDB(t))
+	shader := &probePlugin{name: "t-sandboxed"}
+	reader := &probePlugin{name: "t-reader", caps: []string{CapDBRead, CapNetwork, CapDBRead}}
+	for _, p := range []*probePlugin{shader, reader} {
+		if err := GetRegistry().Register(p); err != nil {
+			t.Fatal(err)
+		}
+		defer GetRegistry().Unregister(p.name)
+	}
+	if err := GetRegistry().Register(&probePlugin{name: "t-greedy", caps: []string{"root"}}); err == nil {
+		t.Fatal("an unknown capability should be refused")
+	}
+
+	ctx := context.Background()
+	for _, action := range []string{"read", "write", "exec", "network"} {
+		if _, err := GetRegistry().Execute(ctx, "t-sandboxed", action, nil); !errors.Is(err, ErrCapabilityDenied) {
+			t.Fatalf("%s without the capability: %v", action, err)
+		}
+	}
+	if _, err := GetRegistry().Execute(ctx, "t-reader", "read", nil); err != nil {
+		t.Fatalf("db:read was declared: %v", err)
+	}
+	if _, err := GetRegistry().Execute(ctx, "t-reader", "write", nil); !errors.Is(err, ErrCapabilityDenied) {
+		t.Fatalf("db:read shouldn't allow writes: %v", err)
+	}
+	if _, err := GetRegistry().Execute(ctx, "t-reader", "network", nil); err == nil || errors.Is(err, ErrCapabilityDenied) {
+		t.Fatalf("network was declared, so only the connection should fail: %v", err)
+	}
+	_, err := GetRegistry().Execute(ctx, "t-reader", "exec", nil)
+	if status := limitStatus(err); status != 403 {
+		t.Fatalf("a refused capability should answer 403, got %d", status)
+	}
+
+	// calls outside the registry aren't plugin calls
+	if _, err := shader.Execute(ctx, "read", nil); err != nil {
+		t.Fatalf("direct calls are unrestricted: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	HandlePluginsList(rr, httptest.NewRequest("GET", "/api/plugins", nil))
+	var resp struct {
+		Capabilities map[string][]string `json:"capabilities"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if got := resp.Capabilities["t-reader"]; len(got) != 2 || got[0] != CapDBRead || got[1] != CapNetwork {
+		t.Fatalf("expected the granted capabilities listed: %v", resp.Capabilities)
+	}
+	if got, ok := resp.Capabilities["t-sandboxed"]; !ok || len(got) != 0 {
+		t.Fatalf("a plugin declaring nothing should be listed with none: %v", resp.Capabilities)
+	}
+}
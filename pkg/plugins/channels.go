@@ -0,0 +1,187 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// === Publishing Channel Schemas ===
+
+// ChannelField describes one key of a publishing channel's config
+type ChannelField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // string, number or bool
+	Required    bool   `json:"required"`
+	Description string `json:"description,omitempty"`
+}
+
+// channelSchemas lists the config keys each channel type's publisher reads
+var channelSchemas = map[string][]ChannelField{
+	"git": {
+		{Name: "repo_url", Type: "string", Description: "remote to push to; defaults to the git plugin's repo"},
+		{Name: "branch", Type: "string", Description: "branch to push, default main"},
+	},
+	"ipfs": {
+		{Name: "api_url", Type: "string", Description: "IPFS API endpoint, default http://localhost:5001"},
+		{Name: "pin", Type: "bool", Description: "pin published content"},
+	},
+	"rss": {
+		{Name: "site_id", Type: "string", Required: true, Description: "site whose feed is updated"},
+		{Name: "format", Type: "string", Description: "rss or atom"},
+		{Name: "limit", Type: "number", Description: "maximum items in the feed"},
+	},
+	"static": {
+		{Name: "output_dir", Type: "string", Description: "directory the site is built into; publishing rewrites only the files a node affects"},
+		{Name: "site_id", Type: "string", Description: "site to build; nodes of this site rebuild it when published"},
+		{Name: "theme", Type: "string", Description: "theme directory, default the built-in theme"},
+		{Name: "base_url", Type: "string", Description: "where the site is served, for sitemap.xml"},
+	},
+	"sftp": append([]ChannelField{
+		{Name: "host", Type: "string", Required: true},
+		{Name: "port", Type: "number", Description: "default 22"},
+		{Name: "user", Type: "string", Required: true},
+		{Name: "remote_dir", Type: "string", Required: true, Description: "directory uploads are placed in"},
+		{Name: "identity_file", Type: "string", Description: "private key passed to sftp -i"},
+		{Name: "site_id", Type: "string", Description: "deploy this whole site instead of the published node's page"},
+	}, deployFields...),
+	"s3": append([]ChannelField{
+		{Name: "endpoint", Type: "string", Required: true, Description: "e.g. https://s3.us-east-1.amazonaws.com"},
+		{Name: "bucket", Type: "string", Required: true},
+		{Name: "region", Type: "string", Description: "default us-east-1"},
+		{Name: "prefix", Type: "string", Description: "key prefix the site is placed under"},
+		{Name: "path_style", Type: "bool", Description: "address the bucket as <endpoint>/<bucket>, as MinIO needs"},
+		{Name: "site_id", Type: "string", Required: true, Description: "site to deploy"},
+	}, deployFields...),
+	"rsync": append([]ChannelField{
+		{Name: "host", Type: "string", Required: true},
+		{Name: "port", Type: "number", Description: "SSH port, default 22"},
+		{Name: "user", Type: "string", Required: true},
+		{Name: "remote_dir", Type: "string", Required: true, Description: "directory the site is deployed to"},
+		{Name: "identity_file", Type: "string", Description: "private key passed to ssh -i"},
+		{Name: "site_id", Type: "string", Required: true, Description: "site to deploy"},
+	}, deployFields...),
+}
+
+// deployFields are the config keys every site deploy channel shares
+var deployFields = []ChannelField{
+	{Name: "theme", Type: "string", Description: "theme directory, default the built-in theme"},
+	{Name: "base_url", Type: "string", Description: "where the site is served, for sitemap.xml"},
+	{Name: "build_dir", Type: "string", Description: "directory under builds/ the site is built in before upload, default builds/<channel_id>"},
+}
+
+// ChannelSchemas returns the config schema of every channel type
+func ChannelSchemas() map[string][]ChannelField {
+	return channelSchemas
+}
+
+// ValidateChannelConfig checks config against channelType's schema: the type
+// must be known, required keys present, values of the declared type and no
+// unknown keys set.
+func ValidateChannelConfig(channelType string, config map[string]interface{}) error {
+	fields, ok := channelSchemas[channelType]
+	if !ok {
+		types := make([]string, 0, len(channelSchemas))
+		for t := range channelSchemas {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return fmt.Errorf("unknown channel type %q (expected one of %s)", channelType, strings.Join(types, ", "))
+	}
+	known := map[string]bool{}
+	for _, f := range fields {
+		known[f.Name] = true
+		v, set := config[f.Name]
+		if !set || v == nil {
+			if f.Required {
+				return fmt.Errorf("%s channel config requires %q", channelType, f.Name)
+			}
+			continue
+		}
+		valid := false
+		switch f.Type {
+		case "string":
+			s, ok := v.(string)
+			valid = ok && (!f.Required || s != "")
+		case "number":
+			_, valid = v.(float64)
+		case "bool":
+			_, valid = v.(bool)
+		}
+		if !valid {
+			return fmt.Errorf("%s channel config %q must be a %s", channelType, f.Name, f.Type)
+		}
+	}
+	for k := range config {
+		if !known[k] {
+			return fmt.Errorf("%s channel config has unknown key %q", channelType, k)
+		}
+	}
+	if channelType == "sftp" || channelType == "rsync" {
+		if _, err := sshDestination(config); err != nil {
+			return fmt.Errorf("%s %v", channelType, err)
+		}
+	}
+	if _, err := deployBuildDir("", config); err != nil {
+		return fmt.Errorf("%s channel config: %v", channelType, err)
+	}
+	return nil
+}
+
+// publishViaSFTP uploads the node's static HTML to the channel's remote_dir
+// using the sftp client in batch mode
+func publishViaSFTP(ctx context.Context, job PublishJob, config map[string]interface{}) (interface{}, error) {
+	if err := ValidateChannelConfig("sftp", config); err != nil {
+		return nil, err
+	}
+	exported, err := handleExportForJob(job.NodeID, "html")
+	if err != nil {
+		return nil, err
+	}
+	html := exported.(map[string]string)["html"]
+
+	tmp, err := os.MkdirTemp("", "veil-sftp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	local := filepath.Join(tmp, job.NodeID+".html")
+	if err := os.WriteFile(local, []byte(html), 0644); err != nil {
+		return nil, err
+	}
+
+	remoteDir, ok := config["remote_dir"].(string)
+	if !ok {
+		return nil, fmt.Errorf("sftp channel config requires %q", "remote_dir")
+	}
+	batch, err := sftpBatch(tmp, strings.TrimSuffix(remoteDir, "/"), []string{job.NodeID + ".html"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-b", "-"}
+	if port, ok := config["port"].(float64); ok {
+		args = append(args, "-P", fmt.Sprintf("%.0f", port))
+	}
+	if key, ok := config["identity_file"].(string); ok && key != "" {
+		args = append(args, "-i", key)
+	}
+	host, err := sshDestination(config)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--", host)
+
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = strings.NewReader(batch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("sftp upload failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return map[string]string{
+		"status": "uploaded",
+		"path":   strings.TrimSuffix(remoteDir, "/") + "/" + job.NodeID + ".html",
+	}, nil
+}
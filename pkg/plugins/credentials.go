@@ -0,0 +1,501 @@
+package plugins
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Credential Storage ===
+// Once unlocked with the master passphrase, the credential manager keeps
+// secrets in the credentials table, each sealed with AES-256-GCM under a key
+// derived from the passphrase with PBKDF2-SHA256. The secret's name is the
+// additional data, so a sealed value cannot be moved to another name. While
+// locked (no passphrase is configured) secrets live in memory and are lost on
+// restart.
+//
+// A credential may be bound to a plugin, and then only that plugin can read
+// it, through the PluginContext it is given when registered. Unbound
+// credentials belong to the core (publish channels). Every read, allowed or
+// not, is recorded in credential_access_log.
+
+// credentialCheck is sealed under each key to recognise its passphrase
+const credentialCheck = "veil-credentials"
+
+// credentialKDFIterations is the PBKDF2 work factor for new keys
+var credentialKDFIterations = 600000
+
+// ErrCredentialNotFound is returned for a credential that is not stored
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// ErrCredentialScope is returned for a credential bound to another plugin
+var ErrCredentialScope = errors.New("credential belongs to another plugin")
+
+// lockedCredential is a credential held in memory while the store is locked
+type lockedCredential struct {
+	plugin string
+	value  []byte
+}
+
+// CredentialManager handles encrypted storage of API keys
+type CredentialManager struct {
+	credentials map[string]lockedCredential // used while locked
+	mu          sync.RWMutex
+	aead        cipher.AEAD
+	keyID       string
+}
+
+var credentialMgr *CredentialManager
+
+func initCredentialManager() {
+	credentialMgr = &CredentialManager{
+		credentials: make(map[string]lockedCredential),
+	}
+}
+
+// GetCredentialManager returns the global credential manager
+func GetCredentialManager() *CredentialManager {
+	if credentialMgr == nil {
+		initCredentialManager()
+	}
+	return credentialMgr
+}
+
+// CredentialPassphrase returns the master passphrase: VEIL_MASTER_PASSPHRASE,
+// else the OS keyring's entry for service "veil", account "master" (macOS
+// Keychain, or the Secret Service via secret-tool on Linux), else ""
+func CredentialPassphrase() string {
+	if p := os.Getenv("VEIL_MASTER_PASSPHRASE"); p != "" {
+		return p
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", "veil", "-a", "master", "-w")
+	case "linux":
+		cmd = exec.Command("secret-tool", "lookup", "service", "veil", "account", "master")
+	default:
+		return ""
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// deriveCredentialKey turns a passphrase and salt into an AES-256-GCM cipher
+func deriveCredentialKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// credentialAAD is the additional data a credential is sealed with: its name,
+// prefixed by the plugin it is bound to
+func credentialAAD(plugin, key string) string {
+	if plugin == "" {
+		return key
+	}
+	return plugin + ":" + key
+}
+
+// seal encrypts value under aead as nonce || ciphertext, bound to name
+func seal(aead cipher.AEAD, name string, value []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, []byte(name)), nil
+}
+
+func unseal(aead cipher.AEAD, name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("credential %s is corrupt", name)
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+}
+
+// newCredentialKey derives a key from passphrase with a fresh salt
+func newCredentialKey(passphrase string) (id string, salt, check []byte, aead cipher.AEAD, err error) {
+	salt = make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+	if aead, err = deriveCredentialKey(passphrase, salt, credentialKDFIterations); err != nil {
+		return
+	}
+	id = ids.New("ckey")
+	check, err = seal(aead, id, []byte(credentialCheck))
+	return
+}
+
+// UnlockCredentials opens the vault's credential store with passphrase,
+// creating its key on first use. Credentials stored in memory before are
+// moved into the store. A passphrase that does not match the store's key is
+// an error, and the manager stays locked.
+func UnlockCredentials(passphrase string) error {
+	cm := GetCredentialManager()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.aead, cm.keyID = nil, ""
+	if db == nil {
+		return fmt.Errorf("plugins DB not configured")
+	}
+
+	var id string
+	var salt, check []byte
+	var iterations int
+	err := db.QueryRow(`SELECT id, salt, iterations, check_value FROM credential_keys WHERE active = 1`).
+		Scan(&id, &salt, &iterations, &check)
+	var aead cipher.AEAD
+	switch {
+	case err == sql.ErrNoRows:
+		if id, salt, check, aead, err = newCredentialKey(passphrase); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`INSERT INTO credential_keys (id, salt, iterations, check_value, active, created_at) VALUES (?, ?, ?, ?, 1, ?)`,
+			id, salt, credentialKDFIterations, check, time.Now().Unix()); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if aead, err = deriveCredentialKey(passphrase, salt, iterations); err != nil {
+			return err
+		}
+		if got, err := unseal(aead, id, check); err != nil || string(got) != credentialCheck {
+			return fmt.Errorf("wrong master passphrase for the credential store")
+		}
+	}
+	cm.aead, cm.keyID = aead, id
+
+	for name, c := range cm.credentials {
+		if err := cm.put(c.plugin, name, c.value); err != nil {
+			return err
+		}
+		delete(cm.credentials, name)
+	}
+	return nil
+}
+
+// Unlocked reports whether credentials are stored encrypted in the vault
+func (cm *CredentialManager) Unlocked() bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.aead != nil
+}
+
+// put seals and saves a credential bound to plugin; the caller holds cm.mu
+func (cm *CredentialManager) put(plugin, key string, value []byte) error {
+	sealed, err := seal(cm.aead, credentialAAD(plugin, key), value)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = db.Exec(`INSERT INTO credentials (key, plugin, key_id, value, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET plugin = excluded.plugin, key_id = excluded.key_id, value = excluded.value, updated_at = excluded.updated_at`,
+		key, plugin, cm.keyID, sealed, now, now)
+	return err
+}
+
+// owner returns the plugin key is bound to; the caller holds cm.mu
+func (cm *CredentialManager) owner(key string) (plugin string, exists bool) {
+	if cm.aead == nil {
+		c, ok := cm.credentials[key]
+		return c.plugin, ok
+	}
+	err := db.QueryRow(`SELECT plugin FROM credentials WHERE key = ?`, key).Scan(&plugin)
+	return plugin, err == nil
+}
+
+// StoreCredential saves a core credential, replacing any credential of the
+// same name and its binding
+func (cm *CredentialManager) StoreCredential(key string, value string) error {
+	return cm.StorePluginCredential("", key, value)
+}
+
+// StorePluginCredential saves a credential only plugin may read, replacing
+// any credential of the same name and its binding
+func (cm *CredentialManager) StorePluginCredential(plugin, key, value string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.store(plugin, key, value)
+}
+
+// store saves a credential; the caller holds cm.mu
+func (cm *CredentialManager) store(plugin, key, value string) error {
+	if cm.aead == nil {
+		cm.credentials[key] = lockedCredential{plugin: plugin, value: []byte(value)}
+		return nil
+	}
+	return cm.put(plugin, key, []byte(value))
+}
+
+// GetCredential reads a core credential
+func (cm *CredentialManager) GetCredential(key string) (string, error) {
+	return cm.get("", key)
+}
+
+// get reads key on behalf of plugin ("" for the core) and records the access
+func (cm *CredentialManager) get(plugin, key string) (string, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	value, err := cm.read(plugin, key)
+	logCredentialAccess(plugin, key, err == nil)
+	return value, err
+}
+
+// read returns key if plugin may read it; the caller holds cm.mu
+func (cm *CredentialManager) read(plugin, key string) (string, error) {
+	if cm.aead == nil {
+		c, exists := cm.credentials[key]
+		if !exists {
+			return "", fmt.Errorf("%w: %s", ErrCredentialNotFound, key)
+		}
+		if c.plugin != plugin {
+			return "", fmt.Errorf("%w: %s", ErrCredentialScope, key)
+		}
+		return string(c.value), nil
+	}
+	var owner, keyID string
+	var sealed []byte
+	if err := db.QueryRow(`SELECT plugin, key_id, value FROM credentials WHERE key = ?`, key).Scan(&owner, &keyID, &sealed); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("%w: %s", ErrCredentialNotFound, key)
+		}
+		return "", err
+	}
+	if owner != plugin {
+		return "", fmt.Errorf("%w: %s", ErrCredentialScope, key)
+	}
+	if keyID != cm.keyID {
+		return "", fmt.Errorf("credential %s is sealed under key %s, not the active %s", key, keyID, cm.keyID)
+	}
+	value, err := unseal(cm.aead, credentialAAD(owner, key), sealed)
+	if err != nil {
+		return "", fmt.Errorf("credential %s could not be decrypted", key)
+	}
+	return string(value), nil
+}
+
+// logCredentialAccess records a read of key by plugin ("" for the core)
+func logCredentialAccess(plugin, key string, granted bool) {
+	if db == nil {
+		return
+	}
+	g := 0
+	if granted {
+		g = 1
+	}
+	if _, err := db.Exec(`INSERT INTO credential_access_log (plugin, key, granted, accessed_at) VALUES (?, ?, ?, ?)`,
+		plugin, key, g, time.Now().Unix()); err != nil {
+		log.Printf("Failed to log credential access to %s: %v", key, err)
+	}
+}
+
+// CredentialAccess is one entry of the credential access log
+type CredentialAccess struct {
+	ID         int64  `json:"id"`
+	Plugin     string `json:"plugin"`
+	Key        string `json:"key"`
+	Granted    bool   `json:"granted"`
+	AccessedAt int64  `json:"accessed_at"`
+}
+
+// CredentialAccessLog returns the latest accesses, newest first, optionally
+// only those by plugin
+func CredentialAccessLog(plugin string, limit int) ([]CredentialAccess, error) {
+	if db == nil {
+		return nil, fmt.Errorf("plugins DB not configured")
+	}
+	query := `SELECT id, plugin, key, granted, accessed_at FROM credential_access_log`
+	var args []interface{}
+	if plugin != "" {
+		query += ` WHERE plugin = ?`
+		args = append(args, plugin)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []CredentialAccess{}
+	for rows.Next() {
+		var e CredentialAccess
+		if err := rows.Scan(&e.ID, &e.Plugin, &e.Key, &e.Granted, &e.AccessedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// === Plugin Context ===
+
+// PluginContext is a plugin's handle on the credential store: it reads and
+// writes only credentials bound to the plugin. The registry hands one to
+// each ContextAware plugin that declares the credentials capability.
+type PluginContext struct {
+	plugin string
+}
+
+// ContextAware is implemented by plugins that need their PluginContext
+type ContextAware interface {
+	AttachContext(*PluginContext)
+}
+
+// attachContext gives p its PluginContext if it wants one and may have it
+func attachContext(p Plugin) {
+	if ca, ok := p.(ContextAware); ok && hasCapability(p, CapCredentials) {
+		ca.AttachContext(&PluginContext{plugin: p.Name()})
+	}
+}
+
+// Plugin returns the slug the context is scoped to
+func (pc *PluginContext) Plugin() string {
+	return pc.plugin
+}
+
+// Credential reads a credential bound to the plugin
+func (pc *PluginContext) Credential(key string) (string, error) {
+	return GetCredentialManager().get(pc.plugin, key)
+}
+
+// StoreCredential saves a credential bound to the plugin. A name already
+// bound to another plugin or the core is refused.
+func (pc *PluginContext) StoreCredential(key, value string) error {
+	cm := GetCredentialManager()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if owner, exists := cm.owner(key); exists && owner != pc.plugin {
+		return fmt.Errorf("%w: %s", ErrCredentialScope, key)
+	}
+	return cm.store(pc.plugin, key, value)
+}
+
+func (cm *CredentialManager) DeleteCredential(key string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if cm.aead == nil {
+		if _, exists := cm.credentials[key]; !exists {
+			return fmt.Errorf("%w: %s", ErrCredentialNotFound, key)
+		}
+		delete(cm.credentials, key)
+		return nil
+	}
+	res, err := db.Exec(`DELETE FROM credentials WHERE key = ?`, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: %s", ErrCredentialNotFound, key)
+	}
+	return nil
+}
+
+// RotateCredentialKey re-encrypts every credential under a new key derived
+// from passphrase with a fresh salt, in one transaction, and retires the old
+// key. passphrase may be the current one, to change only the key. It returns
+// how many credentials were re-encrypted.
+func RotateCredentialKey(passphrase string) (int, error) {
+	cm := GetCredentialManager()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if cm.aead == nil {
+		return 0, fmt.Errorf("the credential store is locked: set VEIL_MASTER_PASSPHRASE or a keyring entry")
+	}
+	if passphrase == "" {
+		return 0, fmt.Errorf("passphrase is required")
+	}
+
+	type row struct {
+		key    string
+		plugin string
+		value  []byte
+	}
+	rows, err := db.Query(`SELECT key, plugin, key_id, value FROM credentials`)
+	if err != nil {
+		return 0, err
+	}
+	var creds []row
+	for rows.Next() {
+		var r row
+		var keyID string
+		var sealed []byte
+		if err := rows.Scan(&r.key, &r.plugin, &keyID, &sealed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if keyID != cm.keyID {
+			rows.Close()
+			return 0, fmt.Errorf("credential %s is sealed under key %s, not the active %s", r.key, keyID, cm.keyID)
+		}
+		if r.value, err = unseal(cm.aead, credentialAAD(r.plugin, r.key), sealed); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("credential %s could not be decrypted", r.key)
+		}
+		creds = append(creds, r)
+	}
+	rows.Close()
+
+	id, salt, check, aead, err := newCredentialKey(passphrase)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO credential_keys (id, salt, iterations, check_value, active, created_at) VALUES (?, ?, ?, ?, 0, ?)`,
+		id, salt, credentialKDFIterations, check, time.Now().Unix()); err != nil {
+		return 0, err
+	}
+	for _, c := range creds {
+		sealed, err := seal(aead, credentialAAD(c.plugin, c.key), c.value)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE credentials SET key_id = ?, value = ?, updated_at = ? WHERE key = ?`,
+			id, sealed, time.Now().Unix(), c.key); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM credential_keys WHERE id <> ?`, id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE credential_keys SET active = 1 WHERE id = ?`, id); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	cm.aead, cm.keyID = aead, id
+	return len(creds), nil
+}
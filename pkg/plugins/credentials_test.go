@@ -0,0 +1,193 @@
+package plugins
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// credentialTestDB applies the credential migrations to d and hands it to
+// the package
+func credentialTestDB(t *testing.T, d *sql.DB) {
+	for _, name := range []string{"015_credentials.sql", "016_credential_scopes.sql"} {
+		schema, err := ioutil.ReadFile("../../migrations/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range strings.Split(string(schema), ";") {
+			if _, err := d.Exec(stmt); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	}
+	SetDB(d)
+}
+
+func TestCredentialStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugins-credentials-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	d, err := sql.Open("sqlite", filepath.Join(tmp, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	credentialTestDB(t, d)
+	defer func(n int) { credentialKDFIterations = n }(credentialKDFIterations)
+	credentialKDFIterations = 1000
+	defer initCredentialManager()
+
+	// stored while locked, then moved into the vault on unlock
+	initCredentialManager()
+	cm := GetCredentialManager()
+	cm.StoreCredential("api_token", "s3cret-value")
+	if err := UnlockCredentials("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	var sealed []byte
+	if err := d.QueryRow(`SELECT value FROM credentials WHERE key = 'api_token'`).Scan(&sealed); err != nil {
+		t.Fatalf("credential should be persisted: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("s3cret-value")) {
+		t.Fatalf("credential stored in plain text")
+	}
+
+	// a restart needs the same passphrase
+	restart := func(passphrase string) error {
+		initCredentialManager()
+		return UnlockCredentials(passphrase)
+	}
+	if err := restart("wrong"); err == nil || GetCredentialManager().Unlocked() {
+		t.Fatalf("a wrong passphrase should leave the store locked")
+	}
+	if err := restart("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := GetCredentialManager().GetCredential("api_token"); err != nil || v != "s3cret-value" {
+		t.Fatalf("expected the stored value, got %q, %v", v, err)
+	}
+
+	// sealed values are bound to their name
+	GetCredentialManager().StoreCredential("other", "x")
+	d.Exec(`UPDATE credentials SET value = ? WHERE key = 'other'`, sealed)
+	if _, err := GetCredentialManager().GetCredential("other"); err == nil {
+		t.Fatalf("a value moved to another name should not decrypt")
+	}
+	d.Exec(`DELETE FROM credentials WHERE key = 'other'`)
+
+	rr := httptest.NewRecorder()
+	HandleCredentialsAPI(rr, httptest.NewRequest("POST", "/api/credentials/rotate", strings.NewReader(`{"passphrase": "battery staple"}`)))
+	if rr.Code != 200 || !strings.Contains(rr.Body.String(), `"rotated":1`) {
+		t.Fatalf("rotate: %d %s", rr.Code, rr.Body.String())
+	}
+	if v, _ := GetCredentialManager().GetCredential("api_token"); v != "s3cret-value" {
+		t.Fatalf("credentials should survive rotation, got %q", v)
+	}
+	var keys int
+	d.QueryRow(`SELECT COUNT(*) FROM credential_keys`).Scan(&keys)
+	if keys != 1 {
+		t.Fatalf("the old key should be retired, %d keys left", keys)
+	}
+	if err := restart("correct horse"); err == nil {
+		t.Fatalf("the old passphrase should no longer unlock the store")
+	}
+	if err := restart("battery staple"); err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	HandleCredentialsAPI(rr, httptest.NewRequest("DELETE", "/api/credentials/api_token", nil))
+	if rr.Code != 204 {
+		t.Fatalf("delete: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	HandleCredentialsAPI(rr, httptest.NewRequest("DELETE", "/api/credentials/api_token", nil))
+	if rr.Code != 404 {
+		t.Fatalf("deleting a missing credential: %d", rr.Code)
+	}
+}
+
+func TestPluginCredentialScopes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugins-credential-scopes-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	d, err := sql.Open("sqlite", filepath.Join(tmp, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	credentialTestDB(t, d)
+	defer func(n int) { credentialKDFIterations = n }(credentialKDFIterations)
+	credentialKDFIterations = 1000
+	defer initCredentialManager()
+	initCredentialManager()
+
+	git := &PluginContext{plugin: "git"}
+	other := &PluginContext{plugin: "namecheap"}
+	// bound while locked, kept through the unlock
+	if err := git.StoreCredential("github_token", "ghp_secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnlockCredentials("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := git.Credential("github_token"); err != nil || v != "ghp_secret" {
+		t.Fatalf("the owner should read its credential, got %q, %v", v, err)
+	}
+	if _, err := other.Credential("github_token"); !errors.Is(err, ErrCredentialScope) {
+		t.Fatalf("another plugin should be refused, got %v", err)
+	}
+	if _, err := GetCredentialManager().GetCredential("github_token"); !errors.Is(err, ErrCredentialScope) {
+		t.Fatalf("core reads should be refused too, got %v", err)
+	}
+	if err := other.StoreCredential("github_token", "stolen"); !errors.Is(err, ErrCredentialScope) {
+		t.Fatalf("another plugin should not take the name over, got %v", err)
+	}
+
+	// rebinding in the database does not make the value readable
+	d.Exec(`UPDATE credentials SET plugin = 'namecheap' WHERE key = 'github_token'`)
+	if _, err := other.Credential("github_token"); err == nil {
+		t.Fatalf("a rebound value should not decrypt")
+	}
+	d.Exec(`UPDATE credentials SET plugin = 'git' WHERE key = 'github_token'`)
+
+	// the API binds credentials, and rotation keeps the binding
+	rr := httptest.NewRecorder()
+	HandleCredentialsAPI(rr, httptest.NewRequest("POST", "/api/credentials", strings.NewReader(`{"key": "namecheap_api_key", "value": "nc", "plugin": "namecheap"}`)))
+	if rr.Code != 201 {
+		t.Fatalf("store: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := RotateCredentialKey("battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := other.Credential("namecheap_api_key"); err != nil || v != "nc" {
+		t.Fatalf("expected the bound value after rotation, got %q, %v", v, err)
+	}
+
+	rr = httptest.NewRecorder()
+	HandleCredentialsAPI(rr, httptest.NewRequest("GET", "/api/credentials/audit?plugin=namecheap", nil))
+	var entries []CredentialAccess
+	json.Unmarshal(rr.Body.Bytes(), &entries)
+	if rr.Code != 200 || len(entries) != 3 {
+		t.Fatalf("audit: %d %s", rr.Code, rr.Body.String())
+	}
+	if e := entries[len(entries)-1]; e.Key != "github_token" || e.Granted || e.AccessedAt == 0 {
+		t.Fatalf("the refused read should be logged: %+v", e)
+	}
+	if e := entries[0]; e.Key != "namecheap_api_key" || !e.Granted {
+		t.Fatalf("the latest read should come first: %+v", e)
+	}
+}
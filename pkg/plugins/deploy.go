@@ -0,0 +1,376 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	s3storage "veil/pkg/codex/storage/s3"
+)
+
+// === Site Deploys ===
+// The s3 and rsync channels, and sftp channels with a site_id, deploy a whole
+// site: the site is built into the channel's build_dir with BuildStaticSite,
+// then files whose content differs from what the channel last pushed are
+// uploaded and files the site no longer has are removed. deployed_files
+// remembers what was pushed. Secrets come from the credential manager under
+// the channel's credentials prefix, "channel/<channel_id>" by default:
+// <prefix>/access_key_id and <prefix>/secret_access_key for S3, and an
+// optional <prefix>/private_key for SSH.
+
+// DeployReport says what a deploy transferred
+type DeployReport struct {
+	ChannelID string   `json:"channel_id"`
+	SiteID    string   `json:"site_id"`
+	Uploaded  []string `json:"uploaded"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// sitePusher transfers a built site's changes to a deploy target. Paths are
+// slash separated and relative to dir.
+type sitePusher interface {
+	push(ctx context.Context, dir string, changed, removed []string) error
+}
+
+// deploySite builds the channel's site and pushes the changes since the
+// channel's last deploy
+func deploySite(ctx context.Context, job PublishJob, channelType string, config map[string]interface{}) (interface{}, error) {
+	if err := ValidateChannelConfig(channelType, config); err != nil {
+		return nil, Permanent(err)
+	}
+	if BuildStaticSite == nil {
+		return nil, Permanent(fmt.Errorf("%s channel needs a static site builder", channelType))
+	}
+	dir, err := deployBuildDir(job.ChannelID, config)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	pusher, cleanup, err := newSitePusher(channelType, config, "channel/"+job.ChannelID)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	defer cleanup()
+
+	build := map[string]interface{}{"output_dir": dir}
+	for _, k := range []string{"site_id", "theme", "base_url"} {
+		if v, ok := config[k]; ok {
+			build[k] = v
+		}
+	}
+	if _, err := BuildStaticSite(ctx, job.NodeID, build); err != nil {
+		return nil, err
+	}
+
+	// what is on disk against what was pushed
+	local := map[string]string{}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		sum := sha256.Sum256(data)
+		local[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pushed := map[string]string{}
+	rows, err := db.Query(`SELECT path, hash FROM deployed_files WHERE channel_id = ?`, job.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p, hash string
+		if err := rows.Scan(&p, &hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pushed[p] = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &DeployReport{ChannelID: job.ChannelID, Uploaded: []string{}, Removed: []string{}}
+	report.SiteID, _ = config["site_id"].(string)
+	for p, hash := range local {
+		if pushed[p] == hash {
+			report.Unchanged++
+		} else {
+			report.Uploaded = append(report.Uploaded, p)
+		}
+	}
+	for p := range pushed {
+		if _, ok := local[p]; !ok {
+			report.Removed = append(report.Removed, p)
+		}
+	}
+	sort.Strings(report.Uploaded)
+	sort.Strings(report.Removed)
+	if len(report.Uploaded) == 0 && len(report.Removed) == 0 {
+		return report, nil
+	}
+	if err := pusher.push(ctx, dir, report.Uploaded, report.Removed); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, p := range report.Uploaded {
+		db.Exec(`INSERT INTO deployed_files (channel_id, path, hash, deployed_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(channel_id, path) DO UPDATE SET hash = excluded.hash, deployed_at = excluded.deployed_at`,
+			job.ChannelID, p, local[p], now)
+	}
+	for _, p := range report.Removed {
+		db.Exec(`DELETE FROM deployed_files WHERE channel_id = ? AND path = ?`, job.ChannelID, p)
+	}
+	return report, nil
+}
+
+// deployBuildDir is where a channel's site is built: its build_dir, which
+// must lie under builds/, or builds/<channel_id>
+func deployBuildDir(channelID string, config map[string]interface{}) (string, error) {
+	dir, _ := config["build_dir"].(string)
+	if dir == "" {
+		return filepath.Join("builds", channelID), nil
+	}
+	dir = filepath.Clean(filepath.FromSlash(dir))
+	if !filepath.IsLocal(dir) || !strings.HasPrefix(dir, "builds"+string(filepath.Separator)) {
+		return "", fmt.Errorf("build_dir must be a directory under builds/")
+	}
+	return dir, nil
+}
+
+// sshUserPattern and sshHostPattern are the user and host names a channel
+// may name. Both end up on the ssh, sftp or rsync command line, where a
+// leading '-' would be read as an option.
+var (
+	sshUserPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+	sshHostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+)
+
+// sshDestination is the user@host of an sftp or rsync channel
+func sshDestination(config map[string]interface{}) (string, error) {
+	user, _ := config["user"].(string)
+	host, _ := config["host"].(string)
+	if !sshUserPattern.MatchString(user) {
+		return "", fmt.Errorf("channel config %q must be a user name", "user")
+	}
+	if ip := net.ParseIP(host); ip != nil && strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	} else if !sshHostPattern.MatchString(host) {
+		return "", fmt.Errorf("channel config %q must be a host name or address", "host")
+	}
+	return user + "@" + host, nil
+}
+
+// newSitePusher sets up the target of a channel. cleanup removes any key
+// file written for SSH.
+func newSitePusher(channelType string, config map[string]interface{}, prefix string) (sitePusher, func(), error) {
+	cm := GetCredentialManager()
+	if channelType == "s3" {
+		accessKey, err := cm.GetCredential(prefix + "/access_key_id")
+		if err != nil {
+			return nil, nil, err
+		}
+		secretKey, err := cm.GetCredential(prefix + "/secret_access_key")
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg := s3storage.Config{AccessKey: accessKey, SecretKey: secretKey}
+		cfg.Endpoint, _ = config["endpoint"].(string)
+		cfg.Bucket, _ = config["bucket"].(string)
+		cfg.Region, _ = config["region"].(string)
+		cfg.Prefix, _ = config["prefix"].(string)
+		cfg.PathStyle, _ = config["path_style"].(bool)
+		store, err := s3storage.New(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s3Pusher{store}, func() {}, nil
+	}
+
+	remoteDir, ok := config["remote_dir"].(string)
+	if !ok || remoteDir == "" {
+		return nil, nil, fmt.Errorf("%s channel config requires %q", channelType, "remote_dir")
+	}
+	host, err := sshDestination(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := sshTarget{host: host, remoteDir: strings.TrimSuffix(remoteDir, "/")}
+	if port, ok := config["port"].(float64); ok {
+		target.port = fmt.Sprintf("%.0f", port)
+	}
+	target.identity, _ = config["identity_file"].(string)
+	cleanup := func() {}
+	if key, err := cm.GetCredential(prefix + "/private_key"); err == nil {
+		f, err := os.CreateTemp("", "veil-deploy-key-")
+		if err != nil {
+			return nil, nil, err
+		}
+		f.Chmod(0600)
+		f.WriteString(strings.TrimSpace(key) + "\n")
+		f.Close()
+		target.identity = f.Name()
+		cleanup = func() { os.Remove(f.Name()) }
+	}
+	if channelType == "rsync" {
+		return rsyncPusher{target}, cleanup, nil
+	}
+	return sftpPusher{target}, cleanup, nil
+}
+
+type s3Pusher struct{ store *s3storage.S3Storage }
+
+func (s s3Pusher) push(ctx context.Context, dir string, changed, removed []string) error {
+	for _, p := range changed {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		contentType := mime.TypeByExtension(path.Ext(p))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		if err := s.store.PutFile(p, data, contentType); err != nil {
+			return err
+		}
+	}
+	for _, p := range removed {
+		if err := s.store.DeleteFile(p); err != nil && !strings.Contains(err.Error(), "not found") {
+			return err
+		}
+	}
+	return nil
+}
+
+// sshTarget is a remote directory reached over SSH
+type sshTarget struct {
+	host      string // user@host
+	port      string
+	identity  string
+	remoteDir string
+}
+
+type sftpPusher struct{ sshTarget }
+
+func (s sftpPusher) push(ctx context.Context, dir string, changed, removed []string) error {
+	args := []string{"-b", "-"}
+	if s.port != "" {
+		args = append(args, "-P", s.port)
+	}
+	if s.identity != "" {
+		args = append(args, "-i", s.identity)
+	}
+	batch, err := sftpBatch(dir, s.remoteDir, changed, removed)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sftp", append(args, "--", s.host)...)
+	cmd.Stdin = strings.NewReader(batch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sftp deploy failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sftpBatch is the sftp batch script that uploads changed and removes
+// removed. Commands prefixed with '-' may fail, as a mkdir of a directory
+// that exists does.
+func sftpBatch(dir, remoteDir string, changed, removed []string) (string, error) {
+	var b strings.Builder
+	line := func(command string, paths ...string) error {
+		b.WriteString(command)
+		for _, p := range paths {
+			q, err := SFTPQuote(p)
+			if err != nil {
+				return err
+			}
+			b.WriteString(" " + q)
+		}
+		b.WriteString("\n")
+		return nil
+	}
+	made := map[string]bool{}
+	for _, p := range changed {
+		var parents []string
+		for d := path.Dir(p); d != "." && !made[d]; d = path.Dir(d) {
+			made[d] = true
+			parents = append(parents, d)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			if err := line("-mkdir", remoteDir+"/"+parents[i]); err != nil {
+				return "", err
+			}
+		}
+		if err := line("put", filepath.Join(dir, filepath.FromSlash(p)), remoteDir+"/"+p); err != nil {
+			return "", err
+		}
+	}
+	for _, p := range removed {
+		if err := line("-rm", remoteDir+"/"+p); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// SFTPQuote double-quotes p for an sftp batch line. Inside quotes sftp reads a
+// backslash or quote as an escape, and a line break would start another
+// command, so paths holding any of those are refused.
+func SFTPQuote(p string) (string, error) {
+	if strings.ContainsAny(p, `"\`) || strings.IndexFunc(p, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("sftp can't upload the path %q", p)
+	}
+	return `"` + p + `"`, nil
+}
+
+type rsyncPusher struct{ sshTarget }
+
+// push hands rsync the changed and removed files; --delete-missing-args
+// deletes the removed ones, which no longer exist locally, on the remote
+func (s rsyncPusher) push(ctx context.Context, dir string, changed, removed []string) error {
+	ssh := "ssh -o BatchMode=yes"
+	if s.port != "" {
+		ssh += " -p " + s.port
+	}
+	if s.identity != "" {
+		ssh += " -i " + rsyncQuote(s.identity)
+	}
+	cmd := exec.CommandContext(ctx, "rsync", "-tz", "--files-from=-", "--delete-missing-args", "-e", ssh, "--",
+		strings.TrimSuffix(dir, "/")+"/", fmt.Sprintf("%s:%s/", s.host, s.remoteDir))
+	cmd.Stdin = strings.NewReader(strings.Join(append(append([]string{}, changed...), removed...), "\n") + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rsync deploy failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// rsyncQuote single-quotes p as one argument of rsync's -e command, which
+// rsync splits at spaces itself. A quote inside is doubled.
+func rsyncQuote(p string) string {
+	return "'" + strings.ReplaceAll(p, "'", "''") + "'"
+}
@@ -0,0 +1,173 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestDeploySiteToS3(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugins-deploy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	d, err := sql.Open("sqlite", filepath.Join(tmp, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	d.Exec(`CREATE TABLE deployed_files (channel_id TEXT NOT NULL, path TEXT NOT NULL, hash TEXT NOT NULL, deployed_at INTEGER NOT NULL, PRIMARY KEY (channel_id, path))`)
+	SetDB(d)
+
+	// the site "builds" whatever files holds
+	files := map[string]string{"index.html": "home", "a.html": "A", "media/cat.png": "PNG"}
+	old := BuildStaticSite
+	defer func() { BuildStaticSite = old }()
+	BuildStaticSite = func(ctx context.Context, nodeID string, config map[string]interface{}) (interface{}, error) {
+		dir := config["output_dir"].(string)
+		os.RemoveAll(dir)
+		for name, content := range files {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+			ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+		return nil, nil
+	}
+
+	var mu sync.Mutex
+	var requests []string
+	types := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		types[r.URL.Path] = r.Header.Get("Content-Type")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	config := map[string]interface{}{"endpoint": srv.URL, "bucket": "www", "path_style": true, "prefix": "site",
+		"site_id": "s1", "build_dir": "builds/www"}
+	job := PublishJob{NodeID: "a", ChannelID: "ch1"}
+	for _, dir := range []string{filepath.Join(tmp, "build"), "../build", "builds", "media/x"} {
+		bad := map[string]interface{}{}
+		for k, v := range config {
+			bad[k] = v
+		}
+		bad["build_dir"] = dir
+		if _, err := deploySite(context.Background(), job, "s3", bad); err == nil || !strings.Contains(err.Error(), "under builds/") {
+			t.Fatalf("build_dir %q should be refused, got %v", dir, err)
+		}
+	}
+	if _, err := deploySite(context.Background(), job, "s3", config); err == nil || !strings.Contains(err.Error(), "channel/ch1/access_key_id") {
+		t.Fatalf("deploying without credentials should fail, got %v", err)
+	}
+	cm := GetCredentialManager()
+	cm.StoreCredential("channel/ch1/access_key_id", "AKID")
+	cm.StoreCredential("channel/ch1/secret_access_key", "secret")
+
+	deploy := func() *DeployReport {
+		t.Helper()
+		requests = nil
+		result, err := deploySite(context.Background(), job, "s3", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.(*DeployReport)
+	}
+	report := deploy()
+	if want := []string{"a.html", "index.html", "media/cat.png"}; !reflect.DeepEqual(report.Uploaded, want) {
+		t.Fatalf("first deploy should upload %v, got %v", want, report.Uploaded)
+	}
+	if types["/www/site/a.html"] != "text/html; charset=utf-8" || types["/www/site/media/cat.png"] != "image/png" {
+		t.Fatalf("uploads should carry their content type: %v", types)
+	}
+
+	if report = deploy(); len(requests) != 0 || report.Unchanged != 3 {
+		t.Fatalf("an unchanged site should transfer nothing: %v %+v", requests, report)
+	}
+
+	files["a.html"] = "A, edited"
+	delete(files, "media/cat.png")
+	deploy()
+	if want := []string{"PUT /www/site/a.html", "DELETE /www/site/media/cat.png"}; !reflect.DeepEqual(requests, want) {
+		t.Fatalf("expected %v, got %v", want, requests)
+	}
+}
+
+func TestSFTPBatch(t *testing.T) {
+	got, err := sftpBatch("/build", "/var/www", []string{"a.html", "media/x/cat.png", "media/dog.png"}, []string{"old.html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `put "/build/a.html" "/var/www/a.html"
+-mkdir "/var/www/media"
+-mkdir "/var/www/media/x"
+put "/build/media/x/cat.png" "/var/www/media/x/cat.png"
+put "/build/media/dog.png" "/var/www/media/dog.png"
+-rm "/var/www/old.html"
+`
+	if got != want {
+		t.Fatalf("unexpected batch:\n%s", got)
+	}
+
+	// a path can't break out of its quotes into another command
+	for _, bad := range []string{"a\"\n!touch pwned\n.html", "a\\\".html", "a\r.html"} {
+		if batch, err := sftpBatch("/build", "/var/www", []string{bad}, nil); err == nil {
+			t.Fatalf("%q should be refused, got:\n%s", bad, batch)
+		}
+	}
+	if _, err := sftpBatch("/build", "/var/www\"\n!id", []string{"a.html"}, nil); err == nil {
+		t.Fatal("a remote_dir breaking out of its quotes should be refused")
+	}
+}
+
+func TestSSHDestination(t *testing.T) {
+	for _, c := range []struct{ user, host, want string }{
+		{"deploy", "example.com", "deploy@example.com"},
+		{"www-data", "10.0.0.7", "www-data@10.0.0.7"},
+		{"me", "::1", "me@[::1]"},
+	} {
+		got, err := sshDestination(map[string]interface{}{"user": c.user, "host": c.host})
+		if err != nil || got != c.want {
+			t.Fatalf("%s@%s: got %q %v, want %q", c.user, c.host, got, err, c.want)
+		}
+	}
+	// nothing that sftp, ssh or rsync would read as an option or a second argument
+	for _, c := range []struct{ user, host string }{
+		{"-oProxyCommand=touch pwned", "example.com"},
+		{"me", "-oProxyCommand=touch pwned"},
+		{"me", "example.com -p 2222"},
+		{"me@other", "example.com"},
+		{"me", "example.com:/etc"},
+		{"", "example.com"},
+		{"me", ""},
+	} {
+		config := map[string]interface{}{"user": c.user, "host": c.host, "remote_dir": "/var/www"}
+		if _, err := sshDestination(config); err == nil {
+			t.Fatalf("%q@%q should be refused", c.user, c.host)
+		}
+		if err := ValidateChannelConfig("sftp", config); err == nil {
+			t.Fatalf("an sftp channel for %q@%q should be refused", c.user, c.host)
+		}
+	}
+	if got := rsyncQuote("/keys/it's mine"); got != "'/keys/it''s mine'" {
+		t.Fatalf("unexpected quoting %s", got)
+	}
+}
@@ -0,0 +1,87 @@
+package plugins
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Plugin Directory ===
+// Plugins that aren't built in live in the vault's plugins/ directory: a
+// WASM module as NAME.wasm, with an optional NAME.json manifest beside it,
+// or an exec plugin as NAME.json with "runtime": "exec". Each is added to
+// plugins_registry, disabled, the first time the vault opens with it, and
+// runs once enabled.
+
+// runtimePlugin builds the plugin a manifest describes, or nil when it names
+// no runtime
+func runtimePlugin(slug, manifest string) Plugin {
+	if m, ok := parseWasmManifest(manifest); ok {
+		return NewWasmPlugin(slug, m)
+	}
+	if m, ok := parseExecManifest(manifest); ok {
+		return NewExecPlugin(slug, m)
+	}
+	return nil
+}
+
+// DiscoverPlugins adds each plugin in dir to plugins_registry, disabled,
+// unless its slug is taken
+func DiscoverPlugins(d *sql.DB, dir string) {
+	wasm, _ := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	manifests, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	paths := append(wasm, manifests...)
+	sort.Strings(paths)
+	for _, path := range paths {
+		base := strings.TrimSuffix(path, filepath.Ext(path))
+		slug := filepath.Base(base)
+		var count int
+		d.QueryRow(`SELECT COUNT(*) FROM plugins_registry WHERE slug = ?`, slug).Scan(&count)
+		if count > 0 {
+			continue
+		}
+		var m map[string]interface{}
+		if b, err := os.ReadFile(base + ".json"); err == nil {
+			if err := json.Unmarshal(b, &m); err != nil {
+				log.Printf("Skipping plugin %s: bad manifest: %v\n", slug, err)
+				continue
+			}
+		}
+		if m == nil {
+			m = map[string]interface{}{}
+		}
+
+		if filepath.Ext(path) == ".wasm" {
+			m["runtime"], m["module"] = WasmRuntime, path
+		} else if _, err := os.Stat(base + ".wasm"); err == nil {
+			continue // the module's sidecar manifest
+		} else if m["runtime"] != ExecRuntime {
+			continue
+		} else if command, _ := m["command"].(string); command != "" && !filepath.IsAbs(command) {
+			// a command shipped beside its manifest
+			if _, err := os.Stat(filepath.Join(dir, command)); err == nil {
+				m["command"] = filepath.Join(dir, command)
+			}
+		}
+		name, _ := m["name"].(string)
+		if name == "" {
+			name = slug
+		}
+		manifest, _ := json.Marshal(m)
+		now := time.Now().Unix()
+		id := ids.New("plugin")
+		if _, err := d.Exec(`INSERT INTO plugins_registry (id, name, slug, manifest, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?)`,
+			id, name, slug, string(manifest), now, now); err != nil {
+			log.Printf("Failed to add plugin %s: %v\n", slug, err)
+			continue
+		}
+		log.Printf("Added plugin to registry: %s (%s), enable it to load\n", name, slug)
+	}
+}
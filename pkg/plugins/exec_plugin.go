@@ -0,0 +1,388 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// === Exec Plugins ===
+// An exec plugin is a separate program, in any language, that veil starts
+// and talks to over its stdin and stdout with JSON-RPC 2.0, one message per
+// line. Its plugins_registry manifest has "runtime": "exec", the command and
+// its arguments. stderr goes to the log. The program's environment is PATH,
+// the manifest's env and VEIL_PLUGIN_PROTOCOL, so it can tell it was started
+// by veil.
+//
+// veil calls initialize {config} once the program starts, execute {action,
+// payload} for each plugin call and shutdown before closing its stdin. The
+// program may call back with log {message}, and with the "credentials"
+// capability credential {key}, which answers the plugin's credential. Calls
+// may overlap; responses are matched by id. A program that exits is started
+// again on the next call.
+
+// ExecRuntime is the manifest runtime of exec plugins
+const ExecRuntime = "exec"
+
+// ExecProtocol is the value of VEIL_PLUGIN_PROTOCOL
+const ExecProtocol = "jsonrpc-1"
+
+// execCapabilities are the capabilities an exec manifest may declare. The
+// program runs outside veil, so network is only a declaration, and every
+// exec plugin is granted exec.
+var execCapabilities = map[string]bool{CapCredentials: true, CapNetwork: true, CapExec: true}
+
+// execShutdownGrace is how long a program has to exit after shutdown
+const execShutdownGrace = 5 * time.Second
+
+// ExecManifest is the plugins_registry manifest of an exec plugin
+type ExecManifest struct {
+	Runtime      string                 `json:"runtime"`
+	Command      string                 `json:"command"`
+	Args         []string               `json:"args,omitempty"`
+	Env          map[string]string      `json:"env,omitempty"`
+	Name         string                 `json:"name,omitempty"`
+	Version      string                 `json:"version,omitempty"`
+	Capabilities []string               `json:"capabilities,omitempty"`
+	Config       map[string]interface{} `json:"config,omitempty"`
+}
+
+// parseExecManifest reads manifest, ok only when it names the exec runtime
+func parseExecManifest(manifest string) (m ExecManifest, ok bool) {
+	if manifest == "" || json.Unmarshal([]byte(manifest), &m) != nil {
+		return m, false
+	}
+	return m, m.Runtime == ExecRuntime
+}
+
+// execMessage is any JSON-RPC message in either direction
+type execMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *execError      `json:"error,omitempty"`
+}
+
+// execError is a JSON-RPC error object
+type execError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *execError) Error() string { return e.Message }
+
+// execProcess is one run of the program
+type execProcess struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan execMessage
+	done    chan struct{} // closed once the program exits
+	err     error
+}
+
+// ExecPlugin runs an external program as a plugin
+type ExecPlugin struct {
+	slug     string
+	manifest ExecManifest
+	config   map[string]interface{}
+	pc       *PluginContext
+
+	mu   sync.Mutex
+	proc *execProcess
+}
+
+// NewExecPlugin returns the plugin for slug described by m, not yet started
+func NewExecPlugin(slug string, m ExecManifest) *ExecPlugin {
+	return &ExecPlugin{slug: slug, manifest: m}
+}
+
+func (p *ExecPlugin) Name() string { return p.slug }
+
+func (p *ExecPlugin) Version() string {
+	if p.manifest.Version == "" {
+		return "0.0.0"
+	}
+	return p.manifest.Version
+}
+
+// AttachContext implements ContextAware
+func (p *ExecPlugin) AttachContext(pc *PluginContext) { p.pc = pc }
+
+// Capabilities implements CapabilityDeclarer
+func (p *ExecPlugin) Capabilities() []string {
+	return append([]string{CapExec}, p.manifest.Capabilities...)
+}
+
+// granted reports whether the manifest declares capability
+func (p *ExecPlugin) granted(capability string) bool {
+	for _, c := range p.manifest.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Initialize starts the program with the manifest's "config" object
+func (p *ExecPlugin) Initialize(config map[string]interface{}) error {
+	if cfg, ok := config["config"]; ok {
+		p.manifest.Config, _ = cfg.(map[string]interface{})
+	}
+	p.config = p.manifest.Config
+	if p.config == nil {
+		p.config = map[string]interface{}{}
+	}
+	for _, c := range p.manifest.Capabilities {
+		if !execCapabilities[c] {
+			return fmt.Errorf("capability %q is not available to exec plugins", c)
+		}
+	}
+	if p.manifest.Command == "" {
+		return fmt.Errorf("manifest has no command")
+	}
+	_, err := p.process(context.Background())
+	return err
+}
+
+// process returns the running program, starting it if needed
+func (p *ExecPlugin) process(ctx context.Context) (*execProcess, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc != nil {
+		select {
+		case <-p.proc.done:
+			slog.WarnContext(ctx, "plugin exited, restarting", "plugin", p.slug, "error", p.proc.err)
+		default:
+			return p.proc, nil
+		}
+	}
+	proc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := proc.call(ctx, "initialize", map[string]interface{}{"config": p.config}); err != nil {
+		proc.kill()
+		return nil, fmt.Errorf("initialize: %w", err)
+	}
+	p.proc = proc
+	return proc, nil
+}
+
+// start launches the program and its reader
+func (p *ExecPlugin) start() (*execProcess, error) {
+	cmd := exec.Command(p.manifest.Command, p.manifest.Args...)
+	// not os.Environ(): the server's environment holds its secrets
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "VEIL_PLUGIN_PROTOCOL=" + ExecProtocol, "VEIL_PLUGIN=" + p.slug}
+	for k, v := range p.manifest.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = pluginLogWriter(p.slug)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", p.manifest.Command, err)
+	}
+	proc := &execProcess{cmd: cmd, stdin: stdin, pending: map[int64]chan execMessage{}, done: make(chan struct{})}
+	go p.read(proc, stdout)
+	return proc, nil
+}
+
+// read dispatches the program's messages until it exits
+func (p *ExecPlugin) read(proc *execProcess, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		var msg execMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			slog.Warn("ignoring plugin output that is not JSON-RPC", "plugin", p.slug, "output", scanner.Text())
+			continue
+		}
+		if msg.Method != "" {
+			go p.answer(proc, msg)
+			continue
+		}
+		if msg.ID == nil {
+			continue
+		}
+		proc.mu.Lock()
+		ch := proc.pending[*msg.ID]
+		delete(proc.pending, *msg.ID)
+		proc.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+	proc.err = proc.cmd.Wait()
+	if proc.err == nil {
+		proc.err = errors.New("plugin exited")
+	}
+	close(proc.done)
+}
+
+// answer serves a call the program makes to veil
+func (p *ExecPlugin) answer(proc *execProcess, msg execMessage) {
+	var result interface{}
+	var rerr *execError
+	switch msg.Method {
+	case "log":
+		var params struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		slog.Info(params.Message, "plugin", p.slug)
+	case "credential":
+		var params struct {
+			Key string `json:"key"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		if !p.granted("credentials") || p.pc == nil {
+			rerr = &execError{Code: -32601, Message: "credential requires the credentials capability"}
+			break
+		}
+		value, err := p.pc.Credential(params.Key)
+		if err != nil {
+			rerr = &execError{Code: -32000, Message: err.Error()}
+			break
+		}
+		result = value
+	default:
+		rerr = &execError{Code: -32601, Message: "method not found: " + msg.Method}
+	}
+	if msg.ID == nil {
+		return // a notification gets no reply
+	}
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": *msg.ID}
+	if rerr != nil {
+		reply["error"] = rerr
+	} else {
+		reply["result"] = result
+	}
+	proc.send(reply)
+}
+
+// send writes one message to the program
+func (proc *execProcess) send(msg interface{}) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	proc.writeMu.Lock()
+	defer proc.writeMu.Unlock()
+	_, err = proc.stdin.Write(append(b, '\n'))
+	return err
+}
+
+// call sends a request and waits for its response
+func (proc *execProcess) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("encode params: %w", err)
+	}
+	ch := make(chan execMessage, 1)
+	proc.mu.Lock()
+	proc.nextID++
+	id := proc.nextID
+	proc.pending[id] = ch
+	proc.mu.Unlock()
+	forget := func() {
+		proc.mu.Lock()
+		delete(proc.pending, id)
+		proc.mu.Unlock()
+	}
+	if err := proc.send(execMessage{JSONRPC: "2.0", ID: &id, Method: method, Params: raw}); err != nil {
+		forget()
+		return nil, fmt.Errorf("send %s: %w", method, err)
+	}
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-proc.done:
+		forget()
+		return nil, fmt.Errorf("plugin exited during %s: %v", method, proc.err)
+	case <-ctx.Done():
+		forget()
+		proc.send(execMessage{JSONRPC: "2.0", Method: "cancel", Params: json.RawMessage(fmt.Sprintf(`{"id":%d}`, id))})
+		return nil, ctx.Err()
+	}
+}
+
+// kill stops the program at once
+func (proc *execProcess) kill() {
+	proc.stdin.Close()
+	proc.cmd.Process.Kill()
+	<-proc.done
+}
+
+func (p *ExecPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	proc, err := p.process(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := proc.call(ctx, "execute", map[string]interface{}{"action": action, "payload": payload})
+	if err != nil {
+		return nil, err
+	}
+	var result interface{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, fmt.Errorf("decode result: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// Validate checks that the program is running
+func (p *ExecPlugin) Validate() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.proc == nil {
+		return fmt.Errorf("%s is not running", p.manifest.Command)
+	}
+	return nil
+}
+
+// Shutdown asks the program to stop, killing it if it hasn't exited within
+// execShutdownGrace
+func (p *ExecPlugin) Shutdown() error {
+	p.mu.Lock()
+	proc := p.proc
+	p.proc = nil
+	p.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execShutdownGrace)
+	defer cancel()
+	proc.call(ctx, "shutdown", nil) // a program may exit without answering
+	proc.stdin.Close()
+	select {
+	case <-proc.done:
+		return nil
+	case <-ctx.Done():
+	}
+	proc.cmd.Process.Kill()
+	<-proc.done
+	return fmt.Errorf("plugin %s did not exit within %s and was killed", p.slug, execShutdownGrace)
+}
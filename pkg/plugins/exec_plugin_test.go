@@ -0,0 +1,153 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExecPluginHelper is the plugin program TestExecPlugin starts: the test
+// binary run again with VEIL_TEST_EXEC_PLUGIN set
+func TestExecPluginHelper(t *testing.T) {
+	if os.Getenv("VEIL_TEST_EXEC_PLUGIN") != "1" {
+		return
+	}
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	greeting := ""
+	for in.Scan() {
+		var msg execMessage
+		json.Unmarshal(in.Bytes(), &msg)
+		reply := map[string]interface{}{"jsonrpc": "2.0", "id": msg.ID}
+		switch msg.Method {
+		case "initialize":
+			var p struct {
+				Config map[string]string `json:"config"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			greeting = p.Config["greeting"]
+			out.Encode(map[string]interface{}{"jsonrpc": "2.0", "method": "log", "params": map[string]string{"message": "ready"}})
+			reply["result"] = true
+		case "execute":
+			var p struct {
+				Action  string            `json:"action"`
+				Payload map[string]string `json:"payload"`
+			}
+			json.Unmarshal(msg.Params, &p)
+			switch p.Action {
+			case "greet":
+				reply["result"] = greeting + ", " + p.Payload["name"]
+			case "secret":
+				// ask veil, then wait for its answer
+				out.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": 1000, "method": "credential", "params": map[string]string{"key": p.Payload["key"]}})
+				for in.Scan() {
+					var answer execMessage
+					json.Unmarshal(in.Bytes(), &answer)
+					if answer.ID != nil && *answer.ID == 1000 {
+						if answer.Error != nil {
+							reply["error"] = answer.Error
+						} else {
+							reply["result"] = answer.Result
+						}
+						break
+					}
+				}
+			case "env":
+				reply["result"] = os.Getenv(p.Payload["name"])
+			case "crash":
+				os.Exit(3)
+			default:
+				reply["error"] = map[string]interface{}{"code": -32000, "message": "unknown action " + p.Action}
+			}
+		case "shutdown":
+			out.Encode(reply)
+			os.Exit(0)
+		}
+		out.Encode(reply)
+	}
+	os.Exit(0)
+}
+
+func TestExecPlugin(t *testing.T) {
+	d := setupPluginsDB(t)
+	credentialTestDB(t, d)
+	initCredentialManager()
+	GetCredentialManager().StorePluginCredential("t-exec", "exec_token", "s3cret")
+	GetCredentialManager().StoreCredential("core_token", "core")
+
+	dir := t.TempDir()
+	manifest := ExecManifest{
+		Runtime:      ExecRuntime,
+		Command:      os.Args[0],
+		Args:         []string{"-test.run=^TestExecPluginHelper$"},
+		Env:          map[string]string{"VEIL_TEST_EXEC_PLUGIN": "1"},
+		Version:      "0.3.0",
+		Capabilities: []string{"credentials"},
+		Config:       map[string]interface{}{"greeting": "Hello"},
+	}
+	b, _ := json.Marshal(manifest)
+	os.WriteFile(filepath.Join(dir, "t-exec.json"), b, 0644)
+	os.WriteFile(filepath.Join(dir, "notes.json"), []byte(`{"title": "not a plugin"}`), 0644)
+	DiscoverPlugins(d, dir)
+	var count int
+	var stored string
+	d.QueryRow(`SELECT COUNT(*) FROM plugins_registry`).Scan(&count)
+	d.QueryRow(`SELECT manifest FROM plugins_registry WHERE slug = 't-exec'`).Scan(&stored)
+	if count != 1 || !strings.Contains(stored, `"runtime":"exec"`) {
+		t.Fatalf("expected only the exec manifest registered: %d %s", count, stored)
+	}
+
+	t.Setenv("VEIL_MASTER_PASSPHRASE", "hunter2")
+	if err := EnablePlugin(d, "t-exec", stored); err != nil {
+		t.Fatal(err)
+	}
+	defer GetRegistry().Unregister("t-exec")
+	ctx := context.Background()
+	if res, err := GetRegistry().Execute(ctx, "t-exec", "greet", map[string]string{"name": "Ada"}); err != nil || res != "Hello, Ada" {
+		t.Fatalf("greet: %v %v", res, err)
+	}
+	if _, err := GetRegistry().Execute(ctx, "t-exec", "nope", nil); err == nil || err.Error() != "unknown action nope" {
+		t.Fatalf("expected the program's error, got %v", err)
+	}
+
+	// the program gets its own variables, not the server's
+	for name, want := range map[string]string{"VEIL_PLUGIN": "t-exec", "VEIL_TEST_EXEC_PLUGIN": "1", "VEIL_MASTER_PASSPHRASE": ""} {
+		if res, err := GetRegistry().Execute(ctx, "t-exec", "env", map[string]string{"name": name}); err != nil || res != want {
+			t.Fatalf("%s in the plugin's environment: %q %v", name, res, err)
+		}
+	}
+
+	// callbacks read only the plugin's own credentials
+	if res, err := GetRegistry().Execute(ctx, "t-exec", "secret", map[string]string{"key": "exec_token"}); err != nil || res != "s3cret" {
+		t.Fatalf("credential: %v %v", res, err)
+	}
+	if _, err := GetRegistry().Execute(ctx, "t-exec", "secret", map[string]string{"key": "core_token"}); err == nil {
+		t.Fatal("a core credential should be out of reach")
+	}
+
+	// a program that exits is started again
+	if _, err := GetRegistry().Execute(ctx, "t-exec", "crash", nil); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expected the exit to surface, got %v", err)
+	}
+	if res, err := GetRegistry().Execute(ctx, "t-exec", "greet", map[string]string{"name": "again"}); err != nil || res != "Hello, again" {
+		t.Fatalf("the program should restart: %v %v", res, err)
+	}
+
+	start := time.Now()
+	if err := GetRegistry().Unregister("t-exec"); err != nil || time.Since(start) > execShutdownGrace {
+		t.Fatalf("shutdown: %v after %s", err, time.Since(start))
+	}
+
+	missing := NewExecPlugin("t-missing", ExecManifest{Command: filepath.Join(dir, "no-such-program")})
+	if err := missing.Initialize(nil); err == nil || !strings.Contains(err.Error(), "start") {
+		t.Fatalf("a missing program should fail to start: %v", err)
+	}
+	if err := NewExecPlugin("t-caps", ExecManifest{Command: "true", Capabilities: []string{"wasi"}}).Initialize(nil); err == nil {
+		t.Fatal("exec plugins cannot take the wasi capability")
+	}
+}
@@ -0,0 +1,246 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Git Plugin - Issue Import ===
+
+// githubAPI is the GitHub REST endpoint; tests point it at a local server
+var githubAPI = "https://api.github.com"
+
+const (
+	issueNodeType      = "issue"
+	issuesSyncedKey    = "git_issues_synced_at"
+	issuesPerPage      = 100
+	issuesMaxPages     = 50
+	issueCommentsLimit = 100
+)
+
+type githubUser struct {
+	Login string `json:"login"`
+}
+
+type githubLabel struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+type githubIssue struct {
+	Number      int           `json:"number"`
+	Title       string        `json:"title"`
+	Body        string        `json:"body"`
+	State       string        `json:"state"`
+	HTMLURL     string        `json:"html_url"`
+	User        githubUser    `json:"user"`
+	Labels      []githubLabel `json:"labels"`
+	Comments    int           `json:"comments"`
+	CommentsURL string        `json:"comments_url"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	PullRequest *struct {
+		HTMLURL string `json:"html_url"`
+	} `json:"pull_request,omitempty"`
+}
+
+type githubComment struct {
+	User      githubUser `json:"user"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// githubRepo reads the configured repository and token as owner, repo, token
+func (gp *GitPlugin) githubRepo() (string, string, string, error) {
+	token, err := gp.githubToken()
+	if err != nil {
+		return "", "", "", err
+	}
+	repoURL, _ := loadConfig("git_repo_url")
+	if repoURL == nil {
+		return "", "", "", fmt.Errorf("repository URL not configured")
+	}
+	repoPath := strings.TrimPrefix(repoURL.(string), "https://github.com/")
+	repoPath = strings.TrimSuffix(strings.TrimSuffix(repoPath, "/"), ".git")
+	parts := strings.Split(repoPath, "/")
+	if len(parts) < 2 {
+		return "", "", "", fmt.Errorf("invalid GitHub repository URL")
+	}
+	return parts[0], parts[1], token, nil
+}
+
+func githubGet(ctx context.Context, url, token string, out interface{}) error {
+	httpReq, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	httpReq.Header.Set("Authorization", "token "+token)
+	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := pluginHTTP(ctx).Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("GitHub API request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GitHub API error: %s", string(body))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// importIssues pulls issues and pull requests from the configured repository
+// into nodes, one per issue. Nodes are matched on the issue's URL so later
+// syncs update them in place; labels become tags and comments are appended
+// to the content. Only issues changed since the previous import are fetched
+// unless the payload sets "full": true.
+//
+// Payload: {site_id?, state?: open|closed|all, include_prs?: bool, full?: bool}
+func (gp *GitPlugin) importIssues(ctx context.Context, payload interface{}) (interface{}, error) {
+	req, ok := payload.(map[string]interface{})
+	if !ok {
+		req = map[string]interface{}{}
+	}
+	owner, repo, token, err := gp.githubRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	state := "all"
+	if s, ok := req["state"].(string); ok && s != "" {
+		state = s
+	}
+	includePRs := true
+	if b, ok := req["include_prs"].(bool); ok {
+		includePRs = b
+	}
+	siteID, _ := req["site_id"].(string)
+	since := ""
+	if full, _ := req["full"].(bool); !full {
+		if v, err := loadConfig(issuesSyncedKey); err == nil && v != nil {
+			since = v.(string)
+		}
+	}
+
+	started := time.Now().UTC()
+	created, updated := 0, 0
+	for page := 1; page <= issuesMaxPages; page++ {
+		url := fmt.Sprintf("%s/repos/%s/%s/issues?state=%s&per_page=%d&page=%d", githubAPI, owner, repo, state, issuesPerPage, page)
+		if since != "" {
+			url += "&since=" + since
+		}
+		var issues []githubIssue
+		if err := githubGet(ctx, url, token, &issues); err != nil {
+			return nil, err
+		}
+		for _, issue := range issues {
+			if issue.PullRequest != nil && !includePRs {
+				continue
+			}
+			var comments []githubComment
+			if issue.Comments > 0 && issue.CommentsURL != "" {
+				if err := githubGet(ctx, fmt.Sprintf("%s?per_page=%d", issue.CommentsURL, issueCommentsLimit), token, &comments); err != nil {
+					return nil, err
+				}
+			}
+			isNew, err := upsertIssueNode(ctx, owner, repo, siteID, issue, comments)
+			if err != nil {
+				return nil, err
+			}
+			if isNew {
+				created++
+			} else {
+				updated++
+			}
+		}
+		if len(issues) < issuesPerPage {
+			break
+		}
+	}
+
+	saveConfig(issuesSyncedKey, started.Format(time.RFC3339))
+	return map[string]interface{}{
+		"status":  "imported",
+		"repo":    owner + "/" + repo,
+		"created": created,
+		"updated": updated,
+	}, nil
+}
+
+// renderIssue formats an issue and its comments as markdown
+func renderIssue(issue githubIssue, comments []githubComment) string {
+	var b strings.Builder
+	kind := "Issue"
+	if issue.PullRequest != nil {
+		kind = "Pull request"
+	}
+	fmt.Fprintf(&b, "# %s\n\n", issue.Title)
+	fmt.Fprintf(&b, "> %s #%d · %s · opened by @%s on %s · [view on GitHub](%s)\n\n",
+		kind, issue.Number, issue.State, issue.User.Login, issue.CreatedAt.Format("2006-01-02"), issue.HTMLURL)
+	if body := strings.TrimSpace(issue.Body); body != "" {
+		b.WriteString(body)
+		b.WriteString("\n")
+	}
+	for _, c := range comments {
+		fmt.Fprintf(&b, "\n---\n\n**@%s** commented on %s:\n\n%s\n", c.User.Login, c.CreatedAt.Format("2006-01-02 15:04"), strings.TrimSpace(c.Body))
+	}
+	return b.String()
+}
+
+// upsertIssueNode creates or refreshes the node for issue and reports
+// whether it was newly created
+func upsertIssueNode(ctx context.Context, owner, repo, siteID string, issue githubIssue, comments []githubComment) (bool, error) {
+	content := renderIssue(issue, comments)
+	meta, _ := json.Marshal(map[string]interface{}{
+		"github": map[string]interface{}{
+			"repo":         owner + "/" + repo,
+			"number":       issue.Number,
+			"state":        issue.State,
+			"author":       issue.User.Login,
+			"pull_request": issue.PullRequest != nil,
+			"updated_at":   issue.UpdatedAt.Format(time.RFC3339),
+		},
+	})
+	now := time.Now().Unix()
+
+	var nodeID string
+	err := pluginDB(ctx).QueryRow(`SELECT id FROM nodes WHERE canonical_uri = ? AND deleted_at IS NULL`, issue.HTMLURL).Scan(&nodeID)
+	isNew := err != nil
+	if isNew {
+		nodeID = ids.New("node")
+		var site interface{}
+		if siteID != "" {
+			site = siteID
+		}
+		_, err = pluginDB(ctx).Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, canonical_uri, metadata, status, created_at, modified_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'draft', ?, ?)`,
+			nodeID, issueNodeType, site, fmt.Sprintf("issues/%s/%s/%d.md", owner, repo, issue.Number), issue.Title, content,
+			fmt.Sprintf("%s-%s-%d", owner, repo, issue.Number), issue.HTMLURL, string(meta), issue.CreatedAt.Unix(), now)
+	} else {
+		_, err = pluginDB(ctx).Exec(`UPDATE nodes SET title = ?, content = ?, metadata = ?, modified_at = ? WHERE id = ?`,
+			issue.Title, content, string(meta), now, nodeID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Labels are the source of truth for the node's tags
+	pluginDB(ctx).Exec(`DELETE FROM node_tags WHERE node_id = ?`, nodeID)
+	for _, label := range issue.Labels {
+		var tagID string
+		if pluginDB(ctx).QueryRow(`SELECT id FROM tags WHERE name = ?`, label.Name).Scan(&tagID) != nil {
+			tagID = ids.New("tag")
+			if _, err := pluginDB(ctx).Exec(`INSERT INTO tags (id, name, color) VALUES (?, ?, ?)`, tagID, label.Name, "#"+label.Color); err != nil {
+				return false, err
+			}
+		}
+		pluginDB(ctx).Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			ids.New("nt"), nodeID, tagID)
+	}
+	return isNew, nil
+}
@@ -0,0 +1,134 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestImportIssues_CreatesAndUpdatesNodes(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "plugins-issues-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d, err := sql.Open("sqlite", tmp+"/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, stmt := range []string{
+		`CREATE TABLE nodes (id TEXT PRIMARY KEY, type TEXT, site_id TEXT, path TEXT, title TEXT, content TEXT, slug TEXT, canonical_uri TEXT, metadata TEXT, status TEXT, created_at INTEGER, modified_at INTEGER, deleted_at INTEGER)`,
+		`CREATE TABLE tags (id TEXT PRIMARY KEY, name TEXT UNIQUE NOT NULL, color TEXT)`,
+		`CREATE TABLE node_tags (id TEXT PRIMARY KEY, node_id TEXT, tag_id TEXT, UNIQUE(node_id, tag_id))`,
+		`CREATE TABLE configs (id TEXT PRIMARY KEY, key TEXT UNIQUE NOT NULL, value TEXT NOT NULL, created_at INTEGER NOT NULL, updated_at INTEGER NOT NULL)`,
+		`CREATE TABLE credential_access_log (id INTEGER PRIMARY KEY AUTOINCREMENT, plugin TEXT, key TEXT, granted INTEGER, accessed_at INTEGER)`,
+	} {
+		if _, err := d.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetDB(d)
+
+	labels := `[{"name":"bug","color":"ff0000"}]`
+	var sinceSeen string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/acme/widgets/issues":
+			sinceSeen = r.URL.Query().Get("since")
+			w.Write([]byte(`[
+				{"number":1,"title":"Crash on save","body":"It crashes.","state":"open","html_url":"https://github.com/acme/widgets/issues/1",
+				 "user":{"login":"ada"},"labels":` + labels + `,"comments":1,"comments_url":"` + srv.URL + `/repos/acme/widgets/issues/1/comments",
+				 "created_at":"2024-01-01T00:00:00Z","updated_at":"2024-01-02T00:00:00Z"},
+				{"number":2,"title":"Add dark mode","body":"","state":"closed","html_url":"https://github.com/acme/widgets/pull/2",
+				 "user":{"login":"bob"},"labels":[],"comments":0,"pull_request":{"html_url":"https://github.com/acme/widgets/pull/2"},
+				 "created_at":"2024-01-03T00:00:00Z","updated_at":"2024-01-03T00:00:00Z"}]`))
+		case "/repos/acme/widgets/issues/1/comments":
+			w.Write([]byte(`[{"user":{"login":"bob"},"body":"Confirmed.","created_at":"2024-01-02T00:00:00Z"}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(old string) { githubAPI = old }(githubAPI)
+	githubAPI = srv.URL
+
+	saveConfig("github_token", "t0ken")
+	saveConfig("git_repo_url", "https://github.com/acme/widgets.git")
+
+	initCredentialManager()
+	defer initCredentialManager()
+	gp := NewGitPlugin()
+	attachContext(gp)
+	res, err := gp.Execute(context.Background(), "import_issues", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("import_issues: %v", err)
+	}
+	// the legacy token moved into the git plugin's credentials
+	if v, _ := loadConfig("github_token"); v != nil {
+		t.Fatalf("the token should have left configs")
+	}
+	if _, err := GetCredentialManager().GetCredential("github_token"); !errors.Is(err, ErrCredentialScope) {
+		t.Fatalf("only the git plugin should read the token, got %v", err)
+	}
+	if out := res.(map[string]interface{}); out["created"] != 2 || out["updated"] != 0 {
+		t.Fatalf("unexpected first import result: %v", out)
+	}
+
+	var id, content, metadata string
+	if err := d.QueryRow(`SELECT id, content, metadata FROM nodes WHERE canonical_uri = ?`, "https://github.com/acme/widgets/issues/1").Scan(&id, &content, &metadata); err != nil {
+		t.Fatalf("issue node missing: %v", err)
+	}
+	if !strings.Contains(content, "It crashes.") || !strings.Contains(content, "**@bob** commented") {
+		t.Fatalf("unexpected content: %q", content)
+	}
+	var meta map[string]map[string]interface{}
+	json.Unmarshal([]byte(metadata), &meta)
+	if meta["github"]["number"] != float64(1) {
+		t.Fatalf("unexpected metadata: %s", metadata)
+	}
+	var tag string
+	d.QueryRow(`SELECT t.name FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = ?`, id).Scan(&tag)
+	if tag != "bug" {
+		t.Fatalf("expected label imported as tag, got %q", tag)
+	}
+
+	labels = `[{"name":"wontfix","color":"cccccc"}]`
+	res, err = gp.Execute(context.Background(), "import_issues", map[string]interface{}{"include_prs": false})
+	if err != nil {
+		t.Fatalf("second import_issues: %v", err)
+	}
+	if out := res.(map[string]interface{}); out["created"] != 0 || out["updated"] != 1 {
+		t.Fatalf("unexpected second import result: %v", out)
+	}
+	if sinceSeen == "" {
+		t.Fatalf("expected incremental sync to pass since")
+	}
+	var n int
+	d.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&n)
+	if n != 2 {
+		t.Fatalf("expected nodes to be updated in place, got %d", n)
+	}
+	var tags []string
+	rows, _ := d.Query(`SELECT t.name FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = ?`, id)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tags = append(tags, name)
+	}
+	rows.Close()
+	if len(tags) != 1 || tags[0] != "wontfix" {
+		t.Fatalf("expected tags to follow labels, got %v", tags)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	codexpkg "veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === Git Plugin ===
@@ -23,6 +25,7 @@ type GitPlugin struct {
 	name    string
 	version string
 	repo    *codexpkg.Repository
+	pc      *PluginContext
 }
 
 func NewGitPlugin() *GitPlugin {
@@ -40,6 +43,11 @@ func (gp *GitPlugin) Version() string {
 	return gp.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (gp *GitPlugin) Capabilities() []string {
+	return []string{CapNetwork, CapExec, CapDBRead, CapDBWrite, CapCredentials}
+}
+
 func (gp *GitPlugin) Initialize(config map[string]interface{}) error {
 	// Store git config (repo URL, credentials, etc.)
 	if repoURL, ok := config["repo_url"].(string); ok {
@@ -54,9 +62,50 @@ func (gp *GitPlugin) Initialize(config map[string]interface{}) error {
 		}
 	}
 
+	if token, ok := config["token"].(string); ok && token != "" {
+		if gp.pc == nil {
+			return fmt.Errorf("git plugin has no credential context")
+		}
+		if err := gp.pc.StoreCredential(githubTokenKey, token); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// githubTokenKey names the GitHub token among the git plugin's credentials
+const githubTokenKey = "github_token"
+
+// AttachContext receives the plugin's credential scope from the registry
+func (gp *GitPlugin) AttachContext(pc *PluginContext) {
+	gp.pc = pc
+}
+
+// githubToken reads the GitHub token from the plugin's credentials. A token
+// left in configs by older versions is moved there on first use.
+func (gp *GitPlugin) githubToken() (string, error) {
+	if gp.pc == nil {
+		return "", fmt.Errorf("git plugin has no credential context")
+	}
+	token, err := gp.pc.Credential(githubTokenKey)
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, ErrCredentialNotFound) {
+		return "", err
+	}
+	legacy, _ := loadConfig(githubTokenKey)
+	if legacy == nil {
+		return "", fmt.Errorf("GitHub token not configured")
+	}
+	if err := gp.pc.StoreCredential(githubTokenKey, legacy.(string)); err != nil {
+		return "", err
+	}
+	db.Exec(`DELETE FROM configs WHERE key = ?`, githubTokenKey)
+	return legacy.(string), nil
+}
+
 func (gp *GitPlugin) Validate() error {
 	// Check if git is installed
 	_, err := exec.LookPath("git")
@@ -84,6 +133,8 @@ func (gp *GitPlugin) Execute(ctx context.Context, action string, payload interfa
 		return gp.createPR(ctx, payload)
 	case "list_issues":
 		return gp.listIssues(ctx, payload)
+	case "import_issues":
+		return gp.importIssues(ctx, payload)
 	case "create_issue":
 		return gp.createIssue(ctx, payload)
 	case "fork":
@@ -127,13 +178,12 @@ func (gp *GitPlugin) clone(ctx context.Context, payload interface{}) (interface{
 	// Ensure directory exists
 	os.MkdirAll(targetDir, 0755)
 
-	cmd := exec.CommandContext(ctx, "git", "clone", repoURL, targetDir)
+	cmd := pluginCommand(ctx, "git", "clone", repoURL, targetDir)
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("clone failed: %v", err)
 	}
 
-	// Store repo URL
-	credentialMgr.StoreCredential("git_repo_url", repoURL)
+	saveConfig("git_repo_url", repoURL)
 	saveConfig("git_local_path", targetDir)
 
 	return map[string]string{"status": "cloned", "path": targetDir}, nil
@@ -162,20 +212,20 @@ func (gp *GitPlugin) push(ctx context.Context, payload interface{}) (interface{}
 	os.Chdir(localPath.(string))
 
 	// Add all changes
-	cmd := exec.CommandContext(ctx, "git", "add", "-A")
+	cmd := pluginCommand(ctx, "git", "add", "-A")
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("git add failed: %v", err)
 	}
 
 	// Commit
-	cmd = exec.CommandContext(ctx, "git", "commit", "-m", message)
+	cmd = pluginCommand(ctx, "git", "commit", "-m", message)
 	if err := cmd.Run(); err != nil {
 		// Might have nothing to commit
 		log.Println("git commit info:", err)
 	}
 
 	// Push
-	cmd = exec.CommandContext(ctx, "git", "push", "origin", branch)
+	cmd = pluginCommand(ctx, "git", "push", "origin", branch)
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("git push failed: %v", err)
 	}
@@ -188,7 +238,7 @@ func (gp *GitPlugin) pull(ctx context.Context, payload interface{}) (interface{}
 
 	os.Chdir(localPath.(string))
 
-	cmd := exec.CommandContext(ctx, "git", "pull")
+	cmd := pluginCommand(ctx, "git", "pull")
 	if err := cmd.Run(); err != nil {
 		return nil, fmt.Errorf("git pull failed: %v", err)
 	}
@@ -215,7 +265,7 @@ func (gp *GitPlugin) commit(ctx context.Context, payload interface{}) (interface
 
 	// Fetch the node from DB
 	var node Node
-	db.QueryRow(`SELECT id, path, content FROM nodes WHERE id = ?`, nodeID).
+	pluginDB(ctx).QueryRow(`SELECT id, path, content FROM nodes WHERE id = ?`, nodeID).
 		Scan(&node.ID, &node.Path, &node.Content)
 
 	// Write to file
@@ -224,10 +274,10 @@ func (gp *GitPlugin) commit(ctx context.Context, payload interface{}) (interface
 	os.WriteFile(filePath, []byte(node.Content), 0644)
 
 	// Git operations
-	cmd := exec.CommandContext(ctx, "git", "add", node.Path)
+	cmd := pluginCommand(ctx, "git", "add", node.Path)
 	cmd.Run()
 
-	cmd = exec.CommandContext(ctx, "git", "commit", "-m", message)
+	cmd = pluginCommand(ctx, "git", "commit", "-m", message)
 	if err := cmd.Run(); err != nil {
 		log.Println("Commit info:", err)
 	}
@@ -264,10 +314,10 @@ func (gp *GitPlugin) commit(ctx context.Context, payload interface{}) (interface
 
 	// Record in database
 	now := time.Now().Unix()
-	db.Exec(`
+	pluginDB(ctx).Exec(`
 		INSERT INTO git_commits (id, node_id, message, created_at)
 		VALUES (?, ?, ?, ?)
-	`, fmt.Sprintf("git_commit_%d", time.Now().UnixNano()), nodeID, message, now)
+	`, ids.New("git_commit"), nodeID, message, now)
 
 	return map[string]string{"status": "committed"}, nil
 }
@@ -277,7 +327,7 @@ func (gp *GitPlugin) status(ctx context.Context) (interface{}, error) {
 
 	os.Chdir(localPath.(string))
 
-	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain")
+	cmd := pluginCommand(ctx, "git", "status", "--porcelain")
 	output, err := cmd.Output()
 	if err != nil {
 		return nil, fmt.Errorf("git status failed: %v", err)
@@ -328,9 +378,9 @@ func (gp *GitPlugin) createPR(ctx context.Context, payload interface{}) (interfa
 		return nil, fmt.Errorf("invalid payload")
 	}
 
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	repoURL, _ := loadConfig("git_repo_url")
@@ -361,11 +411,11 @@ func (gp *GitPlugin) createPR(ctx context.Context, payload interface{}) (interfa
 
 	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls", owner, repo)
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
@@ -398,9 +448,9 @@ func (gp *GitPlugin) createIssue(ctx context.Context, payload interface{}) (inte
 		return nil, fmt.Errorf("invalid payload")
 	}
 
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	repoURL, _ := loadConfig("git_repo_url")
@@ -432,11 +482,11 @@ func (gp *GitPlugin) createIssue(ctx context.Context, payload interface{}) (inte
 
 	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/issues", owner, repo)
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
@@ -463,9 +513,9 @@ func (gp *GitPlugin) listIssues(ctx context.Context, payload interface{}) (inter
 		req = map[string]interface{}{}
 	}
 
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	repoURL, _ := loadConfig("git_repo_url")
@@ -487,10 +537,10 @@ func (gp *GitPlugin) listIssues(ctx context.Context, payload interface{}) (inter
 
 	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/issues?state=%s", owner, repo, state)
 	httpReq, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
@@ -511,9 +561,9 @@ func (gp *GitPlugin) listIssues(ctx context.Context, payload interface{}) (inter
 }
 
 func (gp *GitPlugin) forkRepo(ctx context.Context, payload interface{}) (interface{}, error) {
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	repoURL, _ := loadConfig("git_repo_url")
@@ -530,10 +580,10 @@ func (gp *GitPlugin) forkRepo(ctx context.Context, payload interface{}) (interfa
 
 	url := fmt.Sprintf("https://api.github.com/repos/%s/%s/forks", owner, repo)
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST", url, nil)
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
@@ -555,9 +605,9 @@ func (gp *GitPlugin) forkRepo(ctx context.Context, payload interface{}) (interfa
 }
 
 func (gp *GitPlugin) starRepo(ctx context.Context, payload interface{}) (interface{}, error) {
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	req, ok := payload.(map[string]interface{})
@@ -577,10 +627,10 @@ func (gp *GitPlugin) starRepo(ctx context.Context, payload interface{}) (interfa
 
 	url := fmt.Sprintf("https://api.github.com/user/starred/%s/%s", owner, repo)
 	httpReq, _ := http.NewRequestWithContext(ctx, "PUT", url, nil)
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
@@ -597,9 +647,9 @@ func (gp *GitPlugin) starRepo(ctx context.Context, payload interface{}) (interfa
 }
 
 func (gp *GitPlugin) getRepos(ctx context.Context, payload interface{}) (interface{}, error) {
-	token, _ := loadConfig("github_token")
-	if token == nil {
-		return nil, fmt.Errorf("GitHub token not configured")
+	token, err := gp.githubToken()
+	if err != nil {
+		return nil, err
 	}
 
 	req, ok := payload.(map[string]interface{})
@@ -636,10 +686,10 @@ func (gp *GitPlugin) getRepos(ctx context.Context, payload interface{}) (interfa
 	}
 
 	httpReq, _ := http.NewRequestWithContext(ctx, "GET", reposURL, nil)
-	httpReq.Header.Set("Authorization", "token "+token.(string))
+	httpReq.Header.Set("Authorization", "token "+token)
 	httpReq.Header.Set("Accept", "application/vnd.github.v3+json")
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("GitHub API request failed: %v", err)
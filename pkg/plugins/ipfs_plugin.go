@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strings"
 	"time"
 	"veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === IPFS Plugin ===
@@ -38,6 +40,11 @@ func (ip *IPFSPlugin) Version() string {
 	return ip.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (ip *IPFSPlugin) Capabilities() []string {
+	return []string{CapNetwork, CapDBRead, CapDBWrite}
+}
+
 func (ip *IPFSPlugin) Initialize(config map[string]interface{}) error {
 	if url, ok := config["gateway_url"].(string); ok {
 		ip.gatewayURL = url
@@ -124,7 +131,7 @@ func (ip *IPFSPlugin) addContent(ctx context.Context, payload interface{}) (inte
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST", ip.gatewayURL+"/api/v0/add?wrap-with-directory=true", body)
 	httpReq.Header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, name))
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("ipfs add failed: %v", err)
@@ -143,11 +150,11 @@ func (ip *IPFSPlugin) addContent(ctx context.Context, payload interface{}) (inte
 	}
 
 	// Store in database
-	now := int64(0) // time.Now().Unix() in context
-	db.Exec(`
+	now := time.Now().Unix()
+	pluginDB(ctx).Exec(`
 		INSERT INTO ipfs_content (id, hash, name, content, pinned, created_at)
 		VALUES (?, ?, ?, ?, ?, ?)
-	`, fmt.Sprintf("ipfs_%d", now), hash, name, content, false, now)
+	`, ids.New("ipfs"), hash, name, content, false, now)
 
 	return map[string]interface{}{
 		"hash": hash,
@@ -168,7 +175,7 @@ func (ip *IPFSPlugin) getContent(ctx context.Context, payload interface{}) (inte
 
 	hash := req["hash"].(string)
 
-	resp, err := http.Get(fmt.Sprintf("%s/ipfs/%s", ip.gatewayURL, hash))
+	resp, err := pluginHTTP(ctx).Get(fmt.Sprintf("%s/ipfs/%s", ip.gatewayURL, hash))
 	if err != nil {
 		return nil, fmt.Errorf("ipfs get failed: %v", err)
 	}
@@ -199,7 +206,7 @@ func (ip *IPFSPlugin) publishVersion(ctx context.Context, payload interface{}) (
 	// Fetch version from database
 	var version Version
 	var content string
-	db.QueryRow(`
+	pluginDB(ctx).QueryRow(`
 		SELECT id, node_id, title, content FROM versions WHERE id = ?
 	`, versionID).Scan(&version.ID, &version.NodeID, &version.Title, &content)
 
@@ -216,11 +223,13 @@ func (ip *IPFSPlugin) publishVersion(ctx context.Context, payload interface{}) (
 	hash := resultMap["hash"].(string)
 
 	// Store IPFS record
-	now := int64(0)
-	db.Exec(`
-		INSERT INTO ipfs_publications (id, version_id, node_id, ipfs_hash, created_at)
+	now := time.Now()
+	if _, err := pluginDB(ctx).Exec(`
+		INSERT INTO ipfs_publications (id, node_id, ipfs_hash, gateway_url, published_at)
 		VALUES (?, ?, ?, ?, ?)
-	`, fmt.Sprintf("pub_%d", now), versionID, nodeID, hash, now)
+	`, ids.New("pub"), nodeID, hash, fmt.Sprintf("https://gateway.pinata.cloud/ipfs/%s", hash), now.Unix()); err != nil {
+		log.Printf("ipfs: recording publication of %s: %v", nodeID, err)
+	}
 
 	// Also register the exported content in codex if a repository is attached
 	if ip.repo != nil {
@@ -262,7 +271,7 @@ func (ip *IPFSPlugin) pinContent(ctx context.Context, payload interface{}) (inte
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST",
 		fmt.Sprintf("%s/api/v0/pin/add?arg=%s", ip.gatewayURL, hash), nil)
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("pin add failed: %v", err)
@@ -270,7 +279,7 @@ func (ip *IPFSPlugin) pinContent(ctx context.Context, payload interface{}) (inte
 	defer resp.Body.Close()
 
 	// Update database
-	db.Exec(`UPDATE ipfs_content SET pinned = 1 WHERE hash = ?`, hash)
+	pluginDB(ctx).Exec(`UPDATE ipfs_content SET pinned = 1 WHERE hash = ?`, hash)
 
 	return map[string]string{"status": "pinned"}, nil
 }
@@ -291,7 +300,7 @@ func (ip *IPFSPlugin) unpinContent(ctx context.Context, payload interface{}) (in
 	httpReq, _ := http.NewRequestWithContext(ctx, "POST",
 		fmt.Sprintf("%s/api/v0/pin/rm?arg=%s", ip.gatewayURL, hash), nil)
 
-	client := &http.Client{}
+	client := pluginHTTP(ctx)
 	resp, err := client.Do(httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("pin rm failed: %v", err)
@@ -299,13 +308,13 @@ func (ip *IPFSPlugin) unpinContent(ctx context.Context, payload interface{}) (in
 	defer resp.Body.Close()
 
 	// Update database
-	db.Exec(`UPDATE ipfs_content SET pinned = 0 WHERE hash = ?`, hash)
+	pluginDB(ctx).Exec(`UPDATE ipfs_content SET pinned = 0 WHERE hash = ?`, hash)
 
 	return map[string]string{"status": "unpinned"}, nil
 }
 
 func (ip *IPFSPlugin) status(ctx context.Context) (interface{}, error) {
-	resp, err := http.Get(ip.gatewayURL + "/api/v0/stats/repo")
+	resp, err := pluginHTTP(ctx).Get(ip.gatewayURL + "/api/v0/stats/repo")
 	if err != nil {
 		return nil, fmt.Errorf("status check failed: %v", err)
 	}
@@ -0,0 +1,569 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+)
+
+// === Job Queue ===
+
+// Jobs are persisted in publish_jobs, so queued work survives a restart. A
+// pool of workers claims due jobs, runs the handler registered for their
+// kind and retries failures with exponential backoff. Publish jobs and
+// asynchronous plugin actions (such as media transcodes) share the queue.
+
+// Job is one row of the job queue
+type Job struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	NodeID      string          `json:"node_id,omitempty"`
+	VersionID   string          `json:"version_id,omitempty"`
+	ChannelID   string          `json:"channel_id,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Status      string          `json:"status"` // queued, running, success, failed
+	Progress    int             `json:"progress"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts,omitempty"`
+	Result      interface{}     `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	CreatedAt   int64           `json:"created_at"`
+	StartedAt   *int64          `json:"started_at,omitempty"`
+	CompletedAt *int64          `json:"completed_at,omitempty"`
+	NextRunAt   int64           `json:"next_run_at,omitempty"`
+	RetryOf     string          `json:"retry_of,omitempty"`
+}
+
+// JobHandler runs one job; its result is stored with the job
+type JobHandler func(ctx context.Context, job *Job) (interface{}, error)
+
+// Job kinds handled by the built-in handlers
+const (
+	JobKindPublish        = "publish"
+	JobKindPlugin         = "plugin"
+	JobKindMediaTranscode = "media_transcode" // a plugin job under a longer timeout
+)
+
+// jobKindTimeouts replace JobTimeout for kinds whose jobs run longer
+var jobKindTimeouts = map[string]time.Duration{JobKindMediaTranscode: 2 * time.Hour}
+
+var (
+	jobHandlers   = map[string]JobHandler{}
+	jobHandlersMu sync.RWMutex
+)
+
+// RegisterJobKind sets the handler for jobs of kind
+func RegisterJobKind(kind string, h JobHandler) {
+	jobHandlersMu.Lock()
+	defer jobHandlersMu.Unlock()
+	jobHandlers[kind] = h
+}
+
+func jobHandler(kind string) JobHandler {
+	jobHandlersMu.RLock()
+	defer jobHandlersMu.RUnlock()
+	return jobHandlers[kind]
+}
+
+func init() {
+	RegisterJobKind(JobKindPublish, runPublishJob)
+	RegisterJobKind(JobKindPlugin, runPluginJob)
+	RegisterJobKind(JobKindMediaTranscode, runPluginJob)
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as not worth retrying; the job fails immediately
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// JobQueueConfig tunes the worker pool
+type JobQueueConfig struct {
+	Workers      int
+	MaxAttempts  int           // per job unless the job sets its own
+	BaseBackoff  time.Duration // delay before the first retry, doubled for each one after
+	MaxBackoff   time.Duration
+	PollInterval time.Duration // how often idle workers look for due retries
+	JobTimeout   time.Duration
+}
+
+// DefaultJobQueueConfig is used by serve and gui unless overridden by flags
+func DefaultJobQueueConfig() JobQueueConfig {
+	return JobQueueConfig{
+		Workers:      2,
+		MaxAttempts:  5,
+		BaseBackoff:  5 * time.Second,
+		MaxBackoff:   10 * time.Minute,
+		PollInterval: 2 * time.Second,
+		JobTimeout:   5 * time.Minute,
+	}
+}
+
+// JobQueue is a running worker pool
+type JobQueue struct {
+	cfg      JobQueueConfig
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	running  int32
+}
+
+var (
+	activeQueue   *JobQueue
+	activeQueueMu sync.Mutex
+)
+
+// StartJobQueue requeues jobs left running by a previous process and starts
+// cfg.Workers workers
+func StartJobQueue(cfg JobQueueConfig) *JobQueue {
+	def := DefaultJobQueueConfig()
+	if cfg.Workers <= 0 {
+		cfg.Workers = def.Workers
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = def.BaseBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = def.MaxBackoff
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = def.PollInterval
+	}
+	if cfg.JobTimeout <= 0 {
+		cfg.JobTimeout = def.JobTimeout
+	}
+
+	// "publishing" is the status older builds used while running a job
+	if res, err := db.Exec(`UPDATE publish_jobs SET status = 'queued', progress = 0 WHERE status IN ('running', 'publishing')`); err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info("job queue: requeued interrupted jobs", "count", n)
+		}
+	}
+
+	q := &JobQueue{cfg: cfg, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	activeQueueMu.Lock()
+	activeQueue = q
+	activeQueueMu.Unlock()
+	return q
+}
+
+// Stop lets running jobs finish and stops the workers
+func (q *JobQueue) Stop() {
+	q.Drain(context.Background())
+}
+
+// Drain stops the workers from claiming jobs and waits for running ones to
+// finish until ctx is done. Jobs still running then are requeued the next
+// time a queue starts.
+func (q *JobQueue) Drain(ctx context.Context) error {
+	q.stopOnce.Do(func() { close(q.stop) })
+	activeQueueMu.Lock()
+	if activeQueue == q {
+		activeQueue = nil
+	}
+	activeQueueMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d jobs still running: %w", atomic.LoadInt32(&q.running), ctx.Err())
+	}
+}
+
+// wakeJobQueue tells an idle worker that a job was queued
+func wakeJobQueue() {
+	activeQueueMu.Lock()
+	q := activeQueue
+	activeQueueMu.Unlock()
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		job, err := claimJob()
+		if err != nil {
+			select {
+			case <-q.stop:
+				return
+			case <-q.wake:
+			case <-time.After(q.cfg.PollInterval):
+			}
+			continue
+		}
+		atomic.AddInt32(&q.running, 1)
+		publishJobEvent(job.ID, job.Kind, job.NodeID, job.ChannelID, "running", 10, "")
+		q.run(job)
+		atomic.AddInt32(&q.running, -1)
+	}
+}
+
+// claimJob atomically marks the oldest due queued job as running
+func claimJob() (*Job, error) {
+	if db == nil {
+		return nil, sql.ErrNoRows
+	}
+	now := time.Now().Unix()
+	var j Job
+	var version, channel, payload, retryOf sql.NullString
+	var maxAttempts sql.NullInt64
+	err := db.QueryRow(`
+		UPDATE publish_jobs SET status = 'running', progress = 10, started_at = ?, attempts = COALESCE(attempts, 0) + 1
+		WHERE id = (
+			SELECT id FROM publish_jobs
+			WHERE status = 'queued' AND COALESCE(next_run_at, 0) <= ?
+			ORDER BY created_at, id LIMIT 1
+		) AND status = 'queued'
+		RETURNING id, COALESCE(kind, 'publish'), node_id, version_id, channel_id, payload, attempts, max_attempts, created_at, retry_of`,
+		now, now).Scan(&j.ID, &j.Kind, &j.NodeID, &version, &channel, &payload, &j.Attempts, &maxAttempts, &j.CreatedAt, &retryOf)
+	if err != nil {
+		return nil, err
+	}
+	j.VersionID, j.ChannelID, j.RetryOf = version.String, channel.String, retryOf.String
+	if payload.Valid && payload.String != "" {
+		j.Payload = json.RawMessage(payload.String)
+	}
+	j.MaxAttempts = int(maxAttempts.Int64)
+	j.Status = "running"
+	return &j, nil
+}
+
+func (q *JobQueue) run(job *Job) {
+	timeout := q.cfg.JobTimeout
+	if d, ok := jobKindTimeouts[job.Kind]; ok {
+		timeout = d
+	}
+	ctx := context.WithValue(context.WithValue(context.Background(), queuedCall{}, true), runningJob{}, job)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := func() (result interface{}, err error) {
+		// A panicking handler must still leave a failed job behind
+		defer func() {
+			if p := recover(); p != nil {
+				err = Permanent(fmt.Errorf("job panicked: %v", p))
+			}
+		}()
+		h := jobHandler(job.Kind)
+		if h == nil {
+			return nil, Permanent(fmt.Errorf("no handler for job kind %q", job.Kind))
+		}
+		return h(ctx, job)
+	}()
+	q.finish(job, result, err)
+}
+
+// backoff is the delay before retry number attempt (1-based)
+func (q *JobQueue) backoff(attempt int) time.Duration {
+	d := q.cfg.BaseBackoff
+	for i := 1; i < attempt && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.cfg.MaxBackoff {
+		d = q.cfg.MaxBackoff
+	}
+	return d
+}
+
+func (q *JobQueue) finish(job *Job, result interface{}, err error) {
+	now := time.Now()
+	if err == nil {
+		resultJSON, _ := json.Marshal(result)
+		q.update(job, `UPDATE publish_jobs SET status = 'success', progress = 100, result = ?, error = NULL, completed_at = ? WHERE id = ?`,
+			string(resultJSON), now.Unix(), job.ID)
+		publishJobEvent(job.ID, job.Kind, job.NodeID, job.ChannelID, "success", 100, "")
+		return
+	}
+
+	maxAttempts := job.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = q.cfg.MaxAttempts
+	}
+	if isPermanent(err) || job.Attempts >= maxAttempts {
+		slog.Error("job failed", "job", job.ID, "kind", job.Kind, "attempts", job.Attempts, "error", err)
+		q.update(job, `UPDATE publish_jobs SET status = 'failed', progress = 100, error = ?, completed_at = ? WHERE id = ?`,
+			err.Error(), now.Unix(), job.ID)
+		publishJobEvent(job.ID, job.Kind, job.NodeID, job.ChannelID, "failed", 100, err.Error())
+		return
+	}
+	next := now.Add(q.backoff(job.Attempts))
+	q.update(job, `UPDATE publish_jobs SET status = 'queued', progress = 0, error = ?, next_run_at = ? WHERE id = ?`,
+		err.Error(), next.Unix(), job.ID)
+	publishJobEvent(job.ID, job.Kind, job.NodeID, job.ChannelID, "queued", 0, err.Error())
+	// sub-second backoffs would otherwise wait for the next poll
+	if d := time.Until(next); d < q.cfg.PollInterval {
+		time.AfterFunc(d, wakeJobQueue)
+	}
+}
+
+// update records a job's outcome; a job left "running" is only picked up
+// again after a restart, so a busy database is retried briefly
+func (q *JobQueue) update(job *Job, query string, args ...interface{}) {
+	var err error
+	for i := 0; i < 5; i++ {
+		if _, err = db.Exec(query, args...); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(i+1) * 50 * time.Millisecond)
+	}
+	slog.Error("failed to record job status", "job", job.ID, "error", err)
+}
+
+// EnqueueJob persists a job of kind with payload and wakes a worker
+func EnqueueJob(kind string, payload interface{}) (Job, error) {
+	if db == nil {
+		return Job{}, fmt.Errorf("plugins DB not configured")
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	j := Job{
+		ID:        ids.New("job"),
+		Kind:      kind,
+		Payload:   b,
+		Status:    "queued",
+		CreatedAt: time.Now().Unix(),
+	}
+	// publish_jobs requires a node and channel; other kinds leave them empty
+	if _, err := db.Exec(`INSERT INTO publish_jobs (id, kind, node_id, channel_id, payload, status, progress, created_at) VALUES (?, ?, '', '', ?, ?, 0, ?)`,
+		j.ID, j.Kind, string(b), j.Status, j.CreatedAt); err != nil {
+		return j, err
+	}
+	publishJobEvent(j.ID, j.Kind, "", "", j.Status, 0, "")
+	wakeJobQueue()
+	return j, nil
+}
+
+// runningJob is the context key of the job a handler is running
+type runningJob struct{}
+
+// ReportJobProgress records that the job running in ctx is percent done.
+// Running jobs start at 10, so percent is scaled into 10-99, and it does
+// nothing outside a job.
+func ReportJobProgress(ctx context.Context, percent int) {
+	job, ok := ctx.Value(runningJob{}).(*Job)
+	if !ok || db == nil {
+		return
+	}
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	progress := 10 + percent*89/100
+	if progress <= job.Progress {
+		return
+	}
+	job.Progress = progress
+	db.Exec(`UPDATE publish_jobs SET progress = ? WHERE id = ? AND status = 'running'`, progress, job.ID)
+	publishJobEvent(job.ID, job.Kind, job.NodeID, job.ChannelID, "running", progress, "")
+}
+
+// publishJobEvent announces a job's status on the event bus
+func publishJobEvent(id, kind, nodeID, channelID, status string, progress int, errMsg string) {
+	data := map[string]interface{}{"id": id, "kind": kind, "status": status, "progress": progress}
+	if nodeID != "" {
+		data["node_id"] = nodeID
+	}
+	if channelID != "" {
+		data["channel_id"] = channelID
+	}
+	if errMsg != "" {
+		data["error"] = errMsg
+	}
+	events.Publish(events.JobProgress, data)
+}
+
+// runPluginJob runs a plugin action in the background; payload is
+// {plugin, action, payload}
+func runPluginJob(ctx context.Context, job *Job) (interface{}, error) {
+	var req struct {
+		Plugin  string      `json:"plugin"`
+		Action  string      `json:"action"`
+		Payload interface{} `json:"payload"`
+	}
+	if err := json.Unmarshal(job.Payload, &req); err != nil || req.Plugin == "" || req.Action == "" {
+		return nil, Permanent(fmt.Errorf("plugin job needs plugin and action"))
+	}
+	if _, err := GetRegistry().Get(req.Plugin); err != nil {
+		return nil, Permanent(err)
+	}
+	return GetRegistry().Execute(ctx, req.Plugin, req.Action, req.Payload)
+}
+
+func scanJob(scan func(dest ...interface{}) error) (Job, error) {
+	var j Job
+	var version, channel, payload, result, errMsg, retryOf sql.NullString
+	var maxAttempts, started, completed, nextRun sql.NullInt64
+	err := scan(&j.ID, &j.Kind, &j.NodeID, &version, &channel, &payload, &j.Status, &j.Progress, &j.Attempts,
+		&maxAttempts, &result, &errMsg, &j.CreatedAt, &started, &completed, &nextRun, &retryOf)
+	if err != nil {
+		return j, err
+	}
+	j.VersionID, j.ChannelID, j.Error, j.RetryOf = version.String, channel.String, errMsg.String, retryOf.String
+	j.MaxAttempts = int(maxAttempts.Int64)
+	j.NextRunAt = nextRun.Int64
+	if payload.Valid && payload.String != "" {
+		j.Payload = json.RawMessage(payload.String)
+	}
+	if result.Valid && result.String != "" && result.String != "null" {
+		var v interface{}
+		if json.Unmarshal([]byte(result.String), &v) == nil {
+			j.Result = v
+		}
+	}
+	if started.Valid {
+		j.StartedAt = &started.Int64
+	}
+	if completed.Valid {
+		j.CompletedAt = &completed.Int64
+	}
+	return j, nil
+}
+
+const jobColumns = `id, COALESCE(kind, 'publish'), node_id, version_id, channel_id, payload, status, COALESCE(progress, 0),
+	COALESCE(attempts, 0), max_attempts, result, error, created_at, started_at, completed_at, next_run_at, retry_of`
+
+// HandleJobs serves GET /api/jobs?kind=&status=&limit=, the queue's status
+// (worker count, jobs per status) and its most recent jobs, and
+// GET /api/jobs/{id} for a single job
+func HandleJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/jobs"), "/"); id != "" {
+		j, err := scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM publish_jobs WHERE id = ?`, id).Scan)
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, "job not found")
+			return
+		}
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+
+	q := r.URL.Query()
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if kind := q.Get("kind"); kind != "" {
+		where = append(where, "COALESCE(kind, 'publish') = ?")
+		args = append(args, kind)
+	}
+	if status := q.Get("status"); status != "" {
+		where = append(where, "status = ?")
+		args = append(args, status)
+	}
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		fmt.Sscanf(l, "%d", &limit)
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 50
+	}
+
+	counts := map[string]int{}
+	crows, err := db.Query(`SELECT status, COUNT(*) FROM publish_jobs GROUP BY status`)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	for crows.Next() {
+		var status string
+		var n int
+		if err := crows.Scan(&status, &n); err != nil {
+			crows.Close()
+			apierror.Internal(w, r, err)
+			return
+		}
+		counts[status] = n
+	}
+	crows.Close()
+	if err := crows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	rows, err := db.Query(`SELECT `+jobColumns+` FROM publish_jobs WHERE `+strings.Join(where, " AND ")+
+		` ORDER BY created_at DESC, id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows.Scan)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	workers, busy := 0, 0
+	activeQueueMu.Lock()
+	if activeQueue != nil {
+		workers = activeQueue.cfg.Workers
+		busy = int(atomic.LoadInt32(&activeQueue.running))
+	}
+	activeQueueMu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"workers": workers,
+		"busy":    busy,
+		"counts":  counts,
+		"jobs":    jobs,
+	})
+}
@@ -0,0 +1,176 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func setupJobQueueDB(t *testing.T) *sql.DB {
+	d, err := sql.Open("sqlite", t.TempDir()+"/jobs.db?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	_, err = d.Exec(`CREATE TABLE publish_jobs (id TEXT PRIMARY KEY, node_id TEXT NOT NULL, version_id TEXT, channel_id TEXT NOT NULL,
+		status TEXT, progress INTEGER DEFAULT 0, result TEXT, error TEXT, created_at INTEGER NOT NULL, completed_at INTEGER,
+		retry_of TEXT, kind TEXT DEFAULT 'publish', payload TEXT, attempts INTEGER DEFAULT 0, max_attempts INTEGER,
+		next_run_at INTEGER DEFAULT 0, started_at INTEGER)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDB(d)
+	return d
+}
+
+func waitForJob(t *testing.T, d *sql.DB, id string) string {
+	for i := 0; i < 400; i++ {
+		var status string
+		d.QueryRow(`SELECT status FROM publish_jobs WHERE id = ?`, id).Scan(&status)
+		if status == "success" || status == "failed" {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return ""
+}
+
+func TestJobQueueRetriesWithBackoff(t *testing.T) {
+	d := setupJobQueueDB(t)
+
+	var calls int32
+	RegisterJobKind("test-flaky", func(ctx context.Context, j *Job) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return nil, errors.New("temporarily unavailable")
+		}
+		return map[string]int{"attempt": j.Attempts}, nil
+	})
+	RegisterJobKind("test-broken", func(ctx context.Context, j *Job) (interface{}, error) {
+		return nil, Permanent(errors.New("bad input"))
+	})
+
+	q := StartJobQueue(JobQueueConfig{Workers: 2, PollInterval: 5 * time.Millisecond, BaseBackoff: time.Millisecond})
+	defer q.Stop()
+
+	flaky, err := EnqueueJob("test-flaky", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, _ := EnqueueJob("test-broken", nil)
+	unknown, _ := EnqueueJob("test-unknown", nil)
+
+	if s := waitForJob(t, d, flaky.ID); s != "success" {
+		t.Fatalf("expected flaky job to succeed after retries, got %s", s)
+	}
+	var attempts int
+	var result string
+	d.QueryRow(`SELECT attempts, result FROM publish_jobs WHERE id = ?`, flaky.ID).Scan(&attempts, &result)
+	if attempts != 3 || result != `{"attempt":3}` {
+		t.Fatalf("expected 3 attempts, got %d (%s)", attempts, result)
+	}
+	for _, id := range []string{broken.ID, unknown.ID} {
+		if s := waitForJob(t, d, id); s != "failed" {
+			t.Fatalf("expected job %s to fail, got %s", id, s)
+		}
+		d.QueryRow(`SELECT attempts FROM publish_jobs WHERE id = ?`, id).Scan(&attempts)
+		if attempts != 1 {
+			t.Fatalf("expected permanent failure without retries, got %d attempts", attempts)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	HandleJobs(rr, httptest.NewRequest("GET", "/api/jobs?status=failed", nil))
+	var status struct {
+		Workers int            `json:"workers"`
+		Counts  map[string]int `json:"counts"`
+		Jobs    []Job          `json:"jobs"`
+	}
+	json.NewDecoder(rr.Body).Decode(&status)
+	if status.Workers != 2 || status.Counts["success"] != 1 || status.Counts["failed"] != 2 || len(status.Jobs) != 2 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+
+	rr = httptest.NewRecorder()
+	HandleJobs(rr, httptest.NewRequest("GET", "/api/jobs/"+broken.ID, nil))
+	var job Job
+	json.NewDecoder(rr.Body).Decode(&job)
+	if job.Error != "bad input" || job.Kind != "test-broken" || job.CompletedAt == nil {
+		t.Fatalf("unexpected job detail: %+v", job)
+	}
+}
+
+func TestJobQueueGivesUpAfterMaxAttempts(t *testing.T) {
+	d := setupJobQueueDB(t)
+	RegisterJobKind("test-down", func(ctx context.Context, j *Job) (interface{}, error) {
+		return nil, errors.New("still down")
+	})
+	q := StartJobQueue(JobQueueConfig{Workers: 1, MaxAttempts: 3, PollInterval: 5 * time.Millisecond, BaseBackoff: time.Millisecond})
+	defer q.Stop()
+
+	j, _ := EnqueueJob("test-down", nil)
+	if s := waitForJob(t, d, j.ID); s != "failed" {
+		t.Fatalf("expected job to fail, got %s", s)
+	}
+	var attempts int
+	d.QueryRow(`SELECT attempts FROM publish_jobs WHERE id = ?`, j.ID).Scan(&attempts)
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestJobQueueRecoversInterruptedJobs(t *testing.T) {
+	d := setupJobQueueDB(t)
+	RegisterJobKind("test-ok", func(ctx context.Context, j *Job) (interface{}, error) { return "done", nil })
+	// left running by a process that exited mid-job
+	d.Exec(`INSERT INTO publish_jobs (id, kind, node_id, channel_id, status, attempts, created_at) VALUES ('stale', 'test-ok', '', '', 'running', 1, 1)`)
+
+	q := StartJobQueue(JobQueueConfig{Workers: 1, PollInterval: 5 * time.Millisecond})
+	defer q.Stop()
+	if s := waitForJob(t, d, "stale"); s != "success" {
+		t.Fatalf("expected interrupted job to be resumed, got %s", s)
+	}
+}
+
+func TestJobQueueDrain(t *testing.T) {
+	d := setupJobQueueDB(t)
+	release := make(chan struct{})
+	RegisterJobKind("test-slow", func(ctx context.Context, j *Job) (interface{}, error) {
+		<-release
+		return "done", nil
+	})
+	q := StartJobQueue(JobQueueConfig{Workers: 1, PollInterval: 5 * time.Millisecond})
+	j, _ := EnqueueJob("test-slow", nil)
+	for i := 0; i < 400 && atomic.LoadInt32(&q.running) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("draining past the deadline should report the running job: %v", err)
+	}
+	close(release)
+	if err := q.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitForJob(t, d, j.ID); s != "success" {
+		t.Fatalf("the running job should finish while draining, got %s", s)
+	}
+}
+
+func TestJobQueueBackoff(t *testing.T) {
+	q := &JobQueue{cfg: JobQueueConfig{BaseBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 9: 10 * time.Second} {
+		if got := q.backoff(attempt); got != want {
+			t.Fatalf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
@@ -1,15 +1,21 @@
 package plugins
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === Media Pipeline Plugin ===
@@ -19,6 +25,7 @@ type MediaPlugin struct {
 	version    string
 	outputDir  string
 	ffmpegPath string
+	presets    map[string]MediaPreset
 	repo       *codex.Repository
 }
 
@@ -29,6 +36,7 @@ func NewMediaPlugin(outputDir string) *MediaPlugin {
 		version:    "1.0.0",
 		outputDir:  outputDir,
 		ffmpegPath: ffmpeg,
+		presets:    DefaultMediaPresets(),
 	}
 }
 
@@ -40,6 +48,11 @@ func (mp *MediaPlugin) Version() string {
 	return mp.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (mp *MediaPlugin) Capabilities() []string {
+	return []string{CapExec, CapDBWrite}
+}
+
 func (mp *MediaPlugin) Initialize(config map[string]interface{}) error {
 	if dir, ok := config["output_dir"].(string); ok {
 		mp.outputDir = dir
@@ -50,6 +63,21 @@ func (mp *MediaPlugin) Initialize(config map[string]interface{}) error {
 		mp.ffmpegPath = ffmpeg
 	}
 
+	// presets from config add to the defaults or replace them by name
+	if raw, ok := config["presets"]; ok {
+		b, _ := json.Marshal(raw)
+		var presets map[string]MediaPreset
+		if err := json.Unmarshal(b, &presets); err != nil {
+			return fmt.Errorf("presets: %v", err)
+		}
+		for name, p := range presets {
+			if p.Format == "" {
+				return fmt.Errorf("preset %s: format is required", name)
+			}
+			mp.presets[name] = p
+		}
+	}
+
 	return nil
 }
 
@@ -79,6 +107,8 @@ func (mp *MediaPlugin) Execute(ctx context.Context, action string, payload inter
 		return mp.extractMetadata(ctx, payload)
 	case "optimize_image":
 		return mp.optimizeImage(ctx, payload)
+	case "presets":
+		return map[string]interface{}{"presets": mp.presets}, nil
 	default:
 		return nil, fmt.Errorf("unknown action: %s", action)
 	}
@@ -94,6 +124,176 @@ func (mp *MediaPlugin) AttachRepository(r *codex.Repository) error {
 	return nil
 }
 
+// === Presets ===
+
+// MediaPreset is a named set of encoding settings. Kind is video, audio
+// (drops the video stream) or image (a single frame, without audio).
+type MediaPreset struct {
+	Kind         string `json:"kind"`
+	Format       string `json:"format"` // output extension: mp4, mp3, webp...
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"` // 0 keeps the aspect ratio
+	VideoCodec   string `json:"video_codec,omitempty"`
+	VideoBitrate string `json:"video_bitrate,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	SampleRate   int    `json:"sample_rate,omitempty"`
+	Channels     int    `json:"channels,omitempty"`
+	Quality      int    `json:"quality,omitempty"` // -q:v
+	Seek         string `json:"seek,omitempty"`    // start position, such as 00:00:01
+}
+
+// DefaultMediaPresets are the presets every media plugin starts with
+func DefaultMediaPresets() map[string]MediaPreset {
+	return map[string]MediaPreset{
+		"web-720p": {Kind: "video", Format: "mp4", Height: 720, VideoCodec: "libx264", VideoBitrate: "2500k",
+			AudioCodec: "aac", AudioBitrate: "128k"},
+		"podcast-mp3": {Kind: "audio", Format: "mp3", AudioCodec: "libmp3lame", AudioBitrate: "96k",
+			SampleRate: 44100, Channels: 1},
+		"webp-thumbnail": {Kind: "image", Format: "webp", Width: 320, Quality: 80, Seek: "00:00:01"},
+	}
+}
+
+// args are the ffmpeg arguments encoding input to output with p
+func (p MediaPreset) args(input, output string) []string {
+	var args []string
+	if p.Seek != "" {
+		args = append(args, "-ss", p.Seek)
+	}
+	args = append(args, "-i", input)
+	switch p.Kind {
+	case "audio":
+		args = append(args, "-vn")
+	case "image":
+		args = append(args, "-frames:v", "1", "-an")
+	}
+	if p.Width > 0 || p.Height > 0 {
+		w, h := p.Width, p.Height
+		if w == 0 {
+			w = -2
+		}
+		if h == 0 {
+			h = -2
+		}
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:%d", w, h))
+	}
+	for _, opt := range []struct{ flag, value string }{
+		{"-c:v", p.VideoCodec}, {"-b:v", p.VideoBitrate}, {"-c:a", p.AudioCodec}, {"-b:a", p.AudioBitrate},
+	} {
+		if opt.value != "" {
+			args = append(args, opt.flag, opt.value)
+		}
+	}
+	if p.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(p.SampleRate))
+	}
+	if p.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(p.Channels))
+	}
+	if p.Quality > 0 {
+		args = append(args, "-q:v", strconv.Itoa(p.Quality))
+	}
+	return append(args, "-y", output)
+}
+
+// requestPreset looks up the preset a request names, if any
+func (mp *MediaPlugin) requestPreset(req map[string]interface{}) (string, *MediaPreset, error) {
+	name, _ := req["preset"].(string)
+	if name == "" {
+		return "", nil, nil
+	}
+	p, ok := mp.presets[name]
+	if !ok {
+		return name, nil, fmt.Errorf("unknown preset: %s", name)
+	}
+	return name, &p, nil
+}
+
+// === FFmpeg Progress ===
+
+var ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d\d):(\d\d(?:\.\d+)?)`)
+
+// ffmpegLog collects ffmpeg's stderr: the input's duration, once it has
+// been printed, and the last few KB for error messages
+type ffmpegLog struct {
+	mu       sync.Mutex
+	header   []byte
+	tail     []byte
+	duration time.Duration
+}
+
+func (l *ffmpegLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.duration == 0 && len(l.header) < 64<<10 {
+		l.header = append(l.header, p...)
+		if m := ffmpegDuration.FindSubmatch(l.header); m != nil {
+			h, _ := strconv.Atoi(string(m[1]))
+			min, _ := strconv.Atoi(string(m[2]))
+			sec, _ := strconv.ParseFloat(string(m[3]), 64)
+			l.duration = time.Duration(h)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec*float64(time.Second))
+			l.header = nil
+		}
+	}
+	l.tail = append(l.tail, p...)
+	if len(l.tail) > 4<<10 {
+		l.tail = l.tail[len(l.tail)-4<<10:]
+	}
+	return len(p), nil
+}
+
+func (l *ffmpegLog) Duration() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.duration
+}
+
+// lastLine is ffmpeg's last message, usually the reason it failed
+func (l *ffmpegLog) lastLine() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines := strings.Split(strings.TrimSpace(string(l.tail)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// runFFmpeg runs ffmpeg with args. On the job queue, the job's progress
+// follows the share of the input encoded so far.
+func (mp *MediaPlugin) runFFmpeg(ctx context.Context, args []string) error {
+	cmd := pluginCommand(ctx, mp.ffmpegPath, append([]string{"-nostats", "-progress", "pipe:1"}, args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &ffmpegLog{}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// -progress writes key=value lines; out_time_ms is in microseconds too
+	sc := bufio.NewScanner(stdout)
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), "=")
+		switch key {
+		case "out_time_us", "out_time_ms":
+			us, err := strconv.ParseInt(value, 10, 64)
+			if d := stderr.Duration(); err == nil && d > 0 {
+				ReportJobProgress(ctx, int(time.Duration(us)*time.Microsecond*100/d))
+			}
+		case "progress":
+			if value == "end" {
+				ReportJobProgress(ctx, 100)
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		if msg := stderr.lastLine(); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
 // Actions
 
 type EncodeVideoRequest struct {
@@ -103,91 +303,65 @@ type EncodeVideoRequest struct {
 	Quality    string `json:"quality"` // high, medium, low
 	Width      int    `json:"width"`
 	Height     int    `json:"height"`
+	Preset     string `json:"preset"` // replaces the other settings
 }
 
+// encodeVideo queues the encode as a media_transcode job, which calls it
+// again from the job queue to run ffmpeg
 func (mp *MediaPlugin) encodeVideo(ctx context.Context, payload interface{}) (interface{}, error) {
 	req, ok := payload.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("invalid payload")
 	}
-
-	inputPath := req["input_path"].(string)
-	format := req["format"].(string)
-	if format == "" {
-		format = "mp4"
+	inputPath, _ := req["input_path"].(string)
+	if inputPath == "" {
+		return nil, fmt.Errorf("input_path is required")
 	}
-
-	width := 1920
-	height := 1080
-	bitrate := "5000k"
-
-	if w, ok := req["width"].(float64); ok {
-		width = int(w)
+	presetName, preset, err := mp.requestPreset(req)
+	if err != nil {
+		return nil, err
 	}
-	if h, ok := req["height"].(float64); ok {
-		height = int(h)
+	if ctx.Value(queuedCall{}) == nil {
+		return mp.enqueue("encode_video", req)
 	}
 
-	quality := req["quality"].(string)
-	if quality == "low" {
-		bitrate = "1000k"
-	} else if quality == "medium" {
-		bitrate = "2500k"
+	quality, _ := req["quality"].(string)
+	if preset == nil {
+		format, _ := req["format"].(string)
+		if format == "" {
+			format = "mp4"
+		}
+		bitrate := "5000k"
+		if quality == "low" {
+			bitrate = "1000k"
+		} else if quality == "medium" {
+			bitrate = "2500k"
+		}
+		preset = &MediaPreset{Kind: "video", Format: format, Width: 1920, Height: 1080,
+			VideoCodec: "libx264", VideoBitrate: bitrate, AudioCodec: "aac"}
+		if w, ok := req["width"].(float64); ok {
+			preset.Width = int(w)
+		}
+		if h, ok := req["height"].(float64); ok {
+			preset.Height = int(h)
+		}
 	}
 
 	// Generate output path
-	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outputPath := filepath.Join(mp.outputDir, fmt.Sprintf("%s_encoded.%s", baseName, format))
-
-	// FFmpeg command
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath,
-		"-i", inputPath,
-		"-vf", fmt.Sprintf("scale=%d:%d", width, height),
-		"-b:v", bitrate,
-		"-c:v", "libx264",
-		"-c:a", "aac",
-		"-y",
-		outputPath,
-	)
-
-	if err := cmd.Run(); err != nil {
+	outputPath := mp.outputPath(inputPath, presetName, "_encoded", preset.Format)
+	if err := mp.runFFmpeg(ctx, preset.args(inputPath, outputPath)); err != nil {
 		return nil, fmt.Errorf("encoding failed: %v", err)
 	}
 
 	// Store record
 	now := time.Now().Unix()
-	db.Exec(`
+	pluginDB(ctx).Exec(`
 		INSERT INTO media_conversions (id, input_path, output_path, format, quality, created_at)
 		VALUES (?, ?, ?, ?, ?, ?)
-	`, fmt.Sprintf("conv_%d", now), inputPath, outputPath, format, quality, now)
-
-	// If repository attached, stream the output into codex and create a commit
-	if mp.repo != nil {
-		f, err := os.Open(outputPath)
-		if err == nil {
-			defer f.Close()
-			contentType := "video/mp4"
-			if format != "mp4" {
-				contentType = fmt.Sprintf("video/%s", format)
-			}
-			if objHash, err2 := mp.repo.PutObjectStreamWithFilename(f, contentType, filepath.Base(outputPath)); err2 == nil {
-				commit := &codex.Commit{
-					Parents:   []string{},
-					Author:    "media_plugin",
-					Timestamp: time.Now().UTC(),
-					Message:   fmt.Sprintf("Encoded media: %s", filepath.Base(outputPath)),
-					Objects:   []string{objHash},
-				}
-				_ = mp.repo.PutCommit(commit)
-			}
-		}
-	}
+	`, ids.New("conv"), inputPath, outputPath, preset.Format, quality, now)
 
-	return map[string]interface{}{
-		"status":      "encoded",
-		"output_path": outputPath,
-		"format":      format,
-	}, nil
+	mp.storeOutput(outputPath, preset.Format, "Encoded media")
+	return encodeResult(outputPath, presetName, preset), nil
 }
 
 type EncodeAudioRequest struct {
@@ -195,69 +369,120 @@ type EncodeAudioRequest struct {
 	Format     string `json:"format"` // mp3, m4a, ogg, flac
 	Bitrate    string `json:"bitrate"`
 	SampleRate int    `json:"sample_rate"`
+	Preset     string `json:"preset"` // replaces the other settings
 }
 
+// encodeAudio queues the encode like encodeVideo
 func (mp *MediaPlugin) encodeAudio(ctx context.Context, payload interface{}) (interface{}, error) {
 	req, ok := payload.(map[string]interface{})
 	if !ok {
 		return nil, fmt.Errorf("invalid payload")
 	}
+	inputPath, _ := req["input_path"].(string)
+	if inputPath == "" {
+		return nil, fmt.Errorf("input_path is required")
+	}
+	presetName, preset, err := mp.requestPreset(req)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Value(queuedCall{}) == nil {
+		return mp.enqueue("encode_audio", req)
+	}
 
-	inputPath := req["input_path"].(string)
-	format := req["format"].(string)
-	if format == "" {
-		format = "mp3"
+	if preset == nil {
+		format, _ := req["format"].(string)
+		if format == "" {
+			format = "mp3"
+		}
+		preset = &MediaPreset{Kind: "audio", Format: format, AudioBitrate: "192k"}
+		if b, ok := req["bitrate"].(string); ok && b != "" {
+			preset.AudioBitrate = b
+		}
+		if sr, ok := req["sample_rate"].(float64); ok {
+			preset.SampleRate = int(sr)
+		}
 	}
 
-	bitrate := "192k"
-	if b, ok := req["bitrate"].(string); ok {
-		bitrate = b
+	outputPath := mp.outputPath(inputPath, presetName, "", preset.Format)
+	if err := mp.runFFmpeg(ctx, preset.args(inputPath, outputPath)); err != nil {
+		return nil, fmt.Errorf("audio encoding failed: %v", err)
 	}
 
-	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
-	outputPath := filepath.Join(mp.outputDir, fmt.Sprintf("%s.%s", baseName, format))
+	mp.storeOutput(outputPath, preset.Format, "Encoded audio")
+	return encodeResult(outputPath, presetName, preset), nil
+}
 
-	// FFmpeg command
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath,
-		"-i", inputPath,
-		"-b:a", bitrate,
-		"-y",
-		outputPath,
-	)
+// enqueue runs action on the job queue and answers with the queued job,
+// whose progress follows ffmpeg's
+func (mp *MediaPlugin) enqueue(action string, payload interface{}) (interface{}, error) {
+	job, err := EnqueueJob(JobKindMediaTranscode, map[string]interface{}{"plugin": mp.name, "action": action, "payload": payload})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"status": "queued", "job": job}, nil
+}
 
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("audio encoding failed: %v", err)
+// outputPath names the output of encoding inputPath: <name>_<preset>.<format>
+// with a preset, otherwise <name><suffix>.<format>
+func (mp *MediaPlugin) outputPath(inputPath, preset, suffix, format string) string {
+	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	if preset != "" {
+		suffix = "_" + preset
 	}
+	return filepath.Join(mp.outputDir, fmt.Sprintf("%s%s.%s", baseName, suffix, format))
+}
 
-	// If repository attached, stream the audio output into codex and create a commit
-	if mp.repo != nil {
-		f, err := os.Open(outputPath)
-		if err == nil {
-			defer f.Close()
-			contentType := "audio/mpeg"
-			if format == "ogg" {
-				contentType = "audio/ogg"
-			} else if format == "flac" {
-				contentType = "audio/flac"
-			}
-			if objHash, err2 := mp.repo.PutObjectStreamWithFilename(f, contentType, filepath.Base(outputPath)); err2 == nil {
-				commit := &codex.Commit{
-					Parents:   []string{},
-					Author:    "media_plugin",
-					Timestamp: time.Now().UTC(),
-					Message:   fmt.Sprintf("Encoded audio: %s", filepath.Base(outputPath)),
-					Objects:   []string{objHash},
-				}
-				_ = mp.repo.PutCommit(commit)
-			}
+// storeOutput streams an output into codex and commits it when a
+// repository is attached
+func (mp *MediaPlugin) storeOutput(outputPath, format, message string) {
+	if mp.repo == nil {
+		return
+	}
+	f, err := os.Open(outputPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if objHash, err := mp.repo.PutObjectStreamWithFilename(f, mediaContentType(format), filepath.Base(outputPath)); err == nil {
+		commit := &codex.Commit{
+			Parents:   []string{},
+			Author:    "media_plugin",
+			Timestamp: time.Now().UTC(),
+			Message:   fmt.Sprintf("%s: %s", message, filepath.Base(outputPath)),
+			Objects:   []string{objHash},
 		}
+		_ = mp.repo.PutCommit(commit)
 	}
+}
 
-	return map[string]interface{}{
+// mediaContentType is the content type of an encoded format
+func mediaContentType(format string) string {
+	switch format {
+	case "mp3":
+		return "audio/mpeg"
+	case "m4a":
+		return "audio/mp4"
+	case "ogg", "flac", "wav", "opus":
+		return "audio/" + format
+	case "webp", "png", "gif":
+		return "image/" + format
+	case "jpg", "jpeg":
+		return "image/jpeg"
+	}
+	return "video/" + format
+}
+
+func encodeResult(outputPath, presetName string, preset *MediaPreset) map[string]interface{} {
+	result := map[string]interface{}{
 		"status":      "encoded",
 		"output_path": outputPath,
-		"format":      format,
-	}, nil
+		"format":      preset.Format,
+	}
+	if presetName != "" {
+		result["preset"] = presetName
+	}
+	return result
 }
 
 type ThumbnailRequest struct {
@@ -265,6 +490,7 @@ type ThumbnailRequest struct {
 	Timestamp string `json:"timestamp"` // 00:00:05
 	Width     int    `json:"width"`
 	Height    int    `json:"height"`
+	Preset    string `json:"preset"` // such as webp-thumbnail
 }
 
 func (mp *MediaPlugin) generateThumbnail(ctx context.Context, payload interface{}) (interface{}, error) {
@@ -273,8 +499,24 @@ func (mp *MediaPlugin) generateThumbnail(ctx context.Context, payload interface{
 		return nil, fmt.Errorf("invalid payload")
 	}
 
-	inputPath := req["input_path"].(string)
-	timestamp := req["timestamp"].(string)
+	inputPath, _ := req["input_path"].(string)
+	if inputPath == "" {
+		return nil, fmt.Errorf("input_path is required")
+	}
+	presetName, preset, err := mp.requestPreset(req)
+	if err != nil {
+		return nil, err
+	}
+	if preset != nil {
+		outputPath := mp.outputPath(inputPath, presetName, "", preset.Format)
+		if err := mp.runFFmpeg(ctx, preset.args(inputPath, outputPath)); err != nil {
+			return nil, fmt.Errorf("thumbnail generation failed: %v", err)
+		}
+		mp.storeOutput(outputPath, preset.Format, "Generated thumbnail")
+		return map[string]interface{}{"status": "generated", "path": outputPath, "preset": presetName}, nil
+	}
+
+	timestamp, _ := req["timestamp"].(string)
 	if timestamp == "" {
 		timestamp = "00:00:05"
 	}
@@ -291,7 +533,7 @@ func (mp *MediaPlugin) generateThumbnail(ctx context.Context, payload interface{
 	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
 	outputPath := filepath.Join(mp.outputDir, fmt.Sprintf("%s_thumb.jpg", baseName))
 
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath,
+	cmd := pluginCommand(ctx, mp.ffmpegPath,
 		"-ss", timestamp,
 		"-i", inputPath,
 		"-vf", fmt.Sprintf("scale=%d:%d", width, height),
@@ -304,23 +546,7 @@ func (mp *MediaPlugin) generateThumbnail(ctx context.Context, payload interface{
 		return nil, fmt.Errorf("thumbnail generation failed: %v", err)
 	}
 
-	// If repository attached, store thumbnail in codex
-	if mp.repo != nil {
-		f, err := os.Open(outputPath)
-		if err == nil {
-			defer f.Close()
-			if objHash, err2 := mp.repo.PutObjectStreamWithFilename(f, "image/jpeg", filepath.Base(outputPath)); err2 == nil {
-				commit := &codex.Commit{
-					Parents:   []string{},
-					Author:    "media_plugin",
-					Timestamp: time.Now().UTC(),
-					Message:   fmt.Sprintf("Generated thumbnail: %s", filepath.Base(outputPath)),
-					Objects:   []string{objHash},
-				}
-				_ = mp.repo.PutCommit(commit)
-			}
-		}
-	}
+	mp.storeOutput(outputPath, "jpg", "Generated thumbnail")
 
 	return map[string]interface{}{
 		"status": "generated",
@@ -345,7 +571,7 @@ func (mp *MediaPlugin) transcode(ctx context.Context, payload interface{}) (inte
 	baseName := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
 	outputPath := filepath.Join(mp.outputDir, fmt.Sprintf("%s.%s", baseName, outputFormat))
 
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath,
+	cmd := pluginCommand(ctx, mp.ffmpegPath,
 		"-i", inputPath,
 		"-y",
 		outputPath,
@@ -374,7 +600,7 @@ func (mp *MediaPlugin) extractMetadata(ctx context.Context, payload interface{})
 
 	filePath := req["file_path"].(string)
 
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath, "-i", filePath)
+	cmd := pluginCommand(ctx, mp.ffmpegPath, "-i", filePath)
 	_ = cmd.Run() // Metadata extraction
 
 	// FFprobe would be better, but we work with what we have
@@ -409,7 +635,7 @@ func (mp *MediaPlugin) optimizeImage(ctx context.Context, payload interface{}) (
 	outputPath := filepath.Join(mp.outputDir, fmt.Sprintf("%s_opt.jpg", baseName))
 
 	// Use ffmpeg for image optimization
-	cmd := exec.CommandContext(ctx, mp.ffmpegPath,
+	cmd := pluginCommand(ctx, mp.ffmpegPath,
 		"-i", inputPath,
 		"-q:v", fmt.Sprintf("%d", quality),
 		"-y",
@@ -0,0 +1,127 @@
+package plugins
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"veil/pkg/events"
+)
+
+// fakeFFmpeg reports a 10 second input, writes two progress updates and
+// the output, and records its arguments in args.txt. It waits for the
+// duration to be read, like ffmpeg opening its output.
+const fakeFFmpeg = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$@" > "$dir/args.txt"
+echo "  Duration: 00:00:10.00, start: 0.000000, bitrate: 800 kb/s" >&2
+sleep 0.2
+echo "out_time_us=2500000"
+echo "progress=continue"
+echo "out_time_us=5000000"
+echo "progress=continue"
+for last; do :; done
+echo encoded > "$last"
+echo "progress=end"
+`
+
+func TestMediaPresetArgs(t *testing.T) {
+	presets := DefaultMediaPresets()
+	got := presets["web-720p"].args("in.mov", "out.mp4")
+	want := []string{"-i", "in.mov", "-vf", "scale=-2:720", "-c:v", "libx264", "-b:v", "2500k", "-c:a", "aac", "-b:a", "128k", "-y", "out.mp4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("web-720p:\n got  %v\n want %v", got, want)
+	}
+	got = presets["webp-thumbnail"].args("in.mov", "out.webp")
+	want = []string{"-ss", "00:00:01", "-i", "in.mov", "-frames:v", "1", "-an", "-vf", "scale=320:-2", "-q:v", "80", "-y", "out.webp"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("webp-thumbnail:\n got  %v\n want %v", got, want)
+	}
+
+	mp := NewMediaPlugin(t.TempDir())
+	if err := mp.Initialize(map[string]interface{}{"presets": map[string]interface{}{
+		"podcast-mp3": map[string]interface{}{"kind": "audio", "format": "mp3", "audio_bitrate": "64k"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if p := mp.presets["podcast-mp3"]; p.AudioBitrate != "64k" || p.SampleRate != 0 || len(mp.presets) != 3 {
+		t.Fatalf("config should replace the preset: %+v", mp.presets)
+	}
+	if err := mp.Initialize(map[string]interface{}{"presets": map[string]interface{}{"broken": map[string]interface{}{}}}); err == nil {
+		t.Fatal("a preset without a format should be refused")
+	}
+}
+
+func TestMediaEncodeRunsAsJob(t *testing.T) {
+	d := setupJobQueueDB(t)
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mp := NewMediaPlugin(filepath.Join(dir, "out"))
+	mp.Initialize(map[string]interface{}{"output_dir": filepath.Join(dir, "out"), "ffmpeg_path": ffmpeg})
+	if err := GetRegistry().Register(mp); err != nil {
+		t.Fatal(err)
+	}
+	defer GetRegistry().Unregister("media")
+
+	if _, err := GetRegistry().Execute(context.Background(), "media", "encode_video", map[string]interface{}{"input_path": "talk.mov", "preset": "web-1080p"}); err == nil || !strings.Contains(err.Error(), "unknown preset") {
+		t.Fatalf("an unknown preset should be refused before queueing: %v", err)
+	}
+
+	sub := events.Subscribe(64, events.JobProgress)
+	defer sub.Close()
+	q := StartJobQueue(JobQueueConfig{Workers: 1, PollInterval: 5 * time.Millisecond})
+	defer q.Stop()
+
+	res, err := GetRegistry().Execute(context.Background(), "media", "encode_video", map[string]interface{}{"input_path": "talk.mov", "preset": "web-720p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := res.(map[string]interface{})
+	job, ok := queued["job"].(Job)
+	if queued["status"] != "queued" || !ok || job.Kind != JobKindMediaTranscode {
+		t.Fatalf("encode_video should answer with a queued job: %+v", res)
+	}
+	if s := waitForJob(t, d, job.ID); s != "success" {
+		var msg string
+		d.QueryRow(`SELECT error FROM publish_jobs WHERE id = ?`, job.ID).Scan(&msg)
+		t.Fatalf("transcode job %s: %s", s, msg)
+	}
+
+	var result string
+	d.QueryRow(`SELECT result FROM publish_jobs WHERE id = ?`, job.ID).Scan(&result)
+	out := filepath.Join(dir, "out", "talk_web-720p.mp4")
+	if !strings.Contains(result, `"preset":"web-720p"`) || !strings.Contains(result, out) {
+		t.Fatalf("unexpected job result: %s", result)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Fatalf("output was not written: %v", err)
+	}
+	args, _ := os.ReadFile(filepath.Join(dir, "args.txt"))
+	if !strings.HasPrefix(string(args), "-nostats -progress pipe:1 -i talk.mov -vf scale=-2:720 -c:v libx264") {
+		t.Fatalf("unexpected ffmpeg arguments: %s", args)
+	}
+
+	// 25% and 50% of the input, then the end, scaled into the running range
+	var progress []int
+	for len(progress) == 0 || progress[len(progress)-1] != 100 {
+		select {
+		case ev := <-sub.C:
+			data := ev.Data.(map[string]interface{})
+			if data["id"] == job.ID {
+				progress = append(progress, data["progress"].(int))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing progress events, got %v", progress)
+		}
+	}
+	if want := []int{0, 10, 32, 54, 99, 100}; !reflect.DeepEqual(progress, want) {
+		t.Fatalf("progress %v, want %v", progress, want)
+	}
+}
@@ -5,9 +5,10 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
+	"time"
 	"veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === Namecheap DNS Plugin ===
@@ -20,6 +21,7 @@ type NamecheapPlugin struct {
 	username string
 	clientIP string
 	repo     *codex.Repository
+	pc       *PluginContext
 }
 
 func NewNamecheapPlugin() *NamecheapPlugin {
@@ -38,14 +40,28 @@ func (nc *NamecheapPlugin) Version() string {
 	return nc.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (nc *NamecheapPlugin) Capabilities() []string {
+	return []string{CapNetwork, CapDBRead, CapDBWrite, CapCredentials}
+}
+
+// AttachContext receives the plugin's credential scope from the registry
+func (nc *NamecheapPlugin) AttachContext(pc *PluginContext) {
+	nc.pc = pc
+}
+
 func (nc *NamecheapPlugin) Initialize(config map[string]interface{}) error {
 	if apiKey, ok := config["api_key"].(string); ok {
-		credentialMgr.StoreCredential("namecheap_api_key", apiKey)
+		if nc.pc != nil {
+			nc.pc.StoreCredential("namecheap_api_key", apiKey)
+		}
 		nc.apiKey = apiKey
 	}
 
 	if username, ok := config["username"].(string); ok {
-		credentialMgr.StoreCredential("namecheap_username", username)
+		if nc.pc != nil {
+			nc.pc.StoreCredential("namecheap_username", username)
+		}
 		nc.username = username
 	}
 
@@ -66,12 +82,12 @@ func (nc *NamecheapPlugin) Validate() error {
 
 func (nc *NamecheapPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
 	// Load credentials
-	if nc.apiKey == "" {
-		key, _ := credentialMgr.GetCredential("namecheap_api_key")
+	if nc.apiKey == "" && nc.pc != nil {
+		key, _ := nc.pc.Credential("namecheap_api_key")
 		nc.apiKey = key
 	}
-	if nc.username == "" {
-		user, _ := credentialMgr.GetCredential("namecheap_username")
+	if nc.username == "" && nc.pc != nil {
+		user, _ := nc.pc.Credential("namecheap_username")
 		nc.username = user
 	}
 
@@ -138,7 +154,7 @@ func (nc *NamecheapPlugin) listDomains(ctx context.Context) (interface{}, error)
 	params.Set("Command", "namecheap.domains.getList")
 	params.Set("ClientIp", nc.clientIP)
 
-	resp, err := http.Get(nc.apiURL + "?" + params.Encode())
+	resp, err := pluginHTTP(ctx).Get(nc.apiURL + "?" + params.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("api call failed: %v", err)
 	}
@@ -178,7 +194,7 @@ func (nc *NamecheapPlugin) getDNSRecords(ctx context.Context, payload interface{
 	params.Set("Domain", domain)
 	params.Set("ClientIp", nc.clientIP)
 
-	resp, err := http.Get(nc.apiURL + "?" + params.Encode())
+	resp, err := pluginHTTP(ctx).Get(nc.apiURL + "?" + params.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("api call failed: %v", err)
 	}
@@ -228,18 +244,18 @@ func (nc *NamecheapPlugin) setDNSRecord(ctx context.Context, payload interface{}
 	params.Set("TTL1", ttl)
 	params.Set("ClientIp", nc.clientIP)
 
-	resp, err := http.Get(nc.apiURL + "?" + params.Encode())
+	resp, err := pluginHTTP(ctx).Get(nc.apiURL + "?" + params.Encode())
 	if err != nil {
 		return nil, fmt.Errorf("api call failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Store DNS record locally
-	now := int64(0)
-	db.Exec(`
+	now := time.Now().Unix()
+	pluginDB(ctx).Exec(`
 		INSERT INTO dns_records (id, domain, hostname, record_type, address, ttl, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, fmt.Sprintf("dns_%d", now), domain, hostname, recordType, address, ttl, now)
+	`, ids.New("dns"), domain, hostname, recordType, address, ttl, now)
 
 	return map[string]string{"status": "created"}, nil
 }
@@ -258,7 +274,7 @@ func (nc *NamecheapPlugin) deleteDNSRecord(ctx context.Context, payload interfac
 	recordID := req["record_id"].(string)
 
 	// Delete from database
-	db.Exec(`DELETE FROM dns_records WHERE id = ?`, recordID)
+	pluginDB(ctx).Exec(`DELETE FROM dns_records WHERE id = ?`, recordID)
 
 	return map[string]string{"status": "deleted"}, nil
 }
@@ -302,7 +318,7 @@ func (nc *NamecheapPlugin) getSubdomains(ctx context.Context, payload interface{
 	domain := req["domain"].(string)
 
 	var subdomains []map[string]interface{}
-	rows, _ := db.Query(`
+	rows, _ := pluginDB(ctx).Query(`
 		SELECT hostname, record_type, address, ttl FROM dns_records WHERE domain = ?
 	`, domain)
 	defer rows.Close()
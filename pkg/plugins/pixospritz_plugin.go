@@ -10,6 +10,7 @@ import (
 	"strings"
 	"time"
 	"veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === Pixospritz Game Engine Plugin ===
@@ -41,6 +42,11 @@ func (pp *PixospritzPlugin) Version() string {
 	return pp.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (pp *PixospritzPlugin) Capabilities() []string {
+	return []string{CapNetwork, CapDBRead, CapDBWrite}
+}
+
 func (pp *PixospritzPlugin) Initialize(config map[string]interface{}) error {
 	if url, ok := config["server_url"].(string); ok {
 		pp.serverURL = url
@@ -145,10 +151,10 @@ func (pp *PixospritzPlugin) embedGame(ctx context.Context, payload interface{})
 		pp.serverURL, gameID)
 
 	// Store in database
-	now := int64(0)
-	embedID := fmt.Sprintf("embed_%d", now)
+	now := time.Now().Unix()
+	embedID := ids.New("embed")
 
-	db.Exec(`
+	pluginDB(ctx).Exec(`
 		INSERT INTO game_embeds (id, node_id, game_id, title, description, embed_code, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`, embedID, nodeID, gameID, title, description, embedCode, now)
@@ -204,7 +210,7 @@ func (pp *PixospritzPlugin) getScores(ctx context.Context, payload interface{})
 
 	query += ` ORDER BY score DESC LIMIT 100`
 
-	rows, err := db.Query(query, args...)
+	rows, err := pluginDB(ctx).Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -257,7 +263,7 @@ func (pp *PixospritzPlugin) saveScore(ctx context.Context, payload interface{})
 	}
 
 	_ = verifyBody // Use verifyBody in actual API call if needed
-	resp, err := http.Post(verifyURL, "application/json", nil)
+	resp, err := pluginHTTP(ctx).Post(verifyURL, "application/json", nil)
 	if err != nil {
 		return nil, fmt.Errorf("score verification failed: %v", err)
 	}
@@ -268,10 +274,10 @@ func (pp *PixospritzPlugin) saveScore(ctx context.Context, payload interface{})
 	}
 
 	// Store score
-	now := int64(0)
-	scoreID := fmt.Sprintf("score_%d", now)
+	now := time.Now().Unix()
+	scoreID := ids.New("score")
 
-	db.Exec(`
+	pluginDB(ctx).Exec(`
 		INSERT INTO game_scores (id, game_id, player_id, score, timestamp, metadata)
 		VALUES (?, ?, ?, ?, ?, ?)
 	`, scoreID, gameID, playerID, score, now, "")
@@ -301,12 +307,12 @@ func (pp *PixospritzPlugin) getLeaderboard(ctx context.Context, payload interfac
 		limit = int(l)
 	}
 
-	rows, _ := db.Query(`
-		SELECT player_id, score, MAX(timestamp) as latest
-		FROM game_scores
-		WHERE game_id = ?
-		GROUP BY player_id
-		ORDER BY score DESC
+	rows, _ := pluginDB(ctx).Query(`
+		SELECT s.player_id, s.score, s.timestamp as latest
+		FROM game_scores s
+		WHERE s.game_id = ? AND s.timestamp = (SELECT MAX(timestamp) FROM game_scores
+			WHERE game_id = s.game_id AND player_id = s.player_id)
+		ORDER BY s.score DESC
 		LIMIT ?
 	`, gameID, limit)
 	defer rows.Close()
@@ -350,13 +356,13 @@ func (pp *PixospritzPlugin) linkToPortfolio(ctx context.Context, payload interfa
 
 	// Get node content
 	var nodeTitle string
-	db.QueryRow(`SELECT title FROM nodes WHERE id = ?`, nodeID).Scan(&nodeTitle)
+	pluginDB(ctx).QueryRow(`SELECT title FROM nodes WHERE id = ?`, nodeID).Scan(&nodeTitle)
 
 	// Create portfolio entry
-	now := int64(0)
-	portfolioID := fmt.Sprintf("portfolio_%d", now)
+	now := time.Now().Unix()
+	portfolioID := ids.New("portfolio")
 
-	db.Exec(`
+	pluginDB(ctx).Exec(`
 		INSERT INTO portfolio_games (id, node_id, game_id, showcase, created_at)
 		VALUES (?, ?, ?, ?, ?)
 	`, portfolioID, nodeID, gameID, showcase, now)
@@ -388,7 +394,7 @@ func (pp *PixospritzPlugin) getGameStatus(ctx context.Context, payload interface
 
 	// Query Pixospritz server
 	url := fmt.Sprintf("%s/api/game-status/%s", pp.serverURL, gameID)
-	resp, err := http.Get(url)
+	resp, err := pluginHTTP(ctx).Get(url)
 	if err != nil {
 		return nil, fmt.Errorf("status check failed: %v", err)
 	}
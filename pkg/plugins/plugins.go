@@ -22,6 +22,9 @@ type Plugin interface {
 // PluginRegistry manages all plugins
 type PluginRegistry struct {
 	plugins map[string]Plugin
+	panics  map[string]int
+	running map[string]int      // calls in flight, for the concurrency limits
+	granted map[string][]string // capabilities, see capabilities.go
 	mu      sync.RWMutex
 }
 
@@ -30,6 +33,9 @@ var pluginRegistry *PluginRegistry
 func initPluginRegistry() {
 	pluginRegistry = &PluginRegistry{
 		plugins: make(map[string]Plugin),
+		panics:  make(map[string]int),
+		running: make(map[string]int),
+		granted: make(map[string][]string),
 	}
 }
 
@@ -49,12 +55,19 @@ func (pr *PluginRegistry) Register(plugin Plugin) error {
 		return fmt.Errorf("plugin validation failed: %v", err)
 	}
 
+	caps, err := declaredCapabilities(plugin)
+	if err != nil {
+		return fmt.Errorf("plugin validation failed: %v", err)
+	}
+
 	name := plugin.Name()
 	if _, exists := pr.plugins[name]; exists {
 		return fmt.Errorf("plugin %s already registered", name)
 	}
 
+	attachContext(plugin)
 	pr.plugins[name] = plugin
+	pr.granted[name] = caps
 	return nil
 }
 
@@ -75,7 +88,7 @@ func (pr *PluginRegistry) Execute(ctx context.Context, pluginName, action string
 		return nil, err
 	}
 
-	return plugin.Execute(ctx, action, payload)
+	return pr.sandboxed(ctx, plugin, pluginName, action, payload)
 }
 
 func (pr *PluginRegistry) ListPlugins() []string {
@@ -106,6 +119,7 @@ func (pr *PluginRegistry) Unregister(name string) error {
 	}
 
 	delete(pr.plugins, name)
+	delete(pr.granted, name)
 	return nil
 }
 
@@ -146,66 +160,16 @@ type PublishingChannel struct {
 
 type PublishJob struct {
 	ID          string      `json:"id"`
-	NodeID      string      `json:"node_id"`
-	VersionID   string      `json:"version_id"`
-	ChannelID   string      `json:"channel_id"`
+	NodeID      string      `json:"node_id" validate:"required,max=128"`
+	VersionID   string      `json:"version_id" validate:"max=128"`
+	ChannelID   string      `json:"channel_id" validate:"required,max=128"`
 	Status      string      `json:"status"` // queued, publishing, success, failed
 	Progress    int         `json:"progress"`
 	Result      interface{} `json:"result,omitempty"`
 	Error       string      `json:"error,omitempty"`
 	CreatedAt   int64       `json:"created_at"`
 	CompletedAt *int64      `json:"completed_at,omitempty"`
-}
-
-// CredentialManager handles encrypted storage of API keys
-type CredentialManager struct {
-	credentials map[string][]byte // Will be encrypted in production
-	mu          sync.RWMutex
-}
-
-var credentialMgr *CredentialManager
-
-func initCredentialManager() {
-	credentialMgr = &CredentialManager{
-		credentials: make(map[string][]byte),
-	}
-}
-
-// GetCredentialManager returns the global credential manager
-func GetCredentialManager() *CredentialManager {
-	if credentialMgr == nil {
-		initCredentialManager()
-	}
-	return credentialMgr
-}
-
-func (cm *CredentialManager) StoreCredential(key string, value string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	// In production, encrypt this
-	cm.credentials[key] = []byte(value)
-	return nil
-}
-
-func (cm *CredentialManager) GetCredential(key string) (string, error) {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-
-	value, exists := cm.credentials[key]
-	if !exists {
-		return "", fmt.Errorf("credential not found: %s", key)
-	}
-
-	return string(value), nil
-}
-
-func (cm *CredentialManager) DeleteCredential(key string) error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	delete(cm.credentials, key)
-	return nil
+	RetryOf     string      `json:"retry_of,omitempty"` // failed job this one retries
 }
 
 // === Configuration Storage ===
@@ -4,10 +4,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
 )
 
 var db *sql.DB
@@ -17,73 +25,49 @@ func SetDB(d *sql.DB) {
 	db = d
 }
 
-// === Plugin Initialization ===
-
-func initializeDefaultPlugins() {
-	registry := GetRegistry()
-
-	// Git
-	gitPlugin := NewGitPlugin()
-	if err := registry.Register(gitPlugin); err != nil {
-		log.Println("Git plugin registration:", err)
-	}
-
-	// IPFS
-	ipfsPlugin := NewIPFSPlugin("http://localhost:5001")
-	if err := registry.Register(ipfsPlugin); err != nil {
-		log.Println("IPFS plugin registration:", err)
-	}
-
-	// Namecheap
-	ncPlugin := NewNamecheapPlugin()
-	if err := registry.Register(ncPlugin); err != nil {
-		log.Println("Namecheap plugin registration:", err)
-	}
-
-	// Media
-	mediaPlugin := NewMediaPlugin("./media_output")
-	if err := registry.Register(mediaPlugin); err != nil {
-		log.Println("Media plugin registration:", err)
-	}
-
-	// Pixospritz
-	pixoPlugin := NewPixospritzPlugin("http://localhost:3000")
-	if err := registry.Register(pixoPlugin); err != nil {
-		log.Println("Pixospritz plugin registration:", err)
-	}
-
-	// Terminal Scripting
-	terminalPlugin := NewTerminalScriptingPlugin()
-	if err := registry.Register(terminalPlugin); err != nil {
-		log.Println("Terminal scripting plugin registration:", err)
-	}
-	if err := terminalPlugin.Initialize(map[string]interface{}{"safe_mode": true}); err != nil {
-		log.Println("Terminal scripting plugin initialization:", err)
-	}
-
-	// Reminder
-	reminderPlugin := NewReminderPlugin()
-	if err := registry.Register(reminderPlugin); err != nil {
-		log.Println("Reminder plugin registration:", err)
-	}
-	if err := reminderPlugin.Initialize(map[string]interface{}{}); err != nil {
-		log.Println("Reminder plugin initialization:", err)
-	}
-
-	fmt.Println("✓ All plugins registered successfully")
+// === Built-in Plugins ===
+
+// builtinPlugins are the plugins compiled into veil, in registry order.
+// PopulatePluginsRegistry lists them in plugins_registry, and enabling one
+// starts it through InstantiatePluginBySlug.
+var builtinPlugins = []struct {
+	name string
+	slug string
+	new  func() Plugin
+}{
+	{"Git", "git", func() Plugin { return NewGitPlugin() }},
+	{"IPFS", "ipfs", func() Plugin { return NewIPFSPlugin("http://localhost:5001") }},
+	{"Namecheap", "namecheap", func() Plugin { return NewNamecheapPlugin() }},
+	{"Media", "media", func() Plugin { return NewMediaPlugin("./media_output") }},
+	{"Pixospritz", "pixospritz", func() Plugin { return NewPixospritzPlugin("http://localhost:3000") }},
+	{"Shader", "shader", func() Plugin { return NewShaderPlugin() }},
+	{"SVG", "svg", func() Plugin { return NewSVGPlugin() }},
+	{"Code", "code", func() Plugin { return NewCodePlugin() }},
+	{"Todo", "todo", func() Plugin { return NewTodoPlugin() }},
+	{"Reminder", "reminder", func() Plugin { return NewReminderPlugin() }},
+	{"Terminal Scripting", "terminal", func() Plugin { return NewTerminalScriptingPlugin() }},
 }
 
 // === Plugin API Endpoints ===
 
-// HandlePluginsList handles the plugins list endpoint
+// HandlePluginsList handles the plugins list endpoint, with the
+// capabilities granted to each plugin
 func HandlePluginsList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	plugins := GetRegistry().ListPlugins()
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"plugins": plugins,
+		"plugins":      plugins,
+		"capabilities": GetRegistry().Capabilities(),
+		"quarantined":  ListQuarantined(),
+		"panics":       GetRegistry().Panics(),
 	})
 }
 
+// AuthorizeExecute, when set, decides whether the request may run action on
+// plugin; the server checks it against the plugin permission matrix. A
+// non-nil error refuses the call with 403.
+var AuthorizeExecute func(r *http.Request, plugin, action string, payload interface{}) error
+
 // HandlePluginExecute handles plugin execution endpoint
 func HandlePluginExecute(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -93,20 +77,54 @@ func HandlePluginExecute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req map[string]interface{}
-	json.NewDecoder(r.Body).Decode(&req)
+	var req struct {
+		Plugin  string      `json:"plugin" validate:"required,max=128"`
+		Action  string      `json:"action" validate:"required,max=128"`
+		Payload interface{} `json:"payload"`
+		Async   bool        `json:"async"`
+	}
+	if err := validate.DecodeJSON(r.Body, &req); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	pluginName, action, payload := req.Plugin, req.Action, req.Payload
 
-	pluginName := req["plugin"].(string)
-	action := req["action"].(string)
-	payload := req["payload"]
+	if AuthorizeExecute != nil {
+		if err := AuthorizeExecute(r, pluginName, action, payload); err != nil {
+			apierror.WriteWith(w, &apierror.Error{Status: http.StatusForbidden, Message: err.Error()}, map[string]interface{}{"plugin": pluginName, "action": action})
+			return
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// Long-running actions such as media transcodes can run on the job queue
+	if req.Async {
+		if _, err := GetRegistry().Get(pluginName); err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job, err := EnqueueJob(JobKindPlugin, map[string]interface{}{"plugin": pluginName, "action": action, "payload": payload})
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+		return
+	}
 
-	result, err := GetRegistry().Execute(ctx, pluginName, action, payload)
+	// the registry applies the plugin's timeout and other limits
+	result, err := GetRegistry().Execute(r.Context(), pluginName, action, payload)
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		apierror.WriteWith(w, &apierror.Error{Status: http.StatusInternalServerError, Message: err.Error()}, map[string]interface{}{"plugin": pluginName})
+		return
+	}
+	if status := limitStatus(err); status != 0 {
+		apierror.WriteWith(w, &apierror.Error{Status: status, Message: err.Error()}, map[string]interface{}{"plugin": pluginName})
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Write(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -157,7 +175,15 @@ func publishToRSS(ctx context.Context, job PublishJob, config map[string]interfa
 	}, nil
 }
 
+// BuildStaticSite, when set, builds the node's site into the config's
+// output_dir, for static channels and site deploys; the server sets it to
+// its incremental site builder
+var BuildStaticSite func(ctx context.Context, nodeID string, config map[string]interface{}) (interface{}, error)
+
 func publishAsStatic(ctx context.Context, job PublishJob, config map[string]interface{}) (interface{}, error) {
+	if dir, _ := config["output_dir"].(string); dir != "" && BuildStaticSite != nil {
+		return BuildStaticSite(ctx, job.NodeID, config)
+	}
 	// Export as static HTML
 	result, _ := handleExportForJob(job.NodeID, "html")
 	return result, nil
@@ -190,33 +216,102 @@ h1 { border-bottom: 2px solid #333; }
 	return nil, fmt.Errorf("unsupported format")
 }
 
+// HandleCredentialsAPI serves /api/credentials: POST {key, value, plugin?}
+// stores a credential, bound to plugin when given, DELETE
+// /api/credentials/{key} removes one and POST /api/credentials/rotate
+// {passphrase} re-encrypts them all under a new key. GET
+// /api/credentials/audit?plugin=&limit= lists recent reads. Values are never
+// returned.
 func HandleCredentialsAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/credentials"), "/")
+
+	switch {
+	case r.Method == "POST" && name == "":
+		var cred struct {
+			Key    string `json:"key" validate:"required,max=256"`
+			Value  string `json:"value" validate:"required,max=65536"`
+			Plugin string `json:"plugin" validate:"max=128"`
+		}
+		if err := validate.DecodeJSON(r.Body, &cred); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		key, value := cred.Key, cred.Value
 
-	if r.Method == "POST" {
-		var cred map[string]string
-		json.NewDecoder(r.Body).Decode(&cred)
-
-		key := cred["key"]
-		value := cred["value"]
-
-		credentialMgr.StoreCredential(key, value)
+		if err := GetCredentialManager().StorePluginCredential(cred.Plugin, key, value); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
 
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(map[string]string{"stored": key})
+		json.NewEncoder(w).Encode(map[string]interface{}{"stored": key, "plugin": cred.Plugin, "encrypted": GetCredentialManager().Unlocked()})
+	case r.Method == "GET" && name == "audit":
+		limit := 100
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+		entries, err := CredentialAccessLog(r.URL.Query().Get("plugin"), limit)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(entries)
+	case r.Method == "POST" && name == "rotate":
+		var req struct {
+			Passphrase string `json:"passphrase" validate:"max=1024"`
+		}
+		if err := validate.DecodeOptionalJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if req.Passphrase == "" {
+			req.Passphrase = CredentialPassphrase()
+		}
+		n, err := RotateCredentialKey(req.Passphrase)
+		if err != nil {
+			apierror.Write(w, http.StatusConflict, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"rotated": n})
+	case r.Method == "DELETE" && name != "":
+		if err := GetCredentialManager().DeleteCredential(name); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrCredentialNotFound) {
+				status = http.StatusNotFound
+			}
+			apierror.Write(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// AuthorizePublish, when set, decides whether the request may queue job,
+// whether new or a retry; the server checks the caller's roles on the node
+// and the channel's site. A non-nil error refuses the call with 403.
+var AuthorizePublish func(r *http.Request, job PublishJob) error
+
 func HandlePublishJob(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	if r.Method == "POST" {
 		var job PublishJob
-		json.NewDecoder(r.Body).Decode(&job)
+		if err := validate.DecodeJSON(r.Body, &job); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if AuthorizePublish != nil {
+			if err := AuthorizePublish(r, job); err != nil {
+				apierror.Write(w, http.StatusForbidden, err.Error())
+				return
+			}
+		}
 		j, err := QueuePublishJob(job)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		w.WriteHeader(http.StatusCreated)
@@ -224,85 +319,58 @@ func HandlePublishJob(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// QueuePublishJob enqueues a publish job into the DB and starts processing it asynchronously.
+// QueuePublishJob enqueues a publish job into the DB; the job queue's workers pick it up.
 func QueuePublishJob(job PublishJob) (PublishJob, error) {
 	if db == nil {
 		return job, fmt.Errorf("plugins DB not configured")
 	}
-	job.ID = fmt.Sprintf("job_%d", time.Now().UnixNano())
+	job.ID = ids.New("job")
 	job.CreatedAt = time.Now().Unix()
 	job.Status = "queued"
 
-	_, err := db.Exec(`
-		INSERT INTO publish_jobs (id, node_id, version_id, channel_id, status, progress, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, job.ID, job.NodeID, job.VersionID, job.ChannelID, job.Status, 0, job.CreatedAt)
+	var err error
+	if job.RetryOf != "" {
+		_, err = db.Exec(`
+			INSERT INTO publish_jobs (id, node_id, version_id, channel_id, status, progress, created_at, retry_of)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, job.ID, job.NodeID, job.VersionID, job.ChannelID, job.Status, 0, job.CreatedAt, job.RetryOf)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO publish_jobs (id, node_id, version_id, channel_id, status, progress, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, job.ID, job.NodeID, job.VersionID, job.ChannelID, job.Status, 0, job.CreatedAt)
+	}
 	if err != nil {
 		return job, err
 	}
-	go processPublishJob(job)
+	publishJobEvent(job.ID, JobKindPublish, job.NodeID, job.ChannelID, job.Status, 0, "")
+	wakeJobQueue()
 	return job, nil
 }
 
 // Instantiate known plugins by slug. Returns nil if the slug is unknown or instantiation fails.
 func InstantiatePluginBySlug(slug string) Plugin {
-	switch slug {
-	case "git":
-		return NewGitPlugin()
-	case "ipfs":
-		return NewIPFSPlugin("http://localhost:5001")
-	case "namecheap":
-		return NewNamecheapPlugin()
-	case "media":
-		return NewMediaPlugin("./media_output")
-	case "pixospritz":
-		return NewPixospritzPlugin("http://localhost:3000")
-	case "shader":
-		return NewShaderPlugin()
-	case "svg":
-		return NewSVGPlugin()
-	case "code":
-		// Code plugin lives in main package; not available here
-		return nil
-	case "todo":
-		return NewTodoPlugin()
-	case "reminder":
-		return NewReminderPlugin()
-	case "terminal":
-		return NewTerminalScriptingPlugin()
-	default:
-		return nil
+	if fn, ok := extraPlugins[slug]; ok {
+		return fn()
+	}
+	for _, b := range builtinPlugins {
+		if b.slug == slug {
+			return b.new()
+		}
 	}
+	return nil
 }
 
 // PopulatePluginsRegistry ensures all known plugins are in the plugins_registry table
 func PopulatePluginsRegistry(db *sql.DB) {
-	// List of all known plugins with their metadata
-	knownPlugins := []struct {
-		name string
-		slug string
-	}{
-		{"Git", "git"},
-		{"IPFS", "ipfs"},
-		{"Namecheap", "namecheap"},
-		{"Media", "media"},
-		{"Pixospritz", "pixospritz"},
-		{"Shader", "shader"},
-		{"SVG", "svg"},
-		{"Code", "code"},
-		{"Todo", "todo"},
-		{"Reminder", "reminder"},
-		{"Terminal Scripting", "terminal"},
-	}
-
 	now := time.Now().Unix()
-	for _, plugin := range knownPlugins {
+	for _, plugin := range builtinPlugins {
 		// Check if plugin already exists
 		var count int
 		db.QueryRow(`SELECT COUNT(*) FROM plugins_registry WHERE slug = ?`, plugin.slug).Scan(&count)
 		if count == 0 {
 			// Insert with enabled=0
-			id := fmt.Sprintf("plugin_%d", time.Now().UnixNano())
+			id := ids.New("plugin")
 			_, err := db.Exec(`INSERT INTO plugins_registry (id, name, slug, manifest, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, 0, ?, ?)`,
 				id, plugin.name, plugin.slug, "", now, now)
 			if err != nil {
@@ -318,57 +386,80 @@ func PopulatePluginsRegistry(db *sql.DB) {
 func LoadEnabledPluginsFromDB(db *sql.DB) {
 	// store DB handle for plugin helpers
 	SetDB(db)
-	rows, err := db.Query(`SELECT id, name, slug, manifest FROM plugins_registry WHERE enabled = 1`)
+	rows, err := db.Query(`SELECT name, slug, COALESCE(manifest, ''), COALESCE(status, '') FROM plugins_registry WHERE enabled = 1`)
 	if err != nil {
 		log.Println("Failed to load enabled plugins from DB:", err)
 		return
 	}
-	defer rows.Close()
-
+	type row struct{ name, slug, manifest, status string }
+	var enabled []row
 	for rows.Next() {
-		var id, name, slug, manifest string
-		rows.Scan(&id, &name, &slug, &manifest)
-		p := InstantiatePluginBySlug(slug)
-		if p == nil {
-			log.Printf("No runtime plugin implementation for slug: %s\n", slug)
+		var r row
+		if rows.Scan(&r.name, &r.slug, &r.manifest, &r.status) == nil {
+			enabled = append(enabled, r)
+		}
+	}
+	rows.Close()
+
+	for _, r := range enabled {
+		if r.status == PluginStatusQuarantined {
+			slog.Warn("skipping quarantined plugin, enable it again to retry", "plugin", r.slug)
 			continue
 		}
-		// Attempt to initialize with manifest JSON if present
-		var cfg map[string]interface{}
-		if manifest != "" {
-			json.Unmarshal([]byte(manifest), &cfg)
+		started, err := StartPluginBySlug(r.slug, r.manifest)
+		if errors.Is(err, ErrUnknownPlugin) {
+			slog.Warn("no runtime plugin implementation", "plugin", r.slug)
+			continue
 		}
-		if err := p.Initialize(cfg); err != nil {
-			log.Printf("Failed to initialize plugin %s: %v\n", slug, err)
+		if err != nil {
+			slog.Error("quarantining plugin", "plugin", r.slug, "error", err)
+			QuarantinePlugin(db, r.slug, err)
 			continue
 		}
-		if err := GetRegistry().Register(p); err != nil {
-			log.Printf("Failed to register plugin %s: %v\n", slug, err)
+		if !started {
 			continue
 		}
-		log.Printf("Registered plugin from DB: %s (%s)\n", name, slug)
+		setPluginActive(db, r.slug)
+		log.Printf("Registered plugin from DB: %s (%s)\n", r.name, r.slug)
 	}
 }
 
 // === Processing Functions ===
 
-func processPublishJob(job PublishJob) {
-	// Update to publishing status
-	db.Exec(`UPDATE publish_jobs SET status = 'publishing', progress = 10 WHERE id = ?`, job.ID)
+// BeforePublish, when set, runs before a publish job sends its node out; the
+// server uses it to fill in missing descriptions
+var BeforePublish func(nodeID string)
+
+// AfterPublish, when set, runs once a publish job has succeeded; the server
+// uses it to notify CI pipelines through a site's publish hooks
+var AfterPublish func(job PublishJob, channel PublishingChannel)
+
+// runPublishJob is the job queue handler for publish jobs. Configuration
+// problems fail the job at once; publisher errors are retried with backoff.
+func runPublishJob(ctx context.Context, j *Job) (interface{}, error) {
+	job := PublishJob{ID: j.ID, NodeID: j.NodeID, VersionID: j.VersionID, ChannelID: j.ChannelID}
+
+	// Publish the node's current version unless one was named
+	if job.VersionID == "" {
+		db.QueryRow(`SELECT id FROM versions WHERE node_id = ? AND is_current = 1`, job.NodeID).Scan(&job.VersionID)
+		db.Exec(`UPDATE publish_jobs SET version_id = ? WHERE id = ?`, job.VersionID, job.ID)
+	}
+	if BeforePublish != nil && job.NodeID != "" {
+		BeforePublish(job.NodeID)
+	}
 
 	// Get channel
 	var channel PublishingChannel
 	var configJSON sql.NullString
-	db.QueryRow(`SELECT type, config FROM publishing_channels WHERE id = ?`, job.ChannelID).
-		Scan(&channel.Type, &configJSON)
+	if err := db.QueryRow(`SELECT type, config FROM publishing_channels WHERE id = ?`, job.ChannelID).
+		Scan(&channel.Type, &configJSON); err != nil {
+		return nil, Permanent(fmt.Errorf("publishing channel %s not found", job.ChannelID))
+	}
 
 	if configJSON.Valid {
 		json.Unmarshal([]byte(configJSON.String), &channel.Config)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-
 	var result interface{}
 	var err error
 
@@ -381,25 +472,99 @@ func processPublishJob(job PublishJob) {
 		result, err = publishToRSS(ctx, job, channel.Config)
 	case "static":
 		result, err = publishAsStatic(ctx, job, channel.Config)
+	case "sftp":
+		if siteID, _ := channel.Config["site_id"].(string); siteID != "" {
+			result, err = deploySite(ctx, job, channel.Type, channel.Config)
+		} else {
+			result, err = publishViaSFTP(ctx, job, channel.Config)
+		}
+	case "s3", "rsync":
+		result, err = deploySite(ctx, job, channel.Type, channel.Config)
 	default:
-		err = fmt.Errorf("unknown channel type: %s", channel.Type)
+		err = Permanent(fmt.Errorf("unknown channel type: %s", channel.Type))
 	}
-
-	status := "success"
-	errorMsg := ""
 	if err != nil {
-		status = "failed"
-		errorMsg = err.Error()
+		return nil, err
 	}
 
-	// Update job status
 	resultJSON, _ := json.Marshal(result)
-	now := time.Now().Unix()
 	db.Exec(`
-		UPDATE publish_jobs 
-		SET status = ?, progress = 100, result = ?, error = ?, completed_at = ?
-		WHERE id = ?
-	`, status, string(resultJSON), errorMsg, now, job.ID)
+		INSERT INTO publish_history (id, node_id, channel_id, version_id, published_at, result)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, ids.New("pubhist"), job.NodeID, job.ChannelID, job.VersionID, time.Now().Unix(), string(resultJSON))
+	if AfterPublish != nil {
+		channel.ID = job.ChannelID
+		AfterPublish(job, channel)
+	}
+	return result, nil
+}
+
+// RetryPublishJob re-enqueues failed job id as a new job with the same node,
+// version and channel
+func RetryPublishJob(id string) (PublishJob, error) {
+	var old PublishJob
+	var versionID sql.NullString
+	err := db.QueryRow(`SELECT id, node_id, version_id, channel_id, status FROM publish_jobs WHERE id = ?`, id).
+		Scan(&old.ID, &old.NodeID, &versionID, &old.ChannelID, &old.Status)
+	if err == sql.ErrNoRows {
+		return old, ErrJobNotFound
+	}
+	if err != nil {
+		return old, err
+	}
+	if old.Status != "failed" {
+		return old, ErrJobNotFailed
+	}
+	return QueuePublishJob(PublishJob{NodeID: old.NodeID, VersionID: versionID.String, ChannelID: old.ChannelID, RetryOf: old.ID})
+}
+
+// Errors returned by RetryPublishJob
+var (
+	ErrJobNotFound  = errors.New("publish job not found")
+	ErrJobNotFailed = errors.New("only failed publish jobs can be retried")
+)
+
+// HandlePublishJobDetail serves POST /api/publish-job/{id}/retry
+func HandlePublishJobDetail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	rest := strings.TrimPrefix(r.URL.Path, "/api/publish-job/")
+	id, action, _ := strings.Cut(rest, "/")
+	if action != "retry" {
+		apierror.Write(w, http.StatusNotFound, "unknown publish job action")
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if AuthorizePublish != nil {
+		var old PublishJob
+		err := db.QueryRow(`SELECT node_id, channel_id FROM publish_jobs WHERE id = ?`, id).Scan(&old.NodeID, &old.ChannelID)
+		if err == sql.ErrNoRows {
+			apierror.Write(w, http.StatusNotFound, ErrJobNotFound.Error())
+			return
+		}
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if err := AuthorizePublish(r, old); err != nil {
+			apierror.Write(w, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	job, err := RetryPublishJob(id)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job)
+	case ErrJobNotFound:
+		apierror.Write(w, http.StatusNotFound, err.Error())
+	case ErrJobNotFailed:
+		apierror.Write(w, http.StatusConflict, err.Error())
+	default:
+		apierror.Internal(w, r, err)
+	}
 }
 
 // Simple plugin-local types and helpers to avoid tight coupling with main
@@ -434,8 +599,9 @@ func saveConfig(key string, value interface{}) error {
 		return fmt.Errorf("db not initialized for plugins")
 	}
 	configID := fmt.Sprintf("config_%s", key)
-	now := int64(0)
-	_, err := db.Exec(`INSERT OR REPLACE INTO configs (id, key, value, updated_at) VALUES (?, ?, ?, ?)`, configID, key, fmt.Sprintf("%v", value), now)
+	now := time.Now().Unix()
+	_, err := db.Exec(`INSERT INTO configs (id, key, value, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`, configID, key, fmt.Sprintf("%v", value), now, now)
 	return err
 }
 
@@ -0,0 +1,176 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// === Plugin Quarantine ===
+// A plugin whose constructor, Initialize or Validate fails or panics while
+// the server starts is quarantined: plugins_registry.status records why, the
+// plugin stays unregistered and /api/plugins lists it until it is enabled
+// again. Panics in Execute are recovered per call and reported as PanicError.
+
+const (
+	PluginStatusActive      = "active"
+	PluginStatusQuarantined = "quarantined"
+)
+
+// QuarantinedPlugin is a plugin that failed to start
+type QuarantinedPlugin struct {
+	Slug          string `json:"slug"`
+	Name          string `json:"name"`
+	Error         string `json:"error"`
+	QuarantinedAt int64  `json:"quarantined_at"`
+}
+
+// PanicError is returned by PluginRegistry.Execute when a plugin panics
+type PanicError struct {
+	Plugin string
+	Action string
+	Value  interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("plugin %s panicked during %s: %v", e.Plugin, e.Action, e.Value)
+}
+
+// ErrUnknownPlugin means no runtime implementation exists for a slug
+var ErrUnknownPlugin = errors.New("no runtime plugin implementation")
+
+// extraPlugins adds constructors to InstantiatePluginBySlug, keyed by slug
+var extraPlugins = map[string]func() Plugin{}
+
+// pluginDefaults are settings from veil's configuration file, by slug. A
+// plugin starts with them, overridden by the configuration saved for it.
+var pluginDefaults = map[string]map[string]interface{}{}
+
+// SetPluginDefaults sets the configuration plugins start with, by slug
+func SetPluginDefaults(defaults map[string]map[string]interface{}) {
+	pluginDefaults = defaults
+}
+
+// StartPluginBySlug instantiates, initializes and registers the plugin for
+// slug, turning panics into errors. started is false when it is already
+// registered; ErrUnknownPlugin is returned when slug has no implementation.
+func StartPluginBySlug(slug, manifest string) (started bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("plugin panicked while starting", "plugin", slug, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			started, err = false, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	p := InstantiatePluginBySlug(slug)
+	if p == nil {
+		p = runtimePlugin(slug, manifest)
+	}
+	if p == nil {
+		return false, ErrUnknownPlugin
+	}
+	if _, err := GetRegistry().Get(p.Name()); err == nil {
+		return false, nil
+	}
+	cfg := map[string]interface{}{}
+	for k, v := range pluginDefaults[slug] {
+		cfg[k] = v
+	}
+	if manifest != "" {
+		var saved map[string]interface{}
+		json.Unmarshal([]byte(manifest), &saved)
+		for k, v := range saved {
+			cfg[k] = v
+		}
+	}
+	attachContext(p) // before Initialize, which may store credentials
+	if err := p.Initialize(cfg); err != nil {
+		return false, fmt.Errorf("initialize: %w", err)
+	}
+	if err := GetRegistry().Register(p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// QuarantinePlugin marks slug as broken so it is skipped on later starts
+func QuarantinePlugin(d *sql.DB, slug string, cause error) {
+	now := time.Now().Unix()
+	if _, err := d.Exec(`UPDATE plugins_registry SET status = ?, status_error = ?, quarantined_at = ?, updated_at = ? WHERE slug = ?`,
+		PluginStatusQuarantined, cause.Error(), now, now, slug); err != nil {
+		slog.Error("failed to quarantine plugin", "plugin", slug, "error", err)
+	}
+}
+
+// setPluginActive records that slug started and clears any quarantine
+func setPluginActive(d *sql.DB, slug string) {
+	d.Exec(`UPDATE plugins_registry SET status = ?, status_error = NULL, quarantined_at = NULL WHERE slug = ?`, PluginStatusActive, slug)
+}
+
+// EnablePlugin lifts a quarantine and starts slug. A plugin that fails again
+// is quarantined again and the error returned.
+func EnablePlugin(d *sql.DB, slug, manifest string) error {
+	d.Exec(`UPDATE plugins_registry SET status = '', status_error = NULL, quarantined_at = NULL WHERE slug = ?`, slug)
+	started, err := StartPluginBySlug(slug, manifest)
+	if errors.Is(err, ErrUnknownPlugin) {
+		return nil
+	}
+	if err != nil {
+		QuarantinePlugin(d, slug, err)
+		return err
+	}
+	if started {
+		setPluginActive(d, slug)
+	}
+	return nil
+}
+
+// ListQuarantined returns the plugins currently in quarantine
+func ListQuarantined() []QuarantinedPlugin {
+	out := []QuarantinedPlugin{}
+	if db == nil {
+		return out
+	}
+	rows, err := db.Query(`SELECT slug, name, COALESCE(status_error, ''), COALESCE(quarantined_at, 0) FROM plugins_registry
+		WHERE status = ? ORDER BY slug`, PluginStatusQuarantined)
+	if err != nil {
+		return out
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var q QuarantinedPlugin
+		if rows.Scan(&q.Slug, &q.Name, &q.Error, &q.QuarantinedAt) == nil {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// execute runs one plugin action, recovering a panic into a PanicError
+func (pr *PluginRegistry) execute(ctx context.Context, plugin Plugin, name, action string, payload interface{}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.ErrorContext(ctx, "plugin panicked", "plugin", name, "action", action, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			pr.mu.Lock()
+			pr.panics[name]++
+			pr.mu.Unlock()
+			result, err = nil, &PanicError{Plugin: name, Action: action, Value: r}
+		}
+	}()
+	return plugin.Execute(ctx, action, payload)
+}
+
+// Panics returns how many Execute calls panicked per plugin since startup
+func (pr *PluginRegistry) Panics() map[string]int {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	out := make(map[string]int, len(pr.panics))
+	for k, v := range pr.panics {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// faultyPlugin fails or panics on request
+type faultyPlugin struct {
+	name      string
+	initPanic bool
+	initErr   error
+}
+
+func (p *faultyPlugin) Name() string    { return p.name }
+func (p *faultyPlugin) Version() string { return "0.0.1" }
+func (p *faultyPlugin) Initialize(config map[string]interface{}) error {
+	if p.initPanic {
+		panic("bad config")
+	}
+	return p.initErr
+}
+func (p *faultyPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	if action == "explode" {
+		var m map[string]int
+		m["boom"]++
+	}
+	return "ok", nil
+}
+func (p *faultyPlugin) Validate() error { return nil }
+func (p *faultyPlugin) Shutdown() error { return nil }
+
+func setupPluginsDB(t *testing.T) *sql.DB {
+	d, err := sql.Open("sqlite", t.TempDir()+"/plugins.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	if _, err := d.Exec(`CREATE TABLE plugins_registry (id TEXT PRIMARY KEY, name TEXT NOT NULL, slug TEXT UNIQUE NOT NULL, manifest TEXT,
+		enabled INTEGER DEFAULT 0, created_at INTEGER NOT NULL, updated_at INTEGER NOT NULL,
+		status TEXT DEFAULT '', status_error TEXT, quarantined_at INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestBrokenPluginsAreQuarantined(t *testing.T) {
+	d := setupPluginsDB(t)
+	now := time.Now().Unix()
+	for _, slug := range []string{"t-panics", "t-fails", "t-healthy"} {
+		d.Exec(`INSERT INTO plugins_registry (id, name, slug, manifest, enabled, created_at, updated_at) VALUES (?, ?, ?, '', 1, ?, ?)`,
+			"plugin_"+slug, slug, slug, now, now)
+	}
+	healthy := &faultyPlugin{name: "t-healthy"}
+	extraPlugins["t-panics"] = func() Plugin { return &faultyPlugin{name: "t-panics", initPanic: true} }
+	extraPlugins["t-fails"] = func() Plugin { return &faultyPlugin{name: "t-fails", initErr: errors.New("missing token")} }
+	extraPlugins["t-healthy"] = func() Plugin { return healthy }
+	defer func() {
+		for _, slug := range []string{"t-panics", "t-fails", "t-healthy"} {
+			delete(extraPlugins, slug)
+			GetRegistry().Unregister(slug)
+		}
+	}()
+
+	LoadEnabledPluginsFromDB(d)
+
+	if _, err := GetRegistry().Get("t-healthy"); err != nil {
+		t.Fatalf("healthy plugin should be registered: %v", err)
+	}
+	for _, name := range []string{"t-panics", "t-fails"} {
+		if _, err := GetRegistry().Get(name); err == nil {
+			t.Fatalf("%s should not be registered", name)
+		}
+	}
+	q := ListQuarantined()
+	if len(q) != 2 || q[0].Slug != "t-fails" || q[0].Error != "initialize: missing token" || q[1].Error != "panic: bad config" {
+		t.Fatalf("unexpected quarantine list: %+v", q)
+	}
+
+	// quarantined plugins are skipped on the next start, even once fixed
+	extraPlugins["t-fails"] = func() Plugin { return &faultyPlugin{name: "t-fails"} }
+	LoadEnabledPluginsFromDB(d)
+	if _, err := GetRegistry().Get("t-fails"); err == nil {
+		t.Fatalf("a quarantined plugin should stay unregistered until enabled again")
+	}
+	if err := EnablePlugin(d, "t-fails", ""); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if q := ListQuarantined(); len(q) != 1 || q[0].Slug != "t-panics" {
+		t.Fatalf("enabling should lift the quarantine: %+v", q)
+	}
+	if err := EnablePlugin(d, "t-panics", ""); err == nil || len(ListQuarantined()) != 1 {
+		t.Fatalf("a plugin that still panics goes back into quarantine: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	HandlePluginsList(rr, httptest.NewRequest("GET", "/api/plugins", nil))
+	var list struct {
+		Quarantined []QuarantinedPlugin `json:"quarantined"`
+	}
+	json.NewDecoder(rr.Body).Decode(&list)
+	if len(list.Quarantined) != 1 {
+		t.Fatalf("/api/plugins should surface quarantined plugins: %s", rr.Body.String())
+	}
+}
+
+func TestExecutePanicIsRecovered(t *testing.T) {
+	p := &faultyPlugin{name: "t-exploding"}
+	if err := GetRegistry().Register(p); err != nil {
+		t.Fatal(err)
+	}
+	defer GetRegistry().Unregister("t-exploding")
+
+	_, err := GetRegistry().Execute(context.Background(), "t-exploding", "explode", nil)
+	var pe *PanicError
+	if !errors.As(err, &pe) || pe.Action != "explode" {
+		t.Fatalf("expected a PanicError, got %v", err)
+	}
+	if GetRegistry().Panics()["t-exploding"] != 1 {
+		t.Fatalf("panic should be counted: %v", GetRegistry().Panics())
+	}
+
+	rr := httptest.NewRecorder()
+	HandlePluginExecute(rr, httptest.NewRequest("POST", "/api/plugin-execute",
+		bytes.NewBufferString(`{"plugin":"t-exploding","action":"explode"}`)))
+	if rr.Code != 500 {
+		t.Fatalf("expected 500 for a panicking action, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if res, err := GetRegistry().Execute(context.Background(), "t-exploding", "ping", nil); err != nil || res != "ok" {
+		t.Fatalf("the plugin should keep serving after a panic: %v %v", res, err)
+	}
+}
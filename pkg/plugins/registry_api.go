@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/codex"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Plugin Registry ===
+// plugins_registry is the persistent list of plugins and whether each is
+// enabled; the runtime registry holds the ones actually running. Every change
+// made through /api/plugins-registry is applied to both, so it and
+// /api/plugins agree on what runs.
+
+// PluginManifest is a plugins_registry row, with its runtime state
+type PluginManifest struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name" validate:"max=128"`
+	Slug      string    `json:"slug" validate:"max=128"`
+	Manifest  string    `json:"manifest"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Status is active or quarantined; StatusError says why a plugin failed to start
+	Status      string `json:"status,omitempty"`
+	StatusError string `json:"status_error,omitempty"`
+	// Running reports whether the plugin is registered at runtime, and
+	// Capabilities what it was granted there
+	Running      bool     `json:"running"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Host is what a vault provides the plugin system: its database, codex
+// repository, the passphrase its credentials are sealed with and the
+// directory WASM and exec plugins are discovered in
+type Host struct {
+	DB         *sql.DB
+	Repository *codex.Repository
+	Passphrase string
+	PluginsDir string
+}
+
+// Open wires the plugin system to a vault: built-in and discovered plugins
+// are listed in plugins_registry, the enabled ones started, credentials
+// unlocked and the repository attached to plugins that want it
+func Open(h Host) {
+	SetDB(h.DB)
+	PopulatePluginsRegistry(h.DB)
+	if h.PluginsDir != "" {
+		DiscoverPlugins(h.DB, h.PluginsDir)
+	}
+	LoadEnabledPluginsFromDB(h.DB)
+	if h.Passphrase == "" {
+		log.Printf("warning: no master passphrase (VEIL_MASTER_PASSPHRASE or keyring), credentials are kept in memory only")
+	} else if err := UnlockCredentials(h.Passphrase); err != nil {
+		log.Printf("warning: credentials are kept in memory only: %v", err)
+	}
+	if h.Repository != nil {
+		if err := GetRegistry().AttachRepositoryToAll(h.Repository); err != nil {
+			log.Printf("warning: failed to attach repository to plugins: %v", err)
+		}
+	}
+}
+
+// listRegistry returns every plugins_registry row with its runtime state
+func listRegistry() ([]PluginManifest, error) {
+	rows, err := db.Query(`SELECT id, name, slug, COALESCE(manifest, ''), enabled, created_at, updated_at, COALESCE(status, ''), COALESCE(status_error, '') FROM plugins_registry ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	granted := GetRegistry().Capabilities()
+	out := []PluginManifest{}
+	for rows.Next() {
+		var p PluginManifest
+		var createdAt, updatedAt sql.NullInt64
+		var enabled int
+		if err := rows.Scan(&p.ID, &p.Name, &p.Slug, &p.Manifest, &enabled, &createdAt, &updatedAt, &p.Status, &p.StatusError); err != nil {
+			return nil, err
+		}
+		p.Enabled = enabled == 1
+		if createdAt.Valid {
+			p.CreatedAt = time.Unix(createdAt.Int64, 0)
+		}
+		if updatedAt.Valid {
+			p.UpdatedAt = time.Unix(updatedAt.Int64, 0)
+		}
+		p.Capabilities, p.Running = granted[p.Slug]
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// isRuntimeManifest reports whether manifest runs code of its own, a WASM
+// module or a command. Only DiscoverPlugins registers those, from the vault's
+// plugins directory; the API can enable them but not add or change them.
+func isRuntimeManifest(manifest string) bool {
+	_, wasm := parseWasmManifest(manifest)
+	_, exec := parseExecManifest(manifest)
+	return wasm || exec
+}
+
+// applyEnabled starts or stops slug to match the registry; a plugin that
+// fails to start is quarantined and the error returned
+func applyEnabled(req PluginManifest) error {
+	if req.Enabled {
+		return EnablePlugin(db, req.Slug, req.Manifest)
+	}
+	// Try by slug first, then name
+	if err := GetRegistry().Unregister(req.Slug); err != nil && req.Name != "" {
+		GetRegistry().Unregister(req.Name)
+	}
+	return nil
+}
+
+// HandlePluginsRegistry serves /api/plugins-registry: GET lists the
+// registry, POST adds a plugin, PUT updates or enables/disables one and
+// DELETE ?id= (id or slug) removes one. Enabling starts the plugin at once,
+// answering 422 when it fails and is quarantined. WASM and exec plugins
+// can't be added or changed here (see isRuntimeManifest).
+func HandlePluginsRegistry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		out, err := listRegistry()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+
+	case "POST":
+		var req PluginManifest
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if req.Name == "" || req.Slug == "" {
+			apierror.Write(w, http.StatusBadRequest, "name and slug are required")
+			return
+		}
+		if isRuntimeManifest(req.Manifest) {
+			apierror.Write(w, http.StatusBadRequest, "wasm and exec plugins are added by putting them in the vault's plugins directory")
+			return
+		}
+		req.ID = ids.New("plugin")
+		now := time.Now().Unix()
+		_, err := db.Exec(`INSERT INTO plugins_registry (id, name, slug, manifest, enabled, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			req.ID, req.Name, req.Slug, req.Manifest, boolInt(req.Enabled), now, now)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "UNIQUE") {
+				status = http.StatusConflict
+			}
+			apierror.Write(w, status, err.Error())
+			return
+		}
+		req.CreatedAt, req.UpdatedAt = time.Unix(now, 0), time.Unix(now, 0)
+		if err := applyEnabled(req); err != nil {
+			slog.ErrorContext(r.Context(), "plugin quarantined", "plugin", req.Slug, "error", err)
+			apierror.Write(w, http.StatusUnprocessableEntity, "plugin quarantined: "+err.Error())
+			return
+		}
+		req.Capabilities, req.Running = GetRegistry().Capabilities()[req.Slug]
+		json.NewEncoder(w).Encode(req)
+
+	case "PUT":
+		var req PluginManifest
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if isRuntimeManifest(req.Manifest) {
+			var saved string
+			db.QueryRow(`SELECT COALESCE(manifest, '') FROM plugins_registry WHERE slug = ? OR id = ?`, req.Slug, req.ID).Scan(&saved)
+			if req.Manifest != saved {
+				apierror.Write(w, http.StatusBadRequest, "the manifest of a wasm or exec plugin is changed in the vault's plugins directory")
+				return
+			}
+		}
+		now := time.Now().Unix()
+		_, err := db.Exec(`UPDATE plugins_registry SET name = ?, manifest = ?, enabled = ?, updated_at = ? WHERE slug = ? OR id = ?`,
+			req.Name, req.Manifest, boolInt(req.Enabled), now, req.Slug, req.ID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		// enabling again lifts a quarantine; a plugin that still fails goes back into it
+		if err := applyEnabled(req); err != nil {
+			slog.ErrorContext(r.Context(), "plugin quarantined", "plugin", req.Slug, "error", err)
+			apierror.Write(w, http.StatusUnprocessableEntity, "plugin quarantined: "+err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"updated": req.Slug})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		var slug string
+		db.QueryRow(`SELECT slug FROM plugins_registry WHERE id = ? OR slug = ?`, id, id).Scan(&slug)
+		_, err := db.Exec(`DELETE FROM plugins_registry WHERE id = ? OR slug = ?`, id, id)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		// a removed plugin stops running too
+		if slug != "" {
+			GetRegistry().Unregister(slug)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"deleted": id})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
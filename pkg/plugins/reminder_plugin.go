@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"time"
 	"veil/pkg/codex"
+	"veil/pkg/events"
+	"veil/pkg/ids"
 )
 
 // === Reminder System Plugin ===
@@ -32,6 +34,11 @@ func (rp *ReminderPlugin) Version() string {
 	return rp.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (rp *ReminderPlugin) Capabilities() []string {
+	return []string{CapDBRead, CapDBWrite}
+}
+
 func (rp *ReminderPlugin) Initialize(config map[string]interface{}) error {
 	// Ensure reminders table exists
 	_, err := db.Exec(`
@@ -121,7 +128,7 @@ func (rp *ReminderPlugin) createReminder(ctx context.Context, payload interface{
 	}
 
 	reminder := Reminder{
-		ID:         fmt.Sprintf("reminder_%d", time.Now().UnixNano()),
+		ID:         ids.New("reminder"),
 		Title:      req["title"].(string),
 		Status:     "pending",
 		Recurrence: "none",
@@ -144,7 +151,7 @@ func (rp *ReminderPlugin) createReminder(ctx context.Context, payload interface{
 		reminder.Recurrence = recurrence
 	}
 
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		INSERT INTO reminders (id, node_id, title, description, remind_at, status, recurrence, created_at, modified_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, reminder.ID, reminder.NodeID, reminder.Title, reminder.Description, reminder.RemindAt,
@@ -214,7 +221,7 @@ func (rp *ReminderPlugin) listReminders(ctx context.Context, payload interface{}
 
 	query += " ORDER BY remind_at ASC"
 
-	rows, err := db.Query(query, args...)
+	rows, err := pluginDB(ctx).Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query reminders: %v", err)
 	}
@@ -247,7 +254,7 @@ func (rp *ReminderPlugin) getReminder(ctx context.Context, payload interface{})
 	}
 
 	var reminder Reminder
-	err := db.QueryRow(`
+	err := pluginDB(ctx).QueryRow(`
 		SELECT id, COALESCE(node_id, ''), title, COALESCE(description, ''), remind_at,
 		       status, COALESCE(recurrence, 'none'), notification_sent, created_at, modified_at
 		FROM reminders WHERE id = ?
@@ -311,7 +318,7 @@ func (rp *ReminderPlugin) updateReminder(ctx context.Context, payload interface{
 	query += " WHERE id = ?"
 	args = append(args, reminderID)
 
-	_, err := db.Exec(query, args...)
+	_, err := pluginDB(ctx).Exec(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update reminder: %v", err)
 	}
@@ -330,7 +337,7 @@ func (rp *ReminderPlugin) deleteReminder(ctx context.Context, payload interface{
 		return nil, fmt.Errorf("reminder id required")
 	}
 
-	_, err := db.Exec(`DELETE FROM reminders WHERE id = ?`, reminderID)
+	_, err := pluginDB(ctx).Exec(`DELETE FROM reminders WHERE id = ?`, reminderID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to delete reminder: %v", err)
 	}
@@ -350,7 +357,7 @@ func (rp *ReminderPlugin) dismissReminder(ctx context.Context, payload interface
 	}
 
 	now := time.Now().Unix()
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		UPDATE reminders SET status = 'dismissed', modified_at = ? WHERE id = ?
 	`, now, reminderID)
 
@@ -381,7 +388,7 @@ func (rp *ReminderPlugin) snoozeReminder(ctx context.Context, payload interface{
 	newRemindAt := time.Now().Add(time.Duration(snoozeMinutes) * time.Minute).Unix()
 	now := time.Now().Unix()
 
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		UPDATE reminders SET remind_at = ?, notification_sent = 0, modified_at = ? WHERE id = ?
 	`, newRemindAt, now, reminderID)
 
@@ -395,7 +402,7 @@ func (rp *ReminderPlugin) snoozeReminder(ctx context.Context, payload interface{
 func (rp *ReminderPlugin) pendingReminders(ctx context.Context, payload interface{}) (interface{}, error) {
 	now := time.Now().Unix()
 
-	rows, err := db.Query(`
+	rows, err := pluginDB(ctx).Query(`
 		SELECT id, COALESCE(node_id, ''), title, COALESCE(description, ''), remind_at,
 		       status, COALESCE(recurrence, 'none'), notification_sent, created_at, modified_at
 		FROM reminders 
@@ -420,13 +427,13 @@ func (rp *ReminderPlugin) pendingReminders(ctx context.Context, payload interfac
 		reminders = append(reminders, reminder)
 
 		// Mark as notified
-		db.Exec(`UPDATE reminders SET notification_sent = 1 WHERE id = ?`, reminder.ID)
+		pluginDB(ctx).Exec(`UPDATE reminders SET notification_sent = 1 WHERE id = ?`, reminder.ID)
 
 		// Handle recurrence
 		if reminder.Recurrence != "none" && reminder.Recurrence != "" {
 			nextRemindAt := calculateNextRecurrence(reminder.RemindAt, reminder.Recurrence)
-			newReminderID := fmt.Sprintf("reminder_%d", time.Now().UnixNano())
-			db.Exec(`
+			newReminderID := ids.New("reminder")
+			pluginDB(ctx).Exec(`
 				INSERT INTO reminders (id, node_id, title, description, remind_at, status, recurrence, created_at, modified_at)
 				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 			`, newReminderID, reminder.NodeID, reminder.Title, reminder.Description, nextRemindAt,
@@ -454,3 +461,53 @@ func calculateNextRecurrence(currentTime int64, recurrence string) int64 {
 		return currentTime
 	}
 }
+
+// WatchDueReminders publishes a reminder.due event as each pending reminder
+// falls due, checking every interval, until the returned stop is called. It
+// leaves notification_sent alone so the "pending" action still returns them.
+func WatchDueReminders(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		since := time.Now().Unix()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			since = announceDueReminders(since, time.Now().Unix())
+		}
+	}()
+	return func() { close(done) }
+}
+
+// announceDueReminders publishes the reminders due in (since, now] and
+// returns the new watermark
+func announceDueReminders(since, now int64) int64 {
+	if db == nil {
+		return since
+	}
+	rows, err := db.Query(`
+		SELECT id, COALESCE(node_id, ''), title, remind_at FROM reminders
+		WHERE status = 'pending' AND notification_sent = 0 AND remind_at > ? AND remind_at <= ?
+		ORDER BY remind_at ASC
+	`, since, now)
+	if err != nil {
+		// the table only exists once the reminder plugin has started
+		return now
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, nodeID, title string
+		var remindAt int64
+		if rows.Scan(&id, &nodeID, &title, &remindAt) != nil {
+			continue
+		}
+		events.Publish(events.ReminderDue, map[string]interface{}{
+			"id": id, "node_id": nodeID, "title": title, "remind_at": remindAt,
+		})
+	}
+	return now
+}
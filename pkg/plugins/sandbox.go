@@ -0,0 +1,300 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// === Execution Sandbox ===
+// Every call through PluginRegistry.Execute runs under the plugin's limits:
+// a timeout, a cap on concurrent calls and a payload size limit, set per
+// plugin in plugin_limits with DefaultExecutionLimits for anything unset. A
+// plugin that ignores its context keeps its slot until it returns, so a stuck
+// plugin turns callers away instead of piling up goroutines. Calls made by
+// jobs on the job queue run under the queue's JobTimeout instead of the
+// plugin's, since long actions are queued for that reason. Each call is
+// recorded in plugin_executions with its duration and outcome.
+
+// ExecutionLimits bound one plugin's calls; zero fields take the default
+type ExecutionLimits struct {
+	Plugin          string `json:"plugin" validate:"required,max=128"`
+	TimeoutMS       int    `json:"timeout_ms"`
+	MaxConcurrent   int    `json:"max_concurrent"`
+	MaxPayloadBytes int    `json:"max_payload_bytes"`
+	Custom          bool   `json:"custom"`
+}
+
+// DefaultExecutionLimits apply to plugins without their own
+var DefaultExecutionLimits = ExecutionLimits{TimeoutMS: 30000, MaxConcurrent: 4, MaxPayloadBytes: 1 << 20}
+
+// queuedCall marks a context as belonging to a job on the job queue
+type queuedCall struct{}
+
+// executionHistoryLimit is how many plugin_executions rows are kept
+const executionHistoryLimit = 10000
+
+// Execution outcomes recorded in plugin_executions
+const (
+	OutcomeSuccess  = "success"
+	OutcomeError    = "error"
+	OutcomeTimeout  = "timeout"
+	OutcomeCanceled = "canceled"
+	OutcomePanic    = "panic"
+	OutcomeRejected = "rejected"
+)
+
+var (
+	// ErrPluginBusy refuses a call while the plugin is at its concurrency cap
+	ErrPluginBusy = errors.New("plugin is at its concurrent execution limit")
+	// ErrPayloadTooLarge refuses a payload over the plugin's size limit
+	ErrPayloadTooLarge = errors.New("payload exceeds the plugin's size limit")
+)
+
+// GetExecutionLimits returns the limits plugin runs under
+func GetExecutionLimits(plugin string) ExecutionLimits {
+	limits := DefaultExecutionLimits
+	limits.Plugin = plugin
+	if db == nil {
+		return limits
+	}
+	var timeout, concurrent, payload int
+	if db.QueryRow(`SELECT timeout_ms, max_concurrent, max_payload_bytes FROM plugin_limits WHERE plugin = ?`, plugin).
+		Scan(&timeout, &concurrent, &payload) != nil {
+		return limits
+	}
+	limits.Custom = true
+	if timeout > 0 {
+		limits.TimeoutMS = timeout
+	}
+	if concurrent > 0 {
+		limits.MaxConcurrent = concurrent
+	}
+	if payload > 0 {
+		limits.MaxPayloadBytes = payload
+	}
+	return limits
+}
+
+// SetExecutionLimits stores limits for limits.Plugin; all zero fields remove
+// them, restoring the defaults
+func SetExecutionLimits(limits ExecutionLimits) error {
+	if db == nil {
+		return fmt.Errorf("plugins DB not configured")
+	}
+	if limits.TimeoutMS < 0 || limits.MaxConcurrent < 0 || limits.MaxPayloadBytes < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if limits.TimeoutMS == 0 && limits.MaxConcurrent == 0 && limits.MaxPayloadBytes == 0 {
+		_, err := db.Exec(`DELETE FROM plugin_limits WHERE plugin = ?`, limits.Plugin)
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO plugin_limits (plugin, timeout_ms, max_concurrent, max_payload_bytes, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(plugin) DO UPDATE SET timeout_ms = excluded.timeout_ms, max_concurrent = excluded.max_concurrent,
+		max_payload_bytes = excluded.max_payload_bytes, updated_at = excluded.updated_at`,
+		limits.Plugin, limits.TimeoutMS, limits.MaxConcurrent, limits.MaxPayloadBytes, time.Now().Unix())
+	return err
+}
+
+// ListExecutionLimits returns the limits of every registered plugin and of
+// any plugin with its own
+func ListExecutionLimits() ([]ExecutionLimits, error) {
+	names := map[string]bool{}
+	for _, name := range GetRegistry().ListPlugins() {
+		names[name] = true
+	}
+	if db != nil {
+		rows, err := db.Query(`SELECT plugin FROM plugin_limits`)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			names[name] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]ExecutionLimits, 0, len(names))
+	for name := range names {
+		out = append(out, GetExecutionLimits(name))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Plugin < out[j].Plugin })
+	return out, nil
+}
+
+// acquire takes one of name's max execution slots
+func (pr *PluginRegistry) acquire(name string, max int) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.running[name] >= max {
+		return false
+	}
+	pr.running[name]++
+	return true
+}
+
+func (pr *PluginRegistry) release(name string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.running[name]--
+}
+
+// sandboxed runs action under name's execution limits and records it
+func (pr *PluginRegistry) sandboxed(ctx context.Context, plugin Plugin, name, action string, payload interface{}) (interface{}, error) {
+	limits := GetExecutionLimits(name)
+	started := time.Now()
+
+	if b, err := json.Marshal(payload); err == nil && len(b) > limits.MaxPayloadBytes {
+		err := fmt.Errorf("%w: %d bytes, limit %d", ErrPayloadTooLarge, len(b), limits.MaxPayloadBytes)
+		recordExecution(ctx, name, action, started, OutcomeRejected, err)
+		return nil, err
+	}
+	if !pr.acquire(name, limits.MaxConcurrent) {
+		err := fmt.Errorf("%w of %d", ErrPluginBusy, limits.MaxConcurrent)
+		recordExecution(ctx, name, action, started, OutcomeRejected, err)
+		return nil, err
+	}
+
+	ctx = pr.withGrant(ctx, name)
+	cancel := func() {}
+	if ctx.Value(queuedCall{}) == nil {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(limits.TimeoutMS)*time.Millisecond)
+	}
+	defer cancel()
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		defer pr.release(name)
+		result, err := pr.execute(ctx, plugin, name, action, payload)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		var panicErr *PanicError
+		switch {
+		case o.err == nil:
+			recordExecution(ctx, name, action, started, OutcomeSuccess, nil)
+		case errors.As(o.err, &panicErr):
+			recordExecution(ctx, name, action, started, OutcomePanic, o.err)
+		default:
+			recordExecution(ctx, name, action, started, OutcomeError, o.err)
+		}
+		return o.result, o.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err := fmt.Errorf("plugin %s timed out after %s: %w", name, time.Since(started).Round(time.Millisecond), ctx.Err())
+			recordExecution(ctx, name, action, started, OutcomeTimeout, err)
+			return nil, err
+		}
+		recordExecution(ctx, name, action, started, OutcomeCanceled, ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// recordExecution logs a call and adds it to plugin_executions. History is
+// best effort: a database without the table only loses the record.
+func recordExecution(ctx context.Context, name, action string, started time.Time, outcome string, err error) {
+	level := slog.LevelDebug
+	switch outcome {
+	case OutcomeError, OutcomeRejected, OutcomeCanceled:
+		level = slog.LevelWarn
+	case OutcomePanic, OutcomeTimeout:
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{slog.String("plugin", name), slog.String("action", action), slog.String("outcome", outcome),
+		slog.Duration("duration", time.Since(started))}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.LogAttrs(ctx, level, "plugin call", attrs...)
+	if db == nil {
+		return
+	}
+	var msg sql.NullString
+	if err != nil {
+		msg = sql.NullString{String: err.Error(), Valid: true}
+	}
+	var id int64
+	e := db.QueryRow(`INSERT INTO plugin_executions (plugin, action, started_at, duration_ms, outcome, error) VALUES (?, ?, ?, ?, ?, ?) RETURNING id`,
+		name, action, started.Unix(), time.Since(started).Milliseconds(), outcome, msg).Scan(&id)
+	if e != nil {
+		return
+	}
+	if id%100 == 0 {
+		db.Exec(`DELETE FROM plugin_executions WHERE id <= ?`, id-executionHistoryLimit)
+	}
+}
+
+// PluginExecution is one recorded plugin call
+type PluginExecution struct {
+	ID         int64  `json:"id"`
+	Plugin     string `json:"plugin"`
+	Action     string `json:"action"`
+	StartedAt  int64  `json:"started_at"`
+	DurationMS int64  `json:"duration_ms"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ExecutionHistory returns the latest calls, newest first, optionally only
+// plugin's
+func ExecutionHistory(plugin string, limit int) ([]PluginExecution, error) {
+	if db == nil {
+		return nil, fmt.Errorf("plugins DB not configured")
+	}
+	query := `SELECT id, plugin, action, started_at, duration_ms, outcome, COALESCE(error, '') FROM plugin_executions`
+	var args []interface{}
+	if plugin != "" {
+		query += ` WHERE plugin = ?`
+		args = append(args, plugin)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []PluginExecution{}
+	for rows.Next() {
+		var e PluginExecution
+		if err := rows.Scan(&e.ID, &e.Plugin, &e.Action, &e.StartedAt, &e.DurationMS, &e.Outcome, &e.Error); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// limitStatus is the HTTP status for a call refused or cut short by its
+// limits or capabilities, or 0 for any other error
+func limitStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrPayloadTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrPluginBusy):
+		return http.StatusTooManyRequests
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrCapabilityDenied):
+		return http.StatusForbidden
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowPlugin blocks "wait" calls until release is closed, ignoring its context
+type slowPlugin struct {
+	release chan struct{}
+}
+
+func (p *slowPlugin) Name() string                                   { return "t-slow" }
+func (p *slowPlugin) Version() string                                { return "0.0.1" }
+func (p *slowPlugin) Initialize(config map[string]interface{}) error { return nil }
+func (p *slowPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	switch action {
+	case "wait":
+		<-p.release
+	case "fail":
+		return nil, errors.New("nope")
+	}
+	return "done", nil
+}
+func (p *slowPlugin) Validate() error { return nil }
+func (p *slowPlugin) Shutdown() error { return nil }
+
+func TestExecutionSandbox(t *testing.T) {
+	d := setupPluginsDB(t)
+	schema, err := ioutil.ReadFile("../../migrations/018_plugin_sandbox.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range strings.Split(string(schema), ";") {
+		if _, err := d.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetDB(d)
+	p := &slowPlugin{release: make(chan struct{})}
+	if err := GetRegistry().Register(p); err != nil {
+		t.Fatal(err)
+	}
+	defer GetRegistry().Unregister(p.Name())
+
+	if l := GetExecutionLimits("t-slow"); l.Custom || l.TimeoutMS != DefaultExecutionLimits.TimeoutMS {
+		t.Fatalf("expected the defaults, got %+v", l)
+	}
+	if err := SetExecutionLimits(ExecutionLimits{Plugin: "t-slow", TimeoutMS: 50, MaxConcurrent: 1, MaxPayloadBytes: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the plugin ignores its context, so the call times out and keeps its slot
+	if _, err := GetRegistry().Execute(context.Background(), "t-slow", "wait", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if _, err := GetRegistry().Execute(context.Background(), "t-slow", "quick", nil); !errors.Is(err, ErrPluginBusy) {
+		t.Fatalf("expected the plugin to be busy, got %v", err)
+	}
+	close(p.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, err := GetRegistry().Execute(context.Background(), "t-slow", "quick", nil)
+		if err == nil && res == "done" {
+			break
+		}
+		if !errors.Is(err, ErrPluginBusy) || time.Now().After(deadline) {
+			t.Fatalf("the slot should free up once the call returns: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	big := map[string]string{"text": strings.Repeat("x", 100)}
+	if _, err := GetRegistry().Execute(context.Background(), "t-slow", "quick", big); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected the payload to be refused, got %v", err)
+	}
+	GetRegistry().Execute(context.Background(), "t-slow", "fail", nil)
+
+	// queued jobs run under the queue's timeout, not the plugin's
+	p.release = make(chan struct{})
+	go func() { time.Sleep(100 * time.Millisecond); close(p.release) }()
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), queuedCall{}, true), 2*time.Second)
+	defer cancel()
+	if _, err := GetRegistry().Execute(ctx, "t-slow", "wait", nil); err != nil {
+		t.Fatalf("a queued call should outlive the plugin timeout: %v", err)
+	}
+
+	history, err := ExecutionHistory("t-slow", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// busy rejections vary with timing, so they are counted apart
+	var outcomes []string
+	busy := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		if strings.Contains(history[i].Error, ErrPluginBusy.Error()) {
+			busy++
+			continue
+		}
+		outcomes = append(outcomes, history[i].Action+":"+history[i].Outcome)
+	}
+	want := "wait:timeout quick:success quick:rejected fail:error wait:success"
+	if got := strings.Join(outcomes, " "); got != want || busy == 0 {
+		t.Fatalf("history (%d busy):\n got %s\nwant %s", busy, got, want)
+	}
+	if history[0].DurationMS < 100 {
+		t.Fatalf("expected the queued call's duration, got %dms", history[0].DurationMS)
+	}
+
+	if err := SetExecutionLimits(ExecutionLimits{Plugin: "t-slow"}); err != nil {
+		t.Fatal(err)
+	}
+	if l := GetExecutionLimits("t-slow"); l.Custom {
+		t.Fatalf("all zero limits should restore the defaults, got %+v", l)
+	}
+}
@@ -94,6 +94,11 @@ func (tsp *TerminalScriptingPlugin) Version() string {
 	return "1.0.0"
 }
 
+// Capabilities implements CapabilityDeclarer
+func (tsp *TerminalScriptingPlugin) Capabilities() []string {
+	return []string{CapExec}
+}
+
 // Validate checks if the plugin is properly configured
 func (tsp *TerminalScriptingPlugin) Validate() error {
 	if tsp.allowedCommands == nil {
@@ -159,7 +164,7 @@ func (tsp *TerminalScriptingPlugin) executeScript(ctx context.Context, payload i
 		return nil, fmt.Errorf("empty command")
 	}
 
-	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	cmd := pluginCommand(ctx, parts[0], parts[1:]...)
 
 	// Set working directory if specified
 	if wd, ok := req["working_directory"].(string); ok {
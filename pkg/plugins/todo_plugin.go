@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"time"
 	"veil/pkg/codex"
+	"veil/pkg/ids"
 )
 
 // === Todo System Plugin ===
@@ -32,6 +33,11 @@ func (tp *TodoPlugin) Version() string {
 	return tp.version
 }
 
+// Capabilities implements CapabilityDeclarer
+func (tp *TodoPlugin) Capabilities() []string {
+	return []string{CapDBRead, CapDBWrite}
+}
+
 func (tp *TodoPlugin) Initialize(config map[string]interface{}) error {
 	// Ensure todos table exists
 	_, err := db.Exec(`
@@ -121,7 +127,7 @@ func (tp *TodoPlugin) createTodo(ctx context.Context, payload interface{}) (inte
 	}
 
 	todo := Todo{
-		ID:         fmt.Sprintf("todo_%d", time.Now().UnixNano()),
+		ID:         ids.New("todo"),
 		Title:      req["title"].(string),
 		Status:     "pending",
 		Priority:   "medium",
@@ -145,7 +151,7 @@ func (tp *TodoPlugin) createTodo(ctx context.Context, payload interface{}) (inte
 		todo.AssignedTo = assignedTo
 	}
 
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		INSERT INTO todos (id, node_id, title, description, status, priority, due_date, assigned_to, created_at, modified_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, todo.ID, todo.NodeID, todo.Title, todo.Description, todo.Status, todo.Priority, todo.DueDate, todo.AssignedTo, todo.CreatedAt, todo.ModifiedAt)
@@ -220,7 +226,7 @@ func (tp *TodoPlugin) listTodos(ctx context.Context, payload interface{}) (inter
 
 	query += " ORDER BY due_date ASC, created_at DESC"
 
-	rows, err := db.Query(query, args...)
+	rows, err := pluginDB(ctx).Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query todos: %v", err)
 	}
@@ -252,7 +258,7 @@ func (tp *TodoPlugin) getTodo(ctx context.Context, payload interface{}) (interfa
 	}
 
 	var todo Todo
-	err := db.QueryRow(`
+	err := pluginDB(ctx).QueryRow(`
 		SELECT id, COALESCE(node_id, ''), title, COALESCE(description, ''), status, priority,
 		       COALESCE(due_date, 0), COALESCE(assigned_to, ''), COALESCE(completed_at, 0), created_at, modified_at
 		FROM todos WHERE id = ?
@@ -318,7 +324,7 @@ func (tp *TodoPlugin) updateTodo(ctx context.Context, payload interface{}) (inte
 	query += " WHERE id = ?"
 	args = append(args, todoID)
 
-	_, err := db.Exec(query, args...)
+	_, err := pluginDB(ctx).Exec(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update todo: %v", err)
 	}
@@ -337,7 +343,7 @@ func (tp *TodoPlugin) deleteTodo(ctx context.Context, payload interface{}) (inte
 		return nil, fmt.Errorf("todo id required")
 	}
 
-	_, err := db.Exec(`DELETE FROM todos WHERE id = ?`, todoID)
+	_, err := pluginDB(ctx).Exec(`DELETE FROM todos WHERE id = ?`, todoID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to delete todo: %v", err)
 	}
@@ -357,7 +363,7 @@ func (tp *TodoPlugin) completeTodo(ctx context.Context, payload interface{}) (in
 	}
 
 	now := time.Now().Unix()
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		UPDATE todos SET status = 'completed', completed_at = ?, modified_at = ? WHERE id = ?
 	`, now, now, todoID)
 
@@ -380,7 +386,7 @@ func (tp *TodoPlugin) reopenTodo(ctx context.Context, payload interface{}) (inte
 	}
 
 	now := time.Now().Unix()
-	_, err := db.Exec(`
+	_, err := pluginDB(ctx).Exec(`
 		UPDATE todos SET status = 'pending', completed_at = NULL, modified_at = ? WHERE id = ?
 	`, now, todoID)
 
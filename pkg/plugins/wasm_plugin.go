@@ -0,0 +1,385 @@
+package plugins
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// === WASM Plugins ===
+// A plugin can be a WebAssembly module instead of Go code. Its
+// plugins_registry manifest has "runtime": "wasm", the module's path and the
+// capabilities it needs. DiscoverPlugins registers modules dropped into the
+// vault's plugins/ directory.
+//
+// The host ABI passes JSON through the module's memory. A module exports
+// memory, veil_alloc(size i32) i32 for the host to place inputs, and
+// veil_execute(action_ptr, action_len, payload_ptr, payload_len i32) i64,
+// which returns the pointer and length of {"result": ...} or {"error": "..."}
+// packed as ptr<<32 | len. It may export veil_init(config_ptr, config_len i32)
+// i64, returning an error message the same way (length 0 for success), and
+// veil_shutdown(). The host provides veil.log(ptr, len i32), and with the
+// "credentials" capability veil.credential(key_ptr, key_len i32) i64, which
+// returns the plugin's credential or length 0. The "wasi" capability adds
+// WASI preview 1 with stdout and stderr sent to the log and no filesystem.
+
+// WasmRuntime is the manifest runtime of WebAssembly plugins
+const WasmRuntime = "wasm"
+
+// wasmCapabilities are the capabilities a WASM manifest may declare
+var wasmCapabilities = map[string]bool{CapCredentials: true, CapWASI: true}
+
+// defaultWasmMemoryMB caps a module's memory when its manifest sets none
+const defaultWasmMemoryMB = 64
+
+// WasmManifest is the plugins_registry manifest of a WASM plugin
+type WasmManifest struct {
+	Runtime       string                 `json:"runtime"`
+	Module        string                 `json:"module"`
+	Name          string                 `json:"name,omitempty"`
+	Version       string                 `json:"version,omitempty"`
+	Capabilities  []string               `json:"capabilities,omitempty"`
+	MemoryLimitMB int                    `json:"memory_limit_mb,omitempty"`
+	Config        map[string]interface{} `json:"config,omitempty"`
+}
+
+// parseWasmManifest reads manifest, ok only when it names the wasm runtime
+func parseWasmManifest(manifest string) (m WasmManifest, ok bool) {
+	if manifest == "" || json.Unmarshal([]byte(manifest), &m) != nil {
+		return m, false
+	}
+	return m, m.Runtime == WasmRuntime
+}
+
+// WasmPlugin runs a WebAssembly module as a plugin. Calls are serialized,
+// since a module instance is single threaded, and a module closed by a
+// timeout or a trap is instantiated afresh on the next call.
+type WasmPlugin struct {
+	slug     string
+	manifest WasmManifest
+	config   []byte
+	pc       *PluginContext
+
+	mu       sync.Mutex
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	mod      api.Module
+}
+
+// NewWasmPlugin returns the plugin for slug described by m, not yet loaded
+func NewWasmPlugin(slug string, m WasmManifest) *WasmPlugin {
+	return &WasmPlugin{slug: slug, manifest: m}
+}
+
+func (p *WasmPlugin) Name() string { return p.slug }
+
+func (p *WasmPlugin) Version() string {
+	if p.manifest.Version == "" {
+		return "0.0.0"
+	}
+	return p.manifest.Version
+}
+
+// AttachContext implements ContextAware
+func (p *WasmPlugin) AttachContext(pc *PluginContext) { p.pc = pc }
+
+// Capabilities implements CapabilityDeclarer
+func (p *WasmPlugin) Capabilities() []string { return p.manifest.Capabilities }
+
+// granted reports whether the manifest declares capability
+func (p *WasmPlugin) granted(capability string) bool {
+	for _, c := range p.manifest.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Initialize compiles the module and instantiates it with the manifest's
+// "config" object
+func (p *WasmPlugin) Initialize(config map[string]interface{}) error {
+	if cfg, ok := config["config"]; ok {
+		p.manifest.Config, _ = cfg.(map[string]interface{})
+	}
+	b, err := json.Marshal(p.manifest.Config)
+	if err != nil {
+		return err
+	}
+	if p.manifest.Config == nil {
+		b = []byte("{}")
+	}
+	p.config = b
+
+	for _, c := range p.manifest.Capabilities {
+		if !wasmCapabilities[c] {
+			return fmt.Errorf("capability %q is not available to WASM plugins", c)
+		}
+	}
+	code, err := os.ReadFile(p.manifest.Module)
+	if err != nil {
+		return fmt.Errorf("read module: %w", err)
+	}
+
+	ctx := context.Background()
+	memoryMB := p.manifest.MemoryLimitMB
+	if memoryMB <= 0 {
+		memoryMB = defaultWasmMemoryMB
+	}
+	// a module page is 64KiB
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(memoryMB*16)))
+	compiled, err := r.CompileModule(ctx, code)
+	if err != nil {
+		r.Close(ctx)
+		return fmt.Errorf("compile module: %w", err)
+	}
+	if err := p.checkModule(compiled); err != nil {
+		r.Close(ctx)
+		return err
+	}
+	if err := p.hostModule(ctx, r); err != nil {
+		r.Close(ctx)
+		return err
+	}
+	if p.granted("wasi") {
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+			r.Close(ctx)
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.runtime, p.compiled = r, compiled
+	if err := p.instantiate(ctx); err != nil {
+		r.Close(ctx)
+		p.runtime, p.compiled = nil, nil
+		return err
+	}
+	return nil
+}
+
+// checkModule refuses a module that lacks the ABI's exports or imports
+// anything its capabilities don't grant
+func (p *WasmPlugin) checkModule(compiled wazero.CompiledModule) error {
+	for _, name := range []string{"veil_alloc", "veil_execute"} {
+		if _, ok := compiled.ExportedFunctions()[name]; !ok {
+			return fmt.Errorf("module does not export %s", name)
+		}
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("module does not export its memory")
+	}
+	for _, def := range compiled.ImportedFunctions() {
+		module, name, _ := def.Import()
+		switch {
+		case module == "veil" && name == "log":
+		case module == "veil" && name == "credential":
+			if !p.granted("credentials") {
+				return fmt.Errorf("module imports veil.credential without the credentials capability")
+			}
+		case module == wasi_snapshot_preview1.ModuleName:
+			if !p.granted("wasi") {
+				return fmt.Errorf("module imports %s.%s without the wasi capability", module, name)
+			}
+		default:
+			return fmt.Errorf("module imports unknown function %s.%s", module, name)
+		}
+	}
+	return nil
+}
+
+// hostModule defines the veil functions the module may import
+func (p *WasmPlugin) hostModule(ctx context.Context, r wazero.Runtime) error {
+	b := r.NewHostModuleBuilder("veil")
+	b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, n uint32) {
+		if msg, ok := m.Memory().Read(ptr, n); ok {
+			slog.Info(string(msg), "plugin", p.slug)
+		}
+	}).Export("log")
+	if p.granted("credentials") {
+		b.NewFunctionBuilder().WithFunc(func(ctx context.Context, m api.Module, ptr, n uint32) uint64 {
+			key, ok := m.Memory().Read(ptr, n)
+			if !ok || p.pc == nil {
+				return 0
+			}
+			value, err := p.pc.Credential(string(key))
+			if err != nil {
+				return 0
+			}
+			packed, err := writeGuest(ctx, m, []byte(value))
+			if err != nil {
+				return 0
+			}
+			return packed
+		}).Export("credential")
+	}
+	_, err := b.Instantiate(ctx)
+	return err
+}
+
+// instantiate starts a fresh module instance and runs veil_init
+func (p *WasmPlugin) instantiate(ctx context.Context) error {
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStdout(pluginLogWriter(p.slug)).
+		WithStderr(pluginLogWriter(p.slug)).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+	mod, err := p.runtime.InstantiateModule(ctx, p.compiled, cfg)
+	if err != nil {
+		return fmt.Errorf("instantiate module: %w", err)
+	}
+	if fn := mod.ExportedFunction("veil_init"); fn != nil {
+		packed, err := writeGuest(ctx, mod, p.config)
+		if err != nil {
+			mod.Close(ctx)
+			return err
+		}
+		res, err := fn.Call(ctx, packed>>32, packed&0xffffffff)
+		if err != nil {
+			mod.Close(ctx)
+			return fmt.Errorf("veil_init: %w", err)
+		}
+		if msg, _ := readGuest(mod, res[0]); len(msg) > 0 {
+			mod.Close(ctx)
+			return fmt.Errorf("veil_init: %s", msg)
+		}
+	}
+	p.mod = mod
+	return nil
+}
+
+func (p *WasmPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.runtime == nil {
+		return nil, fmt.Errorf("plugin %s is not initialized", p.slug)
+	}
+	if p.mod == nil || p.mod.IsClosed() {
+		if err := p.instantiate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("encode payload: %w", err)
+	}
+	actionRef, err := writeGuest(ctx, p.mod, []byte(action))
+	if err != nil {
+		return nil, err
+	}
+	payloadRef, err := writeGuest(ctx, p.mod, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.mod.ExportedFunction("veil_execute").Call(ctx,
+		actionRef>>32, actionRef&0xffffffff, payloadRef>>32, payloadRef&0xffffffff)
+	if err != nil {
+		if p.mod.IsClosed() {
+			p.mod = nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("veil_execute: %w", err)
+	}
+	out, ok := readGuest(p.mod, res[0])
+	if !ok {
+		return nil, fmt.Errorf("veil_execute returned a pointer outside memory")
+	}
+	var envelope struct {
+		Result interface{} `json:"result"`
+		Error  string      `json:"error"`
+	}
+	if err := json.Unmarshal(out, &envelope); err != nil {
+		return nil, fmt.Errorf("veil_execute returned invalid JSON: %w", err)
+	}
+	if envelope.Error != "" {
+		return nil, errors.New(envelope.Error)
+	}
+	return envelope.Result, nil
+}
+
+// Validate checks that the module loaded
+func (p *WasmPlugin) Validate() error {
+	if p.compiled == nil {
+		return fmt.Errorf("module %s is not loaded", p.manifest.Module)
+	}
+	return nil
+}
+
+// Shutdown runs veil_shutdown and frees the runtime
+func (p *WasmPlugin) Shutdown() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.runtime == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var err error
+	if p.mod != nil && !p.mod.IsClosed() {
+		if fn := p.mod.ExportedFunction("veil_shutdown"); fn != nil {
+			_, err = fn.Call(ctx)
+		}
+	}
+	p.runtime.Close(ctx)
+	p.runtime, p.compiled, p.mod = nil, nil, nil
+	return err
+}
+
+// writeGuest copies data into memory veil_alloc hands out and returns its
+// packed pointer and length
+func writeGuest(ctx context.Context, m api.Module, data []byte) (uint64, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	res, err := m.ExportedFunction("veil_alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, fmt.Errorf("veil_alloc: %w", err)
+	}
+	ptr := uint32(res[0])
+	if !m.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("veil_alloc returned a pointer outside memory")
+	}
+	return uint64(ptr)<<32 | uint64(len(data)), nil
+}
+
+// readGuest copies out the bytes a packed pointer and length refer to
+func readGuest(m api.Module, packed uint64) ([]byte, bool) {
+	n := uint32(packed)
+	if n == 0 {
+		return nil, true
+	}
+	b, ok := m.Memory().Read(uint32(packed>>32), n)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), b...), true
+}
+
+// pluginLogWriter sends a module's WASI output to the log
+type pluginLogWriter string
+
+func (w pluginLogWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		slog.Info(line, "plugin", string(w))
+	}
+	return len(b), nil
+}
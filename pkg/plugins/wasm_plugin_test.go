@@ -0,0 +1,165 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wasmSection frames one module section
+func wasmSection(id byte, body []byte) []byte {
+	return append(append([]byte{id}, uleb(uint64(len(body)))...), body...)
+}
+
+func uleb(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+			continue
+		}
+		return append(out, b)
+	}
+}
+
+func sleb(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func wasmName(s string) []byte { return append(uleb(uint64(len(s))), s...) }
+
+// echoModule is a hand-assembled plugin: "ping" answers "pong", "echo"
+// returns its payload as the envelope, "spin" never returns and anything
+// else fails. Every call logs "hi" through veil.log.
+func echoModule() []byte {
+	const i32, i64 = 0x7f, 0x7e
+	types := []byte{3,
+		0x60, 2, i32, i32, 0, // log
+		0x60, 1, i32, 1, i32, // veil_alloc
+		0x60, 4, i32, i32, i32, i32, 1, i64, // veil_execute
+	}
+	imports := append([]byte{1}, wasmName("veil")...)
+	imports = append(append(imports, wasmName("log")...), 0x00, 0)
+	exports := []byte{3}
+	exports = append(append(exports, wasmName("memory")...), 0x02, 0)
+	exports = append(append(exports, wasmName("veil_alloc")...), 0x00, 1)
+	exports = append(append(exports, wasmName("veil_execute")...), 0x00, 2)
+
+	alloc := []byte{0, 0x23, 0, 0x23, 0, 0x20, 0, 0x6a, 0x24, 0, 0x0b}
+	execute := []byte{1, 1, i32} // one i32 local for the action's first byte
+	execute = append(execute, 0x41)
+	execute = append(execute, sleb(64)...)
+	execute = append(execute, 0x41, 2, 0x10, 0) // log "hi"
+	execute = append(execute, 0x20, 0, 0x2d, 0, 0, 0x21, 4)
+	execute = append(execute, 0x20, 4, 0x41)
+	execute = append(execute, sleb('p')...)
+	execute = append(execute, 0x46, 0x04, i64, 0x42)
+	execute = append(execute, sleb(17)...) // {"result":"pong"} at 0
+	execute = append(execute, 0x05, 0x20, 4, 0x41)
+	execute = append(execute, sleb('e')...)
+	execute = append(execute, 0x46, 0x04, i64,
+		0x20, 2, 0xad, 0x42, 32, 0x86, 0x20, 3, 0xad, 0x84, // payload ptr<<32 | len
+		0x05, 0x20, 4, 0x41)
+	execute = append(execute, sleb('s')...)
+	execute = append(execute, 0x46, 0x04, 0x40, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b, 0x42)
+	execute = append(execute, sleb(32<<32|16)...) // {"error":"nope"} at 32
+	execute = append(execute, 0x0b, 0x0b, 0x0b)
+	code := []byte{2}
+	code = append(append(code, uleb(uint64(len(alloc)))...), alloc...)
+	code = append(append(code, uleb(uint64(len(execute)))...), execute...)
+
+	data := []byte{3}
+	for _, seg := range []struct {
+		at   int64
+		text string
+	}{{0, `{"result":"pong"}`}, {32, `{"error":"nope"}`}, {64, "hi"}} {
+		data = append(append(data, 0, 0x41), sleb(seg.at)...)
+		data = append(append(data, 0x0b), wasmName(seg.text)...)
+	}
+
+	module := []byte("\x00asm\x01\x00\x00\x00")
+	module = append(module, wasmSection(1, types)...)
+	module = append(module, wasmSection(2, imports)...)
+	module = append(module, wasmSection(3, []byte{2, 1, 2})...)
+	module = append(module, wasmSection(5, []byte{1, 0, 1})...)
+	module = append(module, wasmSection(6, append([]byte{1, i32, 1, 0x41}, append(sleb(1024), 0x0b)...))...)
+	module = append(module, wasmSection(7, exports)...)
+	module = append(module, wasmSection(10, code)...)
+	module = append(module, wasmSection(11, data)...)
+	return module
+}
+
+func TestWasmPlugin(t *testing.T) {
+	d := setupPluginsDB(t)
+	SetDB(d)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "echo.wasm"), echoModule(), 0644)
+	os.WriteFile(filepath.Join(dir, "echo.json"), []byte(`{"name": "Echo", "version": "1.2.0"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "empty.wasm"), []byte("\x00asm\x01\x00\x00\x00"), 0644)
+
+	DiscoverPlugins(d, dir)
+	DiscoverPlugins(d, dir)
+	var count int
+	var name, manifest string
+	d.QueryRow(`SELECT COUNT(*) FROM plugins_registry`).Scan(&count)
+	d.QueryRow(`SELECT name, manifest FROM plugins_registry WHERE slug = 'echo'`).Scan(&name, &manifest)
+	if count != 2 || name != "Echo" || !strings.Contains(manifest, `"runtime":"wasm"`) {
+		t.Fatalf("expected both modules registered once: %d %s %s", count, name, manifest)
+	}
+
+	if err := EnablePlugin(d, "echo", manifest); err != nil {
+		t.Fatal(err)
+	}
+	defer GetRegistry().Unregister("echo")
+	p, err := GetRegistry().Get("echo")
+	if err != nil || p.Version() != "1.2.0" {
+		t.Fatalf("echo should be registered: %v", err)
+	}
+	ctx := context.Background()
+	if res, err := GetRegistry().Execute(ctx, "echo", "ping", nil); err != nil || res != "pong" {
+		t.Fatalf("ping: %v %v", res, err)
+	}
+	res, err := GetRegistry().Execute(ctx, "echo", "echo", map[string]interface{}{"result": []int{1, 2}})
+	if b, _ := json.Marshal(res); err != nil || string(b) != "[1,2]" {
+		t.Fatalf("echo: %s %v", b, err)
+	}
+	if _, err := GetRegistry().Execute(ctx, "echo", "fail", nil); err == nil || err.Error() != "nope" {
+		t.Fatalf("expected the module's error, got %v", err)
+	}
+
+	// a module stuck in a loop is stopped and starts afresh on the next call
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Execute(short, "spin", nil); err == nil {
+		t.Fatal("a spinning module should be stopped")
+	}
+	if res, err := p.Execute(ctx, "ping", nil); err != nil || res != "pong" {
+		t.Fatalf("the module should be reinstantiated: %v %v", res, err)
+	}
+
+	d.QueryRow(`SELECT manifest FROM plugins_registry WHERE slug = 'empty'`).Scan(&manifest)
+	if err := EnablePlugin(d, "empty", manifest); err == nil || !strings.Contains(err.Error(), "does not export veil_alloc") {
+		t.Fatalf("a module without the ABI should be refused: %v", err)
+	}
+	if q := ListQuarantined(); len(q) != 1 || q[0].Slug != "empty" {
+		t.Fatalf("the broken module should be quarantined: %+v", q)
+	}
+	bad := NewWasmPlugin("t-net", WasmManifest{Module: filepath.Join(dir, "echo.wasm"), Capabilities: []string{"network"}})
+	if err := bad.Initialize(nil); err == nil || !strings.Contains(err.Error(), `"network"`) {
+		t.Fatalf("undeclarable capabilities should be refused: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Postgres is PostgreSQL. Statements are rewritten token by token, leaving
+// string literals, quoted names and comments alone: ? placeholders become
+// $1, $2, ... and ?N becomes $N. Everything else in a query is written to
+// run on both databases.
+//
+// Migrations get PostgreSQL's column types besides: BIGINT for INTEGER,
+// BIGSERIAL for an AUTOINCREMENT key, BYTEA for BLOB and DOUBLE PRECISION
+// for REAL. Foreign keys are made DEFERRABLE, so DeferForeignKeys can put
+// them off to commit as SQLite's defer_foreign_keys does.
+type Postgres struct{}
+
+func (Postgres) Name() string { return "postgres" }
+
+func (Postgres) NoLimit() string { return "ALL" }
+
+var (
+	pgAutoincrement = regexp.MustCompile(`(?i)\bINTEGER\s+PRIMARY\s+KEY\s+AUTOINCREMENT\b`)
+	pgInteger       = regexp.MustCompile(`(?i)\bINTEGER\b`)
+	pgBlob          = regexp.MustCompile(`(?i)\bBLOB\b`)
+	pgReal          = regexp.MustCompile(`(?i)\bREAL\b`)
+	pgReferences    = regexp.MustCompile(`(?i)\bREFERENCES\s+\w+\s*\(\s*\w+\s*\)`)
+)
+
+func (Postgres) Rewrite(query string) string {
+	n := 0
+	return mapCode(query, func(code string) string {
+		var b strings.Builder
+		for i := 0; i < len(code); i++ {
+			if code[i] != '?' {
+				b.WriteByte(code[i])
+				continue
+			}
+			j := i + 1
+			for j < len(code) && code[j] >= '0' && code[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				b.WriteString("$" + code[i+1:j])
+				i = j - 1
+				continue
+			}
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		}
+		return b.String()
+	})
+}
+
+func (Postgres) Schema(stmt string) string {
+	return mapCode(stmt, func(code string) string {
+		code = pgAutoincrement.ReplaceAllString(code, "BIGSERIAL PRIMARY KEY")
+		code = pgInteger.ReplaceAllString(code, "BIGINT")
+		code = pgBlob.ReplaceAllString(code, "BYTEA")
+		code = pgReal.ReplaceAllString(code, "DOUBLE PRECISION")
+		return pgReferences.ReplaceAllString(code, "$0 DEFERRABLE")
+	})
+}
+
+func (Postgres) Tables(q Querier) ([]string, error) {
+	return textColumn(q, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' ORDER BY table_name`)
+}
+
+func (Postgres) Columns(q Querier, table string) ([]Column, error) {
+	rows, err := q.Query(`SELECT c.column_name, upper(c.data_type), c.is_nullable = 'NO',
+			EXISTS (SELECT 1 FROM information_schema.table_constraints t
+				JOIN information_schema.key_column_usage k ON k.constraint_schema = t.constraint_schema AND k.constraint_name = t.constraint_name
+				WHERE t.constraint_type = 'PRIMARY KEY' AND t.table_schema = c.table_schema AND t.table_name = c.table_name
+					AND k.column_name = c.column_name)
+		FROM information_schema.columns c
+		WHERE c.table_schema = current_schema() AND c.table_name = ? ORDER BY c.ordinal_position`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []Column
+	for rows.Next() {
+		var c Column
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull, &c.PK); err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+func (Postgres) ForeignKeys(q Querier) ([]ForeignKey, error) {
+	rows, err := q.Query(`SELECT k.table_name, k.column_name, u.table_name, u.column_name
+		FROM information_schema.referential_constraints r
+		JOIN information_schema.key_column_usage k ON k.constraint_schema = r.constraint_schema AND k.constraint_name = r.constraint_name
+		JOIN information_schema.constraint_column_usage u ON u.constraint_schema = r.unique_constraint_schema
+			AND u.constraint_name = r.unique_constraint_name
+		WHERE k.table_schema = current_schema()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []ForeignKey
+	for rows.Next() {
+		var k ForeignKey
+		if err := rows.Scan(&k.Table, &k.Column, &k.RefTable, &k.RefCol); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// IntegrityCheck has nothing to check: PostgreSQL looks after its own
+// files, and pg_amcheck is the tool for when it can't
+func (Postgres) IntegrityCheck(q Querier) (string, error) {
+	return "ok", nil
+}
+
+func (Postgres) DeferForeignKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`SET CONSTRAINTS ALL DEFERRED`)
+	return err
+}
+
+// mapCode applies fn to the parts of query outside string literals, quoted
+// names, comments and dollar-quoted bodies
+func mapCode(query string, fn func(code string) string) string {
+	var out strings.Builder
+	start := 0
+	flush := func(end int) {
+		out.WriteString(fn(query[start:end]))
+	}
+	for i := 0; i < len(query); {
+		end := skipQuoted(query, i)
+		if end == i {
+			i++
+			continue
+		}
+		flush(i)
+		out.WriteString(query[i:end])
+		i, start = end, end
+	}
+	flush(len(query))
+	return out.String()
+}
+
+// skipQuoted returns where the literal, quoted name or comment starting at
+// i ends, or i when none starts there
+func skipQuoted(s string, i int) int {
+	switch {
+	case s[i] == '\'' || s[i] == '"':
+		if j := strings.IndexByte(s[i+1:], s[i]); j >= 0 {
+			return i + j + 2
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "--"):
+		if j := strings.IndexByte(s[i:], '\n'); j >= 0 {
+			return i + j + 1
+		}
+		return len(s)
+	case strings.HasPrefix(s[i:], "/*"):
+		if j := strings.Index(s[i+2:], "*/"); j >= 0 {
+			return i + j + 4
+		}
+		return len(s)
+	case s[i] == '$':
+		j := i + 1
+		for j < len(s) && (s[j] == '_' || s[j] >= 'a' && s[j] <= 'z' || s[j] >= 'A' && s[j] <= 'Z') {
+			j++
+		}
+		if j >= len(s) || s[j] != '$' || (i > 0 && isWordByte(s[i-1])) {
+			return i
+		}
+		tag := s[i : j+1]
+		if k := strings.Index(s[j+1:], tag); k >= 0 {
+			return j + 1 + k + len(tag)
+		}
+		return len(s)
+	}
+	return i
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
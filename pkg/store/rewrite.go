@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+)
+
+// rewriteConn rewrites every statement for its dialect before the
+// connection underneath sees it
+type rewriteConn struct {
+	driver.Conn
+	dialect Dialect
+}
+
+func (c *rewriteConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(c.dialect.Rewrite(query))
+}
+
+func (c *rewriteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, c.dialect.Rewrite(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c *rewriteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return e.ExecContext(ctx, c.dialect.Rewrite(query), args)
+}
+
+func (c *rewriteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return q.QueryContext(ctx, c.dialect.Rewrite(query), args)
+}
+
+func (c *rewriteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != 0 || opts.ReadOnly {
+		return nil, errors.New("store: transaction options are not supported")
+	}
+	return c.Conn.Begin()
+}
+
+func (c *rewriteConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *rewriteConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *rewriteConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue sends booleans as 0 and 1, which is how veil's schema
+// stores them, in INTEGER columns
+func (c *rewriteConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v := nv.Value
+	if valuer, ok := v.(driver.Valuer); ok {
+		var err error
+		if v, err = valuer.Value(); err != nil {
+			return err
+		}
+	}
+	if b, ok := v.(bool); ok {
+		nv.Value = int64(0)
+		if b {
+			nv.Value = int64(1)
+		}
+		return nil
+	}
+	return driver.ErrSkip
+}
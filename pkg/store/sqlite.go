@@ -0,0 +1,81 @@
+package store
+
+import "database/sql"
+
+// SQLite is the dialect veil's statements are written in
+type SQLite struct{}
+
+func (SQLite) Name() string                { return "sqlite" }
+func (SQLite) Rewrite(query string) string { return query }
+func (SQLite) Schema(stmt string) string   { return stmt }
+func (SQLite) NoLimit() string             { return "-1" }
+
+func (SQLite) Tables(q Querier) ([]string, error) {
+	return textColumn(q, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+}
+
+func (SQLite) Columns(q Querier, table string) ([]Column, error) {
+	rows, err := q.Query(`SELECT name, upper(type), "notnull", pk FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []Column
+	for rows.Next() {
+		var c Column
+		var pk int
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull, &pk); err != nil {
+			return nil, err
+		}
+		c.PK = pk > 0
+		cols = append(cols, c)
+	}
+	return cols, rows.Err()
+}
+
+func (SQLite) ForeignKeys(q Querier) ([]ForeignKey, error) {
+	rows, err := q.Query(`SELECT m.name, f."from", f."table", COALESCE(f."to", 'id') FROM sqlite_master m, pragma_foreign_key_list(m.name) f
+		WHERE m.type = 'table'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []ForeignKey
+	for rows.Next() {
+		var k ForeignKey
+		if err := rows.Scan(&k.Table, &k.Column, &k.RefTable, &k.RefCol); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (SQLite) IntegrityCheck(q Querier) (string, error) {
+	var result string
+	err := q.QueryRow(`PRAGMA integrity_check`).Scan(&result)
+	return result, err
+}
+
+func (SQLite) DeferForeignKeys(tx *sql.Tx) error {
+	_, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`)
+	return err
+}
+
+// textColumn runs a query returning one text column
+func textColumn(q Querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,156 @@
+// Package store hides which SQL database holds a vault. Veil's queries are
+// written for SQLite; a Dialect knows what another database needs instead,
+// rewriting placeholders and migrations for it and answering the questions
+// SQLite answers with PRAGMAs. OpenPostgres connects to PostgreSQL with
+// lib/pq, wrapped so every statement is rewritten on its way out.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Dialect is what differs between the databases veil runs on
+type Dialect interface {
+	// Name is sqlite or postgres
+	Name() string
+	// Rewrite turns the placeholders of a statement written for SQLite into
+	// this dialect's
+	Rewrite(query string) string
+	// Schema turns a migration statement written for SQLite into this
+	// dialect: column types, keys and the like
+	Schema(stmt string) string
+	// Tables lists the tables, sorted by name
+	Tables(q Querier) ([]string, error)
+	// Columns lists the columns of table
+	Columns(q Querier, table string) ([]Column, error)
+	// ForeignKeys lists the declared foreign keys
+	ForeignKeys(q Querier) ([]ForeignKey, error)
+	// IntegrityCheck checks the database file, returning "ok" when it's
+	// sound or what's wrong
+	IntegrityCheck(q Querier) (string, error)
+	// DeferForeignKeys checks tx's foreign keys at commit, not per statement
+	DeferForeignKeys(tx *sql.Tx) error
+	// NoLimit is the LIMIT that keeps every row, for an OFFSET without a limit
+	NoLimit() string
+}
+
+// Querier is a *sql.DB or *sql.Tx
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Column is a column of a table
+type Column struct {
+	Name    string
+	Type    string // upper case, as declared
+	NotNull bool
+	PK      bool
+}
+
+// ForeignKey is a column referring to the id of another table
+type ForeignKey struct {
+	Table    string
+	Column   string
+	RefTable string
+	RefCol   string
+}
+
+// IsPostgresURL reports whether dsn is a postgres:// URL
+func IsPostgresURL(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+// ParsePostgresURL checks a postgres:// URL, filling in what veil defaults:
+// sslmode=prefer and application_name=veil
+func ParsePostgresURL(url string) (pq.Config, error) {
+	if !IsPostgresURL(url) {
+		return pq.Config{}, errors.New("store: not a postgres:// URL")
+	}
+	cfg, err := pq.NewConfig(url)
+	if err != nil {
+		// the URL may hold a password; leave it out of the error
+		return pq.Config{}, errors.New("store: malformed postgres:// URL")
+	}
+	if cfg.SSLMode == "" {
+		cfg.SSLMode = pq.SSLModePrefer
+	}
+	if cfg.ApplicationName == "" {
+		cfg.ApplicationName = "veil"
+	}
+	return cfg, nil
+}
+
+// OpenPostgres opens the PostgreSQL database at a postgres:// URL, taking
+// statements written for SQLite
+func OpenPostgres(url string) (*sql.DB, error) {
+	cfg, err := ParsePostgresURL(url)
+	if err != nil {
+		return nil, err
+	}
+	c, err := pq.NewConnectorConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(&rewriteConnector{c, Postgres{}}), nil
+}
+
+// SQLState is the SQLSTATE of a PostgreSQL error, such as 23505 for a
+// unique violation, or "" for any other error
+func SQLState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
+
+// For returns the dialect of db
+func For(db *sql.DB) Dialect {
+	if d, ok := db.Driver().(rewriteDriver); ok {
+		return d.dialect
+	}
+	return SQLite{}
+}
+
+// IsPostgres reports whether db is a PostgreSQL database
+func IsPostgres(db *sql.DB) bool {
+	return For(db).Name() == "postgres"
+}
+
+// rewriteConnector hands out connections that rewrite statements for dialect
+type rewriteConnector struct {
+	driver.Connector
+	dialect Dialect
+}
+
+func (c *rewriteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &rewriteConn{conn, c.dialect}, nil
+}
+
+func (c *rewriteConnector) Driver() driver.Driver {
+	return rewriteDriver{c.Connector.Driver(), c.dialect}
+}
+
+type rewriteDriver struct {
+	driver.Driver
+	dialect Dialect
+}
+
+func (d rewriteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &rewriteConn{conn, d.dialect}, nil
+}
@@ -0,0 +1,253 @@
+// Package validate decodes JSON request bodies and checks them against
+// `validate` struct tags, reporting problems per field.
+//
+// Rules are comma separated:
+//
+//	required     the value is not empty (zero, "", nil or no elements)
+//	min=N,max=N  bounds on string length in characters, on the number of
+//	             elements of a slice or map, or on a number's value
+//	oneof=a|b    a non-empty string is one of the listed values
+//
+// Fields are named by their json tag. Nested structs are checked with a
+// dotted prefix.
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"veil/pkg/apierror"
+)
+
+// FieldError is one invalid field. Field is empty for problems with the body
+// as a whole.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors is every problem found in a request body
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	parts := make([]string, len(e))
+	for i, f := range e {
+		if f.Field == "" {
+			parts[i] = f.Message
+		} else {
+			parts[i] = f.Field + " " + f.Message
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Add records a problem found by a handler's own checks
+func (e *Errors) Add(field, message string) {
+	*e = append(*e, FieldError{Field: field, Message: message})
+}
+
+// Err returns e as an error, or nil when it is empty
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// DecodeJSON decodes a JSON body into v and validates it. Malformed JSON and
+// values of the wrong type are reported as Errors like failed rules.
+func DecodeJSON(r io.Reader, v interface{}) error {
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.Is(err, io.EOF):
+			return Errors{{Message: errEmptyBody}}
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return Errors{{Field: typeErr.Field, Message: "must be " + jsonKind(typeErr.Type)}}
+		default:
+			return Errors{{Message: "invalid JSON: " + err.Error()}}
+		}
+	}
+	return Struct(v).Err()
+}
+
+// DecodeOptionalJSON is DecodeJSON for endpoints whose body may be left out.
+// An empty body leaves v as it is and passes.
+func DecodeOptionalJSON(r io.Reader, v interface{}) error {
+	err := DecodeJSON(r, v)
+	var verrs Errors
+	if errors.As(err, &verrs) && len(verrs) == 1 && verrs[0].Message == errEmptyBody {
+		return Struct(v).Err()
+	}
+	return err
+}
+
+const errEmptyBody = "request body is required"
+
+// jsonKind names a Go type the way a JSON client thinks of it
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
+
+// Struct checks the validate tags of the struct v points to
+func Struct(v interface{}) Errors {
+	var errs Errors
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		checkStruct("", rv, &errs)
+	}
+	return errs
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func checkStruct(prefix string, rv reflect.Value, errs *Errors) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n, _, _ := strings.Cut(tag, ","); n != "" {
+				name = n
+			}
+		}
+		fv := rv.Field(i)
+		if rules := f.Tag.Get("validate"); rules != "" {
+			checkField(prefix+name, fv, rules, errs)
+		}
+		if fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != timeType {
+			checkStruct(prefix+name+".", fv, errs)
+		}
+	}
+}
+
+func checkField(name string, fv reflect.Value, rules string, errs *Errors) {
+	for _, rule := range strings.Split(rules, ",") {
+		key, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch key {
+		case "required":
+			if fv.IsZero() || (hasLen(fv) && fv.Len() == 0) {
+				errs.Add(name, "is required")
+				return
+			}
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s rule on %s", key, name))
+			}
+			size, unit, ok := measure(fv)
+			if !ok {
+				continue
+			}
+			if key == "min" && size < n {
+				errs.Add(name, fmt.Sprintf("must be at least %s%s", arg, unit))
+			} else if key == "max" && size > n {
+				errs.Add(name, fmt.Sprintf("must be at most %s%s", arg, unit))
+			}
+		case "oneof":
+			if fv.Kind() != reflect.String || fv.String() == "" {
+				continue
+			}
+			allowed := strings.Split(arg, "|")
+			if !contains(allowed, fv.String()) {
+				sorted := append([]string{}, allowed...)
+				sort.Strings(sorted)
+				errs.Add(name, "must be one of "+strings.Join(sorted, ", "))
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q on %s", key, name))
+		}
+	}
+}
+
+func hasLen(fv reflect.Value) bool {
+	switch fv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return true
+	}
+	return false
+}
+
+// measure returns what min and max compare for fv
+func measure(fv reflect.Value) (float64, string, bool) {
+	switch fv.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(fv.String())), " characters", true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(fv.Len()), " items", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), "", true
+	}
+	return 0, "", false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteError answers 400 in the apierror envelope, with code "invalid" and
+// "fields": {field: message} beside it when err is Errors; other errors get
+// a plain 400
+func WriteError(w http.ResponseWriter, err error) {
+	var verrs Errors
+	if !errors.As(err, &verrs) {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields := map[string]string{}
+	for _, f := range verrs {
+		if _, seen := fields[f.Field]; !seen && f.Field != "" {
+			fields[f.Field] = f.Message
+		}
+	}
+	apierror.WriteWith(w, &apierror.Error{Status: http.StatusBadRequest, Code: "invalid", Message: verrs.Error()},
+		map[string]interface{}{"fields": fields})
+}
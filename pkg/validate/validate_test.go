@@ -0,0 +1,85 @@
+package validate
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type payload struct {
+	Name  string   `json:"name" validate:"required,max=5"`
+	Kind  string   `json:"kind,omitempty" validate:"oneof=a|b"`
+	Count int      `json:"count" validate:"min=1,max=3"`
+	Tags  []string `json:"tags" validate:"max=2"`
+	Inner struct {
+		ID string `json:"id" validate:"required"`
+	} `json:"inner"`
+}
+
+func TestDecodeJSONReportsEachField(t *testing.T) {
+	var p payload
+	err := DecodeJSON(strings.NewReader(`{"name":"toolong","kind":"c","count":0,"tags":["x","y","z"]}`), &p)
+	verrs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected Errors, got %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range verrs {
+		got[f.Field] = f.Message
+	}
+	want := map[string]string{
+		"name":     "must be at most 5 characters",
+		"kind":     "must be one of a, b",
+		"count":    "must be at least 1",
+		"tags":     "must be at most 2 items",
+		"inner.id": "is required",
+	}
+	for field, msg := range want {
+		if got[field] != msg {
+			t.Errorf("%s: got %q, want %q", field, got[field], msg)
+		}
+	}
+	if len(verrs) != len(want) {
+		t.Errorf("unexpected errors: %v", verrs)
+	}
+
+	if err := DecodeJSON(strings.NewReader(`{"name":"ok","count":2,"inner":{"id":"x"}}`), &payload{}); err != nil {
+		t.Fatalf("valid payload rejected: %v", err)
+	}
+}
+
+func TestDecodeJSONBodyErrors(t *testing.T) {
+	if err := DecodeJSON(strings.NewReader(""), &payload{}); err == nil || err.Error() != "request body is required" {
+		t.Fatalf("empty body: %v", err)
+	}
+	err := DecodeJSON(strings.NewReader(`{"name":"x","count":"two"}`), &payload{})
+	if verrs, ok := err.(Errors); !ok || verrs[0].Field != "count" || verrs[0].Message != "must be an integer" {
+		t.Fatalf("type mismatch: %v", err)
+	}
+	if err := DecodeJSON(strings.NewReader(`{"name":`), &payload{}); err == nil || !strings.HasPrefix(err.Error(), "invalid JSON") {
+		t.Fatalf("malformed body: %v", err)
+	}
+
+	var opt struct {
+		Kind string `json:"kind" validate:"oneof=a|b"`
+	}
+	if err := DecodeOptionalJSON(strings.NewReader(""), &opt); err != nil {
+		t.Fatalf("optional body may be empty: %v", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	WriteError(rr, Errors{{Field: "name", Message: "is required"}})
+	var out struct {
+		Error struct {
+			Code, Message string
+		} `json:"error"`
+		Fields map[string]string `json:"fields"`
+	}
+	json.NewDecoder(rr.Body).Decode(&out)
+	if rr.Code != 400 || out.Error.Code != "invalid" || out.Error.Message != "name is required" || out.Fields["name"] != "is required" {
+		t.Fatalf("unexpected response %d %+v", rr.Code, out)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"veil/pkg/apierror"
+	plugins "veil/pkg/plugins"
+	"veil/pkg/validate"
+)
+
+// === Plugin Permissions ===
+// Every /api/plugin-execute call needs a role for its plugin and action.
+// Actions on the built-in allow-list need a site role; anything else,
+// including terminal commands and DNS changes, is admin only. Rows in
+// plugin_permissions override the list, per action or plugin-wide with
+// action "*". Nothing is gated until accounts exist.
+
+// RoleAdmin is the role needed for plugin actions outside the allow-list.
+// The first account is an admin.
+const RoleAdmin = "admin"
+
+var pluginRoleRank = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleOwner: 3, RoleAdmin: 4}
+
+// pluginActionRoles lists the plugin actions open to non-admins and the site
+// role each needs
+var pluginActionRoles = map[string]map[string]string{
+	"git": {"status": RoleViewer, "list_issues": RoleViewer, "get_repos": RoleViewer},
+	"ipfs": {"status": RoleViewer, "get": RoleViewer,
+		"add": RoleEditor, "pin": RoleEditor, "unpin": RoleEditor, "publish": RoleEditor},
+	"media": {"extract_metadata": RoleViewer, "presets": RoleViewer,
+		"generate_thumbnail": RoleEditor, "optimize_image": RoleEditor, "transcode": RoleEditor,
+		"encode_audio": RoleEditor, "encode_video": RoleEditor},
+	"namecheap": {"list_domains": RoleViewer, "get_dns_records": RoleViewer, "get_subdomains": RoleViewer},
+	"pixospritz": {"get_game_status": RoleViewer, "get_leaderboard": RoleViewer, "get_scores": RoleViewer,
+		"save_score": RoleEditor, "embed_game": RoleEditor, "link_to_portfolio": RoleEditor},
+	"reminder": {"list": RoleViewer, "get": RoleViewer, "pending": RoleViewer,
+		"create": RoleEditor, "update": RoleEditor, "delete": RoleEditor, "dismiss": RoleEditor, "snooze": RoleEditor},
+	"shader": {"preview": RoleViewer, "create": RoleEditor, "compile": RoleEditor, "export": RoleEditor},
+	"svg":    {"export": RoleViewer, "create": RoleEditor, "update": RoleEditor, "import": RoleEditor},
+	"todo": {"list": RoleViewer, "get": RoleViewer,
+		"create": RoleEditor, "update": RoleEditor, "complete": RoleEditor, "reopen": RoleEditor, "delete": RoleEditor},
+}
+
+func init() {
+	plugins.AuthorizeExecute = authorizePluginAction
+	plugins.AuthorizePublish = authorizePublishJob
+}
+
+// pluginActionRole returns the role needed to run action on plugin and
+// whether it comes from plugin_permissions
+func pluginActionRole(plugin, action string) (role string, custom bool) {
+	if db.QueryRow(`SELECT role FROM plugin_permissions WHERE plugin = ? AND action = ?`, plugin, action).Scan(&role) == nil {
+		return role, true
+	}
+	if db.QueryRow(`SELECT role FROM plugin_permissions WHERE plugin = ? AND action = '*'`, plugin).Scan(&role) == nil {
+		return role, true
+	}
+	if role, ok := pluginActionRoles[plugin][action]; ok {
+		return role, false
+	}
+	return RoleAdmin, false
+}
+
+// pluginCallerRank is the strongest role the request holds for a plugin call.
+// A site_id in the payload checks that site; otherwise the user's strongest
+// membership counts. Sites without members are open to any signed-in user,
+// so there, and for users who belong to no site, that is owner and editor.
+// A failed membership lookup ranks 0, refusing the call.
+func pluginCallerRank(r *http.Request, payload interface{}) int {
+	u := currentUser(r)
+	if u == nil {
+		return 0
+	}
+	if u.IsAdmin {
+		return pluginRoleRank[RoleAdmin]
+	}
+	if p, ok := payload.(map[string]interface{}); ok {
+		if siteID, _ := p["site_id"].(string); siteID != "" {
+			if !siteHasACL(siteID) {
+				return pluginRoleRank[RoleOwner]
+			}
+			return pluginRoleRank[siteRole(u.ID, siteID)]
+		}
+	}
+	best, member := 0, false
+	rows, err := db.Query(`SELECT role FROM site_members WHERE user_id = ?`, u.ID)
+	if err != nil {
+		return 0
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return 0
+		}
+		member = true
+		if pluginRoleRank[role] > best {
+			best = pluginRoleRank[role]
+		}
+	}
+	if rows.Err() != nil {
+		return 0
+	}
+	if !member {
+		return pluginRoleRank[RoleEditor]
+	}
+	return best
+}
+
+// authorizePluginAction is plugins.AuthorizeExecute
+func authorizePluginAction(r *http.Request, plugin, action string, payload interface{}) error {
+	if !authEnabled() {
+		return nil
+	}
+	need, _ := pluginActionRole(plugin, action)
+	if pluginCallerRank(r, payload) >= pluginRoleRank[need] {
+		return nil
+	}
+	if need == RoleAdmin {
+		return fmt.Errorf("%s %s is restricted to admins", plugin, action)
+	}
+	return fmt.Errorf("%s %s requires the %s role", plugin, action, need)
+}
+
+// authorizePublishJob is plugins.AuthorizePublish: publishing a node needs
+// the right to change it, as /api/publish does, and a job without a node
+// needs the right to manage the channel's site
+func authorizePublishJob(r *http.Request, job plugins.PublishJob) error {
+	if !authEnabled() {
+		return nil
+	}
+	if job.NodeID != "" {
+		if !canModifyNode(r, job.NodeID) {
+			return fmt.Errorf("editor role required to publish")
+		}
+		return nil
+	}
+	c, err := getChannel(job.ChannelID)
+	if err != nil {
+		return fmt.Errorf("publishing channel %s not found", job.ChannelID)
+	}
+	if !canManageChannel(r, c.Config) {
+		return fmt.Errorf("admin or site owner required to publish to this channel")
+	}
+	return nil
+}
+
+// isAdminRequest reports whether the request may change admin settings
+func isAdminRequest(r *http.Request) bool {
+	if !authEnabled() {
+		return true
+	}
+	u := currentUser(r)
+	return u != nil && u.IsAdmin
+}
+
+// adminWrites serves reads through h to anyone signed in and needs an admin
+// for everything else; what names the resource in the 403
+func adminWrites(h http.HandlerFunc, what string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && !isAdminRequest(r) {
+			apierror.Write(w, http.StatusForbidden, "admin required to change "+what)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// PluginPermission is one entry of the plugin permission matrix
+type PluginPermission struct {
+	Plugin string `json:"plugin" validate:"required,max=128"`
+	Action string `json:"action" validate:"required,max=128"`
+	Role   string `json:"role" validate:"oneof=viewer|editor|owner|admin"`
+	Custom bool   `json:"custom"`
+}
+
+// /api/plugin-permissions: GET lists the matrix (actions not listed are admin
+// only), PUT {plugin, action, role} sets a requirement (action "*" for the
+// whole plugin, role "" restores the default). Changes need an admin.
+func handlePluginPermissions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		entries := map[string]PluginPermission{}
+		for plugin, actions := range pluginActionRoles {
+			for action, role := range actions {
+				entries[plugin+"\x00"+action] = PluginPermission{Plugin: plugin, Action: action, Role: role}
+			}
+		}
+		rows, err := db.Query(`SELECT plugin, action, role FROM plugin_permissions`)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		for rows.Next() {
+			var p PluginPermission
+			if err := rows.Scan(&p.Plugin, &p.Action, &p.Role); err != nil {
+				rows.Close()
+				apierror.WriteError(w, r, err)
+				return
+			}
+			p.Custom = true
+			entries[p.Plugin+"\x00"+p.Action] = p
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			apierror.WriteError(w, r, err)
+			return
+		}
+		out := make([]PluginPermission, 0, len(entries))
+		for _, p := range entries {
+			out = append(out, p)
+		}
+		sort.Slice(out, func(i, j int) bool {
+			if out[i].Plugin != out[j].Plugin {
+				return out[i].Plugin < out[j].Plugin
+			}
+			return out[i].Action < out[j].Action
+		})
+		json.NewEncoder(w).Encode(out)
+	case "PUT":
+		if !isAdminRequest(r) {
+			apierror.Write(w, http.StatusForbidden, "admin required to change plugin permissions")
+			return
+		}
+		var req PluginPermission
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if req.Role == "" {
+			db.Exec(`DELETE FROM plugin_permissions WHERE plugin = ? AND action = ?`, req.Plugin, req.Action)
+		} else if _, err := db.Exec(`INSERT INTO plugin_permissions (plugin, action, role, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(plugin, action) DO UPDATE SET role = excluded.role, updated_at = excluded.updated_at`,
+			req.Plugin, req.Action, req.Role, time.Now().Unix()); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		req.Role, req.Custom = pluginActionRole(req.Plugin, req.Action)
+		json.NewEncoder(w).Encode(req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// /api/plugin-limits: GET lists each plugin's execution limits, PUT
+// {plugin, timeout_ms, max_concurrent, max_payload_bytes} sets them (0 keeps
+// the default, all 0 restores the defaults). Changes need an admin.
+func handlePluginLimits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		limits, err := plugins.ListExecutionLimits()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(limits)
+	case "PUT":
+		if !isAdminRequest(r) {
+			apierror.Write(w, http.StatusForbidden, "admin required to change plugin limits")
+			return
+		}
+		var req plugins.ExecutionLimits
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if err := plugins.SetExecutionLimits(req); err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(plugins.GetExecutionLimits(req.Plugin))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// /api/plugin-executions?plugin=&limit= lists recent plugin calls, newest
+// first, with their duration and outcome
+func handlePluginExecutions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 1000 {
+		limit = n
+	}
+	history, err := plugins.ExecutionHistory(r.URL.Query().Get("plugin"), limit)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPluginExecuteAuthorization(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(user string) string {
+		rr := do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"})
+		var out struct {
+			Token string `json:"token"`
+			User  User   `json:"user"`
+		}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out.Token
+	}
+	execute := func(token, plugin, action string, payload interface{}) int {
+		return do("POST", "/api/plugin-execute", token, map[string]interface{}{"plugin": plugin, "action": action, "payload": payload}).Code
+	}
+
+	do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"})
+	ada := login("ada")
+	do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"})
+	bob := login("bob")
+
+	var me User
+	json.NewDecoder(do("GET", "/api/auth/me", ada, nil).Body).Decode(&me)
+	if !me.IsAdmin {
+		t.Fatalf("the first account should be an admin")
+	}
+
+	if code := execute(bob, "terminal", "execute", map[string]interface{}{"command": "echo hi"}); code != http.StatusForbidden {
+		t.Fatalf("non-admin terminal execute: expected 403, got %d", code)
+	}
+	if code := execute(bob, "namecheap", "set_dns_record", map[string]interface{}{}); code != http.StatusForbidden {
+		t.Fatalf("non-admin DNS change: expected 403, got %d", code)
+	}
+	if code := execute(bob, "todo", "list", map[string]interface{}{}); code == http.StatusForbidden {
+		t.Fatalf("allow-listed action should be open to members")
+	}
+	if code := execute(ada, "namecheap", "set_dns_record", map[string]interface{}{}); code == http.StatusForbidden {
+		t.Fatalf("admins may run any action")
+	}
+
+	// on a site with members the site role counts
+	var site Site
+	json.NewDecoder(do("POST", "/api/sites", ada, map[string]string{"name": "Team"}).Body).Decode(&site)
+	var bobUser User
+	json.NewDecoder(do("GET", "/api/auth/me", bob, nil).Body).Decode(&bobUser)
+	do("POST", "/api/sites/"+site.ID+"/members", ada, map[string]string{"user_id": bobUser.ID, "role": RoleViewer})
+	if code := execute(bob, "todo", "create", map[string]interface{}{"site_id": site.ID, "title": "x"}); code != http.StatusForbidden {
+		t.Fatalf("viewer creating a todo: expected 403, got %d", code)
+	}
+	if code := execute(bob, "todo", "list", map[string]interface{}{"site_id": site.ID}); code == http.StatusForbidden {
+		t.Fatalf("viewer listing todos should be allowed")
+	}
+
+	// admins change the matrix, others cannot
+	if rr := do("PUT", "/api/plugin-permissions", bob, PluginPermission{Plugin: "terminal", Action: "execute", Role: RoleViewer}); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin matrix change: expected 403, got %d", rr.Code)
+	}
+	if rr := do("PUT", "/api/plugin-permissions", ada, PluginPermission{Plugin: "todo", Action: "*", Role: RoleViewer}); rr.Code != http.StatusOK {
+		t.Fatalf("admin matrix change: %d %s", rr.Code, rr.Body.String())
+	}
+	if code := execute(bob, "todo", "create", map[string]interface{}{"site_id": site.ID, "title": "x"}); code == http.StatusForbidden {
+		t.Fatalf("plugin-wide override should open todo create to viewers")
+	}
+	var matrix []PluginPermission
+	json.NewDecoder(do("GET", "/api/plugin-permissions", bob, nil).Body).Decode(&matrix)
+	found := false
+	for _, p := range matrix {
+		if p.Plugin == "todo" && p.Action == "*" && p.Custom {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("custom entry missing from matrix: %+v", matrix)
+	}
+
+	// only admins change the plugin registry, and nobody adds a command through it
+	shell := map[string]interface{}{"name": "Shell", "slug": "shell", "enabled": true,
+		"manifest": `{"runtime": "exec", "command": "/bin/sh", "args": ["-c", "exit 1"]}`}
+	if rr := do("POST", "/api/plugins-registry", bob, shell); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin plugin add: expected 403, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/plugins-registry", ada, shell); rr.Code != http.StatusBadRequest {
+		t.Fatalf("exec plugin added over the API: expected 400, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/api/plugins-registry?id=todo", bob, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin plugin delete: expected 403, got %d", rr.Code)
+	}
+	if rr := do("GET", "/api/plugins-registry", bob, nil); rr.Code != http.StatusOK {
+		t.Fatalf("members may list plugins, got %d", rr.Code)
+	}
+
+	// and credentials
+	if rr := do("POST", "/api/credentials", bob, map[string]string{"key": "github_token", "value": "x", "plugin": "git"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin credential store: expected 403, got %d", rr.Code)
+	}
+	if rr := do("DELETE", "/api/credentials/github_token", bob, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin credential delete: expected 403, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/credentials/rotate", bob, map[string]string{"passphrase": "mine now"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("non-admin key rotation: expected 403, got %d", rr.Code)
+	}
+}
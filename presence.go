@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/validate"
+)
+
+// === Presence ===
+// Each open editor tab (a client) sends a heartbeat naming the node it is on
+// and whether it is viewing or editing, with an optional cursor. Clients that
+// miss heartbeats for presenceTimeout are dropped. Changes go out on the event
+// bus as presence.updated and presence.left, so /ws subscribers can warn when
+// someone else is editing the same node. Presence lives in memory only.
+
+const (
+	presenceTimeout       = 45 * time.Second
+	presenceSweepInterval = 15 * time.Second
+)
+
+// Presence is one client's position
+type Presence struct {
+	ClientID string          `json:"client_id" validate:"required,max=128"`
+	NodeID   string          `json:"node_id" validate:"required,max=128"`
+	State    string          `json:"state" validate:"oneof=viewing|editing"`
+	Cursor   *PresenceCursor `json:"cursor,omitempty"`
+	UserID   string          `json:"user_id,omitempty"`
+	Username string          `json:"username,omitempty"`
+	LastSeen int64           `json:"last_seen"`
+	// conn ties the entry to the WebSocket that sent it, if any
+	conn uint64
+}
+
+// PresenceCursor is a position or selection in the node's content
+type PresenceCursor struct {
+	Line   int `json:"line" validate:"min=0"`
+	Column int `json:"column" validate:"min=0"`
+	// SelectionEnd is a character offset, 0 for no selection
+	SelectionEnd int `json:"selection_end,omitempty" validate:"min=0"`
+}
+
+type presenceTracker struct {
+	mu      sync.Mutex
+	clients map[string]*Presence
+}
+
+var presence = &presenceTracker{clients: map[string]*Presence{}}
+
+// errPresenceTaken is returned when a client id belongs to another user
+var errPresenceTaken = validate.Errors{{Field: "client_id", Message: "is in use by another user"}}
+
+// heartbeat records p and announces it when the node, state or cursor changed
+func (t *presenceTracker) heartbeat(p Presence, now time.Time) error {
+	if p.State == "" {
+		p.State = "viewing"
+	}
+	p.LastSeen = now.Unix()
+	t.mu.Lock()
+	old := t.clients[p.ClientID]
+	if old != nil && old.UserID != p.UserID {
+		t.mu.Unlock()
+		return errPresenceTaken
+	}
+	t.clients[p.ClientID] = &p
+	t.mu.Unlock()
+
+	if old != nil && old.NodeID != p.NodeID {
+		publishPresence(events.PresenceLeft, *old)
+	}
+	if old == nil || old.NodeID != p.NodeID || old.State != p.State || !sameCursor(old.Cursor, p.Cursor) {
+		publishPresence(events.PresenceUpdated, p)
+	}
+	return nil
+}
+
+func sameCursor(a, b *PresenceCursor) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// leave drops clientID if it belongs to userID
+func (t *presenceTracker) leave(clientID, userID string) bool {
+	t.mu.Lock()
+	p := t.clients[clientID]
+	if p == nil || p.UserID != userID {
+		t.mu.Unlock()
+		return false
+	}
+	delete(t.clients, clientID)
+	t.mu.Unlock()
+	publishPresence(events.PresenceLeft, *p)
+	return true
+}
+
+// dropConn drops every client heard from over WebSocket conn
+func (t *presenceTracker) dropConn(conn uint64) {
+	t.drop(func(p *Presence) bool { return p.conn == conn })
+}
+
+// sweep drops clients whose last heartbeat is older than presenceTimeout
+func (t *presenceTracker) sweep(now time.Time) {
+	cutoff := now.Add(-presenceTimeout).Unix()
+	t.drop(func(p *Presence) bool { return p.LastSeen < cutoff })
+}
+
+func (t *presenceTracker) drop(match func(*Presence) bool) {
+	var gone []Presence
+	t.mu.Lock()
+	for id, p := range t.clients {
+		if match(p) {
+			gone = append(gone, *p)
+			delete(t.clients, id)
+		}
+	}
+	t.mu.Unlock()
+	for _, p := range gone {
+		publishPresence(events.PresenceLeft, p)
+	}
+}
+
+// list returns the clients on nodeID, or on every node when it is empty,
+// oldest heartbeat first
+func (t *presenceTracker) list(nodeID string) []Presence {
+	t.mu.Lock()
+	out := []Presence{}
+	for _, p := range t.clients {
+		if nodeID == "" || p.NodeID == nodeID {
+			out = append(out, *p)
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LastSeen != out[j].LastSeen {
+			return out[i].LastSeen < out[j].LastSeen
+		}
+		return out[i].ClientID < out[j].ClientID
+	})
+	return out
+}
+
+func publishPresence(typ string, p Presence) {
+	data := map[string]interface{}{
+		"client_id": p.ClientID, "node_id": p.NodeID, "state": p.State,
+		"user_id": p.UserID, "username": p.Username, "last_seen": p.LastSeen,
+	}
+	if p.Cursor != nil {
+		data["cursor"] = p.Cursor
+	}
+	events.Publish(typ, data)
+}
+
+// watchPresence sweeps out silent clients until the returned stop is called
+func watchPresence(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				presence.sweep(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// presenceHeartbeat validates and records a heartbeat from the request's user
+func presenceHeartbeat(r *http.Request, p Presence, conn uint64) error {
+	if errs := validate.Struct(&p); len(errs) > 0 {
+		return errs
+	}
+	var exists int
+	db.QueryRow(`SELECT 1 FROM nodes WHERE id = ? AND deleted_at IS NULL`, p.NodeID).Scan(&exists)
+	if siteID, _, vis := nodeAccess(p.NodeID); exists == 0 || !nodeReadFilter(r)(siteID, vis) {
+		return validate.Errors{{Field: "node_id", Message: "is not a node you can read"}}
+	}
+	p.UserID, p.Username = "", ""
+	if u := currentUser(r); u != nil {
+		p.UserID, p.Username = u.ID, u.Username
+	}
+	p.conn = conn
+	return presence.heartbeat(p, time.Now())
+}
+
+// /api/presence: GET ?node_id= lists who is on a node (every readable node
+// without it), POST {client_id, node_id, state, cursor} is a heartbeat and
+// returns the other clients on the node, DELETE ?client_id= leaves.
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	presence.sweep(time.Now())
+	switch r.Method {
+	case "GET":
+		canRead := nodeReadFilter(r)
+		out := []Presence{}
+		for _, p := range presence.list(r.URL.Query().Get("node_id")) {
+			if siteID, _, vis := nodeAccess(p.NodeID); canRead(siteID, vis) {
+				out = append(out, p)
+			}
+		}
+		json.NewEncoder(w).Encode(out)
+	case "POST":
+		var p Presence
+		if err := validate.DecodeJSON(r.Body, &p); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		if err := presenceHeartbeat(r, p, 0); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		others := []Presence{}
+		editing := false
+		for _, o := range presence.list(p.NodeID) {
+			if o.ClientID == p.ClientID {
+				continue
+			}
+			others = append(others, o)
+			editing = editing || o.State == "editing"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"others":         others,
+			"others_editing": editing,
+			"timeout":        int(presenceTimeout.Seconds()),
+		})
+	case "DELETE":
+		if !presence.leave(r.URL.Query().Get("client_id"), currentUserID(r)) {
+			apierror.Write(w, http.StatusNotFound, "client not present")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
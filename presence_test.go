@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"veil/pkg/events"
+)
+
+func TestPresenceHeartbeatsAndTimeouts(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	presence = &presenceTracker{clients: map[string]*Presence{}}
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, mime_type, created_at, modified_at) VALUES ('node_p', 'note', 'p.md', 'P', '', 'text/markdown', 1, 1)`)
+
+	sub := events.Subscribe(16, "presence.*")
+	defer sub.Close()
+
+	mux := setupRoutes()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	if rr := do("POST", "/api/presence", `{"client_id":"a","node_id":"node_p","state":"editing","cursor":{"line":2,"column":4}}`); rr.Code != http.StatusOK {
+		t.Fatalf("heartbeat a: %d %s", rr.Code, rr.Body.String())
+	}
+	rr := do("POST", "/api/presence", `{"client_id":"b","node_id":"node_p"}`)
+	var res struct {
+		Others        []Presence `json:"others"`
+		OthersEditing bool       `json:"others_editing"`
+	}
+	json.NewDecoder(rr.Body).Decode(&res)
+	if len(res.Others) != 1 || res.Others[0].ClientID != "a" || !res.OthersEditing {
+		t.Fatalf("b should see a editing: %+v", res)
+	}
+	if res.Others[0].Cursor == nil || res.Others[0].Cursor.Line != 2 {
+		t.Fatalf("cursor not kept: %+v", res.Others[0])
+	}
+
+	if rr := do("POST", "/api/presence", `{"client_id":"c","node_id":"node_missing"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unknown node should be refused, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/presence", `{"client_id":"c","node_id":"node_p","state":"typing"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("bad state should be refused, got %d", rr.Code)
+	}
+
+	// an unchanged heartbeat is not announced again
+	do("POST", "/api/presence", `{"client_id":"b","node_id":"node_p"}`)
+	if n := len(sub.C); n != 2 {
+		t.Fatalf("expected 2 presence.updated events, got %d", n)
+	}
+	<-sub.C
+	<-sub.C
+
+	var list []Presence
+	json.NewDecoder(do("GET", "/api/presence?node_id=node_p", "").Body).Decode(&list)
+	if len(list) != 2 {
+		t.Fatalf("expected 2 clients on node_p, got %+v", list)
+	}
+
+	if rr := do("DELETE", "/api/presence?client_id=b", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("leave: %d", rr.Code)
+	}
+	if ev := <-sub.C; ev.Type != events.PresenceLeft {
+		t.Fatalf("expected presence.left, got %+v", ev)
+	}
+
+	// a client that stops sending heartbeats times out
+	presence.sweep(time.Now().Add(presenceTimeout + time.Second))
+	if ev := <-sub.C; ev.Type != events.PresenceLeft || ev.Data.(map[string]interface{})["client_id"] != "a" {
+		t.Fatalf("expected a to time out, got %+v", ev)
+	}
+	if got := presence.list(""); len(got) != 0 {
+		t.Fatalf("expected nobody present, got %+v", got)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// === Print and Reader Views ===
+// /veil/ URIs take ?view=print or ?view=reader to render the node itself
+// instead of redirecting to its preview: the title, a byline and the body
+// in a plain serif column, without navigation, scripts or node assets.
+// Footnotes ([^id] with a "[^id]: text" line) are numbered and listed in
+// full after the body. The print view also spells out where each link goes
+// and ends with a QR code of the node's canonical URI, so a paper copy
+// leads back to the page.
+
+var (
+	footnoteDef = regexp.MustCompile(`(?m)^\[\^([^\]\s]+)\]:[ \t]*(.*)$`)
+	footnoteRef = regexp.MustCompile(`\[\^([^\]\s]+)\]`)
+)
+
+const viewCSS = `body { font: 1.15rem/1.7 Georgia, "Times New Roman", serif; color: #111; background: #fff; max-width: 40em; margin: 0 auto; padding: 2rem 1.25rem; }
+h1, h2, h3, h4, h5 { line-height: 1.25; margin: 1.6em 0 0.6em; }
+h1 { margin-top: 0; }
+.byline { color: #555; font-style: italic; margin-bottom: 2em; }
+a { color: inherit; }
+pre, code { font-family: "Courier New", monospace; font-size: 0.9em; }
+pre { white-space: pre-wrap; border-left: 3px solid #ddd; padding-left: 1em; }
+img, svg { max-width: 100%; height: auto; }
+.footnotes { border-top: 1px solid #ccc; margin-top: 3em; font-size: 0.9em; }
+.canonical { margin-top: 3em; display: flex; gap: 1em; align-items: center; font-size: 0.8em; color: #555; word-break: break-all; }
+.canonical svg { width: 8em; flex-shrink: 0; }
+.view-print a[href^="http"]::after { content: " (" attr(href) ")"; font-size: 0.85em; word-break: break-all; }
+@media (prefers-color-scheme: dark) { .view-reader { color: #ddd; background: #181818; } .view-reader .byline { color: #999; } }
+@media print { body { max-width: none; padding: 0; font-size: 11pt; } a[href^="http"]::after { content: " (" attr(href) ")"; } h1, h2, h3 { break-after: avoid; } pre, figure, .canonical { break-inside: avoid; } }
+`
+
+// handleNodeView writes the print or reader view of a node
+func handleNodeView(w http.ResponseWriter, r *http.Request, siteID, nodeID, view string) {
+	if view != "print" && view != "reader" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("view must be print or reader"))
+		return
+	}
+	var node Node
+	var modified int64
+	var siteName string
+	err := db.QueryRow(`SELECT id, type, title, content, COALESCE(mime_type, ''), COALESCE(metadata, ''), modified_at, COALESCE(canonical_uri, '')
+		FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+		Scan(&node.ID, &node.Type, &node.Title, &node.Content, &node.MimeType, &node.Metadata, &modified, &node.CanonicalURI)
+	if err != nil || !canReadNode(r, node.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Node not found"))
+		return
+	}
+	db.QueryRow(`SELECT name FROM sites WHERE id = ?`, siteID).Scan(&siteName)
+	node.ModifiedAt = time.Unix(modified, 0)
+	page := renderNodeView(node, siteName, viewURI(r, node.CanonicalURI), view)
+
+	w.Header().Set("Content-Security-Policy", pageCSP(siteID))
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(page))
+}
+
+// renderNodeView is the print or reader view page of a node, linking to uri
+func renderNodeView(node Node, siteName, uri, view string) string {
+	var body string
+	switch node.Type {
+	case "shader":
+		body = "<pre><code>" + html.EscapeString(node.Content) + "</code></pre>"
+	case "canvas":
+		body = "<figure>" + sanitizeSVG(node.Content) + "</figure>"
+	case NodeTypeTable:
+		if t, err := parseTable(node.Content, node.MimeType, node.Metadata); err == nil {
+			body = tableHTML(t)
+		} else {
+			body = "<pre>" + html.EscapeString(node.Content) + "</pre>"
+		}
+	default:
+		body = footnotedHTML(node.Content)
+	}
+	byline := node.ModifiedAt.Format("January 2, 2006")
+	if siteName != "" {
+		byline = html.EscapeString(siteName) + " · " + byline
+	}
+	canonical := ""
+	if view == "print" {
+		if qr, err := qrSVG(uri); err == nil {
+			canonical = fmt.Sprintf("<footer class=\"canonical\">%s<span>%s</span></footer>\n", qr, html.EscapeString(uri))
+		}
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<link rel="canonical" href="%s">
+<style>
+%s</style>
+</head>
+<body class="view-%s">
+<article>
+<h1>%s</h1>
+<p class="byline">%s</p>
+%s</article>
+%s</body>
+</html>`, html.EscapeString(node.Title), html.EscapeString(uri), viewCSS, view, html.EscapeString(node.Title), byline, body, canonical)
+}
+
+// viewURI is the address a view's QR code and canonical link point to: the
+// node's canonical URI when it is a web address, else the /veil/ URI asked for
+func viewURI(r *http.Request, canonical string) string {
+	if strings.HasPrefix(canonical, "https://") || strings.HasPrefix(canonical, "http://") {
+		return canonical
+	}
+	return requestBaseURL(r) + r.URL.EscapedPath()
+}
+
+// footnotedHTML renders markdown with its footnotes numbered in the order
+// they are referenced and listed after the body. References without a
+// definition are left as written.
+func footnotedHTML(markdown string) string {
+	notes := map[string]string{}
+	markdown = footnoteDef.ReplaceAllStringFunc(markdown, func(m string) string {
+		def := footnoteDef.FindStringSubmatch(m)
+		notes[def[1]] = def[2]
+		return ""
+	})
+	var order []string
+	number := map[string]int{}
+	body := footnoteRef.ReplaceAllStringFunc(markdownToHTML(markdown), func(m string) string {
+		id := footnoteRef.FindStringSubmatch(m)[1]
+		if _, ok := notes[id]; !ok {
+			return m
+		}
+		n, seen := number[id]
+		if seen {
+			return fmt.Sprintf(`<sup><a href="#fn-%d">%d</a></sup>`, n, n)
+		}
+		order = append(order, id)
+		n = len(order)
+		number[id] = n
+		return fmt.Sprintf(`<sup><a href="#fn-%d" id="fnref-%d">%d</a></sup>`, n, n, n)
+	})
+	if len(order) == 0 {
+		return body
+	}
+
+	var list strings.Builder
+	list.WriteString("<section class=\"footnotes\">\n<ol>\n")
+	for i, id := range order {
+		text := strings.TrimSpace(markdownToHTML(notes[id]))
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "<p>"), "</p>")
+		fmt.Fprintf(&list, "<li id=\"fn-%d\">%s <a href=\"#fnref-%d\">↩</a></li>\n", i+1, text, i+1)
+	}
+	list.WriteString("</ol>\n</section>\n")
+	return body + list.String()
+}
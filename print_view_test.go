@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQRCode(t *testing.T) {
+	// "HELLO WORLD" as version 1-M data codewords and their error correction
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Fatalf("error correction: got %v, want %v", got, want)
+	}
+
+	// level M with mask 0 is 101010000010010, top left copy read outwards
+	q := newQRCode(7)
+	q.drawFormat(0)
+	var format string
+	for _, c := range []int{0, 1, 2, 3, 4, 5, 7, 8} {
+		format += map[bool]string{true: "1", false: "0"}[q.modules[8][c]]
+	}
+	for _, r := range []int{7, 5, 4, 3, 2, 1, 0} {
+		format += map[bool]string{true: "1", false: "0"}[q.modules[r][8]]
+	}
+	if format != "101010000010010" {
+		t.Fatalf("format information: %s", format)
+	}
+	// version 7's information is 000111110010010100, least significant bit first
+	version := 0
+	for i := 17; i >= 0; i-- {
+		version = version<<1 | map[bool]int{true: 1}[q.modules[i/3][q.size-11+i%3]]
+	}
+	if version != 0x07C94 {
+		t.Fatalf("version information: %018b", version)
+	}
+
+	if q, err := encodeQR("https://notes.example/veil/node/node_1"); err != nil || q.size != 29 {
+		t.Fatalf("a short URL should fit version 3: %v", err)
+	}
+	if _, err := encodeQR(strings.Repeat("x", 214)); err != errQRTooLong {
+		t.Fatalf("214 bytes should not fit: %v", err)
+	}
+}
+
+func TestNodeViews(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "print-view-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'notes', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'Tides', ?, 'a', 'text/markdown', 'published', 1, 1)`,
+		"---\ntitle: Tides\n---\n# Tides\n\nThe moon pulls[^moon] and the sun too[^sun], see [charts](https://tides.example).\n\n[^moon]: Mostly.\n[^sun]: Less so.\n")
+	mux := setupRoutes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	rr := get("/veil/notes/a.md?view=print")
+	body := rr.Body.String()
+	if rr.Code != 200 {
+		t.Fatalf("print view: %d %s", rr.Code, body)
+	}
+	for _, want := range []string{
+		`<body class="view-print">`,
+		`pulls<sup><a href="#fn-1" id="fnref-1">1</a></sup>`,
+		`<li id="fn-2">Less so. <a href="#fnref-2">↩</a></li>`,
+		`<link rel="canonical" href="http://example.com/veil/notes/a.md">`,
+		`<svg xmlns="http://www.w3.org/2000/svg"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("print view is missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "title: Tides") || strings.Contains(body, "<nav") || strings.Contains(body, "<script") {
+		t.Fatalf("print view should be the article alone:\n%s", body)
+	}
+
+	rr = get("/veil/node/a?view=reader")
+	if rr.Code != 200 || !strings.Contains(rr.Body.String(), `<body class="view-reader">`) || strings.Contains(rr.Body.String(), "<svg") {
+		t.Fatalf("reader view: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/veil/node/a?view=slides"); rr.Code != 400 {
+		t.Fatalf("unknown views should be refused: %d", rr.Code)
+	}
+	if rr := get("/veil/node/a"); rr.Code != 302 {
+		t.Fatalf("without a view the URI still redirects: %d", rr.Code)
+	}
+
+	out := filepath.Join(tmp, "dist")
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", Theme: "default"}, out); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(out, "a.html"))
+	if _, err := os.Stat(filepath.Join(out, "print.css")); err != nil || !strings.Contains(string(page), `<link rel="stylesheet" href="print.css" media="print">`) {
+		t.Fatalf("exports should carry a print stylesheet: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// === QR Codes ===
+// A small QR encoder for the print view, which ends with a code of the
+// page's address. Text is encoded as bytes at error correction level M in
+// the smallest of versions 1 to 10 it fits, which holds 213 bytes: plenty
+// for a URL. The symbol is drawn as SVG.
+
+// qrBlocks is, per version at level M, the error correction codewords per
+// block and the two groups of blocks with their data codewords
+var qrBlocks = [...]struct{ ec, n1, d1, n2, d2 int }{
+	{10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0}, {24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39}, {22, 3, 36, 2, 37}, {26, 4, 43, 1, 44},
+}
+
+// qrAlignment is the row and column of each version's alignment patterns
+var qrAlignment = [...][]int{
+	nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+var errQRTooLong = errors.New("text is too long for a QR code")
+
+// qrCode is a symbol's modules, true for dark, indexed [row][col]
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // finder, timing, alignment, format and version modules
+}
+
+// encodeQR encodes text as a QR symbol
+func encodeQR(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v <= len(qrBlocks); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrDataCodewords(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// byte mode, the length, the data, a terminator, then pad bytes
+	var bits qrBits
+	bits.add(0x4, 4)
+	if version >= 10 {
+		bits.add(len(data), 16)
+	} else {
+		bits.add(len(data), 8)
+	}
+	for _, b := range data {
+		bits.add(int(b), 8)
+	}
+	capacity := 8 * qrDataCodewords(version)
+	bits.add(0, min(4, capacity-len(bits)))
+	bits.add(0, (8-len(bits)%8)%8)
+	codewords := bits.bytes()
+	for pad := byte(0xEC); len(codewords) < capacity/8; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	q := newQRCode(version)
+	q.placeCodewords(qrInterleave(version, codewords))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // masking twice undoes it
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+func qrDataCodewords(version int) int {
+	b := qrBlocks[version-1]
+	return b.n1*b.d1 + b.n2*b.d2
+}
+
+// qrBits is a bit stream, most significant bit first
+type qrBits []bool
+
+func (b *qrBits) add(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 == 1)
+	}
+}
+
+func (b qrBits) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// qrInterleave splits data into the version's blocks, adds each block's
+// error correction and interleaves them as the symbol stores them
+func qrInterleave(version int, data []byte) []byte {
+	spec := qrBlocks[version-1]
+	divisor := rsDivisor(spec.ec)
+	var blocks, ecc [][]byte
+	for i := 0; i < spec.n1+spec.n2; i++ {
+		n := spec.d1
+		if i >= spec.n1 {
+			n = spec.d2
+		}
+		blocks = append(blocks, data[:n])
+		ecc = append(ecc, rsRemainder(data[:n], divisor))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i < max(spec.d1, spec.d2); i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ec; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ byte(int(z>>7)*0x1D)
+		if y>>i&1 == 1 {
+			z ^= x
+		}
+	}
+	return z
+}
+
+// rsDivisor is the Reed-Solomon generator polynomial of the given degree,
+// leading coefficient left out
+func rsDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = gfMul(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return out
+}
+
+// rsRemainder is the error correction codewords of data
+func rsRemainder(data, divisor []byte) []byte {
+	out := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i, c := range divisor {
+			out[i] ^= gfMul(c, factor)
+		}
+	}
+	return out
+}
+
+// newQRCode is a blank symbol with its function patterns drawn
+func newQRCode(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	// finders with their separators
+	for _, c := range [][2]int{{3, 3}, {3, size - 4}, {size - 4, 3}} {
+		for dr := -4; dr <= 4; dr++ {
+			for dc := -4; dc <= 4; dc++ {
+				r, col := c[0]+dr, c[1]+dc
+				if r < 0 || r >= size || col < 0 || col >= size {
+					continue
+				}
+				d := max(abs(dr), abs(dc))
+				q.set(r, col, d != 2 && d != 4)
+			}
+		}
+	}
+	centres := qrAlignment[version-1]
+	for i, r := range centres {
+		for j, c := range centres {
+			if (i == 0 && j == 0) || (i == 0 && j == len(centres)-1) || (i == len(centres)-1 && j == 0) {
+				continue // taken by a finder
+			}
+			for dr := -2; dr <= 2; dr++ {
+				for dc := -2; dc <= 2; dc++ {
+					q.set(r+dr, c+dc, max(abs(dr), abs(dc)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0) // reserves the format modules until the mask is chosen
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			a, b := size-11+i%3, i/3
+			q.set(b, a, bits>>i&1 == 1)
+			q.set(a, b, bits>>i&1 == 1)
+		}
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (q *qrCode) set(row, col int, dark bool) {
+	q.modules[row][col] = dark
+	q.function[row][col] = true
+}
+
+// drawFormat draws both copies of the format information for level M and mask
+func (q *qrCode) drawFormat(mask int) {
+	data := mask // level M's two bits are 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(i, 8, bit(i))
+	}
+	q.set(7, 8, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(8, 7, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(8, 14-i, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(8, q.size-1-i, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(q.size-15+i, 8, bit(i))
+	}
+	q.set(q.size-8, 8, true) // the dark module
+}
+
+// placeCodewords lays data out in the zigzag of two-module columns, right
+// to left, skipping function modules
+func (q *qrCode) placeCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			row := vert
+			if upward {
+				row = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				col := right - j
+				if q.function[row][col] || i >= len(data)*8 {
+					continue
+				}
+				q.modules[row][col] = data[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules mask selects
+func (q *qrCode) applyMask(mask int) {
+	for r := 0; r < q.size; r++ {
+		for c := 0; c < q.size; c++ {
+			if q.function[r][c] {
+				continue
+			}
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (r+c)%2 == 0
+			case 1:
+				flip = r%2 == 0
+			case 2:
+				flip = c%3 == 0
+			case 3:
+				flip = (r+c)%3 == 0
+			case 4:
+				flip = (r/2+c/3)%2 == 0
+			case 5:
+				flip = r*c%2+r*c%3 == 0
+			case 6:
+				flip = (r*c%2+r*c%3)%2 == 0
+			case 7:
+				flip = ((r+c)%2+r*c%3)%2 == 0
+			}
+			q.modules[r][c] = q.modules[r][c] != flip
+		}
+	}
+}
+
+// penalty scores how hard the symbol is to read; the mask with the lowest
+// score is used
+func (q *qrCode) penalty() int {
+	at := func(r, c int, transpose bool) bool {
+		if transpose {
+			return q.modules[c][r]
+		}
+		return q.modules[r][c]
+	}
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	score, dark := 0, 0
+	for _, transpose := range []bool{false, true} {
+		for r := 0; r < q.size; r++ {
+			run := 1
+			for c := 1; c <= q.size; c++ {
+				if c < q.size && at(r, c, transpose) == at(r, c-1, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for c := 0; c+11 <= q.size; c++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if at(r, c+k, transpose) != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+	for r := 0; r < q.size; r++ {
+		for c := 0; c < q.size; c++ {
+			if q.modules[r][c] {
+				dark++
+			}
+			if r+1 < q.size && c+1 < q.size && q.modules[r][c] == q.modules[r+1][c] &&
+				q.modules[r][c] == q.modules[r][c+1] && q.modules[r][c] == q.modules[r+1][c+1] {
+				score += 3
+			}
+		}
+	}
+	percent := dark * 100 / (q.size * q.size)
+	return score + abs(percent-50)/5*10
+}
+
+// qrSVG draws text as a QR code with a four module quiet zone
+func qrSVG(text string) (string, error) {
+	q, err := encodeQR(text)
+	if err != nil {
+		return "", err
+	}
+	var path strings.Builder
+	for r := 0; r < q.size; r++ {
+		for c := 0; c < q.size; c++ {
+			if q.modules[r][c] {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", c+4, r+4)
+			}
+		}
+	}
+	n := q.size + 8
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges" role="img"><rect width="%d" height="%d" fill="#fff"/><path d="%s" fill="#000"/></svg>`,
+		n, n, n, n, path.String()), nil
+}
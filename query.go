@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"veil/pkg/apierror"
+)
+
+// === Query API ===
+// /api/query runs read-only queries written in a small SQL-like language,
+// so dashboards can be built without access to the database:
+//
+//	SELECT title, modified_at FROM nodes
+//	WHERE type = 'post' AND tag = 'go' AND modified_at >= '2024-01-01'
+//	ORDER BY modified_at DESC LIMIT 10
+//
+//	SELECT type, COUNT(*) FROM nodes GROUP BY type ORDER BY count DESC
+//
+// Queries name a source (nodes, tags or references) and its fields, never
+// tables or columns: the server defines what each field is and how sources
+// join, and compiles the query to parameterized SQL. Only nodes the caller
+// can read are seen, deleted nodes never are. Conditions compare a field to
+// a value with = != < <= > >= LIKE CONTAINS IN (...) and IS [NOT] NULL,
+// combined with AND, OR, NOT and parentheses. Times compare to unix seconds,
+// RFC 3339 or YYYY-MM-DD and come back as RFC 3339.
+
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+	queryTimeout      = 5 * time.Second
+	queryMaxLength    = 4096
+)
+
+// queryField is a field of a query source. match is set for fields with
+// several values per row, like a node's tags: a condition on the field
+// holds when it holds for any value, with %s standing for the condition on
+// one value, written against column.
+type queryField struct {
+	expr   string
+	kind   string // text, number, time or bool
+	match  string
+	column string
+	doc    string
+}
+
+// querySource is what FROM can name: SQL over the nodes the caller can
+// read, in the readable CTE
+type querySource struct {
+	from     string
+	where    string
+	fields   map[string]queryField
+	defaults []string // the fields SELECT * returns
+	doc      string
+}
+
+var querySources = map[string]*querySource{
+	"nodes": {
+		from:  `nodes n LEFT JOIN node_visibility v ON v.node_id = n.id LEFT JOIN sites s ON s.id = n.site_id`,
+		where: `n.id IN (SELECT id FROM readable)`,
+		fields: map[string]queryField{
+			"id":          {expr: "n.id", kind: "text"},
+			"type":        {expr: "n.type", kind: "text"},
+			"title":       {expr: "n.title", kind: "text"},
+			"path":        {expr: "n.path", kind: "text"},
+			"slug":        {expr: "n.slug", kind: "text"},
+			"status":      {expr: "n.status", kind: "text"},
+			"visibility":  {expr: "v.visibility", kind: "text"},
+			"mime_type":   {expr: "n.mime_type", kind: "text"},
+			"parent_id":   {expr: "n.parent_id", kind: "text"},
+			"site_id":     {expr: "n.site_id", kind: "text"},
+			"site":        {expr: "s.name", kind: "text", doc: "the site's name"},
+			"created_at":  {expr: "n.created_at", kind: "time"},
+			"modified_at": {expr: "n.modified_at", kind: "time"},
+			"archived_at": {expr: "n.archived_at", kind: "time"},
+			"archived":    {expr: "n.archived_at IS NOT NULL", kind: "bool"},
+			"backlinks":   {expr: "COALESCE(n.backlink_count, 0)", kind: "number", doc: "how many live nodes link here"},
+			"length":      {expr: "LENGTH(COALESCE(n.content, ''))", kind: "number", doc: "characters of content"},
+			"tag": {expr: "(SELECT string_agg(t.name, ', ') FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = n.id)", kind: "text",
+				match: "EXISTS (SELECT 1 FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = n.id AND %s)", column: "t.name",
+				doc: "the node's tags; tag = 'x' holds when any tag is x"},
+		},
+		defaults: []string{"id", "type", "title", "path", "status", "modified_at"},
+		doc:      "live nodes",
+	},
+	"tags": {
+		from:  `tags t`,
+		where: `EXISTS (SELECT 1 FROM node_tags nt WHERE nt.tag_id = t.id AND nt.node_id IN (SELECT id FROM readable))`,
+		fields: map[string]queryField{
+			"id":    {expr: "t.id", kind: "text"},
+			"name":  {expr: "t.name", kind: "text"},
+			"nodes": {expr: "(SELECT COUNT(*) FROM node_tags nt WHERE nt.tag_id = t.id AND nt.node_id IN (SELECT id FROM readable))", kind: "number", doc: "how many nodes have the tag"},
+		},
+		defaults: []string{"name", "nodes"},
+		doc:      "tags in use on live nodes",
+	},
+	"references": {
+		from:  `node_references r JOIN nodes src ON src.id = r.source_node_id JOIN nodes dst ON dst.id = r.target_node_id`,
+		where: `r.source_node_id IN (SELECT id FROM readable) AND r.target_node_id IN (SELECT id FROM readable)`,
+		fields: map[string]queryField{
+			"id":           {expr: "r.id", kind: "text"},
+			"link_type":    {expr: "r.link_type", kind: "text"},
+			"link_text":    {expr: "r.link_text", kind: "text"},
+			"created_at":   {expr: "r.created_at", kind: "time"},
+			"source.id":    {expr: "src.id", kind: "text"},
+			"source.title": {expr: "src.title", kind: "text"},
+			"source.type":  {expr: "src.type", kind: "text"},
+			"source.path":  {expr: "src.path", kind: "text"},
+			"target.id":    {expr: "dst.id", kind: "text"},
+			"target.title": {expr: "dst.title", kind: "text"},
+			"target.type":  {expr: "dst.type", kind: "text"},
+			"target.path":  {expr: "dst.path", kind: "text"},
+		},
+		defaults: []string{"source.title", "target.title", "link_type", "link_text"},
+		doc:      "links between live nodes",
+	},
+}
+
+// queryToken is a token of a query: i for a word, s for a string, n for a
+// number, p for punctuation and 0 at the end
+type queryToken struct {
+	kind byte
+	text string
+	pos  int
+}
+
+// queryError is a mistake in a query, at a position in it
+type queryError struct {
+	pos int
+	msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("%s (at %d)", e.msg, e.pos)
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	var toks []queryToken
+	rs := []rune(q)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, queryToken{'i', string(rs[i:j]), i})
+			i = j
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			toks = append(toks, queryToken{'n', string(rs[i:j]), i})
+			i = j
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(rs); j++ {
+				if rs[j] == '\'' {
+					if j+1 < len(rs) && rs[j+1] == '\'' {
+						b.WriteRune('\'')
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, &queryError{i, "unterminated string"}
+			}
+			toks = append(toks, queryToken{'s', b.String(), i})
+			i = j + 1
+		default:
+			op := string(c)
+			if i+1 < len(rs) {
+				if two := string(rs[i : i+2]); two == "!=" || two == "<>" || two == "<=" || two == ">=" {
+					op = two
+				}
+			}
+			if !strings.Contains("(),*=<>", op) && op != "!=" && op != "<>" && op != "<=" && op != ">=" {
+				return nil, &queryError{i, fmt.Sprintf("unexpected %q", op)}
+			}
+			toks = append(toks, queryToken{'p', op, i})
+			i += len([]rune(op))
+		}
+	}
+	return append(toks, queryToken{0, "", len(rs)}), nil
+}
+
+// compiledQuery is a query as SQL, with the names and kinds of its columns
+type compiledQuery struct {
+	sql     string
+	args    []interface{}
+	columns []string
+	kinds   []string
+	limit   int
+}
+
+type queryParser struct {
+	toks []queryToken
+	i    int
+	src  *querySource
+	args []interface{}
+}
+
+func (p *queryParser) peek() queryToken { return p.toks[p.i] }
+
+func (p *queryParser) next() queryToken {
+	t := p.toks[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the word kw, consuming it if so
+func (p *queryParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == 'i' && strings.EqualFold(t.text, kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) punct(s string) bool {
+	if t := p.peek(); t.kind == 'p' && t.text == s {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) fail(msg string) error {
+	t := p.peek()
+	if t.kind == 0 {
+		return &queryError{t.pos, msg + ", found the end of the query"}
+	}
+	return &queryError{t.pos, fmt.Sprintf("%s, found %q", msg, t.text)}
+}
+
+func (p *queryParser) expect(kw string) error {
+	if !p.keyword(kw) {
+		return p.fail("expected " + kw)
+	}
+	return nil
+}
+
+// field reads a field name of the source
+func (p *queryParser) field() (string, queryField, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		return "", queryField{}, p.fail("expected a field")
+	}
+	name := strings.ToLower(t.text)
+	f, ok := p.src.fields[name]
+	if !ok {
+		return "", queryField{}, &queryError{t.pos, fmt.Sprintf("%s has no field %q", sourceName(p.src), t.text)}
+	}
+	p.i++
+	return name, f, nil
+}
+
+func sourceName(src *querySource) string {
+	for name, s := range querySources {
+		if s == src {
+			return name
+		}
+	}
+	return ""
+}
+
+// value reads a literal as an argument for a field of kind
+func (p *queryParser) value(kind string) (interface{}, error) {
+	t := p.next()
+	bad := func() error {
+		return &queryError{t.pos, fmt.Sprintf("%q is not a %s value", t.text, kind)}
+	}
+	switch {
+	case t.kind == 'i' && strings.EqualFold(t.text, "null"):
+		return nil, nil
+	case kind == "bool" && t.kind == 'i' && (strings.EqualFold(t.text, "true") || strings.EqualFold(t.text, "false")):
+		if strings.EqualFold(t.text, "true") {
+			return 1, nil
+		}
+		return 0, nil
+	case kind == "number" && (t.kind == 'n' || t.kind == 's'):
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, bad()
+		}
+		return n, nil
+	case kind == "time" && (t.kind == 'n' || t.kind == 's'):
+		at, err := parseAsOf(t.text)
+		if err != nil {
+			return nil, &queryError{t.pos, err.Error()}
+		}
+		return at.Unix(), nil
+	case kind == "text" && (t.kind == 's' || t.kind == 'n'):
+		return t.text, nil
+	}
+	if t.kind == 0 {
+		p.i--
+		return nil, p.fail("expected a value")
+	}
+	return nil, bad()
+}
+
+func (p *queryParser) arg(v interface{}) string {
+	p.args = append(p.args, v)
+	return "?"
+}
+
+// or parses conditions joined by OR
+func (p *queryParser) or() (string, error) {
+	left, err := p.and()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return "", err
+		}
+		left = left + " OR " + right
+	}
+	return left, nil
+}
+
+func (p *queryParser) and() (string, error) {
+	left, err := p.not()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + ") AND (" + right + ")"
+	}
+	return left, nil
+}
+
+func (p *queryParser) not() (string, error) {
+	if p.keyword("not") {
+		c, err := p.not()
+		return "NOT (" + c + ")", err
+	}
+	if p.punct("(") {
+		c, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		if !p.punct(")") {
+			return "", p.fail("expected )")
+		}
+		return "(" + c + ")", nil
+	}
+	return p.comparison()
+}
+
+// comparison parses FIELD OP VALUE, FIELD [NOT] IN (...) and FIELD IS [NOT] NULL
+func (p *queryParser) comparison() (string, error) {
+	_, f, err := p.field()
+	if err != nil {
+		return "", err
+	}
+	expr := f.expr
+	if f.match != "" {
+		expr = f.column
+	}
+	// on a field with several values a negative condition holds when no
+	// value matches
+	cond := func(c string, negate bool) string {
+		if f.match == "" {
+			if negate {
+				return "NOT (" + c + ")"
+			}
+			return c
+		}
+		c = fmt.Sprintf(f.match, c)
+		if negate {
+			return "NOT " + c
+		}
+		return c
+	}
+
+	if p.keyword("is") {
+		negate := p.keyword("not")
+		if !p.keyword("null") {
+			return "", p.fail("expected NULL")
+		}
+		if f.match != "" {
+			return cond("1 = 1", !negate), nil
+		}
+		if negate {
+			return expr + " IS NOT NULL", nil
+		}
+		return expr + " IS NULL", nil
+	}
+	negate := p.keyword("not")
+	switch {
+	case p.keyword("in"):
+		if !p.punct("(") {
+			return "", p.fail("expected (")
+		}
+		var marks []string
+		for {
+			v, err := p.value(f.kind)
+			if err != nil {
+				return "", err
+			}
+			marks = append(marks, p.arg(v))
+			if p.punct(")") {
+				break
+			}
+			if !p.punct(",") {
+				return "", p.fail("expected , or )")
+			}
+		}
+		return cond(expr+" IN ("+strings.Join(marks, ", ")+")", negate), nil
+	case p.keyword("like"), p.keyword("contains"):
+		contains := strings.EqualFold(p.toks[p.i-1].text, "contains")
+		t := p.peek()
+		if f.kind != "text" {
+			return "", &queryError{t.pos, "LIKE and CONTAINS compare text"}
+		}
+		v, err := p.value("text")
+		if err != nil {
+			return "", err
+		}
+		s, _ := v.(string)
+		if contains {
+			s = "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s) + "%"
+		}
+		return cond("lower("+expr+") LIKE lower("+p.arg(s)+`) ESCAPE '\'`, negate), nil
+	case negate:
+		return "", p.fail("expected IN, LIKE or CONTAINS")
+	}
+
+	t := p.next()
+	ops := map[string]string{"=": "=", "!=": "=", "<>": "=", "<": "<", "<=": "<=", ">": ">", ">=": ">="}
+	op, ok := ops[t.text]
+	if t.kind != 'p' || !ok {
+		p.i--
+		return "", p.fail("expected a comparison")
+	}
+	negate = t.text == "!=" || t.text == "<>"
+	v, err := p.value(f.kind)
+	if err != nil {
+		return "", err
+	}
+	if v == nil {
+		return "", &queryError{t.pos, "compare with IS NULL or IS NOT NULL"}
+	}
+	return cond(expr+" "+op+" "+p.arg(v), negate), nil
+}
+
+// compileQuery turns a query into SQL for the nodes readable (the CTE's
+// query and arguments)
+func compileQuery(q, readable string, readableArgs []interface{}) (*compiledQuery, error) {
+	if len(q) > queryMaxLength {
+		return nil, &queryError{queryMaxLength, fmt.Sprintf("queries are limited to %d characters", queryMaxLength)}
+	}
+	toks, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	if err := p.expect("select"); err != nil {
+		return nil, err
+	}
+
+	// fields are resolved once FROM names the source
+	type item struct {
+		name  string
+		pos   int
+		count bool
+	}
+	var items []item
+	star := p.punct("*")
+	for !star {
+		t := p.peek()
+		if p.keyword("count") {
+			if !p.punct("(") || !p.punct("*") || !p.punct(")") {
+				return nil, p.fail("expected COUNT(*)")
+			}
+			items = append(items, item{name: "count", pos: t.pos, count: true})
+		} else if t.kind == 'i' && !strings.EqualFold(t.text, "from") {
+			items = append(items, item{name: strings.ToLower(t.text), pos: t.pos})
+			p.i++
+		} else {
+			return nil, p.fail("expected a field or COUNT(*)")
+		}
+		if !p.punct(",") {
+			break
+		}
+	}
+	if err := p.expect("from"); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	p.src = querySources[strings.ToLower(t.text)]
+	if t.kind != 'i' || p.src == nil {
+		names := make([]string, 0, len(querySources))
+		for name := range querySources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, &queryError{t.pos, "FROM takes one of " + strings.Join(names, ", ")}
+	}
+	if star {
+		for _, name := range p.src.defaults {
+			items = append(items, item{name: name})
+		}
+	}
+
+	cq := &compiledQuery{}
+	var selects []string
+	aggregate := false
+	for _, it := range items {
+		if it.count {
+			selects = append(selects, "COUNT(*)")
+			cq.columns, cq.kinds = append(cq.columns, "count"), append(cq.kinds, "number")
+			aggregate = true
+			continue
+		}
+		f, ok := p.src.fields[it.name]
+		if !ok {
+			return nil, &queryError{it.pos, fmt.Sprintf("%s has no field %q", t.text, it.name)}
+		}
+		selects = append(selects, f.expr)
+		cq.columns, cq.kinds = append(cq.columns, it.name), append(cq.kinds, f.kind)
+	}
+
+	where := p.src.where
+	if p.keyword("where") {
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		where += " AND (" + c + ")"
+	}
+
+	var groups []string
+	grouped := map[string]bool{}
+	if p.keyword("group") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+		for {
+			name, f, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, f.expr)
+			grouped[name] = true
+			if !p.punct(",") {
+				break
+			}
+		}
+		aggregate = true
+	}
+	if aggregate {
+		for _, it := range items {
+			if !it.count && !grouped[it.name] {
+				return nil, &queryError{it.pos, fmt.Sprintf("%s must be in GROUP BY to be selected with COUNT(*)", it.name)}
+			}
+		}
+	}
+
+	var orders []string
+	if p.keyword("order") {
+		if err := p.expect("by"); err != nil {
+			return nil, err
+		}
+		for {
+			t := p.peek()
+			var expr string
+			if p.keyword("count") {
+				if !aggregate {
+					return nil, &queryError{t.pos, "ORDER BY count needs COUNT(*)"}
+				}
+				p.punct("(")
+				p.punct("*")
+				p.punct(")")
+				expr = "COUNT(*)"
+			} else {
+				name, f, err := p.field()
+				if err != nil {
+					return nil, err
+				}
+				if aggregate && !grouped[name] {
+					return nil, &queryError{t.pos, fmt.Sprintf("%s must be in GROUP BY to order by it", name)}
+				}
+				expr = f.expr
+			}
+			if p.keyword("desc") {
+				expr += " DESC"
+			} else {
+				p.keyword("asc")
+			}
+			orders = append(orders, expr)
+			if !p.punct(",") {
+				break
+			}
+		}
+	}
+
+	limit, offset := queryDefaultLimit, 0
+	if p.keyword("limit") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != 'n' || err != nil || n < 0 {
+			return nil, &queryError{t.pos, "LIMIT takes a number of rows"}
+		}
+		limit = min(n, queryMaxLimit)
+	}
+	if p.keyword("offset") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != 'n' || err != nil || n < 0 {
+			return nil, &queryError{t.pos, "OFFSET takes a number of rows"}
+		}
+		offset = n
+	}
+	if p.peek().kind != 0 {
+		return nil, p.fail("expected the end of the query")
+	}
+
+	var b strings.Builder
+	b.WriteString("WITH readable AS (" + readable + ") SELECT " + strings.Join(selects, ", ") + " FROM " + p.src.from + " WHERE " + where)
+	if len(groups) > 0 {
+		b.WriteString(" GROUP BY " + strings.Join(groups, ", "))
+	}
+	if len(orders) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(orders, ", "))
+	}
+	// one more row than asked for tells whether there are more
+	fmt.Fprintf(&b, " LIMIT %d OFFSET %d", limit+1, offset)
+	cq.sql, cq.limit = b.String(), limit
+	cq.args = append(append([]interface{}{}, readableArgs...), p.args...)
+	return cq, nil
+}
+
+// readableNodesSQL selects the ids of the live nodes the request may read
+func readableNodesSQL(r *http.Request) (string, []interface{}) {
+	cond, args := nodeReadSQL(r)
+	return `SELECT n.id FROM nodes n LEFT JOIN node_visibility v ON v.node_id = n.id WHERE n.deleted_at IS NULL AND ` + cond, args
+}
+
+// QueryResult is the table a query returns
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// More is set when rows past the limit were left out
+	More bool `json:"more"`
+}
+
+func runQuery(ctx context.Context, cq *compiledQuery) (*QueryResult, error) {
+	rows, err := db.QueryContext(ctx, cq.sql, cq.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := &QueryResult{Columns: cq.columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		vals := make([]interface{}, len(cq.columns))
+		ptrs := make([]interface{}, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range vals {
+			vals[i] = queryValue(cq.kinds[i], v)
+		}
+		res.Rows = append(res.Rows, vals)
+	}
+	if len(res.Rows) > cq.limit {
+		res.Rows, res.More = res.Rows[:cq.limit], true
+	}
+	return res, rows.Err()
+}
+
+// queryValue converts a value from the database for JSON by field kind
+func queryValue(kind string, v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		v = string(b)
+	}
+	n, isInt := v.(int64)
+	switch {
+	case v == nil:
+		return nil
+	case kind == "time" && isInt:
+		if n == 0 {
+			return nil
+		}
+		return time.Unix(n, 0).UTC().Format(time.RFC3339)
+	case kind == "bool" && isInt:
+		return n != 0
+	}
+	return v
+}
+
+// /api/query: GET ?q= or POST {"query"} runs a query and answers
+// {columns, rows, more}; GET without q describes the sources and fields
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var q string
+	switch r.Method {
+	case "GET":
+		q = r.URL.Query().Get("q")
+		if q == "" {
+			json.NewEncoder(w).Encode(querySchema())
+			return
+		}
+	case "POST":
+		var req struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
+			apierror.Write(w, http.StatusBadRequest, "body must be {\"query\": \"SELECT ...\"}")
+			return
+		}
+		q = req.Query
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	readable, args := readableNodesSQL(r)
+	cq, err := compileQuery(q, readable, args)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	res, err := runQuery(ctx, cq)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if ctx.Err() != nil {
+			status = http.StatusRequestTimeout
+		}
+		apierror.Write(w, status, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// querySchema describes each source: its fields, their kinds and what * selects
+func querySchema() map[string]interface{} {
+	out := map[string]interface{}{}
+	for name, src := range querySources {
+		fields := map[string]string{}
+		for fname, f := range src.fields {
+			fields[fname] = f.kind
+			if f.doc != "" {
+				fields[fname] += ": " + f.doc
+			}
+		}
+		out[name] = map[string]interface{}{"description": src.doc, "fields": fields, "default": src.defaults}
+	}
+	return out
+}
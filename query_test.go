@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestQueryAPI(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	query := func(token, q string) (QueryResult, *httptest.ResponseRecorder) {
+		rr := do("GET", "/api/query?q="+url.QueryEscape(q), token, nil)
+		var res QueryResult
+		json.NewDecoder(bytes.NewReader(rr.Body.Bytes())).Decode(&res)
+		return res, rr
+	}
+
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, status, created_at, modified_at) VALUES
+		('a', 'post', 'a.md', 'Go tips', 'see [[B]]', 'published', 1700000000, 1700000000),
+		('b', 'post', 'b.md', 'B', 'x', 'draft', 1700000000, 1710000000),
+		('c', 'note', 'c.md', 'It''s 100% done', '', 'draft', 1700000000, 1720000000),
+		('d', 'note', 'd.md', 'Deleted', '', 'draft', 1, 1)`)
+	testDB.Exec(`UPDATE nodes SET deleted_at = 5 WHERE id = 'd'`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'go'), ('t2', 'web'), ('t3', 'unused')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1'), ('nt2', 'a', 't2'), ('nt3', 'b', 't1'), ('nt4', 'd', 't3')`)
+	testDB.Exec(`INSERT INTO node_references (id, source_node_id, target_node_id, link_type, link_text, created_at) VALUES ('r1', 'a', 'b', 'wikilink', 'B', 1)`)
+
+	res, rr := query("", "select title, modified_at from nodes where type = 'post' and tag = 'go' and modified_at >= '2024-01-01' order by modified_at desc")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("query: %d %s", rr.Code, rr.Body.String())
+	}
+	if len(res.Columns) != 2 || len(res.Rows) != 1 || res.Rows[0][0] != "B" || res.Rows[0][1] != "2024-03-09T16:00:00Z" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	res, _ = query("", "SELECT type, COUNT(*) FROM nodes GROUP BY type ORDER BY count DESC, type")
+	if len(res.Rows) != 2 || res.Columns[1] != "count" || res.Rows[0][0] != "post" || res.Rows[0][1] != float64(2) || res.Rows[1][1] != float64(1) {
+		t.Fatalf("deleted nodes should not be counted: %+v", res)
+	}
+	res, _ = query("", "SELECT id FROM nodes WHERE tag != 'go' OR title CONTAINS '100%' ORDER BY id")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "c" {
+		t.Fatalf("!= on tags should match nodes without the tag, CONTAINS should escape %%: %+v", res)
+	}
+	res, _ = query("", "SELECT id FROM nodes WHERE NOT (id IN ('a', 'b')) AND tag IS NULL")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "c" {
+		t.Fatalf("unexpected NOT IN / IS NULL result: %+v", res)
+	}
+	res, _ = query("", "SELECT * FROM tags ORDER BY name")
+	if len(res.Rows) != 2 || res.Rows[0][0] != "go" || res.Rows[0][1] != float64(2) {
+		t.Fatalf("tags only on deleted nodes should be left out: %+v", res)
+	}
+	res, _ = query("", "SELECT source.title, target.title, link_type FROM references")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "Go tips" || res.Rows[0][1] != "B" {
+		t.Fatalf("unexpected references: %+v", res)
+	}
+	res, _ = query("", "SELECT id FROM nodes ORDER BY id LIMIT 1 OFFSET 1")
+	if len(res.Rows) != 1 || res.Rows[0][0] != "b" || !res.More {
+		t.Fatalf("unexpected page: %+v", res)
+	}
+
+	rr = do("POST", "/api/query", "", map[string]string{"query": "SELECT id FROM nodes WHERE title = 'x''; DROP TABLE nodes; --'"})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"rows":[]`) {
+		t.Fatalf("strings should only ever be values: %d %s", rr.Code, rr.Body.String())
+	}
+	for _, q := range []string{
+		"SELECT password_hash FROM users",
+		"SELECT title FROM users",
+		"SELECT title FROM nodes WHERE content = 'x'",
+		"SELECT title FROM nodes; DELETE FROM nodes",
+		"SELECT title, COUNT(*) FROM nodes",
+		"SELECT title FROM nodes WHERE backlinks > 'many'",
+		"SELECT title FROM nodes WHERE title = 'open",
+	} {
+		if _, rr := query("", q); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "(at ") {
+			t.Fatalf("%s: expected 400 with a position, got %d %s", q, rr.Code, rr.Body.String())
+		}
+	}
+	var schema map[string]struct {
+		Fields map[string]string `json:"fields"`
+	}
+	json.NewDecoder(do("GET", "/api/query", "", nil).Body).Decode(&schema)
+	if !strings.HasPrefix(schema["nodes"].Fields["modified_at"], "time") || len(schema["references"].Fields) == 0 {
+		t.Fatalf("unexpected schema: %+v", schema)
+	}
+
+	// with accounts, nodes of a site with members are theirs alone
+	do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"})
+	login := func(user string) string {
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"}).Body).Decode(&out)
+		return out.Token
+	}
+	ada := login("ada")
+	do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"})
+	bob := login("bob")
+	var site Site
+	json.NewDecoder(do("POST", "/api/sites", ada, map[string]string{"name": "Team"}).Body).Decode(&site)
+	testDB.Exec(`UPDATE nodes SET site_id = ? WHERE id = 'b'`, site.ID)
+
+	if res, _ := query(ada, "SELECT COUNT(*) FROM nodes"); len(res.Rows) != 1 || res.Rows[0][0] != float64(3) {
+		t.Fatalf("a member should see the site's nodes: %+v", res)
+	}
+	if res, _ := query(bob, "SELECT COUNT(*) FROM nodes"); len(res.Rows) != 1 || res.Rows[0][0] != float64(2) {
+		t.Fatalf("others should not: %+v", res)
+	}
+	if res, _ := query(bob, "SELECT id FROM references"); len(res.Rows) != 0 {
+		t.Fatalf("a link to a node they can't read should be hidden: %+v", res)
+	}
+}
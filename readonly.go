@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"veil/pkg/apierror"
+)
+
+// === Read-only Replicas ===
+// `veil serve --read-only` hosts a public mirror of a vault that is edited
+// elsewhere. Every endpoint that changes something answers 403, and the
+// background workers (jobs, reminders, notifications, trash purging,
+// alerts) are not started. Content still arrives over the replication
+// protocol: the editing instance pushes to /api/codex/sync/, which checks
+// its own --codex-sync-token.
+
+// readOnly is set by --read-only
+var readOnly bool
+
+// readOnlySafe lists the POST endpoints that only read: queries and
+// previews take their input as a body, and signing in only opens a session
+var readOnlySafe = map[string]bool{
+	"/api/query":               true,
+	"/api/verify":              true,
+	"/api/codex/query":         true,
+	"/api/codex/merge/preview": true,
+	"/api/auth/login":          true,
+	"/api/auth/logout":         true,
+}
+
+// readOnlyGuard refuses mutating requests while the server is a read-only
+// replica, and marks every response so clients can hide their editors
+func readOnlyGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Veil-Read-Only", "1")
+		// node deletion is a GET endpoint, so gate it explicitly
+		mutating := isMutating(r) || r.URL.Path == "/api/node-delete"
+		allowed := readOnlySafe[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/api/codex/sync/")
+		if mutating && !allowed {
+			w.Header().Set("Content-Type", "application/json")
+			apierror.Write(w, http.StatusForbidden, "this server is a read-only replica")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
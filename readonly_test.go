@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	codex "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+)
+
+func TestReadOnlyReplica(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	tmp := t.TempDir()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+	defer func(tok string) { codexSyncToken = tok }(codexSyncToken)
+	defer func() { readOnly = false }()
+
+	srv := httptest.NewServer(readOnlyGuard(requireAuth(setupRoutes())))
+	defer srv.Close()
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Docs', '', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, parent_id, site_id, path, title, content, mime_type, status, created_at, modified_at) VALUES ('n1', 'page', NULL, 's1', 'a.md', 'A', 'hello', 'text/markdown', 'published', 1, 1)`)
+	create := `{"type": "page", "site_id": "s1", "path": "b.md", "title": "B", "content": ""}`
+
+	if resp := do("GET", "/api/nodes", ""); resp.Header.Get("X-Veil-Read-Only") != "" {
+		t.Fatal("a normal server should not claim to be read-only")
+	}
+	readOnly = true
+
+	for _, c := range []struct{ method, path, body string }{
+		{"POST", "/api/node-create", create},
+		{"PUT", "/api/node-update", `{"id": "n1", "title": "Changed"}`},
+		{"GET", "/api/node-delete?id=n1", ""},
+		{"POST", "/api/node-move", `{"id": "n1", "folder": "x"}`},
+		{"POST", "/api/codex/push", `{"remote": "http://example.com"}`},
+		{"DELETE", "/api/alert-transports?id=x", ""},
+	} {
+		if resp := do(c.method, c.path, c.body); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s %s should be refused on a replica: %d", c.method, c.path, resp.StatusCode)
+		}
+	}
+	var count int
+	testDB.QueryRow(`SELECT COUNT(*) FROM nodes WHERE deleted_at IS NULL AND title = 'A'`).Scan(&count)
+	if count != 1 {
+		t.Fatal("nothing should have changed")
+	}
+
+	resp := do("GET", "/api/node/n1", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Veil-Read-Only") != "1" {
+		t.Fatalf("reads should be served and marked: %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp := do("POST", "/api/query", `{"query": "SELECT title FROM nodes"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("a query only reads: %d", resp.StatusCode)
+	}
+
+	// the editing instance still pushes to the mirror
+	codexSyncToken = "s3cret"
+	peerDir := filepath.Join(tmp, "peer")
+	peer := codex.NewRepository(fsstorage.New(peerDir), peerDir)
+	h, _ := peer.PutObjectStream(strings.NewReader(`{"urn":"urn:note:1","title":"Hi"}`), "application/json")
+	c := &codex.Commit{Timestamp: time.Now().UTC(), Message: "hi", Objects: []string{h}}
+	peer.PutCommit(c)
+	peer.SetRef("refs/heads/main", c.Hash)
+	if _, err := peer.Push(srv.URL+"/api/codex/sync", codex.SyncOptions{Token: "s3cret"}); err != nil {
+		t.Fatalf("push to the replica: %v", err)
+	}
+	if got, _ := codexRepo().GetRef("refs/heads/main"); got != c.Hash {
+		t.Fatalf("replica main = %q, want %s", got, c.Hash)
+	}
+}
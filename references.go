@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Automatic References ===
+// Saving a node rewrites its rows in node_references from the links in its
+// content, so backlinks follow the text. Three kinds of link are recognised:
+//   - wiki:     [[Title]], [[Title|label]] and [[Title#heading]], matched by
+//     title, slug or path
+//   - markdown: [text](path.md), [text](/veil/note/{id}) or a veil:// href
+//   - uri:      a bare veil://site/type/slug in the text
+// Links inside code are ignored, as are links that match no node.
+
+var (
+	refFencedCode   = regexp.MustCompile("(?s)```.*?```|~~~.*?~~~")
+	refInlineCode   = regexp.MustCompile("`[^`\n]*`")
+	refWikiLink     = regexp.MustCompile(`\[\[([^\[\]|#]+)(#[^\[\]|]*)?(\|[^\[\]]*)?\]\]`)
+	refMarkdownLink = regexp.MustCompile(`(!?)\[([^\]]*)\]\(<?([^)\s>]+)>?(?:\s+"[^"]*")?\)`)
+	refVeilURI      = regexp.MustCompile(`veil://[^\s<>"'()\[\]]+`)
+)
+
+// nodeLink is one link found in a node's content
+type nodeLink struct {
+	Type   string // wiki, markdown or uri
+	Target string // title, href or URI as written
+	Text   string // what the reader sees
+}
+
+// extractLinks lists the links in markdown content in the order they appear
+func extractLinks(content string) []nodeLink {
+	content = refFencedCode.ReplaceAllString(content, "")
+	content = refInlineCode.ReplaceAllString(content, "")
+
+	var links []nodeLink
+	content = refWikiLink.ReplaceAllStringFunc(content, func(m string) string {
+		sub := refWikiLink.FindStringSubmatch(m)
+		target := strings.TrimSpace(sub[1])
+		text := target
+		if label := strings.TrimSpace(strings.TrimPrefix(sub[3], "|")); label != "" {
+			text = label
+		}
+		if target != "" {
+			links = append(links, nodeLink{Type: "wiki", Target: target, Text: text})
+		}
+		return " "
+	})
+	content = refMarkdownLink.ReplaceAllStringFunc(content, func(m string) string {
+		sub := refMarkdownLink.FindStringSubmatch(m)
+		if sub[1] == "" {
+			links = append(links, nodeLink{Type: "markdown", Target: sub[3], Text: sub[2]})
+		}
+		return " "
+	})
+	for _, uri := range refVeilURI.FindAllString(content, -1) {
+		uri = strings.TrimRight(uri, ".,;:!?")
+		links = append(links, nodeLink{Type: "uri", Target: uri, Text: uri})
+	}
+	return links
+}
+
+// resolveLink finds the node a link points at, preferring nodes in siteID
+func resolveLink(siteID string, link nodeLink) string {
+	switch link.Type {
+	case "wiki":
+		return resolveNodeName(siteID, link.Target)
+	case "uri":
+		return resolveVeilURI(link.Target)
+	}
+
+	href := link.Target
+	if strings.HasPrefix(href, "veil://") {
+		return resolveVeilURI(href)
+	}
+	if strings.HasPrefix(href, "#") || strings.Contains(href, "://") || strings.HasPrefix(href, "mailto:") {
+		return ""
+	}
+	if i := strings.IndexAny(href, "?#"); i >= 0 {
+		href = href[:i]
+	}
+	if p, err := url.PathUnescape(href); err == nil {
+		href = p
+	}
+	for _, prefix := range []string{"/veil/note/", "/veil/node/"} {
+		if strings.HasPrefix(href, prefix) {
+			var id string
+			db.QueryRow(`SELECT id FROM nodes WHERE id = ? AND deleted_at IS NULL`, strings.TrimPrefix(href, prefix)).Scan(&id)
+			return id
+		}
+	}
+	href = strings.TrimPrefix(strings.TrimPrefix(href, "./"), "/")
+	if href == "" {
+		return ""
+	}
+	var id string
+	db.QueryRow(`SELECT id FROM nodes WHERE path = ? AND deleted_at IS NULL
+		ORDER BY (COALESCE(site_id, '') = ?) DESC, created_at LIMIT 1`, href, siteID).Scan(&id)
+	return id
+}
+
+// resolveNodeName matches a wiki link target against titles, then slugs,
+// then paths with or without a .md extension
+func resolveNodeName(siteID, name string) string {
+	const order = ` AND deleted_at IS NULL ORDER BY (COALESCE(site_id, '') = ?) DESC, created_at LIMIT 1`
+	var id string
+	if db.QueryRow(`SELECT id FROM nodes WHERE lower(title) = lower(?)`+order, name, siteID).Scan(&id) == nil ||
+		db.QueryRow(`SELECT id FROM nodes WHERE slug = ?`+order, name, siteID).Scan(&id) == nil ||
+		db.QueryRow(`SELECT id FROM nodes WHERE (path = ? OR path = ? || '.md')`+order, name, name, siteID).Scan(&id) == nil {
+		return id
+	}
+	return ""
+}
+
+// resolveVeilURI looks a veil:// URI up in node_uris, then as
+// veil://site/type/slug, where the slug may also be the node id
+func resolveVeilURI(uri string) string {
+	var id string
+	if db.QueryRow(`SELECT node_id FROM node_uris WHERE uri = ?`, uri).Scan(&id) == nil {
+		return id
+	}
+	if db.QueryRow(`SELECT id FROM nodes WHERE canonical_uri = ? AND deleted_at IS NULL`, uri).Scan(&id) == nil {
+		return id
+	}
+	parts := strings.SplitN(strings.TrimPrefix(uri, "veil://"), "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	site := parts[0]
+	if site == "default" {
+		site = ""
+	}
+	db.QueryRow(`SELECT id FROM nodes WHERE COALESCE(site_id, '') = ? AND type = ? AND (slug = ? OR id = ?) AND deleted_at IS NULL`,
+		site, parts[1], parts[2], parts[2]).Scan(&id)
+	return id
+}
+
+// syncNodeReferences replaces a node's outgoing references with the links in
+// its content. Links to itself or to unknown nodes are skipped, and each
+// target is recorded once per link type.
+func syncNodeReferences(nodeID, siteID, content string) error {
+	if _, err := db.Exec(`DELETE FROM node_references WHERE source_node_id = ?`, nodeID); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	seen := map[string]bool{}
+	for _, link := range extractLinks(content) {
+		target := resolveLink(siteID, link)
+		if target == "" || target == nodeID || seen[link.Type+"\x00"+target] {
+			continue
+		}
+		seen[link.Type+"\x00"+target] = true
+		if _, err := db.Exec(`INSERT INTO node_references (id, source_node_id, target_node_id, link_type, link_text, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			ids.New("ref"), nodeID, target, link.Type, link.Text, now); err != nil {
+			return err
+		}
+	}
+	return indexBacklinks(db, nodeID)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestExtractLinks(t *testing.T) {
+	content := "See [[Target Note|the target]] and [[Other#Intro]].\n" +
+		"A [markdown link](other.md), an ![image](pic.png), and [the web](https://example.com).\n" +
+		"Bare veil://site_a/note/target-note.\n" +
+		"```\n[[Not A Link]]\n```\nand `[[Nor This]]`"
+	got := extractLinks(content)
+	want := []nodeLink{
+		{Type: "wiki", Target: "Target Note", Text: "the target"},
+		{Type: "wiki", Target: "Other", Text: "Other"},
+		{Type: "markdown", Target: "other.md", Text: "markdown link"},
+		{Type: "markdown", Target: "https://example.com", Text: "the web"},
+		{Type: "uri", Target: "veil://site_a/note/target-note", Text: "veil://site_a/note/target-note"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d links, got %+v", len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("link %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestNodeReferencesFollowContent(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	wd, _ := os.Getwd()
+	tmp, err := ioutil.TempDir("", "references-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('site_a', 'Site A', 'project', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, slug, created_at, modified_at) VALUES
+		('node_target', 'note', 'site_a', 'target.md', 'Target Note', '', 'text/markdown', 'target-note', 1, 1),
+		('node_other', 'note', 'site_a', 'other.md', 'Other', '', 'text/markdown', 'other', 1, 1)`)
+
+	mux := setupRoutes()
+	save := func(method string, node map[string]string) Node {
+		b, _ := json.Marshal(node)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, map[string]string{"POST": "/api/node-create", "PUT": "/api/node-update"}[method], bytes.NewReader(b)))
+		if rr.Code != http.StatusCreated && rr.Code != http.StatusOK {
+			t.Fatalf("%s node: %d %s", method, rr.Code, rr.Body.String())
+		}
+		var n Node
+		json.NewDecoder(rr.Body).Decode(&n)
+		return n
+	}
+	refs := func(id string) map[string]string {
+		rows, err := testDB.Query(`SELECT target_node_id, link_type FROM node_references WHERE source_node_id = ?`, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		out := map[string]string{}
+		for rows.Next() {
+			var target, typ string
+			rows.Scan(&target, &typ)
+			out[target+" "+typ] = typ
+		}
+		return out
+	}
+
+	node := save("POST", map[string]string{"type": "note", "site_id": "site_a", "path": "source.md", "title": "Source",
+		"content": "Links to [[target note]], [the other](other.md), veil://site_a/note/target-note and [[Missing]]."})
+	got := refs(node.ID)
+	for _, want := range []string{"node_target wiki", "node_other markdown", "node_target uri"} {
+		if _, ok := got[want]; !ok {
+			t.Fatalf("missing reference %q in %v", want, got)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 references, got %v", got)
+	}
+
+	// editing the links away removes the stale rows
+	save("PUT", map[string]string{"id": node.ID, "type": "note", "path": "source.md", "title": "Source",
+		"content": "Only [[Other]] now."})
+	got = refs(node.ID)
+	if len(got) != 1 || got["node_other wiki"] == "" {
+		t.Fatalf("expected only the wiki link to Other, got %v", got)
+	}
+}
+
+func TestBacklinkIndex(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES
+		('a', 'note', 'a.md', 'A', '', 1, 1),
+		('b', 'note', 'b.md', 'B', '', 1, 1),
+		('c', 'note', 'c.md', 'C', '', 1, 1)`)
+	count := func(id string) int {
+		var n int
+		testDB.QueryRow(`SELECT backlink_count FROM nodes WHERE id = ?`, id).Scan(&n)
+		return n
+	}
+
+	if err := syncNodeReferences("b", "", "[[A]] twice: [a](a.md)"); err != nil {
+		t.Fatal(err)
+	}
+	syncNodeReferences("c", "", "[[A]] and [[B]]")
+	var links int
+	testDB.QueryRow(`SELECT link_count FROM node_backlinks WHERE target_node_id = 'a' AND source_node_id = 'b'`).Scan(&links)
+	if count("a") != 2 || count("b") != 1 || links != 2 {
+		t.Fatalf("expected counts 2 and 1 and one pair with 2 links, got %d, %d, %d", count("a"), count("b"), links)
+	}
+
+	// dropping a link and deleting a source both lower the counts
+	syncNodeReferences("c", "", "only [[B]] now")
+	if count("a") != 1 {
+		t.Fatalf("expected 1 backlink left on a, got %d", count("a"))
+	}
+	mux := setupRoutes()
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/node-delete?id=b", nil))
+	if count("a") != 0 {
+		t.Fatalf("a deleted node should not count, got %d", count("a"))
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/backlinks?ids=a,b,nope", nil))
+	var batch map[string]struct {
+		Count     int              `json:"count"`
+		Backlinks []backlinkSource `json:"backlinks"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &batch); err != nil {
+		t.Fatalf("%d %s", rr.Code, rr.Body.String())
+	}
+	if _, ok := batch["nope"]; ok || len(batch) != 1 {
+		t.Fatalf("only live, known ids should come back: %s", rr.Body.String())
+	}
+	if a := batch["a"]; a.Count != 0 || a.Backlinks == nil {
+		t.Fatalf("a should have an empty list: %s", rr.Body.String())
+	}
+
+	// a restored source counts again
+	testDB.Exec(`UPDATE nodes SET deleted_at = NULL WHERE id = 'b'`)
+	recountBacklinks(testDB, []string{"a", "b"})
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/backlinks?ids=a,b", nil))
+	json.Unmarshal(rr.Body.Bytes(), &batch)
+	if batch["b"].Count != 1 || batch["b"].Backlinks[0].ID != "c" || batch["a"].Backlinks[0].Path != "b.md" {
+		t.Fatalf("unexpected batch: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/backlinks", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("ids is required: %d", rr.Code)
+	}
+}
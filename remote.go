@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"veil/pkg/client"
+	"veil/pkg/plugins"
+	"veil/pkg/validate"
+)
+
+// === Remote mode ===
+// `veil --remote http://host:8080 <command>` runs the node commands against
+// a running server through pkg/client instead of opening a vault, as the
+// session in VEIL_SESSION_TOKEN (or --token). Commands that work on the
+// vault's files or database themselves (init, serve, migrate, fsck, ...)
+// refuse to run remotely.
+
+// remote is the server given with --remote, nil for a local vault
+var remote *client.Client
+
+// remoteCommands are the commands --remote works with
+var remoteCommands = map[string]bool{
+	"new": true, "list": true, "show": true, "search": true, "publish": true, "delete": true, "export": true, "version": true,
+}
+
+// takeRemoteFlag takes --remote URL, and --token T along with it, out of
+// os.Args, and exits if the command can't run remotely. VEIL_REMOTE stands
+// in for --remote with the commands that can.
+func takeRemoteFlag() {
+	base, token := "", ""
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		if (os.Args[i] == "--remote" || os.Args[i] == "--token") && i+1 < len(os.Args) {
+			if os.Args[i] == "--remote" {
+				base = os.Args[i+1]
+			} else {
+				token = os.Args[i+1]
+			}
+			i++
+			continue
+		}
+		args = append(args, os.Args[i])
+	}
+	command := ""
+	if len(args) > 1 {
+		command = args[1]
+	}
+	if base == "" && remoteCommands[command] {
+		base = os.Getenv("VEIL_REMOTE")
+	}
+	if base == "" {
+		return
+	}
+	os.Args = args
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		log.Fatal("--remote must be an http:// or https:// URL")
+	}
+	if dbFlag != "" {
+		log.Fatal("--remote and --db can't be used together")
+	}
+	if !remoteCommands[command] {
+		log.Fatalf("veil %s works on a local vault and can't run with --remote", command)
+	}
+	if token == "" {
+		token = os.Getenv("VEIL_SESSION_TOKEN")
+	}
+	remote = client.New(base, token)
+}
+
+// nodeBackend is what the node commands work on: the vault's database, or
+// the server given with --remote
+type nodeBackend interface {
+	// Find gets a live node by ID or path; sql.ErrNoRows or a 404 when
+	// there's none
+	Find(ref string) (Node, error)
+	List(siteID, nodeType string) ([]Node, error)
+	Search(query, siteID string, limit int) ([]Node, error)
+	// Create fills in node from the template with slug template, when set,
+	// and stores it
+	Create(node *Node, template string) error
+	// Publish publishes the node's current version and, with a channel,
+	// queues a job sending it there, returning the job's ID
+	Publish(nodeID, channelID string) (string, error)
+	Delete(nodeID string) error
+	Export(node Node, format string) ([]byte, error)
+}
+
+// openNodeBackend opens vault, or the --remote server, for a node command.
+// close is deferred by the caller.
+func openNodeBackend(vault string) (backend nodeBackend, close func()) {
+	if remote != nil {
+		return remoteBackend{remote}, func() {}
+	}
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	return vaultBackend{}, func() { db.Close() }
+}
+
+// mustFindNode is Find for commands, exiting when there's no such node
+func mustFindNode(b nodeBackend, ref string) Node {
+	node, err := b.Find(ref)
+	if err == sql.ErrNoRows || client.IsNotFound(err) {
+		log.Fatalf("node %s not found", ref)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return node
+}
+
+// vaultBackend works on the open vault's database
+type vaultBackend struct{}
+
+func (vaultBackend) Find(ref string) (Node, error) { return findNode(ref) }
+
+func (vaultBackend) List(siteID, nodeType string) ([]Node, error) {
+	query := `SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, ''), created_at, modified_at FROM nodes WHERE deleted_at IS NULL`
+	var args []interface{}
+	if siteID != "" {
+		query += ` AND site_id = ?`
+		args = append(args, siteID)
+	}
+	if nodeType != "" {
+		query += ` AND type = ?`
+		args = append(args, nodeType)
+	}
+	rows, err := db.Query(query+` ORDER BY path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanNodeList(rows)
+}
+
+func (vaultBackend) Search(query, siteID string, limit int) ([]Node, error) {
+	return searchNodes(query, siteID, limit)
+}
+
+func (vaultBackend) Create(node *Node, template string) error {
+	if template != "" {
+		tmpl, err := loadTemplate(template)
+		if err != nil {
+			return fmt.Errorf("template %s not found", template)
+		}
+		if err := applyTemplate(tmpl, node, time.Now()); err != nil {
+			return err
+		}
+	}
+	if node.Type == "" {
+		node.Type = "note"
+	}
+	if node.MimeType == "" {
+		node.MimeType = "text/markdown"
+	}
+	if err := applyFrontMatter(node, node.Metadata, ""); err != nil {
+		return err
+	}
+	if err := validate.Struct(node).Err(); err != nil {
+		return err
+	}
+	if err := nodeParentErrors(*node).Err(); err != nil {
+		return err
+	}
+	return insertNode(node, "Veil System")
+}
+
+func (vaultBackend) Publish(nodeID, channelID string) (string, error) {
+	if channelID != "" {
+		if _, err := getChannel(channelID); err != nil {
+			return "", fmt.Errorf("publishing channel %s not found", channelID)
+		}
+	}
+	versionID, err := publishCurrentVersion(nodeID)
+	if err != nil || channelID == "" {
+		return "", err
+	}
+	j, err := plugins.QueuePublishJob(plugins.PublishJob{NodeID: nodeID, VersionID: versionID, ChannelID: channelID})
+	if err != nil {
+		return "", fmt.Errorf("failed to queue publish job: %v", err)
+	}
+	return j.ID, nil
+}
+
+func (vaultBackend) Delete(nodeID string) error { return deleteNode(nodeID) }
+
+func (vaultBackend) Export(node Node, format string) ([]byte, error) {
+	return exportNodeAs(node, format)
+}
+
+// remoteBackend works on a server through its API
+type remoteBackend struct {
+	c *client.Client
+}
+
+func (b remoteBackend) Find(ref string) (Node, error) {
+	n, err := b.c.FindNode(ref)
+	if err != nil {
+		return Node{}, err
+	}
+	return fromClient(n), nil
+}
+
+func (b remoteBackend) List(siteID, nodeType string) ([]Node, error) {
+	nodes := []Node{}
+	for {
+		page, total, err := b.c.ListNodes(client.ListOptions{SiteID: siteID, Type: nodeType, Limit: maxNodePage, Offset: len(nodes)})
+		if err != nil {
+			return nil, err
+		}
+		for i := range page {
+			nodes = append(nodes, fromClient(&page[i]))
+		}
+		if len(page) == 0 || len(nodes) >= total {
+			return nodes, nil
+		}
+	}
+}
+
+func (b remoteBackend) Search(query, siteID string, limit int) ([]Node, error) {
+	found, err := b.c.Search(query, client.SearchOptions{SiteID: siteID, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Node{}
+	for i := range found {
+		nodes = append(nodes, fromClient(&found[i]))
+	}
+	return nodes, nil
+}
+
+func (b remoteBackend) Create(node *Node, template string) error {
+	// with a template the server fills these in
+	if template == "" && node.Type == "" {
+		node.Type = "note"
+	}
+	if template == "" && node.MimeType == "" {
+		node.MimeType = "text/markdown"
+	}
+	var in client.Node
+	convertJSON(node, &in)
+	out, err := b.c.CreateNode(in, template)
+	if err != nil {
+		return err
+	}
+	*node = fromClient(out)
+	return nil
+}
+
+func (b remoteBackend) Publish(nodeID, channelID string) (string, error) {
+	if err := b.c.Publish(nodeID); err != nil || channelID == "" {
+		return "", err
+	}
+	versions, err := b.c.Versions(nodeID)
+	if err != nil {
+		return "", err
+	}
+	versionID := ""
+	for _, v := range versions {
+		if v.IsCurrent {
+			versionID = v.ID
+		}
+	}
+	j, err := b.c.QueuePublishJob(nodeID, versionID, channelID)
+	if err != nil {
+		return "", fmt.Errorf("failed to queue publish job: %v", err)
+	}
+	return j.ID, nil
+}
+
+func (b remoteBackend) Delete(nodeID string) error { return b.c.DeleteNode(nodeID) }
+
+func (b remoteBackend) Export(node Node, format string) ([]byte, error) {
+	return b.c.ExportNode(node.ID, format)
+}
+
+// fromClient is a node from the API as the commands use it
+func fromClient(n *client.Node) Node {
+	var node Node
+	convertJSON(n, &node)
+	return node
+}
+
+// convertJSON copies in to out through their JSON encoding
+func convertJSON(in, out interface{}) {
+	b, _ := json.Marshal(in)
+	json.Unmarshal(b, out)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+)
+
+// === Restore ===
+// veil restore checks a backup archive (veil migrate --backup) the way a
+// restore would use it: it unpacks it into a scratch directory, checks the
+// database, brings its schema up to date and verifies every codex object
+// against its hash. With --to the checked copy becomes a new vault in a
+// fresh directory. An existing vault is never overwritten.
+
+// RestoreReport describes a backup archive and what restoring it found
+type RestoreReport struct {
+	Archive    string   `json:"archive"`
+	To         string   `json:"to,omitempty"` // empty when only verified
+	Files      int      `json:"files"`
+	MediaFiles int      `json:"media_files"`
+	Nodes      int      `json:"nodes"`
+	Objects    int      `json:"objects"` // codex objects verified
+	Corrupt    []string `json:"corrupt"` // codex objects failing their hash
+}
+
+// backupEntry reports whether name may appear in a backup archive
+func backupEntry(name string) bool {
+	if name == "" || strings.Contains(name, `\`) || path.IsAbs(name) || path.Clean(name) != name || strings.HasPrefix(name, "../") {
+		return false
+	}
+	return name == vaultDBName || strings.HasPrefix(name, ".codex/") || strings.HasPrefix(name, "media/")
+}
+
+// restoreBackup checks the archive at archive and, when to is set, restores
+// it into the directory to, which must not exist yet or be empty
+func restoreBackup(archive, to string) (*RestoreReport, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %v", err)
+	}
+	defer zr.Close()
+	report := &RestoreReport{Archive: archive, Corrupt: []string{}}
+
+	seen := map[string]bool{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !backupEntry(f.Name) {
+			return nil, fmt.Errorf("unexpected entry %q in archive", f.Name)
+		}
+		if seen[f.Name] {
+			return nil, fmt.Errorf("%s appears twice in archive", f.Name)
+		}
+		seen[f.Name] = true
+	}
+	if !seen[vaultDBName] {
+		return nil, fmt.Errorf("archive has no %s", vaultDBName)
+	}
+
+	// the scratch directory sits next to the destination so it can be
+	// renamed into place
+	parent := ""
+	if to != "" {
+		if to, err = expandVaultPath(to); err != nil {
+			return nil, err
+		}
+		if entries, err := os.ReadDir(to); err == nil && len(entries) > 0 {
+			return nil, fmt.Errorf("%s is not empty; restore into a new directory", to)
+		}
+		parent = filepath.Dir(to)
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return nil, err
+		}
+	}
+	work, err := os.MkdirTemp(parent, ".veil-restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(work)
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if err := extractBackupFile(f, filepath.Join(work, filepath.FromSlash(f.Name))); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		report.Files++
+		if strings.HasPrefix(f.Name, "media/") {
+			report.MediaFiles++
+		}
+	}
+
+	if err := checkRestoredDB(filepath.Join(work, vaultDBName), report); err != nil {
+		return nil, err
+	}
+
+	verify, err := codexpkg.NewRepository(fsstorage.New(work), work).VerifyObjects()
+	if err != nil {
+		return nil, fmt.Errorf("codex: %v", err)
+	}
+	report.Objects, report.Corrupt = verify.Checked, verify.Corrupt
+	if len(report.Corrupt) > 0 || to == "" {
+		return report, nil
+	}
+
+	os.Remove(to) // empty, checked above
+	if err := os.Rename(work, to); err != nil {
+		return nil, err
+	}
+	report.To = to
+	return report, nil
+}
+
+// extractBackupFile writes one archive entry to dest; zip checks the
+// entry's checksum as it is read
+func extractBackupFile(f *zip.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// checkRestoredDB checks the restored database's integrity and migrates it
+// to the current schema
+func checkRestoredDB(dbFile string, report *RestoreReport) error {
+	header := make([]byte, 16)
+	if f, err := os.Open(dbFile); err == nil {
+		io.ReadFull(f, header)
+		f.Close()
+	}
+	if !bytes.Equal(header, []byte("SQLite format 3\x00")) {
+		return fmt.Errorf("%s is not a SQLite database", vaultDBName)
+	}
+	d, err := sql.Open("sqlite", dbFile)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	var check string
+	if err := d.QueryRow(`PRAGMA integrity_check`).Scan(&check); err != nil {
+		return fmt.Errorf("%s: %v", vaultDBName, err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("%s failed its integrity check: %s", vaultDBName, check)
+	}
+	if err := applyMigrations(d); err != nil {
+		return err
+	}
+	d.QueryRow(`SELECT COUNT(*) FROM nodes`).Scan(&report.Nodes)
+	return nil
+}
+
+// restoreCommand is `veil restore <backup.zip> [--to DIR] [--json]`
+func restoreCommand() {
+	usage := "Usage: veil restore <backup.zip> [--to DIR] [--json]"
+	var archive, to string
+	asJSON := false
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--to" && i+1 < len(args):
+			i++
+			to = args[i]
+		case args[i] == "--json":
+			asJSON = true
+		case archive == "" && !strings.HasPrefix(args[i], "--"):
+			archive = args[i]
+		default:
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+	}
+	if archive == "" {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	report, err := restoreBackup(archive, to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if report.To != "" {
+		if _, err := registerVault(report.To, "", false); err != nil {
+			log.Printf("warning: failed to update vault registry: %v", err)
+		}
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+	} else {
+		fmt.Printf("%s: %d files, %d nodes, %d media files\n", archive, report.Files, report.Nodes, report.MediaFiles)
+		fmt.Printf("codex: %d objects verified\n", report.Objects)
+		for _, h := range report.Corrupt {
+			fmt.Printf("CORRUPT: %s\n", h)
+		}
+		switch {
+		case len(report.Corrupt) > 0:
+			fmt.Println("not restored: the archive is damaged")
+		case report.To != "":
+			fmt.Printf("restored into %s\n", report.To)
+		default:
+			fmt.Println("backup is restorable; use --to DIR to restore it")
+		}
+	}
+	if len(report.Corrupt) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+)
+
+func TestRestoreBackup(t *testing.T) {
+	tmp := t.TempDir()
+	vault := filepath.Join(tmp, "vault")
+	os.MkdirAll(vault, 0755)
+	d, err := sql.Open("sqlite", filepath.Join(vault, vaultDBName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyMigrations(d)
+	d.Exec(`INSERT INTO nodes (id, type, path, title, content, mime_type, status, created_at, modified_at) VALUES ('n1', 'note', 'a.md', 'A', 'kept', 'text/markdown', 'draft', 1, 1)`)
+	d.Close()
+	repo := codexpkg.NewRepository(fsstorage.New(vault), vault)
+	obj, _ := repo.PutObjectStream(strings.NewReader("hello"), "text/plain")
+	repo.PutCommit(&codexpkg.Commit{Author: "a", Timestamp: time.Now().UTC(), Message: "m", Objects: []string{obj}})
+
+	archive, err := createBackupZip(vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := restoreBackup(archive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.To != "" || report.Nodes != 1 || report.Objects != 2 || len(report.Corrupt) != 0 {
+		t.Fatalf("unexpected check report: %+v", report)
+	}
+
+	dest := filepath.Join(tmp, "restored")
+	if report, err = restoreBackup(archive, dest); err != nil || report.To != dest {
+		t.Fatalf("restore: %v %+v", err, report)
+	}
+	restored, _ := sql.Open("sqlite", filepath.Join(dest, vaultDBName))
+	var content string
+	restored.QueryRow(`SELECT content FROM nodes WHERE id = 'n1'`).Scan(&content)
+	restored.Close()
+	if content != "kept" {
+		t.Fatalf("restored node content %q", content)
+	}
+	if b, err := codexpkg.NewRepository(fsstorage.New(dest), dest).GetObject(obj); err != nil || string(b) != "hello" {
+		t.Fatalf("restored codex object: %q %v", b, err)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 2 {
+		t.Fatalf("the scratch directory should be gone: %v", entries)
+	}
+	if _, err := restoreBackup(archive, dest); err == nil || !strings.Contains(err.Error(), "not empty") {
+		t.Fatalf("restoring over a vault should be refused: %v", err)
+	}
+
+	// an archive whose objects don't match their hashes is not restored
+	writeZip := func(name string, files map[string]string) string {
+		p := filepath.Join(t.TempDir(), name)
+		f, _ := os.Create(p)
+		zw := zip.NewWriter(f)
+		for n, body := range files {
+			w, _ := zw.Create(n)
+			w.Write([]byte(body))
+		}
+		zw.Close()
+		f.Close()
+		return p
+	}
+	dbBytes, _ := os.ReadFile(filepath.Join(vault, vaultDBName))
+	damaged := writeZip("damaged.zip", map[string]string{
+		vaultDBName:                       string(dbBytes),
+		".codex/objects/" + obj + ".data": "tampered",
+	})
+	other := filepath.Join(tmp, "other")
+	if report, err = restoreBackup(damaged, other); err != nil || len(report.Corrupt) != 1 || report.Corrupt[0] != obj || report.To != "" {
+		t.Fatalf("damaged archive: %v %+v", err, report)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatal("a damaged archive should not be restored")
+	}
+
+	for name, files := range map[string]map[string]string{
+		"escape.zip": {vaultDBName: string(dbBytes), "../evil": "x"},
+		"nodb.zip":   {".codex/objects/x.json": "{}"},
+		"notdb.zip":  {vaultDBName: "not a database"},
+	} {
+		if _, err := restoreBackup(writeZip(name, files), ""); err == nil {
+			t.Fatalf("%s should be refused", name)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+// === JSON-RPC over stdio ===
+// `veil rpc` lets editor extensions (Neovim, VS Code) work with a local vault
+// without the HTTP server. It reads JSON-RPC 2.0 requests from stdin, one per
+// line, and writes each response as one line to stdout. Requests run with the
+// permissions of the session in VEIL_SESSION_TOKEN (or --token), which only
+// matter once the vault has accounts.
+//
+// Methods:
+//   resolveLink  {text, site_id?}                    -> node summary or null
+//   search       {query, limit?}                     -> [node summary]
+//   getNode      {id}                                -> node with content
+//   getBacklinks {node_id}                           -> [node summary]
+//   createNode   {type, path, title, content, site_id?, mime_type?, parent_id?} -> node
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// rpcError is a JSON-RPC error object
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string { return e.Message }
+
+// rpcNode is how nodes are returned; Content is only set by getNode
+type rpcNode struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	SiteID  string `json:"site_id,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// rpcSession carries the caller's session into the access checks
+type rpcSession struct {
+	token string
+}
+
+// request is an API request made as the session's user
+func (s rpcSession) request(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return req
+}
+
+func rpcCommand() {
+	vault := "."
+	token := os.Getenv("VEIL_SESSION_TOKEN")
+	for i := 2; i < len(os.Args)-1; i++ {
+		switch os.Args[i] {
+		case "--vault":
+			vault = os.Args[i+1]
+			if v, ok := lookupVault(vault); ok {
+				vault = v.Path
+			}
+		case "--token":
+			token = os.Args[i+1]
+		}
+	}
+
+	// stdout carries the protocol; anything else printed goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if err := openVault(vault); err != nil {
+		log.Fatal("Failed to open vault:", err)
+	}
+	defer db.Close()
+	if err := serveRPC(os.Stdin, out, rpcSession{token: token}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveRPC answers requests from in on out until in ends
+func serveRPC(in io.Reader, out io.Writer, session rpcSession) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	enc := json.NewEncoder(out)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var req rpcRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			enc.Encode(rpcReply(json.RawMessage("null"), nil, &rpcError{Code: rpcParseError, Message: "parse error: " + err.Error()}))
+			continue
+		}
+		if req.JSONRPC != "2.0" || req.Method == "" {
+			id := req.ID
+			if id == nil {
+				id = json.RawMessage("null")
+			}
+			enc.Encode(rpcReply(id, nil, &rpcError{Code: rpcInvalidRequest, Message: `expected {"jsonrpc": "2.0", "method": ...}`}))
+			continue
+		}
+		result, err := session.call(req.Method, req.Params)
+		if req.ID == nil {
+			continue // a notification gets no reply
+		}
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = &rpcError{Code: rpcInternalError, Message: err.Error()}
+			}
+			enc.Encode(rpcReply(req.ID, nil, rerr))
+			continue
+		}
+		enc.Encode(rpcReply(req.ID, result, nil))
+	}
+	return scanner.Err()
+}
+
+// rpcReply builds a response, which has either a result (possibly null) or
+// an error, never both
+func rpcReply(id json.RawMessage, result interface{}, err *rpcError) map[string]interface{} {
+	reply := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		reply["error"] = err
+	} else {
+		reply["result"] = result
+	}
+	return reply
+}
+
+func (s rpcSession) call(method string, raw json.RawMessage) (interface{}, error) {
+	params := func(v interface{}) error {
+		if len(raw) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+		return nil
+	}
+
+	switch method {
+	case "resolveLink":
+		var p struct {
+			Text   string `json:"text"`
+			SiteID string `json:"site_id"`
+		}
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(p.Text) == "" {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "text is required"}
+		}
+		// [[Title]], [text](href) or veil://..., else a bare name
+		link := nodeLink{Type: "wiki", Target: strings.TrimSpace(p.Text)}
+		if links := extractLinks(p.Text); len(links) > 0 {
+			link = links[0]
+		}
+		id := resolveLink(p.SiteID, link)
+		if id == "" || !canReadNode(s.request("GET", "/", nil), id) {
+			return nil, nil
+		}
+		return rpcNodeSummary(id), nil
+
+	case "search":
+		var p struct {
+			Query string `json:"query"`
+			Limit int    `json:"limit"`
+		}
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if p.Limit <= 0 {
+			p.Limit = 50
+		}
+		rows, err := db.Query(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, '') FROM nodes
+			WHERE deleted_at IS NULL AND archived_at IS NULL AND (lower(title) LIKE lower(?) OR lower(content) LIKE lower(?)) ORDER BY path`, "%"+p.Query+"%", "%"+p.Query+"%")
+		if err != nil {
+			return nil, err
+		}
+		return s.readableNodes(rows, p.Limit)
+
+	case "getNode":
+		var p struct {
+			ID string `json:"id"`
+		}
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		var n rpcNode
+		err := db.QueryRow(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, ''), COALESCE(content, '') FROM nodes
+			WHERE id = ? AND deleted_at IS NULL`, p.ID).Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.SiteID, &n.Content)
+		if err != nil || !canReadNode(s.request("GET", "/", nil), n.ID) {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "node not found"}
+		}
+		return n, nil
+
+	case "getBacklinks":
+		var p struct {
+			NodeID string `json:"node_id"`
+		}
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if !canReadNode(s.request("GET", "/", nil), p.NodeID) {
+			return nil, &rpcError{Code: rpcInvalidParams, Message: "node not found"}
+		}
+		rows, err := db.Query(`SELECT n.id, n.type, n.path, COALESCE(n.title, ''), COALESCE(n.site_id, '') FROM node_backlinks b
+			JOIN nodes n ON n.id = b.source_node_id
+			WHERE b.target_node_id = ? AND n.deleted_at IS NULL ORDER BY n.path`, p.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		return s.readableNodes(rows, 0)
+
+	case "createNode":
+		// the API handler does the work: codex commit, version, references
+		body := []byte(raw)
+		if len(body) == 0 {
+			body = []byte("{}")
+		}
+		rr := httptest.NewRecorder()
+		handleNodeCreate(rr, s.request("POST", "/api/nodes", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			var data interface{}
+			json.Unmarshal(rr.Body.Bytes(), &data)
+			code := rpcInternalError
+			if rr.Code == http.StatusBadRequest || rr.Code == http.StatusForbidden || rr.Code == http.StatusRequestEntityTooLarge {
+				code = rpcInvalidParams
+			}
+			return nil, &rpcError{Code: code, Message: fmt.Sprintf("createNode failed: %s", http.StatusText(rr.Code)), Data: data}
+		}
+		var node Node
+		json.Unmarshal(rr.Body.Bytes(), &node)
+		return rpcNode{ID: node.ID, Type: node.Type, Path: node.Path, Title: node.Title, SiteID: node.SiteID}, nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + method}
+}
+
+// readableNodes collects up to limit (0 for all) rows the session may read
+func (s rpcSession) readableNodes(rows *sql.Rows, limit int) ([]rpcNode, error) {
+	defer rows.Close()
+	var found []rpcNode
+	for rows.Next() {
+		var n rpcNode
+		if err := rows.Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.SiteID); err != nil {
+			return nil, err
+		}
+		found = append(found, n)
+	}
+	rows.Close()
+	readable := s.request("GET", "/", nil)
+	nodes := []rpcNode{}
+	for _, n := range found {
+		if limit > 0 && len(nodes) == limit {
+			break
+		}
+		if canReadNode(readable, n.ID) {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// rpcNodeSummary loads a node without its content
+func rpcNodeSummary(id string) *rpcNode {
+	var n rpcNode
+	if db.QueryRow(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, '') FROM nodes WHERE id = ?`, id).
+		Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.SiteID) != nil {
+		return nil
+	}
+	return &n
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestServeRPC(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "rpc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES
+		('ideas', 'note', 'ideas.md', 'Ideas', 'Things to build', 1, 1)`)
+
+	in := strings.Join([]string{
+		`{"jsonrpc": "2.0", "id": 1, "method": "createNode", "params": {"type": "note", "path": "plan.md", "title": "Plan", "content": "See [[Ideas]] first"}}`,
+		`{"jsonrpc": "2.0", "id": 2, "method": "resolveLink", "params": {"text": "[[ideas]]"}}`,
+		`{"jsonrpc": "2.0", "id": 3, "method": "getBacklinks", "params": {"node_id": "ideas"}}`,
+		`{"jsonrpc": "2.0", "id": 4, "method": "search", "params": {"query": "build"}}`,
+		`{"jsonrpc": "2.0", "id": 5, "method": "resolveLink", "params": {"text": "Nowhere"}}`,
+		`{"jsonrpc": "2.0", "method": "search", "params": {"query": "x"}}`,
+		`{"jsonrpc": "2.0", "id": 6, "method": "createNode", "params": {"title": "No path"}}`,
+		`{"jsonrpc": "2.0", "id": 7, "method": "rename"}`,
+		`not json`,
+		`{"jsonrpc": "2.0", "id": "g", "method": "getNode", "params": {"id": "ideas"}}`,
+	}, "\n")
+	var out bytes.Buffer
+	if err := serveRPC(strings.NewReader(in), &out, rpcSession{}); err != nil {
+		t.Fatal(err)
+	}
+
+	type reply struct {
+		ID     json.RawMessage `json:"id"`
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	var replies []reply
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var r reply
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("bad reply line %q: %v", line, err)
+		}
+		replies = append(replies, r)
+	}
+	if len(replies) != 9 {
+		t.Fatalf("expected 9 replies (notifications get none), got %d:\n%s", len(replies), out.String())
+	}
+
+	var created rpcNode
+	json.Unmarshal(replies[0].Result, &created)
+	if created.ID == "" || created.Path != "plan.md" {
+		t.Fatalf("createNode: %s %+v", replies[0].Result, replies[0].Error)
+	}
+	if !strings.Contains(string(replies[1].Result), `"id":"ideas"`) {
+		t.Fatalf("resolveLink should find the node by title: %s", replies[1].Result)
+	}
+	if !strings.Contains(string(replies[2].Result), `"id":"`+created.ID+`"`) {
+		t.Fatalf("the new node's link should be a backlink: %s", replies[2].Result)
+	}
+	if !strings.Contains(string(replies[3].Result), `"path":"ideas.md"`) {
+		t.Fatalf("search: %s", replies[3].Result)
+	}
+	if string(replies[4].Result) != "null" || replies[4].Error != nil {
+		t.Fatalf("an unresolved link is a null result: %s", replies[4].Result)
+	}
+	if replies[5].Error == nil || replies[5].Error.Code != rpcInvalidParams || !strings.Contains(string(mustJSON(replies[5].Error.Data)), "path") {
+		t.Fatalf("validation errors should come back as invalid params: %+v", replies[5].Error)
+	}
+	if replies[6].Error == nil || replies[6].Error.Code != rpcMethodNotFound {
+		t.Fatalf("unknown methods: %+v", replies[6].Error)
+	}
+	if replies[7].Error == nil || replies[7].Error.Code != rpcParseError || string(replies[7].ID) != "null" {
+		t.Fatalf("bad JSON: %+v", replies[7])
+	}
+	if string(replies[8].ID) != `"g"` || !strings.Contains(string(replies[8].Result), `"content":"Things to build"`) {
+		t.Fatalf("getNode: %s %s", replies[8].ID, replies[8].Result)
+	}
+}
+
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
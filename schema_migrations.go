@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/store"
+)
+
+// === Schema Migrations ===
+// Migrations are the embedded migrations/NNN_name.sql files, versioned by
+// their number. schema_migrations records the ones a database has, and each
+// new one runs in a transaction with its row, so a failing migration leaves
+// nothing behind and stops the ones after it. NNN_name.down.sql, when there
+// is one, undoes NNN. Databases from before schema_migrations get every
+// migration once more the old way, ignoring what already exists, and are
+// then recorded as up to date.
+
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+)`
+
+// migrationFiles holds the migrations/ directory; tests swap it out
+var migrationFiles fs.FS = migrations
+
+// Migration is one embedded migration
+type Migration struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"applied_at,omitempty"`
+	HasDown   bool   `json:"has_down"`
+	up, down  string
+}
+
+// MigrationStatus is where a database stands against the embedded migrations
+type MigrationStatus struct {
+	Current  int         `json:"current"` // highest applied version, 0 for none
+	Latest   int         `json:"latest"`
+	Legacy   bool        `json:"legacy"` // predates schema_migrations
+	Applied  []Migration `json:"applied"`
+	Pending  []Migration `json:"pending"`
+	Unknown  []int       `json:"unknown,omitempty"` // applied by a newer veil
+	Migrated []string    `json:"migrated,omitempty"`
+}
+
+// loadMigrations reads the embedded migrations for dialect, oldest first.
+// Migrations are written for SQLite and translated with dialect.Schema,
+// except where migrations/<dialect>/ has its own version of the file.
+func loadMigrations(dialect store.Dialect) ([]Migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() {
+			continue
+		}
+		base, isDown := strings.CutSuffix(name, ".down.sql")
+		if !isDown {
+			base = strings.TrimSuffix(name, ".sql")
+		}
+		num, label, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must start with its version", name)
+		}
+		content, err := fs.ReadFile(migrationFiles, "migrations/"+name)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", name, err)
+		}
+		if dialect.Name() != "sqlite" {
+			if own, err := fs.ReadFile(migrationFiles, "migrations/"+dialect.Name()+"/"+name); err == nil {
+				content = own
+			} else {
+				content = []byte(dialect.Schema(string(content)))
+			}
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		if isDown {
+			m.down, m.HasDown = string(content), true
+			continue
+		}
+		if m.up != "" {
+			return nil, fmt.Errorf("migration %s: version %d is used twice", name, version)
+		}
+		m.Name, m.up = label, string(content)
+	}
+	var out []Migration
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %03d has a down migration but no up", m.Version)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+func tableExists(database *sql.DB, name string) bool {
+	tables, _ := store.For(database).Tables(database)
+	for _, t := range tables {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// migrationStatus compares database with the embedded migrations
+func migrationStatus(database *sql.DB) (*MigrationStatus, error) {
+	all, err := loadMigrations(store.For(database))
+	if err != nil {
+		return nil, err
+	}
+	status := &MigrationStatus{Applied: []Migration{}, Pending: []Migration{}}
+	if len(all) > 0 {
+		status.Latest = all[len(all)-1].Version
+	}
+	applied := map[int]int64{}
+	if tableExists(database, "schema_migrations") {
+		rows, err := database.Query(`SELECT version, applied_at FROM schema_migrations`)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var v int
+			var at int64
+			rows.Scan(&v, &at)
+			applied[v] = at
+		}
+		rows.Close()
+	} else {
+		status.Legacy = tableExists(database, "nodes")
+	}
+	known := map[int]bool{}
+	for _, m := range all {
+		known[m.Version] = true
+		if at, ok := applied[m.Version]; ok {
+			m.AppliedAt = at
+			status.Applied = append(status.Applied, m)
+		} else {
+			status.Pending = append(status.Pending, m)
+		}
+	}
+	for v := range applied {
+		if v > status.Current {
+			status.Current = v
+		}
+		if !known[v] {
+			status.Unknown = append(status.Unknown, v)
+		}
+	}
+	sort.Ints(status.Unknown)
+	return status, nil
+}
+
+// applyMigrations brings database up to the latest migration
+func applyMigrations(database *sql.DB) error {
+	_, err := migrateTo(database, -1)
+	return err
+}
+
+// migrateTo applies pending migrations up to version target, or rolls back
+// applied ones above it, newest first. A negative target is the latest.
+func migrateTo(database *sql.DB, target int) (*MigrationStatus, error) {
+	status, err := migrationStatus(database)
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 {
+		target = status.Latest
+	}
+	if status.Legacy {
+		if err := baselineMigrations(database, status); err != nil {
+			return nil, err
+		}
+		if status, err = migrationStatus(database); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := database.Exec(schemaMigrationsTable); err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+	for _, m := range status.Pending {
+		if m.Version > target {
+			break
+		}
+		if err := runMigration(database, m.up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now().Unix()); err != nil {
+			return nil, fmt.Errorf("migration %03d_%s: %w", m.Version, m.Name, err)
+		}
+		migrated = append(migrated, fmt.Sprintf("up %03d_%s", m.Version, m.Name))
+	}
+	for i := len(status.Applied) - 1; i >= 0; i-- {
+		m := status.Applied[i]
+		if m.Version <= target {
+			break
+		}
+		if !m.HasDown {
+			return nil, fmt.Errorf("migration %03d_%s has no down migration", m.Version, m.Name)
+		}
+		if err := runMigration(database, m.down, `DELETE FROM schema_migrations WHERE version = ?`, m.Version); err != nil {
+			return nil, fmt.Errorf("down migration %03d_%s: %w", m.Version, m.Name, err)
+		}
+		migrated = append(migrated, fmt.Sprintf("down %03d_%s", m.Version, m.Name))
+	}
+
+	if status, err = migrationStatus(database); err != nil {
+		return nil, err
+	}
+	status.Migrated = migrated
+	return status, nil
+}
+
+// runMigration runs the statements of script and record in one transaction
+func runMigration(database *sql.DB, script, record string, args ...interface{}) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range splitStatements(script) {
+		if stripSQLComments(stmt) == "" {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// baselineMigrations brings a database from before schema_migrations up to
+// date the way veil used to, running every statement and skipping what
+// already exists, and records every migration as applied
+func baselineMigrations(database *sql.DB, status *MigrationStatus) error {
+	for _, m := range status.Pending {
+		for _, stmt := range splitStatements(m.up) {
+			if stripSQLComments(stmt) == "" {
+				continue
+			}
+			if _, err := database.Exec(stmt); err != nil {
+				msg := err.Error()
+				if !strings.Contains(msg, "duplicate column name") && !strings.Contains(msg, "already exists") {
+					log.Printf("Migration %03d_%s: %v\n", m.Version, m.Name, err)
+				}
+			}
+		}
+	}
+	if _, err := database.Exec(schemaMigrationsTable); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, m := range status.Pending {
+		database.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, m.Version, m.Name, now)
+	}
+	log.Printf("Recorded %d migrations as applied to a database from before schema_migrations\n", len(status.Pending))
+	return nil
+}
+
+// splitStatements splits a migration into statements at semicolons, keeping
+// the body of a CREATE TRIGGER, whose statements end in semicolons too,
+// together up to its END, and a $$-quoted function body up to its closing $$
+func splitStatements(content string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, part := range strings.Split(content, ";") {
+		current.WriteString(part)
+		stmt := strings.TrimSpace(current.String())
+		code := strings.ToUpper(stripSQLComments(stmt))
+		inTrigger := strings.HasPrefix(code, "CREATE TRIGGER") && strings.Contains(code, "BEGIN") && !strings.HasSuffix(code, "END")
+		if inTrigger || strings.Count(code, "$$")%2 == 1 {
+			current.WriteString(";")
+			continue
+		}
+		statements = append(statements, stmt)
+		current.Reset()
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// stripSQLComments drops "--" comment lines
+func stripSQLComments(stmt string) string {
+	var lines []string
+	for _, line := range strings.Split(stmt, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"veil/pkg/store"
+)
+
+func columnExists(d *sql.DB, table, column string) bool {
+	var n int
+	d.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	return n > 0
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	d, err := sql.Open("sqlite", t.TempDir()+"/veil.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	status, err := migrateTo(d, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != status.Latest || len(status.Pending) != 0 || len(status.Migrated) != len(status.Applied) {
+		t.Fatalf("a new database should get every migration: %+v", status)
+	}
+	if status, _ = migrateTo(d, -1); len(status.Migrated) != 0 {
+		t.Fatalf("applied migrations should not run again: %v", status.Migrated)
+	}
+
+	// down migrations undo the newest first
+	if status, err = migrateTo(d, 27); err != nil {
+		t.Fatal(err)
+	}
+	if status.Current != 27 || len(status.Pending) != 3 || status.Migrated[0] != "down 030_publish_jobs_keys" {
+		t.Fatalf("unexpected rollback: %+v", status)
+	}
+	if columnExists(d, "media", "width") || columnExists(d, "citations", "doi") || tableExists(d, "media_variants") {
+		t.Fatal("the down migrations should have dropped their columns and tables")
+	}
+	if _, err := migrateTo(d, 26); err == nil || !strings.Contains(err.Error(), "027_cold_storage has no down migration") {
+		t.Fatalf("rolling back without a down migration should fail: %v", err)
+	}
+	if status, err = migrateTo(d, -1); err != nil || status.Current != status.Latest || !columnExists(d, "media", "width") {
+		t.Fatalf("migrating up again: %v %+v", err, status)
+	}
+}
+
+func TestSchemaMigrationFailureRollsBack(t *testing.T) {
+	orig := migrationFiles
+	defer func() { migrationFiles = orig }()
+	migrationFiles = fstest.MapFS{
+		"migrations/001_notes.sql":      {Data: []byte("CREATE TABLE notes (id TEXT PRIMARY KEY);")},
+		"migrations/002_tags.sql":       {Data: []byte("CREATE TABLE tags (id TEXT);\nINSERT INTO missing VALUES (1);")},
+		"migrations/003_labels.sql":     {Data: []byte("CREATE TABLE labels (id TEXT);")},
+		"migrations/002_tags.down.sql":  {Data: []byte("DROP TABLE tags;")},
+		"migrations/001_notes.down.sql": {Data: []byte("DROP TABLE notes;")},
+	}
+	d, _ := sql.Open("sqlite", t.TempDir()+"/veil.db")
+	defer d.Close()
+
+	if err := applyMigrations(d); err == nil || !strings.Contains(err.Error(), "migration 002_tags") {
+		t.Fatalf("a failing migration should be reported: %v", err)
+	}
+	if tableExists(d, "tags") || tableExists(d, "labels") || !tableExists(d, "notes") {
+		t.Fatal("the failed migration should be rolled back and stop the ones after it")
+	}
+	status, _ := migrationStatus(d)
+	if status.Current != 1 || len(status.Pending) != 2 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestSchemaMigrationsBaselineLegacy(t *testing.T) {
+	d, _ := sql.Open("sqlite", t.TempDir()+"/veil.db")
+	defer d.Close()
+	// a vault migrated the old way: every statement, and no record of it
+	all, _ := loadMigrations(store.SQLite{})
+	for _, m := range all {
+		for _, stmt := range splitStatements(m.up) {
+			d.Exec(stmt)
+		}
+	}
+	if status, _ := migrationStatus(d); !status.Legacy || status.Current != 0 {
+		t.Fatalf("the vault should be seen as legacy: %+v", status)
+	}
+	status, err := migrateTo(d, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Legacy || status.Current != status.Latest || len(status.Pending) != 0 || len(status.Migrated) != 0 {
+		t.Fatalf("a legacy vault should be recorded as up to date: %+v", status)
+	}
+}
+
+func TestSchemaMigrationsPostgres(t *testing.T) {
+	all, err := loadMigrations(store.Postgres{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range all {
+		for _, script := range []string{m.up, m.down} {
+			for _, stmt := range splitStatements(script) {
+				code := strings.ToUpper(stripSQLComments(store.Postgres{}.Rewrite(stmt)))
+				for _, sqliteOnly := range []string{"AUTOINCREMENT", "STRFTIME", " BLOB", "INTEGER", "INSERT OR IGNORE", "INSERT OR REPLACE"} {
+					if strings.Contains(code, sqliteOnly) {
+						t.Errorf("%03d_%s: %s is left in %s", m.Version, m.Name, sqliteOnly, stmt)
+					}
+				}
+			}
+		}
+	}
+	// the PostgreSQL version of a migration is used whole, its function
+	// body one statement however many semicolons it has
+	for _, m := range all {
+		if m.Name != "content_changes" {
+			continue
+		}
+		var function string
+		for _, stmt := range splitStatements(m.up) {
+			if strings.HasPrefix(stmt, "CREATE OR REPLACE FUNCTION") {
+				function = stmt
+			}
+		}
+		if !strings.HasSuffix(function, "LANGUAGE plpgsql") || !strings.Contains(function, "RETURN NULL") {
+			t.Fatalf("the trigger function should be kept together: %q", function)
+		}
+	}
+}
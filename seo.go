@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	plugins "veil/pkg/plugins"
+)
+
+// === Excerpts and SEO Descriptions ===
+// Publishing fills in a node's meta description and its blog post excerpt
+// when they are empty. Text comes from the summary plugin when one is
+// configured, else from excerpt(). Values an editor sets through
+// /api/node/{id}/seo are locked so neither publishing nor regeneration
+// replaces them.
+
+// metaDescriptionLen is the length search engines show for a description
+const metaDescriptionLen = 160
+
+// summaryPlugin names a plugin whose "summarize" action writes descriptions.
+// It receives {title, content, max_length} and returns a string or
+// {"summary": "..."}. Set by VEIL_SUMMARY_PLUGIN or serve --summary-plugin.
+var summaryPlugin string
+
+func init() {
+	plugins.BeforePublish = func(nodeID string) { fillDescriptions(nodeID, false) }
+}
+
+// NodeSEO is a node's description fields as served by /api/node/{id}/seo
+type NodeSEO struct {
+	NodeID                string `json:"node_id"`
+	MetaDescription       string `json:"meta_description"`
+	MetaDescriptionLocked bool   `json:"meta_description_locked"`
+	// Excerpt fields are only set when the node is a blog post
+	HasPost       bool   `json:"has_post"`
+	Excerpt       string `json:"excerpt,omitempty"`
+	ExcerptLocked bool   `json:"excerpt_locked,omitempty"`
+	// Source is how regenerated text was written: plugin or excerpt
+	Source string `json:"source,omitempty"`
+}
+
+// summarize writes a description of at most maxLen characters, asking the
+// summary plugin first and falling back to excerpt()
+func summarize(title, content string, maxLen int) (string, string) {
+	if summaryPlugin != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		res, err := plugins.GetRegistry().Execute(ctx, summaryPlugin, "summarize", map[string]interface{}{
+			"title":      title,
+			"content":    content,
+			"max_length": maxLen,
+		})
+		var s string
+		switch v := res.(type) {
+		case string:
+			s = v
+		case map[string]interface{}:
+			s, _ = v["summary"].(string)
+		case map[string]string:
+			s = v["summary"]
+		}
+		if s = strings.TrimSpace(s); err == nil && s != "" {
+			return truncate(s, maxLen), "plugin"
+		}
+	}
+	return excerpt(content, maxLen), "excerpt"
+}
+
+// loadNodeSEO reads a node's description fields
+func loadNodeSEO(nodeID string) (*NodeSEO, error) {
+	seo := &NodeSEO{NodeID: nodeID}
+	var desc sql.NullString
+	var locked sql.NullInt64
+	if err := db.QueryRow(`SELECT meta_description, meta_description_locked FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+		Scan(&desc, &locked); err != nil {
+		return nil, err
+	}
+	seo.MetaDescription, seo.MetaDescriptionLocked = desc.String, locked.Int64 == 1
+
+	var postExcerpt sql.NullString
+	var excerptLocked sql.NullInt64
+	if db.QueryRow(`SELECT excerpt, excerpt_locked FROM blog_posts WHERE node_id = ?`, nodeID).
+		Scan(&postExcerpt, &excerptLocked) == nil {
+		seo.HasPost = true
+		seo.Excerpt, seo.ExcerptLocked = postExcerpt.String, excerptLocked.Int64 == 1
+	}
+	return seo, nil
+}
+
+// fillDescriptions generates the node's meta description and blog excerpt.
+// Locked fields are never touched; others are only written when empty unless
+// force is set.
+func fillDescriptions(nodeID string, force bool) (*NodeSEO, error) {
+	seo, err := loadNodeSEO(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	needDesc := !seo.MetaDescriptionLocked && (force || seo.MetaDescription == "")
+	needExcerpt := seo.HasPost && !seo.ExcerptLocked && (force || seo.Excerpt == "")
+	if !needDesc && !needExcerpt {
+		return seo, nil
+	}
+
+	var title, content string
+	db.QueryRow(`SELECT COALESCE(title, ''), COALESCE(content, '') FROM nodes WHERE id = ?`, nodeID).Scan(&title, &content)
+	if needDesc {
+		seo.MetaDescription, seo.Source = summarize(title, content, metaDescriptionLen)
+		if _, err := db.Exec(`UPDATE nodes SET meta_description = ? WHERE id = ?`, seo.MetaDescription, nodeID); err != nil {
+			return nil, err
+		}
+	}
+	if needExcerpt {
+		seo.Excerpt, seo.Source = summarize(title, content, feedExcerptLen)
+		if _, err := db.Exec(`UPDATE blog_posts SET excerpt = ? WHERE node_id = ?`, seo.Excerpt, nodeID); err != nil {
+			return nil, err
+		}
+	}
+	return seo, nil
+}
+
+// metaDescription is the description for a page: the stored one, else an
+// excerpt of content
+func metaDescription(nodeID, content string) string {
+	var desc sql.NullString
+	db.QueryRow(`SELECT meta_description FROM nodes WHERE id = ?`, nodeID).Scan(&desc)
+	if desc.String != "" {
+		return desc.String
+	}
+	return excerpt(content, metaDescriptionLen)
+}
+
+// metaDescriptionTag renders a description as a <meta> element
+func metaDescriptionTag(desc string) string {
+	return `<meta name="description" content="` + html.EscapeString(desc) + `">`
+}
+
+// /api/node/{id}/seo
+// GET returns the description fields. PUT stores the meta_description and/or
+// excerpt given and locks them; meta_description_locked / excerpt_locked
+// set explicitly override that (false unlocks a field for regeneration).
+// POST /api/node/{id}/seo/regenerate rewrites every unlocked field.
+func handleNodeSEO(w http.ResponseWriter, r *http.Request, nodeID string, regenerate bool) {
+	allowed := r.Method == "GET" || r.Method == "PUT"
+	if regenerate {
+		allowed = r.Method == "POST"
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == "GET" && !canReadNode(r, nodeID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" && !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "editor role required to change descriptions")
+		return
+	}
+
+	seo, err := loadNodeSEO(nodeID)
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	switch {
+	case regenerate:
+		if seo, err = fillDescriptions(nodeID, true); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+	case r.Method == "PUT":
+		var req struct {
+			MetaDescription       *string `json:"meta_description"`
+			MetaDescriptionLocked *bool   `json:"meta_description_locked"`
+			Excerpt               *string `json:"excerpt"`
+			ExcerptLocked         *bool   `json:"excerpt_locked"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apierror.Write(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if (req.Excerpt != nil || req.ExcerptLocked != nil) && !seo.HasPost {
+			apierror.Write(w, http.StatusBadRequest, "node is not a blog post")
+			return
+		}
+		if req.MetaDescription != nil {
+			seo.MetaDescription, seo.MetaDescriptionLocked = strings.TrimSpace(*req.MetaDescription), true
+		}
+		if req.MetaDescriptionLocked != nil {
+			seo.MetaDescriptionLocked = *req.MetaDescriptionLocked
+		}
+		if req.Excerpt != nil {
+			seo.Excerpt, seo.ExcerptLocked = strings.TrimSpace(*req.Excerpt), true
+		}
+		if req.ExcerptLocked != nil {
+			seo.ExcerptLocked = *req.ExcerptLocked
+		}
+		db.Exec(`UPDATE nodes SET meta_description = ?, meta_description_locked = ? WHERE id = ?`,
+			seo.MetaDescription, boolToInt(seo.MetaDescriptionLocked), nodeID)
+		if seo.HasPost {
+			db.Exec(`UPDATE blog_posts SET excerpt = ?, excerpt_locked = ? WHERE node_id = ?`,
+				seo.Excerpt, boolToInt(seo.ExcerptLocked), nodeID)
+		}
+	}
+	json.NewEncoder(w).Encode(seo)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	plugins "veil/pkg/plugins"
+)
+
+// summaryTestPlugin answers "summarize" with a fixed summary
+type summaryTestPlugin struct{}
+
+func (summaryTestPlugin) Name() string                                   { return "summary-test" }
+func (summaryTestPlugin) Version() string                                { return "1.0.0" }
+func (summaryTestPlugin) Initialize(config map[string]interface{}) error { return nil }
+func (summaryTestPlugin) Validate() error                                { return nil }
+func (summaryTestPlugin) Shutdown() error                                { return nil }
+func (summaryTestPlugin) Execute(ctx context.Context, action string, payload interface{}) (interface{}, error) {
+	return map[string]interface{}{"summary": "A summary of " + payload.(map[string]interface{})["title"].(string)}, nil
+}
+
+func TestDescriptionsFilledAtPublish(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	db.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Blog', 'blog', 100, 100)`)
+	db.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, mime_type, created_at, modified_at) VALUES
+		('n1', 'post', 's1', 'p.md', 'Post', '# Post' || char(10) || 'The **first** paragraph.' || char(10) || 'More.', 'text/markdown', 100, 100)`)
+	db.Exec(`INSERT INTO blog_posts (id, node_id, slug, excerpt) VALUES ('b1', 'n1', 'post', '')`)
+
+	mux := setupRoutes()
+	do := func(method, path, body string) (*NodeSEO, int) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		var seo NodeSEO
+		json.NewDecoder(rr.Body).Decode(&seo)
+		return &seo, rr.Code
+	}
+
+	do("POST", "/api/publish?node_id=n1", "")
+	seo, _ := do("GET", "/api/node/n1/seo", "")
+	if seo.MetaDescription != "Post" || seo.Excerpt != "Post" || !seo.HasPost {
+		t.Fatalf("expected descriptions from the excerpt helper: %+v", seo)
+	}
+
+	// a manual description is locked; regeneration only rewrites the excerpt
+	if seo, code := do("PUT", "/api/node/n1/seo", `{"meta_description":"Hand written"}`); code != http.StatusOK || !seo.MetaDescriptionLocked {
+		t.Fatalf("PUT: %d %+v", code, seo)
+	}
+	plugins.GetRegistry().Register(summaryTestPlugin{})
+	defer plugins.GetRegistry().Unregister("summary-test")
+	defer func(p string) { summaryPlugin = p }(summaryPlugin)
+	summaryPlugin = "summary-test"
+
+	seo, _ = do("POST", "/api/node/n1/seo/regenerate", "")
+	if seo.MetaDescription != "Hand written" || seo.Excerpt != "A summary of Post" || seo.Source != "plugin" {
+		t.Fatalf("unexpected regenerated fields: %+v", seo)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/preview/s1/n1", nil))
+	if !strings.Contains(rr.Body.String(), `<meta name="description" content="Hand written">`) {
+		t.Fatalf("preview should carry the meta description:\n%s", rr.Body.String())
+	}
+
+	// unlocking lets regeneration replace it
+	do("PUT", "/api/node/n1/seo", `{"meta_description_locked":false}`)
+	if seo, _ = do("POST", "/api/node/n1/seo/regenerate", ""); seo.MetaDescription != "A summary of Post" {
+		t.Fatalf("expected an unlocked description to be regenerated: %+v", seo)
+	}
+	if _, code := do("GET", "/api/node/n1/seo/regenerate", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", code)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// === HTTP Server ===
+// veil serve listens with an http.Server built from Config.Server and stops
+// gracefully on SIGINT or SIGTERM: it stops accepting connections, lets
+// requests in flight finish, drains the job queue and closes the database,
+// each bounded by the shutdown timeout. It serves https with a certificate
+// from files, or one obtained from Let's Encrypt for --acme-domain, in which
+// case a second listener on HTTPPort answers the CA's challenges and
+// redirects everything else to https.
+
+// ServerConfig is where and how veil serve listens
+type ServerConfig struct {
+	Host string // empty listens on every interface
+	Port string
+	// ReadTimeout bounds reading a request, headers and body. WriteTimeout
+	// bounds writing a response and is off by default, since event streams,
+	// websockets and large downloads stay open for as long as they need.
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	TLSCert, TLSKey string // PEM files
+	ACMEDomains     []string
+	ACMEEmail       string
+	ACMEDirectory   string // default Let's Encrypt
+	ACMECache       string // default acme/ in the vault
+	HTTPPort        string // challenges and redirects with ACME
+}
+
+// DefaultServerConfig is used unless serve flags say otherwise
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Port:            "8080",
+		ReadTimeout:     30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		HTTPPort:        "80",
+	}
+}
+
+// Addr is the address to listen on
+func (c ServerConfig) Addr() string {
+	return net.JoinHostPort(c.Host, c.Port)
+}
+
+// TLS reports whether the server speaks https
+func (c ServerConfig) TLS() bool {
+	return c.TLSCert != "" || c.TLSKey != "" || len(c.ACMEDomains) > 0
+}
+
+// URL is where the server can be reached from this machine, or at its
+// first ACME domain
+func (c ServerConfig) URL() string {
+	host := c.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	if len(c.ACMEDomains) > 0 {
+		host = c.ACMEDomains[0]
+	}
+	if !c.TLS() {
+		return "http://" + net.JoinHostPort(host, c.Port)
+	}
+	if c.Port == "443" {
+		return "https://" + host
+	}
+	return "https://" + net.JoinHostPort(host, c.Port)
+}
+
+// acmeCacheDir is where certificates are kept in the vault, beside
+// signing.key. Backups take veil.db, .codex/ and media/ only, so the keys
+// stay out of them.
+const acmeCacheDir = "acme"
+
+// configureTLS gives srv the certificate cfg names. With ACME it returns
+// the manager, whose HTTPHandler must answer the CA's challenges.
+func configureTLS(cfg ServerConfig, srv *http.Server) (*autocert.Manager, error) {
+	switch {
+	case !cfg.TLS():
+		return nil, nil
+	case len(cfg.ACMEDomains) > 0 && (cfg.TLSCert != "" || cfg.TLSKey != ""):
+		return nil, errors.New("use either --tls-cert/--tls-key or --acme-domain, not both")
+	case len(cfg.ACMEDomains) > 0:
+		cache := cfg.ACMECache
+		if cache == "" {
+			cache = acmeCacheDir
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cache),
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+			Email:      cfg.ACMEEmail,
+			Client:     &acme.Client{DirectoryURL: cfg.acmeDirectory()},
+		}
+		srv.TLSConfig = m.TLSConfig()
+		return m, nil
+	case cfg.TLSCert == "" || cfg.TLSKey == "":
+		return nil, errors.New("--tls-cert and --tls-key go together")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("TLS certificate: %v", err)
+	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	return nil, nil
+}
+
+// acmeDirectory is the ACME CA's directory URL
+func (c ServerConfig) acmeDirectory() string {
+	if c.ACMEDirectory != "" {
+		return c.ACMEDirectory
+	}
+	return autocert.DefaultACMEDirectory
+}
+
+// newHTTPServer returns a server for handler with cfg's timeouts
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr(),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// runServer serves on ln, over TLS when srv has a TLSConfig, until ctx is
+// done, then shuts srv down, waiting up to timeout for requests in flight
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errc <- srv.Serve(ln)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if serveErr := <-errc; serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) && err == nil {
+		err = serveErr
+	}
+	return err
+}
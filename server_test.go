@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerConfig(t *testing.T) {
+	cfg := DefaultServerConfig()
+	if cfg.Addr() != ":8080" || cfg.URL() != "http://localhost:8080" {
+		t.Fatalf("default address %q, url %q", cfg.Addr(), cfg.URL())
+	}
+	cfg.Host, cfg.Port = "::1", "3000"
+	if cfg.Addr() != "[::1]:3000" || cfg.URL() != "http://[::1]:3000" {
+		t.Fatalf("address %q, url %q", cfg.Addr(), cfg.URL())
+	}
+	cfg.WriteTimeout = time.Minute
+	srv := newHTTPServer(cfg, http.NotFoundHandler())
+	if srv.Addr != "[::1]:3000" || srv.ReadTimeout != 30*time.Second || srv.WriteTimeout != time.Minute || srv.IdleTimeout != 2*time.Minute {
+		t.Fatalf("unexpected server: %+v", srv)
+	}
+}
+
+func TestRunServerShutsDownGracefully(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	srv := newHTTPServer(DefaultServerConfig(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "finished")
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, ln, 5*time.Second) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(b)
+	}()
+	<-started
+	cancel()
+
+	// new connections are refused while the request in flight finishes
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if i == 100 {
+			t.Fatal("the server kept accepting connections after shutdown began")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("runServer returned before the request finished: %v", err)
+	default:
+	}
+	close(release)
+	if got := <-body; got != "finished" {
+		t.Fatalf("the request in flight got %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("runServer: %v", err)
+	}
+}
+
+func TestConfigureTLS(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	cfg := DefaultServerConfig()
+	cfg.TLSCert, cfg.TLSKey, cfg.Port = certFile, keyFile, "443"
+	if cfg.URL() != "https://localhost" {
+		t.Fatalf("url %q", cfg.URL())
+	}
+	srv := newHTTPServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			t.Error("the request should arrive over TLS")
+		}
+		io.WriteString(w, "secure")
+	}))
+	if m, err := configureTLS(cfg, srv); err != nil || m != nil || srv.TLSConfig == nil {
+		t.Fatalf("configureTLS: %v %v", m, err)
+	}
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, ln, time.Second) }()
+
+	pool := x509.NewCertPool()
+	parsed, _ := x509.ParseCertificate(der)
+	pool.AddCert(parsed)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "secure" {
+		t.Fatalf("got %q", b)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []ServerConfig{
+		{TLSCert: certFile},
+		{TLSCert: certFile, TLSKey: keyFile, ACMEDomains: []string{"example.com"}},
+		{TLSCert: certFile, TLSKey: filepath.Join(dir, "missing.pem")},
+	} {
+		if _, err := configureTLS(bad, &http.Server{}); err == nil {
+			t.Fatalf("%+v should be refused", bad)
+		}
+	}
+
+	cfg = DefaultServerConfig()
+	cfg.ACMEDomains, cfg.ACMECache, cfg.Port = []string{"notes.example.com"}, dir, "443"
+	srv = newHTTPServer(cfg, http.NotFoundHandler())
+	m, err := configureTLS(cfg, srv)
+	if err != nil || m == nil || srv.TLSConfig.GetCertificate == nil || !strings.Contains(m.Client.DirectoryURL, "letsencrypt") {
+		t.Fatalf("acme: %v %+v", err, m)
+	}
+	if m.HostPolicy(context.Background(), "notes.example.com") != nil || m.HostPolicy(context.Background(), "other.example.com") == nil {
+		t.Fatal("certificates should only be requested for the configured domains")
+	}
+	if cfg.URL() != "https://notes.example.com" {
+		t.Fatalf("url %q", cfg.URL())
+	}
+}
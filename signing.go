@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Bundle Signing ===
+// Archives a vault hands out (site exports and codex commit bundles) are
+// signed with the vault's Ed25519 key, so whoever downloads one can check it
+// came from the vault and was not altered on the way. The key is made on
+// first use and kept in signing.key in the vault directory; its public half
+// is served at /api/signing-key for consumers to pin.
+//
+// A zip carries its signature inside, as META-INF/veil-signature.json: the
+// SHA-256 of every other entry, signed. Other files get a detached signature
+// of the same shape next to them, as <file>.sig. `veil verify` and
+// /api/verify check either.
+
+const (
+	signingKeyFile     = "signing.key"
+	zipSignatureEntry  = "META-INF/veil-signature.json"
+	signatureAlgorithm = "ed25519"
+)
+
+// signingKeyMu keeps two first exports from each making a key
+var signingKeyMu sync.Mutex
+
+// BundleSignature lists the files of a bundle by SHA-256 and signs the list.
+// Signature is over the JSON of the rest of the struct.
+type BundleSignature struct {
+	Version   int               `json:"version"`
+	Algorithm string            `json:"algorithm"`
+	KeyID     string            `json:"key_id"`
+	PublicKey string            `json:"public_key"`
+	SignedAt  int64             `json:"signed_at"`
+	Files     map[string]string `json:"files"`
+	Signature string            `json:"signature,omitempty"`
+}
+
+// SignatureCheck is the outcome of verifying a bundle. Valid means the
+// signature holds for the files as they are; Trusted that it was made with
+// this vault's key or the key the caller pinned.
+type SignatureCheck struct {
+	Valid     bool     `json:"valid"`
+	Trusted   bool     `json:"trusted"`
+	KeyID     string   `json:"key_id,omitempty"`
+	PublicKey string   `json:"public_key,omitempty"`
+	SignedAt  int64    `json:"signed_at,omitempty"`
+	Files     []string `json:"files,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// keyID is a short fingerprint of a public key
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// readSigningKey reads the signing key of the vault in dir
+func readSigningKey(dir string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(filepath.Join(dir, signingKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", signingKeyFile)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", signingKeyFile)
+	}
+	return priv, nil
+}
+
+// vaultSigningKey is the open vault's signing key, made if it has none
+func vaultSigningKey() (ed25519.PrivateKey, error) {
+	signingKeyMu.Lock()
+	defer signingKeyMu.Unlock()
+	priv, err := readSigningKey(".")
+	if !errors.Is(err, os.ErrNotExist) {
+		return priv, err
+	}
+	_, priv, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(signingKeyFile, data, 0600); err != nil {
+		return nil, err
+	}
+	return priv, nil
+}
+
+// payload is what the signature covers
+func (s BundleSignature) payload() []byte {
+	s.Signature = ""
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// signFiles signs the hashes of a bundle's files with the vault's key
+func signFiles(files map[string]string) (*BundleSignature, error) {
+	priv, err := vaultSigningKey()
+	if err != nil {
+		return nil, fmt.Errorf("signing key: %w", err)
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	s := &BundleSignature{
+		Version:   1,
+		Algorithm: signatureAlgorithm,
+		KeyID:     keyID(pub),
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		SignedAt:  time.Now().Unix(),
+		Files:     files,
+	}
+	s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, s.payload()))
+	return s, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// zipFileHashes hashes the entries of a zip other than its signature, which
+// it returns separately
+func zipFileHashes(zr *zip.Reader) (files map[string]string, sig []byte, err error) {
+	files = map[string]string{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		if f.Name == zipSignatureEntry {
+			sig = data
+			continue
+		}
+		if _, dup := files[f.Name]; dup {
+			return nil, nil, fmt.Errorf("%s is in the archive twice", f.Name)
+		}
+		files[f.Name] = sha256Hex(data)
+	}
+	return files, sig, nil
+}
+
+// signZip adds a signature of its entries to a zip, replacing any it had
+func signZip(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files, _, err := zipFileHashes(zr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := signFiles(files)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, f := range zr.File {
+		if f.Name == zipSignatureEntry {
+			continue
+		}
+		if err := zw.Copy(f); err != nil {
+			return nil, err
+		}
+	}
+	sb, _ := json.MarshalIndent(s, "", "  ")
+	fw, err := zw.Create(zipSignatureEntry)
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(sb)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// signDetached signs a file that can't hold its own signature, as name
+func signDetached(data []byte, name string) ([]byte, error) {
+	s, err := signFiles(map[string]string{filepath.Base(name): sha256Hex(data)})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// checkSignature verifies that s signs its file list with the key it names
+func checkSignature(s *BundleSignature) error {
+	if s.Algorithm != signatureAlgorithm {
+		return fmt.Errorf("unsupported algorithm %q", s.Algorithm)
+	}
+	pub, err := base64.StdEncoding.DecodeString(s.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("malformed public key")
+	}
+	if keyID(pub) != s.KeyID {
+		return errors.New("key id does not match the public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(pub, s.payload(), sig) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+// verifyBundle checks a signed zip, or data against the detached signature
+// sig. The key is trusted when it is the one pinned (a key id or public key),
+// or with nothing pinned, the vault in dir's own.
+func verifyBundle(data, sig []byte, pinned, dir string) SignatureCheck {
+	var check SignatureCheck
+	var files map[string]string
+	if sig == nil {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			check.Error = "not a zip archive; give the detached signature too"
+			return check
+		}
+		if files, sig, err = zipFileHashes(zr); err != nil {
+			check.Error = err.Error()
+			return check
+		}
+		if sig == nil {
+			check.Error = "the archive is not signed"
+			return check
+		}
+	}
+
+	var s BundleSignature
+	if err := json.Unmarshal(sig, &s); err != nil {
+		check.Error = "malformed signature: " + err.Error()
+		return check
+	}
+	check.KeyID, check.PublicKey, check.SignedAt = s.KeyID, s.PublicKey, s.SignedAt
+	if err := checkSignature(&s); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if files == nil {
+		// a detached signature covers one file, whatever it is called now
+		if len(s.Files) != 1 {
+			check.Error = "a detached signature must list one file"
+			return check
+		}
+		files = map[string]string{}
+		for name := range s.Files {
+			files[name] = sha256Hex(data)
+		}
+	}
+	for name, sum := range files {
+		if want, ok := s.Files[name]; !ok {
+			check.Error = name + " was added after signing"
+			return check
+		} else if want != sum {
+			check.Error = name + " was changed after signing"
+			return check
+		}
+	}
+	for name := range s.Files {
+		if _, ok := files[name]; !ok {
+			check.Error = name + " was removed after signing"
+			return check
+		}
+		check.Files = append(check.Files, name)
+	}
+	sort.Strings(check.Files)
+	check.Valid = true
+
+	switch {
+	case pinned != "":
+		check.Trusted = pinned == s.KeyID || pinned == s.PublicKey
+	default:
+		if priv, err := readSigningKey(dir); err == nil {
+			check.Trusted = keyID(priv.Public().(ed25519.PublicKey)) == s.KeyID
+		}
+	}
+	return check
+}
+
+// GET /api/signing-key: the public key bundles are signed with
+func handleSigningKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	priv, err := vaultSigningKey()
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	pub := priv.Public().(ed25519.PublicKey)
+	json.NewEncoder(w).Encode(map[string]string{
+		"algorithm":  signatureAlgorithm,
+		"key_id":     keyID(pub),
+		"public_key": base64.StdEncoding.EncodeToString(pub),
+	})
+}
+
+// POST /api/verify[?key=]: checks a signed zip sent as the body, or a
+// multipart "file" with an optional detached "signature"
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limitMediaBody(w, r, 1<<20)
+	var data, sig []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if err = r.ParseMultipartForm(32 << 20); err == nil {
+			var file io.ReadCloser
+			if file, _, err = r.FormFile("file"); err == nil {
+				data, err = io.ReadAll(file)
+				file.Close()
+			}
+			if s, _, serr := r.FormFile("signature"); serr == nil {
+				sig, _ = io.ReadAll(s)
+				s.Close()
+			}
+		}
+	} else {
+		data, err = io.ReadAll(r.Body)
+	}
+	if err != nil || len(data) == 0 {
+		if isBodyTooLarge(err) {
+			writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, r.ContentLength)
+			return
+		}
+		apierror.Write(w, http.StatusBadRequest, "send the bundle as the body, or as a multipart file with its signature")
+		return
+	}
+	json.NewEncoder(w).Encode(verifyBundle(data, sig, r.URL.Query().Get("key"), "."))
+}
+
+// verifyCommand is `veil verify <file> [--sig FILE] [--key KEY] [--vault
+// NAME|PATH]`. A file with <file>.sig next to it is checked against that.
+// It exits 1 unless the signature is valid and trusted.
+func verifyCommand() {
+	usage := "Usage: veil verify <file> [--sig <file.sig>] [--key <key id|public key>] [--vault NAME|PATH]"
+	var path, sigPath, pinned string
+	vault := "."
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--sig" && i+1 < len(args):
+			i++
+			sigPath = args[i]
+		case args[i] == "--key" && i+1 < len(args):
+			i++
+			pinned = args[i]
+		case args[i] == "--vault" && i+1 < len(args):
+			i++
+			vault = args[i]
+			if v, ok := lookupVault(vault); ok {
+				vault = v.Path
+			}
+		case path == "" && !strings.HasPrefix(args[i], "--"):
+			path = args[i]
+		default:
+			fmt.Println(usage)
+			os.Exit(2)
+		}
+	}
+	if path == "" {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if sigPath == "" {
+		if _, err := os.Stat(path + ".sig"); err == nil {
+			sigPath = path + ".sig"
+		}
+	}
+	var sig []byte
+	if sigPath != "" {
+		if sig, err = os.ReadFile(sigPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	check := verifyBundle(data, sig, pinned, vault)
+	switch {
+	case !check.Valid:
+		fmt.Printf("%s: INVALID: %s\n", path, check.Error)
+		os.Exit(1)
+	case !check.Trusted:
+		fmt.Printf("%s: valid signature by unknown key %s (%d files); pin it with --key to trust it\n", path, check.KeyID, len(check.Files))
+		os.Exit(1)
+	}
+	fmt.Printf("%s: OK, signed by %s on %s (%d files)\n", path, check.KeyID, time.Unix(check.SignedAt, 0).Format(time.RFC3339), len(check.Files))
+}
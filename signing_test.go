@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBundleSigning(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	mux := setupRoutes()
+	do := func(method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	verify := func(body []byte) SignatureCheck {
+		var check SignatureCheck
+		json.NewDecoder(do("POST", "/api/verify", "application/zip", body).Body).Decode(&check)
+		return check
+	}
+	// rezip rewrites an archive, letting edit change or drop entries and add more
+	rezip := func(data []byte, edit func(name string, content []byte) []byte, extra map[string]string) []byte {
+		zr, _ := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			content := new(bytes.Buffer)
+			content.ReadFrom(rc)
+			rc.Close()
+			if c := edit(f.Name, content.Bytes()); c != nil {
+				fw, _ := zw.Create(f.Name)
+				fw.Write(c)
+			}
+		}
+		for name, content := range extra {
+			fw, _ := zw.Create(name)
+			fw.Write([]byte(content))
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	keep := func(_ string, c []byte) []byte { return c }
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, status, created_at, modified_at) VALUES ('a', 'post', 's1', 'a.md', 'A', 'hello', 'published', 1, 1)`)
+
+	rr := do("GET", "/api/export?site_id=s1&format=zip", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", rr.Code, rr.Body.String())
+	}
+	bundle := rr.Body.Bytes()
+	if _, err := os.Stat(signingKeyFile); err != nil {
+		t.Fatal("the first export should make the vault's key")
+	}
+	var key map[string]string
+	json.NewDecoder(do("GET", "/api/signing-key", "", nil).Body).Decode(&key)
+
+	check := verify(bundle)
+	if !check.Valid || !check.Trusted || check.KeyID != key["key_id"] || check.PublicKey != key["public_key"] || len(check.Files) == 0 {
+		t.Fatalf("a fresh export should verify: %+v", check)
+	}
+	if slices.Contains(check.Files, zipSignatureEntry) {
+		t.Fatal("the signature should not sign itself")
+	}
+	// copying the archive entry by entry keeps it valid
+	if check := verify(rezip(bundle, keep, nil)); !check.Valid {
+		t.Fatalf("an unchanged rezip should verify: %+v", check)
+	}
+
+	for name, tampered := range map[string][]byte{
+		"changed": rezip(bundle, func(name string, c []byte) []byte {
+			if name == check.Files[0] {
+				return append(c, "<script>evil()</script>"...)
+			}
+			return c
+		}, nil),
+		"added": rezip(bundle, keep, map[string]string{"extra.html": "hi"}),
+		"removed": rezip(bundle, func(name string, c []byte) []byte {
+			if name == check.Files[0] {
+				return nil
+			}
+			return c
+		}, nil),
+	} {
+		if check := verify(tampered); check.Valid || !strings.Contains(check.Error, name+" after signing") {
+			t.Fatalf("%s: expected a failed check, got %+v", name, check)
+		}
+	}
+	if check := verify(rezip(bundle, func(name string, c []byte) []byte {
+		if name == zipSignatureEntry {
+			return bytes.Replace(c, []byte(`"signed_at": `), []byte(`"signed_at": 1`), 1)
+		}
+		return c
+	}, nil)); check.Valid || check.Error != "signature does not match" {
+		t.Fatalf("an edited signature should fail: %+v", check)
+	}
+	if check := verify(rezip(bundle, func(name string, c []byte) []byte {
+		if name == zipSignatureEntry {
+			return nil
+		}
+		return c
+	}, nil)); check.Valid || check.Error != "the archive is not signed" {
+		t.Fatalf("an unsigned archive should fail: %+v", check)
+	}
+
+	// another vault's key is valid but not trusted unless pinned
+	os.Rename(signingKeyFile, "old.key")
+	other := verify(bundle)
+	if !other.Valid || other.Trusted {
+		t.Fatalf("a bundle from another key should be valid but untrusted: %+v", other)
+	}
+	var pinned SignatureCheck
+	json.NewDecoder(do("POST", "/api/verify?key="+check.KeyID, "", bundle).Body).Decode(&pinned)
+	if !pinned.Trusted {
+		t.Fatalf("a pinned key should be trusted: %+v", pinned)
+	}
+
+	// a file that can't hold its signature is checked against a detached one
+	doc := []byte(`{"@context": "https://schema.org"}`)
+	sig, err := signDetached(doc, "/tmp/commit.jsonld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(file []byte) SignatureCheck {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		fw, _ := mw.CreateFormFile("file", "renamed.jsonld")
+		fw.Write(file)
+		fw, _ = mw.CreateFormFile("signature", "commit.jsonld.sig")
+		fw.Write(sig)
+		mw.Close()
+		var check SignatureCheck
+		json.NewDecoder(do("POST", "/api/verify", mw.FormDataContentType(), body.Bytes()).Body).Decode(&check)
+		return check
+	}
+	if check := upload(doc); !check.Valid || !check.Trusted || len(check.Files) != 1 || check.Files[0] != "commit.jsonld" {
+		t.Fatalf("a detached signature should verify: %+v", check)
+	}
+	if check := upload(append(doc, ' ')); check.Valid {
+		t.Fatalf("a changed file should fail its detached signature: %+v", check)
+	}
+	if rr := do("POST", "/api/verify", "", nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("verify without a bundle: %d", rr.Code)
+	}
+}
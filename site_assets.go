@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Site Assets ===
+// Each site has its own bucket of fonts, icons, logos and images for its
+// themes, kept under site-assets/<site_id>/ and served at /site-assets/.
+// Themes find them in .Assets by name, and .Fonts, .Icon and .Logo. Static
+// exports copy them to site-assets/ along with a fonts.css of @font-face
+// rules, and pages preload the fonts and the logo. Favicons and the social
+// image can be generated from the logo (site_icons.go).
+
+const siteAssetMaxBytes = 5 << 20
+
+// siteAssetTypes maps the extensions a site asset may have to their type
+var siteAssetTypes = map[string]string{
+	".woff2": "font/woff2",
+	".woff":  "font/woff",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".ico":   "image/x-icon",
+	".png":   "image/png",
+	".svg":   "image/svg+xml",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".webp":  "image/webp",
+	".gif":   "image/gif",
+}
+
+var siteAssetName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SiteAsset is a file in a site's asset bucket
+type SiteAsset struct {
+	ID       string `json:"id"`
+	SiteID   string `json:"site_id"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind" validate:"oneof=font|icon|logo|image"`
+	MimeType string `json:"mime_type"`
+	Family   string `json:"family,omitempty" validate:"max=100"`
+	Weight   string `json:"weight,omitempty" validate:"max=20"`
+	Style    string `json:"style,omitempty" validate:"oneof=normal|italic|oblique"`
+	Size     int64  `json:"size"`
+	Hash     string `json:"hash"`
+	// Sizes is an icon's pixel sizes, "32x32" or "16x16 32x32" for an ICO
+	Sizes string `json:"sizes,omitempty"`
+	// URL is where the server serves the file; exports rewrite it
+	URL       string `json:"url"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// siteAssetPath is where a site asset is stored on disk
+func siteAssetPath(siteID, name string) string {
+	return filepath.Join("site-assets", path.Base(siteID), path.Base(name))
+}
+
+// siteAssets lists a site's assets by name
+func siteAssets(siteID string) ([]SiteAsset, error) {
+	rows, err := db.Query(`SELECT id, site_id, name, kind, COALESCE(mime_type, ''), COALESCE(family, ''), COALESCE(font_weight, ''),
+		COALESCE(font_style, ''), COALESCE(file_size, 0), COALESCE(hash, ''), created_at FROM site_assets WHERE site_id = ? ORDER BY name`, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SiteAsset
+	for rows.Next() {
+		var a SiteAsset
+		if err := rows.Scan(&a.ID, &a.SiteID, &a.Name, &a.Kind, &a.MimeType, &a.Family, &a.Weight, &a.Style, &a.Size, &a.Hash, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.URL = "/site-assets/" + a.SiteID + "/" + a.Name
+		a.Sizes = iconSizes(a)
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// fontFaceCSS is the @font-face rules for a site's fonts. URLs are relative
+// to the stylesheet, which sits beside the fonts.
+func fontFaceCSS(assets []SiteAsset) string {
+	var b strings.Builder
+	for _, a := range assets {
+		if a.Kind != "font" {
+			continue
+		}
+		format := strings.TrimPrefix(a.MimeType, "font/")
+		if format == "ttf" {
+			format = "truetype"
+		} else if format == "otf" {
+			format = "opentype"
+		}
+		fmt.Fprintf(&b, "@font-face {\n\tfont-family: %q;\n\tsrc: url(%q) format(%q);\n", a.Family, a.Name, format)
+		if a.Weight != "" {
+			fmt.Fprintf(&b, "\tfont-weight: %s;\n", a.Weight)
+		}
+		if a.Style != "" {
+			fmt.Fprintf(&b, "\tfont-style: %s;\n", a.Style)
+		}
+		b.WriteString("\tfont-display: swap;\n}\n")
+	}
+	return b.String()
+}
+
+var fontWeight = regexp.MustCompile(`^([1-9]00|normal|bold)$`)
+
+// /api/site-assets?site_id=: GET lists the site's assets, POST (multipart:
+// file, kind, name, family, weight, style) adds or replaces one, DELETE
+// &name= removes one. Changes are for site owners.
+func handleSiteAssets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "POST" {
+		limitMediaBody(w, r, 1<<20)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			if isBodyTooLarge(err) {
+				writeLimitError(w, "max_media_bytes", limits.MaxMediaBytes, r.ContentLength)
+				return
+			}
+			apierror.Write(w, http.StatusBadRequest, "failed to parse form")
+			return
+		}
+	}
+	siteID := r.FormValue("site_id")
+	var exists int
+	if db.QueryRow(`SELECT 1 FROM sites WHERE id = ?`, siteID).Scan(&exists) != nil {
+		apierror.Write(w, http.StatusNotFound, "site not found")
+		return
+	}
+	if r.Method != "GET" && !canManageSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "owner role required to change the site's assets")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		assets, err := siteAssets(siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if assets == nil {
+			assets = []SiteAsset{}
+		}
+		json.NewEncoder(w).Encode(assets)
+	case "POST":
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "file", Message: "is required"}})
+			return
+		}
+		defer file.Close()
+
+		a := SiteAsset{SiteID: siteID, Name: r.FormValue("name"), Kind: r.FormValue("kind"),
+			Family: r.FormValue("family"), Weight: r.FormValue("weight"), Style: r.FormValue("style")}
+		if a.Name == "" {
+			a.Name = header.Filename
+		}
+		ext := strings.ToLower(path.Ext(a.Name))
+		a.MimeType = siteAssetTypes[ext]
+		if a.Kind == "" {
+			a.Kind = "image"
+			if strings.HasPrefix(a.MimeType, "font/") {
+				a.Kind = "font"
+			} else if ext == ".ico" {
+				a.Kind = "icon"
+			}
+		}
+		if a.Kind == "font" && a.Family == "" {
+			a.Family = strings.TrimSuffix(a.Name, path.Ext(a.Name))
+		}
+		verrs := validate.Struct(&a)
+		if !siteAssetName.MatchString(a.Name) {
+			verrs.Add("name", "may only use letters, digits, '.', '_' and '-'")
+		}
+		if a.MimeType == "" {
+			verrs.Add("name", "must end in .woff2, .woff, .ttf, .otf, .ico, .png, .svg, .jpg, .jpeg, .webp or .gif")
+		} else if (a.Kind == "font") != strings.HasPrefix(a.MimeType, "font/") {
+			verrs.Add("kind", "fonts must be font files, and font files fonts")
+		}
+		if a.Weight != "" && !fontWeight.MatchString(a.Weight) {
+			verrs.Add("weight", "must be 100 to 900, normal or bold")
+		}
+		if header.Size > siteAssetMaxBytes {
+			verrs.Add("file", fmt.Sprintf("must be at most %d bytes", siteAssetMaxBytes))
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		if !checkVaultRoom(w, header.Size) {
+			return
+		}
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, "failed to read upload")
+			return
+		}
+		if a.MimeType == "image/svg+xml" {
+			data = []byte(sanitizeSVG(string(data)))
+		}
+		if err := saveSiteAsset(&a, data); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	case "DELETE":
+		name := r.URL.Query().Get("name")
+		res, _ := db.Exec(`DELETE FROM site_assets WHERE site_id = ? AND name = ?`, siteID, name)
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, http.StatusNotFound, "asset not found")
+			return
+		}
+		os.Remove(siteAssetPath(siteID, name))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// saveSiteAsset writes data to a's file and adds or replaces its row,
+// filling in its size, hash, URL, ID and creation time
+func saveSiteAsset(a *SiteAsset, data []byte) error {
+	a.ID = ids.New("sasset")
+	a.Size = int64(len(data))
+	a.Hash = fmt.Sprintf("%x", md5.Sum(data))
+	a.CreatedAt = time.Now().Unix()
+	a.URL = "/site-assets/" + a.SiteID + "/" + a.Name
+	diskPath := siteAssetPath(a.SiteID, a.Name)
+	os.MkdirAll(filepath.Dir(diskPath), 0755)
+	if err := os.WriteFile(diskPath, data, 0644); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO site_assets (id, site_id, name, kind, mime_type, family, font_weight, font_style, file_size, hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(site_id, name) DO UPDATE SET kind = excluded.kind, mime_type = excluded.mime_type, family = excluded.family,
+			font_weight = excluded.font_weight, font_style = excluded.font_style, file_size = excluded.file_size, hash = excluded.hash`,
+		a.ID, a.SiteID, a.Name, a.Kind, a.MimeType, a.Family, a.Weight, a.Style, a.Size, a.Hash, a.CreatedAt)
+	if err != nil {
+		return err
+	}
+	noteVaultWrite(a.Size)
+	a.Sizes = iconSizes(*a)
+	db.QueryRow(`SELECT id, created_at FROM site_assets WHERE site_id = ? AND name = ?`, a.SiteID, a.Name).Scan(&a.ID, &a.CreatedAt)
+	return nil
+}
+
+// GET /site-assets/<site_id>/<name> serves a site asset
+func serveSiteAsset(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/site-assets/"), "/")
+	if len(parts) != 2 || !siteAssetName.MatchString(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	var mimeType string
+	if db.QueryRow(`SELECT COALESCE(mime_type, '') FROM site_assets WHERE site_id = ? AND name = ?`, parts[0], parts[1]).Scan(&mimeType) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", mimeType)
+	http.ServeFile(w, r, siteAssetPath(parts[0], parts[1]))
+}
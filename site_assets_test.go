@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSiteAssets(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "site-assets-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'hello', 'a', 'text/markdown', 'published', 1, 1)`)
+
+	mux := setupRoutes()
+	upload := func(filename, content string, fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("site_id", "s1")
+		for k, v := range fields {
+			mw.WriteField(k, v)
+		}
+		fw, _ := mw.CreateFormFile("file", filename)
+		fw.Write([]byte(content))
+		mw.Close()
+		req := httptest.NewRequest("POST", "/api/site-assets", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := upload("Inter-Bold.woff2", "WOFF2", map[string]string{"family": "Inter", "weight": "700"})
+	if rr.Code != 201 {
+		t.Fatalf("font upload: %d %s", rr.Code, rr.Body.String())
+	}
+	var font SiteAsset
+	json.NewDecoder(rr.Body).Decode(&font)
+	if font.Kind != "font" || font.MimeType != "font/woff2" || font.URL != "/site-assets/s1/Inter-Bold.woff2" {
+		t.Fatalf("unexpected font: %+v", font)
+	}
+	if rr := upload("favicon.ico", "ICO", nil); rr.Code != 201 {
+		t.Fatalf("icon upload: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := upload("logo.svg", `<svg><script>alert(1)</script></svg>`, map[string]string{"kind": "logo"}); rr.Code != 201 {
+		t.Fatalf("logo upload: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := upload("evil.html", "<p>", nil); rr.Code != 400 || !strings.Contains(rr.Body.String(), `"name"`) {
+		t.Fatalf("unknown file types should be refused: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := upload("cat.png", "PNG", map[string]string{"kind": "font"}); rr.Code != 400 {
+		t.Fatalf("a font kind needs a font file: %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/site-assets/s1/logo.svg", nil))
+	if rr.Code != 200 || strings.Contains(rr.Body.String(), "script") || rr.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("logo should be served sanitized: %d %q %s", rr.Code, rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	out := filepath.Join(tmp, "dist")
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", Theme: "default"}, out); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(out, "a.html"))
+	for _, want := range []string{
+		`<link rel="preload" href="site-assets/Inter-Bold.woff2" as="font" type="font/woff2" crossorigin>`,
+		`<link rel="preload" href="site-assets/logo.svg" as="image">`,
+		`<link rel="icon" href="site-assets/favicon.ico" type="image/x-icon">`,
+		`<link rel="stylesheet" href="site-assets/fonts.css">`,
+		`<img class="logo" src="site-assets/logo.svg" alt="">`,
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Fatalf("page is missing %s:\n%s", want, page)
+		}
+	}
+	fonts, _ := ioutil.ReadFile(filepath.Join(out, "site-assets", "fonts.css"))
+	if !strings.Contains(string(fonts), `font-family: "Inter";`) || !strings.Contains(string(fonts), `src: url("Inter-Bold.woff2") format("woff2");`) ||
+		!strings.Contains(string(fonts), "font-weight: 700;") {
+		t.Fatalf("unexpected fonts.css: %s", fonts)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(out, "site-assets", "Inter-Bold.woff2")); string(data) != "WOFF2" {
+		t.Fatalf("font should be copied into the export")
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("DELETE", "/api/site-assets?site_id=s1&name=favicon.ico", nil))
+	if rr.Code != 204 {
+		t.Fatalf("delete: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(siteAssetPath("s1", "favicon.ico")); !os.IsNotExist(err) {
+		t.Fatalf("deleting an asset should remove its file")
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/site-assets?site_id=s1", nil))
+	var assets []SiteAsset
+	json.NewDecoder(rr.Body).Decode(&assets)
+	if len(assets) != 2 || assets[0].Name != "Inter-Bold.woff2" || assets[1].Name != "logo.svg" {
+		t.Fatalf("unexpected assets: %+v", assets)
+	}
+}
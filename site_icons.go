@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"veil/pkg/apierror"
+)
+
+// === Site Icons ===
+// POST /api/site-assets/generate?site_id= draws a site's favicons and its
+// default social image into its asset bucket: favicon.ico (16 and 32 px),
+// icon-180.png (the apple touch icon), icon-192.png and icon-512.png for the
+// web app manifest, and og-image.png, the site's name over the theme colour.
+// They are drawn from the site's logo, else its icon, when that is a PNG,
+// JPEG or GIF, and from the site's initial otherwise. Generating again
+// replaces them. Exports and previews also give every page an Open Graph
+// image of its own title, over the theme's og-background.png if it has one.
+
+// siteThemeColor is the background of generated images and the manifest's
+// theme_color
+const siteThemeColor = "#4f46e5"
+
+const ogWidth, ogHeight = 1200, 630
+
+// faviconSizes go into favicon.ico; iconSizesPNG are written as icon-N.png
+var (
+	faviconSizes = []int{16, 32}
+	iconSizesPNG = []int{180, 192, 512}
+)
+
+// iconSizes reads an icon's pixel sizes from its file
+func iconSizes(a SiteAsset) string {
+	if a.Kind != "icon" {
+		return ""
+	}
+	f, err := os.Open(siteAssetPath(a.SiteID, a.Name))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if a.MimeType == "image/x-icon" {
+		// ICONDIR then a 16 byte entry per image; 0 means 256
+		var head [6]byte
+		if _, err := f.Read(head[:]); err != nil || binary.LittleEndian.Uint16(head[2:]) != 1 {
+			return ""
+		}
+		var sizes []string
+		for n := binary.LittleEndian.Uint16(head[4:]); n > 0; n-- {
+			var e [16]byte
+			if _, err := f.Read(e[:]); err != nil {
+				return ""
+			}
+			w, h := int(e[0]), int(e[1])
+			if w == 0 {
+				w = 256
+			}
+			if h == 0 {
+				h = 256
+			}
+			sizes = append(sizes, fmt.Sprintf("%dx%d", w, h))
+		}
+		return strings.Join(sizes, " ")
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", cfg.Width, cfg.Height)
+}
+
+// siteIconSource is the image a site's icons are drawn from: its logo, else
+// its largest icon, or nil when neither can be decoded
+func siteIconSource(siteID string) (image.Image, string, error) {
+	assets, err := siteAssets(siteID)
+	if err != nil {
+		return nil, "", err
+	}
+	var best image.Image
+	var name string
+	for _, kind := range []string{"logo", "icon"} {
+		for _, a := range assets {
+			if a.Kind != kind {
+				continue
+			}
+			f, err := os.Open(siteAssetPath(siteID, a.Name))
+			if err != nil {
+				continue
+			}
+			img, _, err := image.Decode(f)
+			f.Close()
+			if err == nil && (best == nil || img.Bounds().Dx() > best.Bounds().Dx()) {
+				best, name = img, a.Name
+			}
+		}
+		if best != nil {
+			return best, name, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// parseHexColor reads #rrggbb
+func parseHexColor(s string) color.RGBA {
+	c := color.RGBA{A: 0xff}
+	fmt.Sscanf(strings.TrimPrefix(s, "#"), "%02x%02x%02x", &c.R, &c.G, &c.B)
+	return c
+}
+
+// scaleInto draws src over r of dst, each pixel the average of the source
+// pixels it covers
+func scaleInto(dst draw.Image, r image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if r.Empty() || sb.Empty() {
+		return
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	for y := 0; y < r.Dy(); y++ {
+		sy0 := sb.Min.Y + y*sb.Dy()/r.Dy()
+		sy1 := sb.Min.Y + (y+1)*sb.Dy()/r.Dy()
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < r.Dx(); x++ {
+			sx0 := sb.Min.X + x*sb.Dx()/r.Dx()
+			sx1 := sb.Min.X + (x+1)*sb.Dx()/r.Dx()
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var rs, gs, bs, as, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					rs, gs, bs, as, n = rs+uint64(cr), gs+uint64(cg), bs+uint64(cb), as+uint64(ca), n+1
+				}
+			}
+			scaled.SetRGBA64(x, y, color.RGBA64{uint16(rs / n), uint16(gs / n), uint16(bs / n), uint16(as / n)})
+		}
+	}
+	draw.Draw(dst, r, scaled, image.Point{}, draw.Over)
+}
+
+// fitRect is the largest rectangle of src's shape centred in r; with cover
+// it fills r instead, overflowing it
+func fitRect(r image.Rectangle, src image.Rectangle, cover bool) image.Rectangle {
+	w, h := r.Dx(), src.Dy()*r.Dx()/src.Dx()
+	if (h > r.Dy()) != cover {
+		w, h = src.Dx()*r.Dy()/src.Dy(), r.Dy()
+	}
+	x, y := r.Min.X+(r.Dx()-w)/2, r.Min.Y+(r.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+// renderIcon draws a size x size icon: src centred on a transparent square,
+// or on white when opaque, or without src the initial on the theme colour
+func renderIcon(src image.Image, initial rune, size int, opaque bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	if src == nil {
+		draw.Draw(img, img.Bounds(), image.NewUniform(parseHexColor(siteThemeColor)), image.Point{}, draw.Src)
+		scale := size * 3 / 5 / glyphHeight
+		if scale < 1 {
+			scale = 1
+		}
+		drawText(img, string(initial), (size-glyphWidth*scale)/2, (size-glyphHeight*scale)/2, scale, color.White)
+		return img
+	}
+	r := img.Bounds()
+	if opaque {
+		draw.Draw(img, r, image.White, image.Point{}, draw.Src)
+		r = r.Inset(size / 10)
+	}
+	scaleInto(img, fitRect(r, src.Bounds(), false), src)
+	return img
+}
+
+// renderSocialImage draws a 1200x630 Open Graph image: title over bg (or
+// the theme colour), with the site's mark and name along the bottom
+func renderSocialImage(title, siteName string, bg, mark image.Image) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, ogWidth, ogHeight))
+	if bg != nil {
+		scaleInto(img, fitRect(img.Bounds(), bg.Bounds(), true), bg)
+	} else {
+		// the theme colour, darkening towards the bottom
+		base := parseHexColor(siteThemeColor)
+		for y := 0; y < ogHeight; y++ {
+			f := 100 - 30*y/ogHeight
+			c := color.RGBA{uint8(int(base.R) * f / 100), uint8(int(base.G) * f / 100), uint8(int(base.B) * f / 100), 0xff}
+			draw.Draw(img, image.Rect(0, y, ogWidth, y+1), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+	}
+
+	const margin = 80
+	footer := ogHeight - margin - 64
+	// the largest text size the title fits at in four lines
+	var lines []string
+	scale := 10
+	for ; scale > 5; scale-- {
+		var cut bool
+		if lines, cut = wrapText(title, (ogWidth-2*margin)/((glyphWidth+1)*scale), 4); !cut {
+			break
+		}
+	}
+	y := margin + (footer-margin-len(lines)*(glyphHeight+3)*scale)/2
+	for _, line := range lines {
+		drawText(img, line, margin, y, scale, color.White)
+		y += (glyphHeight + 3) * scale
+	}
+
+	x := margin
+	if mark != nil {
+		scaleInto(img, fitRect(image.Rect(x, footer, x+64, footer+64), mark.Bounds(), false), mark)
+		x += 64 + 24
+	}
+	name, _ := wrapText(siteName, (ogWidth-margin-x)/((glyphWidth+1)*4), 1)
+	if len(name) > 0 {
+		drawText(img, name[0], x, footer+(64-glyphHeight*4)/2, 4, color.RGBA{0xe0, 0xe7, 0xff, 0xff})
+	}
+	return img
+}
+
+// socialImage renders title's Open Graph image for a site, over the theme
+// background in static (og-background.png) when there is one
+func socialImage(siteID, siteName, title string, static map[string][]byte) ([]byte, error) {
+	var bg image.Image
+	if data, ok := static["og-background.png"]; ok {
+		bg, _ = png.Decode(bytes.NewReader(data))
+	}
+	mark, _, err := siteIconSource(siteID)
+	if err != nil {
+		return nil, err
+	}
+	return encodePNG(renderSocialImage(title, siteName, bg, mark))
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// encodeICO packs PNG images into an ICO file, which every browser reads
+func encodeICO(imgs []image.Image) ([]byte, error) {
+	var dir, data bytes.Buffer
+	binary.Write(&dir, binary.LittleEndian, [3]uint16{0, 1, uint16(len(imgs))})
+	offset := 6 + 16*len(imgs)
+	for _, img := range imgs {
+		b, err := encodePNG(img)
+		if err != nil {
+			return nil, err
+		}
+		w, h := img.Bounds().Dx(), img.Bounds().Dy()
+		dir.Write([]byte{byte(w), byte(h), 0, 0})
+		binary.Write(&dir, binary.LittleEndian, [2]uint16{1, 32})
+		binary.Write(&dir, binary.LittleEndian, [2]uint32{uint32(len(b)), uint32(offset + data.Len())})
+		data.Write(b)
+	}
+	dir.Write(data.Bytes())
+	return dir.Bytes(), nil
+}
+
+// generateSiteIcons renders a site's favicons, manifest icons and social
+// image, returning them by asset name
+func generateSiteIcons(siteID, siteName string) ([]SiteAsset, map[string][]byte, string, error) {
+	src, source, err := siteIconSource(siteID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if source == "" {
+		source = "initial"
+	}
+	initial := '?'
+	for _, c := range siteName {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			initial = unicode.ToUpper(c)
+			break
+		}
+	}
+
+	files := map[string][]byte{}
+	var assets []SiteAsset
+	add := func(name, kind, mimeType string, data []byte) {
+		files[name] = data
+		assets = append(assets, SiteAsset{SiteID: siteID, Name: name, Kind: kind, MimeType: mimeType})
+	}
+	var favicons []image.Image
+	for _, size := range faviconSizes {
+		favicons = append(favicons, renderIcon(src, initial, size, false))
+	}
+	ico, err := encodeICO(favicons)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	add("favicon.ico", "icon", "image/x-icon", ico)
+	for _, size := range iconSizesPNG {
+		// iOS draws transparent touch icons on black
+		b, err := encodePNG(renderIcon(src, initial, size, size == 180))
+		if err != nil {
+			return nil, nil, "", err
+		}
+		add(fmt.Sprintf("icon-%d.png", size), "icon", "image/png", b)
+	}
+	og, err := encodePNG(renderSocialImage(siteName, "", nil, src))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	add("og-image.png", "image", "image/png", og)
+	return assets, files, source, nil
+}
+
+// POST /api/site-assets/generate?site_id= generates the site's favicons and
+// social image from its logo. Owners only.
+func handleGenerateSiteIcons(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	siteID := r.URL.Query().Get("site_id")
+	var name string
+	if db.QueryRow(`SELECT name FROM sites WHERE id = ?`, siteID).Scan(&name) != nil {
+		apierror.Write(w, http.StatusNotFound, "site not found")
+		return
+	}
+	if !canManageSite(r, siteID) {
+		apierror.Write(w, http.StatusForbidden, "owner role required to change the site's assets")
+		return
+	}
+
+	assets, files, source, err := generateSiteIcons(siteID, name)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	var total int64
+	for _, data := range files {
+		total += int64(len(data))
+	}
+	if !checkVaultRoom(w, total) {
+		return
+	}
+	for i := range assets {
+		if err := saveSiteAsset(&assets[i], files[assets[i].Name]); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"source": source, "assets": assets})
+}
+
+// siteIcons picks a site's sized PNG icons, for icon links and the manifest
+func siteIcons(assets []SiteAsset) []SiteAsset {
+	var out []SiteAsset
+	for _, a := range assets {
+		if a.Kind == "icon" && a.MimeType == "image/png" && a.Sizes != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// siteSocialImage is the site's own og-image.*, if it has one
+func siteSocialImage(assets []SiteAsset) *SiteAsset {
+	for i, a := range assets {
+		if strings.HasPrefix(a.Name, "og-image.") && strings.HasPrefix(a.MimeType, "image/") {
+			return &assets[i]
+		}
+	}
+	return nil
+}
+
+// iconLinkTags links a site's icons in a page head, the 180px one as the
+// apple touch icon
+func iconLinkTags(assets []SiteAsset) string {
+	var b strings.Builder
+	for _, a := range assets {
+		switch {
+		case a.Kind != "icon":
+		case a.Sizes == "180x180":
+			fmt.Fprintf(&b, "<link rel=\"apple-touch-icon\" href=\"%s\">\n", html.EscapeString(a.URL))
+		case a.Sizes == "" || a.MimeType == "image/x-icon":
+			fmt.Fprintf(&b, "<link rel=\"icon\" href=\"%s\" type=\"%s\">\n", html.EscapeString(a.URL), a.MimeType)
+		default:
+			fmt.Fprintf(&b, "<link rel=\"icon\" href=\"%s\" type=\"%s\" sizes=\"%s\">\n", html.EscapeString(a.URL), a.MimeType, a.Sizes)
+		}
+	}
+	return b.String()
+}
+
+// socialMetaTags are a page's Open Graph and Twitter card tags, as the
+// default theme writes them
+func socialMetaTags(siteName, title, desc, pageURL, imageURL string) string {
+	var b strings.Builder
+	meta := func(attr, key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "<meta %s=\"%s\" content=\"%s\">\n", attr, key, html.EscapeString(value))
+		}
+	}
+	meta("property", "og:type", "article")
+	meta("property", "og:site_name", siteName)
+	meta("property", "og:title", title)
+	meta("property", "og:description", desc)
+	meta("property", "og:url", pageURL)
+	meta("property", "og:image", imageURL)
+	if imageURL != "" {
+		meta("name", "twitter:card", "summary_large_image")
+	}
+	return b.String()
+}
+
+// === Bitmap Text ===
+// Generated images letter titles in a 5x7 bitmap font, upper case, so they
+// need no font files.
+
+const glyphWidth, glyphHeight = 5, 7
+
+// glyphs are rows of five bits, the high bit leftmost
+var glyphs = map[rune][glyphHeight]uint8{
+	'A':  {0x0e, 0x11, 0x11, 0x11, 0x1f, 0x11, 0x11},
+	'B':  {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C':  {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D':  {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F':  {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G':  {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H':  {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I':  {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M':  {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O':  {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P':  {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q':  {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R':  {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S':  {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T':  {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X':  {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y':  {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0':  {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1':  {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3':  {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4':  {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5':  {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6':  {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7':  {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8':  {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9':  {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	' ':  {},
+	'.':  {0, 0, 0, 0, 0, 0x0c, 0x0c},
+	',':  {0, 0, 0, 0, 0x0c, 0x04, 0x08},
+	':':  {0, 0x0c, 0x0c, 0, 0x0c, 0x0c, 0},
+	';':  {0, 0x0c, 0x0c, 0, 0x0c, 0x04, 0x08},
+	'!':  {0x04, 0x04, 0x04, 0x04, 0x04, 0, 0x04},
+	'?':  {0x0e, 0x11, 0x01, 0x02, 0x04, 0, 0x04},
+	'\'': {0x0c, 0x04, 0x08, 0, 0, 0, 0},
+	'"':  {0x0a, 0x0a, 0x0a, 0, 0, 0, 0},
+	'-':  {0, 0, 0, 0x1f, 0, 0, 0},
+	'+':  {0, 0x04, 0x04, 0x1f, 0x04, 0x04, 0},
+	'=':  {0, 0, 0x1f, 0, 0x1f, 0, 0},
+	'*':  {0, 0x04, 0x15, 0x0e, 0x15, 0x04, 0},
+	'/':  {0, 0x01, 0x02, 0x04, 0x08, 0x10, 0},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'&':  {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d},
+	'#':  {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	'@':  {0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e},
+	'%':  {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'$':  {0x04, 0x0f, 0x14, 0x0e, 0x05, 0x1e, 0x04},
+	'_':  {0, 0, 0, 0, 0, 0, 0x1f},
+}
+
+// glyphText upper-cases s and swaps typographic punctuation for what the
+// font has
+var glyphText = strings.NewReplacer("‘", "'", "’", "'", "“", `"`, "”", `"`,
+	"–", "-", "—", "-", "…", "...")
+
+// wrapText breaks s into at most max lines of width characters, ending the
+// last with ... and reporting it cut when s doesn't fit
+func wrapText(s string, width, max int) ([]string, bool) {
+	var words []string
+	for _, w := range strings.Fields(strings.ToUpper(glyphText.Replace(s))) {
+		// break words longer than a line
+		r := []rune(w)
+		for ; len(r) > width; r = r[width:] {
+			words = append(words, string(r[:width]))
+		}
+		words = append(words, string(r))
+	}
+	var lines []string
+	line := ""
+	for _, w := range words {
+		switch {
+		case line == "":
+			line = w
+		case len([]rune(line))+1+len([]rune(w)) <= width:
+			line += " " + w
+		default:
+			lines, line = append(lines, line), w
+		}
+		if len(lines) == max {
+			last := []rune(lines[max-1])
+			if len(last) > width-3 {
+				last = last[:width-3]
+			}
+			lines[max-1] = string(last) + "..."
+			return lines, true
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines, false
+}
+
+// drawText draws s at x, y with each font pixel scale pixels square; runes
+// the font lacks are drawn as ?
+func drawText(img draw.Image, s string, x, y, scale int, c color.Color) {
+	fill := image.NewUniform(c)
+	for _, r := range s {
+		g, ok := glyphs[r]
+		if !ok {
+			g = glyphs['?']
+		}
+		for row := 0; row < glyphHeight; row++ {
+			for col := 0; col < glyphWidth; col++ {
+				if g[row]&(0x10>>col) != 0 {
+					px := image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale)
+					draw.Draw(img, px, fill, image.Point{}, draw.Over)
+				}
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
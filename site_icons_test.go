@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSiteIcons(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "site-icons-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Field Notes', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'Hello world', 'hello', 'a', 'text/markdown', 'published', 1, 1)`)
+	mux := setupRoutes()
+
+	generate := func() map[string]interface{} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/site-assets/generate?site_id=s1", nil))
+		if rr.Code != 201 {
+			t.Fatalf("generate: %d %s", rr.Code, rr.Body.String())
+		}
+		var out map[string]interface{}
+		json.NewDecoder(rr.Body).Decode(&out)
+		return out
+	}
+	if out := generate(); out["source"] != "initial" {
+		t.Fatalf("without a logo icons are drawn from the initial: %v", out)
+	}
+
+	// a red 300x100 logo
+	logo := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for i := range logo.Pix {
+		logo.Pix[i] = []uint8{0xff, 0, 0, 0xff}[i%4]
+	}
+	var logoPNG, body bytes.Buffer
+	png.Encode(&logoPNG, logo)
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("site_id", "s1")
+	mw.WriteField("kind", "logo")
+	fw, _ := mw.CreateFormFile("file", "logo.png")
+	fw.Write(logoPNG.Bytes())
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/site-assets", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != 201 {
+		t.Fatalf("logo upload: %d %s", rr.Code, rr.Body.String())
+	}
+	if out := generate(); out["source"] != "logo.png" {
+		t.Fatalf("icons should be drawn from the logo: %v", out)
+	}
+
+	sizes := map[string]string{}
+	assets, err := siteAssets("s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range assets {
+		sizes[a.Name] = a.Sizes
+	}
+	for name, want := range map[string]string{"favicon.ico": "16x16 32x32", "icon-180.png": "180x180", "icon-192.png": "192x192", "icon-512.png": "512x512"} {
+		if sizes[name] != want {
+			t.Fatalf("%s should be %q, got %q (%v)", name, want, sizes[name], sizes)
+		}
+	}
+	f, _ := os.Open(siteAssetPath("s1", "icon-192.png"))
+	icon, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.RGBAModel.Convert(icon.At(96, 96)).(color.RGBA); c.R != 0xff || c.G != 0 || c.A != 0xff {
+		t.Fatalf("the icon's centre should be the logo's red, got %v", c)
+	}
+	if c := color.RGBAModel.Convert(icon.At(96, 2)).(color.RGBA); c.A != 0 {
+		t.Fatalf("the icon should be transparent around the logo, got %v", c)
+	}
+
+	out := filepath.Join(tmp, "dist")
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", Theme: "default", BaseURL: "https://notes.example"}, out); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(out, "a.html"))
+	for _, want := range []string{
+		`<link rel="icon" href="site-assets/favicon.ico" type="image/x-icon">`,
+		`<link rel="apple-touch-icon" href="site-assets/icon-180.png">`,
+		`<link rel="icon" href="site-assets/icon-512.png" type="image/png" sizes="512x512">`,
+		`<meta property="og:title" content="Hello world">`,
+		`<meta property="og:url" content="https://notes.example/a.html">`,
+		`<meta property="og:image" content="https://notes.example/og/a.png">`,
+	} {
+		if !strings.Contains(string(page), want) {
+			t.Fatalf("page is missing %s:\n%s", want, page)
+		}
+	}
+	index, _ := ioutil.ReadFile(filepath.Join(out, "index.html"))
+	if !strings.Contains(string(index), `<meta property="og:image" content="https://notes.example/site-assets/og-image.png">`) {
+		t.Fatalf("the index should use the site's social image:\n%s", index)
+	}
+	f, _ = os.Open(filepath.Join(out, "og", "a.png"))
+	cfg, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil || cfg.Width != ogWidth || cfg.Height != ogHeight {
+		t.Fatalf("og/a.png should be a %dx%d PNG: %+v %v", ogWidth, ogHeight, cfg, err)
+	}
+	var manifest struct {
+		Icons []map[string]string `json:"icons"`
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(out, "manifest.json"))
+	json.Unmarshal(data, &manifest)
+	if len(manifest.Icons) != 3 || manifest.Icons[2]["src"] != "site-assets/icon-512.png" || manifest.Icons[2]["sizes"] != "512x512" {
+		t.Fatalf("manifest should list the PNG icons: %s", data)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/preview/s1/a", nil))
+	for _, want := range []string{`<link rel="apple-touch-icon" href="/site-assets/s1/icon-180.png">`, `<meta property="og:image" content="http://example.com/preview/s1/a/og.png">`} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Fatalf("preview is missing %s:\n%s", want, rr.Body.String())
+		}
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/preview/s1/a/og.png", nil))
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("preview social image: %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	lines, cut := wrapText("The quick brown fox jumps over the lazy dog", 10, 3)
+	if !cut || len(lines) != 3 || lines[0] != "THE QUICK" || lines[2] != "JUMPS O..." {
+		t.Fatalf("unexpected wrap: %q %v", lines, cut)
+	}
+	if lines, cut := wrapText("Supercalifragilistic", 8, 4); cut || len(lines) != 3 || lines[2] != "STIC" {
+		t.Fatalf("long words should be broken: %q %v", lines, cut)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Site Snapshots ===
+// A snapshot saves the state of every live node of a site under a name,
+// e.g. before a redesign. Restoring it rolls the whole site back in one
+// transaction: nodes that changed get their saved title, content, metadata,
+// path and status back as a new version, nodes deleted since come out of
+// the trash (or are recreated once purged) and nodes added since go to the
+// trash. The state just before a restore is saved as a snapshot too, so a
+// restore can itself be undone.
+
+// Snapshot is a named state of a site
+type Snapshot struct {
+	ID          string    `json:"id"`
+	SiteID      string    `json:"site_id" validate:"required,max=128"`
+	Name        string    `json:"name" validate:"max=255"`
+	Description string    `json:"description,omitempty" validate:"max=2000"`
+	NodeCount   int       `json:"node_count"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// SnapshotNode is a node as a snapshot saved it
+type SnapshotNode struct {
+	NodeID    string `json:"node_id"`
+	VersionID string `json:"version_id,omitempty"`
+	Type      string `json:"type"`
+	ParentID  string `json:"parent_id,omitempty"`
+	Path      string `json:"path"`
+	Title     string `json:"title"`
+	Content   string `json:"-"`
+	Slug      string `json:"slug,omitempty"`
+	Metadata  string `json:"-"`
+	MimeType  string `json:"-"`
+	Status    string `json:"status"`
+}
+
+// SnapshotRestore is what restoring a snapshot changed
+type SnapshotRestore struct {
+	SnapshotID string `json:"snapshot_id"`
+	// UndoSnapshotID saved the site as it was before the restore
+	UndoSnapshotID string   `json:"undo_snapshot_id"`
+	Restored       []string `json:"restored"`  // nodes set back to their saved state
+	Recreated      []string `json:"recreated"` // saved nodes that had been purged
+	Trashed        []string `json:"trashed"`   // nodes added since the snapshot
+}
+
+// takeSnapshot saves the live nodes of s.SiteID and fills in s.ID,
+// s.NodeCount and s.CreatedAt
+func takeSnapshot(x execer, s *Snapshot) error {
+	s.ID = ids.New("snap")
+	s.CreatedAt = time.Unix(time.Now().Unix(), 0)
+	res, err := x.Exec(`INSERT INTO site_snapshot_nodes (snapshot_id, node_id, version_id, type, parent_id, path, title, content, slug, metadata, mime_type, status)
+		SELECT ?, n.id, (SELECT v.id FROM versions v WHERE v.node_id = n.id ORDER BY v.is_current DESC, v.version_number DESC LIMIT 1),
+			n.type, n.parent_id, n.path, n.title, n.content, n.slug, n.metadata, n.mime_type, n.status
+		FROM nodes n WHERE n.site_id = ? AND n.deleted_at IS NULL`, s.ID, s.SiteID)
+	if err != nil {
+		return err
+	}
+	count, _ := res.RowsAffected()
+	s.NodeCount = int(count)
+	_, err = x.Exec(`INSERT INTO site_snapshots (id, site_id, name, description, node_count, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.SiteID, s.Name, s.Description, s.NodeCount, s.CreatedBy, s.CreatedAt.Unix())
+	return err
+}
+
+func loadSnapshot(id string) (*Snapshot, error) {
+	var s Snapshot
+	var created int64
+	err := db.QueryRow(`SELECT id, site_id, name, COALESCE(description, ''), node_count, COALESCE(created_by, ''), created_at FROM site_snapshots WHERE id = ?`, id).
+		Scan(&s.ID, &s.SiteID, &s.Name, &s.Description, &s.NodeCount, &s.CreatedBy, &created)
+	s.CreatedAt = time.Unix(created, 0)
+	return &s, err
+}
+
+func snapshotNodes(id string) ([]SnapshotNode, error) {
+	rows, err := db.Query(`SELECT node_id, COALESCE(version_id, ''), type, COALESCE(parent_id, ''), path, COALESCE(title, ''), COALESCE(content, ''),
+		COALESCE(slug, ''), COALESCE(metadata, ''), COALESCE(mime_type, ''), COALESCE(status, '') FROM site_snapshot_nodes WHERE snapshot_id = ? ORDER BY path, node_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	nodes := []SnapshotNode{}
+	for rows.Next() {
+		var n SnapshotNode
+		if err := rows.Scan(&n.NodeID, &n.VersionID, &n.Type, &n.ParentID, &n.Path, &n.Title, &n.Content, &n.Slug, &n.Metadata, &n.MimeType, &n.Status); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
+
+// nullString stores "" as NULL
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// restoreSnapshot rolls s's site back to it in one transaction
+func restoreSnapshot(s *Snapshot, userID string) (*SnapshotRestore, error) {
+	saved, err := snapshotNodes(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	undo := &Snapshot{SiteID: s.SiteID, Name: "Before restoring " + s.Name, CreatedBy: userID}
+	if err := takeSnapshot(tx, undo); err != nil {
+		return nil, err
+	}
+	result := &SnapshotRestore{SnapshotID: s.ID, UndoSnapshotID: undo.ID, Restored: []string{}, Recreated: []string{}, Trashed: []string{}}
+	now := time.Now().Unix()
+	keep := map[string]bool{}
+	for _, n := range saved {
+		keep[n.NodeID] = true
+		var cur SnapshotNode
+		var deleted sql.NullInt64
+		err := tx.QueryRow(`SELECT COALESCE(parent_id, ''), path, COALESCE(title, ''), COALESCE(content, ''), COALESCE(slug, ''),
+			COALESCE(metadata, ''), COALESCE(mime_type, ''), COALESCE(status, ''), deleted_at FROM nodes WHERE id = ?`, n.NodeID).
+			Scan(&cur.ParentID, &cur.Path, &cur.Title, &cur.Content, &cur.Slug, &cur.Metadata, &cur.MimeType, &cur.Status, &deleted)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.Exec(`INSERT INTO nodes (id, type, site_id, parent_id, path, title, content, slug, metadata, mime_type, status, created_at, modified_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				n.NodeID, n.Type, s.SiteID, nullString(n.ParentID), n.Path, n.Title, n.Content, nullString(n.Slug), nullString(n.Metadata), nullString(n.MimeType), n.Status, now, now); err != nil {
+				return nil, err
+			}
+			result.Recreated = append(result.Recreated, n.NodeID)
+		case err != nil:
+			return nil, err
+		default:
+			cur.NodeID, cur.VersionID, cur.Type = n.NodeID, n.VersionID, n.Type
+			if cur == n && !deleted.Valid {
+				continue
+			}
+			if _, err := tx.Exec(`UPDATE nodes SET parent_id = ?, path = ?, title = ?, content = ?, slug = ?, metadata = ?, mime_type = ?, status = ?,
+				deleted_at = NULL, modified_at = ? WHERE id = ?`,
+				nullString(n.ParentID), n.Path, n.Title, n.Content, nullString(n.Slug), nullString(n.Metadata), nullString(n.MimeType), n.Status, now, n.NodeID); err != nil {
+				return nil, err
+			}
+			result.Restored = append(result.Restored, n.NodeID)
+		}
+		var versionNumber int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, n.NodeID).Scan(&versionNumber); err != nil {
+			return nil, err
+		}
+		tx.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ?`, n.NodeID)
+		if _, err := tx.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1)`, ids.New("v"), n.NodeID, versionNumber+1, n.Content, n.Title, n.Status, now, now); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id FROM nodes WHERE site_id = ? AND deleted_at IS NULL ORDER BY id`, s.SiteID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !keep[id] {
+			result.Trashed = append(result.Trashed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range result.Trashed {
+		if _, err := tx.Exec(`UPDATE nodes SET deleted_at = ? WHERE id = ?`, now, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// links follow the restored content
+	byID := map[string]SnapshotNode{}
+	for _, n := range saved {
+		byID[n.NodeID] = n
+	}
+	var targets []string
+	for _, id := range append(append([]string{}, result.Restored...), result.Recreated...) {
+		n := byID[id]
+		if err := syncNodeReferences(id, s.SiteID, n.Content); err != nil {
+			log.Printf("references for node %s: %v", id, err)
+		}
+		publishNodeEvent(events.NodeUpdated, Node{ID: id, Type: n.Type, Path: n.Path, Title: n.Title, SiteID: s.SiteID, Status: n.Status})
+	}
+	for _, id := range result.Trashed {
+		t, err := backlinkTargets(db, id)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+		publishNodeEvent(events.NodeDeleted, Node{ID: id, SiteID: s.SiteID})
+	}
+	recountBacklinks(db, targets)
+	if len(result.Restored)+len(result.Recreated)+len(result.Trashed) > 0 {
+		queueStaticRebuilds(s.SiteID, "")
+	}
+	return result, nil
+}
+
+// /api/snapshots: GET ?site_id= lists a site's snapshots, newest first; POST
+// {site_id, name, description} takes one
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		siteID := r.URL.Query().Get("site_id")
+		if siteID == "" {
+			apierror.Write(w, http.StatusBadRequest, "site_id is required")
+			return
+		}
+		if !canCreateInSite(r, siteID) {
+			apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+			return
+		}
+		rows, err := db.Query(`SELECT id FROM site_snapshots WHERE site_id = ? ORDER BY created_at DESC, id DESC`, siteID)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		var snapshotIDs []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				apierror.Internal(w, r, err)
+				return
+			}
+			snapshotIDs = append(snapshotIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		list := []*Snapshot{}
+		for _, id := range snapshotIDs {
+			if s, err := loadSnapshot(id); err == nil {
+				list = append(list, s)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case "POST":
+		var s Snapshot
+		if err := validate.DecodeJSON(r.Body, &s); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		var exists int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sites WHERE id = ?`, s.SiteID).Scan(&exists); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if exists == 0 {
+			apierror.Write(w, http.StatusNotFound, "site not found")
+			return
+		}
+		if !canCreateInSite(r, s.SiteID) {
+			apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+			return
+		}
+		if strings.TrimSpace(s.Name) == "" {
+			s.Name = time.Now().UTC().Format("2006-01-02 15:04")
+		}
+		s.CreatedBy = currentUserID(r)
+		tx, err := db.Begin()
+		if err == nil {
+			if err = takeSnapshot(tx, &s); err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// /api/snapshots/{id}: GET returns a snapshot with the nodes it saved,
+// DELETE removes it; POST /api/snapshots/{id}/restore rolls its site back
+// to it. Restoring and deleting need the site's owner.
+func handleSnapshotDetail(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/snapshots/"), "/")
+	s, err := loadSnapshot(id)
+	if err != nil || (action != "" && action != "restore") {
+		apierror.Write(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+	if !canCreateInSite(r, s.SiteID) {
+		apierror.Write(w, http.StatusForbidden, "editor role required on this site")
+		return
+	}
+	if r.Method != "GET" && !canManageSite(r, s.SiteID) {
+		apierror.Write(w, http.StatusForbidden, "only site owners can restore or delete snapshots")
+		return
+	}
+
+	switch {
+	case action == "restore" && r.Method == "POST":
+		result, err := restoreSnapshot(s, currentUserID(r))
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(result)
+	case action == "" && r.Method == "GET":
+		nodes, err := snapshotNodes(id)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			*Snapshot
+			Nodes []SnapshotNode `json:"nodes"`
+		}{s, nodes})
+	case action == "" && r.Method == "DELETE":
+		db.Exec(`DELETE FROM site_snapshot_nodes WHERE snapshot_id = ?`, id)
+		db.Exec(`DELETE FROM site_snapshots WHERE id = ?`, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSiteSnapshots(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	str := func(q string, args ...interface{}) string {
+		var s string
+		testDB.QueryRow(q, args...).Scan(&s)
+		return s
+	}
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1), ('s2', 'Other', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'first draft', 'published', 1, 1),
+		('b', 'note', 's1', 'b.md', 'B', 'see [[A]]', 'draft', 1, 1),
+		('gone', 'note', 's1', 'gone.md', 'Gone', 'soon purged', 'draft', 1, 1),
+		('other', 'note', 's2', 'other.md', 'Other', '', 'draft', 1, 1)`)
+	testDB.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, created_at, modified_at, is_current) VALUES ('va', 'a', 1, 'first draft', 'A', 1, 1, 1)`)
+
+	if rr := do("POST", "/api/snapshots", map[string]string{"site_id": "nope"}); rr.Code != http.StatusNotFound {
+		t.Fatalf("snapshot of a missing site: %d", rr.Code)
+	}
+	rr := do("POST", "/api/snapshots", map[string]string{"site_id": "s1", "name": "Before redesign"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	var snap Snapshot
+	json.NewDecoder(rr.Body).Decode(&snap)
+	if snap.NodeCount != 3 || snap.Name != "Before redesign" {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+	var detail struct {
+		Snapshot
+		Nodes []SnapshotNode `json:"nodes"`
+	}
+	json.NewDecoder(do("GET", "/api/snapshots/"+snap.ID, nil).Body).Decode(&detail)
+	if len(detail.Nodes) != 3 || detail.Nodes[0].NodeID != "a" || detail.Nodes[0].VersionID != "va" {
+		t.Fatalf("unexpected snapshot nodes: %+v", detail.Nodes)
+	}
+
+	// the site moves on
+	testDB.Exec(`UPDATE nodes SET title = 'A, rewritten', content = 'second draft', status = 'draft' WHERE id = 'a'`)
+	testDB.Exec(`UPDATE nodes SET deleted_at = 5 WHERE id = 'b'`)
+	if _, err := purgeTrash(10); err != nil {
+		t.Fatal(err)
+	}
+	testDB.Exec(`DELETE FROM nodes WHERE id = 'gone'`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, created_at, modified_at) VALUES ('new', 'note', 's1', 'new.md', 'New', '', 6, 6)`)
+
+	rr = do("POST", "/api/snapshots/"+snap.ID+"/restore", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", rr.Code, rr.Body.String())
+	}
+	var result SnapshotRestore
+	json.NewDecoder(rr.Body).Decode(&result)
+	if len(result.Restored) != 1 || result.Restored[0] != "a" || len(result.Recreated) != 2 || len(result.Trashed) != 1 || result.Trashed[0] != "new" {
+		t.Fatalf("unexpected restore: %+v", result)
+	}
+	if str(`SELECT title || '|' || content || '|' || status FROM nodes WHERE id = 'a'`) != "A|first draft|published" {
+		t.Fatal("a should be back as it was")
+	}
+	if str(`SELECT content FROM versions WHERE node_id = 'a' AND is_current = 1`) != "first draft" || str(`SELECT MAX(version_number) FROM versions WHERE node_id = 'a'`) != "2" {
+		t.Fatal("the restore should be a new current version")
+	}
+	if str(`SELECT content FROM nodes WHERE id = 'gone' AND deleted_at IS NULL`) != "soon purged" {
+		t.Fatal("a purged node should be recreated")
+	}
+	if str(`SELECT COUNT(*) FROM node_references WHERE source_node_id = 'b' AND target_node_id = 'a'`) != "1" || str(`SELECT backlink_count FROM nodes WHERE id = 'a'`) != "1" {
+		t.Fatal("a recreated node's links should be indexed again")
+	}
+	if str(`SELECT COUNT(*) FROM nodes WHERE id = 'new' AND deleted_at IS NOT NULL`) != "1" || str(`SELECT COUNT(*) FROM nodes WHERE id = 'other' AND deleted_at IS NULL`) != "1" {
+		t.Fatal("only nodes added to the site since should go to the trash")
+	}
+
+	// the restore can be undone
+	var list []Snapshot
+	json.NewDecoder(do("GET", "/api/snapshots?site_id=s1", nil).Body).Decode(&list)
+	if len(list) != 2 || list[0].ID != result.UndoSnapshotID || list[0].Name != "Before restoring Before redesign" {
+		t.Fatalf("unexpected snapshots: %+v", list)
+	}
+	do("POST", "/api/snapshots/"+result.UndoSnapshotID+"/restore", nil)
+	if str(`SELECT title FROM nodes WHERE id = 'a'`) != "A, rewritten" || str(`SELECT COUNT(*) FROM nodes WHERE id = 'new' AND deleted_at IS NULL`) != "1" {
+		t.Fatal("restoring the undo snapshot should bring the later state back")
+	}
+
+	if rr := do("DELETE", "/api/snapshots/"+snap.ID, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/snapshots/"+snap.ID+"/restore", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("a deleted snapshot can't be restored: %d", rr.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/store"
+)
+
+// === SQLite Connections ===
+// Vault databases are opened through openDB so every connection in the pool
+// gets the same pragmas: WAL, so readers never wait for the writer and the
+// writer never waits for readers; a busy timeout, so a second writer waits
+// its turn instead of failing with "database is locked"; foreign keys on;
+// and synchronous=NORMAL, which WAL makes safe. Transactions begin
+// IMMEDIATE, taking the write lock up front, so two transactions that read
+// and then write can't deadlock on upgrading their locks. writeTx retries a
+// transaction that still finds the database busy after the timeout.
+// A postgres:// URL opens PostgreSQL instead (see pkg/store), where the
+// same retry covers serialization failures and deadlocks.
+
+// dbBusyTimeout is how long a statement waits for another writer
+const dbBusyTimeout = 5 * time.Second
+
+// dbDSN is the connection string for the database at path
+func dbDSN(path string) string {
+	params := []string{
+		"_pragma=busy_timeout(" + strconv.Itoa(int(dbBusyTimeout/time.Millisecond)) + ")",
+		"_pragma=foreign_keys(1)",
+		"_pragma=synchronous(NORMAL)",
+		"_txlock=immediate",
+	}
+	if path != ":memory:" && !strings.Contains(path, "mode=memory") {
+		params = append(params, "_pragma=journal_mode(WAL)")
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + strings.Join(params, "&")
+}
+
+// openDB opens the SQLite database at path with veil's pragmas, or the
+// PostgreSQL database when path is a postgres:// URL
+func openDB(path string) (*sql.DB, error) {
+	if store.IsPostgresURL(path) {
+		return store.OpenPostgres(path)
+	}
+	return sql.Open("sqlite", dbDSN(path))
+}
+
+// isBusy reports whether err is SQLite refusing a lock another connection
+// holds, or PostgreSQL giving up on a transaction that collided with another
+func isBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code := store.SQLState(err); code != "" {
+		return code == "40001" || code == "40P01"
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "database table is locked")
+}
+
+// isForeignKey reports whether err is a write refused by a foreign key
+func isForeignKey(err error) bool {
+	if code := store.SQLState(err); code != "" {
+		return code == "23503"
+	}
+	return err != nil && strings.Contains(err.Error(), "FOREIGN KEY constraint failed")
+}
+
+// writeTx runs fn in a transaction and commits it, starting over a few
+// times while the database stays busy. fn may run more than once, so it
+// should only touch the database.
+func writeTx(fn func(tx *sql.Tx) error) error {
+	var err error
+	for attempt := 0; attempt < 4; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*attempt) * 50 * time.Millisecond)
+		}
+		err = runTx(fn)
+		if !isBusy(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func runTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
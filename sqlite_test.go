@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestOpenDBPragmas(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sqlite-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d, err := openDB(filepath.Join(tmp, "veil.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	prev := db
+	db = d
+	defer func() { db = prev }()
+
+	var mode string
+	var fk, timeout int
+	d.QueryRow(`PRAGMA journal_mode`).Scan(&mode)
+	d.QueryRow(`PRAGMA foreign_keys`).Scan(&fk)
+	d.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout)
+	if mode != "wal" || fk != 1 || timeout != 5000 {
+		t.Fatalf("unexpected pragmas: journal_mode=%s foreign_keys=%d busy_timeout=%d", mode, fk, timeout)
+	}
+	if dsn := dbDSN(":memory:"); strings.Contains(dsn, "journal_mode") || !strings.HasPrefix(dsn, ":memory:?") {
+		t.Fatalf("an in-memory database has no WAL: %s", dsn)
+	}
+	if dsn := dbDSN("file:x.db?cache=shared"); !strings.Contains(dsn, "cache=shared&_pragma=") {
+		t.Fatalf("existing parameters should be kept: %s", dsn)
+	}
+
+	if _, err := d.Exec(`CREATE TABLE parents (id TEXT PRIMARY KEY);
+		CREATE TABLE counters (id TEXT PRIMARY KEY, parent_id TEXT REFERENCES parents(id), n INTEGER NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Exec(`INSERT INTO counters (id, parent_id, n) VALUES ('c', 'missing', 0)`); !isForeignKey(err) {
+		t.Fatalf("a dangling reference should be refused: %v", err)
+	}
+	d.Exec(`INSERT INTO counters (id, n) VALUES ('c', 0)`)
+
+	// read-modify-write from many goroutines at once, each on its own connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 80)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				errs <- writeTx(func(tx *sql.Tx) error {
+					var n int
+					if err := tx.QueryRow(`SELECT n FROM counters WHERE id = 'c'`).Scan(&n); err != nil {
+						return err
+					}
+					_, err := tx.Exec(`UPDATE counters SET n = ? WHERE id = 'c'`, n+1)
+					return err
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent writes should wait their turn: %v", err)
+		}
+	}
+	var n int
+	d.QueryRow(`SELECT n FROM counters WHERE id = 'c'`).Scan(&n)
+	if n != 80 {
+		t.Fatalf("every increment should land, got %d", n)
+	}
+
+	// a failing transaction leaves nothing behind
+	err = writeTx(func(tx *sql.Tx) error {
+		tx.Exec(`UPDATE counters SET n = 0`)
+		return errors.New("changed my mind")
+	})
+	if d.QueryRow(`SELECT n FROM counters WHERE id = 'c'`).Scan(&n); err == nil || n != 80 {
+		t.Fatalf("a failed transaction should roll back: %v, n=%d", err, n)
+	}
+	if !isBusy(fmt.Errorf("saving: %w", errors.New("database is locked (5) (SQLITE_BUSY)"))) || isBusy(errors.New("no such table")) {
+		t.Fatal("isBusy should only match lock errors")
+	}
+	if !isBusy(&pq.Error{Code: "40001"}) || !isForeignKey(fmt.Errorf("saving: %w", &pq.Error{Code: "23503"})) ||
+		isForeignKey(&pq.Error{Code: "23505"}) {
+		t.Fatal("PostgreSQL errors should be told apart by SQLSTATE")
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"veil/pkg/apierror"
+	plugins "veil/pkg/plugins"
+)
+
+// === Incremental Static Builds ===
+// A static publishing channel with an output_dir keeps a built copy of its
+// site there. A build plans the site's files (see planSite) and writes only
+// those whose key differs from the one in build_outputs, or that are gone
+// from disk, so publishing one node rewrites its page, the index, its tag
+// pages and the feeds rather than every page. Files no longer produced, like
+// the page of a deleted node, are removed. Changes to the theme or the
+// navigation still rebuild every page, since every page shows them.
+
+func init() {
+	plugins.BuildStaticSite = buildForPublish
+}
+
+// BuildReport says what a build changed
+type BuildReport struct {
+	SiteID    string   `json:"site_id"`
+	OutputDir string   `json:"output_dir"`
+	Written   []string `json:"written"`
+	Removed   []string `json:"removed"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// BuildSite brings dir up to date with the site. full rewrites every file.
+func BuildSite(opts ExportOptions, dir string, full bool) (*BuildReport, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := planSite(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	built := map[string]string{}
+	rows, err := db.Query(`SELECT path, build_key FROM build_outputs WHERE output_dir = ?`, dir)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var path, key string
+		if err := rows.Scan(&path, &key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		built[path] = key
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &BuildReport{SiteID: opts.SiteID, OutputDir: dir, Written: []string{}, Removed: []string{}}
+	out := dirOutput(dir)
+	now := time.Now().Unix()
+	for _, f := range files {
+		key, seen := built[f.Path]
+		delete(built, f.Path)
+		if seen && key == f.Key && !full {
+			if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.Path))); err == nil {
+				report.Unchanged++
+				continue
+			}
+		}
+		data, err := f.render()
+		if err != nil {
+			return report, err
+		}
+		if err := out.WriteFile(f.Path, data); err != nil {
+			return report, err
+		}
+		db.Exec(`INSERT INTO build_outputs (output_dir, path, site_id, build_key, built_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(output_dir, path) DO UPDATE SET site_id = excluded.site_id, build_key = excluded.build_key, built_at = excluded.built_at`,
+			dir, f.Path, opts.SiteID, f.Key, now)
+		db.Exec(`DELETE FROM build_output_nodes WHERE output_dir = ? AND path = ?`, dir, f.Path)
+		for _, nodeID := range f.Deps {
+			db.Exec(`INSERT INTO build_output_nodes (output_dir, path, node_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`, dir, f.Path, nodeID)
+		}
+		report.Written = append(report.Written, f.Path)
+	}
+
+	// what is left was built before but is no longer part of the site
+	for path := range built {
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(path))); err != nil && !os.IsNotExist(err) {
+			return report, err
+		}
+		db.Exec(`DELETE FROM build_outputs WHERE output_dir = ? AND path = ?`, dir, path)
+		db.Exec(`DELETE FROM build_output_nodes WHERE output_dir = ? AND path = ?`, dir, path)
+		report.Removed = append(report.Removed, path)
+	}
+	sort.Strings(report.Removed)
+	return report, nil
+}
+
+// buildForPublish runs a static channel's build for a publish job
+func buildForPublish(ctx context.Context, nodeID string, config map[string]interface{}) (interface{}, error) {
+	opts := ExportOptions{IncludeAssets: true, Theme: "default", Format: "html"}
+	opts.SiteID, _ = config["site_id"].(string)
+	if opts.SiteID == "" {
+		opts.SiteID, _, _ = nodeAccess(nodeID)
+	}
+	if opts.SiteID == "" {
+		return nil, plugins.Permanent(fmt.Errorf("node %s belongs to no site, set site_id on the channel", nodeID))
+	}
+	if theme, _ := config["theme"].(string); theme != "" {
+		opts.Theme = theme
+	}
+	opts.BaseURL, _ = config["base_url"].(string)
+	if format, _ := config["format"].(string); isContentTreeFormat(format) {
+		opts.Format = format
+	}
+	report, err := BuildSite(opts, config["output_dir"].(string), false)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// queueStaticRebuilds queues a publish job on every active channel that
+// builds or deploys siteID, after nodeID was published ("" when a build hook
+// asked for the rebuild), and returns the jobs queued
+func queueStaticRebuilds(siteID, nodeID string) []plugins.PublishJob {
+	rows, err := db.Query(`SELECT id, type, COALESCE(config, '') FROM publishing_channels
+		WHERE type IN ('static', 's3', 'sftp', 'rsync') AND active = 1`)
+	if err != nil {
+		return nil
+	}
+	var channels []string
+	for rows.Next() {
+		var id, channelType, configJSON string
+		if err := rows.Scan(&id, &channelType, &configJSON); err != nil {
+			log.Printf("static rebuild of %s: %v", siteID, err)
+			continue
+		}
+		var config map[string]interface{}
+		json.Unmarshal([]byte(configJSON), &config)
+		if dir, _ := config["output_dir"].(string); dir == "" && channelType == "static" {
+			continue
+		}
+		if config["site_id"] == siteID {
+			channels = append(channels, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("static rebuild of %s: %v", siteID, err)
+	}
+	jobs := []plugins.PublishJob{}
+	for _, id := range channels {
+		job, err := plugins.QueuePublishJob(plugins.PublishJob{NodeID: nodeID, ChannelID: id})
+		if err != nil {
+			log.Printf("static rebuild of %s on channel %s: %v", siteID, id, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// BuildOutput is a built file and when it was last written
+type BuildOutput struct {
+	OutputDir string `json:"output_dir"`
+	Path      string `json:"path"`
+	SiteID    string `json:"site_id"`
+	BuiltAt   int64  `json:"built_at"`
+}
+
+// GET /api/build-outputs?node_id=[&output_dir=] lists the built files a node
+// appears in
+func handleBuildOutputs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	nodeID := r.URL.Query().Get("node_id")
+	if !canReadNode(r, nodeID) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return
+	}
+	query := `SELECT o.output_dir, o.path, o.site_id, o.built_at FROM build_output_nodes d
+		JOIN build_outputs o ON o.output_dir = d.output_dir AND o.path = d.path WHERE d.node_id = ?`
+	args := []interface{}{nodeID}
+	if dir := r.URL.Query().Get("output_dir"); dir != "" {
+		abs, _ := filepath.Abs(dir)
+		query += ` AND o.output_dir = ?`
+		args = append(args, abs)
+	}
+	rows, err := db.Query(query+` ORDER BY o.output_dir, o.path`, args...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	defer rows.Close()
+	outputs := []BuildOutput{}
+	for rows.Next() {
+		var o BuildOutput
+		if err := rows.Scan(&o.OutputDir, &o.Path, &o.SiteID, &o.BuiltAt); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		outputs = append(outputs, o)
+	}
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(outputs)
+}
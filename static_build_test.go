@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	plugins "veil/pkg/plugins"
+)
+
+func TestIncrementalBuild(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "static-build-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'first', 'a', 'text/markdown', 'published', 1, 1),
+		('b', 'post', 's1', 'b.md', 'B', 'second', 'b', 'text/markdown', 'published', 2, 2),
+		('c', 'post', 's1', 'c.md', 'C', 'third', 'c', 'text/markdown', 'draft', 3, 3)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'Go Notes')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1')`)
+
+	opts := ExportOptions{SiteID: "s1", IncludeAssets: true, Theme: "default"}
+	report, err := BuildSite(opts, "dist", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unchanged != 0 || !contains(report.Written, "a.html") || !contains(report.Written, "tag-go-notes.html") {
+		t.Fatalf("first build should write everything: %+v", report)
+	}
+
+	report, _ = BuildSite(opts, "dist", false)
+	if len(report.Written) != 0 || len(report.Removed) != 0 {
+		t.Fatalf("nothing changed, yet the build wrote %v and removed %v", report.Written, report.Removed)
+	}
+
+	// editing a keeps b's page, which only shares the navigation with it
+	testDB.Exec(`UPDATE nodes SET content = 'first, edited', modified_at = 10 WHERE id = 'a'`)
+	report, _ = BuildSite(opts, "dist", false)
+	written := append([]string{}, report.Written...)
+	sort.Strings(written)
+	if want := []string{"a.html", "api.json", "feed.xml", "index.html", "tag-go-notes.html"}; !reflect.DeepEqual(written, want) {
+		t.Fatalf("expected %v rewritten, got %v", want, written)
+	}
+	if page, _ := ioutil.ReadFile(filepath.Join("dist", "a.html")); !strings.Contains(string(page), "first, edited") {
+		t.Fatalf("a.html was not rebuilt: %s", page)
+	}
+
+	// a file deleted from disk is written again
+	os.Remove(filepath.Join("dist", "b.html"))
+	if report, _ = BuildSite(opts, "dist", false); !reflect.DeepEqual(report.Written, []string{"b.html"}) {
+		t.Fatalf("expected only the missing b.html, got %v", report.Written)
+	}
+
+	// unpublishing b removes its page
+	testDB.Exec(`UPDATE nodes SET status = 'draft' WHERE id = 'b'`)
+	report, _ = BuildSite(opts, "dist", false)
+	if !reflect.DeepEqual(report.Removed, []string{"b.html", "og/b.png"}) {
+		t.Fatalf("expected b.html and its social image removed, got %v", report.Removed)
+	}
+	if _, err := os.Stat(filepath.Join("dist", "b.html")); !os.IsNotExist(err) {
+		t.Fatalf("b.html should be gone from disk")
+	}
+
+	rr := httptest.NewRecorder()
+	setupRoutes().ServeHTTP(rr, httptest.NewRequest("GET", "/api/build-outputs?node_id=a", nil))
+	var outputs []BuildOutput
+	json.NewDecoder(rr.Body).Decode(&outputs)
+	var paths []string
+	for _, o := range outputs {
+		paths = append(paths, o.Path)
+	}
+	if want := []string{"a.html", "api.json", "feed.xml", "index.html", "og/a.png", "tag-go-notes.html"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("expected a's outputs %v, got %v", want, paths)
+	}
+}
+
+func TestPublishQueuesStaticRebuild(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	// jobs run in the background; keep them on the one in-memory connection
+	testDB.SetMaxOpenConns(1)
+	plugins.SetDB(testDB)
+	tmp, err := ioutil.TempDir("", "static-publish-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, mime_type, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'hello', 'a', 'text/markdown', 'draft', 1, 1)`)
+	testDB.Exec(`INSERT INTO publishing_channels (id, name, type, config, active, created_at) VALUES
+		('ch1', 'Site', 'static', '{"output_dir": "public", "site_id": "s1"}', 1, 1),
+		('ch2', 'Other site', 'static', '{"output_dir": "other", "site_id": "s2"}', 1, 1)`)
+
+	queue := plugins.StartJobQueue(plugins.JobQueueConfig{Workers: 1, PollInterval: 5 * time.Millisecond, BaseBackoff: time.Millisecond})
+	defer queue.Stop()
+
+	rr := httptest.NewRecorder()
+	setupRoutes().ServeHTTP(rr, httptest.NewRequest("POST", "/api/sites/s1/nodes/a/publish", nil))
+	if rr.Code != 200 {
+		t.Fatalf("publish: %d %s", rr.Code, rr.Body.String())
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join("public", "a.html")); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := os.Stat(filepath.Join("public", "a.html")); err != nil {
+		t.Fatalf("publishing should build the static channel's site: %v", err)
+	}
+	if _, err := os.Stat("other"); !os.IsNotExist(err) {
+		t.Fatalf("channels of other sites should not build")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
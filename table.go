@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Table Nodes ===
+// A "table" node holds a dataset: its content is CSV, or TSV when its
+// mime_type is text/tab-separated-values, with the column names in the
+// first row. Its metadata's "schema" types the columns by name, e.g.
+// {"schema": {"year": "number", "measured": "date"}}; columns it leaves out
+// are text. Cells must parse as their column's type or be empty.
+//
+// Pages render tables as HTML that /table-sort.js sorts by column.
+// /api/table returns the data, as CSV, TSV or JSON records on request, and
+// /api/table/rows and /api/table/columns edit it a row or a column at a
+// time, each edit saving a new version like any other.
+
+// tsvMimeType marks a table stored as tab separated values
+const tsvMimeType = "text/tab-separated-values"
+
+// tableColumnTypes are the types a table schema can give a column
+var tableColumnTypes = []string{"text", "number", "date", "bool"}
+
+// TableColumn is a column of a table
+type TableColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Table is a parsed table node. Every row has a cell per column.
+type Table struct {
+	Columns []TableColumn `json:"columns"`
+	Rows    [][]string    `json:"rows"`
+	tsv     bool
+}
+
+// parseTable reads a table from a node's content, mime type and metadata
+func parseTable(content, mimeType, metadata string) (*Table, error) {
+	t := &Table{Columns: []TableColumn{}, Rows: [][]string{}, tsv: mimeType == tsvMimeType}
+	var meta struct {
+		Schema map[string]string `json:"schema"`
+	}
+	if metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+			return nil, errors.New("metadata schema must map column names to types")
+		}
+	}
+	for name, typ := range meta.Schema {
+		if !slices.Contains(tableColumnTypes, typ) {
+			return nil, fmt.Errorf("column %q: type must be one of %s", name, strings.Join(tableColumnTypes, ", "))
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(content))
+	if t.tsv {
+		r.Comma = '\t'
+		r.LazyQuotes = true
+	}
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return t, nil
+	}
+	for _, name := range records[0] {
+		name = strings.TrimSpace(name)
+		if err := t.checkNewName(name); err != nil {
+			return nil, err
+		}
+		typ := meta.Schema[name]
+		if typ == "" {
+			typ = "text"
+		}
+		t.Columns = append(t.Columns, TableColumn{Name: name, Type: typ})
+	}
+	for i, row := range records[1:] {
+		if err := t.checkRow(row); err != nil {
+			return nil, fmt.Errorf("row %d: %v", i, err)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, nil
+}
+
+// checkCell reports whether v is a value of a column of type typ
+func checkCell(typ, v string) error {
+	if v == "" {
+		return nil
+	}
+	var err error
+	switch typ {
+	case "number":
+		_, err = strconv.ParseFloat(v, 64)
+	case "date":
+		if _, err = time.Parse("2006-01-02", v); err != nil {
+			_, err = time.Parse(time.RFC3339, v)
+		}
+	case "bool":
+		_, err = strconv.ParseBool(v)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a %s", v, typ)
+	}
+	return nil
+}
+
+// checkRow reports whether row fits the table's columns
+func (t *Table) checkRow(row []string) error {
+	if len(row) != len(t.Columns) {
+		return fmt.Errorf("has %d cells for %d columns", len(row), len(t.Columns))
+	}
+	for i, c := range t.Columns {
+		if err := checkCell(c.Type, row[i]); err != nil {
+			return fmt.Errorf("column %q: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkNewName reports whether a column can be called name
+func (t *Table) checkNewName(name string) error {
+	if name == "" {
+		return errors.New("column names can't be empty")
+	}
+	if t.column(name) >= 0 {
+		return fmt.Errorf("column %q appears twice", name)
+	}
+	return nil
+}
+
+// column is the index of the named column, or -1
+func (t *Table) column(name string) int {
+	for i, c := range t.Columns {
+		if c.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// encode writes the table back as node content
+func (t *Table) encode() string {
+	return t.delimited(t.tsv)
+}
+
+// delimited is the table as CSV, or TSV when tsv is set, header first
+func (t *Table) delimited(tsv bool) string {
+	if len(t.Columns) == 0 {
+		return ""
+	}
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if tsv {
+		w.Comma = '\t'
+	}
+	header := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		header[i] = c.Name
+	}
+	w.Write(header)
+	w.WriteAll(t.Rows)
+	return b.String()
+}
+
+// schemaMetadata is metadata with its "schema" set to the table's column
+// types; text columns are left out
+func (t *Table) schemaMetadata(metadata string) string {
+	meta := map[string]interface{}{}
+	if metadata != "" {
+		json.Unmarshal([]byte(metadata), &meta)
+	}
+	schema := map[string]string{}
+	for _, c := range t.Columns {
+		if c.Type != "text" {
+			schema[c.Name] = c.Type
+		}
+	}
+	delete(meta, "schema")
+	if len(schema) > 0 {
+		meta["schema"] = schema
+	}
+	if len(meta) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(meta)
+	return string(b)
+}
+
+// records is the table as JSON objects, one per row, with numbers and
+// booleans typed and empty cells null
+func (t *Table) records() []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(t.Rows))
+	for _, row := range t.Rows {
+		rec := make(map[string]interface{}, len(t.Columns))
+		for i, c := range t.Columns {
+			var v interface{} = row[i]
+			switch {
+			case row[i] == "":
+				v = nil
+			case c.Type == "number":
+				v = json.Number(row[i])
+			case c.Type == "bool":
+				v, _ = strconv.ParseBool(row[i])
+			}
+			rec[c.Name] = v
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+// cellString is a JSON value as a cell
+func cellString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("cells must be strings, numbers, booleans or null")
+}
+
+// row turns a JSON row into cells: an array gives every cell in order, an
+// object the cells of the columns it names, the rest coming from base
+func (t *Table) row(v interface{}, base []string) ([]string, error) {
+	row := make([]string, len(t.Columns))
+	copy(row, base)
+	switch v := v.(type) {
+	case []interface{}:
+		if len(v) != len(t.Columns) {
+			return nil, fmt.Errorf("has %d cells for %d columns", len(v), len(t.Columns))
+		}
+		for i, cell := range v {
+			s, err := cellString(cell)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = s
+		}
+	case map[string]interface{}:
+		for name, cell := range v {
+			i := t.column(name)
+			if i < 0 {
+				return nil, fmt.Errorf("no column %q", name)
+			}
+			s, err := cellString(cell)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = s
+		}
+	default:
+		return nil, errors.New("rows must be arrays or objects")
+	}
+	return row, t.checkRow(row)
+}
+
+// tableHTML renders a table for a page, sortable by /table-sort.js
+func tableHTML(t *Table) string {
+	var b strings.Builder
+	b.WriteString("<table class=\"data-table\" data-sortable>\n<thead><tr>")
+	for _, c := range t.Columns {
+		fmt.Fprintf(&b, `<th scope="col" data-type="%s">%s</th>`, c.Type, html.EscapeString(c.Name))
+	}
+	b.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range t.Rows {
+		b.WriteString("<tr>")
+		for i, cell := range row {
+			if t.Columns[i].Type == "number" {
+				fmt.Fprintf(&b, `<td class="num">%s</td>`, html.EscapeString(cell))
+			} else {
+				fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(cell))
+			}
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>")
+	return b.String()
+}
+
+// tableMarkdown renders a table as a GitHub-flavored Markdown table
+func tableMarkdown(t *Table) string {
+	if len(t.Columns) == 0 {
+		return ""
+	}
+	cell := strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+	var b strings.Builder
+	line := func(cells []string) {
+		b.WriteString("|")
+		for _, c := range cells {
+			b.WriteString(" " + cell.Replace(c) + " |")
+		}
+		b.WriteString("\n")
+	}
+	header := make([]string, len(t.Columns))
+	rule := make([]string, len(t.Columns))
+	for i, c := range t.Columns {
+		header[i], rule[i] = c.Name, "---"
+		if c.Type == "number" {
+			rule[i] = "---:"
+		}
+	}
+	line(header)
+	line(rule)
+	for _, row := range t.Rows {
+		line(row)
+	}
+	return b.String()
+}
+
+// tableBody renders a table node's page body
+func tableBody(node Node) string {
+	t, err := parseTable(node.Content, node.MimeType, node.Metadata)
+	if err != nil {
+		return "<pre>" + html.EscapeString(node.Content) + "</pre>"
+	}
+	return tableHTML(t) + "\n<script src=\"/table-sort.js\"></script>"
+}
+
+// checkTable rejects a table node whose content doesn't fit its schema
+func checkTable(w http.ResponseWriter, node Node) bool {
+	if _, err := parseTable(node.Content, node.MimeType, node.Metadata); err != nil {
+		validate.WriteError(w, validate.Errors{{Field: "content", Message: "is not a valid table: " + err.Error()}})
+		return false
+	}
+	return true
+}
+
+// tableNode is a table node loaded for the table API
+type tableNode struct {
+	Node
+	table *Table
+}
+
+// loadTableNode loads the table named by ?node_id=, checking the caller can
+// read it, or change it when write is set. It answers the request itself when
+// it can't.
+func loadTableNode(w http.ResponseWriter, r *http.Request, write bool) (*tableNode, bool) {
+	nodeID := r.URL.Query().Get("node_id")
+	var n tableNode
+	err := db.QueryRow(`SELECT id, type, COALESCE(title, ''), COALESCE(content, ''), COALESCE(mime_type, ''), COALESCE(metadata, ''), COALESCE(site_id, '')
+		FROM nodes WHERE id = ? AND deleted_at IS NULL`, nodeID).
+		Scan(&n.ID, &n.Type, &n.Title, &n.Content, &n.MimeType, &n.Metadata, &n.SiteID)
+	if err != nil || !canReadNode(r, nodeID) {
+		apierror.Write(w, http.StatusNotFound, "node not found")
+		return nil, false
+	}
+	if n.Type != NodeTypeTable {
+		apierror.Write(w, http.StatusBadRequest, "node is not a table")
+		return nil, false
+	}
+	if write && !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's owner can edit it")
+		return nil, false
+	}
+	if n.table, err = parseTable(n.Content, n.MimeType, n.Metadata); err != nil {
+		apierror.Write(w, http.StatusUnprocessableEntity, "stored table is invalid: "+err.Error())
+		return nil, false
+	}
+	return &n, true
+}
+
+// save stores the edited table as the node's content and schema, with a new
+// version, and answers with the table
+func (n *tableNode) save(w http.ResponseWriter, r *http.Request) {
+	n.Content = n.table.encode()
+	n.Metadata = n.table.schemaMetadata(n.Metadata)
+	if !checkNodeSize(w, n.Node) {
+		return
+	}
+	now := time.Now().Unix()
+	var metadata interface{}
+	if n.Metadata != "" {
+		metadata = n.Metadata
+	}
+	if _, err := db.Exec(`UPDATE nodes SET content = ?, metadata = ?, modified_at = ? WHERE id = ?`, n.Content, metadata, now, n.ID); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	var versionNumber int
+	db.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, n.ID).Scan(&versionNumber)
+	versionID := ids.New("v")
+	db.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ?`, n.ID)
+	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		versionID, n.ID, versionNumber+1, n.Content, n.Title, "draft", now, now, 1)
+	n.ModifiedAt = time.Unix(now, 0)
+	publishNodeEvent(events.NodeUpdated, n.Node)
+	json.NewEncoder(w).Encode(n.table)
+}
+
+// rowIndex reads ?index= as a row of t
+func rowIndex(r *http.Request, t *Table) (int, error) {
+	i, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil || i < 0 || i >= len(t.Rows) {
+		return 0, fmt.Errorf("index must be a row number from 0 to %d", len(t.Rows)-1)
+	}
+	return i, nil
+}
+
+// GET /api/table?node_id=[&format=csv|tsv|json] returns a table's columns and
+// rows, or downloads it as CSV, TSV or JSON records
+func handleTable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n, ok := loadTableNode(w, r, false)
+	if !ok {
+		return
+	}
+	name := slugify(n.Title)
+	if name == "" {
+		name = n.ID
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+		json.NewEncoder(w).Encode(n.table)
+	case "csv", "tsv":
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", tsvMimeType+"; charset=utf-8")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", name, format))
+		io.WriteString(w, n.table.delimited(format == "tsv"))
+	case "json":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.json", name))
+		json.NewEncoder(w).Encode(n.table.records())
+	default:
+		apierror.Write(w, http.StatusBadRequest, "format must be csv, tsv or json")
+	}
+}
+
+// /api/table/rows?node_id= edits a table's rows, numbered from 0:
+//
+//	POST {"rows": [...], "at": i}  inserts rows, each an array of every cell
+//	                               or an object by column, before row at
+//	                               (default: at the end)
+//	PUT ?index= {"row": ...}       replaces a row with an array, or changes
+//	                               the cells an object names
+//	DELETE ?index=                 removes a row
+func handleTableRows(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n, ok := loadTableNode(w, r, true)
+	if !ok {
+		return
+	}
+	t := n.table
+	switch r.Method {
+	case "POST":
+		var req struct {
+			Rows []interface{} `json:"rows"`
+			At   *int          `json:"at"`
+		}
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		at := len(t.Rows)
+		if req.At != nil {
+			at = *req.At
+		}
+		var verrs validate.Errors
+		if len(t.Columns) == 0 {
+			verrs.Add("rows", "need columns to go in; add one first")
+		}
+		if at < 0 || at > len(t.Rows) {
+			verrs.Add("at", fmt.Sprintf("must be from 0 to %d", len(t.Rows)))
+		}
+		var rows [][]string
+		for i, v := range req.Rows {
+			row, err := t.row(v, nil)
+			if err != nil {
+				verrs.Add(fmt.Sprintf("rows[%d]", i), err.Error())
+			}
+			rows = append(rows, row)
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		t.Rows = append(t.Rows[:at], append(rows, t.Rows[at:]...)...)
+	case "PUT":
+		i, err := rowIndex(r, t)
+		if err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "index", Message: err.Error()}})
+			return
+		}
+		var req struct {
+			Row interface{} `json:"row"`
+		}
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		row, err := t.row(req.Row, t.Rows[i])
+		if err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "row", Message: err.Error()}})
+			return
+		}
+		t.Rows[i] = row
+	case "DELETE":
+		i, err := rowIndex(r, t)
+		if err != nil {
+			validate.WriteError(w, validate.Errors{{Field: "index", Message: err.Error()}})
+			return
+		}
+		t.Rows = append(t.Rows[:i], t.Rows[i+1:]...)
+	}
+	n.save(w, r)
+}
+
+// /api/table/columns?node_id= edits a table's columns:
+//
+//	POST {"name", "type", "default", "at"}  adds a column before column at
+//	                                        (default: last), its cells set
+//	                                        to default
+//	PUT ?name= {"name", "type"}             renames or retypes a column; every
+//	                                        cell must fit the new type
+//	DELETE ?name=                           removes a column
+func handleTableColumns(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	n, ok := loadTableNode(w, r, true)
+	if !ok {
+		return
+	}
+	t := n.table
+	var req struct {
+		Name    string      `json:"name" validate:"max=255"`
+		Type    string      `json:"type"`
+		Default interface{} `json:"default"`
+		At      *int        `json:"at"`
+	}
+	if r.Method != "DELETE" {
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+	}
+	var verrs validate.Errors
+	if req.Type != "" && !slices.Contains(tableColumnTypes, req.Type) {
+		verrs.Add("type", "must be one of "+strings.Join(tableColumnTypes, ", "))
+	}
+	switch r.Method {
+	case "POST":
+		at := len(t.Columns)
+		if req.At != nil {
+			at = *req.At
+		}
+		if req.Type == "" {
+			req.Type = "text"
+		}
+		if err := t.checkNewName(req.Name); err != nil {
+			verrs.Add("name", err.Error())
+		}
+		if at < 0 || at > len(t.Columns) {
+			verrs.Add("at", fmt.Sprintf("must be from 0 to %d", len(t.Columns)))
+		}
+		def, err := cellString(req.Default)
+		if err == nil {
+			err = checkCell(req.Type, def)
+		}
+		if err != nil {
+			verrs.Add("default", err.Error())
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		t.Columns = append(t.Columns[:at], append([]TableColumn{{Name: req.Name, Type: req.Type}}, t.Columns[at:]...)...)
+		for i, row := range t.Rows {
+			t.Rows[i] = append(row[:at], append([]string{def}, row[at:]...)...)
+		}
+	case "PUT":
+		c := t.column(r.URL.Query().Get("name"))
+		if c < 0 {
+			apierror.Write(w, http.StatusNotFound, "no such column")
+			return
+		}
+		if req.Name != "" && req.Name != t.Columns[c].Name {
+			if err := t.checkNewName(req.Name); err != nil {
+				verrs.Add("name", err.Error())
+			}
+		}
+		if req.Type != "" && len(verrs) == 0 {
+			for i, row := range t.Rows {
+				if err := checkCell(req.Type, row[c]); err != nil {
+					verrs.Add("type", fmt.Sprintf("row %d: %v", i, err))
+					break
+				}
+			}
+		}
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		if req.Name != "" {
+			t.Columns[c].Name = req.Name
+		}
+		if req.Type != "" {
+			t.Columns[c].Type = req.Type
+		}
+	case "DELETE":
+		c := t.column(r.URL.Query().Get("name"))
+		if c < 0 {
+			apierror.Write(w, http.StatusNotFound, "no such column")
+			return
+		}
+		t.Columns = append(t.Columns[:c], t.Columns[c+1:]...)
+		for i, row := range t.Rows {
+			t.Rows[i] = append(row[:c], row[c+1:]...)
+		}
+		if len(t.Columns) == 0 {
+			t.Rows = [][]string{}
+		}
+	}
+	n.save(w, r)
+}
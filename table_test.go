@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTableNodes(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	vault, err := ioutil.TempDir("", "table-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(vault)
+	wd, _ := os.Getwd()
+	os.Chdir(vault)
+	defer os.Chdir(wd)
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	table := func(rr *httptest.ResponseRecorder) Table {
+		t.Helper()
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var tbl Table
+		json.NewDecoder(rr.Body).Decode(&tbl)
+		return tbl
+	}
+
+	if rr := do("POST", "/api/node-create", map[string]string{"type": "table", "path": "bad.csv",
+		"content": "year,count\n2023,many\n", "metadata": `{"schema":{"count":"number"}}`}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a cell that isn't its column's type should be refused: %d", rr.Code)
+	}
+	rr := do("POST", "/api/node-create", map[string]string{"type": "table", "path": "birds.csv", "title": "Bird counts",
+		"content": "species,count,seen\nwren,12,2024-03-01\n\"owl, barn\",3,2024-03-02\n", "metadata": `{"schema":{"count":"number","seen":"date"},"source":"survey"}`})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	var node Node
+	json.NewDecoder(rr.Body).Decode(&node)
+	q := "?node_id=" + node.ID
+
+	tbl := table(do("GET", "/api/table"+q, nil))
+	if len(tbl.Columns) != 3 || tbl.Columns[1] != (TableColumn{Name: "count", Type: "number"}) || len(tbl.Rows) != 2 || tbl.Rows[1][0] != "owl, barn" {
+		t.Fatalf("unexpected table: %+v", tbl)
+	}
+
+	// rows
+	tbl = table(do("POST", "/api/table/rows"+q, map[string]interface{}{"rows": []interface{}{
+		[]interface{}{"kite", 1, "2024-03-03"},
+		map[string]interface{}{"species": "robin"},
+	}, "at": 0}))
+	if len(tbl.Rows) != 4 || tbl.Rows[0][1] != "1" || tbl.Rows[1][0] != "robin" || tbl.Rows[1][1] != "" {
+		t.Fatalf("insert rows: %+v", tbl.Rows)
+	}
+	if rr := do("POST", "/api/table/rows"+q, map[string]interface{}{"rows": []interface{}{map[string]interface{}{"count": "lots"}}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a bad row should be refused: %d", rr.Code)
+	}
+	tbl = table(do("PUT", "/api/table/rows"+q+"&index=1", map[string]interface{}{"row": map[string]interface{}{"count": 7}}))
+	if tbl.Rows[1][0] != "robin" || tbl.Rows[1][1] != "7" {
+		t.Fatalf("update a row's cells: %+v", tbl.Rows[1])
+	}
+	tbl = table(do("DELETE", "/api/table/rows"+q+"&index=0", nil))
+	if len(tbl.Rows) != 3 || tbl.Rows[0][0] != "robin" {
+		t.Fatalf("delete a row: %+v", tbl.Rows)
+	}
+	if rr := do("DELETE", "/api/table/rows"+q+"&index=9", nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("deleting a missing row: %d", rr.Code)
+	}
+
+	// columns
+	tbl = table(do("POST", "/api/table/columns"+q, map[string]interface{}{"name": "ringed", "type": "bool", "default": false, "at": 1}))
+	if tbl.Columns[1].Name != "ringed" || tbl.Rows[0][1] != "false" || len(tbl.Rows[0]) != 4 {
+		t.Fatalf("add a column: %+v", tbl)
+	}
+	if rr := do("PUT", "/api/table/columns"+q+"&name=species", map[string]string{"type": "number"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("retyping a column its cells don't fit: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/table/columns"+q, map[string]string{"name": "count"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a duplicate column: %d", rr.Code)
+	}
+	table(do("PUT", "/api/table/columns"+q+"&name=species", map[string]string{"name": "bird"}))
+	tbl = table(do("DELETE", "/api/table/columns"+q+"&name=seen", nil))
+	if len(tbl.Columns) != 3 || tbl.Columns[0].Name != "bird" || len(tbl.Rows[2]) != 3 {
+		t.Fatalf("rename and delete columns: %+v", tbl)
+	}
+
+	var content, metadata string
+	var versions int
+	testDB.QueryRow(`SELECT content, metadata FROM nodes WHERE id = ?`, node.ID).Scan(&content, &metadata)
+	testDB.QueryRow(`SELECT COUNT(*) FROM versions WHERE node_id = ?`, node.ID).Scan(&versions)
+	if content != "bird,ringed,count\nrobin,false,7\nwren,false,12\n\"owl, barn\",false,3\n" {
+		t.Fatalf("unexpected stored content: %q", content)
+	}
+	if metadata != `{"schema":{"count":"number","ringed":"bool"},"source":"survey"}` {
+		t.Fatalf("the schema should follow the columns and other metadata stay: %s", metadata)
+	}
+	if versions != 7 {
+		t.Fatalf("each edit should save a version: %d", versions)
+	}
+
+	// export
+	rr = do("GET", "/api/table"+q+"&format=json", nil)
+	var records []map[string]interface{}
+	json.NewDecoder(rr.Body).Decode(&records)
+	if len(records) != 3 || records[0]["count"] != 7.0 || records[0]["ringed"] != false || records[2]["bird"] != "owl, barn" {
+		t.Fatalf("JSON export: %+v", records)
+	}
+	rr = do("GET", "/api/table"+q+"&format=tsv", nil)
+	if !strings.HasPrefix(rr.Body.String(), "bird\tringed\tcount\nrobin\tfalse\t7\n") || !strings.Contains(rr.Header().Get("Content-Disposition"), "bird-counts.tsv") {
+		t.Fatalf("TSV export: %s %q", rr.Header(), rr.Body.String())
+	}
+	if rr := do("GET", "/api/table"+q+"&format=csv", nil); rr.Body.String() != content {
+		t.Fatalf("CSV export: %q", rr.Body.String())
+	}
+
+	// the node API keeps tables valid too
+	if rr := do("PUT", "/api/node-update", map[string]string{"id": node.ID, "title": "Bird counts", "content": "bird,count\nwren,x\n"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("updating a table to content its schema rejects: %d", rr.Code)
+	}
+	note := do("POST", "/api/node-create", map[string]string{"type": "note", "path": "n.md", "content": "a,b"})
+	var n Node
+	json.NewDecoder(note.Body).Decode(&n)
+	if rr := do("GET", "/api/table?node_id="+n.ID, nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("a note is not a table: %d", rr.Code)
+	}
+
+	// pages
+	tsv, _ := parseTable("a\tb\nx, y\t2\n", tsvMimeType, `{"schema":{"b":"number"}}`)
+	if body := tableHTML(tsv); !strings.Contains(body, `<th scope="col" data-type="number">b</th>`) || !strings.Contains(body, `<td>x, y</td><td class="num">2</td>`) {
+		t.Fatalf("unexpected table HTML: %s", body)
+	}
+	if md := tableMarkdown(tsv); md != "| a | b |\n| --- | ---: |\n| x, y | 2 |\n" {
+		t.Fatalf("unexpected Markdown table: %q", md)
+	}
+
+	tmp, _ := ioutil.TempDir("", "table-export-")
+	defer os.RemoveAll(tmp)
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Field notes', '', 'blog', 1, 1)`)
+	testDB.Exec(`UPDATE nodes SET site_id = 's1', status = 'published', slug = 'birds' WHERE id = ?`, node.ID)
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1"}, tmp); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadFile(filepath.Join(tmp, "birds.html"))
+	if !strings.Contains(string(page), `<table class="data-table" data-sortable>`) || !strings.Contains(string(page), `<script src="table-sort.js">`) {
+		t.Fatalf("the page should hold a sortable table:\n%s", page)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "table-sort.js")); err != nil {
+		t.Fatal("table-sort.js should be exported with the table")
+	}
+}
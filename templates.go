@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Node Templates ===
+// A template is a reusable skeleton for new nodes: a type, a default title
+// and content, front-matter fields with their defaults and tags. A node
+// started from one (POST /api/node-create?template=<slug>, or veil new
+// --template) takes whatever the request leaves out from the template:
+// fields and tags are merged, the request's winning. {{title}}, {{date}}
+// and {{time}} in the template's title, content and field values are filled
+// in as the node is created.
+
+// NodeTemplate is a node_templates row
+type NodeTemplate struct {
+	ID          string                 `json:"id"`
+	Slug        string                 `json:"slug" validate:"required,max=128"`
+	Name        string                 `json:"name" validate:"required,max=200"`
+	Description string                 `json:"description,omitempty" validate:"max=1000"`
+	Type        string                 `json:"type" validate:"required,max=64"`
+	Title       string                 `json:"title,omitempty" validate:"max=500"`
+	Content     string                 `json:"content,omitempty"`
+	MimeType    string                 `json:"mime_type,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	CreatedAt   int64                  `json:"created_at"`
+	ModifiedAt  int64                  `json:"modified_at"`
+}
+
+var templateSlug = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+const templateColumns = `id, slug, name, COALESCE(description, ''), node_type, COALESCE(title, ''), COALESCE(content, ''),
+	COALESCE(mime_type, ''), COALESCE(fields, ''), COALESCE(tags, ''), created_at, modified_at`
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (*NodeTemplate, error) {
+	var t NodeTemplate
+	var fields, tags string
+	if err := row.Scan(&t.ID, &t.Slug, &t.Name, &t.Description, &t.Type, &t.Title, &t.Content, &t.MimeType, &fields, &tags, &t.CreatedAt, &t.ModifiedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(fields), &t.Fields)
+	json.Unmarshal([]byte(tags), &t.Tags)
+	return &t, nil
+}
+
+// loadTemplate finds a template by slug or id
+func loadTemplate(key string) (*NodeTemplate, error) {
+	return scanTemplate(db.QueryRow(`SELECT `+templateColumns+` FROM node_templates WHERE slug = ? OR id = ?`, key, key))
+}
+
+func listTemplates() ([]NodeTemplate, error) {
+	rows, err := db.Query(`SELECT ` + templateColumns + ` FROM node_templates ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []NodeTemplate{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *t)
+	}
+	return out, rows.Err()
+}
+
+// checkTemplate adds the problems with t its tags can't express
+func checkTemplate(t *NodeTemplate, verrs *validate.Errors) {
+	if t.Slug != "" && !templateSlug.MatchString(t.Slug) {
+		verrs.Add("slug", "may only use lower case letters, digits and '-'")
+	}
+	for _, tag := range t.Tags {
+		if strings.TrimSpace(tag) == "" {
+			verrs.Add("tags", "may not be empty")
+			break
+		}
+	}
+}
+
+// saveTemplate inserts t, or replaces the template with its id
+func saveTemplate(database execer, t *NodeTemplate) error {
+	fields, _ := json.Marshal(t.Fields)
+	if t.Fields == nil {
+		fields = nil
+	}
+	tags, _ := json.Marshal(t.Tags)
+	if t.Tags == nil {
+		tags = nil
+	}
+	_, err := database.Exec(`INSERT INTO node_templates (id, slug, name, description, node_type, title, content, mime_type, fields, tags, created_at, modified_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET slug = excluded.slug, name = excluded.name, description = excluded.description,
+			node_type = excluded.node_type, title = excluded.title, content = excluded.content, mime_type = excluded.mime_type,
+			fields = excluded.fields, tags = excluded.tags, modified_at = excluded.modified_at`,
+		t.ID, t.Slug, t.Name, t.Description, t.Type, t.Title, t.Content, t.MimeType, string(fields), string(tags), t.CreatedAt, t.ModifiedAt)
+	return err
+}
+
+// execer is a *sql.DB or *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// applyTemplate fills in what node leaves out from t
+func applyTemplate(t *NodeTemplate, node *Node, now time.Time) error {
+	if node.Type == "" {
+		node.Type = t.Type
+	}
+	if node.MimeType == "" {
+		node.MimeType = t.MimeType
+	}
+	fill := strings.NewReplacer("{{date}}", now.Format("2006-01-02"), "{{time}}", now.Format("15:04"))
+	if node.Title == "" {
+		node.Title = fill.Replace(t.Title)
+	}
+	fill = strings.NewReplacer("{{title}}", node.Title, "{{date}}", now.Format("2006-01-02"), "{{time}}", now.Format("15:04"))
+	if node.Content == "" {
+		node.Content = fill.Replace(t.Content)
+	}
+	if node.Path == "" {
+		name := slugify(node.Title)
+		if name == "" {
+			name = t.Slug + "-" + now.Format("2006-01-02-150405")
+		}
+		node.Path = name + ".md"
+	}
+
+	if len(t.Fields) > 0 {
+		meta := map[string]interface{}{}
+		for k, v := range t.Fields {
+			if s, ok := v.(string); ok {
+				v = fill.Replace(s)
+			}
+			meta[k] = v
+		}
+		if node.Metadata != "" {
+			var own map[string]interface{}
+			if err := json.Unmarshal([]byte(node.Metadata), &own); err != nil {
+				return validate.Errors{{Field: "metadata", Message: "must be a JSON object"}}
+			}
+			for k, v := range own {
+				meta[k] = v
+			}
+		}
+		b, _ := json.Marshal(meta)
+		node.Metadata = string(b)
+	}
+
+	seen := map[string]bool{}
+	for _, tag := range node.Tags {
+		seen[tag] = true
+	}
+	for _, tag := range t.Tags {
+		if !seen[tag] {
+			seen[tag] = true
+			node.Tags = append(node.Tags, tag)
+		}
+	}
+	return nil
+}
+
+// tagNode links a node to each of tags, creating the tags it lacks
+func tagNode(nodeID string, tags []string) {
+	for _, name := range tags {
+		var tagID string
+		if db.QueryRow(`SELECT id FROM tags WHERE name = ?`, name).Scan(&tagID) != nil {
+			tagID = ids.New("tag")
+			db.Exec(`INSERT INTO tags (id, name) VALUES (?, ?)`, tagID, name)
+		}
+		db.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES (?, ?, ?) ON CONFLICT DO NOTHING`,
+			ids.New("nt"), nodeID, tagID)
+	}
+}
+
+// /api/templates: GET lists templates (?slug= returns one), POST adds one,
+// PUT updates one by id or slug and DELETE ?id= (id or slug) removes one
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		if slug := r.URL.Query().Get("slug"); slug != "" {
+			t, err := loadTemplate(slug)
+			if err != nil {
+				apierror.Write(w, http.StatusNotFound, "template not found")
+				return
+			}
+			json.NewEncoder(w).Encode(t)
+			return
+		}
+		out, err := listTemplates()
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(out)
+
+	case "POST":
+		var t NodeTemplate
+		verrs, _ := validate.DecodeJSON(r.Body, &t).(validate.Errors)
+		checkTemplate(&t, &verrs)
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		t.ID = ids.New("tpl")
+		t.CreatedAt = time.Now().Unix()
+		t.ModifiedAt = t.CreatedAt
+		if err := saveTemplate(db, &t); err != nil {
+			status := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "UNIQUE") {
+				status = http.StatusConflict
+			}
+			apierror.Write(w, status, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+
+	case "PUT":
+		var t NodeTemplate
+		verrs, _ := validate.DecodeJSON(r.Body, &t).(validate.Errors)
+		checkTemplate(&t, &verrs)
+		if len(verrs) > 0 {
+			validate.WriteError(w, verrs)
+			return
+		}
+		key := t.ID
+		if key == "" {
+			key = t.Slug
+		}
+		current, err := loadTemplate(key)
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, "template not found")
+			return
+		}
+		t.ID, t.CreatedAt, t.ModifiedAt = current.ID, current.CreatedAt, time.Now().Unix()
+		if err := saveTemplate(db, &t); err != nil {
+			status := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "UNIQUE") {
+				status = http.StatusConflict
+			}
+			apierror.Write(w, status, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(t)
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		res, err := db.Exec(`DELETE FROM node_templates WHERE id = ? OR slug = ?`, id, id)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, http.StatusNotFound, "template not found")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"deleted": id})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNodeTemplates(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "templates-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	mux := setupRoutes()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		return rr
+	}
+
+	rr := do("POST", "/api/templates", `{"slug":"meeting-notes","name":"Meeting notes","type":"note","mime_type":"text/markdown",
+		"title":"Meeting {{date}}","content":"# {{title}}\n\n## Agenda\n","fields":{"date":"{{date}}","attendees":[]},"tags":["meeting"]}`)
+	if rr.Code != 201 {
+		t.Fatalf("create: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/api/templates", `{"slug":"meeting-notes","name":"Again","type":"note"}`); rr.Code != 409 {
+		t.Fatalf("a taken slug should conflict: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("POST", "/api/templates", `{"slug":"Bad Slug","name":"X"}`); rr.Code != 400 ||
+		!strings.Contains(rr.Body.String(), `"slug"`) || !strings.Contains(rr.Body.String(), `"type"`) {
+		t.Fatalf("expected slug and type errors: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// a node from the template alone
+	rr = do("POST", "/api/node-create?template=meeting-notes", "")
+	if rr.Code != 201 {
+		t.Fatalf("create from template: %d %s", rr.Code, rr.Body.String())
+	}
+	var node Node
+	json.NewDecoder(rr.Body).Decode(&node)
+	today := time.Now().Format("2006-01-02")
+	if node.Type != "note" || node.Title != "Meeting "+today || node.Path != "meeting-"+today+".md" ||
+		node.Content != "# Meeting "+today+"\n\n## Agenda\n" || node.Metadata != `{"attendees":[],"date":"`+today+`"}` {
+		t.Fatalf("unexpected node from template: %+v", node)
+	}
+	var metadata, tag string
+	testDB.QueryRow(`SELECT COALESCE(metadata, '') FROM nodes WHERE id = ?`, node.ID).Scan(&metadata)
+	testDB.QueryRow(`SELECT t.name FROM node_tags nt JOIN tags t ON t.id = nt.tag_id WHERE nt.node_id = ?`, node.ID).Scan(&tag)
+	if metadata != node.Metadata || tag != "meeting" {
+		t.Fatalf("metadata and tags should be stored: %q %q", metadata, tag)
+	}
+
+	// what the request gives wins over the template
+	rr = do("POST", "/api/node-create?template=meeting-notes", `{"title":"Kickoff","path":"meetings/kickoff.md","metadata":"{\"attendees\":[\"ada\"]}","tags":["project"]}`)
+	if rr.Code != 201 {
+		t.Fatalf("create from template: %d %s", rr.Code, rr.Body.String())
+	}
+	node = Node{}
+	json.NewDecoder(rr.Body).Decode(&node)
+	if node.Title != "Kickoff" || node.Path != "meetings/kickoff.md" || node.Content != "# Kickoff\n\n## Agenda\n" ||
+		node.Metadata != `{"attendees":["ada"],"date":"`+today+`"}` || strings.Join(node.Tags, ",") != "project,meeting" {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+	if rr := do("POST", "/api/node-create?template=nope", `{}`); rr.Code != 404 {
+		t.Fatalf("an unknown template should 404: %d", rr.Code)
+	}
+
+	rr = do("PUT", "/api/templates", `{"slug":"meeting-notes","name":"Meetings","type":"meeting"}`)
+	if rr.Code != 200 {
+		t.Fatalf("update: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = do("GET", "/api/templates", "")
+	var list []NodeTemplate
+	json.NewDecoder(rr.Body).Decode(&list)
+	if len(list) != 1 || list[0].Name != "Meetings" || list[0].Type != "meeting" || list[0].Tags != nil {
+		t.Fatalf("unexpected templates: %+v", list)
+	}
+	if rr := do("DELETE", "/api/templates?id=meeting-notes", ""); rr.Code != 200 {
+		t.Fatalf("delete: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := do("GET", "/api/templates?slug=meeting-notes", ""); rr.Code != 404 {
+		t.Fatalf("deleted template should be gone: %d", rr.Code)
+	}
+}
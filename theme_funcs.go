@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// === Theme Functions ===
+// Every theme template can call these, so common needs don't take Go
+// changes:
+//
+//	formatDate T LAYOUT [LOCALE]  a time in a Go layout ("2 January 2006"),
+//	                              with month and day names in LOCALE
+//	excerpt N X                   X (a page, HTML or Markdown) as plain text
+//	                              of at most N characters
+//	tagCloud PAGES                the tags of PAGES with counts and a 1-5 weight
+//	relatedNodes PAGE PAGES N     up to N of PAGES sharing the most tags with PAGE
+//	pagination PAGER              links to the other pages of a paginated list
+//
+// Index and tag pages are paginated when the theme's theme.json sets
+// "per_page"; .Pager then says where the page is.
+
+// themeFuncs is the function map every theme is parsed with
+var themeFuncs = template.FuncMap{
+	"formatDate":   formatDate,
+	"excerpt":      themeExcerpt,
+	"tagCloud":     tagCloud,
+	"relatedNodes": relatedNodes,
+	"pagination":   pagination,
+}
+
+// dateNames holds a locale's month names, January first, and day names,
+// Sunday first, each full and abbreviated
+type dateNames struct {
+	months, shortMonths [12]string
+	days, shortDays     [7]string
+}
+
+var dateLocales = map[string]dateNames{
+	"de": {
+		months:      [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths: [12]string{"Jan.", "Feb.", "März", "Apr.", "Mai", "Juni", "Juli", "Aug.", "Sept.", "Okt.", "Nov.", "Dez."},
+		days:        [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortDays:   [7]string{"So.", "Mo.", "Di.", "Mi.", "Do.", "Fr.", "Sa."},
+	},
+	"es": {
+		months:      [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		days:        [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+	},
+	"fr": {
+		months:      [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		days:        [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortDays:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+	},
+	"it": {
+		months:      [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		shortMonths: [12]string{"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set", "ott", "nov", "dic"},
+		days:        [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+		shortDays:   [7]string{"dom", "lun", "mar", "mer", "gio", "ven", "sab"},
+	},
+	"nl": {
+		months:      [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		shortMonths: [12]string{"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep", "okt", "nov", "dec"},
+		days:        [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+		shortDays:   [7]string{"zo", "ma", "di", "wo", "do", "vr", "za"},
+	},
+	"pt": {
+		months:      [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		shortMonths: [12]string{"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set", "out", "nov", "dez"},
+		days:        [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+		shortDays:   [7]string{"dom", "seg", "ter", "qua", "qui", "sex", "sáb"},
+	},
+}
+
+// dateNameTokens are the layout elements formatDate translates, longest
+// first so "Jan" doesn't match the start of "January"
+var dateNameTokens = regexp.MustCompile(`January|Jan|Monday|Mon`)
+
+// formatDate formats t with a Go layout. A locale such as "fr" or "de-AT"
+// names months and days in that language; English is the default and the
+// fallback for locales it doesn't know.
+func formatDate(t time.Time, layout string, locale ...string) string {
+	if t.IsZero() {
+		return ""
+	}
+	var names dateNames
+	var ok bool
+	if len(locale) > 0 {
+		lang := strings.ToLower(strings.SplitN(strings.ReplaceAll(locale[0], "_", "-"), "-", 2)[0])
+		names, ok = dateLocales[lang]
+	}
+	if !ok {
+		return t.Format(layout)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range dateNameTokens.FindAllStringIndex(layout, -1) {
+		b.WriteString(t.Format(layout[last:m[0]]))
+		switch layout[m[0]:m[1]] {
+		case "January":
+			b.WriteString(names.months[t.Month()-1])
+		case "Jan":
+			b.WriteString(names.shortMonths[t.Month()-1])
+		case "Monday":
+			b.WriteString(names.days[t.Weekday()])
+		case "Mon":
+			b.WriteString(names.shortDays[t.Weekday()])
+		}
+		last = m[1]
+	}
+	b.WriteString(t.Format(layout[last:]))
+	return b.String()
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// themeExcerpt is up to n characters of plain text from a page, HTML or
+// Markdown, cut at a word
+func themeExcerpt(n int, x interface{}) string {
+	switch v := x.(type) {
+	case *ThemePage:
+		return excerpt(v.node.Content, n)
+	case template.HTML:
+		text := strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(string(v), " "))), " ")
+		return truncate(text, n)
+	case string:
+		return excerpt(v, n)
+	}
+	return ""
+}
+
+// TagCount is a tag in a tag cloud. Weight runs from 1 for the least used
+// tags to 5 for the most used.
+type TagCount struct {
+	Name   string
+	URL    string
+	Count  int
+	Weight int
+}
+
+// tagCloud counts the tags of pages, by name
+func tagCloud(pages []*ThemePage) []TagCount {
+	counts := map[string]*TagCount{}
+	for _, p := range pages {
+		for _, t := range p.Tags {
+			if counts[t.Name] == nil {
+				counts[t.Name] = &TagCount{Name: t.Name, URL: t.URL}
+			}
+			counts[t.Name].Count++
+		}
+	}
+	cloud := make([]TagCount, 0, len(counts))
+	lo, hi := 0, 0
+	for _, c := range counts {
+		if lo == 0 || c.Count < lo {
+			lo = c.Count
+		}
+		if c.Count > hi {
+			hi = c.Count
+		}
+		cloud = append(cloud, *c)
+	}
+	for i := range cloud {
+		cloud[i].Weight = 1
+		if hi > lo {
+			cloud[i].Weight = 1 + (cloud[i].Count-lo)*4/(hi-lo)
+		}
+	}
+	sort.Slice(cloud, func(i, j int) bool { return strings.ToLower(cloud[i].Name) < strings.ToLower(cloud[j].Name) })
+	return cloud
+}
+
+// relatedNodes is up to n pages sharing tags with page, most shared tags
+// first, then the most recently modified
+func relatedNodes(page *ThemePage, pages []*ThemePage, n int) []*ThemePage {
+	if page == nil {
+		return nil
+	}
+	tags := map[string]bool{}
+	for _, t := range page.Tags {
+		tags[t.Name] = true
+	}
+	shared := map[string]int{}
+	var related []*ThemePage
+	for _, p := range pages {
+		if p.ID == page.ID {
+			continue
+		}
+		for _, t := range p.Tags {
+			if tags[t.Name] {
+				shared[p.ID]++
+			}
+		}
+		if shared[p.ID] > 0 {
+			related = append(related, p)
+		}
+	}
+	sort.SliceStable(related, func(i, j int) bool {
+		if a, b := shared[related[i].ID], shared[related[j].ID]; a != b {
+			return a > b
+		}
+		return related[i].Modified.After(related[j].Modified)
+	})
+	if n >= 0 && len(related) > n {
+		related = related[:n]
+	}
+	return related
+}
+
+// Pager is where a page of a paginated list is. Number counts from 1.
+type Pager struct {
+	Number  int
+	Total   int
+	PrevURL string
+	NextURL string
+	URLs    []string // every page of the list, in order
+}
+
+// pagedFileName is the file of page number (from 1) of a list whose first
+// page is first
+func pagedFileName(first string, number int) string {
+	if number <= 1 {
+		return first
+	}
+	if first == "index.html" {
+		return fmt.Sprintf("page-%d.html", number)
+	}
+	return fmt.Sprintf("%s-%d.html", strings.TrimSuffix(first, ".html"), number)
+}
+
+// paginate splits pages into lists of perPage, each with its Pager. With
+// perPage 0 the whole list is one page without a Pager.
+func paginate(first string, pages []*ThemePage, perPage int) ([][]*ThemePage, []*Pager) {
+	if perPage <= 0 || len(pages) <= perPage {
+		return [][]*ThemePage{pages}, []*Pager{nil}
+	}
+	var chunks [][]*ThemePage
+	for i := 0; i < len(pages); i += perPage {
+		chunks = append(chunks, pages[i:min(i+perPage, len(pages))])
+	}
+	urls := make([]string, len(chunks))
+	for i := range chunks {
+		urls[i] = pagedFileName(first, i+1)
+	}
+	pagers := make([]*Pager, len(chunks))
+	for i := range chunks {
+		p := &Pager{Number: i + 1, Total: len(chunks), URLs: urls}
+		if i > 0 {
+			p.PrevURL = urls[i-1]
+		}
+		if i+1 < len(chunks) {
+			p.NextURL = urls[i+1]
+		}
+		pagers[i] = p
+	}
+	return chunks, pagers
+}
+
+// pagination renders a pager as a <nav> of page links, or nothing for a
+// list that fits on one page
+func pagination(p *Pager) template.HTML {
+	if p == nil || p.Total < 2 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(`<nav class="pagination">`)
+	if p.PrevURL != "" {
+		fmt.Fprintf(&b, `<a href="%s" rel="prev">&larr; Newer</a>`, html.EscapeString(p.PrevURL))
+	}
+	for i, u := range p.URLs {
+		if i+1 == p.Number {
+			fmt.Fprintf(&b, `<span aria-current="page">%d</span>`, i+1)
+		} else {
+			fmt.Fprintf(&b, `<a href="%s">%d</a>`, html.EscapeString(u), i+1)
+		}
+	}
+	if p.NextURL != "" {
+		fmt.Fprintf(&b, `<a href="%s" rel="next">Older &rarr;</a>`, html.EscapeString(p.NextURL))
+	}
+	b.WriteString(`</nav>`)
+	return template.HTML(b.String())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThemeFuncs(t *testing.T) {
+	day := time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC) // a Tuesday
+	for _, c := range []struct{ layout, locale, want string }{
+		{"2 January 2006", "", "5 March 2024"},
+		{"Monday 2 January 2006", "fr", "mardi 5 mars 2024"},
+		{"Mon, 2. Jan 2006", "de-AT", "Di., 5. März 2024"},
+		{"January 2", "xx", "March 5"},
+	} {
+		var got string
+		if c.locale == "" {
+			got = formatDate(day, c.layout)
+		} else {
+			got = formatDate(day, c.layout, c.locale)
+		}
+		if got != c.want {
+			t.Errorf("formatDate(%q, %q) = %q, want %q", c.layout, c.locale, got, c.want)
+		}
+	}
+
+	if got := themeExcerpt(12, template.HTML("<p>Hello <b>big</b> &amp; wide world</p>")); got != "Hello big &..." {
+		t.Errorf("HTML excerpt: %q", got)
+	}
+	if got := themeExcerpt(50, "---\ntitle: x\n---\n# Heading\n\nSome **bold** text"); got != "Heading" {
+		t.Errorf("Markdown excerpt: %q", got)
+	}
+
+	tag := func(names ...string) []TagLink {
+		var links []TagLink
+		for _, n := range names {
+			links = append(links, TagLink{Name: n, URL: tagFileName(n)})
+		}
+		return links
+	}
+	pages := []*ThemePage{
+		{ID: "a", Tags: tag("go", "web")},
+		{ID: "b", Tags: tag("go"), Modified: day},
+		{ID: "c", Tags: tag("go", "web"), Modified: day.AddDate(0, 0, -1)},
+		{ID: "d", Tags: tag("rust")},
+		{ID: "e", Tags: tag("go")},
+	}
+	cloud := tagCloud(pages)
+	if len(cloud) != 3 || cloud[0].Name != "go" || cloud[0].Count != 4 || cloud[0].Weight != 5 || cloud[1].Name != "rust" || cloud[1].Weight != 1 {
+		t.Errorf("unexpected tag cloud: %+v", cloud)
+	}
+	related := relatedNodes(pages[0], pages, 2)
+	if len(related) != 2 || related[0].ID != "c" || related[1].ID != "b" {
+		t.Errorf("related pages should rank shared tags, then recency: %v", related)
+	}
+
+	chunks, pagers := paginate("tag-go.html", pages, 2)
+	if len(chunks) != 3 || pagers[1].PrevURL != "tag-go.html" || pagers[1].NextURL != "tag-go-3.html" {
+		t.Fatalf("unexpected pagination: %d chunks, %+v", len(chunks), pagers[1])
+	}
+	if nav := string(pagination(pagers[0])); !strings.Contains(nav, `<span aria-current="page">1</span>`) || !strings.Contains(nav, `href="tag-go-2.html" rel="next"`) {
+		t.Errorf("unexpected pagination links: %s", nav)
+	}
+	if pagination(nil) != "" {
+		t.Error("an unpaginated list has no pagination links")
+	}
+}
+
+func TestThemePagination(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "theme-funcs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Blog', '', 'blog', 1, 1)`)
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, slug, status, created_at, modified_at) VALUES
+		('a', 'post', 's1', 'a.md', 'A', 'one', 'a', 'published', 1709596800, 1709596800),
+		('b', 'post', 's1', 'b.md', 'B', 'two', 'b', 'published', 1709683200, 1709683200),
+		('c', 'post', 's1', 'c.md', 'C', 'three', 'c', 'published', 1709769600, 1709769600)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'go')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1'), ('nt2', 'b', 't1')`)
+
+	theme := filepath.Join(tmp, "theme")
+	os.MkdirAll(theme, 0755)
+	ioutil.WriteFile(filepath.Join(theme, "theme.json"), []byte(`{"per_page": 2}`), 0644)
+	ioutil.WriteFile(filepath.Join(theme, "index.html"), []byte(`{{range .Pages}}<p>{{.Title}} {{formatDate .Created "2 Jan" "fr"}}</p>{{end}}`+
+		`{{range tagCloud .AllPages}}<i>{{.Name}}:{{.Count}}</i>{{end}}{{pagination .Pager}}`), 0644)
+
+	out := filepath.Join(tmp, "dist")
+	if err := ExportSiteToDir(ExportOptions{SiteID: "s1", Theme: theme}, out); err != nil {
+		t.Fatal(err)
+	}
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatalf("expected %s: %v", name, err)
+		}
+		return string(data)
+	}
+	first := read("index.html")
+	if !strings.Contains(first, "<p>C 7 mars</p><p>B 6 mars</p>") || !strings.Contains(first, "<i>go:2</i>") || !strings.Contains(first, `href="page-2.html"`) {
+		t.Fatalf("unexpected first page:\n%s", first)
+	}
+	if second := read("page-2.html"); !strings.Contains(second, "<p>A 5 mars</p>") || strings.Contains(second, "<p>B") {
+		t.Fatalf("unexpected second page:\n%s", second)
+	}
+	if _, err := os.Stat(filepath.Join(out, "theme.json")); err == nil {
+		t.Fatal("theme.json configures the theme and is not part of the site")
+	}
+	if page := read("a.html"); !strings.Contains(page, `<aside class="related">`) || !strings.Contains(page, `href="b.html"`) {
+		t.Fatalf("the default node layout should link related pages:\n%s", page)
+	}
+}
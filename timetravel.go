@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Time Travel ===
+// ?as_of=<time> on /api/node/{id}, /preview/ and /veil/ shows a node as it
+// was at that moment, rebuilt from its versions and codex commits, so
+// historical views and citations stay reproducible after later edits.
+
+// errNoHistory means the node existed at the time but none of its state
+// before that time was recorded
+var errNoHistory = errors.New("no recorded state for this node at that time")
+
+// errNotAtTime means the node was created after the time, or deleted by then
+var errNotAtTime = errors.New("node did not exist at that time")
+
+// NodeAsOf is a node as it was at a point in time
+type NodeAsOf struct {
+	Node
+	AsOf      time.Time `json:"as_of"`
+	Source    string    `json:"source"`               // current, version or codex
+	VersionID string    `json:"version_id,omitempty"` // when Source is version
+	Commit    string    `json:"commit,omitempty"`     // when Source is codex
+	// RecordedAt is when the returned state was saved; a citation can use it
+	// with the node ID to refer to exactly this content
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// parseAsOf accepts unix seconds, RFC 3339 or a YYYY-MM-DD date (midnight UTC)
+func parseAsOf(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("as_of must be unix seconds, RFC 3339 or YYYY-MM-DD")
+}
+
+// nodeAsOf rebuilds a node at time at. The current row wins if it was last
+// modified by then; otherwise the latest version or codex commit recorded by
+// then supplies the title and content.
+func nodeAsOf(nodeID string, at time.Time) (*NodeAsOf, error) {
+	var n NodeAsOf
+	var created, modified int64
+	var deleted sql.NullInt64
+	var site, slug, status, visibility, owner sql.NullString
+	err := db.QueryRow(`SELECT id, type, COALESCE(parent_id, ''), path, COALESCE(title, ''), COALESCE(content, ''), COALESCE(mime_type, ''),
+		created_at, modified_at, deleted_at, site_id, slug, status, visibility, owner_id FROM nodes WHERE id = ?`, nodeID).
+		Scan(&n.ID, &n.Type, &n.ParentID, &n.Path, &n.Title, &n.Content, &n.MimeType,
+			&created, &modified, &deleted, &site, &slug, &status, &visibility, &owner)
+	if err != nil {
+		return nil, err
+	}
+	n.SiteID, n.Slug, n.Status, n.Visibility, n.OwnerID = site.String, slug.String, status.String, visibility.String, owner.String
+	n.CreatedAt = time.Unix(created, 0)
+	n.AsOf = at
+	ts := at.Unix()
+	if created > ts || (deleted.Valid && deleted.Int64 <= ts) {
+		return nil, errNotAtTime
+	}
+	if modified <= ts {
+		n.Source = "current"
+		n.ModifiedAt = time.Unix(modified, 0)
+		n.RecordedAt = n.ModifiedAt
+		return &n, nil
+	}
+
+	var versionID, vTitle, vContent string
+	var vAt int64
+	hasVersion := db.QueryRow(`SELECT id, COALESCE(title, ''), COALESCE(content, ''), created_at FROM versions
+		WHERE node_id = ? AND created_at <= ? ORDER BY created_at DESC, version_number DESC LIMIT 1`, nodeID, ts).
+		Scan(&versionID, &vTitle, &vContent, &vAt) == nil
+
+	var commit, object string
+	var cAt int64
+	hasCommit := db.QueryRow(`SELECT commit_hash, object_hash, created_at FROM node_codex_commits
+		WHERE node_id = ? AND created_at <= ? ORDER BY created_at DESC LIMIT 1`, nodeID, ts).
+		Scan(&commit, &object, &cAt) == nil
+
+	if hasCommit && (!hasVersion || cAt > vAt) {
+		if b, err := codexRepo().GetObject(object); err == nil {
+			var obj map[string]interface{}
+			if json.Unmarshal(b, &obj) == nil {
+				if s, ok := obj["title"].(string); ok {
+					n.Title = s
+				}
+				if s, ok := obj["content"].(string); ok {
+					n.Content = s
+				}
+				if s, ok := obj["path"].(string); ok && s != "" {
+					n.Path = s
+				}
+				n.Source, n.Commit = "codex", commit
+				n.ModifiedAt = time.Unix(cAt, 0)
+				n.RecordedAt = n.ModifiedAt
+				return &n, nil
+			}
+		}
+	}
+	if hasVersion {
+		if vTitle != "" {
+			n.Title = vTitle
+		}
+		n.Content = vContent
+		n.Source, n.VersionID = "version", versionID
+		n.ModifiedAt = time.Unix(vAt, 0)
+		n.RecordedAt = n.ModifiedAt
+		return &n, nil
+	}
+	return nil, errNoHistory
+}
+
+// writeAsOfError maps nodeAsOf errors to a JSON response
+func writeAsOfError(w http.ResponseWriter, err error) {
+	msg := "node not found"
+	if errors.Is(err, errNotAtTime) || errors.Is(err, errNoHistory) {
+		msg = err.Error()
+	}
+	apierror.Write(w, http.StatusNotFound, msg)
+}
+
+// GET /api/node/{id}?as_of=
+func handleNodeAsOf(w http.ResponseWriter, r *http.Request, nodeID, asOf string) {
+	at, err := parseAsOf(asOf)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !canReadNode(r, nodeID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	n, err := nodeAsOf(nodeID, at)
+	if err != nil {
+		writeAsOfError(w, err)
+		return
+	}
+	// RFC 7089: the datetime of the state being served
+	w.Header().Set("Memento-Datetime", n.RecordedAt.UTC().Format(http.TimeFormat))
+	json.NewEncoder(w).Encode(n)
+}
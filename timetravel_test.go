@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNodeAsOf(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	db.Exec(`INSERT INTO sites (id, name, type, created_at, modified_at) VALUES ('s1', 'Blog', 'blog', 100, 100)`)
+	db.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, created_at, modified_at) VALUES ('n1', 'note', 's1', 'n.md', 'Third', 'three', 100, 300)`)
+	db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, created_at, modified_at) VALUES
+		('v1', 'n1', 1, 'one', 'First', 100, 100),
+		('v2', 'n1', 2, 'two', 'Second', 200, 200),
+		('v3', 'n1', 3, 'three', 'Third', 300, 300)`)
+
+	mux := setupRoutes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+	asOf := func(ts string) (NodeAsOf, int) {
+		rr := get("/api/node/n1?as_of=" + ts)
+		var n NodeAsOf
+		json.NewDecoder(rr.Body).Decode(&n)
+		return n, rr.Code
+	}
+
+	for ts, want := range map[string]string{"150": "one", "200": "two", "299": "two", "1970-01-01T00:05:00Z": "three"} {
+		n, code := asOf(ts)
+		if code != http.StatusOK || n.Content != want {
+			t.Fatalf("as_of=%s: got %d %q, want %q", ts, code, n.Content, want)
+		}
+	}
+	n, _ := asOf("250")
+	if n.Source != "version" || n.VersionID != "v2" || n.Title != "Second" || n.RecordedAt.Unix() != 200 {
+		t.Fatalf("unexpected historical node: %+v", n)
+	}
+	if _, code := asOf("50"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 before the node existed, got %d", code)
+	}
+	if rr := get("/api/node/n1?as_of=yesterday"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad as_of, got %d", rr.Code)
+	}
+	if rr := get("/api/node/n1?as_of=250"); rr.Header().Get("Memento-Datetime") == "" {
+		t.Fatalf("expected a Memento-Datetime header")
+	}
+
+	db.Exec(`UPDATE nodes SET deleted_at = 400 WHERE id = 'n1'`)
+	if n, code := asOf("350"); code != http.StatusOK || n.Content != "three" {
+		t.Fatalf("expected a deleted node to be readable before its deletion: %d %+v", code, n)
+	}
+	if _, code := asOf("450"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 after deletion, got %d", code)
+	}
+
+	rr := get("/veil/node/n1?as_of=150")
+	if loc := rr.Header().Get("Location"); loc != "/preview/s1/n1?as_of=150" {
+		t.Fatalf("expected as_of to survive the redirect, got %q", loc)
+	}
+	rr = get("/preview/s1/n1?as_of=150")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "one") || !strings.Contains(rr.Body.String(), "As of") {
+		t.Fatalf("unexpected historical preview: %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+)
+
+// === Trash ===
+// Deleting a node only sets deleted_at, so it sits in the trash: listed by
+// /api/trash and restorable with /api/node-restore until it has been there
+// for trashRetention. serve and gui then purge it for good, together with
+// its versions, tags, links, URIs, asset links, citations and the rows
+// plugins keep for it. Media files stay in the library, detached from the
+// node. Publish history, the change feed and notifications keep mentioning
+// it.
+
+// trashRetention is how long deleted nodes stay restorable; 0 keeps them
+// forever. serve and gui take --trash-retention-days.
+var trashRetention = 30 * 24 * time.Hour
+
+// trashPurgeInterval is how often serve and gui empty expired trash
+const trashPurgeInterval = time.Hour
+
+// trashPurges are the rows that go with a purged node, each run with its id
+var trashPurges = []string{
+	`DELETE FROM versions WHERE node_id = ?`,
+	`DELETE FROM node_tags WHERE node_id = ?`,
+	`DELETE FROM node_references WHERE source_node_id = ?1 OR target_node_id = ?1`,
+	`DELETE FROM node_backlinks WHERE source_node_id = ?1 OR target_node_id = ?1`,
+	`DELETE FROM node_uris WHERE node_id = ?`,
+	`DELETE FROM node_visibility WHERE node_id = ?`,
+	`DELETE FROM node_assets WHERE node_id = ?`,
+	`DELETE FROM node_codex_links WHERE node_id = ?`,
+	`DELETE FROM blog_posts WHERE node_id = ?`,
+	`DELETE FROM citations WHERE node_id = ?`,
+	`DELETE FROM node_codex_commits WHERE node_id = ?`,
+	`DELETE FROM user_permissions WHERE node_id = ?`,
+	`DELETE FROM exports WHERE node_id = ?`,
+	`DELETE FROM git_commits WHERE node_id = ?`,
+	`DELETE FROM ipfs_content WHERE node_id = ?`,
+	`DELETE FROM ipfs_publications WHERE node_id = ?`,
+	`DELETE FROM game_embeds WHERE node_id = ?`,
+	`DELETE FROM portfolio_games WHERE node_id = ?`,
+	`DELETE FROM todos WHERE node_id = ?`,
+	`DELETE FROM reminders WHERE node_id = ?`,
+	`UPDATE media SET node_id = NULL WHERE node_id = ?`,
+	`UPDATE nodes SET parent_id = NULL WHERE parent_id = ?`,
+	`DELETE FROM nodes WHERE id = ?`,
+}
+
+// TrashedNode is a deleted node as the trash lists it
+type TrashedNode struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Path      string `json:"path"`
+	SiteID    string `json:"site_id,omitempty"`
+	DeletedAt int64  `json:"deleted_at"`
+	PurgeAt   int64  `json:"purge_at,omitempty"` // when it goes for good; unset when kept forever
+}
+
+// GET /api/trash[?site_id=]
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	siteID := r.URL.Query().Get("site_id")
+	rows, err := db.Query(`SELECT id, type, COALESCE(title, ''), path, COALESCE(site_id, ''), deleted_at FROM nodes
+		WHERE deleted_at IS NOT NULL AND (? = '' OR site_id = ?) ORDER BY deleted_at DESC, id`, siteID, siteID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	var trashed []TrashedNode
+	for rows.Next() {
+		var n TrashedNode
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Path, &n.SiteID, &n.DeletedAt); err != nil {
+			rows.Close()
+			apierror.WriteError(w, r, err)
+			return
+		}
+		if trashRetention > 0 {
+			n.PurgeAt = n.DeletedAt + int64(trashRetention/time.Second)
+		}
+		trashed = append(trashed, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		apierror.WriteError(w, r, err)
+		return
+	}
+	// only what the user could have deleted
+	list := []TrashedNode{}
+	for _, n := range trashed {
+		if canModifyNode(r, n.ID) {
+			list = append(list, n)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// POST /api/node-restore?id=
+func handleNodeRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	nodeID := r.URL.Query().Get("id")
+	var n Node
+	var status, canonical string
+	err := db.QueryRow(`SELECT id, type, path, COALESCE(title, ''), COALESCE(site_id, ''), COALESCE(status, ''), COALESCE(canonical_uri, '')
+		FROM nodes WHERE id = ? AND deleted_at IS NOT NULL`, nodeID).Scan(&n.ID, &n.Type, &n.Path, &n.Title, &n.SiteID, &status, &canonical)
+	if err != nil {
+		apierror.Write(w, http.StatusNotFound, "node not in the trash")
+		return
+	}
+	if !canModifyNode(r, nodeID) {
+		apierror.Write(w, http.StatusForbidden, "only the node's owner can restore it")
+		return
+	}
+	if canonical != "" {
+		var other string
+		db.QueryRow(`SELECT id FROM nodes WHERE canonical_uri = ? AND id != ? AND deleted_at IS NULL`, canonical, nodeID).Scan(&other)
+		if other != "" {
+			apierror.Write(w, http.StatusConflict, "canonical URI "+canonical+" now belongs to "+other)
+			return
+		}
+	}
+	if _, err := db.Exec(`UPDATE nodes SET deleted_at = NULL WHERE id = ?`, nodeID); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	targets, err := backlinkTargets(db, nodeID)
+	if err == nil {
+		err = recountBacklinks(db, targets)
+	}
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	publishNodeEvent(events.NodeRestored, n)
+	if n.SiteID != "" && (status == "published" || status == "public") {
+		queueStaticRebuilds(n.SiteID, n.ID)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": nodeID, "restored": true})
+}
+
+// purgeTrash deletes for good the nodes deleted before cutoff and returns
+// their ids
+func purgeTrash(cutoff int64) ([]string, error) {
+	rows, err := db.Query(`SELECT id FROM nodes WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY deleted_at, id`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		purged = append(purged, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(purged) == 0 {
+		return nil, nil
+	}
+
+	// links from the purged nodes no longer count once they're gone
+	var targets []string
+	for _, id := range purged {
+		t, err := backlinkTargets(db, id)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t...)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	for _, id := range purged {
+		for _, q := range trashPurges {
+			if _, err := tx.Exec(q, id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	recountBacklinks(db, targets)
+	return purged, nil
+}
+
+// watchTrash purges expired trash now and every interval until the returned
+// stop is called
+func watchTrash(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	purge := func(now time.Time) {
+		if trashRetention <= 0 {
+			return
+		}
+		purged, err := purgeTrash(now.Add(-trashRetention).Unix())
+		if err != nil {
+			log.Printf("trash: %v", err)
+		} else if len(purged) > 0 {
+			log.Printf("trash: purged %d nodes deleted over %s ago", len(purged), trashRetention)
+		}
+	}
+	go func() {
+		purge(time.Now())
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-t.C:
+				purge(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
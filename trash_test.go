@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	call := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+	count := func(q string, args ...interface{}) int {
+		var n int
+		testDB.QueryRow(q, args...).Scan(&n)
+		return n
+	}
+
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES
+		('a', 'note', 'a.md', 'A', 'see [[B]]', 1, 1),
+		('b', 'note', 'b.md', 'B', '', 1, 1),
+		('child', 'note', 'a/child.md', 'Child', '', 1, 1)`)
+	testDB.Exec(`UPDATE nodes SET parent_id = 'a' WHERE id = 'child'`)
+	testDB.Exec(`INSERT INTO versions (id, node_id, version_number, content, created_at, modified_at) VALUES ('v1', 'a', 1, '', 1, 1)`)
+	testDB.Exec(`INSERT INTO tags (id, name) VALUES ('t1', 'x')`)
+	testDB.Exec(`INSERT INTO node_tags (id, node_id, tag_id) VALUES ('nt1', 'a', 't1')`)
+	testDB.Exec(`INSERT INTO media (id, filename, node_id, created_at) VALUES ('m1', 'cat.png', 'a', 1)`)
+	syncNodeReferences("a", "", "see [[B]]")
+
+	if rr := call("GET", "/api/node-delete?id=a"); rr.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d", rr.Code)
+	}
+	var trash []TrashedNode
+	json.NewDecoder(call("GET", "/api/trash").Body).Decode(&trash)
+	if len(trash) != 1 || trash[0].ID != "a" || trash[0].PurgeAt != trash[0].DeletedAt+30*24*3600 {
+		t.Fatalf("unexpected trash: %+v", trash)
+	}
+	if rr := call("POST", "/api/node-restore?id=b"); rr.Code != http.StatusNotFound {
+		t.Fatalf("restoring a live node: expected 404, got %d", rr.Code)
+	}
+	if rr := call("POST", "/api/node-restore?id=a"); rr.Code != http.StatusOK {
+		t.Fatalf("restore: %d %s", rr.Code, rr.Body.String())
+	}
+	if count(`SELECT COUNT(*) FROM nodes WHERE id = 'a' AND deleted_at IS NULL`) != 1 {
+		t.Fatal("the node should be live again")
+	}
+	if count(`SELECT backlink_count FROM nodes WHERE id = 'b'`) != 1 {
+		t.Fatal("a restored node's links should count again")
+	}
+
+	// nothing expired yet
+	call("GET", "/api/node-delete?id=a")
+	if purged, err := purgeTrash(time.Now().Add(-time.Hour).Unix()); err != nil || len(purged) != 0 {
+		t.Fatalf("a node deleted just now should stay: %v %v", purged, err)
+	}
+	purged, err := purgeTrash(time.Now().Add(time.Hour).Unix())
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("purge: %v %v", purged, err)
+	}
+	for q, want := range map[string]int{
+		`SELECT COUNT(*) FROM nodes WHERE id = 'a'`:                                     0,
+		`SELECT COUNT(*) FROM versions WHERE node_id = 'a'`:                             0,
+		`SELECT COUNT(*) FROM node_tags WHERE node_id = 'a'`:                            0,
+		`SELECT COUNT(*) FROM node_references WHERE source_node_id = 'a'`:               0,
+		`SELECT COUNT(*) FROM media WHERE id = 'm1' AND node_id IS NULL`:                1,
+		`SELECT COUNT(*) FROM nodes WHERE id = 'child' AND parent_id IS NULL`:           1,
+		`SELECT COUNT(*) FROM nodes WHERE id = 'b' AND COALESCE(backlink_count, 0) = 0`: 1,
+	} {
+		if got := count(q); got != want {
+			t.Fatalf("%s: got %d, want %d", q, got, want)
+		}
+	}
+	if rr := call("POST", "/api/node-restore?id=a"); rr.Code != http.StatusNotFound {
+		t.Fatalf("a purged node can't be restored: %d", rr.Code)
+	}
+}
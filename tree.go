@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/events"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
+)
+
+// === Node Tree ===
+// GET /api/tree nests a site's nodes the way an editor's sidebar shows them:
+// a node sits under its parent_id, and nodes without a (readable) parent sit
+// in folders made from the directories of their paths. A node's children
+// live in the directory named after its path without the extension, so the
+// children of guides/setup.md are guides/setup/*. POST /api/node-move
+// re-parents a node, rewriting its path and, when asked, those of its
+// subtree, then rewrites the links in other nodes that reached a moved node
+// by its path so references follow the move.
+
+// TreeEntry is a folder or a node in GET /api/tree
+type TreeEntry struct {
+	Kind     string       `json:"kind"` // folder or node
+	Name     string       `json:"name"`
+	Path     string       `json:"path"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty"`
+	Title    string       `json:"title,omitempty"`
+	Children []*TreeEntry `json:"children,omitempty"`
+}
+
+// treeNode is what the tree needs of a node
+type treeNode struct {
+	ID, Type, ParentID, Path, Title string
+}
+
+// buildTree nests nodes under their parents and the rest in path folders.
+// A parent chain that loops is cut where it comes back to a node.
+func buildTree(nodes []treeNode) []*TreeEntry {
+	byID := map[string]treeNode{}
+	entries := map[string]*TreeEntry{}
+	for _, n := range nodes {
+		byID[n.ID] = n
+		entries[n.ID] = &TreeEntry{Kind: "node", Name: path.Base(n.Path), Path: n.Path, ID: n.ID, Type: n.Type, Title: n.Title}
+	}
+	root := &TreeEntry{Kind: "folder"}
+	folders := map[string]*TreeEntry{".": root, "/": root}
+	var folder func(dir string) *TreeEntry
+	folder = func(dir string) *TreeEntry {
+		if f, ok := folders[dir]; ok {
+			return f
+		}
+		f := &TreeEntry{Kind: "folder", Name: path.Base(dir), Path: dir}
+		folders[dir] = f
+		parent := folder(path.Dir(dir))
+		parent.Children = append(parent.Children, f)
+		return f
+	}
+	loops := func(id string) bool {
+		cur := byID[id].ParentID
+		for range nodes {
+			if cur == id {
+				return true
+			}
+			p, ok := byID[cur]
+			if !ok {
+				return false
+			}
+			cur = p.ParentID
+		}
+		return false
+	}
+	for _, n := range nodes {
+		if parent, ok := entries[n.ParentID]; ok && !loops(n.ID) {
+			parent.Children = append(parent.Children, entries[n.ID])
+		} else {
+			f := folder(path.Dir(n.Path))
+			f.Children = append(f.Children, entries[n.ID])
+		}
+	}
+	var sortTree func(list []*TreeEntry)
+	sortTree = func(list []*TreeEntry) {
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Kind != list[j].Kind {
+				return list[i].Kind == "folder"
+			}
+			return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+		})
+		for _, e := range list {
+			sortTree(e.Children)
+		}
+	}
+	sortTree(root.Children)
+	if root.Children == nil {
+		return []*TreeEntry{}
+	}
+	return root.Children
+}
+
+// GET /api/tree[?site_id=][&archived=include|only] is the readable nodes of
+// a site (or of the vault) as a tree
+func handleTree(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	where := "n.deleted_at IS NULL" + archivedClause(r, "n.")
+	cond, args := nodeReadSQL(r)
+	where += " AND " + cond
+	if site := r.URL.Query().Get("site_id"); site != "" {
+		where += " AND n.site_id = ?"
+		args = append(args, site)
+	}
+	rows, err := db.Query(`SELECT n.id, n.type, COALESCE(n.parent_id, ''), n.path, COALESCE(n.title, '')
+		FROM nodes n LEFT JOIN node_visibility v ON v.node_id = n.id WHERE `+where+` ORDER BY n.path, n.id`, args...)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	var nodes []treeNode
+	for rows.Next() {
+		var n treeNode
+		if err := rows.Scan(&n.ID, &n.Type, &n.ParentID, &n.Path, &n.Title); err != nil {
+			rows.Close()
+			apierror.WriteError(w, r, err)
+			return
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		apierror.WriteError(w, r, err)
+		return
+	}
+	writeJSONCached(w, r, buildTree(nodes))
+}
+
+// NodeMove is a POST /api/node-move request. ParentID "" moves the node to
+// the top level, into Folder if given. With Subtree the node's descendants
+// move with it; without, its children stay where they are and take its old
+// parent.
+type NodeMove struct {
+	ID       string `json:"id" validate:"required,max=128"`
+	ParentID string `json:"parent_id" validate:"max=128"`
+	Folder   string `json:"folder" validate:"max=500"`
+	Subtree  bool   `json:"subtree"`
+}
+
+// MovedNode is a node the move gave a new path or parent
+type MovedNode struct {
+	ID       string `json:"id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ParentID string `json:"parent_id,omitempty"`
+}
+
+// NodeMoveResult is what POST /api/node-move did
+type NodeMoveResult struct {
+	Moved             []MovedNode `json:"moved"`
+	ReferencesUpdated []string    `json:"references_updated"`
+}
+
+// childDir is the directory a node's children live in
+func childDir(p string) string {
+	return strings.TrimSuffix(p, path.Ext(p))
+}
+
+// POST /api/node-move {"id", "parent_id", "folder"?, "subtree"?}
+func handleNodeMove(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req NodeMove
+	if err := validate.DecodeJSON(r.Body, &req); err != nil {
+		validate.WriteError(w, err)
+		return
+	}
+	if req.ParentID != "" && req.Folder != "" {
+		validate.WriteError(w, validate.Errors{{Field: "folder", Message: "only applies to moves to the top level"}})
+		return
+	}
+	fail := func(code int, msg string) {
+		apierror.Write(w, code, msg)
+	}
+
+	nodeWriteMu.Lock()
+	defer nodeWriteMu.Unlock()
+	var siteID, oldParent, oldPath string
+	if err := db.QueryRow(`SELECT COALESCE(site_id, ''), COALESCE(parent_id, ''), path FROM nodes WHERE id = ? AND deleted_at IS NULL`, req.ID).
+		Scan(&siteID, &oldParent, &oldPath); err != nil || !canReadNode(r, req.ID) {
+		fail(http.StatusNotFound, "node not found")
+		return
+	}
+	if !canModifyNode(r, req.ID) {
+		fail(http.StatusForbidden, "only the node's owner can move it")
+		return
+	}
+
+	// the subtree, which the new parent must not be in
+	rows, err := db.Query(`WITH RECURSIVE sub(id) AS (
+			SELECT id FROM nodes WHERE parent_id = ? AND deleted_at IS NULL
+			UNION SELECT n.id FROM nodes n JOIN sub ON n.parent_id = sub.id WHERE n.deleted_at IS NULL)
+		SELECT n.id, COALESCE(n.parent_id, ''), n.path FROM nodes n JOIN sub ON sub.id = n.id ORDER BY n.path`, req.ID)
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	var descendants []MovedNode
+	for rows.Next() {
+		var d MovedNode
+		if err := rows.Scan(&d.ID, &d.ParentID, &d.From); err != nil {
+			rows.Close()
+			apierror.Internal(w, r, err)
+			return
+		}
+		if d.ID != req.ID {
+			descendants = append(descendants, d)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	dir := strings.Trim(path.Clean("/"+req.Folder), "/")
+	if req.ParentID != "" {
+		var parentSite, parentPath string
+		if err := db.QueryRow(`SELECT COALESCE(site_id, ''), path FROM nodes WHERE id = ? AND deleted_at IS NULL`, req.ParentID).
+			Scan(&parentSite, &parentPath); err != nil || !canReadNode(r, req.ParentID) {
+			fail(http.StatusNotFound, "parent not found")
+			return
+		}
+		if parentSite != siteID {
+			fail(http.StatusBadRequest, "the parent is in another site")
+			return
+		}
+		if req.ParentID == req.ID || containsMoved(descendants, req.ParentID) {
+			fail(http.StatusConflict, "a node can't be moved under itself")
+			return
+		}
+		dir = childDir(parentPath)
+	}
+
+	newPath := path.Base(oldPath)
+	if dir != "" {
+		newPath = dir + "/" + newPath
+	}
+	moves := []MovedNode{{ID: req.ID, From: oldPath, To: newPath, ParentID: req.ParentID}}
+	oldDir, newDir := childDir(oldPath)+"/", childDir(newPath)+"/"
+	for _, d := range descendants {
+		switch {
+		case req.Subtree && strings.HasPrefix(d.From, oldDir):
+			moves = append(moves, MovedNode{ID: d.ID, From: d.From, To: newDir + strings.TrimPrefix(d.From, oldDir), ParentID: d.ParentID})
+		case !req.Subtree && d.ParentID == req.ID:
+			// left behind under the old parent, where it keeps its path
+			moves = append(moves, MovedNode{ID: d.ID, From: d.From, To: d.From, ParentID: oldParent})
+		}
+	}
+	for _, m := range moves[1:] {
+		if !canModifyNode(r, m.ID) {
+			fail(http.StatusForbidden, "you can't modify every node the move changes")
+			return
+		}
+	}
+	for _, m := range moves {
+		var taken string
+		err := db.QueryRow(`SELECT id FROM nodes WHERE path = ? AND COALESCE(site_id, '') = ? AND deleted_at IS NULL AND id != ? LIMIT 1`, m.To, siteID, m.ID).Scan(&taken)
+		if err != nil && err != sql.ErrNoRows {
+			apierror.Internal(w, r, err)
+			return
+		}
+		if taken != "" && !containsMoved(moves, taken) {
+			fail(http.StatusConflict, "another node already has the path "+m.To)
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	for _, m := range moves {
+		if _, err := tx.Exec(`UPDATE nodes SET parent_id = ?, path = ?, modified_at = ? WHERE id = ?`, nullString(m.ParentID), m.To, now, m.ID); err != nil {
+			tx.Rollback()
+			apierror.Internal(w, r, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+
+	for _, m := range moves {
+		var n Node
+		if err := db.QueryRow(`SELECT type, COALESCE(title, '') FROM nodes WHERE id = ?`, m.ID).Scan(&n.Type, &n.Title); err != nil {
+			log.Printf("move of node %s: %v", m.ID, err)
+		}
+		events.Publish(events.NodeMoved, map[string]interface{}{
+			"id": m.ID, "type": n.Type, "path": m.To, "from": m.From, "parent_id": m.ParentID, "title": n.Title, "site_id": siteID,
+		})
+	}
+	json.NewEncoder(w).Encode(NodeMoveResult{Moved: moves, ReferencesUpdated: rewriteMovedLinks(moves, now)})
+}
+
+func containsMoved(list []MovedNode, id string) bool {
+	for _, m := range list {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteMovedLinks points the markdown and wiki links that reached a moved
+// node by its old path at the new one, recording a version of each node it
+// changes and resyncing its references. It returns the nodes it changed.
+func rewriteMovedLinks(moves []MovedNode, now int64) []string {
+	renamed := map[string]string{}
+	var targets []interface{}
+	for _, m := range moves {
+		if m.From != m.To {
+			renamed[m.From] = m.To
+			targets = append(targets, m.ID)
+		}
+	}
+	changed := []string{}
+	if len(targets) == 0 {
+		return changed
+	}
+	rows, err := db.Query(`SELECT DISTINCT n.id, COALESCE(n.site_id, ''), n.type, n.path, COALESCE(n.title, ''), COALESCE(n.content, '')
+		FROM node_references r JOIN nodes n ON n.id = r.source_node_id
+		WHERE r.link_type IN ('markdown', 'wiki') AND n.deleted_at IS NULL AND r.target_node_id IN (?`+strings.Repeat(`, ?`, len(targets)-1)+`)
+		ORDER BY n.id`, targets...)
+	if err != nil {
+		return changed
+	}
+	var sources []Node
+	for rows.Next() {
+		var n Node
+		if err := rows.Scan(&n.ID, &n.SiteID, &n.Type, &n.Path, &n.Title, &n.Content); err != nil {
+			log.Printf("links to moved nodes: %v", err)
+			continue
+		}
+		sources = append(sources, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("links to moved nodes: %v", err)
+	}
+
+	for _, n := range sources {
+		content := rewriteLinks(n.Content, renamed)
+		if content == n.Content {
+			continue
+		}
+		n.Content = content
+		db.Exec(`UPDATE nodes SET content = ?, modified_at = ? WHERE id = ?`, content, now, n.ID)
+		var versionNumber int
+		if err := db.QueryRow(`SELECT COALESCE(MAX(version_number), 0) FROM versions WHERE node_id = ?`, n.ID).Scan(&versionNumber); err != nil {
+			log.Printf("version of node %s: %v", n.ID, err)
+			continue
+		}
+		db.Exec(`UPDATE versions SET is_current = 0 WHERE node_id = ?`, n.ID)
+		db.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			ids.New("v"), n.ID, versionNumber+1, content, n.Title, "draft", now, now, 1)
+		syncNodeReferences(n.ID, n.SiteID, content)
+		publishNodeEvent(events.NodeUpdated, n)
+		changed = append(changed, n.ID)
+	}
+	return changed
+}
+
+// rewriteLinks replaces the renamed paths in markdown hrefs and wiki link
+// targets, keeping a leading / or ./, any ?query or #fragment, and a wiki
+// link's missing .md. Code is left alone.
+func rewriteLinks(content string, renamed map[string]string) string {
+	return outside(refFencedCode, content, func(s string) string {
+		return outside(refInlineCode, s, func(s string) string {
+			s = refMarkdownLink.ReplaceAllStringFunc(s, func(m string) string {
+				href := refMarkdownLink.FindStringSubmatch(m)[3]
+				rest, suffix := href, ""
+				if i := strings.IndexAny(href, "?#"); i >= 0 {
+					rest, suffix = href[:i], href[i:]
+				}
+				prefix := ""
+				for _, p := range []string{"./", "/"} {
+					if strings.HasPrefix(rest, p) {
+						prefix, rest = p, strings.TrimPrefix(rest, p)
+						break
+					}
+				}
+				to, ok := renamed[rest]
+				if !ok {
+					return m
+				}
+				i := strings.Index(m, "](")
+				return m[:i] + strings.Replace(m[i:], href, prefix+to+suffix, 1)
+			})
+			return refWikiLink.ReplaceAllStringFunc(s, func(m string) string {
+				sub := refWikiLink.FindStringSubmatch(m)
+				target := strings.TrimSpace(sub[1])
+				if to, ok := renamed[target]; ok {
+					return "[[" + to + sub[2] + sub[3] + "]]"
+				}
+				if to, ok := renamed[target+".md"]; ok {
+					return "[[" + strings.TrimSuffix(to, ".md") + sub[2] + sub[3] + "]]"
+				}
+				return m
+			})
+		})
+	})
+}
+
+// outside applies fn to the parts of s that re doesn't match
+func outside(re *regexp.Regexp, s string, fn func(string) string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(s, -1) {
+		b.WriteString(fn(s[last:loc[0]]))
+		b.WriteString(s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(fn(s[last:]))
+	return b.String()
+}
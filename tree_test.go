@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"veil/pkg/events"
+)
+
+func TestNodeTreeAndMove(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	move := func(req map[string]interface{}) (NodeMoveResult, int) {
+		rr := do("POST", "/api/node-move", req)
+		var res NodeMoveResult
+		json.NewDecoder(rr.Body).Decode(&res)
+		return res, rr.Code
+	}
+	nodePath := func(id string) (p, parent string) {
+		testDB.QueryRow(`SELECT path, COALESCE(parent_id, '') FROM nodes WHERE id = ?`, id).Scan(&p, &parent)
+		return
+	}
+	// outline renders a tree as "path" lines indented by depth
+	var outline func(entries []*TreeEntry, depth int) string
+	outline = func(entries []*TreeEntry, depth int) string {
+		var b strings.Builder
+		for _, e := range entries {
+			b.WriteString(strings.Repeat("  ", depth) + e.Kind + " " + e.Path + "\n")
+			b.WriteString(outline(e.Children, depth+1))
+		}
+		return b.String()
+	}
+
+	testDB.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES ('s1', 'Docs', '', 'project', 1, 1), ('s2', 'Other', '', 'project', 1, 1)`)
+	readme := "See [setup](/guides/setup.md#install), [[guides/setup]] and [[Setup]].\n\n```\n[raw](guides/setup.md)\n```\n"
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, parent_id, path, title, content, created_at, modified_at) VALUES
+		('g', 'page', 's1', NULL, 'guides.md', 'Guides', '', 1, 1),
+		('g1', 'page', 's1', 'g', 'guides/setup.md', 'Setup', '', 1, 1),
+		('g2', 'page', 's1', 'g1', 'guides/setup/advanced.md', 'Advanced', '', 1, 1),
+		('n', 'note', 's1', NULL, 'notes/todo.md', 'Todo', '', 1, 1),
+		('a', 'page', 's1', NULL, 'archive.md', 'Archive', '', 1, 1),
+		('r', 'page', 's1', NULL, 'readme.md', 'Readme', ?, 1, 1),
+		('o', 'page', 's2', NULL, 'other.md', 'Other', '', 1, 1)`, readme)
+	syncNodeReferences("r", "s1", readme)
+
+	var tree []*TreeEntry
+	json.NewDecoder(do("GET", "/api/tree?site_id=s1", nil).Body).Decode(&tree)
+	want := `folder notes
+  node notes/todo.md
+node archive.md
+node guides.md
+  node guides/setup.md
+    node guides/setup/advanced.md
+node readme.md
+`
+	if got := outline(tree, 0); got != want {
+		t.Fatalf("unexpected tree:\n%s\nwant:\n%s", got, want)
+	}
+
+	sub := events.Subscribe(16, events.NodeMoved)
+	defer sub.Close()
+
+	// the subtree follows, and links by path follow it
+	res, code := move(map[string]interface{}{"id": "g1", "parent_id": "a", "subtree": true})
+	if code != http.StatusOK || len(res.Moved) != 2 || len(res.ReferencesUpdated) != 1 || res.ReferencesUpdated[0] != "r" {
+		t.Fatalf("move: %d %+v", code, res)
+	}
+	if p, parent := nodePath("g1"); p != "archive/setup.md" || parent != "a" {
+		t.Fatalf("g1 should be under archive: %s %s", p, parent)
+	}
+	if p, parent := nodePath("g2"); p != "archive/setup/advanced.md" || parent != "g1" {
+		t.Fatalf("g2 should follow g1: %s %s", p, parent)
+	}
+	var content string
+	testDB.QueryRow(`SELECT content FROM nodes WHERE id = 'r'`).Scan(&content)
+	wantContent := "See [setup](/archive/setup.md#install), [[archive/setup]] and [[Setup]].\n\n```\n[raw](guides/setup.md)\n```\n"
+	if content != wantContent {
+		t.Fatalf("links should follow the move, code should not:\n%s", content)
+	}
+	var refs, versions int
+	testDB.QueryRow(`SELECT COUNT(*) FROM node_references WHERE source_node_id = 'r' AND target_node_id = 'g1'`).Scan(&refs)
+	testDB.QueryRow(`SELECT COUNT(*) FROM versions WHERE node_id = 'r'`).Scan(&versions)
+	if refs != 2 || versions != 1 {
+		t.Fatalf("the referrer should keep its references and get a version: %d refs, %d versions", refs, versions)
+	}
+	select {
+	case ev := <-sub.C:
+		data := ev.Data.(map[string]interface{})
+		if data["id"] != "g1" || data["from"] != "guides/setup.md" || data["path"] != "archive/setup.md" {
+			t.Fatalf("unexpected event: %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a move should be announced")
+	}
+
+	// without the subtree, children stay and take the old parent
+	res, code = move(map[string]interface{}{"id": "g1", "parent_id": "", "folder": "notes"})
+	if code != http.StatusOK || len(res.Moved) != 2 {
+		t.Fatalf("move to the top: %d %+v", code, res)
+	}
+	if p, parent := nodePath("g1"); p != "notes/setup.md" || parent != "" {
+		t.Fatalf("g1 should be in notes at the top level: %s %q", p, parent)
+	}
+	if p, parent := nodePath("g2"); p != "archive/setup/advanced.md" || parent != "a" {
+		t.Fatalf("g2 should stay behind under archive: %s %s", p, parent)
+	}
+
+	if _, code := move(map[string]interface{}{"id": "a", "parent_id": "g2"}); code != http.StatusConflict {
+		t.Fatalf("moving a node under its own child should conflict: %d", code)
+	}
+	testDB.Exec(`INSERT INTO nodes (id, type, site_id, path, title, content, created_at, modified_at) VALUES ('k', 'page', 's1', 'archive/readme.md', 'Old readme', '', 1, 1)`)
+	if _, code := move(map[string]interface{}{"id": "r", "parent_id": "a"}); code != http.StatusConflict {
+		t.Fatalf("a move onto a taken path should conflict: %d", code)
+	}
+	if _, code := move(map[string]interface{}{"id": "r", "parent_id": "o"}); code != http.StatusBadRequest {
+		t.Fatalf("a parent in another site should be refused: %d", code)
+	}
+	if _, code := move(map[string]interface{}{"id": "r", "parent_id": "a", "folder": "x"}); code != http.StatusBadRequest {
+		t.Fatalf("folder only applies at the top level: %d", code)
+	}
+	if _, code := move(map[string]interface{}{"id": "missing"}); code != http.StatusNotFound {
+		t.Fatalf("moving a missing node: %d", code)
+	}
+}
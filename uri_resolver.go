@@ -8,6 +8,10 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"veil/pkg/apierror"
+	"veil/pkg/ids"
+	"veil/pkg/validate"
 )
 
 // === URI Resolution System ===
@@ -83,7 +87,7 @@ func (ur *URIResolver) GetNodeURI(nodeID string) (string, error) {
 
 // RegisterNodeURI creates a custom URI alias for a node
 func (ur *URIResolver) RegisterNodeURI(nodeID, customURI string, isPrimary bool) error {
-	id := fmt.Sprintf("uri_%d", time.Now().UnixNano())
+	id := ids.New("uri")
 	now := time.Now().Unix()
 
 	primary := 0
@@ -117,13 +121,15 @@ func (ur *URIResolver) GetAllNodeURIs(nodeID string) ([]NodeURI, error) {
 		var createdAt int64
 		var isPrimary int
 
-		rows.Scan(&u.ID, &u.NodeID, &u.URI, &isPrimary, &createdAt)
+		if err := rows.Scan(&u.ID, &u.NodeID, &u.URI, &isPrimary, &createdAt); err != nil {
+			return nil, err
+		}
 		u.IsPrimary = isPrimary == 1
 		u.CreatedAt = time.Unix(createdAt, 0)
 		uris = append(uris, u)
 	}
 
-	return uris, nil
+	return uris, rows.Err()
 }
 
 var uriResolver *URIResolver
@@ -144,29 +150,28 @@ func handleNodeURIs(w http.ResponseWriter, r *http.Request) {
 			// Get all URIs for a node
 			uris, err := uriResolver.GetAllNodeURIs(nodeID)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				apierror.Internal(w, r, err)
 				return
 			}
 			json.NewEncoder(w).Encode(uris)
 		} else {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "node_id required"})
+			apierror.Write(w, http.StatusBadRequest, "node_id required")
 		}
 	} else if r.Method == "POST" {
 		// Create new URI alias
 		var req struct {
-			NodeID    string `json:"node_id"`
-			URI       string `json:"uri"`
+			NodeID    string `json:"node_id" validate:"required,max=128"`
+			URI       string `json:"uri" validate:"required,max=2048"`
 			IsPrimary bool   `json:"is_primary"`
 		}
-
-		json.NewDecoder(r.Body).Decode(&req)
+		if err := validate.DecodeJSON(r.Body, &req); err != nil {
+			validate.WriteError(w, err)
+			return
+		}
 
 		err := uriResolver.RegisterNodeURI(req.NodeID, req.URI, req.IsPrimary)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 
@@ -177,8 +182,7 @@ func handleNodeURIs(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		_, err := db.Exec(`DELETE FROM node_uris WHERE id = ?`, id)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			apierror.Internal(w, r, err)
 			return
 		}
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
@@ -191,8 +195,7 @@ func handleResolveURI(w http.ResponseWriter, r *http.Request) {
 
 	uri := r.URL.Query().Get("uri")
 	if uri == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "uri parameter required"})
+		apierror.Write(w, http.StatusBadRequest, "uri parameter required")
 		return
 	}
 
@@ -203,8 +206,7 @@ func handleResolveURI(w http.ResponseWriter, r *http.Request) {
 
 	node, err := uriResolver.ResolveURI(uri)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Write(w, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -217,15 +219,13 @@ func handleGenerateURI(w http.ResponseWriter, r *http.Request) {
 
 	nodeID := r.URL.Query().Get("node_id")
 	if nodeID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "node_id parameter required"})
+		apierror.Write(w, http.StatusBadRequest, "node_id parameter required")
 		return
 	}
 
 	uri, err := uriResolver.GetNodeURI(nodeID)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		apierror.Write(w, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -10,6 +10,7 @@ import (
 
 // markdownToHTML converts basic markdown to HTML
 func markdownToHTML(markdown string) string {
+	markdown = stripFrontMatter(markdown)
 	if markdown == "" {
 		return ""
 	}
@@ -27,13 +28,17 @@ func markdownToHTML(markdown string) string {
 	result = regexp.MustCompile(`\*\*\*(.*?)\*\*\*`).ReplaceAllString(result, "<strong><em>$1</em></strong>")
 	result = regexp.MustCompile(`\*\*(.*?)\*\*`).ReplaceAllString(result, "<strong>$1</strong>")
 	result = regexp.MustCompile(`\*(.*?)\*`).ReplaceAllString(result, "<em>$1</em>")
-	result = regexp.MustCompile(`___(.*?)___`).ReplaceAllString(result, "<strong><em>$1</em></strong>")
-	result = regexp.MustCompile(`__(.*?)__`).ReplaceAllString(result, "<strong>$1</strong>")
-	result = regexp.MustCompile(`_(.*?)_`).ReplaceAllString(result, "<em>$1</em>")
+	// underscores inside words, as in file names, are not emphasis
+	result = regexp.MustCompile(`(^|[^\w])___(.*?)___($|[^\w])`).ReplaceAllString(result, "$1<strong><em>$2</em></strong>$3")
+	result = regexp.MustCompile(`(^|[^\w])__(.*?)__($|[^\w])`).ReplaceAllString(result, "$1<strong>$2</strong>$3")
+	result = regexp.MustCompile(`(^|[^\w])_(.*?)_($|[^\w])`).ReplaceAllString(result, "$1<em>$2</em>$3")
 
 	// Code
 	result = regexp.MustCompile("`([^`]+)`").ReplaceAllString(result, "<code>$1</code>")
 
+	// Images, before the links they look like
+	result = regexp.MustCompile(`!\[([^\]]*)\]\(([^\)\s]+)\)`).ReplaceAllString(result, `<img src="$2" alt="$1">`)
+
 	// Links
 	result = regexp.MustCompile(`\[([^\]]+)\]\(([^\)]+)\)`).ReplaceAllString(result, `<a href="$2">$1</a>`)
 
@@ -134,8 +139,8 @@ func truncate(s string, maxLen int) string {
 
 // excerpt generates an excerpt from markdown content
 func excerpt(content string, maxLen int) string {
-	// Strip markdown syntax
-	text := content
+	// Strip front matter and markdown syntax
+	text := stripFrontMatter(content)
 	text = regexp.MustCompile(`#+ `).ReplaceAllString(text, "")
 	text = regexp.MustCompile(`\*\*?(.*?)\*\*?`).ReplaceAllString(text, "$1")
 	text = regexp.MustCompile(`\[(.*?)\]\(.*?\)`).ReplaceAllString(text, "$1")
@@ -152,3 +157,11 @@ func excerpt(content string, maxLen int) string {
 
 	return truncate(text, maxLen)
 }
+
+// boolToInt stores a bool in an INTEGER column
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
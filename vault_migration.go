@@ -0,0 +1,507 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"veil/pkg/ids"
+)
+
+// === Vault Migration ===
+// Databases from v0.x vaults predate columns the current code takes for
+// granted, like nodes.slug, site_id and canonical_uri, so the embedded
+// migrations alone can't bring them up: CREATE TABLE IF NOT EXISTS leaves
+// their tables as they are. `veil migrate vault --from OLD.db` copies such a
+// database into a vault, adds the missing columns, runs the migrations and
+// backfills what the new columns should have held, then reports what it did.
+// The old database is only read.
+
+// VaultMigrationReport is what migrating a v0.x database found and did.
+// Variant is "current" when the database already had the current schema.
+type VaultMigrationReport struct {
+	From           string         `json:"from"`
+	To             string         `json:"to"`
+	DryRun         bool           `json:"dry_run"`
+	Variant        string         `json:"variant"`
+	MissingColumns []string       `json:"missing_columns,omitempty"`
+	CreatedTables  []string       `json:"created_tables,omitempty"`
+	ExtraColumns   []string       `json:"extra_columns,omitempty"`
+	Unresolved     []string       `json:"unresolved,omitempty"`
+	DefaultSite    string         `json:"default_site,omitempty"`
+	Backfilled     map[string]int `json:"backfilled"`
+}
+
+// sqlColumn is a column as PRAGMA table_info describes it
+type sqlColumn struct {
+	name, typ string
+	notNull   bool
+	dflt      sql.NullString
+	pk        bool
+}
+
+// schemaColumns lists the columns of every table of a database
+func schemaColumns(d *sql.DB) (map[string][]sqlColumn, error) {
+	rows, err := d.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	schema := map[string][]sqlColumn{}
+	for _, t := range tables {
+		cols, err := d.Query(`SELECT name, type, "notnull", dflt_value, pk > 0 FROM pragma_table_info(?)`, t)
+		if err != nil {
+			return nil, err
+		}
+		for cols.Next() {
+			var c sqlColumn
+			if err := cols.Scan(&c.name, &c.typ, &c.notNull, &c.dflt, &c.pk); err != nil {
+				cols.Close()
+				return nil, err
+			}
+			schema[t] = append(schema[t], c)
+		}
+		cols.Close()
+		if err := cols.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return schema, nil
+}
+
+// currentSchema is the schema the embedded migrations make
+func currentSchema() (map[string][]sqlColumn, error) {
+	ref, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer ref.Close()
+	applyMigrations(ref)
+	return schemaColumns(ref)
+}
+
+// missingColumns is what old lacks of the tables both schemas have
+func missingColumns(old, current map[string][]sqlColumn) map[string][]sqlColumn {
+	missing := map[string][]sqlColumn{}
+	for table, cols := range old {
+		have := map[string]bool{}
+		for _, c := range cols {
+			have[c.name] = true
+		}
+		for _, c := range current[table] {
+			if !have[c.name] {
+				missing[table] = append(missing[table], c)
+			}
+		}
+	}
+	return missing
+}
+
+// upgradeSchema adds the columns a database lacks and runs the migrations
+// over it. A column SQLite can't add (a primary key) is left unresolved;
+// NOT NULL ones without a default go in nullable, to be backfilled.
+func upgradeSchema(d *sql.DB, report *VaultMigrationReport) error {
+	current, err := currentSchema()
+	if err != nil {
+		return err
+	}
+	old, err := schemaColumns(d)
+	if err != nil {
+		return err
+	}
+	if _, ok := old["nodes"]; !ok {
+		return errors.New("no nodes table: not a veil database")
+	}
+
+	missing := missingColumns(old, current)
+	for _, table := range sortedKeys(missing) {
+		for _, c := range missing[table] {
+			report.MissingColumns = append(report.MissingColumns, table+"."+c.name)
+			if c.pk {
+				continue
+			}
+			stmt := fmt.Sprintf(`ALTER TABLE %q ADD COLUMN %q %s`, table, c.name, c.typ)
+			if c.dflt.Valid {
+				stmt += " DEFAULT " + c.dflt.String
+			}
+			if _, err := d.Exec(stmt); err != nil {
+				return fmt.Errorf("adding %s.%s: %w", table, c.name, err)
+			}
+		}
+	}
+	for _, table := range sortedKeys(old) {
+		known := map[string]bool{}
+		for _, c := range current[table] {
+			known[c.name] = true
+		}
+		for _, c := range old[table] {
+			if current[table] != nil && !known[c.name] {
+				report.ExtraColumns = append(report.ExtraColumns, table+"."+c.name)
+			}
+		}
+	}
+	for _, table := range sortedKeys(current) {
+		if _, ok := old[table]; !ok {
+			report.CreatedTables = append(report.CreatedTables, table)
+		}
+	}
+	report.Variant = "current"
+	if len(report.MissingColumns) > 0 {
+		report.Variant = "v0.x"
+	}
+
+	// the migrations log each ALTER of a column added above; those aren't
+	// news, and what they failed to do shows up in the check after
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	applyMigrations(d)
+	log.SetOutput(out)
+
+	upgraded, err := schemaColumns(d)
+	if err != nil {
+		return err
+	}
+	for _, table := range sortedKeys(current) {
+		if upgraded[table] == nil {
+			report.Unresolved = append(report.Unresolved, "table "+table+" could not be created")
+		}
+	}
+	left := missingColumns(upgraded, current)
+	for _, table := range sortedKeys(left) {
+		for _, c := range left[table] {
+			report.Unresolved = append(report.Unresolved, table+"."+c.name+" could not be added")
+		}
+	}
+	return nil
+}
+
+// added reports whether the migration added a column
+func (report *VaultMigrationReport) added(column string) bool {
+	for _, c := range report.MissingColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// backfillVault fills in what the added columns should have held: slugs from
+// titles, one per site; a default site for nodes from before sites; times,
+// status and paths; a first version for nodes without one; and the link
+// index, rebuilt from content. It runs against the global db.
+func backfillVault(report *VaultMigrationReport) error {
+	count := func(key, query string, args ...interface{}) error {
+		res, err := db.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			report.Backfilled[key] += int(n)
+		}
+		return nil
+	}
+	now := time.Now().Unix()
+	if err := count("created_at", `UPDATE nodes SET created_at = COALESCE(NULLIF(modified_at, 0), ?) WHERE created_at IS NULL OR created_at = 0`, now); err != nil {
+		return err
+	}
+	if err := count("modified_at", `UPDATE nodes SET modified_at = created_at WHERE modified_at IS NULL OR modified_at = 0`); err != nil {
+		return err
+	}
+	if err := count("status", `UPDATE nodes SET status = 'draft' WHERE status IS NULL OR status = ''`); err != nil {
+		return err
+	}
+	if err := count("type", `UPDATE nodes SET type = 'note' WHERE type IS NULL OR type = ''`); err != nil {
+		return err
+	}
+
+	// nodes from before sites join one: the vault's only site, or a new one
+	if report.added("nodes.site_id") {
+		var sites int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sites`).Scan(&sites); err != nil {
+			return fmt.Errorf("default site: %w", err)
+		}
+		if sites == 1 {
+			if err := db.QueryRow(`SELECT id FROM sites`).Scan(&report.DefaultSite); err != nil {
+				return fmt.Errorf("default site: %w", err)
+			}
+		} else {
+			report.DefaultSite = ids.New("site")
+			if _, err := db.Exec(`INSERT INTO sites (id, name, description, type, created_at, modified_at) VALUES (?, 'Default', 'Nodes migrated from a v0.x vault', 'project', ?, ?)`,
+				report.DefaultSite, now, now); err != nil {
+				return fmt.Errorf("default site: %w", err)
+			}
+		}
+		if err := count("site_id", `UPDATE nodes SET site_id = ? WHERE site_id IS NULL OR site_id = ''`, report.DefaultSite); err != nil {
+			return err
+		}
+	}
+
+	// slugs from titles, falling back to the file name, unique in each site
+	rows, err := db.Query(`SELECT id, COALESCE(site_id, ''), COALESCE(title, ''), COALESCE(path, ''), COALESCE(slug, '') FROM nodes ORDER BY created_at, id`)
+	if err != nil {
+		return err
+	}
+	type slugRow struct{ id, site, title, path, slug string }
+	var nodes []slugRow
+	for rows.Next() {
+		var n slugRow
+		if err := rows.Scan(&n.id, &n.site, &n.title, &n.path, &n.slug); err != nil {
+			rows.Close()
+			return err
+		}
+		nodes = append(nodes, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	taken := map[string]bool{}
+	for _, n := range nodes {
+		if n.slug != "" {
+			taken[n.site+"\x00"+n.slug] = true
+		}
+	}
+	for _, n := range nodes {
+		if n.slug != "" {
+			continue
+		}
+		base := slugify(n.title)
+		if base == "" {
+			base = slugify(strings.TrimSuffix(filepath.Base(n.path), filepath.Ext(n.path)))
+		}
+		if base == "" {
+			base = slugify(n.id)
+		}
+		slug := base
+		for i := 2; taken[n.site+"\x00"+slug]; i++ {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		taken[n.site+"\x00"+slug] = true
+		if err := count("slug", `UPDATE nodes SET slug = ? WHERE id = ?`, slug, n.id); err != nil {
+			return err
+		}
+	}
+	if err := count("path", `UPDATE nodes SET path = slug || '.md' WHERE path IS NULL OR path = ''`); err != nil {
+		return err
+	}
+
+	var unversioned []string
+	rows, err = db.Query(`SELECT id FROM nodes n WHERE NOT EXISTS (SELECT 1 FROM versions v WHERE v.node_id = n.id)`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		unversioned = append(unversioned, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range unversioned {
+		if err := count("versions", `INSERT INTO versions (id, node_id, version_number, content, title, status, created_at, modified_at, is_current)
+			SELECT ?, id, 1, content, title, status, created_at, modified_at, 1 FROM nodes WHERE id = ?`, ids.New("v"), id); err != nil {
+			return err
+		}
+	}
+
+	// the link index is rebuilt from content, as old vaults may not have one
+	rows, err = db.Query(`SELECT id, COALESCE(site_id, ''), COALESCE(content, '') FROM nodes WHERE deleted_at IS NULL`)
+	if err != nil {
+		return err
+	}
+	type linkRow struct{ id, site, content string }
+	var live []linkRow
+	for rows.Next() {
+		var n linkRow
+		if err := rows.Scan(&n.id, &n.site, &n.content); err != nil {
+			rows.Close()
+			return err
+		}
+		live = append(live, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var all []string
+	for _, n := range live {
+		if err := syncNodeReferences(n.id, n.site, n.content); err != nil {
+			return fmt.Errorf("links of %s: %w", n.id, err)
+		}
+		all = append(all, n.id)
+	}
+	var refs int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM node_references`).Scan(&refs); err != nil {
+		return err
+	}
+	report.Backfilled["references"] = refs
+	return recountBacklinks(db, all)
+}
+
+// migrateVault brings the database at from into the vault dir as its
+// veil.db. With dryRun the work is done on a scratch copy and thrown away.
+// A vault that already has a database is only migrated in place, when from
+// is that database; it is backed up beside itself first.
+func migrateVault(from, dir string, dryRun bool) (*VaultMigrationReport, error) {
+	from, err := filepath.Abs(from)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(from); err != nil {
+		return nil, err
+	}
+	if dir, err = expandVaultPath(dir); err != nil {
+		return nil, err
+	}
+	dest := filepath.Join(dir, vaultDBName)
+	report := &VaultMigrationReport{From: from, To: dest, DryRun: dryRun, Backfilled: map[string]int{}}
+
+	inPlace := dest == from
+	if _, err := os.Stat(dest); err == nil && !inPlace {
+		return nil, fmt.Errorf("%s already has a database; migrate into a new directory", dir)
+	}
+	work := dest
+	if dryRun {
+		tmp, err := os.MkdirTemp("", "veil-migrate-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		work = filepath.Join(tmp, vaultDBName)
+	} else if inPlace {
+		backup := fmt.Sprintf("%s.v0-%s.bak", from, time.Now().UTC().Format("20060102T150405Z"))
+		if err := copySQLite(from, backup); err != nil {
+			return nil, fmt.Errorf("backup: %w", err)
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if work != from {
+		if err := copySQLite(from, work); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err := sql.Open("sqlite", work)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	if err := upgradeSchema(d, report); err != nil {
+		return nil, err
+	}
+	prev := db
+	db = d
+	defer func() { db = prev }()
+	if err := backfillVault(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// copySQLite copies a database consistently, whatever its journal holds
+func copySQLite(from, to string) error {
+	src, err := sql.Open("sqlite", "file:"+from+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = src.Exec(`VACUUM INTO ?`, to)
+	return err
+}
+
+// migrateVaultCommand is `veil migrate vault --from OLD.db [--to DIR]
+// [--dry-run] [--json]`
+func migrateVaultCommand(args []string) {
+	usage := "Usage: veil migrate vault --from <old-db> [--to DIR] [--dry-run] [--json]"
+	var from string
+	to := "."
+	dryRun, asJSON := false, false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--from" && i+1 < len(args):
+			i++
+			from = args[i]
+		case args[i] == "--to" && i+1 < len(args):
+			i++
+			to = args[i]
+		case args[i] == "--dry-run":
+			dryRun = true
+		case args[i] == "--json":
+			asJSON = true
+		default:
+			fmt.Println(usage)
+			return
+		}
+	}
+	if from == "" {
+		fmt.Println(usage)
+		return
+	}
+	report, err := migrateVault(from, to, dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !dryRun {
+		if _, err := registerVault(filepath.Dir(report.To), "", false); err != nil {
+			log.Printf("warning: failed to update vault registry: %v", err)
+		}
+	}
+	if asJSON {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
+	fmt.Printf("%s: %s schema\n", report.From, report.Variant)
+	if len(report.MissingColumns) > 0 {
+		fmt.Printf("added columns: %s\n", strings.Join(report.MissingColumns, ", "))
+	}
+	if len(report.CreatedTables) > 0 {
+		fmt.Printf("created tables: %s\n", strings.Join(report.CreatedTables, ", "))
+	}
+	if len(report.ExtraColumns) > 0 {
+		fmt.Printf("kept unknown columns: %s\n", strings.Join(report.ExtraColumns, ", "))
+	}
+	if report.DefaultSite != "" {
+		fmt.Printf("nodes without a site joined %s\n", report.DefaultSite)
+	}
+	for _, key := range sortedKeys(report.Backfilled) {
+		fmt.Printf("backfilled %s: %d\n", key, report.Backfilled[key])
+	}
+	for _, u := range report.Unresolved {
+		fmt.Printf("UNRESOLVED: %s\n", u)
+	}
+	if dryRun {
+		fmt.Println("dry-run: nothing was written")
+	} else {
+		fmt.Printf("migrated into %s\n", report.To)
+	}
+	if len(report.Unresolved) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMigrateV0Vault(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// a vault from before sites, slugs, URIs and versions
+	tmp := t.TempDir()
+	oldPath := filepath.Join(tmp, "old.db")
+	old, err := sql.Open("sqlite", oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE nodes (id TEXT PRIMARY KEY, type TEXT NOT NULL, path TEXT NOT NULL, title TEXT, content TEXT, legacy_flag INTEGER, created_at INTEGER NOT NULL)`,
+		`CREATE TABLE tags (id TEXT PRIMARY KEY, name TEXT UNIQUE NOT NULL)`,
+		`INSERT INTO nodes (id, type, path, title, content, created_at) VALUES
+			('n1', 'note', 'hello.md', 'Hello World', 'see [[Other]]', 100),
+			('n2', 'note', 'hello-again.md', 'Hello World', '', 200),
+			('n3', 'post', 'notes/other.md', 'Other', '', 300),
+			('n4', '', 'untitled.md', '', '', 400)`,
+	} {
+		if _, err := old.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+	before, _ := os.ReadFile(oldPath)
+
+	dest := filepath.Join(tmp, "vault")
+	dry, err := migrateVault(oldPath, dest, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Fatal("a dry run should write nothing")
+	}
+
+	report, err := migrateVault(oldPath, dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db != testDB {
+		t.Fatal("the global database should be given back")
+	}
+	if after, _ := os.ReadFile(oldPath); string(after) != string(before) {
+		t.Fatal("the old database should only be read")
+	}
+	if report.Variant != "v0.x" || len(report.Unresolved) != 0 || report.DefaultSite == "" {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, col := range []string{"nodes.slug", "nodes.site_id", "nodes.canonical_uri", "nodes.modified_at", "tags.color"} {
+		if !slices.Contains(report.MissingColumns, col) {
+			t.Fatalf("%s should be reported added: %v", col, report.MissingColumns)
+		}
+	}
+	if !slices.Contains(report.CreatedTables, "versions") || !slices.Equal(report.ExtraColumns, []string{"nodes.legacy_flag"}) {
+		t.Fatalf("unexpected tables and columns: %+v", report)
+	}
+	if report.Backfilled["slug"] != 4 || report.Backfilled["site_id"] != 4 || report.Backfilled["versions"] != 4 || report.Backfilled["references"] != 1 {
+		t.Fatalf("unexpected backfills: %v", report.Backfilled)
+	}
+	if dry.Variant != report.Variant || len(dry.MissingColumns) != len(report.MissingColumns) || dry.Backfilled["slug"] != 4 {
+		t.Fatalf("a dry run should report what the migration does: %+v", dry)
+	}
+
+	d, err := sql.Open("sqlite", filepath.Join(dest, vaultDBName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var got []string
+	rows, _ := d.Query(`SELECT id || ':' || slug || ':' || site_id || ':' || type || ':' || status || ':' || modified_at || ':' || backlink_count FROM nodes ORDER BY id`)
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		got = append(got, strings.Replace(s, report.DefaultSite, "S", 1))
+	}
+	rows.Close()
+	want := []string{"n1:hello-world:S:note:draft:100:0", "n2:hello-world-2:S:note:draft:200:0", "n3:other:S:post:draft:300:1", "n4:untitled:S:note:draft:400:0"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("unexpected nodes:\n got %v\nwant %v", got, want)
+	}
+	var name string
+	d.QueryRow(`SELECT name FROM sites WHERE id = ?`, report.DefaultSite).Scan(&name)
+	if name != "Default" {
+		t.Fatalf("expected a default site, got %q", name)
+	}
+
+	if _, err := migrateVault(oldPath, dest, false); err == nil || !strings.Contains(err.Error(), "already has a database") {
+		t.Fatalf("migrating over a vault's database should be refused: %v", err)
+	}
+	// migrated again in place, the current schema needs nothing
+	again, err := migrateVault(filepath.Join(dest, vaultDBName), dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Variant != "current" || len(again.MissingColumns) != 0 || again.Backfilled["slug"] != 0 || again.Backfilled["versions"] != 0 {
+		t.Fatalf("a current database should need no changes: %+v", again)
+	}
+	if backups, _ := filepath.Glob(filepath.Join(dest, "veil.db.v0-*.bak")); len(backups) != 1 {
+		t.Fatalf("an in-place migration should back up first: %v", backups)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"veil/pkg/apierror"
+	codexpkg "veil/pkg/codex"
+	fsstorage "veil/pkg/codex/storage/fs"
+	plugins "veil/pkg/plugins"
+)
+
+// === Vaults ===
+
+// A vault is a directory holding veil.db, media/ and .codex/. Known vaults
+// are kept in a user-level registry so the GUI can list and switch between
+// them instead of assuming the current directory.
+
+const vaultDBName = "veil.db"
+
+// VaultEntry is one registered vault
+type VaultEntry struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	LastOpened int64  `json:"last_opened"`
+}
+
+type vaultRegistry struct {
+	Vaults []VaultEntry `json:"vaults"`
+}
+
+// vaultMu serialises registry writes and vault switches
+var vaultMu sync.Mutex
+
+// currentVault is the directory of the open vault
+var currentVault string
+
+// vaultDatabase is the postgres:// URL of the database vaults use instead
+// of their veil.db, set by --db or the database setting. The vault
+// directory still holds media/ and .codex/.
+var vaultDatabase string
+
+// vaultRegistryFile is $VEIL_VAULTS_FILE, or vaults.json in the user config dir
+func vaultRegistryFile() string {
+	if p := os.Getenv("VEIL_VAULTS_FILE"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "veil", "vaults.json")
+}
+
+func loadVaultRegistry() vaultRegistry {
+	var reg vaultRegistry
+	if b, err := os.ReadFile(vaultRegistryFile()); err == nil {
+		json.Unmarshal(b, &reg)
+	}
+	return reg
+}
+
+func saveVaultRegistry(reg vaultRegistry) error {
+	path := vaultRegistryFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	b, _ := json.MarshalIndent(reg, "", "  ")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// expandVaultPath resolves ~ and makes dir absolute
+func expandVaultPath(dir string) (string, error) {
+	if strings.HasPrefix(dir, "~/") {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, dir[2:])
+	}
+	// accept a path to the database itself
+	if filepath.Base(dir) == vaultDBName {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// registerVault adds or refreshes dir in the registry. An empty name keeps
+// the existing one or falls back to the directory name.
+func registerVault(dir, name string, opened bool) (VaultEntry, error) {
+	reg := loadVaultRegistry()
+	entry := VaultEntry{Name: name, Path: dir}
+	found := false
+	for i, v := range reg.Vaults {
+		if v.Path == dir {
+			if name == "" {
+				reg.Vaults[i].Name = v.Name
+			} else {
+				reg.Vaults[i].Name = name
+			}
+			if opened {
+				reg.Vaults[i].LastOpened = time.Now().Unix()
+			}
+			entry = reg.Vaults[i]
+			found = true
+			if opened {
+				// most recent first, so ties within a second keep their order
+				reg.Vaults = append(reg.Vaults[:i], reg.Vaults[i+1:]...)
+				reg.Vaults = append([]VaultEntry{entry}, reg.Vaults...)
+			}
+			break
+		}
+	}
+	if !found {
+		if entry.Name == "" {
+			entry.Name = filepath.Base(dir)
+		}
+		if opened {
+			entry.LastOpened = time.Now().Unix()
+			reg.Vaults = append([]VaultEntry{entry}, reg.Vaults...)
+		} else {
+			reg.Vaults = append(reg.Vaults, entry)
+		}
+	}
+	return entry, saveVaultRegistry(reg)
+}
+
+// lookupVault finds a registered vault by name or path
+func lookupVault(ref string) (VaultEntry, bool) {
+	abs, _ := expandVaultPath(ref)
+	for _, v := range loadVaultRegistry().Vaults {
+		if v.Name == ref || v.Path == abs {
+			return v, true
+		}
+	}
+	return VaultEntry{}, false
+}
+
+// lastOpenedVault is the most recently opened registered vault that still exists
+func lastOpenedVault() string {
+	vaults := loadVaultRegistry().Vaults
+	sort.SliceStable(vaults, func(i, j int) bool { return vaults[i].LastOpened > vaults[j].LastOpened })
+	for _, v := range vaults {
+		if _, err := os.Stat(filepath.Join(v.Path, vaultDBName)); err == nil {
+			return v.Path
+		}
+	}
+	return ""
+}
+
+// openVault makes dir the working vault: it opens and migrates its database,
+// or vaultDatabase when that's set, moves into the directory so media and
+// codex paths resolve inside it, and rebinds everything holding the previous
+// database. The previous database is closed.
+func openVault(dir string) error {
+	dir, err := expandVaultPath(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, vaultDBName)
+	if vaultDatabase != "" {
+		path = vaultDatabase
+	}
+	database, err := openDB(path)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := database.Ping(); err != nil {
+		database.Close()
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := applyMigrations(database); err != nil {
+		database.Close()
+		return fmt.Errorf("migrations failed (see veil migrate): %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		database.Close()
+		return err
+	}
+
+	old := db
+	db = database
+	dbPath = ""
+	if vaultDatabase == "" {
+		dbPath = path
+	}
+	currentVault = dir
+	if old != nil && old != database {
+		old.Close()
+	}
+
+	initURIResolver()
+	vaultUsageCache.Lock()
+	vaultUsageCache.at = time.Time{}
+	vaultUsageCache.Unlock()
+
+	plugins.Open(plugins.Host{
+		DB:         db,
+		Repository: codexpkg.NewRepository(fsstorage.New("."), "."),
+		Passphrase: plugins.CredentialPassphrase(),
+		PluginsDir: "plugins",
+	})
+
+	if _, err := registerVault(dir, "", true); err != nil {
+		log.Printf("warning: failed to update vault registry: %v", err)
+	}
+	return nil
+}
+
+// handleVaults serves /api/vaults:
+// GET lists registered vaults, marking the open one;
+// POST {name, path} creates (when missing) and registers a vault;
+// DELETE ?path= forgets a vault without touching its files.
+// They reach outside the open vault, so all need an admin.
+func handleVaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can manage vaults")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		vaults := loadVaultRegistry().Vaults
+		sort.SliceStable(vaults, func(i, j int) bool { return vaults[i].LastOpened > vaults[j].LastOpened })
+		out := []map[string]interface{}{}
+		for _, v := range vaults {
+			_, err := os.Stat(filepath.Join(v.Path, vaultDBName))
+			out = append(out, map[string]interface{}{
+				"name":        v.Name,
+				"path":        v.Path,
+				"last_opened": v.LastOpened,
+				"exists":      err == nil,
+				"current":     v.Path == currentVault,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"current": currentVault, "vaults": out})
+	case "POST":
+		var req struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Path) == "" {
+			apierror.Write(w, http.StatusBadRequest, "path is required")
+			return
+		}
+		dir, err := expandVaultPath(req.Path)
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vaultMu.Lock()
+		defer vaultMu.Unlock()
+		if err := initVaultDir(dir); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		entry, err := registerVault(dir, req.Name, false)
+		if err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(entry)
+	case "DELETE":
+		dir, err := expandVaultPath(r.URL.Query().Get("path"))
+		if err != nil {
+			apierror.Write(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vaultMu.Lock()
+		defer vaultMu.Unlock()
+		if dir == currentVault {
+			apierror.Write(w, http.StatusConflict, "cannot forget the open vault")
+			return
+		}
+		reg := loadVaultRegistry()
+		kept := reg.Vaults[:0]
+		for _, v := range reg.Vaults {
+			if v.Path != dir {
+				kept = append(kept, v)
+			}
+		}
+		reg.Vaults = kept
+		if err := saveVaultRegistry(reg); err != nil {
+			apierror.Internal(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// POST /api/vaults/open {name} switches the server to a registered vault
+func handleVaultOpen(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		apierror.Write(w, http.StatusForbidden, "only admins can switch vaults")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		apierror.Write(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	var dir string
+	for _, v := range loadVaultRegistry().Vaults {
+		if v.Name == req.Name {
+			dir = v.Path
+			break
+		}
+	}
+	if dir == "" {
+		apierror.Write(w, http.StatusNotFound, "vault not found")
+		return
+	}
+	dir, err := expandVaultPath(dir)
+	if err != nil {
+		apierror.Write(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, vaultDBName)); err != nil {
+		apierror.Write(w, http.StatusNotFound, "no vault at "+dir)
+		return
+	}
+
+	vaultMu.Lock()
+	defer vaultMu.Unlock()
+	if err := openVault(dir); err != nil {
+		apierror.Internal(w, r, err)
+		return
+	}
+	entry, _ := lookupVault(dir)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// initVaultDir creates dir with a migrated database unless one exists
+func initVaultDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	database, err := openDB(filepath.Join(dir, vaultDBName))
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+	return applyMigrations(database)
+}
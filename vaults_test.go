@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVaultRegistryAndSwitching(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "vaults-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	t.Setenv("VEIL_VAULTS_FILE", filepath.Join(tmp, "config", "vaults.json"))
+
+	first := filepath.Join(tmp, "first")
+	if err := openVault(first); err != nil {
+		t.Fatalf("openVault: %v", err)
+	}
+	defer func() { db.Close() }()
+
+	mux := setupRoutes()
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, path, bytes.NewReader(b)))
+		return rr
+	}
+	countNodes := func() int {
+		var nodes []Node
+		json.NewDecoder(do("GET", "/api/nodes", nil).Body).Decode(&nodes)
+		return len(nodes)
+	}
+
+	do("POST", "/api/node-create", map[string]string{"type": "note", "path": "a.md", "title": "A"})
+	if countNodes() != 1 {
+		t.Fatalf("expected node in first vault")
+	}
+
+	second := filepath.Join(tmp, "second")
+	if rr := do("POST", "/api/vaults", map[string]string{"name": "Work", "path": second}); rr.Code != http.StatusCreated {
+		t.Fatalf("create vault: %d %s", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(second, "veil.db")); err != nil {
+		t.Fatalf("expected vault database to be created: %v", err)
+	}
+
+	if rr := do("POST", "/api/vaults/open", map[string]string{"name": "Work"}); rr.Code != http.StatusOK {
+		t.Fatalf("open vault: %d %s", rr.Code, rr.Body.String())
+	}
+	if countNodes() != 0 {
+		t.Fatalf("expected empty second vault")
+	}
+	if cwd, _ := os.Getwd(); cwd != second {
+		t.Fatalf("expected working directory %s, got %s", second, cwd)
+	}
+
+	var list struct {
+		Current string                   `json:"current"`
+		Vaults  []map[string]interface{} `json:"vaults"`
+	}
+	json.NewDecoder(do("GET", "/api/vaults", nil).Body).Decode(&list)
+	if list.Current != second || len(list.Vaults) != 2 || list.Vaults[0]["name"] != "Work" || list.Vaults[0]["current"] != true {
+		t.Fatalf("unexpected vault list: %+v", list)
+	}
+	if lastOpenedVault() != second {
+		t.Fatalf("expected last opened vault to be %s", second)
+	}
+
+	if rr := do("DELETE", "/api/vaults?path="+second, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("expected forgetting the open vault to conflict, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/vaults/open", map[string]string{"name": "first"}); rr.Code != http.StatusOK {
+		t.Fatalf("reopen first vault: %d", rr.Code)
+	}
+	if countNodes() != 1 {
+		t.Fatalf("expected first vault's node after switching back")
+	}
+	if rr := do("DELETE", "/api/vaults?path="+second, nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("forget vault: %d", rr.Code)
+	}
+	if rr := do("POST", "/api/vaults/open", map[string]string{"name": "Missing"}); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for missing vault, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/vaults/open", map[string]string{"path": first}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a path instead of a registered name, got %d", rr.Code)
+	}
+	if rr := do("POST", "/api/vaults/open", "{"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a malformed body, got %d", rr.Code)
+	}
+}
+
+func TestVaultsNeedAdmin(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	t.Setenv("VEIL_VAULTS_FILE", filepath.Join(t.TempDir(), "vaults.json"))
+
+	h := requireAuth(setupRoutes())
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	login := func(user string) string {
+		var out struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(do("POST", "/api/auth/login", "", map[string]string{"username": user, "password": "correct horse"}).Body).Decode(&out)
+		return out.Token
+	}
+	do("POST", "/api/auth/register", "", map[string]string{"username": "ada", "password": "correct horse"})
+	ada := login("ada")
+	do("POST", "/api/auth/register", ada, map[string]string{"username": "bob", "password": "correct horse"})
+	bob := login("bob")
+
+	for _, c := range []struct{ method, path string }{
+		{"GET", "/api/vaults"}, {"POST", "/api/vaults"}, {"DELETE", "/api/vaults?path=/tmp"}, {"POST", "/api/vaults/open"},
+	} {
+		if rr := do(c.method, c.path, bob, map[string]string{"name": "x", "path": "/tmp/x"}); rr.Code != http.StatusForbidden {
+			t.Fatalf("%s %s by a non-admin: %d", c.method, c.path, rr.Code)
+		}
+	}
+	if rr := do("GET", "/api/vaults", ada, nil); rr.Code != http.StatusOK {
+		t.Fatalf("an admin lists vaults: %d", rr.Code)
+	}
+}
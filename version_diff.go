@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"veil/pkg/apierror"
+)
+
+// === Version Diffs ===
+// GET /api/versions/diff?from=&to= compares the content of two versions of a
+// node line by line, so the UI can show what changed between revisions
+// rather than two whole snapshots. &words=true also diffs the words of each
+// changed line against the line that replaced it, and &context=N keeps only
+// the unchanged lines within N lines of a change.
+
+// maxVersionDiffLines bounds the diff; the comparison takes memory in the
+// product of the two line counts
+const maxVersionDiffLines = 5000
+
+// DiffLine is a line of a version diff. Op is "=" for a line both versions
+// have, "-" for one only the from version has and "+" for one only the to
+// version has. Old and New are its 1-based line numbers in each version.
+type DiffLine struct {
+	Op    string     `json:"op"`
+	Old   int        `json:"old,omitempty"`
+	New   int        `json:"new,omitempty"`
+	Text  string     `json:"text"`
+	Words []DiffWord `json:"words,omitempty"`
+}
+
+// DiffWord is a run of a changed line: "=" where it matches the line it is
+// paired with, "-" or "+" where it differs
+type DiffWord struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// VersionRef identifies a side of a diff
+type VersionRef struct {
+	ID            string    `json:"id"`
+	VersionNumber int       `json:"version_number"`
+	Title         string    `json:"title"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// VersionDiff is the change from one version of a node to another
+type VersionDiff struct {
+	NodeID  string     `json:"node_id"`
+	From    VersionRef `json:"from"`
+	To      VersionRef `json:"to"`
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Lines   []DiffLine `json:"lines"`
+}
+
+// diffStep is a step of an alignment: '=' keeps a[A] as b[B], '-' drops a[A]
+// and '+' adds b[B]
+type diffStep struct {
+	op   byte
+	A, B int
+}
+
+// diffSeq aligns a with b along their longest common subsequence
+func diffSeq(a, b []string) []diffStep {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var steps []diffStep
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[i] == b[j]:
+			steps = append(steps, diffStep{'=', i, j})
+			i++
+			j++
+		case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+			steps = append(steps, diffStep{'-', i, j})
+			i++
+		default:
+			steps = append(steps, diffStep{'+', i, j})
+			j++
+		}
+	}
+	return steps
+}
+
+// splitLines splits content into lines; a final newline doesn't start
+// another line
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines is the line diff from a to b, with stats
+func diffLines(a, b string) (lines []DiffLine, added, removed int) {
+	al, bl := splitLines(a), splitLines(b)
+	lines = []DiffLine{}
+	for _, s := range diffSeq(al, bl) {
+		switch s.op {
+		case '=':
+			lines = append(lines, DiffLine{Op: "=", Old: s.A + 1, New: s.B + 1, Text: al[s.A]})
+		case '-':
+			lines = append(lines, DiffLine{Op: "-", Old: s.A + 1, Text: al[s.A]})
+			removed++
+		case '+':
+			lines = append(lines, DiffLine{Op: "+", New: s.B + 1, Text: bl[s.B]})
+			added++
+		}
+	}
+	return lines, added, removed
+}
+
+// diffToken splits a line into words, spaces and punctuation, which together
+// make up the whole line
+var diffToken = regexp.MustCompile(`[\p{L}\p{N}_]+|\s+|[^\p{L}\p{N}_\s]+`)
+
+// diffWords is the word diff of a changed line against its replacement, for
+// each of the two lines
+func diffWords(a, b string) (from, to []DiffWord) {
+	at, bt := diffToken.FindAllString(a, -1), diffToken.FindAllString(b, -1)
+	add := func(words []DiffWord, op, text string) []DiffWord {
+		if n := len(words); n > 0 && words[n-1].Op == op {
+			words[n-1].Text += text
+			return words
+		}
+		return append(words, DiffWord{Op: op, Text: text})
+	}
+	for _, s := range diffSeq(at, bt) {
+		switch s.op {
+		case '=':
+			from = add(from, "=", at[s.A])
+			to = add(to, "=", bt[s.B])
+		case '-':
+			from = add(from, "-", at[s.A])
+		case '+':
+			to = add(to, "+", bt[s.B])
+		}
+	}
+	return from, to
+}
+
+// addWordDiffs pairs each run of removed lines with the added lines that
+// follow it, first with first, and diffs the words of each pair
+func addWordDiffs(lines []DiffLine) {
+	for i := 0; i < len(lines); {
+		if lines[i].Op != "-" {
+			i++
+			continue
+		}
+		start := i
+		for i < len(lines) && lines[i].Op == "-" {
+			i++
+		}
+		removed := i - start
+		for k := 0; k < removed && i+k < len(lines) && lines[i+k].Op == "+"; k++ {
+			lines[start+k].Words, lines[i+k].Words = diffWords(lines[start+k].Text, lines[i+k].Text)
+		}
+	}
+}
+
+// withContext keeps the changed lines and the unchanged lines within n
+// lines of one
+func withContext(lines []DiffLine, n int) []DiffLine {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Op == "=" {
+			continue
+		}
+		for j := max(0, i-n); j <= min(len(lines)-1, i+n); j++ {
+			keep[j] = true
+		}
+	}
+	out := []DiffLine{}
+	for i, l := range lines {
+		if keep[i] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// loadVersion reads a version for diffing, with its node and content
+func loadVersion(id string) (ref VersionRef, nodeID, content string, err error) {
+	var created int64
+	err = db.QueryRow(`SELECT id, node_id, version_number, COALESCE(title, ''), COALESCE(content, ''), created_at FROM versions WHERE id = ?`, id).
+		Scan(&ref.ID, &nodeID, &ref.VersionNumber, &ref.Title, &content, &created)
+	ref.CreatedAt = time.Unix(created, 0)
+	return ref, nodeID, content, err
+}
+
+// GET /api/versions/diff?from=&to=[&words=true][&context=N]
+func handleVersionDiff(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	context := -1
+	if c := q.Get("context"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 0 {
+			apierror.Write(w, http.StatusBadRequest, "context must be a number of lines")
+			return
+		}
+		context = n
+	}
+	from, fromNode, a, err := loadVersion(q.Get("from"))
+	if err != nil || !canReadNode(r, fromNode) {
+		apierror.Write(w, http.StatusNotFound, "from version not found")
+		return
+	}
+	to, toNode, b, err := loadVersion(q.Get("to"))
+	if err != nil || !canReadNode(r, toNode) {
+		apierror.Write(w, http.StatusNotFound, "to version not found")
+		return
+	}
+	if fromNode != toNode {
+		apierror.Write(w, http.StatusBadRequest, "versions belong to different nodes")
+		return
+	}
+	if strings.Count(a, "\n") >= maxVersionDiffLines || strings.Count(b, "\n") >= maxVersionDiffLines {
+		apierror.Write(w, http.StatusRequestEntityTooLarge, "versions over "+strconv.Itoa(maxVersionDiffLines)+" lines are too long to diff")
+		return
+	}
+
+	diff := VersionDiff{NodeID: fromNode, From: from, To: to}
+	diff.Lines, diff.Added, diff.Removed = diffLines(a, b)
+	if q.Get("words") == "true" {
+		addWordDiffs(diff.Lines)
+	}
+	if context >= 0 {
+		diff.Lines = withContext(diff.Lines, context)
+	}
+	json.NewEncoder(w).Encode(diff)
+}
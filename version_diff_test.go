@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionDiff(t *testing.T) {
+	testDB, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	mux := setupRoutes()
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+	testDB.Exec(`INSERT INTO nodes (id, type, path, title, content, created_at, modified_at) VALUES
+		('n1', 'note', 'n1.md', 'Plan', '', 1, 1), ('n2', 'note', 'n2.md', 'Other', '', 1, 1)`)
+	testDB.Exec(`INSERT INTO versions (id, node_id, version_number, content, title, created_at, modified_at) VALUES
+		('v1', 'n1', 1, ?, 'Plan', 1, 1), ('v2', 'n1', 2, ?, 'Plan v2', 2, 2), ('v3', 'n2', 1, '', 'Other', 1, 1)`,
+		"one\ntwo\nthe quick fox\nfour\nfive\nsix\n", "one\ntwo\nthe slow fox\nfour\nfive\nsix\nseven\n")
+
+	rr := get("/api/versions/diff?from=v1&to=v2&words=true")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("diff: %d %s", rr.Code, rr.Body.String())
+	}
+	var diff VersionDiff
+	json.NewDecoder(rr.Body).Decode(&diff)
+	if diff.NodeID != "n1" || diff.From.VersionNumber != 1 || diff.To.Title != "Plan v2" || diff.Added != 2 || diff.Removed != 1 || len(diff.Lines) != 8 {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
+	removed, added := diff.Lines[2], diff.Lines[3]
+	if removed.Op != "-" || removed.Old != 3 || added.Op != "+" || added.New != 3 || added.Text != "the slow fox" {
+		t.Fatalf("unexpected changed lines: %+v %+v", removed, added)
+	}
+	if len(added.Words) != 3 || added.Words[0] != (DiffWord{"=", "the "}) || added.Words[1] != (DiffWord{"+", "slow"}) || removed.Words[1] != (DiffWord{"-", "quick"}) {
+		t.Fatalf("unexpected word diff: %+v / %+v", removed.Words, added.Words)
+	}
+	if last := diff.Lines[7]; last.Op != "+" || last.New != 7 || last.Text != "seven" || last.Words != nil {
+		t.Fatalf("an added line without a removed one has no word diff: %+v", last)
+	}
+
+	var near VersionDiff
+	json.NewDecoder(get("/api/versions/diff?from=v1&to=v2&context=1").Body).Decode(&near)
+	if len(near.Lines) != 6 || near.Lines[0].Old != 2 || near.Lines[3].Old != 4 || near.Lines[4].Old != 6 || near.Lines[2].Words != nil {
+		t.Fatalf("context 1 should keep two, the change, four, then six and seven: %+v", near.Lines)
+	}
+
+	for path, code := range map[string]int{
+		"/api/versions/diff?from=v1&to=v3":           http.StatusBadRequest,
+		"/api/versions/diff?from=v1&to=nope":         http.StatusNotFound,
+		"/api/versions/diff?from=v1&to=v2&context=x": http.StatusBadRequest,
+	} {
+		if rr := get(path); rr.Code != code {
+			t.Fatalf("%s: expected %d, got %d", path, code, rr.Code)
+		}
+	}
+}
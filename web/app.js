@@ -32,9 +32,93 @@ document.addEventListener('DOMContentLoaded', async () => {
     await loadSites();
     await loadNodes();
     restoreSettings();
+    connectLiveUpdates();
     console.log('✓ Veil initialized');
 });
 
+// ====== LIVE UPDATES ======
+// Server events arrive over /ws; node changes refresh the list and every
+// event is re-dispatched on document as 'veil:event' for other panels.
+let liveSocket = null;
+let liveRetryDelay = 1000;
+
+function connectLiveUpdates() {
+    if (!('WebSocket' in window)) return;
+    const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    liveSocket = new WebSocket(`${proto}//${location.host}/ws`);
+    liveSocket.onopen = () => { liveRetryDelay = 1000; };
+    liveSocket.onmessage = (msg) => {
+        let ev;
+        try { ev = JSON.parse(msg.data); } catch (e) { return; }
+        document.dispatchEvent(new CustomEvent('veil:event', { detail: ev }));
+        if (ev.type && ev.type.startsWith('node.')) {
+            refreshNodesSoon();
+        } else if (ev.type === 'reminder.due' && ev.data) {
+            console.info('Reminder due:', ev.data.title);
+        }
+    };
+    liveSocket.onclose = () => {
+        // back off up to a minute while the server is away
+        setTimeout(connectLiveUpdates, liveRetryDelay);
+        liveRetryDelay = Math.min(liveRetryDelay * 2, 60000);
+    };
+}
+
+const refreshNodesSoon = debounce(() => loadNodes(), 300);
+
+// ====== PRESENCE ======
+// Each tab heartbeats the node it is on over the socket (or /api/presence
+// when the socket is down) and warns when another client edits the same node.
+const presenceClientId = (crypto.randomUUID && crypto.randomUUID()) || `tab-${Date.now()}-${Math.random().toString(36).slice(2)}`;
+let presenceState = 'viewing';
+let presenceEditingUntil = 0;
+const presenceOthers = new Map();
+
+function sendPresence() {
+    if (!currentNode) return;
+    if (presenceState === 'editing' && Date.now() > presenceEditingUntil) presenceState = 'viewing';
+    const beat = { client_id: presenceClientId, node_id: currentNode.id, state: presenceState };
+    const editor = document.getElementById('editor');
+    if (editor) {
+        const before = editor.value.slice(0, editor.selectionStart).split('\n');
+        beat.cursor = { line: before.length - 1, column: before[before.length - 1].length };
+        if (editor.selectionEnd !== editor.selectionStart) beat.cursor.selection_end = editor.selectionEnd;
+    }
+    if (liveSocket && liveSocket.readyState === WebSocket.OPEN) {
+        liveSocket.send(JSON.stringify({ type: 'presence', ...beat }));
+    } else {
+        fetch('/api/presence', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: JSON.stringify(beat) }).catch(() => {});
+    }
+}
+
+function markEditing() {
+    const was = presenceState;
+    presenceState = 'editing';
+    presenceEditingUntil = Date.now() + 30000;
+    if (was !== 'editing') sendPresence();
+}
+
+function updatePresenceWarning() {
+    const editors = [...presenceOthers.values()].filter(p => currentNode && p.node_id === currentNode.id && p.state === 'editing');
+    if (editors.length) {
+        const names = editors.map(p => p.username || 'someone').join(', ');
+        showStatusBadge(`Also editing: ${names}`, 'yellow');
+    }
+}
+
+document.addEventListener('veil:event', (e) => {
+    const ev = e.detail;
+    if (!ev.data || ev.data.client_id === presenceClientId) return;
+    if (ev.type === 'presence.updated') {
+        presenceOthers.set(ev.data.client_id, ev.data);
+        updatePresenceWarning();
+    } else if (ev.type === 'presence.left') {
+        presenceOthers.delete(ev.data.client_id);
+    }
+});
+
+setInterval(sendPresence, 15000);
+
 // ====== EVENT SETUP ======
 function setupEventListeners() {
     // Sidebar
@@ -50,6 +134,7 @@ function setupEventListeners() {
     document.getElementById('exportSiteBtn')?.addEventListener('click', exportCurrentSite);
     
     // Editor
+    document.getElementById('editor')?.addEventListener('input', () => markEditing());
     document.getElementById('editor')?.addEventListener('input', debounce(() => {
         if (currentNode) {
             currentNode.title = document.getElementById('editor').value.split('\n')[0] || 'Untitled';
@@ -185,7 +270,7 @@ async function createNewSite() {
         if (!resp.ok) {
             const errBody = await resp.json().catch(() => ({ error: resp.statusText }));
             console.error('Create site failed:', resp.status, errBody);
-            alert('Failed to create site: ' + (errBody.error || resp.statusText));
+            alert('Failed to create site: ' + apiErrorMessage(errBody, resp.statusText));
             return;
         }
 
@@ -300,6 +385,8 @@ async function openNode(nodeId) {
         updateWordCount();
         loadReferences();
         loadNodeURIs();
+        presenceState = 'viewing';
+        sendPresence();
         
         renderNodesList();
     } catch (e) {
@@ -341,7 +428,7 @@ async function createNewNote() {
                     return await tryCreate(uniqueTitle, 2);
                 }
 
-                alert('Failed to create note: ' + (errBody.error || resp.statusText));
+                alert('Failed to create note: ' + apiErrorMessage(errBody, resp.statusText));
                 return;
             }
 
@@ -1117,7 +1204,7 @@ async function uploadMedia() {
             loadMediaLibrary();
             fileInput.value = '';
         } else {
-            alert('Upload failed: ' + (data.error || 'Unknown error'));
+            alert('Upload failed: ' + apiErrorMessage(data, 'Unknown error'));
         }
     } catch (err) {
         alert('Upload error: ' + err.message);
@@ -1139,7 +1226,7 @@ async function loadMediaLibrary() {
             const isImage = m.mime_type && m.mime_type.startsWith('image/');
             return `
                 <div class="media-item border border-slate-200 rounded-lg p-2 hover:border-indigo-500 cursor-pointer transition" data-media-id="${m.id}" data-media-url="${m.url}" data-media-filename="${m.filename}" onclick="insertMediaIntoEditor('${m.url}', '${m.filename}')" oncontextmenu="showMediaContextMenu(event, '${m.id}')">
-                    ${isImage ? `<img src="${m.url}" alt="${m.filename}" class="w-full h-24 object-cover rounded mb-1">` : `<div class="w-full h-24 bg-slate-100 rounded mb-1 flex items-center justify-center"><i class="fas fa-file text-3xl text-slate-400"></i></div>`}
+                    ${isImage ? `<img src="${m.thumbnail_url || m.url}" alt="${m.filename}" class="w-full h-24 object-cover rounded mb-1">` : `<div class="w-full h-24 bg-slate-100 rounded mb-1 flex items-center justify-center"><i class="fas fa-file text-3xl text-slate-400"></i></div>`}
                     <p class="text-xs text-slate-600 truncate" title="${m.filename}">${m.filename}</p>
                     <p class="text-xs text-slate-400">${formatFileSize(m.size)}</p>
                 </div>
@@ -1443,7 +1530,7 @@ function openMediaUpload() {
                 editor.dispatchEvent(new Event('input'));
                 showToast('Media uploaded successfully');
             } else {
-                showToast('Upload failed: ' + (data.error || 'Unknown error'), 'error');
+                showToast('Upload failed: ' + apiErrorMessage(data, 'Unknown error'), 'error');
             }
         } catch (err) {
             console.error('Upload error:', err);
@@ -2007,7 +2094,7 @@ async function executeTerminalAction() {
         if (response.ok && result) {
             displayTerminalResult(result);
         } else {
-            outputEl.innerHTML = `<div class="text-red-400">Error: ${result?.error || 'Unknown error'}</div>`;
+            outputEl.innerHTML = `<div class="text-red-400">Error: ${escapeHtml(apiErrorMessage(result, 'Unknown error'))}</div>`;
         }
 
     } catch (error) {
@@ -2061,6 +2148,14 @@ function displayTerminalResult(result) {
     }
 }
 
+// apiErrorMessage reads the message of an API error body,
+// {"error": {"code", "message"}}, or returns fallback
+function apiErrorMessage(body, fallback) {
+    const err = body && body.error;
+    if (!err) return fallback;
+    return typeof err === 'string' ? err : (err.message || err.code || fallback);
+}
+
 function escapeHtml(text) {
     const div = document.createElement('div');
     div.textContent = text;
@@ -0,0 +1,65 @@
+// Runs the fragment shader of a shader node's page. The page carries the
+// source as JSON in #node-content and a #shaderCanvas to draw on. Shaders get
+// the same inputs as the shader plugin: uniform float time, uniform vec2
+// resolution and varying vec2 vUv. The running demo is window.veilShader so
+// a node's own scripts can change it.
+(function () {
+    const data = JSON.parse(document.getElementById('node-content')?.textContent || '{}');
+    const canvas = document.getElementById('shaderCanvas');
+    const gl = canvas && canvas.getContext('webgl');
+    if (!gl || !data.fragment) return;
+
+    const vertexSource = `
+attribute vec2 position;
+varying vec2 vUv;
+void main() {
+    vUv = position * 0.5 + 0.5;
+    gl_Position = vec4(position, 0.0, 1.0);
+}`;
+
+    function compile(type, source) {
+        const shader = gl.createShader(type);
+        gl.shaderSource(shader, source);
+        gl.compileShader(shader);
+        if (!gl.getShaderParameter(shader, gl.COMPILE_STATUS)) {
+            const log = gl.getShaderInfoLog(shader);
+            const pre = document.createElement('pre');
+            pre.textContent = log;
+            canvas.after(pre);
+            throw new Error(log);
+        }
+        return shader;
+    }
+
+    const program = gl.createProgram();
+    gl.attachShader(program, compile(gl.VERTEX_SHADER, vertexSource));
+    gl.attachShader(program, compile(gl.FRAGMENT_SHADER, data.fragment));
+    gl.linkProgram(program);
+    gl.useProgram(program);
+
+    const buffer = gl.createBuffer();
+    gl.bindBuffer(gl.ARRAY_BUFFER, buffer);
+    gl.bufferData(gl.ARRAY_BUFFER, new Float32Array([-1, -1, 1, -1, -1, 1, 1, 1]), gl.STATIC_DRAW);
+    const position = gl.getAttribLocation(program, 'position');
+    gl.enableVertexAttribArray(position);
+    gl.vertexAttribPointer(position, 2, gl.FLOAT, false, 0, 0);
+
+    const timeLoc = gl.getUniformLocation(program, 'time');
+    const resolutionLoc = gl.getUniformLocation(program, 'resolution');
+    const demo = { gl, program, playing: true, time: 0 };
+    window.veilShader = demo;
+
+    let last = performance.now();
+    function frame(now) {
+        if (demo.playing) demo.time += (now - last) / 1000;
+        last = now;
+        canvas.width = canvas.clientWidth;
+        canvas.height = canvas.clientHeight;
+        gl.viewport(0, 0, canvas.width, canvas.height);
+        gl.uniform1f(timeLoc, demo.time);
+        gl.uniform2f(resolutionLoc, canvas.width, canvas.height);
+        gl.drawArrays(gl.TRIANGLE_STRIP, 0, 4);
+        requestAnimationFrame(frame);
+    }
+    requestAnimationFrame(frame);
+})();
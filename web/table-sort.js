@@ -0,0 +1,45 @@
+// Sorts the tables of a table node's page. Every table[data-sortable] gets a
+// button in each column header; clicking it sorts the rows by that column,
+// then again in reverse. A header's data-type (number, date, bool or text)
+// says how its cells compare; empty cells always go last.
+(function () {
+    function value(type, text) {
+        if (text === '') return null;
+        switch (type) {
+        case 'number': return parseFloat(text);
+        case 'date': return Date.parse(text);
+        case 'bool': return text === 'true' || text === '1' || text === 'TRUE' ? 1 : 0;
+        default: return text;
+        }
+    }
+
+    function compare(a, b) {
+        if (typeof a === 'string') return a.localeCompare(b, undefined, { numeric: true, sensitivity: 'base' });
+        return a - b;
+    }
+
+    function sortBy(table, th, index) {
+        const ascending = th.getAttribute('aria-sort') !== 'ascending';
+        const type = th.dataset.type || 'text';
+        const body = table.tBodies[0];
+        const rows = Array.from(body.rows).map(row => ({ row, v: value(type, row.cells[index].textContent.trim()) }));
+        rows.sort((x, y) => {
+            if (x.v === null || y.v === null) return (x.v === null) - (y.v === null);
+            return ascending ? compare(x.v, y.v) : compare(y.v, x.v);
+        });
+        rows.forEach(({ row }) => body.appendChild(row));
+        for (const other of table.tHead.rows[0].cells) other.removeAttribute('aria-sort');
+        th.setAttribute('aria-sort', ascending ? 'ascending' : 'descending');
+    }
+
+    for (const table of document.querySelectorAll('table[data-sortable]')) {
+        if (!table.tHead || !table.tBodies.length) continue;
+        Array.from(table.tHead.rows[0].cells).forEach((th, index) => {
+            const button = document.createElement('button');
+            button.type = 'button';
+            button.append(...th.childNodes);
+            button.addEventListener('click', () => sortBy(table, th, index));
+            th.appendChild(button);
+        });
+    }
+})();
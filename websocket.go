@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"veil/pkg/apierror"
+	codexpkg "veil/pkg/codex"
+	"veil/pkg/events"
+)
+
+// === Live Updates ===
+// /ws upgrades to a WebSocket and streams events from the bus as JSON text
+// frames: {id, type, time, data}. ?types=node.*,codex.commit limits what is
+// sent. Node and presence events are only sent to clients that may read the
+// node, and notification events only to their recipient. The connection is pinged every wsPingInterval. Clients may send
+// presence heartbeats as text frames, {"type":"presence", client_id, node_id,
+// state, cursor}; those clients leave when the socket closes. Other messages
+// are ignored.
+
+const (
+	wsGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	wsMaxFrame     = 64 << 10
+	wsBuffer       = 64
+)
+
+// wsConnSeq numbers connections so presence can be dropped with them
+var wsConnSeq uint64
+
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+	// wsHangup is an internal marker: the client connection is gone
+	wsHangup = 0xFF
+)
+
+// commitEvents announces every commit the server stores
+type commitEvents struct {
+	codexpkg.Storage
+}
+
+func (s commitEvents) PutCommit(c *codexpkg.Commit) error {
+	if err := s.Storage.PutCommit(c); err != nil {
+		return err
+	}
+	events.Publish(events.CodexCommit, map[string]interface{}{
+		"hash": c.Hash, "parents": c.Parents, "author": c.Author, "message": c.Message, "objects": len(c.Objects),
+	})
+	return nil
+}
+
+// publishNodeEvent announces a node change
+func publishNodeEvent(typ string, node Node) {
+	events.Publish(typ, map[string]interface{}{
+		"id": node.ID, "type": node.Type, "path": node.Path, "title": node.Title, "site_id": node.SiteID,
+	})
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if authEnabled() && currentUser(r) == nil {
+		w.Header().Set("Content-Type", "application/json")
+		apierror.Write(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	// cookies ride along on cross-site WebSocket requests, so only accept
+	// browser connections from the same host
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		w.Header().Set("Content-Type", "application/json")
+		apierror.Write(w, http.StatusBadRequest, "WebSocket upgrade required")
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var filters []string
+	if t := r.URL.Query().Get("types"); t != "" {
+		filters = strings.Split(t, ",")
+	}
+	sub := events.Subscribe(wsBuffer, filters...)
+	defer sub.Close()
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// server timeouts set before the hijack would end a quiet connection
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	// the reader answers pings and notices when the client goes away;
+	// replies go through out so only this goroutine writes
+	out := make(chan wsFrame, 4)
+	stop := make(chan struct{})
+	defer close(stop)
+	connID := atomic.AddUint64(&wsConnSeq, 1)
+	defer presence.dropConn(connID)
+	go wsReadLoop(rw.Reader, out, stop, func(msg []byte) {
+		var m struct {
+			Type string `json:"type"`
+			Presence
+		}
+		if json.Unmarshal(msg, &m) == nil && m.Type == "presence" {
+			presenceHeartbeat(r, m.Presence, connID)
+		}
+	})
+
+	canRead := nodeReadFilter(r)
+	userID := currentUserID(r)
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		var f wsFrame
+		select {
+		case f = <-out:
+			if f.op == wsHangup {
+				return
+			}
+		case <-ping.C:
+			f = wsFrame{op: wsOpPing}
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if !wsMayReceive(canRead, userID, ev) {
+				continue
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			f = wsFrame{op: wsOpText, payload: b}
+		}
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := wsWriteFrame(conn, f); err != nil || f.op == wsOpClose {
+			return
+		}
+	}
+}
+
+// wsMayReceive hides node and presence events for nodes the client cannot
+// read, and other users' notifications
+func wsMayReceive(canRead func(siteID, visibility string) bool, userID string, ev events.Event) bool {
+	key := "id"
+	switch {
+	case strings.HasPrefix(ev.Type, "notification."):
+		data, _ := ev.Data.(map[string]interface{})
+		to, _ := data["user_id"].(string)
+		return to == "" || to == userID
+	case strings.HasPrefix(ev.Type, "presence."):
+		key = "node_id"
+	case !strings.HasPrefix(ev.Type, "node."):
+		return true
+	}
+	data, _ := ev.Data.(map[string]interface{})
+	id, _ := data[key].(string)
+	siteID, _, vis := nodeAccess(id)
+	if siteID == "" {
+		siteID, _ = data["site_id"].(string)
+	}
+	return canRead(siteID, vis)
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+// wsWriteFrame writes one unmasked, unfragmented server frame
+func wsWriteFrame(w io.Writer, f wsFrame) error {
+	header := []byte{0x80 | f.op, 0}
+	switch n := len(f.payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+var errWSProtocol = errors.New("websocket protocol error")
+
+// wsReadFrame reads one client frame, unmasking its payload
+func wsReadFrame(r *bufio.Reader) (wsFrame, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return wsFrame{}, err
+	}
+	f := wsFrame{op: h[0] & 0x0F}
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return f, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return f, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxFrame || !masked {
+		return f, errWSProtocol
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return f, err
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return f, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// wsReadLoop handles client frames until the connection ends, finishing
+// with a close frame to send or wsHangup when there is no one to answer.
+// Text messages go to onText.
+func wsReadLoop(r *bufio.Reader, out chan<- wsFrame, stop <-chan struct{}, onText func([]byte)) {
+	send := func(f wsFrame) {
+		select {
+		case out <- f:
+		case <-stop:
+		}
+	}
+	for {
+		f, err := wsReadFrame(r)
+		switch {
+		case errors.Is(err, errWSProtocol):
+			send(wsFrame{op: wsOpClose, payload: []byte{0x03, 0xEA}}) // 1002 protocol error
+			return
+		case err != nil:
+			send(wsFrame{op: wsHangup})
+			return
+		case f.op == wsOpPing:
+			send(wsFrame{op: wsOpPong, payload: f.payload})
+		case f.op == wsOpClose:
+			send(wsFrame{op: wsOpClose, payload: f.payload})
+			return
+		case f.op == wsOpText && onText != nil:
+			onText(f.payload)
+		}
+	}
+}
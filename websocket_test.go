@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"veil/pkg/events"
+)
+
+func TestWebSocketStreamsEvents(t *testing.T) {
+	_, cleanup := setupTestDB(t)
+	defer cleanup()
+	tmp, err := ioutil.TempDir("", "ws-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	wd, _ := os.Getwd()
+	os.Chdir(tmp)
+	defer os.Chdir(wd)
+
+	srv := httptest.NewServer(requireAuth(setupRoutes()))
+	defer srv.Close()
+
+	if resp, err := http.Get(srv.URL + "/ws"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("plain GET should be refused: %v %v", resp, err)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET /ws?types=node.*,codex.commit HTTP/1.1\r\nHost: " + strings.TrimPrefix(srv.URL, "http://") +
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake failed: %v %v", resp, err)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("bad accept key %q", got)
+	}
+	// wait for the subscription before publishing
+	for i := 0; events.Default.Subscribers() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events.Publish(events.JobProgress, map[string]interface{}{"id": "job_filtered"})
+	body := `{"type":"note","path":"live.md","title":"Live"}`
+	if resp, err := http.Post(srv.URL+"/api/node-create", "application/json", strings.NewReader(body)); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create node: %v %v", resp, err)
+	}
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		f, err := readServerFrame(br)
+		if err != nil {
+			t.Fatalf("reading frame (seen %v): %v", seen, err)
+		}
+		if f.op != wsOpText {
+			continue
+		}
+		var ev events.Event
+		json.Unmarshal(f.payload, &ev)
+		if ev.Type == events.JobProgress {
+			t.Fatalf("filtered event delivered: %s", f.payload)
+		}
+		seen[ev.Type] = true
+		if ev.Type == events.NodeCreated {
+			if data, _ := ev.Data.(map[string]interface{}); data["title"] != "Live" {
+				t.Fatalf("unexpected node event: %s", f.payload)
+			}
+		}
+	}
+	if !seen[events.NodeCreated] || !seen[events.CodexCommit] {
+		t.Fatalf("expected node and commit events, got %v", seen)
+	}
+
+	// a masked close frame is echoed back
+	conn.Write([]byte{0x88, 0x82, 1, 2, 3, 4, 0x03 ^ 1, 0xE8 ^ 2})
+	for {
+		f, err := readServerFrame(br)
+		if err != nil {
+			t.Fatalf("expected a close frame: %v", err)
+		}
+		if f.op == wsOpClose {
+			break
+		}
+	}
+}
+
+// readServerFrame reads an unmasked frame as a client would
+func readServerFrame(r *bufio.Reader) (wsFrame, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return wsFrame{}, err
+	}
+	n := int(h[1] & 0x7F)
+	if n == 126 {
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return wsFrame{}, err
+		}
+		n = int(binary.BigEndian.Uint16(b[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return wsFrame{}, err
+	}
+	return wsFrame{op: h[0] & 0x0F, payload: payload}, nil
+}